@@ -0,0 +1,226 @@
+// Writing query results in the Apache Arrow IPC streaming format.
+
+package gumshoe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ArrowStreamContentType is the content type of query results in the Arrow IPC streaming format.
+const ArrowStreamContentType = "application/vnd.apache.arrow.stream"
+
+type arrowType int
+
+const (
+	arrowInt64 arrowType = iota
+	arrowFloat64
+	arrowUtf8
+)
+
+// Constants from the Arrow IPC format (Schema.fbs and Message.fbs)
+const (
+	arrowMetadataV5 = 4
+
+	arrowHeaderSchema      = 1
+	arrowHeaderRecordBatch = 3
+
+	arrowTypeInt           = 2
+	arrowTypeFloatingPoint = 3
+	arrowTypeUtf8          = 5
+
+	arrowPrecisionDouble = 2
+)
+
+type arrowColumn struct {
+	name string
+	typ  arrowType
+}
+
+// arrowColumns returns the columns of query's results (see Query.ResultColumns) with their Arrow types.
+// Integral values are int64s and other numbers are float64s.
+func (s *Schema) arrowColumns(query *Query) []arrowColumn {
+	types := make(map[string]arrowType)
+	for _, grouping := range query.Groupings {
+		types[grouping.Name] = s.arrowColumnType(grouping.Column)
+	}
+	for _, lookup := range query.Lookups {
+		types[lookup.Name] = arrowUtf8
+	}
+	for _, aggregate := range query.Aggregates {
+		switch aggregate.Type {
+		case AggregateSum:
+			types[aggregate.Name] = s.arrowColumnType(aggregate.Column)
+		case AggregateDistinct:
+			types[aggregate.Name] = arrowInt64
+		default: // averages, rates, and percentiles
+			types[aggregate.Name] = arrowFloat64
+		}
+	}
+	types["rowCount"] = arrowInt64
+	for _, expression := range query.Expressions {
+		types[expression.Name] = arrowFloat64
+	}
+	for _, window := range query.Windows {
+		types[window.Name] = arrowFloat64
+	}
+	var columns []arrowColumn
+	for _, name := range query.ResultColumns() {
+		columns = append(columns, arrowColumn{name, types[name]})
+	}
+	return columns
+}
+
+// arrowColumnType returns the Arrow type of the values of the named column of s.
+func (s *Schema) arrowColumnType(name string) arrowType {
+	var typ Type
+	if i, ok := s.DimensionNameToIndex[name]; ok {
+		if s.DimensionColumns[i].String {
+			return arrowUtf8
+		}
+		typ = s.DimensionColumns[i].Type
+	} else if i, ok := s.MetricNameToIndex[name]; ok {
+		typ = s.MetricColumns[i].Type
+	} else {
+		return arrowInt64 // The timestamp column
+	}
+	if typ == TypeFloat32 || typ == TypeFloat64 {
+		return arrowFloat64
+	}
+	return arrowInt64
+}
+
+// WriteArrowRows writes rows, the results of query, to w as an Arrow IPC stream: a schema and a single
+// record batch. Null values are marked as such in the validity bitmaps.
+func (s *Schema) WriteArrowRows(w io.Writer, rows []RowMap, query *Query) error {
+	columns := s.arrowColumns(query)
+	if err := writeArrowMessage(w, arrowSchemaMessage(columns), nil); err != nil {
+		return err
+	}
+	metadata, body := arrowRecordBatchMessage(columns, rows)
+	if err := writeArrowMessage(w, metadata, body); err != nil {
+		return err
+	}
+	// End of stream
+	_, err := w.Write([]byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+	return err
+}
+
+// writeArrowMessage writes an encapsulated IPC message: a continuation marker, the metadata length, the
+// metadata (padded to a multiple of 8 bytes), and the body.
+func writeArrowMessage(w io.Writer, metadata, body []byte) error {
+	size := (len(metadata) + 7) &^ 7
+	buf := make([]byte, 8+size, 8+size+len(body))
+	binary.LittleEndian.PutUint32(buf, 0xffffffff)
+	binary.LittleEndian.PutUint32(buf[4:], uint32(size))
+	copy(buf[8:], metadata)
+	_, err := w.Write(append(buf, body...))
+	return err
+}
+
+func finishArrowMessage(b *fbBuilder, headerType uint8, header int, bodyLength int) []byte {
+	b.startTable(5)
+	b.addUint64(3, uint64(bodyLength))
+	b.addOffset(2, header)
+	b.addUint16(0, arrowMetadataV5)
+	b.addUint8(1, headerType)
+	return b.finish(b.endTable())
+}
+
+func arrowSchemaMessage(columns []arrowColumn) []byte {
+	b := new(fbBuilder)
+	fields := make([]int, len(columns))
+	for i, column := range columns {
+		name := b.createString(column.name)
+		var typeType uint8
+		switch column.typ {
+		case arrowInt64:
+			typeType = arrowTypeInt
+			b.startTable(2)
+			b.addUint32(0, 64) // bitWidth
+			b.addUint8(1, 1)   // is_signed
+		case arrowFloat64:
+			typeType = arrowTypeFloatingPoint
+			b.startTable(1)
+			b.addUint16(0, arrowPrecisionDouble)
+		case arrowUtf8:
+			typeType = arrowTypeUtf8
+			b.startTable(0)
+		}
+		typ := b.endTable()
+		children := b.createOffsetVector(nil)
+		b.startTable(7)
+		b.addOffset(0, name)
+		b.addOffset(3, typ)
+		b.addOffset(5, children)
+		b.addUint8(1, 1) // nullable
+		b.addUint8(2, typeType)
+		fields[i] = b.endTable()
+	}
+	fieldVector := b.createOffsetVector(fields)
+	b.startTable(4)
+	b.addOffset(1, fieldVector)
+	return finishArrowMessage(b, arrowHeaderSchema, b.endTable(), 0)
+}
+
+func arrowRecordBatchMessage(columns []arrowColumn, rows []RowMap) (metadata, body []byte) {
+	var nodes, buffers [][2]int64 // (length, null count) and (offset, length)
+	addBuffer := func(buf []byte) {
+		buffers = append(buffers, [2]int64{int64(len(body)), int64(len(buf))})
+		body = append(body, buf...)
+		for len(body)%8 != 0 {
+			body = append(body, 0)
+		}
+	}
+	n := len(rows)
+	for _, column := range columns {
+		validity := make([]byte, (n+7)/8)
+		var nulls int
+		var values, data []byte
+		if column.typ == arrowUtf8 {
+			values = make([]byte, 4*(n+1)) // Offsets into data
+		} else {
+			values = make([]byte, 8*n)
+		}
+		for i, row := range rows {
+			value := row[column.name]
+			if value != nil {
+				validity[i/8] |= 1 << uint(i%8)
+				switch column.typ {
+				case arrowInt64:
+					binary.LittleEndian.PutUint64(values[8*i:], uint64(UntypedToInt(value)))
+				case arrowFloat64:
+					binary.LittleEndian.PutUint64(values[8*i:], math.Float64bits(UntypedToFloat64(value)))
+				case arrowUtf8:
+					if s, ok := value.(string); ok {
+						data = append(data, s...)
+					} else {
+						data = append(data, fmt.Sprint(value)...)
+					}
+				}
+			} else {
+				nulls++
+			}
+			if column.typ == arrowUtf8 {
+				binary.LittleEndian.PutUint32(values[4*(i+1):], uint32(len(data)))
+			}
+		}
+		nodes = append(nodes, [2]int64{int64(n), int64(nulls)})
+		addBuffer(validity)
+		addBuffer(values)
+		if column.typ == arrowUtf8 {
+			addBuffer(data)
+		}
+	}
+
+	b := new(fbBuilder)
+	nodeVector := b.createStructVector(nodes)
+	bufferVector := b.createStructVector(buffers)
+	b.startTable(3)
+	b.addUint64(0, uint64(n))
+	b.addOffset(1, nodeVector)
+	b.addOffset(2, bufferVector)
+	return finishArrowMessage(b, arrowHeaderRecordBatch, b.endTable(), len(body)), body
+}
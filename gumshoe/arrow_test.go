@@ -0,0 +1,109 @@
+package gumshoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// fbTable reads fields from a FlatBuffers table at pos in buf.
+type fbTable struct {
+	buf []byte
+	pos int
+}
+
+func (t fbTable) field(i int) int {
+	vtable := t.pos - int(int32(binary.LittleEndian.Uint32(t.buf[t.pos:])))
+	if 4+2*i >= int(binary.LittleEndian.Uint16(t.buf[vtable:])) {
+		return 0
+	}
+	off := int(binary.LittleEndian.Uint16(t.buf[vtable+4+2*i:]))
+	if off == 0 {
+		return 0
+	}
+	return t.pos + off
+}
+
+func (t fbTable) deref(pos int) int { return pos + int(binary.LittleEndian.Uint32(t.buf[pos:])) }
+
+func (t fbTable) table(i int) fbTable { return fbTable{t.buf, t.deref(t.field(i))} }
+
+func (t fbTable) vectorLen(i int) int {
+	return int(binary.LittleEndian.Uint32(t.buf[t.deref(t.field(i)):]))
+}
+
+func (t fbTable) vectorTable(i, j int) fbTable {
+	elem := t.deref(t.field(i)) + 4 + 4*j
+	return fbTable{t.buf, t.deref(elem)}
+}
+
+func (t fbTable) str(i int) string {
+	pos := t.deref(t.field(i))
+	n := int(binary.LittleEndian.Uint32(t.buf[pos:]))
+	return string(t.buf[pos+4 : pos+4+n])
+}
+
+// readArrowMessage reads an encapsulated message from buf and returns its root table and body.
+func readArrowMessage(t *testing.T, buf *bytes.Buffer) (fbTable, []byte) {
+	header := buf.Next(8)
+	Assert(t, binary.LittleEndian.Uint32(header), Equals, uint32(0xffffffff))
+	size := int(binary.LittleEndian.Uint32(header[4:]))
+	Assert(t, size%8, Equals, 0)
+	metadata := buf.Next(size)
+	message := fbTable{metadata, int(binary.LittleEndian.Uint32(metadata))}
+	bodyLength := int(binary.LittleEndian.Uint64(metadata[message.field(3):]))
+	return message, buf.Next(bodyLength)
+}
+
+func TestWriteArrowRows(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	query.Aggregates = append(query.Aggregates, QueryAggregate{AggregateAvg, "metric1", "avgMetric1"})
+	rows := []RowMap{
+		{"dim1": "a", "metric1": uint64(3), "avgMetric1": 1.5, "rowCount": uint32(2)},
+		{"dim1": "bc", "metric1": uint64(0), "avgMetric1": nil, "rowCount": uint32(0)},
+	}
+	var buf bytes.Buffer
+	Assert(t, db.WriteArrowRows(&buf, rows, query), IsNil)
+
+	message, body := readArrowMessage(t, &buf)
+	Assert(t, message.buf[message.field(1)], Equals, byte(arrowHeaderSchema))
+	Assert(t, len(body), Equals, 0)
+	fields := message.table(2)
+	Assert(t, fields.vectorLen(1), Equals, 4)
+	var names []string
+	var types []byte
+	for i := 0; i < 4; i++ {
+		field := fields.vectorTable(1, i)
+		names = append(names, field.str(0))
+		types = append(types, field.buf[field.field(2)])
+	}
+	Assert(t, names, DeepEquals, []string{"dim1", "metric1", "avgMetric1", "rowCount"})
+	Assert(t, types, DeepEquals, []byte{arrowTypeUtf8, arrowTypeInt, arrowTypeFloatingPoint, arrowTypeInt})
+
+	message, body = readArrowMessage(t, &buf)
+	Assert(t, message.buf[message.field(1)], Equals, byte(arrowHeaderRecordBatch))
+	batch := message.table(2)
+	Assert(t, binary.LittleEndian.Uint64(batch.buf[batch.field(0):]), Equals, uint64(2))
+	// Buffers: dim1 validity, offsets, and data; metric1 validity and values; avgMetric1 validity and values;
+	// rowCount validity and values.
+	Assert(t, batch.vectorLen(2), Equals, 9)
+	buffer := func(i int) []byte {
+		pos := batch.deref(batch.field(2)) + 4 + 16*i
+		offset := binary.LittleEndian.Uint64(batch.buf[pos:])
+		length := binary.LittleEndian.Uint64(batch.buf[pos+8:])
+		Assert(t, offset%8, Equals, uint64(0))
+		return body[offset : offset+length]
+	}
+	Assert(t, string(buffer(2)), Equals, "abc")
+	Assert(t, binary.LittleEndian.Uint64(buffer(4)), Equals, uint64(3))
+	Assert(t, buffer(5)[0], Equals, byte(1)) // avgMetric1 is null in the second row
+	Assert(t, math.Float64frombits(binary.LittleEndian.Uint64(buffer(6))), Equals, 1.5)
+
+	Assert(t, buf.Bytes(), DeepEquals, []byte{0xff, 0xff, 0xff, 0xff, 0, 0, 0, 0})
+}
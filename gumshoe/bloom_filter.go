@@ -0,0 +1,220 @@
+// Bloom filters of the values of string dimensions in each segment, for skipping segments in scans.
+
+package gumshoe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"unsafe"
+)
+
+const (
+	bloomBitsPerValue = 10 // With bloomHashes, this gives a false positive rate of about 1%
+	bloomHashes       = 7
+	bloomMinWords     = 8 // Tiny filters have poor false positive rates, and a few bytes more are cheap
+)
+
+// A bloomFilter is a set of dimension table indexes which may have false positives.
+type bloomFilter struct {
+	Bits []uint64
+}
+
+func newBloomFilter(values map[uint32]struct{}) *bloomFilter {
+	words := (len(values)*bloomBitsPerValue + 63) / 64
+	if words < bloomMinWords {
+		words = bloomMinWords
+	}
+	f := &bloomFilter{Bits: make([]uint64, words)}
+	for v := range values {
+		f.add(v)
+	}
+	return f
+}
+
+// bloomHash returns two hashes of v for double hashing.
+func bloomHash(v uint32) (h1, h2 uint64) {
+	// splitmix64's finalizer.
+	x := uint64(v) + 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	x ^= x >> 31
+	return x, (x >> 32) | 1
+}
+
+func (f *bloomFilter) add(v uint32) {
+	h1, h2 := bloomHash(v)
+	n := uint64(len(f.Bits)) * 64
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % n
+		f.Bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+func (f *bloomFilter) mayContain(v uint32) bool {
+	h1, h2 := bloomHash(v)
+	n := uint64(len(f.Bits)) * 64
+	for i := uint64(0); i < bloomHashes; i++ {
+		bit := (h1 + i*h2) % n
+		if f.Bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// segmentBloomFilters are the bloom filters of a segment, by dimension column index.
+type segmentBloomFilters map[int]*bloomFilter
+
+// A bloomFilterWriter collects the values of the bloom filter columns (Schema.BloomFilterIndexes) of the
+// current segment of a writeOnlyInterval.
+type bloomFilterWriter struct {
+	*Schema
+	valueFuncs []func(cell unsafe.Pointer) int // By position in BloomFilterIndexes
+	values     []map[uint32]struct{}
+}
+
+func newBloomFilterWriter(s *Schema) *bloomFilterWriter {
+	w := &bloomFilterWriter{Schema: s}
+	for _, i := range s.BloomFilterIndexes {
+		w.valueFuncs = append(w.valueFuncs, makeGetDimensionValueAsIntFuncGen(s.DimensionColumns[i].Type))
+		w.values = append(w.values, make(map[uint32]struct{}))
+	}
+	return w
+}
+
+func (w *bloomFilterWriter) add(dimensions DimensionBytes) {
+	for j, i := range w.BloomFilterIndexes {
+		if dimensions.IsNil(i) {
+			continue
+		}
+		v := w.valueFuncs[j](unsafe.Pointer(&dimensions[w.DimensionOffsets[i]]))
+		w.values[j][uint32(v)] = struct{}{}
+	}
+}
+
+// finishSegment returns the bloom filters of the values added since the last call.
+func (w *bloomFilterWriter) finishSegment() segmentBloomFilters {
+	filters := make(segmentBloomFilters)
+	for j, i := range w.BloomFilterIndexes {
+		filters[i] = newBloomFilter(w.values[j])
+		w.values[j] = make(map[uint32]struct{})
+	}
+	return filters
+}
+
+// BloomFilename is the name of the file holding the bloom filters of iv's segments. It's only written if
+// iv.BloomFilters is set.
+func (iv *Interval) BloomFilename(s *Schema) string {
+	name := fmt.Sprintf("interval.%d.generation%04d.bloom", iv.Start.Unix(), iv.Generation)
+	return filepath.Join(s.Dir, name)
+}
+
+func (iv *Interval) storeBloomFilters(s *Schema) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(iv.blooms); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(iv.BloomFilename(s), buf.Bytes(), 0666)
+}
+
+func (iv *Interval) loadBloomFilters(s *Schema) error {
+	filename := iv.BloomFilename(s)
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	var blooms []segmentBloomFilters
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&blooms); err != nil {
+		return fmt.Errorf("cannot decode bloom filters in %s: %s", filename, err)
+	}
+	if len(blooms) != iv.NumSegments {
+		return fmt.Errorf("%s has bloom filters for %d segments (expected %d)", filename, len(blooms),
+			iv.NumSegments)
+	}
+	if iv.Layout != 0 {
+		// The filters are indexed by the columns of the interval's layout.
+		layout := s.Layouts[iv.Layout-1]
+		for k, filters := range blooms {
+			moved := make(segmentBloomFilters)
+			for i, filter := range filters {
+				if j, ok := s.DimensionNameToIndex[layout.DimensionColumns[i].Name]; ok {
+					moved[j] = filter
+				}
+			}
+			blooms[k] = moved
+		}
+	}
+	iv.blooms = blooms
+	return nil
+}
+
+// A bloomQuery is an equality or 'in' filter on a string dimension column with bloom filters. A segment
+// can only match if its bloom filter may contain one of the dimension table indexes.
+type bloomQuery struct {
+	index   int
+	indexes []uint32
+}
+
+// makeBloomQuery makes a bloom query for filter, which is on dimension column index. ok is false if the
+// column doesn't have bloom filters or they can't be used for the filter.
+func (s *StaticTable) makeBloomQuery(filter QueryFilter, index int) (q bloomQuery, ok bool) {
+	if !s.hasBloomFilters(index) {
+		return q, false
+	}
+	q.index = index
+	switch filter.Type {
+	case FilterEqual:
+		str, ok := filter.Value.(string)
+		if !ok {
+			return q, false
+		}
+		if i, ok := s.DimensionTables[index].Get(str); ok {
+			q.indexes = append(q.indexes, i)
+		}
+	case FilterIn:
+		list, ok := filter.Value.([]interface{})
+		if !ok || len(list) == 0 {
+			return q, false
+		}
+		for _, v := range list {
+			str, ok := v.(string)
+			if !ok {
+				// Includes null, which matches nil values.
+				return q, false
+			}
+			if i, ok := s.DimensionTables[index].Get(str); ok {
+				q.indexes = append(q.indexes, i)
+			}
+		}
+	default:
+		return q, false
+	}
+	return q, true
+}
+
+func (s *Schema) hasBloomFilters(index int) bool {
+	for _, i := range s.BloomFilterIndexes {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
+
+// mayMatch reports whether filters (the bloom filters of a segment) allow it to match q. A segment without a
+// bloom filter for the column (because it was written before the column had one) may match.
+func (q bloomQuery) mayMatch(filters segmentBloomFilters) bool {
+	filter, ok := filters[q.index]
+	if !ok {
+		return true
+	}
+	for _, i := range q.indexes {
+		if filter.mayContain(i) {
+			return true
+		}
+	}
+	return false
+}
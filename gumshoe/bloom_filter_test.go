@@ -0,0 +1,127 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestBloomFilterFalsePositiveRate(t *testing.T) {
+	values := make(map[uint32]struct{})
+	for i := uint32(0); i < 1000; i++ {
+		values[i] = struct{}{}
+	}
+	f := newBloomFilter(values)
+	for v := range values {
+		Assert(t, f.mayContain(v), IsTrue)
+	}
+	falsePositives := 0
+	for v := uint32(1000); v < 11000; v++ {
+		if f.mayContain(v) {
+			falsePositives++
+		}
+	}
+	Assert(t, falsePositives < 300, IsTrue)
+}
+
+// makeBloomFilterTestDB returns a DB with bloom filters on dim1 whose one interval has segments of 4 rows,
+// with dim1 values a, b, c, and so on.
+func makeBloomFilterTestDB(diskBacked bool) *DB {
+	db := makeCustomTestDB(diskBacked, func(schema *Schema) {
+		schema.BloomFilterColumns = []string{"dim1"}
+		schema.Initialize()
+		schema.SegmentSize = 4 * schema.RowSize
+	})
+	var rows []RowMap
+	for i := 0; i < 20; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim1": string('a' + rune(i)), "metric1": 1.0})
+	}
+	insertRows(db, rows)
+	return db
+}
+
+// bloomFilename returns the bloom filter file of the one interval of db.
+func bloomFilename(t *testing.T, db *DB) string {
+	resp := db.MakeRequest()
+	defer resp.Done()
+	Assert(t, len(resp.StaticTable.Intervals), Equals, 1)
+	for _, interval := range resp.StaticTable.Intervals {
+		Assert(t, interval.BloomFilters, IsTrue)
+		return interval.BloomFilename(db.Schema)
+	}
+	panic("unreachable")
+}
+
+// countSegmentsMayMatch returns the number of segments of db which may match the query.
+func countSegmentsMayMatch(t *testing.T, db *DB, query *Query) int {
+	resp := db.MakeRequest()
+	defer resp.Done()
+	params, err := resp.StaticTable.makeScanParams(query)
+	Assert(t, err, IsNil)
+	segments := 0
+	for _, interval := range resp.StaticTable.Intervals {
+		for i := 0; i < interval.NumSegments; i++ {
+			if params.segmentMayMatch(interval, i) {
+				segments++
+			}
+		}
+	}
+	return segments
+}
+
+func TestBloomFiltersSkipSegments(t *testing.T) {
+	db := makeBloomFilterTestDB(false)
+	defer closeTestDB(db)
+
+	for _, testCase := range []struct {
+		filter   QueryFilter
+		segments int // Segments which may match (assuming no false positives)
+		sum      int
+	}{
+		{QueryFilter{FilterEqual, "dim1", "f"}, 1, 1},
+		{QueryFilter{FilterEqual, "dim1", "zzz"}, 0, 0},
+		{QueryFilter{FilterIn, "dim1", []interface{}{"a", "b", "t"}}, 2, 3},
+		// These can't skip any segments.
+		{QueryFilter{FilterNotEqual, "dim1", "f"}, 5, 19},
+		{QueryFilter{FilterIn, "dim1", []interface{}{"a", nil}}, 5, 1},
+	} {
+		query := createQuery()
+		query.Filters = []QueryFilter{testCase.filter}
+		Assert(t, countSegmentsMayMatch(t, db, query), Equals, testCase.segments)
+		results := runQuery(db, query)
+		Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, testCase.sum)
+	}
+}
+
+func TestBloomFiltersArePersisted(t *testing.T) {
+	db := makeBloomFilterTestDB(true)
+	filename := bloomFilename(t, db)
+	_, err := os.Stat(filename)
+	Assert(t, err, IsNil)
+
+	db = reopenTestDB(db)
+	defer func() { closeTestDB(db) }()
+	query := createQuery()
+	query.Filters = []QueryFilter{{FilterEqual, "dim1", "f"}}
+	Assert(t, countSegmentsMayMatch(t, db, query), Equals, 1)
+
+	// Rewriting the interval replaces its bloom filter file.
+	insertRows(db, []RowMap{{"at": 0.0, "dim1": "a", "metric1": 1.0}})
+	_, err = os.Stat(filename)
+	Assert(t, os.IsNotExist(err), IsTrue)
+	_, err = os.Stat(bloomFilename(t, db))
+	Assert(t, err, IsNil)
+	Assert(t, countSegmentsMayMatch(t, db, query), Equals, 1)
+}
+
+func TestMissingBloomFilterFile(t *testing.T) {
+	db := makeBloomFilterTestDB(true)
+	filename := bloomFilename(t, db)
+	closeTestDB(db)
+	Assert(t, os.Remove(filename), IsNil)
+	_, err := OpenDB(db.Schema)
+	Assert(t, os.IsNotExist(err), IsTrue)
+}
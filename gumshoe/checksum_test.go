@@ -0,0 +1,75 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// firstSegmentFilename returns the filename of the first segment of db's only interval.
+func firstSegmentFilename(db *DB) string {
+	resp := db.MakeRequest()
+	defer resp.Done()
+	for _, interval := range resp.StaticTable.Intervals {
+		return interval.SegmentFilename(db.Schema, 0)
+	}
+	panic("no intervals")
+}
+
+func TestCorruptSegmentIsDetectedOnOpen(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		db := makeTestPersistentDB()
+		defer os.RemoveAll(db.Dir)
+		db.CompressSegments = compressed
+		insertRows(db, []RowMap{{"at": 0.0, "dim1": "string1", "metric1": 1.0}})
+		filename := firstSegmentFilename(db)
+		closeTestDB(db)
+
+		f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+		Assert(t, err, IsNil)
+		_, err = f.WriteAt([]byte{0xff}, 0)
+		Assert(t, err, IsNil)
+		f.Close()
+
+		_, err = OpenDB(db.Schema)
+		_, ok := err.(*CorruptSegmentError)
+		Assert(t, ok, IsTrue)
+	}
+}
+
+func TestSegmentVerificationCanBeTurnedOff(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	insertRows(db, []RowMap{{"at": 0.0, "dim1": "string1", "metric1": 1.0}})
+	filename := firstSegmentFilename(db)
+	closeTestDB(db)
+
+	f, err := os.OpenFile(filename, os.O_WRONLY, 0)
+	Assert(t, err, IsNil)
+	_, err = f.WriteAt([]byte{0xff}, int64(db.MetricStartOffset))
+	Assert(t, err, IsNil)
+	f.Close()
+
+	db.SegmentVerification = VerifySegmentsNever
+	db, err = OpenDB(db.Schema)
+	Assert(t, err, IsNil)
+	closeTestDB(db)
+}
+
+func TestTruncatedSegmentIsDetectedWithoutChecksums(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": 0.0, "dim1": "string2", "metric1": 1.0},
+	})
+	filename := firstSegmentFilename(db)
+	closeTestDB(db)
+
+	Assert(t, os.Truncate(filename, int64(db.RowSize)), IsNil)
+	db.SegmentVerification = VerifySegmentsNever
+	_, err := OpenDB(db.Schema)
+	_, ok := err.(*CorruptSegmentError)
+	Assert(t, ok, IsTrue)
+}
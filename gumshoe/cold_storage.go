@@ -0,0 +1,324 @@
+// Tiering old intervals out to a cold store.
+
+package gumshoe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// A ColdStore holds the segment files of cold intervals (see RunConfig.ColdStore). Files are identified by
+// their base names, which are unique for the life of a DB. A file must be durably stored once Put returns,
+// since the local copy is then deleted.
+type ColdStore interface {
+	Put(name string, r io.Reader) error
+	Get(name string, w io.Writer) error
+	Delete(name string) error
+}
+
+// DirColdStore is a ColdStore which keeps files in a directory, such as one on a network filesystem. Put
+// relies on fsync and rename, so the directory must not be an object storage bucket mounted with FUSE (with
+// s3fs or gcsfuse, say), which doesn't make them durable; use an S3ColdStore instead.
+type DirColdStore string
+
+func (d DirColdStore) Put(name string, r io.Reader) error {
+	filename := filepath.Join(string(d), name)
+	tmpFilename := filename + ".tmp"
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	// The file and its name are synced before returning, since the caller then deletes its local copy.
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return err
+	}
+	return syncDir(string(d))
+}
+
+func (d DirColdStore) Get(name string, w io.Writer) error {
+	f, err := os.Open(filepath.Join(string(d), name))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (d DirColdStore) Delete(name string) error { return os.Remove(filepath.Join(string(d), name)) }
+
+// coldCacheDir is the subdirectory of the DB dir holding segment files fetched from the cold store.
+const coldCacheDir = "cold-cache"
+
+var errNoColdStore = errors.New("the DB has cold intervals, but no cold store is configured")
+
+// A coldCache holds the segments of cold intervals which have been fetched for queries or rewrites. A cached
+// interval is evicted (least recently used first) once the cache holds more than RunConfig.ColdCacheSize
+// bytes, but only when no one is using it.
+type coldCache struct {
+	*Schema
+	dir string
+
+	mu      sync.Mutex
+	entries map[string]*coldCacheEntry // By the name of the interval's first segment
+	size    int                        // Total bytes of the fetched entries
+	clock   int                        // Incremented on each use, for LRU ordering
+}
+
+type coldCacheEntry struct {
+	names    []string // The segment file names
+	segments []*Segment
+	size     int
+	refs     int
+	lastUsed int
+
+	fetched chan struct{} // Closed once segments (or err) is set
+	err     error
+}
+
+func newColdCache(s *Schema) (*coldCache, error) {
+	var dir string
+	if s.ReadOnly {
+		// A read-only DB keeps its cache in a temporary directory, which is removed when the DB is closed.
+		var err error
+		if dir, err = ioutil.TempDir("", "gumshoe-cold-cache"); err != nil {
+			return nil, err
+		}
+	} else {
+		dir = filepath.Join(s.Dir, coldCacheDir)
+		// Anything left in the cache by a previous process isn't tracked; start over.
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, err
+		}
+		if err := os.Mkdir(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &coldCache{
+		Schema:  s,
+		dir:     dir,
+		entries: make(map[string]*coldCacheEntry),
+	}, nil
+}
+
+// acquire returns iv with its segments loaded. If iv is cold, the result is a copy of iv using cached segments
+// (which are fetched first, if necessary); the caller must call release when it's finished with them. If iv
+// isn't cold it is returned as-is and release does nothing.
+func (c *coldCache) acquire(iv *Interval) (loaded *Interval, release func(), err error) {
+	if !iv.Cold {
+		return iv, func() {}, nil
+	}
+	if c == nil {
+		return nil, nil, errNoColdStore
+	}
+	key := iv.segmentName(0)
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if !ok {
+		entry = &coldCacheEntry{fetched: make(chan struct{})}
+		for i := 0; i < iv.NumSegments; i++ {
+			entry.names = append(entry.names, iv.segmentName(i))
+		}
+		c.entries[key] = entry
+	}
+	entry.refs++
+	c.clock++
+	entry.lastUsed = c.clock
+	c.mu.Unlock()
+
+	if ok {
+		<-entry.fetched
+	} else {
+		segments, size, err := c.fetch(iv)
+		c.mu.Lock()
+		entry.segments, entry.size, entry.err = segments, size, err
+		if err != nil {
+			delete(c.entries, key)
+		} else {
+			c.size += size
+		}
+		c.mu.Unlock()
+		close(entry.fetched)
+	}
+
+	release = func() {
+		c.mu.Lock()
+		entry.refs--
+		c.evict()
+		c.mu.Unlock()
+	}
+	if entry.err != nil {
+		release()
+		return nil, nil, entry.err
+	}
+	copied := *iv
+	copied.Segments = entry.segments
+	return &copied, release, nil
+}
+
+// fetch copies the segment files of iv from the cold store into the cache directory and loads them.
+func (c *coldCache) fetch(iv *Interval) (segments []*Segment, size int, err error) {
+	start := time.Now()
+	defer func() {
+		if err != nil {
+			closeSegments(segments)
+			segments = nil
+		}
+	}()
+	for i := 0; i < iv.NumSegments; i++ {
+		name := iv.segmentName(i)
+		filename := filepath.Join(c.dir, name)
+		if err := c.fetchFile(name, filename); err != nil {
+			return segments, 0, fmt.Errorf("cannot fetch cold segment %s: %s", name, err)
+		}
+		// The file has come over the network, so always check it.
+		segment, err := c.loadSegmentFile(iv, i, filename, true)
+		if err != nil {
+			return segments, 0, err
+		}
+		segments = append(segments, segment)
+		size += len(segment.Bytes)
+	}
+	Log.Printf("Fetched %d cold segments (%d bytes) for the interval starting at %s in %s",
+		iv.NumSegments, size, iv.Start, time.Since(start))
+	return segments, size, nil
+}
+
+func (c *coldCache) fetchFile(name, filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := c.ColdStore.Get(name, f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// evict drops unused entries, least recently used first, until the cache fits in ColdCacheSize. c.mu must be
+// held.
+func (c *coldCache) evict() {
+	for c.ColdCacheSize > 0 && c.size > c.ColdCacheSize {
+		var oldestKey string
+		var oldest *coldCacheEntry
+		for key, entry := range c.entries {
+			if entry.refs > 0 || entry.segments == nil {
+				continue
+			}
+			if oldest == nil || entry.lastUsed < oldest.lastUsed {
+				oldestKey, oldest = key, entry
+			}
+		}
+		if oldest == nil {
+			return
+		}
+		c.drop(oldestKey, oldest)
+	}
+}
+
+// drop removes an unused entry from c. c.mu must be held.
+func (c *coldCache) drop(key string, entry *coldCacheEntry) {
+	delete(c.entries, key)
+	c.size -= entry.size
+	closeSegments(entry.segments)
+	for _, name := range entry.names {
+		if err := os.Remove(filepath.Join(c.dir, name)); err != nil {
+			Log.Println("error removing cached cold segment file:", err)
+		}
+	}
+}
+
+// forget removes iv's segments from the cache, if they're there, because iv is being deleted. This should
+// only be called once nothing can be using iv.
+func (c *coldCache) forget(iv *Interval) {
+	if c == nil {
+		return
+	}
+	key := iv.segmentName(0)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[key]; ok && entry.segments != nil {
+		c.drop(key, entry)
+	}
+}
+
+func closeSegments(segments []*Segment) {
+	for _, segment := range segments {
+		if err := segment.close(); err != nil {
+			Log.Println("error closing segment:", err)
+		}
+	}
+}
+
+// moveColdIntervals uploads the segment files of the intervals in intervals which ended more than ColdAfter
+// ago to the cold store and replaces them with cold copies. It returns the replaced intervals, whose local
+// files should be removed once they're no longer used. An interval which can't be uploaded is left alone (and
+// tried again at the next flush). This should only be called by the inserter goroutine.
+func (db *DB) moveColdIntervals(intervals map[time.Time]*Interval) (moved []*Interval) {
+	if !db.DiskBacked || db.ColdStore == nil || db.ColdAfter <= 0 {
+		return nil
+	}
+	cutoff := time.Now().Add(-db.ColdAfter)
+	for key, interval := range intervals {
+		if interval.Cold || interval.End.After(cutoff) {
+			continue
+		}
+		if err := db.uploadInterval(interval); err != nil {
+			Log.Printf("error moving the interval starting at %s to the cold store: %s", interval.Start, err)
+			continue
+		}
+		cold := *interval
+		cold.Segments = nil
+		cold.Cold = true
+		intervals[key] = &cold
+		moved = append(moved, interval)
+	}
+	if len(moved) > 0 {
+		Log.Printf("Flush: moved %d intervals to the cold store", len(moved))
+	}
+	return moved
+}
+
+func (db *DB) uploadInterval(interval *Interval) error {
+	for i := 0; i < interval.NumSegments; i++ {
+		f, err := os.Open(interval.SegmentFilename(db.Schema, i))
+		if err != nil {
+			return err
+		}
+		err = db.ColdStore.Put(interval.segmentName(i), f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeColdInterval deletes the files of the cold interval iv from the cold store and the cache.
+func (db *DB) removeColdInterval(iv *Interval) {
+	db.coldCache.forget(iv)
+	for i := 0; i < iv.NumSegments; i++ {
+		if err := db.ColdStore.Delete(iv.segmentName(i)); err != nil {
+			Log.Println("cleanup error deleting cold segment file:", err)
+		}
+	}
+}
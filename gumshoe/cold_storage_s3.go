@@ -0,0 +1,182 @@
+// A cold store in an S3-compatible object store.
+
+package gumshoe
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// S3ColdStore is a ColdStore which keeps files as objects in a bucket of an S3-compatible object store
+// (such as S3, GCS with HMAC keys, or MinIO). Requests use path-style URLs and are signed with AWS Signature
+// Version 4. Each object is stored with the SHA-256 of its contents, which is checked when it's fetched.
+type S3ColdStore struct {
+	Endpoint     string // The base URL of the store, such as "https://s3.us-east-1.amazonaws.com"
+	Region       string
+	Bucket       string
+	Prefix       string // Prepended to file names to make object keys, such as "events/"
+	AccessKey    string
+	SecretKey    string
+	SessionToken string       // Optional, for temporary credentials
+	Client       *http.Client // If nil, http.DefaultClient is used
+}
+
+// s3ChecksumHeader is the object metadata holding the SHA-256 of an object's contents (in hex).
+const s3ChecksumHeader = "X-Amz-Meta-Gumshoe-Sha256"
+
+// emptySHA256 is the SHA-256 of an empty request body, in hex.
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// Put uploads the file as an object. The store checks the body against its signed SHA-256, and only
+// responds successfully once the object is durably stored.
+func (s *S3ColdStore) Put(name string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(b)
+	checksum := hex.EncodeToString(sum[:])
+	req, err := http.NewRequest("PUT", s.objectURL(name), bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set(s3ChecksumHeader, checksum)
+	return s.do(req, checksum, nil)
+}
+
+// Get downloads the object into w. It returns an error if the contents don't match the object's checksum.
+func (s *S3ColdStore) Get(name string, w io.Writer) error {
+	req, err := http.NewRequest("GET", s.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req, emptySHA256, func(resp *http.Response) error {
+		want := resp.Header.Get(s3ChecksumHeader)
+		if want == "" {
+			return fmt.Errorf("cold object %s has no checksum", name)
+		}
+		h := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(w, h), resp.Body); err != nil {
+			return err
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); got != want {
+			return fmt.Errorf("cold object %s is damaged: its SHA-256 is %s rather than %s", name, got, want)
+		}
+		return nil
+	})
+}
+
+func (s *S3ColdStore) Delete(name string) error {
+	req, err := http.NewRequest("DELETE", s.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req, emptySHA256, nil)
+}
+
+// objectURL returns the path-style URL of the object for the file name.
+func (s *S3ColdStore) objectURL(name string) string {
+	return strings.TrimSuffix(s.Endpoint, "/") + "/" + s3Escape(s.Bucket+"/"+s.Prefix+name)
+}
+
+// do signs and sends req, whose body has the SHA-256 payloadHash, and passes a successful response to handle
+// (if it isn't nil).
+func (s *S3ColdStore) do(req *http.Request, payloadHash string, handle func(*http.Response) error) error {
+	s.sign(req, payloadHash, time.Now())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<10))
+		return fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, bytes.TrimSpace(body))
+	}
+	if handle == nil {
+		return nil
+	}
+	return handle(resp)
+}
+
+// sign adds the headers and the Authorization of AWS Signature Version 4 to req, whose body has the SHA-256
+// payloadHash. The host and all the headers which have been set on req are signed.
+func (s *S3ColdStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	timestamp := now.UTC().Format("20060102T150405Z")
+	date := timestamp[:8]
+	req.Header.Set("X-Amz-Date", timestamp)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if s.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.SessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.Region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + timestamp + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + s.SecretKey)
+	for _, part := range []string{date, s.Region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.AccessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape escapes an object path as Signature Version 4 requires: every byte but the unreserved characters
+// and slashes is percent-encoded.
+func s3Escape(path string) string {
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '.', c == '_', c == '~', c == '/':
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+package gumshoe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// makeTestColdDB returns a persistent DB which moves intervals older than a day to a cold store directory.
+func makeTestColdDB() (db *DB, coldDir string) {
+	coldDir, err := ioutil.TempDir("", "gumshoe-cold-test")
+	if err != nil {
+		panic(err)
+	}
+	db = makeCustomTestDB(true, func(schema *Schema) {
+		schema.ColdStore = DirColdStore(coldDir)
+		schema.ColdAfter = 24 * time.Hour
+	})
+	return db, coldDir
+}
+
+func countFiles(dir, glob string) int {
+	matches, err := filepath.Glob(filepath.Join(dir, glob))
+	if err != nil {
+		panic(err)
+	}
+	return len(matches)
+}
+
+func TestOldIntervalsAreMovedToColdStore(t *testing.T) {
+	db, coldDir := makeTestColdDB()
+	defer os.RemoveAll(db.Dir)
+	defer os.RemoveAll(coldDir)
+	defer func() { closeTestDB(db) }()
+
+	now := float64(time.Now().Unix())
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": now, "dim1": "string1", "metric1": 2.0},
+	})
+	Assert(t, countFiles(db.Dir, "interval.*.dat"), Equals, 1)
+	Assert(t, countFiles(coldDir, "interval.*.dat"), Equals, 1)
+	Assert(t, db.GetDebugStats().ColdIntervals, Equals, 1)
+
+	// Queries fetch the cold interval.
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 3)
+
+	// The cold interval is still cold after reopening.
+	db = reopenTestDB(db)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 3)
+
+	// A late row for the cold interval rewrites it locally, and then it's moved again.
+	insertRows(db, []RowMap{{"at": 0.0, "dim1": "string2", "metric1": 4.0}})
+	Assert(t, countFiles(db.Dir, "interval.*.dat"), Equals, 1)
+	Assert(t, countFiles(coldDir, "interval.*.dat"), Equals, 1)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 7)
+
+	deleted, err := db.DeleteRows([]QueryFilter{{Type: FilterEqual, Column: "dim1", Value: "string2"}},
+		time.Unix(0, 0), time.Unix(int64(hour(1)), 0))
+	Assert(t, err, IsNil)
+	Assert(t, deleted, Equals, 1)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 3)
+}
+
+func TestColdCacheEvictsUnusedIntervals(t *testing.T) {
+	db, coldDir := makeTestColdDB()
+	defer os.RemoveAll(db.Dir)
+	defer os.RemoveAll(coldDir)
+	db.ColdCacheSize = 1
+	defer func() { closeTestDB(db) }()
+
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": hour(1), "dim1": "string1", "metric1": 2.0},
+	})
+	Assert(t, countFiles(coldDir, "interval.*.dat"), Equals, 2)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 3)
+	// Once the query is done, nothing fits in the cache.
+	Assert(t, countFiles(filepath.Join(db.Dir, coldCacheDir), "*"), Equals, 0)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 3)
+}
+
+func TestOpeningColdDBRequiresColdStore(t *testing.T) {
+	db, coldDir := makeTestColdDB()
+	defer os.RemoveAll(db.Dir)
+	defer os.RemoveAll(coldDir)
+	insertRows(db, []RowMap{{"at": 0.0, "dim1": "string1", "metric1": 1.0}})
+	closeTestDB(db)
+
+	db.ColdStore = nil
+	_, err := OpenDB(db.Schema)
+	Assert(t, err, Equals, errNoColdStore)
+}
@@ -13,6 +13,9 @@ import (
 
 const MetadataFilename = "db.json"
 
+// maxBatchIDs is the number of recently inserted batch IDs that a DB remembers (see InsertBatch).
+const maxBatchIDs = 10000
+
 // Log is a global logger instance. The user may replace it with a custom logger (e.g., a log.Logger) before
 // calling any gumshoedb functions.
 var Log Logger = nopLogger{}
@@ -20,45 +23,109 @@ var Log Logger = nopLogger{}
 type DB struct {
 	*Schema
 	dirFile *os.File // An open file handle to be flocked while the DB is open (nil unless disk-backed)
+	wal     *os.File // The write-ahead log, owned by the inserter goroutine (nil unless disk-backed)
 
 	StaticTable *StaticTable // Owned by the request goroutine
 	memTable    *MemTable    // Owned by the inserter goroutine
 
+	// The IDs of the most recently inserted batches, oldest first. These are saved with the metadata so that
+	// a retried batch is not inserted twice. Owned by the inserter goroutine.
+	BatchIDs   []string
+	batchIDSet map[string]bool
+
+	// The sequence number of the last WAL entry whose rows have been flushed, and of the last entry appended to
+	// the WAL. Entries up to FlushedWALSeq are skipped when the WAL is replayed, in case the DB crashed after a
+	// flush but before the WAL was truncated. Owned by the inserter goroutine.
+	FlushedWALSeq uint64 `json:",omitempty"`
+	walSeq        uint64
+
+	// The string dimension columns to be widened (to the given types) when the DB is next opened, and the rows
+	// held back until then (see PromoteStringOverflow). Owned by the inserter goroutine.
+	PromotedColumns map[string]Type `json:",omitempty"`
+	heldRows        []UnpackedRow
+
+	// The retention period set by SetRetention (0 if it hasn't been called), which replaces RunConfig.Retention
+	// when the DB is opened. Owned by the inserter goroutine.
+	SavedRetention time.Duration `json:",omitempty"`
+
+	// The DBs of the views (see RunConfig.Views), and the rows inserted since they were last given to them
+	// (owned by the inserter goroutine).
+	views    []*viewDB
+	viewRows []UnpackedRow
+
 	shutdown chan struct{} // To tell goroutines to exit by closing
 
-	// The inserter reads from these two chans.
+	// The inserter reads from these five chans.
 	inserts      chan *InsertRequest
 	flushSignals chan chan error
+	deletes      chan *deleteRequest
+	rollups      chan *rollupRequest
+	retentions   chan *retentionRequest
 
 	// The request goroutine reads from these two chans.
 	requests chan *Request
 	flushes  chan *FlushInfo
 
-	// A fixed-size worker pool for running query scans.
+	// A worker pool for running query scans. Its size is changed with SetQueryParallelism: a value sent on
+	// stopWorker stops one worker.
 	scanRequests chan *scanRequest
+	stopWorker   chan struct{}
+	workersLock  *sync.Mutex
+	numWorkers   int32 // Read atomically by scans; changed only with workersLock held
+
+	coldCache *coldCache // Nil unless there's a cold store
+
+	intervalUsers *intervalUsers // The requests using each interval, shared by the StaticTables
 
 	latestTimestampLock *sync.Mutex
 	// Latest inserted row timestamp.
 	latestTimestamp time.Time
+
+	backlogLock *sync.Mutex
+	// Rows in insert requests which haven't been applied yet, physical rows in the memtable, and rows held back
+	// by PromoteStringOverflow (len(heldRows)).
+	queuedRows   int
+	memTableRows int
+	numHeldRows  int
+
+	lookupTablesLock    *sync.Mutex
+	lookupTables        map[string]*LookupTable
+	lookupTablesVersion int // Incremented for each new lookup table
 }
 
-// OpenDB loads an existing DB. If schema.DiskBacked is false, this is the same as NewDB. Otherwise,
-// schema.Dir must already contain a valid saved database. OpenDB sanity-checks the existing DB against the
-// given schema.
+// OpenDB loads an existing DB. If schema.DiskBacked is false, this is the same as NewDB (so the DB can't be
+// read-only). Otherwise, schema.Dir must already contain a valid saved database. OpenDB sanity-checks the
+// existing DB against the given schema. The schema may drop columns, add dimension and metric columns after
+// the existing DB's columns, and widen string dimension columns (see Schema.CheckColumnChanges); the existing
+// rows have nil values for the new dimensions and zero for the new metrics. String dimension columns which
+// were saved with wider types (including those widened by PromoteStringOverflow) keep them.
 func OpenDB(schema *Schema) (*DB, error) {
 	if !schema.DiskBacked {
 		return NewDB(schema)
 	}
-	return openDBDir(schema.Dir, schema)
+	return openDBDir(schema.Dir, schema, schema.ReadOnly)
 }
 
 // OpenDBDir loads an existing DB, discovering the schema from the data there.
-func OpenDBDir(dir string) (*DB, error) { return openDBDir(dir, nil) }
+func OpenDBDir(dir string) (*DB, error) { return openDBDir(dir, nil, false) }
+
+// OpenDBDirReadOnly is like OpenDBDir, but opens the DB read-only (see RunConfig.ReadOnly), so nothing in
+// dir is changed.
+func OpenDBDirReadOnly(dir string) (*DB, error) { return openDBDir(dir, nil, true) }
 
 var DBDoesNotExistErr = errors.New("db dir does not exist")
 
-// openDBDir opens an existing DB directory. If schema is non-nil, it is checked against the schema in dir.
-func openDBDir(dir string, schema *Schema) (*DB, error) {
+// ReadOnlyErr is returned by the methods which would change a read-only DB (see RunConfig.ReadOnly).
+var ReadOnlyErr = errors.New("the DB is read-only")
+
+// DuplicateBatchErr is returned by InsertBatch if a batch with the same ID was inserted recently. The rows
+// are not inserted again.
+var DuplicateBatchErr = errors.New("batch has already been inserted")
+
+// openDBDir opens an existing DB directory. If schema is non-nil, it is checked against the schema in dir,
+// whose columns it may change (see Schema.CheckColumnChanges); otherwise the saved schema is used, and
+// readOnly says whether the DB is opened read-only.
+func openDBDir(dir string, schema *Schema, readOnly bool) (*DB, error) {
 	f, err := os.Open(filepath.Join(dir, MetadataFilename))
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -72,27 +139,82 @@ func openDBDir(dir string, schema *Schema) (*DB, error) {
 	if err := decoder.Decode(db); err != nil {
 		return nil, err
 	}
-	if schema != nil {
-		if err := db.Schema.Equivalent(schema); err != nil {
-			return nil, err
-		}
-		// We need to use the given Schema because the on-disk one has a blank RunConfig.
-		db.Schema = schema
+	old := db.Schema
+	old.Initialize()
+	// The saved schema doesn't record the views, so they're left alone unless schema is given.
+	discovered := schema == nil
+	if discovered {
+		saved := *old
+		saved.ReadOnly = readOnly
+		schema = &saved
+	}
+	// String dimension columns keep their saved types if those are wider, and they're widened as recorded by
+	// PromoteStringOverflow.
+	schema.widenStringColumns(old.stringColumnTypes())
+	promoted := false
+	if !schema.ReadOnly {
+		schema.widenStringColumns(db.PromotedColumns)
+		promoted = len(db.PromotedColumns) > 0
+		db.PromotedColumns = nil
+	}
+	if err := schema.CheckColumnChanges(old); err != nil {
+		return nil, err
+	}
+	if schema.ReadOnly && !old.rowLayout().equal(schema.rowLayout()) {
+		return nil, errors.New("the columns of a read-only DB cannot be changed")
 	}
+	// We need to use the given Schema because the on-disk one has a blank RunConfig.
+	db.Schema = schema
 	db.Schema.DiskBacked = true
 	db.Schema.Dir = dir
+	if db.SavedRetention > 0 {
+		Log.Printf("Using the retention period set at runtime (%s) rather than the configured one (%s)",
+			db.SavedRetention, db.Retention)
+		db.FixedRetention = true
+		db.Retention = db.SavedRetention
+	}
+	// Loading the segments needs the row layout.
+	db.Schema.Initialize()
+	old.DiskBacked = true
+	old.Dir = dir
+	changed, obsoleteFiles, err := db.StaticTable.changeColumns(old, schema)
+	if err != nil {
+		return nil, err
+	}
+	// Unused layouts are only forgotten in memory by a read-only DB.
+	if (changed || promoted) && !db.ReadOnly {
+		if err := db.writeMetadataFile(); err != nil {
+			return nil, err
+		}
+		for _, filename := range obsoleteFiles {
+			if err := os.Remove(filename); err != nil {
+				Log.Println("error deleting obsolete dimension table file:", err)
+			}
+		}
+	}
 	if err := db.StaticTable.initialize(db.Schema); err != nil {
 		return nil, err
 	}
+	db.StaticTable.updateSegmentLocks(time.Now())
 	if err := db.initialize(); err != nil {
 		return nil, err
 	}
+	if err := db.loadLookupTables(); err != nil {
+		return nil, err
+	}
+	if err := db.openViews(!discovered); err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
 // NewDB creates a fresh DB. If it is disk-backed, the directory (schema.Dir) must not contain any existing DB
-// files (*.json or *.dat).
+// files (*.json or *.dat). Rows in a write-ahead log left by a DB which crashed before its first flush are
+// replayed. A new DB can't be read-only.
 func NewDB(schema *Schema) (*DB, error) {
+	if schema.ReadOnly {
+		return nil, errors.New("cannot create a read-only DB")
+	}
 	if !schema.DiskBacked {
 		db := &DB{
 			Schema:      schema,
@@ -101,6 +223,9 @@ func NewDB(schema *Schema) (*DB, error) {
 		if err := db.initialize(); err != nil {
 			return nil, err
 		}
+		if err := db.openViews(true); err != nil {
+			return nil, err
+		}
 		return db, nil
 	}
 
@@ -125,6 +250,9 @@ func NewDB(schema *Schema) (*DB, error) {
 	if err := db.initialize(); err != nil {
 		return nil, err
 	}
+	if err := db.openViews(true); err != nil {
+		return nil, err
+	}
 	return db, nil
 }
 
@@ -140,14 +268,39 @@ func (db *DB) initialize() error {
 	db.shutdown = make(chan struct{})
 	db.inserts = make(chan *InsertRequest)
 	db.flushSignals = make(chan chan error)
+	db.deletes = make(chan *deleteRequest)
+	db.rollups = make(chan *rollupRequest)
+	db.retentions = make(chan *retentionRequest)
 	db.requests = make(chan *Request)
 	db.flushes = make(chan *FlushInfo)
 	db.scanRequests = make(chan *scanRequest)
+	db.stopWorker = make(chan struct{})
+	db.workersLock = new(sync.Mutex)
+	db.intervalUsers = newIntervalUsers()
 	db.latestTimestampLock = new(sync.Mutex)
-
-	for i := 0; i < db.Schema.QueryParallelism; i++ {
-		go db.RunQueryWorker()
+	db.backlogLock = new(sync.Mutex)
+	db.lookupTablesLock = new(sync.Mutex)
+	db.lookupTables = make(map[string]*LookupTable)
+	db.batchIDSet = make(map[string]bool)
+	for _, id := range db.BatchIDs {
+		db.batchIDSet[id] = true
+	}
+	if db.DiskBacked {
+		if !db.ReadOnly {
+			if err := db.openWAL(); err != nil {
+				return err
+			}
+		}
+		if db.ColdStore != nil {
+			cache, err := newColdCache(db.Schema)
+			if err != nil {
+				return err
+			}
+			db.coldCache = cache
+		}
 	}
+
+	db.setQueryWorkers(db.Schema.QueryParallelism)
 	go db.HandleRequests()
 	go db.HandleInserts()
 	return nil
@@ -155,19 +308,39 @@ func (db *DB) initialize() error {
 
 // Flush triggers a DB flush and waits for it to complete.
 func (db *DB) Flush() error {
+	if db.ReadOnly {
+		return ReadOnlyErr
+	}
 	errCh := make(chan error)
 	db.flushSignals <- errCh
 	return <-errCh
 }
 
-// Close triggers a flush, waits for it to complete, and then shuts down the DB's goroutines. The DB may not
-// be used again after calling Close.
+// Close triggers a flush (unless the DB is read-only), waits for it to complete, and then shuts down the DB's
+// goroutines. The DB may not be used again after calling Close.
 func (db *DB) Close() error {
-	if err := db.Flush(); err != nil {
-		return err
+	if !db.ReadOnly {
+		if err := db.Flush(); err != nil {
+			return err
+		}
+	}
+	for _, view := range db.views {
+		if err := view.Close(); err != nil {
+			return err
+		}
 	}
 	close(db.shutdown)
 	if db.DiskBacked {
+		if db.wal != nil {
+			if err := db.wal.Close(); err != nil {
+				return err
+			}
+		}
+		if db.ReadOnly && db.coldCache != nil {
+			if err := os.RemoveAll(db.coldCache.dir); err != nil {
+				return err
+			}
+		}
 		return db.removeFlock()
 	}
 	return nil
@@ -179,7 +352,12 @@ func (db *DB) addFlock() error {
 		return err
 	}
 	db.dirFile = f
-	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+	// A read-only DB shares the directory with other read-only DBs.
+	how := syscall.LOCK_EX
+	if db.ReadOnly {
+		how = syscall.LOCK_SH
+	}
+	if err := syscall.Flock(int(f.Fd()), how|syscall.LOCK_NB); err != nil {
 		return fmt.Errorf("cannot lock database dir; is it currently in use? (err = %v)", err)
 	}
 	return nil
@@ -191,17 +369,34 @@ func (db *DB) removeFlock() error {
 }
 
 type InsertRequest struct {
-	Rows []UnpackedRow
-	Err  chan error
+	BatchID     string // Optional
+	Rows        []UnpackedRow
+	SkipInvalid bool
+	Err         chan error
+	RowErrors   []RowError // Set by the inserter (before sending on Err) if SkipInvalid is true
+	HeldRows    int        // Set by the inserter: the rows held back by PromoteStringOverflow
+}
+
+// A RowError describes an invalid row which was skipped by InsertSkippingInvalid.
+type RowError struct {
+	Row   int    `json:"row"` // The index of the row in the inserted batch
+	Error string `json:"error"`
+	Late  bool   `json:"late,omitempty"` // Whether the row was rejected as a LateRowError
+
+	// Whether the row was rejected as a StringOverflowError
+	Overflow bool `json:"overflow,omitempty"`
 }
 
 type FlushInfo struct {
-	NewStaticTable          *StaticTable
-	AllRequestsFinishedChan chan chan struct{}
+	NewStaticTable *StaticTable
+	Swapped        chan struct{} // Closed once NewStaticTable is handed to new requests
 }
 
 func (db *DB) HandleRequests() {
 	db.StaticTable.scanRequests = db.scanRequests
+	db.StaticTable.numWorkers = &db.numWorkers
+	db.StaticTable.coldCache = db.coldCache
+	db.StaticTable.users = db.intervalUsers
 	for {
 		select {
 		case <-db.shutdown:
@@ -209,35 +404,74 @@ func (db *DB) HandleRequests() {
 		case req := <-db.requests:
 			db.StaticTable.handleRequest(req)
 		case flushInfo := <-db.flushes:
-			// Spin up a goroutine that waits for all requests on the current StaticTable to finish and pass the
-			// chan back to the inserter goroutine.
-			requestsFinished := make(chan struct{})
-			go func(st *StaticTable) {
-				st.wg.Wait()
-				requestsFinished <- struct{}{}
-			}(db.StaticTable)
-			// Swap out the old StaticTable for the new -- the inserter goroutine can garbage collect the old one
-			// once all requests have been processed.
+			// Swap out the old StaticTable for the new. Requests on the old one keep using its intervals; the
+			// inserter goroutine retires the intervals which were replaced (see intervalUsers).
 			db.StaticTable = flushInfo.NewStaticTable
 			db.StaticTable.scanRequests = db.scanRequests
-			flushInfo.AllRequestsFinishedChan <- requestsFinished
+			db.StaticTable.numWorkers = &db.numWorkers
+			db.StaticTable.coldCache = db.coldCache
+			db.StaticTable.users = db.intervalUsers
+			close(flushInfo.Swapped)
 		}
 	}
 }
 
 // InsertUnpacked is like insert, but takes UnpackedRows (which have an associated count).
-func (db *DB) InsertUnpacked(rows []UnpackedRow) error {
-	errc := make(chan error)
-	db.inserts <- &InsertRequest{Rows: rows, Err: errc}
-	return <-errc
+func (db *DB) InsertUnpacked(rows []UnpackedRow) error { return db.insert(&InsertRequest{Rows: rows}) }
+
+// insert sends req to the inserter goroutine and waits for it to be applied.
+func (db *DB) insert(req *InsertRequest) error {
+	if db.ReadOnly {
+		return ReadOnlyErr
+	}
+	db.addQueuedRows(len(req.Rows))
+	defer db.addQueuedRows(-len(req.Rows))
+	req.Err = make(chan error)
+	db.inserts <- req
+	return <-req.Err
 }
 
-// Insert adds some rows into the database. It returns (and stops) on the first error encountered. Note that
+func (db *DB) addQueuedRows(n int) {
+	db.backlogLock.Lock()
+	db.queuedRows += n
+	db.backlogLock.Unlock()
+}
+
+// Insert adds some rows into the database. It returns (and stops) on the first error encountered, except that
+// rows which overflow a string dimension column are handled according to RunConfig.StringOverflow. Note that
 // the data is only in the memtable (not necessarily on disk) when Insert returns.
-func (db *DB) Insert(rows []RowMap) error {
+func (db *DB) Insert(rows []RowMap) error { return db.InsertBatch("", rows) }
+
+// InsertBatch is like Insert, but it also takes an ID for the batch of rows (if batchID is not empty). If a
+// batch with the same ID was successfully inserted recently, the rows are not inserted and InsertBatch
+// returns DuplicateBatchErr. This makes it safe for clients to retry inserts.
+func (db *DB) InsertBatch(batchID string, rows []RowMap) error {
+	return db.insert(&InsertRequest{BatchID: batchID, Rows: unpackRows(rows)})
+}
+
+// InsertSkippingInvalid is like InsertBatch, but rather than stopping at an invalid row (such as one with an
+// unknown column or a value which is too large for its column), it skips the row and goes on. The skipped
+// rows, and those rejected by RejectStringOverflow, are returned as RowErrors, in order.
+func (db *DB) InsertSkippingInvalid(batchID string, rows []RowMap) ([]RowError, error) {
+	req := &InsertRequest{BatchID: batchID, Rows: unpackRows(rows), SkipInvalid: true}
+	err := db.insert(req)
+	return req.RowErrors, err
+}
+
+// InsertWithResult is like InsertBatch, or InsertSkippingInvalid if skipInvalid is true, but it also returns
+// the number of rows which were held back by PromoteStringOverflow rather than inserted. Held rows aren't
+// visible to queries until the DB is reopened.
+func (db *DB) InsertWithResult(batchID string, rows []RowMap, skipInvalid bool) (rowErrors []RowError,
+	heldRows int, err error) {
+	req := &InsertRequest{BatchID: batchID, Rows: unpackRows(rows), SkipInvalid: skipInvalid}
+	err = db.insert(req)
+	return req.RowErrors, req.HeldRows, err
+}
+
+func unpackRows(rows []RowMap) []UnpackedRow {
 	unpacked := make([]UnpackedRow, len(rows))
 	for i, row := range rows {
 		unpacked[i] = UnpackedRow{row, 1}
 	}
-	return db.InsertUnpacked(unpacked)
+	return unpacked
 }
@@ -3,7 +3,13 @@ package gumshoe
 import (
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
 )
 
 func TestDoubleOpen(t *testing.T) {
@@ -24,3 +30,54 @@ func TestDoubleOpen(t *testing.T) {
 		t.Fatal("Expected error double-opening database dir")
 	}
 }
+
+func TestReadOnlyDB(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	insertRows(db, []RowMap{{"at": 0.0, "dim1": "a", "metric1": 1.0}})
+	// This row is only in the WAL, so the read-only DB doesn't see it.
+	Assert(t, db.Insert([]RowMap{{"at": 0.0, "dim1": "b", "metric1": 2.0}}), IsNil)
+	crashTestDB(db)
+	metadata, err := ioutil.ReadFile(filepath.Join(db.Dir, MetadataFilename))
+	Assert(t, err, IsNil)
+	wal, err := ioutil.ReadFile(filepath.Join(db.Dir, WALFilename))
+	Assert(t, err, IsNil)
+
+	schema := *db.Schema
+	schema.ReadOnly = true
+	_, err = NewDB(&schema)
+	Assert(t, err, NotNil)
+	readOnly, err := OpenDB(&schema)
+	Assert(t, err, IsNil)
+	// Other read-only DBs can share the directory, but a writable one can't.
+	other, err := OpenDB(&schema)
+	Assert(t, err, IsNil)
+	closeTestDB(other)
+	_, err = OpenDB(db.Schema)
+	Assert(t, err, NotNil)
+
+	Assert(t, runQuery(readOnly, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 1)
+	Assert(t, readOnly.Insert([]RowMap{{"at": 0.0, "dim1": "c", "metric1": 4.0}}), Equals, ReadOnlyErr)
+	Assert(t, readOnly.Flush(), Equals, ReadOnlyErr)
+	_, err = readOnly.DeleteRows(nil, time.Unix(0, 0), time.Unix(int64(hour(1)), 0))
+	Assert(t, err, Equals, ReadOnlyErr)
+	Assert(t, readOnly.RegisterLookupTable("t", map[string]string{}), Equals, ReadOnlyErr)
+	closeTestDB(readOnly)
+	readOnly, err = OpenDBDirReadOnly(db.Dir)
+	Assert(t, err, IsNil)
+	Assert(t, readOnly.Flush(), Equals, ReadOnlyErr)
+	closeTestDB(readOnly)
+
+	newMetadata, err := ioutil.ReadFile(filepath.Join(db.Dir, MetadataFilename))
+	Assert(t, err, IsNil)
+	Assert(t, string(newMetadata), Equals, string(metadata))
+	newWAL, err := ioutil.ReadFile(filepath.Join(db.Dir, WALFilename))
+	Assert(t, err, IsNil)
+	Assert(t, string(newWAL), Equals, string(wal))
+
+	db, err = OpenDB(db.Schema)
+	Assert(t, err, IsNil)
+	defer closeTestDB(db)
+	Assert(t, db.Flush(), IsNil)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 3)
+}
@@ -0,0 +1,148 @@
+// Deleting rows which match filters.
+
+package gumshoe
+
+import (
+	"fmt"
+	"time"
+)
+
+type deleteRequest struct {
+	Filters    []QueryFilter
+	Start, End time.Time
+	Deleted    int // Set by the inserter (before sending on Err)
+	Err        chan error
+}
+
+// DeleteRows permanently deletes the rows in the time range [start, end) which match all of filters (which
+// are the same as a query's filters) and returns the number of rows deleted. Timestamps are only stored to
+// the precision of the interval duration, so a row is in the time range if its interval starts in the range.
+//
+// The memtable is flushed first. Each interval containing deleted rows is then rewritten as a new generation
+// without those rows.
+func (db *DB) DeleteRows(filters []QueryFilter, start, end time.Time) (int, error) {
+	if db.ReadOnly {
+		return 0, ReadOnlyErr
+	}
+	if !start.Before(end) {
+		return 0, fmt.Errorf("the start of the time range to delete (%s) must be before the end (%s)",
+			start, end)
+	}
+	req := &deleteRequest{Filters: filters, Start: start, End: end, Err: make(chan error)}
+	db.deletes <- req
+	err := <-req.Err
+	return req.Deleted, err
+}
+
+// deleteRows carries out req. This should only be called by the insertion goroutine.
+func (db *DB) deleteRows(req *deleteRequest) error {
+	if err := db.checkViewsCanDelete(req.Filters); err != nil {
+		return err
+	}
+	if err := db.flush(); err != nil {
+		return err
+	}
+	// The filters are made after the flush because they refer to the flushed dimension tables.
+	params, err := db.StaticTable.makeScanParams(&Query{Filters: req.Filters})
+	if err != nil {
+		return err
+	}
+
+	intervals := make(map[time.Time]*Interval)
+	var intervalsForCleanup []*Interval
+	for key, interval := range db.StaticTable.Intervals {
+		if key.Before(req.Start) || !key.Before(req.End) || !params.AllTimestampFilterFuncsMatch(key) {
+			intervals[key] = interval
+			continue
+		}
+		loaded, release, err := db.coldCache.acquire(interval)
+		if err != nil {
+			return err
+		}
+		if !db.anyRowMatches(loaded, params.FilterFuncs) {
+			release()
+			intervals[key] = interval
+			continue
+		}
+		newInterval, deleted, err := db.rewriteIntervalWithout(loaded, params.FilterFuncs)
+		release()
+		if err != nil {
+			return fmt.Errorf("cannot rewrite interval without deleted rows: %s", err)
+		}
+		req.Deleted += deleted
+		intervalsForCleanup = append(intervalsForCleanup, interval)
+		if newInterval.NumRows > 0 {
+			intervals[key] = newInterval
+		}
+	}
+	Log.Printf("Deleted %d rows from %d intervals", req.Deleted, len(intervalsForCleanup))
+	for _, view := range db.views {
+		if _, err := view.DeleteRows(req.Filters, req.Start, req.End); err != nil {
+			return fmt.Errorf("cannot delete rows from view %s: %s", view.name, err)
+		}
+	}
+	if len(intervalsForCleanup) == 0 {
+		return nil
+	}
+
+	newStaticTable := NewStaticTable(db.Schema)
+	newStaticTable.Intervals = intervals
+	newStaticTable.DimensionTables = db.StaticTable.DimensionTables
+	db.swapStaticTable(newStaticTable)
+
+	if db.DiskBacked {
+		if err := db.writeMetadataFile(); err != nil {
+			return fmt.Errorf("error writing metadata: %s", err)
+		}
+		db.cleanUpOldIntervals(intervalsForCleanup)
+	}
+	return nil
+}
+
+// matchesAll reports whether row passes every one of filters.
+func matchesAll(row RowBytes, filters []filterFunc) bool {
+	for _, filter := range filters {
+		if !filter(row) {
+			return false
+		}
+	}
+	return true
+}
+
+func (db *DB) anyRowMatches(interval *Interval, filters []filterFunc) bool {
+	var buf []byte
+	for _, segment := range interval.Segments {
+		rows := db.SegmentRows(segment, &buf)
+		for i := 0; i < len(rows); i += db.RowSize {
+			if matchesAll(RowBytes(rows[i:i+db.RowSize]), filters) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rewriteIntervalWithout writes the rows of interval which don't match filters to a fresh Interval with
+// generation interval.Generation+1. It returns the new interval and the number of rows left out.
+func (db *DB) rewriteIntervalWithout(interval *Interval, filters []filterFunc) (*Interval, int, error) {
+	newInterval := newWriteOnlyInterval(db.Schema, interval.Generation+1, interval.Start, interval.End)
+	deleted := 0
+	var buf []byte
+	for _, segment := range interval.Segments {
+		rows := db.SegmentRows(segment, &buf)
+		for i := 0; i < len(rows); i += db.RowSize {
+			row := RowBytes(rows[i : i+db.RowSize])
+			if matchesAll(row, filters) {
+				deleted += int(row.count(db.Schema))
+				continue
+			}
+			dimensions := row[db.DimensionStartOffset:db.MetricStartOffset]
+			metrics := row[db.MetricStartOffset:]
+			if err := newInterval.appendRow(db.Schema, dimensions, metrics, int(row.count(db.Schema))); err != nil {
+				return nil, 0, err
+			}
+		}
+	}
+	iv, err := newInterval.freeze(db.Schema)
+	return iv, deleted, err
+}
@@ -0,0 +1,53 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestDeleteRows(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 1.0},
+		{"at": 0.0, "dim1": "a", "metric1": 2.0},
+		{"at": 0.0, "dim1": "b", "metric1": 4.0},
+		{"at": hour(1), "dim1": "a", "metric1": 8.0},
+	})
+	// This row is only in the memtable.
+	Assert(t, db.Insert([]RowMap{{"at": hour(2), "dim1": "a", "metric1": 16.0}}), IsNil)
+
+	filters := []QueryFilter{{FilterEqual, "dim1", "a"}}
+	deleted, err := db.DeleteRows(filters, time.Unix(0, 0), time.Unix(int64(hour(1)), 0))
+	Assert(t, err, IsNil)
+	Assert(t, deleted, Equals, 2)
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 28)
+
+	// Deleting every row of an interval removes it.
+	deleted, err = db.DeleteRows(filters, time.Unix(int64(hour(1)), 0), time.Unix(int64(hour(3)), 0))
+	Assert(t, err, IsNil)
+	Assert(t, deleted, Equals, 2)
+	Assert(t, len(db.GetIntervalGenerations()), Equals, 1)
+
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+	result = runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 4)
+}
+
+func TestDeleteRowsRejectsBadRequests(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	_, err := db.DeleteRows(nil, time.Unix(10, 0), time.Unix(0, 0))
+	Assert(t, err, NotNil)
+	_, err = db.DeleteRows([]QueryFilter{{FilterEqual, "bogus", 1.0}}, time.Unix(0, 0), time.Unix(10, 0))
+	Assert(t, err, NotNil)
+}
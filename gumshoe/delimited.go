@@ -0,0 +1,105 @@
+// Writing query results in delimited text formats (CSV and TSV).
+
+package gumshoe
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// DelimitedFormat returns the field separator and HTTP content type for the query result format name ("csv"
+// or "tsv"). ok is false if name is not a delimited format.
+func DelimitedFormat(name string) (comma rune, contentType string, ok bool) {
+	switch name {
+	case "csv":
+		return ',', "text/csv; charset=utf-8", true
+	case "tsv":
+		return '\t', "text/tab-separated-values; charset=utf-8", true
+	}
+	return 0, "", false
+}
+
+// ResultColumns returns the names of the columns in q's result rows, in a stable order: the groupings, the
+// lookup labels, the aggregates, "rowCount", the expressions, and the windows.
+func (q *Query) ResultColumns() []string {
+	var columns []string
+	for _, grouping := range q.Groupings {
+		columns = append(columns, grouping.Name)
+	}
+	for _, lookup := range q.Lookups {
+		columns = append(columns, lookup.Name)
+	}
+	for _, aggregate := range q.Aggregates {
+		columns = append(columns, aggregate.Name)
+	}
+	columns = append(columns, "rowCount")
+	for _, expression := range q.Expressions {
+		columns = append(columns, expression.Name)
+	}
+	for _, window := range q.Windows {
+		columns = append(columns, window.Name)
+	}
+	return columns
+}
+
+// WriteDelimitedRows writes rows to w as delimited text, with fields separated by comma (',' for CSV or '\t'
+// for TSV). The first line is a header of column names. Null values are written as empty fields.
+func WriteDelimitedRows(w io.Writer, rows []RowMap, columns []string, comma rune) error {
+	writer, err := NewDelimitedWriter(w, columns, comma)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	return writer.Flush()
+}
+
+// A DelimitedWriter writes rows as delimited text one at a time, in the same form as WriteDelimitedRows.
+type DelimitedWriter struct {
+	writer  *csv.Writer
+	columns []string
+	record  []string
+}
+
+// NewDelimitedWriter writes the header line of column names to w and returns a DelimitedWriter for the rows.
+func NewDelimitedWriter(w io.Writer, columns []string, comma rune) (*DelimitedWriter, error) {
+	writer := csv.NewWriter(w)
+	writer.Comma = comma
+	if err := writer.Write(columns); err != nil {
+		return nil, err
+	}
+	return &DelimitedWriter{writer: writer, columns: columns, record: make([]string, len(columns))}, nil
+}
+
+// Write writes a row. The output is buffered until Flush.
+func (w *DelimitedWriter) Write(row RowMap) error {
+	for i, column := range w.columns {
+		w.record[i] = formatDelimitedValue(row[column])
+	}
+	return w.writer.Write(w.record)
+}
+
+// Flush writes any buffered rows to the underlying io.Writer.
+func (w *DelimitedWriter) Flush() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func formatDelimitedValue(value Untyped) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	case float32:
+		return strconv.FormatFloat(float64(v), 'g', -1, 32)
+	case string:
+		return v
+	}
+	return fmt.Sprint(value)
+}
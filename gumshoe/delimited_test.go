@@ -0,0 +1,30 @@
+package gumshoe
+
+import (
+	"bytes"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestWriteDelimitedRows(t *testing.T) {
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	query.Aggregates = []QueryAggregate{
+		{AggregateSum, "metric1", "metric1"},
+		{AggregateAvg, "metric1", "avgMetric1"},
+	}
+	rows := []RowMap{
+		{"dim1": "a,b", "metric1": uint32(3), "avgMetric1": 1.5, "rowCount": 2},
+		{"dim1": nil, "metric1": uint32(0), "avgMetric1": nil, "rowCount": 0},
+	}
+	Assert(t, query.ResultColumns(), DeepEquals, []string{"dim1", "metric1", "avgMetric1", "rowCount"})
+
+	var buf bytes.Buffer
+	Assert(t, WriteDelimitedRows(&buf, rows, query.ResultColumns(), ','), IsNil)
+	Assert(t, buf.String(), Equals, "dim1,metric1,avgMetric1,rowCount\n\"a,b\",3,1.5,2\n,0,,0\n")
+
+	buf.Reset()
+	Assert(t, WriteDelimitedRows(&buf, rows[:1], query.ResultColumns(), '\t'), IsNil)
+	Assert(t, buf.String(), Equals, "dim1\tmetric1\tavgMetric1\trowCount\na,b\t3\t1.5\t2\n")
+}
@@ -63,14 +63,19 @@ func (t *DimensionTable) Filename(s *Schema, index int) string {
 // Load reads a dimension table file identified by the schema directory, this dimension table's index, and the
 // table generation and loads it into t. t.Values and t.ValuesToIndex are overwritten. The size is checked
 // against t.Size.
-func (t *DimensionTable) Load(s *Schema, index int) (err error) {
-	defer func() {
-		if err == nil && len(t.Values) != t.Size {
-			err = fmt.Errorf("dimension table %q has size %d but was loaded with %d values",
-				s.DimensionColumns[index].Name, t.Size, len(t.Values))
-		}
-	}()
+func (t *DimensionTable) Load(s *Schema, index int) error {
+	if err := t.read(s, index); err != nil {
+		return err
+	}
+	if len(t.Values) != t.Size {
+		return fmt.Errorf("dimension table %q has size %d but was loaded with %d values",
+			s.DimensionColumns[index].Name, t.Size, len(t.Values))
+	}
+	return nil
+}
 
+// read is like Load, but doesn't check the size.
+func (t *DimensionTable) read(s *Schema, index int) error {
 	t.ValueToIndex = make(map[string]uint32)
 	f, err := os.Open(t.Filename(s, index))
 	if err != nil {
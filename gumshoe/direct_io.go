@@ -0,0 +1,145 @@
+// Writing segment files without going through the page cache (see RunConfig.DirectIO).
+
+package gumshoe
+
+import (
+	"errors"
+	"io"
+	"os"
+	"unsafe"
+)
+
+// directIOAlignment is the alignment O_DIRECT needs of the memory, offsets, and sizes of writes. It is the
+// largest logical block size of common disks.
+const directIOAlignment = 4096
+
+// directIOBufferSize is the size of the buffer in which a directWriter gathers small writes.
+const directIOBufferSize = 256 * directIOAlignment
+
+// errDirectIOUnsupported is returned by openDirect where O_DIRECT can't be used.
+var errDirectIOUnsupported = errors.New("direct I/O is not supported")
+
+// createSegmentFile creates (or truncates) a segment file for writing. With DirectIO, the file is written
+// with O_DIRECT if the OS and filesystem allow it, and it's synced to disk when it's closed either way.
+func (s *Schema) createSegmentFile(filename string) (io.WriteCloser, error) {
+	if s.DirectIO {
+		f, err := openDirect(filename)
+		if err == nil {
+			return newDirectWriter(f), nil
+		}
+		if err != errDirectIOUnsupported {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	if s.DirectIO {
+		return syncedFile{f}, nil
+	}
+	return f, nil
+}
+
+// A syncedFile is a file which is synced to disk when it's closed.
+type syncedFile struct {
+	*os.File
+}
+
+func (f syncedFile) Close() error {
+	if err := f.Sync(); err != nil {
+		f.File.Close()
+		return err
+	}
+	return f.File.Close()
+}
+
+// A directWriter writes a file opened with O_DIRECT. Since O_DIRECT writes must be made from aligned memory
+// in whole blocks, writes are gathered in an aligned buffer; the last, partial block is padded with zeros,
+// and the file is truncated to the right size afterwards.
+type directWriter struct {
+	f    *os.File
+	buf  []byte
+	n    int   // The number of buffered bytes
+	size int64 // The number of bytes written (without padding)
+}
+
+func newDirectWriter(f *os.File) *directWriter {
+	return &directWriter{f: f, buf: alignedBuffer(directIOBufferSize)}
+}
+
+// alignedBuffer returns a buffer of n bytes which starts at a multiple of directIOAlignment.
+func alignedBuffer(n int) []byte {
+	b := make([]byte, n+directIOAlignment)
+	offset := 0
+	if rem := int(uintptr(unsafe.Pointer(&b[0])) % directIOAlignment); rem != 0 {
+		offset = directIOAlignment - rem
+	}
+	return b[offset : offset+n]
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		written += n
+		p = p[n:]
+		if w.n == len(w.buf) {
+			if err := w.writeBuffer(w.n); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// writeBuffer writes the first padded bytes of the buffer (a multiple of directIOAlignment, including any
+// padding after the w.n buffered bytes).
+func (w *directWriter) writeBuffer(padded int) error {
+	if _, err := w.f.Write(w.buf[:padded]); err != nil {
+		return err
+	}
+	w.size += int64(w.n)
+	w.n = 0
+	return nil
+}
+
+// Close writes any buffered bytes and syncs and closes the file.
+func (w *directWriter) Close() error {
+	err := w.finish()
+	if closeErr := w.f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (w *directWriter) finish() error {
+	if w.n > 0 {
+		padded := (w.n + directIOAlignment - 1) / directIOAlignment * directIOAlignment
+		for i := w.n; i < padded; i++ {
+			w.buf[i] = 0
+		}
+		if err := w.writeBuffer(padded); err != nil {
+			return err
+		}
+		if err := w.f.Truncate(w.size); err != nil {
+			return err
+		}
+	}
+	return w.f.Sync()
+}
+
+// syncDir syncs the directory dir, so that the files which were created, renamed, or removed in it are
+// durable.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
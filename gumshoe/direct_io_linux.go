@@ -0,0 +1,19 @@
+package gumshoe
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirect creates (or truncates) filename for writing with O_DIRECT. Some filesystems, such as tmpfs,
+// reject O_DIRECT; the result is errDirectIOUnsupported for those.
+func openDirect(filename string) (*os.File, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC|syscall.O_DIRECT, 0666)
+	if err != nil {
+		if pathErr, ok := err.(*os.PathError); ok && pathErr.Err == syscall.EINVAL {
+			return nil, errDirectIOUnsupported
+		}
+		return nil, err
+	}
+	return f, nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package gumshoe
+
+import "os"
+
+func openDirect(filename string) (*os.File, error) {
+	return nil, errDirectIOUnsupported
+}
@@ -0,0 +1,59 @@
+package gumshoe
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestDirectWriter(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gumshoe-direct-io-test")
+	Assert(t, err, IsNil)
+	defer os.RemoveAll(tempDir)
+
+	// The buffer is written out in full blocks, followed by a padded partial block.
+	for _, size := range []int{0, 1, directIOAlignment, directIOBufferSize + 3*directIOAlignment + 17} {
+		contents := bytes.Repeat([]byte("gumshoe"), size/7+1)[:size]
+		filename := filepath.Join(tempDir, "segment")
+		f, err := os.Create(filename)
+		Assert(t, err, IsNil)
+		w := newDirectWriter(f)
+		for i := 0; i < size; i += 1000 {
+			end := i + 1000
+			if end > size {
+				end = size
+			}
+			_, err := w.Write(contents[i:end])
+			Assert(t, err, IsNil)
+		}
+		Assert(t, w.Close(), IsNil)
+		written, err := ioutil.ReadFile(filename)
+		Assert(t, err, IsNil)
+		Assert(t, bytes.Equal(written, contents), IsTrue)
+	}
+}
+
+func TestDirectIODB(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		db := makeCustomTestDB(true, func(schema *Schema) {
+			schema.DirectIO = true
+			schema.CompressSegments = compress
+		})
+		rows := make([]RowMap, 100)
+		for i := range rows {
+			rows[i] = RowMap{"at": 0.0, "dim1": string(rune('a' + i%26)), "metric1": float64(i)}
+		}
+		insertRows(db, rows)
+		db = reopenTestDB(db)
+		Assert(t, physicalRows(db), Equals, 26)
+		Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 4950)
+		closeTestDB(db)
+		os.RemoveAll(db.Dir)
+	}
+}
@@ -0,0 +1,94 @@
+// Query plans, which describe how a query would be executed without running it.
+
+package gumshoe
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// A QueryPlan describes the work that running a query against a StaticTable would involve.
+type QueryPlan struct {
+	// Grouping is the grouping strategy: "none", "slice" (groups are indexed by dimension value), or "map".
+	Grouping string
+	// TimestampFilters are checked once per interval, in this order, to decide whether to scan it.
+	TimestampFilters []string
+	// Filters are checked for each row of the scanned intervals, in this order.
+	Filters []string
+	// TimestampPruning is whether the timestamp filters exclude some intervals from the scan.
+	TimestampPruning bool
+	// SampleStride is n if the scan visits only every nth row of each segment (for a sampled query).
+	SampleStride int
+	// View is the name of the view (see RunConfig.Views) which answers the query, if any.
+	View string `json:",omitempty"`
+
+	IntervalsScanned int
+	IntervalsSkipped int
+	SegmentsScanned  int
+	// EstimatedRows is the number of (collapsed) rows stored in the scanned intervals. This is an upper
+	// bound on the number of rows which match the filters.
+	EstimatedRows int
+
+	Intervals []*IntervalPlan // Sorted by start time
+}
+
+// An IntervalPlan describes whether a query would scan a single interval.
+type IntervalPlan struct {
+	Start       time.Time
+	Generation  int
+	Scanned     bool
+	NumSegments int
+	NumRows     int
+}
+
+// ExplainQuery returns the plan for running query on s. The query is validated but not executed.
+func (s *StaticTable) ExplainQuery(query *Query) (*QueryPlan, error) {
+	params, err := s.makeScanParams(query)
+	if err != nil {
+		return nil, err
+	}
+	plan := &QueryPlan{Grouping: "none", SampleStride: params.SampleStride}
+	if params.Grouping != nil {
+		plan.Grouping = "map"
+		if params.Grouping.UseSlice {
+			plan.Grouping = "slice"
+		}
+	}
+	// makeScanParams compiles the filters in query order, separating out those on the timestamp column.
+	for _, filter := range query.Filters {
+		description := fmt.Sprintf("%s %s %v", filter.Column, filter.Type.name(), filter.Value)
+		if filter.Column == s.TimestampColumn.Name {
+			plan.TimestampFilters = append(plan.TimestampFilters, description)
+		} else {
+			plan.Filters = append(plan.Filters, description)
+		}
+	}
+
+	for timestamp, interval := range s.Intervals {
+		intervalPlan := &IntervalPlan{
+			Start:       timestamp,
+			Generation:  interval.Generation,
+			Scanned:     params.AllTimestampFilterFuncsMatch(timestamp),
+			NumSegments: interval.NumSegments,
+			NumRows:     interval.NumRows,
+		}
+		plan.Intervals = append(plan.Intervals, intervalPlan)
+		if !intervalPlan.Scanned {
+			plan.IntervalsSkipped++
+			continue
+		}
+		plan.IntervalsScanned++
+		plan.SegmentsScanned += intervalPlan.NumSegments
+		plan.EstimatedRows += intervalPlan.NumRows
+	}
+	plan.TimestampPruning = plan.IntervalsSkipped > 0
+	sort.Sort(intervalPlansByStart(plan.Intervals))
+	return plan, nil
+}
+
+type intervalPlansByStart []*IntervalPlan
+
+func (p intervalPlansByStart) Len() int           { return len(p) }
+func (p intervalPlansByStart) Less(i, j int) bool { return p[i].Start.Before(p[j].Start) }
+func (p intervalPlansByStart) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
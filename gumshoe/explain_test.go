@@ -0,0 +1,43 @@
+package gumshoe
+
+import (
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestExplainQuery(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 1.0},
+		{"at": hour(1), "dim1": "a", "metric1": 1.0},
+		{"at": hour(1), "dim1": "b", "metric1": 1.0},
+		{"at": hour(2), "dim1": "b", "metric1": 1.0},
+	})
+
+	query := createQuery()
+	query.Filters = []QueryFilter{
+		{FilterEqual, "dim1", "a"},
+		{FilterGreaterThenOrEqual, "at", hour(1)},
+	}
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	plan, err := db.GetQueryPlan(query)
+	Assert(t, err, IsNil)
+
+	Assert(t, plan.Grouping, Equals, "slice")
+	Assert(t, plan.TimestampFilters, DeepEquals, []string{"at >= 3600"})
+	Assert(t, plan.Filters, DeepEquals, []string{"dim1 = a"})
+	Assert(t, plan.TimestampPruning, IsTrue)
+	Assert(t, plan.IntervalsScanned, Equals, 2)
+	Assert(t, plan.IntervalsSkipped, Equals, 1)
+	Assert(t, plan.SegmentsScanned, Equals, 2)
+	Assert(t, plan.EstimatedRows, Equals, 3)
+	Assert(t, len(plan.Intervals), Equals, 3)
+	Assert(t, plan.Intervals[0].Scanned, IsFalse)
+	Assert(t, plan.Intervals[2].NumRows, Equals, 1)
+
+	query.Filters = []QueryFilter{{FilterEqual, "nonexistent", "a"}}
+	_, err = db.GetQueryPlan(query)
+	Assert(t, err, NotNil)
+}
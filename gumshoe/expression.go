@@ -0,0 +1,245 @@
+// Arithmetic expressions over aggregated query results.
+
+package gumshoe
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// A QueryExpression computes a new column for each aggregated result row from the row's other columns. The
+// expression is simple arithmetic (+, -, *, /, and parentheses) over numeric literals and column names. The
+// columns may be aggregates, "rowCount", or expressions earlier in the query. For example:
+//
+//	{"name": "ctr", "expression": "clicks / impressions"}
+//
+// If any column in the expression is null or there is a division by zero, the result is null.
+type QueryExpression struct {
+	Name       string
+	Expression string
+}
+
+// ValidateExpressions checks that each of q's expressions parses and refers only to columns that precede it.
+func (q *Query) ValidateExpressions() error {
+	names := map[string]bool{"rowCount": true}
+	for _, aggregate := range q.Aggregates {
+		names[aggregate.Name] = true
+	}
+	for _, expression := range q.Expressions {
+		e, err := parseExpression(expression.Expression)
+		if err != nil {
+			return fmt.Errorf("bad expression %q: %s", expression.Name, err)
+		}
+		for _, column := range e.columns(nil) {
+			if !names[column] {
+				return fmt.Errorf("%q (in expression %q) is not the name of an aggregate or earlier expression",
+					column, expression.Name)
+			}
+		}
+		names[expression.Name] = true
+	}
+	return nil
+}
+
+// ApplyExpressions evaluates each of query.Expressions for each row and adds the results to the rows. The
+// expressions must have been checked with ValidateExpressions.
+func ApplyExpressions(rows []RowMap, query *Query) {
+	for _, expression := range query.Expressions {
+		e, err := parseExpression(expression.Expression)
+		if err != nil {
+			panic("invalid expression")
+		}
+		for _, row := range rows {
+			if value, ok := e.eval(row); ok {
+				row[expression.Name] = value
+			} else {
+				row[expression.Name] = nil
+			}
+		}
+	}
+}
+
+// exprNode is a node in a parsed expression. eval returns false if the expression has no value for row.
+type exprNode interface {
+	eval(row RowMap) (float64, bool)
+	columns(names []string) []string
+}
+
+type (
+	exprNumber float64
+	exprColumn string
+	exprNegate struct{ x exprNode }
+	exprBinary struct {
+		op          byte
+		left, right exprNode
+	}
+)
+
+func (n exprNumber) eval(RowMap) (float64, bool)     { return float64(n), true }
+func (n exprNumber) columns(names []string) []string { return names }
+
+func (c exprColumn) eval(row RowMap) (float64, bool) {
+	value := row[string(c)]
+	if value == nil {
+		return 0, false
+	}
+	return UntypedToFloat64(value), true
+}
+
+func (c exprColumn) columns(names []string) []string { return append(names, string(c)) }
+
+func (n exprNegate) eval(row RowMap) (float64, bool) {
+	x, ok := n.x.eval(row)
+	return -x, ok
+}
+
+func (n exprNegate) columns(names []string) []string { return n.x.columns(names) }
+
+func (b exprBinary) eval(row RowMap) (float64, bool) {
+	left, ok := b.left.eval(row)
+	if !ok {
+		return 0, false
+	}
+	right, ok := b.right.eval(row)
+	if !ok {
+		return 0, false
+	}
+	switch b.op {
+	case '+':
+		return left + right, true
+	case '-':
+		return left - right, true
+	case '*':
+		return left * right, true
+	case '/':
+		if right == 0 {
+			return 0, false
+		}
+		return left / right, true
+	}
+	panic("unexpected operator")
+}
+
+func (b exprBinary) columns(names []string) []string { return b.right.columns(b.left.columns(names)) }
+
+// exprParser is a recursive descent parser for the grammar
+//
+//	expr   = term {("+" | "-") term}
+//	term   = factor {("*" | "/") factor}
+//	factor = number | column | "(" expr ")" | "-" factor
+//
+// where columns are made of letters, digits, and underscores (and don't start with a digit).
+type exprParser struct {
+	s   string
+	pos int
+}
+
+func parseExpression(s string) (exprNode, error) {
+	p := &exprParser{s: s}
+	node, err := p.parseExpr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() != 0 {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.s[p.pos], p.pos)
+	}
+	return node, nil
+}
+
+// peek skips whitespace and returns the next byte, or 0 at the end of the input.
+func (p *exprParser) peek() byte {
+	for p.pos < len(p.s) && (p.s[p.pos] == ' ' || p.s[p.pos] == '\t') {
+		p.pos++
+	}
+	if p.pos == len(p.s) {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *exprParser) parseExpr() (exprNode, error) {
+	left, err := p.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '+' && op != '-' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op, left, right}
+	}
+}
+
+func (p *exprParser) parseTerm() (exprNode, error) {
+	left, err := p.parseFactor()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.peek()
+		if op != '*' && op != '/' {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		left = exprBinary{op, left, right}
+	}
+}
+
+func (p *exprParser) parseFactor() (exprNode, error) {
+	c := p.peek()
+	switch {
+	case c == 0:
+		return nil, fmt.Errorf("unexpected end of expression")
+	case c == '(':
+		p.pos++
+		node, err := p.parseExpr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, fmt.Errorf("missing ')' at position %d", p.pos)
+		}
+		p.pos++
+		return node, nil
+	case c == '-':
+		p.pos++
+		node, err := p.parseFactor()
+		if err != nil {
+			return nil, err
+		}
+		return exprNegate{node}, nil
+	case isDigit(c) || c == '.':
+		start := p.pos
+		for p.pos < len(p.s) && (isDigit(p.s[p.pos]) || p.s[p.pos] == '.') {
+			p.pos++
+		}
+		f, err := strconv.ParseFloat(p.s[start:p.pos], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", p.s[start:p.pos])
+		}
+		return exprNumber(f), nil
+	case isIdentifierByte(c):
+		start := p.pos
+		for p.pos < len(p.s) && (isIdentifierByte(p.s[p.pos]) || isDigit(p.s[p.pos])) {
+			p.pos++
+		}
+		return exprColumn(p.s[start:p.pos]), nil
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", c, p.pos)
+}
+
+func isDigit(c byte) bool { return '0' <= c && c <= '9' }
+
+func isIdentifierByte(c byte) bool {
+	return c == '_' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
@@ -0,0 +1,40 @@
+package gumshoe
+
+import (
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestExpressionEvaluation(t *testing.T) {
+	row := RowMap{"clicks": uint64(3), "impressions": uint64(12), "revenue": 1.5, "avg": nil}
+	for _, tc := range []struct {
+		expression string
+		expected   Untyped
+	}{
+		{"clicks / impressions", 0.25},
+		{"clicks + impressions * 2", 27.0},
+		{"(clicks + impressions) * 2", 30.0},
+		{"-revenue - -1", -0.5},
+		{"1000 * revenue / impressions", 125.0},
+		{"revenue / (clicks - 3)", nil},
+		{"avg + 1", nil},
+	} {
+		e, err := parseExpression(tc.expression)
+		Assert(t, err, IsNil)
+		value, ok := e.eval(row)
+		if tc.expected == nil {
+			Assert(t, ok, IsFalse)
+			continue
+		}
+		Assert(t, ok, IsTrue)
+		Assert(t, value, Equals, tc.expected)
+	}
+}
+
+func TestExpressionParseErrors(t *testing.T) {
+	for _, s := range []string{"", "clicks /", "(clicks", "clicks impressions", "clicks % 2", "1..2"} {
+		_, err := parseExpression(s)
+		Assert(t, err, NotNil)
+	}
+}
@@ -0,0 +1,136 @@
+// Filling in empty time buckets in grouped query results.
+
+package gumshoe
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// A TimeFill asks for a query grouped by time to include a result row for every time bucket in a range, even
+// those which have no data. The empty rows have zero sums and counts (averages and percentiles are null).
+//
+// The range is Start to End, inclusive, if they're given. Otherwise, it is taken from the query's filters on
+// the timestamp column, and lacking those, from the first and last buckets in the results.
+type TimeFill struct {
+	Start *int64 `json:",omitempty"`
+	End   *int64 `json:",omitempty"`
+}
+
+// maxFillBuckets limits the number of buckets which may be filled, as a guard against mistakes such as
+// filling 1-minute buckets over years.
+const maxFillBuckets = 100000
+
+// ApplyTimeFill adds a row for each empty time bucket requested by query.Fill and returns the rows sorted by
+// time. bucket is the size of the time buckets (see Query.TimeBucketDuration). The filters of query must
+// already have been validated.
+func ApplyTimeFill(rows []RowMap, query *Query, timestampColumn string, bucket time.Duration) ([]RowMap, error) {
+	if query.Fill == nil {
+		return rows, nil
+	}
+	size := int64(bucket / time.Second)
+	name := query.Groupings[0].Name
+	existing := make(map[int64]bool)
+	first, last := int64(math.MaxInt64), int64(math.MinInt64)
+	for _, row := range rows {
+		t := int64(UntypedToFloat64(row[name]))
+		existing[t] = true
+		if t < first {
+			first = t
+		}
+		if t > last {
+			last = t
+		}
+	}
+
+	lower, upper := query.TimestampBounds(timestampColumn)
+	start, end := first, last
+	switch {
+	case query.Fill.Start != nil:
+		start = *query.Fill.Start
+	case lower != nil:
+		start = *lower
+	}
+	switch {
+	case query.Fill.End != nil:
+		end = *query.Fill.End
+	case upper != nil:
+		end = *upper
+	}
+	if start > end {
+		return rows, nil
+	}
+	start -= start % size
+	end -= end % size
+	if (end-start)/size >= maxFillBuckets {
+		return nil, fmt.Errorf("fill range is too large (more than %d buckets)", maxFillBuckets)
+	}
+
+	for t := start; t <= end; t += size {
+		if existing[t] {
+			continue
+		}
+		row := RowMap{name: t, "rowCount": 0}
+		for _, aggregate := range query.Aggregates {
+			switch aggregate.Type {
+			case AggregateSum, AggregateRate, AggregateDistinct:
+				row[aggregate.Name] = 0
+			default:
+				row[aggregate.Name] = nil
+			}
+		}
+		rows = append(rows, row)
+	}
+	sort.Sort(rowsByColumn{rows, name})
+	return rows, nil
+}
+
+// TimestampBounds returns the inclusive bounds on the timestamp implied by q's filters. Either may be nil if
+// the filters don't bound the timestamp in that direction.
+func (q *Query) TimestampBounds(timestampColumn string) (lower, upper *int64) {
+	for _, filter := range q.Filters {
+		if filter.Column != timestampColumn {
+			continue
+		}
+		switch filter.Type {
+		case FilterEqual, FilterGreaterThan, FilterGreaterThenOrEqual, FilterLessThan, FilterLessThanOrEqual:
+		default:
+			continue
+		}
+		t := int64(UntypedToFloat64(filter.Value))
+		switch filter.Type {
+		case FilterEqual:
+			lower, upper = minBound(lower, t, false), minBound(upper, t, true)
+		case FilterGreaterThan:
+			lower = minBound(lower, t+1, false)
+		case FilterGreaterThenOrEqual:
+			lower = minBound(lower, t, false)
+		case FilterLessThan:
+			upper = minBound(upper, t-1, true)
+		case FilterLessThanOrEqual:
+			upper = minBound(upper, t, true)
+		}
+	}
+	return lower, upper
+}
+
+// minBound returns the tighter of the bound b and t. If upper is false, the bounds are lower bounds.
+func minBound(b *int64, t int64, upper bool) *int64 {
+	if b == nil || (upper && t < *b) || (!upper && t > *b) {
+		return &t
+	}
+	return b
+}
+
+type rowsByColumn struct {
+	rows   []RowMap
+	column string
+}
+
+func (r rowsByColumn) Len() int { return len(r.rows) }
+func (r rowsByColumn) Less(i, j int) bool {
+	return UntypedToFloat64(r.rows[i][r.column]) < UntypedToFloat64(r.rows[j][r.column])
+}
+func (r rowsByColumn) Swap(i, j int) { r.rows[i], r.rows[j] = r.rows[j], r.rows[i] }
@@ -0,0 +1,147 @@
+// A minimal FlatBuffers builder, enough to write the metadata of Arrow IPC messages.
+
+package gumshoe
+
+import "encoding/binary"
+
+// fbBuilder builds a FlatBuffer back to front, as the reference implementations do: each object is built
+// before the objects which refer to it, and is identified by its offset from the end of the buffer.
+type fbBuilder struct {
+	buf      []byte // The tail of the finished buffer
+	minAlign int
+
+	// State for the table being built
+	fields   []int // Offset of each field; 0 if not set
+	tableEnd int   // Offset of the end of the table (before its first field is written)
+}
+
+func (b *fbBuilder) offset() int { return len(b.buf) }
+
+// prepend adds n zero bytes to the front of the buffer and returns them.
+func (b *fbBuilder) prepend(n int) []byte {
+	buf := make([]byte, n, n+len(b.buf))
+	b.buf = append(buf, b.buf...)
+	return b.buf[:n]
+}
+
+// prep pads the buffer so that after writing additional bytes, a value of the given size is aligned.
+func (b *fbBuilder) prep(size, additional int) {
+	if size > b.minAlign {
+		b.minAlign = size
+	}
+	pad := (-(len(b.buf) + additional)) & (size - 1)
+	b.prepend(pad)
+}
+
+func (b *fbBuilder) prependUint8(v uint8) {
+	b.prep(1, 0)
+	b.prepend(1)[0] = v
+}
+
+func (b *fbBuilder) prependUint16(v uint16) {
+	b.prep(2, 0)
+	binary.LittleEndian.PutUint16(b.prepend(2), v)
+}
+
+func (b *fbBuilder) prependUint32(v uint32) {
+	b.prep(4, 0)
+	binary.LittleEndian.PutUint32(b.prepend(4), v)
+}
+
+func (b *fbBuilder) prependUint64(v uint64) {
+	b.prep(8, 0)
+	binary.LittleEndian.PutUint64(b.prepend(8), v)
+}
+
+// prependOffset writes a reference to the object at off.
+func (b *fbBuilder) prependOffset(off int) {
+	b.prep(4, 0)
+	rel := b.offset() + 4 - off
+	binary.LittleEndian.PutUint32(b.prepend(4), uint32(rel))
+}
+
+func (b *fbBuilder) createString(s string) int {
+	b.prep(4, len(s)+1)
+	b.prepend(1) // NUL terminator
+	copy(b.prepend(len(s)), s)
+	b.prependUint32(uint32(len(s)))
+	return b.offset()
+}
+
+// createOffsetVector writes a vector of references to the objects at offs.
+func (b *fbBuilder) createOffsetVector(offs []int) int {
+	b.prep(4, 4*len(offs))
+	for i := len(offs) - 1; i >= 0; i-- {
+		b.prependOffset(offs[i])
+	}
+	b.prependUint32(uint32(len(offs)))
+	return b.offset()
+}
+
+// createStructVector writes a vector of structs made of pairs of int64s (Arrow's FieldNode and Buffer).
+func (b *fbBuilder) createStructVector(pairs [][2]int64) int {
+	b.prep(4, 16*len(pairs))
+	b.prep(8, 16*len(pairs))
+	for i := len(pairs) - 1; i >= 0; i-- {
+		b.prependUint64(uint64(pairs[i][1]))
+		b.prependUint64(uint64(pairs[i][0]))
+	}
+	b.prependUint32(uint32(len(pairs)))
+	return b.offset()
+}
+
+func (b *fbBuilder) startTable(numFields int) {
+	b.fields = make([]int, numFields)
+	b.tableEnd = b.offset()
+}
+
+func (b *fbBuilder) addUint8(field int, v uint8) {
+	b.prependUint8(v)
+	b.fields[field] = b.offset()
+}
+
+func (b *fbBuilder) addUint16(field int, v uint16) {
+	b.prependUint16(v)
+	b.fields[field] = b.offset()
+}
+
+func (b *fbBuilder) addUint32(field int, v uint32) {
+	b.prependUint32(v)
+	b.fields[field] = b.offset()
+}
+
+func (b *fbBuilder) addUint64(field int, v uint64) {
+	b.prependUint64(v)
+	b.fields[field] = b.offset()
+}
+
+func (b *fbBuilder) addOffset(field, off int) {
+	b.prependOffset(off)
+	b.fields[field] = b.offset()
+}
+
+// endTable writes the table's vtable (immediately before it) and returns the table's offset.
+func (b *fbBuilder) endTable() int {
+	b.prependUint32(0) // Placeholder for the vtable offset
+	table := b.offset()
+	for i := len(b.fields) - 1; i >= 0; i-- {
+		var fieldOffset uint16
+		if b.fields[i] != 0 {
+			fieldOffset = uint16(table - b.fields[i])
+		}
+		b.prependUint16(fieldOffset)
+	}
+	b.prependUint16(uint16(table - b.tableEnd))
+	b.prependUint16(uint16(2 * (len(b.fields) + 2)))
+	// The table starts with the (signed) distance back to its vtable.
+	binary.LittleEndian.PutUint32(b.buf[len(b.buf)-table:], uint32(int32(b.offset()-table)))
+	b.fields = nil
+	return table
+}
+
+// finish writes the reference to the root table and returns the finished buffer.
+func (b *fbBuilder) finish(root int) []byte {
+	b.prep(b.minAlign, 4)
+	b.prependOffset(root)
+	return b.buf
+}
@@ -9,12 +9,16 @@ import (
 	"sort"
 	"sync"
 	"time"
+
+	"github.com/philc/gumshoedb/internal/metrics"
 )
 
 // flush saves the current memTable to disk by combining with overlapping static intervals to create a new
 // StaticTable. This should only be called by the insertion goroutine.
 //
 // If db.FixedRetention is set, then flush will discard old intervals while constructing the new StaticTable.
+// Static intervals containing rows whose TTLs have expired (see RunConfig.TTLColumn) are rewritten without
+// those rows. If there is a cold store, old intervals are moved there (see RunConfig.ColdStore).
 //
 // If the result error is not nil, the state of database may not be well-defined and a user should clean up
 // any extraneous segment files not referenced by the metadata. (Note the new metadata is written at the end,
@@ -24,6 +28,7 @@ func (db *DB) flush() error {
 	start := time.Now()
 	defer func() {
 		Log.Printf("Flush completed in %s", time.Since(start))
+		metrics.Since("flush", start)
 	}()
 
 	// Collect the interval keys in the StaticTable and MemTable.
@@ -60,6 +65,7 @@ func (db *DB) flush() error {
 		return fmt.Errorf("error combining mem+static intervals: %s", err)
 	}
 	intervalsForCleanup = append(intervalsForCleanup, cleanup...)
+	movedToColdStore := db.moveColdIntervals(intervals)
 	Log.Printf("Flushing %d total intervals and cleaning up %d obsolete or out-of-retention intervals",
 		len(intervals), len(intervalsForCleanup))
 
@@ -74,20 +80,38 @@ func (db *DB) flush() error {
 	newStaticTable.Intervals = intervals
 	newStaticTable.DimensionTables = newDimTables
 
-	// Create the FlushInfo and send it over to the request handling goroutine which will make the swap and then
-	// return a chan to wait on all requests currently running on the old StaticTable.
-	allRequestsFinishedChan := make(chan chan struct{})
-	db.flushes <- &FlushInfo{NewStaticTable: newStaticTable, AllRequestsFinishedChan: allRequestsFinishedChan}
-	allRequestsFinished := <-allRequestsFinishedChan
-
-	// Wait for all requests on the old StaticTable to be done.
-	<-allRequestsFinished
+	db.swapStaticTable(newStaticTable)
 
 	if db.DiskBacked {
+		// Every WAL entry so far has been flushed. Rows held for widening a column are kept in the WAL until the
+		// DB is reopened, so they're written once, to the log which replaces this one (see writeNextWAL).
+		flushedSeq := db.walSeq
+		var nextWAL *os.File
+		if len(db.heldRows) > 0 && db.wal != nil {
+			var err error
+			if nextWAL, err = db.writeNextWAL(); err != nil {
+				return fmt.Errorf("error writing held rows to the WAL: %s", err)
+			}
+		}
 		// Write out the metadata.
+		prevFlushedSeq := db.FlushedWALSeq
+		db.FlushedWALSeq = flushedSeq
 		if err := db.writeMetadataFile(); err != nil {
+			db.FlushedWALSeq = prevFlushedSeq
+			if nextWAL != nil {
+				nextWAL.Close()
+				os.Remove(nextWAL.Name())
+			}
 			return fmt.Errorf("error writing metadata: %s", err)
 		}
+		// The flushed rows are now safely on disk (and would be skipped if the WAL were replayed).
+		if nextWAL != nil {
+			if err := db.replaceWAL(nextWAL); err != nil {
+				return fmt.Errorf("error replacing WAL: %s", err)
+			}
+		} else if err := db.truncateWAL(); err != nil {
+			return fmt.Errorf("error truncating WAL: %s", err)
+		}
 
 		// Clean up any now-unused intervals and dimension tables (only associated with previous StaticTable).
 		for _, dimTable := range oldDimTables {
@@ -96,13 +120,42 @@ func (db *DB) flush() error {
 			}
 		}
 		db.cleanUpOldIntervals(intervalsForCleanup)
+		for _, interval := range movedToColdStore {
+			interval := interval
+			db.intervalUsers.retire(interval, func() { db.removeLocalSegments(interval) })
+		}
 	}
 
 	// Replace the MemTable with a fresh, empty one.
 	db.memTable = NewMemTable(db.Schema)
+	db.backlogLock.Lock()
+	metrics.Count("flush.rows", float64(db.memTableRows))
+	db.memTableRows = 0
+	db.backlogLock.Unlock()
+	metrics.Gauge("memtable.rows", 0)
+	metrics.Gauge("memtable.bytes", 0)
+
+	for _, view := range db.views {
+		if err := view.Flush(); err != nil {
+			return fmt.Errorf("error flushing view %s: %s", view.name, err)
+		}
+	}
 	return nil
 }
 
+// swapStaticTable replaces the current StaticTable with newStaticTable. It doesn't wait for the requests on
+// the old one, which keep using its intervals; the intervals which were replaced must be cleaned up with
+// cleanUpOldIntervals. The new table's recent segments are locked into memory first (see
+// RunConfig.MlockWindow). This should only be called by the insertion goroutine.
+func (db *DB) swapStaticTable(newStaticTable *StaticTable) {
+	newStaticTable.updateSegmentLocks(time.Now())
+
+	// Send the FlushInfo over to the request handling goroutine, which makes the swap.
+	swapped := make(chan struct{})
+	db.flushes <- &FlushInfo{NewStaticTable: newStaticTable, Swapped: swapped}
+	<-swapped
+}
+
 const intervalWriterParallelism = 8
 
 type intervalWriterResponse struct {
@@ -146,21 +199,32 @@ func (db *DB) combineSortedMemStaticIntervals(memKeys, staticKeys []time.Time) (
 				err = response.err
 				continue
 			}
+			if response.interval.NumRows == 0 {
+				// All the rows expired.
+				continue
+			}
 			intervals[response.key] = response.interval
 		}
 		done <- err
 	}()
 
-	var numMemIntervals, numStaticIntervals, numCombinedIntervals int
+	now := time.Now()
+	var numMemIntervals, numStaticIntervals, numCombinedIntervals, numRewrittenIntervals int
 	for len(staticKeys) > 0 && len(memKeys) > 0 {
 		staticKey := staticKeys[0]
 		memKey := memKeys[0]
 		switch {
 		case staticKey.Before(memKey):
-			// We reuse this interval directly; the data hasn't changed.
-			numStaticIntervals++
-			intervalWriterRequests <- func() *intervalWriterResponse {
-				return &intervalWriterResponse{staticKey, db.StaticTable.Intervals[staticKey], nil}
+			if staticInterval := db.StaticTable.Intervals[staticKey]; staticInterval.expired(now) {
+				numRewrittenIntervals++
+				intervalWriterRequests <- db.rewriteStaticInterval(staticInterval)
+				intervalsForCleanup = append(intervalsForCleanup, staticInterval)
+			} else {
+				// We reuse this interval directly; the data hasn't changed.
+				numStaticIntervals++
+				intervalWriterRequests <- func() *intervalWriterResponse {
+					return &intervalWriterResponse{staticKey, staticInterval, nil}
+				}
 			}
 			staticKeys = staticKeys[1:]
 		case memKey.Before(staticKey):
@@ -178,7 +242,12 @@ func (db *DB) combineSortedMemStaticIntervals(memKeys, staticKeys []time.Time) (
 			staticInterval := db.StaticTable.Intervals[staticKey]
 			memInterval := db.memTable.Intervals[memKey]
 			intervalWriterRequests <- func() *intervalWriterResponse {
-				iv, err := db.WriteCombinedInterval(memInterval, staticInterval)
+				loaded, release, err := db.coldCache.acquire(staticInterval)
+				if err != nil {
+					return &intervalWriterResponse{staticKey, nil, err}
+				}
+				defer release()
+				iv, err := db.WriteCombinedInterval(memInterval, loaded)
 				if err != nil {
 					err = fmt.Errorf("cannot write combined interval: %s", err)
 				}
@@ -190,10 +259,17 @@ func (db *DB) combineSortedMemStaticIntervals(memKeys, staticKeys []time.Time) (
 		}
 	}
 	for _, staticKey := range staticKeys {
-		numStaticIntervals++
 		key := staticKey
+		staticInterval := db.StaticTable.Intervals[key]
+		if staticInterval.expired(now) {
+			numRewrittenIntervals++
+			intervalWriterRequests <- db.rewriteStaticInterval(staticInterval)
+			intervalsForCleanup = append(intervalsForCleanup, staticInterval)
+			continue
+		}
+		numStaticIntervals++
 		intervalWriterRequests <- func() *intervalWriterResponse {
-			return &intervalWriterResponse{key, db.StaticTable.Intervals[key], nil}
+			return &intervalWriterResponse{key, staticInterval, nil}
 		}
 	}
 	for _, memKey := range memKeys {
@@ -215,12 +291,29 @@ func (db *DB) combineSortedMemStaticIntervals(memKeys, staticKeys []time.Time) (
 		return nil, nil, err
 	}
 
-	Log.Printf("Flush: using %d mem intervals and %d static intervals as-is and combining %d intervals",
-		numMemIntervals, numStaticIntervals, numCombinedIntervals)
+	Log.Printf("Flush: using %d mem intervals and %d static intervals as-is, combining %d intervals, and "+
+		"rewriting %d intervals with expired rows",
+		numMemIntervals, numStaticIntervals, numCombinedIntervals, numRewrittenIntervals)
 
 	return intervals, intervalsForCleanup, nil
 }
 
+// rewriteStaticInterval returns an interval writer request to rewrite staticInterval without its expired rows.
+func (db *DB) rewriteStaticInterval(staticInterval *Interval) func() *intervalWriterResponse {
+	return func() *intervalWriterResponse {
+		loaded, release, err := db.coldCache.acquire(staticInterval)
+		if err != nil {
+			return &intervalWriterResponse{staticInterval.Start, nil, err}
+		}
+		defer release()
+		iv, err := db.rewriteInterval(loaded)
+		if err != nil {
+			err = fmt.Errorf("cannot rewrite interval with expired rows: %s", err)
+		}
+		return &intervalWriterResponse{staticInterval.Start, iv, err}
+	}
+}
+
 // combineDimensionTables returns a combined set of dimension tables
 // appropriate for the schema from the memtable and static table's dimension tables.
 // Any dimensions in which the memtable has no new entries are reused from the static table.
@@ -261,7 +354,8 @@ type indexedDimensionTable struct {
 }
 
 // writeMetadataFile serializes db to JSON and atomically writes it to disk by using an intermediate tempfile
-// and moving it into place.
+// and moving it into place. With DirectIO, the file and the directory are synced, so that the new metadata
+// (and the segment files it refers to) survive a crash.
 func (db *DB) writeMetadataFile() error {
 	b, err := json.MarshalIndent(db, "", "  ")
 	if err != nil {
@@ -269,25 +363,58 @@ func (db *DB) writeMetadataFile() error {
 	}
 	filename := filepath.Join(db.Dir, MetadataFilename)
 	tmpFilename := filename + ".tmp"
-	if err := ioutil.WriteFile(tmpFilename, b, 0666); err != nil {
+	if !db.DirectIO {
+		if err := ioutil.WriteFile(tmpFilename, b, 0666); err != nil {
+			return err
+		}
+		return os.Rename(tmpFilename, filename)
+	}
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	file := syncedFile{f}
+	if _, err := file.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
 		return err
 	}
-	return os.Rename(tmpFilename, filename)
+	if err := os.Rename(tmpFilename, filename); err != nil {
+		return err
+	}
+	return syncDir(db.Dir)
 }
 
+// cleanUpOldIntervals deletes the files of intervals, which have been replaced by swapStaticTable, once the
+// requests still using each of them are done.
 func (db *DB) cleanUpOldIntervals(intervals []*Interval) {
 	for _, interval := range intervals {
-		// Unmap, close, and delete all the segment files
-		for i, segment := range interval.Segments {
-			if err := segment.Bytes.Unmap(); err != nil {
-				Log.Println("cleanup error unmapping segment file:", err)
-			}
-			if err := segment.File.Close(); err != nil {
-				Log.Println("cleanup error closing segment file:", err)
+		interval := interval
+		db.intervalUsers.retire(interval, func() {
+			if interval.Cold {
+				db.removeColdInterval(interval)
+			} else {
+				db.removeLocalSegments(interval)
 			}
-			if err := os.Remove(interval.SegmentFilename(db.Schema, i)); err != nil {
-				Log.Println("cleanup error deleting segment file:", err)
+			if interval.BloomFilters {
+				if err := os.Remove(interval.BloomFilename(db.Schema)); err != nil {
+					Log.Println("cleanup error deleting bloom filter file:", err)
+				}
 			}
+		})
+	}
+}
+
+// removeLocalSegments unmaps, closes, and deletes all the segment files of interval.
+func (db *DB) removeLocalSegments(interval *Interval) {
+	for i, segment := range interval.Segments {
+		if err := segment.close(); err != nil {
+			Log.Println("cleanup error closing segment file:", err)
+		}
+		if err := os.Remove(interval.SegmentFilename(db.Schema, i)); err != nil {
+			Log.Println("cleanup error deleting segment file:", err)
 		}
 	}
 }
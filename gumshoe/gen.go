@@ -36,6 +36,11 @@ var filters = []FilterType{
 	{"FilterLessThan", "<", "<"},
 	{"FilterLessThanOrEqual", "<=", "<="},
 	{"FilterIn", "in", ""},
+	{"FilterNotIn", "not in", ""},
+	{"FilterPrefix", "prefix", ""}, // String dimensions only
+	{"FilterRegex", "regex", ""},   // String dimensions only
+	{"FilterEqualFold", "ieq", ""}, // String dimensions only; case-insensitive =
+	{"FilterInFold", "iin", ""},    // String dimensions only; case-insensitive in
 }
 
 type Type struct {
@@ -232,6 +237,14 @@ func makeGetDimensionValueAsIntFuncGen(typ Type) func(cell unsafe.Pointer) int {
 	panic("unreached")
 }
 
+func makeGetCellValueAsFloat64FuncGen(typ Type) func(cell unsafe.Pointer) float64 {
+	{{range .Types}}
+	if typ == {{.GumshoeTypeName}} {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*{{.GoName}})(cell)) }
+	}{{end}}
+	panic("unreached")
+}
+
 func makeTimestampFilterFuncSimpleGen(filter FilterType) func(timestamp uint32) timestampFilterFunc {
 	{{range $.SimpleFilterTypes}}
 	if filter == {{.GumshoeTypeName}} {
@@ -278,9 +291,11 @@ func makeDimensionFilterFuncSimpleGen(typ Type, filter FilterType, isString bool
 	panic("unreached")
 }
 
-func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, bool, int, byte, int) filterFunc {
-	{{range $type := .Types}}{{range $str := $.Bools}}
-	if typ == {{$type.GumshoeTypeName}} && isString == {{$str}} {
+// The 'in' filter funcs are also used for 'not in' filters (with negate == true).
+
+func makeDimensionFilterFuncInGen(typ Type, isString, negate bool) func(interface{}, bool, int, byte, int) filterFunc {
+	{{range $type := .Types}}{{range $str := $.Bools}}{{range $neg := $.Bools}}
+	if typ == {{$type.GumshoeTypeName}} && isString == {{$str}} && negate == {{$neg}} {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
 			var typedValues []{{$type.GoName}}
 			{{if $str}}
@@ -292,18 +307,18 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset] & mask > 0 {
-					return acceptNil
+					return {{if $neg}}!{{end}}acceptNil
 				}
 				value := *(*{{$type.GoName}})(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
-						return true
+						return {{not $neg}}
 					}
 				}
-				return false
+				return {{$neg}}
 			}
 		}
-	}{{end}}{{end}}
+	}{{end}}{{end}}{{end}}
 	panic("unreached")
 }
 
@@ -320,25 +335,25 @@ func makeMetricFilterFuncSimpleGen(typ Type, filter FilterType) func(value float
 	panic("unreached")
 }
 
-func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filterFunc {
-	{{range .Types}}
-	if typ == {{.GumshoeTypeName}} {
+func makeMetricFilterFuncInGen(typ Type, negate bool) func(floats []float64, offset int) filterFunc {
+	{{range $type := .Types}}{{range $neg := $.Bools}}
+	if typ == {{$type.GumshoeTypeName}} && negate == {{$neg}} {
 		return func(floats []float64, offset int) filterFunc {
-			typedValues := make([]{{.GoName}}, len(floats))
+			typedValues := make([]{{$type.GoName}}, len(floats))
 			for i, f := range floats {
-				typedValues[i] = {{.GoName}}(f)
+				typedValues[i] = {{$type.GoName}}(f)
 			}
 			return func(row RowBytes) bool {
-				value := *(*{{.GoName}})(unsafe.Pointer(&row[offset]))
+				value := *(*{{$type.GoName}})(unsafe.Pointer(&row[offset]))
 				for _, v := range typedValues {
 					if value == v {
-						return true
+						return {{not $neg}}
 					}
 				}
-				return false
+				return {{$neg}}
 			}
 		}
-	}{{end}}
+	}{{end}}{{end}}
 	panic("unreached")
 }
 `
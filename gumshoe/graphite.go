@@ -0,0 +1,92 @@
+// Parsing Graphite's plaintext protocol and mapping its metrics to rows.
+
+package gumshoe
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A GraphiteSample is a line of Graphite's plaintext protocol: a metric path, a value, and a time.
+type GraphiteSample struct {
+	Path  string
+	Value float64
+	Time  time.Time
+}
+
+// A GraphiteRule says how the samples of matching metric paths are inserted: each sample becomes a row with
+// its value in Column and nodes of its path in dimension columns.
+type GraphiteRule struct {
+	// Nodes is the dot-separated pattern of the matching paths, node by node. Each is either a literal node,
+	// "*" (for any node), or a dimension column in braces, such as "{host}" (for any node, which is inserted in
+	// the column).
+	Nodes  []string
+	Column string // The metric column for the samples' values
+}
+
+// ParseGraphiteLine parses a line of Graphite's plaintext protocol (path value timestamp, where timestamp is
+// a Unix time). A missing timestamp, or -1, means the time now.
+func ParseGraphiteLine(line string, now time.Time) (GraphiteSample, error) {
+	sample := GraphiteSample{Time: now}
+	fields := strings.Fields(line)
+	if len(fields) != 2 && len(fields) != 3 {
+		return sample, fmt.Errorf("bad graphite line %q (must be path value [timestamp])", line)
+	}
+	sample.Path = fields[0]
+	value, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return sample, fmt.Errorf("bad value %q for %s", fields[1], sample.Path)
+	}
+	sample.Value = value
+	if len(fields) == 3 && fields[2] != "-1" {
+		// Some emitters send fractional timestamps.
+		ts, err := strconv.ParseFloat(fields[2], 64)
+		if err != nil || ts < 0 {
+			return sample, fmt.Errorf("bad timestamp %q for %s", fields[2], sample.Path)
+		}
+		sample.Time = time.Unix(int64(ts), 0)
+	}
+	return sample, nil
+}
+
+// GraphiteRow maps sample to a row for insertion using the first of rules which matches its path. It returns
+// false if no rule matches or the value is NaN. Nodes for numeric dimension columns are parsed as numbers; a
+// row with a node which isn't a number is left for the insert to reject.
+func (s *Schema) GraphiteRow(sample GraphiteSample, rules []GraphiteRule) (RowMap, bool) {
+	if math.IsNaN(sample.Value) {
+		return nil, false
+	}
+	nodes := strings.Split(sample.Path, ".")
+	for _, rule := range rules {
+		if row, ok := rule.match(nodes); ok {
+			for column, value := range row {
+				row[column] = s.labelValue(column, value.(string))
+			}
+			row[s.TimestampColumn.Name] = float64(sample.Time.Unix())
+			row[rule.Column] = sample.Value
+			return row, true
+		}
+	}
+	return nil, false
+}
+
+// match returns the dimension values captured from a path (split into nodes) which matches r.
+func (r *GraphiteRule) match(nodes []string) (RowMap, bool) {
+	if len(nodes) != len(r.Nodes) {
+		return nil, false
+	}
+	row := make(RowMap)
+	for i, pattern := range r.Nodes {
+		switch {
+		case pattern == "*":
+		case strings.HasPrefix(pattern, "{") && strings.HasSuffix(pattern, "}"):
+			row[pattern[1:len(pattern)-1]] = nodes[i]
+		case pattern != nodes[i]:
+			return nil, false
+		}
+	}
+	return row, true
+}
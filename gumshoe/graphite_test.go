@@ -0,0 +1,50 @@
+package gumshoe
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestParseGraphiteLine(t *testing.T) {
+	now := time.Unix(100, 0)
+	sample, err := ParseGraphiteLine("servers.a.cpu 0.5 1500000000\n", now)
+	Assert(t, err, IsNil)
+	want := GraphiteSample{Path: "servers.a.cpu", Value: 0.5, Time: time.Unix(1500000000, 0)}
+	Assert(t, sample, DeepEquals, want)
+	sample, err = ParseGraphiteLine("servers.a.cpu 2 1500000000.7", now)
+	Assert(t, err, IsNil)
+	Assert(t, sample.Time, Equals, time.Unix(1500000000, 0))
+	for _, line := range []string{"servers.a.cpu 1", "servers.a.cpu 1 -1"} {
+		sample, err = ParseGraphiteLine(line, now)
+		Assert(t, err, IsNil)
+		Assert(t, sample.Time, Equals, now)
+	}
+	for _, line := range []string{"", "servers.a.cpu", "servers.a.cpu x 1", "servers.a.cpu 1 soon", "a 1 2 3"} {
+		_, err := ParseGraphiteLine(line, now)
+		Assert(t, err, NotNil)
+	}
+}
+
+func TestGraphiteRow(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	rules := []GraphiteRule{
+		{Nodes: []string{"servers", "{dim1}", "cpu", "*"}, Column: "metric1"},
+		{Nodes: []string{"servers", "*", "*"}, Column: "metric1"},
+	}
+	for _, tt := range []struct {
+		path string
+		want RowMap
+	}{
+		{"servers.a.cpu.idle", RowMap{"at": hour(1), "dim1": "a", "metric1": 3.0}},
+		{"servers.a.mem", RowMap{"at": hour(1), "metric1": 3.0}},
+		{"servers.a", nil},
+		{"servers.a.disk.used", nil},
+	} {
+		row, ok := db.GraphiteRow(GraphiteSample{Path: tt.path, Value: 3, Time: time.Unix(3600, 0)}, rules)
+		Assert(t, ok, Equals, tt.want != nil)
+		Assert(t, row, DeepEquals, tt.want)
+	}
+}
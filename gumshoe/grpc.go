@@ -0,0 +1,382 @@
+// The messages and framing of the gRPC service defined by shard.proto.
+
+package gumshoe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// GRPCContentType is the content type of gRPC requests and responses.
+const GRPCContentType = "application/grpc"
+
+// The paths of the methods of the Shard service.
+const (
+	GRPCInsertPath = "/gumshoe.Shard/Insert"
+	GRPCQueryPath  = "/gumshoe.Shard/Query"
+)
+
+// GRPCStatusTrailer is the trailer in which a shard gives the HTTP status of the request equivalent to a
+// failed call, so that the router can treat the failure just as it would the HTTP one.
+const GRPCStatusTrailer = "X-Gumshoe-Status"
+
+// gRPC status codes
+const (
+	GRPCOK                = 0
+	GRPCUnknown           = 2
+	GRPCInvalidArgument   = 3
+	GRPCDeadlineExceeded  = 4
+	GRPCNotFound          = 5
+	GRPCPermissionDenied  = 7
+	GRPCResourceExhausted = 8
+	GRPCAborted           = 10
+	GRPCUnimplemented     = 12
+	GRPCInternal          = 13
+	GRPCUnavailable       = 14
+	GRPCUnauthenticated   = 16
+)
+
+var grpcCodesByHTTPStatus = map[int]int{
+	http.StatusBadRequest:          GRPCInvalidArgument,
+	http.StatusUnauthorized:        GRPCUnauthenticated,
+	http.StatusForbidden:           GRPCPermissionDenied,
+	http.StatusNotFound:            GRPCNotFound,
+	http.StatusConflict:            GRPCAborted,
+	http.StatusTooManyRequests:     GRPCResourceExhausted,
+	http.StatusInternalServerError: GRPCInternal,
+	http.StatusNotImplemented:      GRPCUnimplemented,
+	http.StatusServiceUnavailable:  GRPCUnavailable,
+	http.StatusGatewayTimeout:      GRPCDeadlineExceeded,
+}
+
+// GRPCCodeForHTTPStatus returns the gRPC status code of a call whose equivalent HTTP request got status.
+func GRPCCodeForHTTPStatus(status int) int {
+	if status == http.StatusOK {
+		return GRPCOK
+	}
+	if code, ok := grpcCodesByHTTPStatus[status]; ok {
+		return code
+	}
+	return GRPCUnknown
+}
+
+// HTTPStatusForGRPCCode returns the HTTP status most like the gRPC status code. (It's only needed for calls
+// which fail without a GRPCStatusTrailer.)
+func HTTPStatusForGRPCCode(code int) int {
+	for status, c := range grpcCodesByHTTPStatus {
+		if c == code {
+			return status
+		}
+	}
+	return http.StatusInternalServerError
+}
+
+// EscapeGRPCMessage percent-encodes a status message for the grpc-message trailer.
+func EscapeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c < ' ' || c > '~' || c == '%' {
+			fmt.Fprintf(&b, "%%%02X", c)
+		} else {
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// UnescapeGRPCMessage decodes the value of a grpc-message trailer. Malformed escapes are left as they are.
+func UnescapeGRPCMessage(msg string) string {
+	var b []byte
+	for i := 0; i < len(msg); i++ {
+		if msg[i] == '%' && i+2 < len(msg) {
+			if c, err := strconv.ParseUint(msg[i+1:i+3], 16, 8); err == nil {
+				b = append(b, byte(c))
+				i += 2
+				continue
+			}
+		}
+		b = append(b, msg[i])
+	}
+	return string(b)
+}
+
+// WriteGRPCMessage writes msg to w as a length-prefixed gRPC message, compressed with gzip if compress is
+// true.
+func WriteGRPCMessage(w io.Writer, msg []byte, compress bool) error {
+	var flag byte
+	if compress {
+		var buf bytes.Buffer
+		gz := gzip.NewWriter(&buf)
+		if _, err := gz.Write(msg); err != nil {
+			return err
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+		msg = buf.Bytes()
+		flag = 1
+	}
+	prefix := make([]byte, 5)
+	prefix[0] = flag
+	binary.BigEndian.PutUint32(prefix[1:], uint32(len(msg)))
+	if _, err := w.Write(prefix); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+// ReadGRPCMessage reads a length-prefixed gRPC message from r, decompressing it with gzip if it's marked as
+// compressed. It returns io.EOF if there are no more messages, and an error if the message is (or
+// decompresses to) more than maxSize bytes.
+func ReadGRPCMessage(r io.Reader, maxSize int64) ([]byte, error) {
+	prefix := make([]byte, 5)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			return nil, errors.New("gRPC message is truncated")
+		}
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(prefix[1:]))
+	if size > maxSize {
+		return nil, fmt.Errorf("gRPC message of %d bytes is too large", size)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, errors.New("gRPC message is truncated")
+	}
+	switch prefix[0] {
+	case 0:
+		return msg, nil
+	case 1:
+		gz, err := gzip.NewReader(bytes.NewReader(msg))
+		if err != nil {
+			return nil, err
+		}
+		msg, err = ioutil.ReadAll(io.LimitReader(gz, maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(msg)) > maxSize {
+			return nil, fmt.Errorf("gRPC message decompresses to more than %d bytes", maxSize)
+		}
+		return msg, nil
+	}
+	return nil, fmt.Errorf("bad gRPC message compression flag %d", prefix[0])
+}
+
+// A GRPCInsertRequest is the InsertRequest of shard.proto.
+type GRPCInsertRequest struct {
+	Table       string // "" for the main DB
+	Batch       []byte // An encoded RowBatch (see EncodeRowBatch)
+	SkipInvalid bool
+	BatchID     string
+}
+
+func (m *GRPCInsertRequest) Marshal() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, m.Table)
+	b = appendProtoBytes(b, 2, m.Batch)
+	b = appendProtoBool(b, 3, m.SkipInvalid)
+	return appendProtoString(b, 4, m.BatchID)
+}
+
+func (m *GRPCInsertRequest) Unmarshal(b []byte) error {
+	return readProtoFields(b, func(r *protoReader, num uint64, wireType int) error {
+		var err error
+		switch num {
+		case 1:
+			m.Table, err = readProtoString(r, num, wireType)
+		case 2:
+			m.Batch, err = readProtoBytes(r, num, wireType)
+		case 3:
+			m.SkipInvalid, err = readProtoBool(r, num, wireType)
+		case 4:
+			m.BatchID, err = readProtoString(r, num, wireType)
+		default:
+			err = r.skip(wireType)
+		}
+		return err
+	})
+}
+
+// A GRPCInsertResponse is the InsertResponse of shard.proto.
+type GRPCInsertResponse struct {
+	Rejected  []RowError
+	Held      int
+	Duplicate bool
+}
+
+func (m *GRPCInsertResponse) Marshal() []byte {
+	var b, rowError []byte
+	for _, e := range m.Rejected {
+		rowError = appendProtoVarint(rowError[:0], 1, uint64(e.Row))
+		rowError = appendProtoString(rowError, 2, e.Error)
+		rowError = appendProtoBool(rowError, 3, e.Late)
+		rowError = appendProtoBool(rowError, 4, e.Overflow)
+		b = appendProtoBytes(b, 1, rowError)
+	}
+	b = appendProtoVarint(b, 2, uint64(m.Held))
+	return appendProtoBool(b, 3, m.Duplicate)
+}
+
+func (m *GRPCInsertResponse) Unmarshal(b []byte) error {
+	return readProtoFields(b, func(r *protoReader, num uint64, wireType int) error {
+		switch num {
+		case 1:
+			field, err := readProtoBytes(r, num, wireType)
+			if err != nil {
+				return err
+			}
+			var e RowError
+			err = readProtoFields(field, func(r *protoReader, num uint64, wireType int) error {
+				var err error
+				switch num {
+				case 1:
+					var row uint64
+					row, err = readProtoVarint(r, num, wireType)
+					e.Row = int(row)
+				case 2:
+					e.Error, err = readProtoString(r, num, wireType)
+				case 3:
+					e.Late, err = readProtoBool(r, num, wireType)
+				case 4:
+					e.Overflow, err = readProtoBool(r, num, wireType)
+				default:
+					err = r.skip(wireType)
+				}
+				return err
+			})
+			m.Rejected = append(m.Rejected, e)
+			return err
+		case 2:
+			held, err := readProtoVarint(r, num, wireType)
+			m.Held = int(held)
+			return err
+		case 3:
+			var err error
+			m.Duplicate, err = readProtoBool(r, num, wireType)
+			return err
+		}
+		return r.skip(wireType)
+	})
+}
+
+// A GRPCQueryRequest is the QueryRequest of shard.proto.
+type GRPCQueryRequest struct {
+	Table  string // "" for the main DB
+	Query  []byte // The query, as JSON
+	Sorted bool
+}
+
+func (m *GRPCQueryRequest) Marshal() []byte {
+	var b []byte
+	b = appendProtoString(b, 1, m.Table)
+	b = appendProtoBytes(b, 2, m.Query)
+	return appendProtoBool(b, 3, m.Sorted)
+}
+
+func (m *GRPCQueryRequest) Unmarshal(b []byte) error {
+	return readProtoFields(b, func(r *protoReader, num uint64, wireType int) error {
+		var err error
+		switch num {
+		case 1:
+			m.Table, err = readProtoString(r, num, wireType)
+		case 2:
+			m.Query, err = readProtoBytes(r, num, wireType)
+		case 3:
+			m.Sorted, err = readProtoBool(r, num, wireType)
+		default:
+			err = r.skip(wireType)
+		}
+		return err
+	})
+}
+
+// MarshalGRPCQueryResponse encodes a QueryResponse of shard.proto holding data, a part of a binary stream.
+func MarshalGRPCQueryResponse(data []byte) []byte { return appendProtoBytes(nil, 1, data) }
+
+// UnmarshalGRPCQueryResponse decodes a QueryResponse of shard.proto, returning its data.
+func UnmarshalGRPCQueryResponse(b []byte) ([]byte, error) {
+	var data []byte
+	err := readProtoFields(b, func(r *protoReader, num uint64, wireType int) error {
+		if num != 1 {
+			return r.skip(wireType)
+		}
+		field, err := readProtoBytes(r, num, wireType)
+		data = append(data, field...)
+		return err
+	})
+	return data, err
+}
+
+// readProtoFields passes each field of the message b to read, which must read or skip its value.
+func readProtoFields(b []byte, read func(r *protoReader, num uint64, wireType int) error) error {
+	r := &protoReader{b}
+	for !r.done() {
+		num, wireType, err := r.field()
+		if err != nil {
+			return err
+		}
+		if err := read(r, num, wireType); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readProtoBytes(r *protoReader, num uint64, wireType int) ([]byte, error) {
+	if err := expectWireType(num, wireType, protoBytes); err != nil {
+		return nil, err
+	}
+	return r.bytes()
+}
+
+func readProtoString(r *protoReader, num uint64, wireType int) (string, error) {
+	b, err := readProtoBytes(r, num, wireType)
+	return string(b), err
+}
+
+func readProtoVarint(r *protoReader, num uint64, wireType int) (uint64, error) {
+	if err := expectWireType(num, wireType, protoVarint); err != nil {
+		return 0, err
+	}
+	return r.varint()
+}
+
+func readProtoBool(r *protoReader, num uint64, wireType int) (bool, error) {
+	v, err := readProtoVarint(r, num, wireType)
+	return v != 0, err
+}
+
+// appendProtoVarint, appendProtoString, and appendProtoBool append a field unless it has the default value
+// (as proto3 does).
+func appendProtoVarint(b []byte, num uint64, v uint64) []byte {
+	if v == 0 {
+		return b
+	}
+	b = appendProtoKey(b, num, protoVarint)
+	return binary.AppendUvarint(b, v)
+}
+
+func appendProtoString(b []byte, num uint64, s string) []byte {
+	if s == "" {
+		return b
+	}
+	return appendProtoBytes(b, num, []byte(s))
+}
+
+func appendProtoBool(b []byte, num uint64, v bool) []byte {
+	if !v {
+		return b
+	}
+	return appendProtoVarint(b, num, 1)
+}
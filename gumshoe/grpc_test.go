@@ -0,0 +1,63 @@
+package gumshoe
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestGRPCMessageFraming(t *testing.T) {
+	var buf bytes.Buffer
+	Assert(t, WriteGRPCMessage(&buf, []byte("abc"), false), IsNil)
+	Assert(t, buf.Bytes(), DeepEquals, []byte{0, 0, 0, 0, 3, 'a', 'b', 'c'})
+	Assert(t, WriteGRPCMessage(&buf, bytes.Repeat([]byte("x"), 1000), true), IsNil)
+
+	msg, err := ReadGRPCMessage(&buf, 1000)
+	Assert(t, err, IsNil)
+	Assert(t, string(msg), Equals, "abc")
+	msg, err = ReadGRPCMessage(&buf, 1000)
+	Assert(t, err, IsNil)
+	Assert(t, len(msg), Equals, 1000)
+	_, err = ReadGRPCMessage(&buf, 1000)
+	Assert(t, err, Equals, io.EOF)
+
+	// Compressed or not, messages larger than the limit are rejected.
+	Assert(t, WriteGRPCMessage(&buf, bytes.Repeat([]byte("x"), 1000), true), IsNil)
+	_, err = ReadGRPCMessage(&buf, 999)
+	Assert(t, err, NotNil)
+	_, err = ReadGRPCMessage(bytes.NewReader([]byte{0, 0, 0, 0, 3, 'a'}), 1000)
+	Assert(t, err, NotNil)
+}
+
+func TestGRPCMessagesRoundTrip(t *testing.T) {
+	insert := GRPCInsertRequest{Table: "t", Batch: []byte{1, 2}, SkipInvalid: true, BatchID: "b"}
+	var decodedInsert GRPCInsertRequest
+	Assert(t, decodedInsert.Unmarshal(insert.Marshal()), IsNil)
+	Assert(t, decodedInsert, DeepEquals, insert)
+
+	inserted := GRPCInsertResponse{
+		Rejected: []RowError{{Row: 0, Error: "bad"}, {Row: 3, Error: "late", Late: true}},
+		Held:     2,
+	}
+	var decodedInserted GRPCInsertResponse
+	Assert(t, decodedInserted.Unmarshal(inserted.Marshal()), IsNil)
+	Assert(t, decodedInserted, DeepEquals, inserted)
+
+	query := GRPCQueryRequest{Query: []byte("{}"), Sorted: true}
+	var decodedQuery GRPCQueryRequest
+	Assert(t, decodedQuery.Unmarshal(query.Marshal()), IsNil)
+	Assert(t, decodedQuery, DeepEquals, query)
+
+	data, err := UnmarshalGRPCQueryResponse(MarshalGRPCQueryResponse([]byte("data")))
+	Assert(t, err, IsNil)
+	Assert(t, string(data), Equals, "data")
+}
+
+func TestGRPCMessageEscaping(t *testing.T) {
+	escaped := EscapeGRPCMessage("50% done\nüber")
+	Assert(t, escaped, Equals, "50%25 done%0A%C3%BCber")
+	Assert(t, UnescapeGRPCMessage(escaped), Equals, "50% done\nüber")
+	Assert(t, UnescapeGRPCMessage("100%"), Equals, "100%")
+}
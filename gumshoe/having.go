@@ -0,0 +1,106 @@
+// Functions for filtering aggregated query results.
+
+package gumshoe
+
+import "fmt"
+
+// ValidateHavingFilters checks that q's HavingFilters refer to aggregates or expressions (or rowCount) and
+// compare them against numeric values.
+func (q *Query) ValidateHavingFilters() error {
+	names := q.aggregateNames()
+	for _, filter := range q.HavingFilters {
+		if !names[filter.Column] {
+			return fmt.Errorf("%q (in a having filter) is not the name of an aggregate, expression, or window",
+				filter.Column)
+		}
+		switch filter.Type {
+		case FilterPrefix, FilterRegex, FilterEqualFold, FilterInFold:
+			return fmt.Errorf("%q filters cannot be used as having filters", filter.Type.name())
+		}
+		if filter.Type == FilterIn || filter.Type == FilterNotIn {
+			name := filter.Type.name()
+			values, ok := filter.Value.([]interface{})
+			if !ok {
+				return fmt.Errorf("'%s' having filters require a list for comparison; got %v", name, filter.Value)
+			}
+			for _, v := range values {
+				if _, ok := v.(float64); !ok {
+					return fmt.Errorf("'%s' having filters take numeric values only; got %v", name, v)
+				}
+			}
+			continue
+		}
+		if _, ok := filter.Value.(float64); !ok {
+			return fmt.Errorf("having filters need a numeric value for comparison; got %v", filter.Value)
+		}
+	}
+	return nil
+}
+
+// aggregateNames returns the set of names of the aggregated columns in q's results: the aggregates,
+// expressions, and rowCount.
+func (q *Query) aggregateNames() map[string]bool {
+	names := map[string]bool{"rowCount": true}
+	for _, aggregate := range q.Aggregates {
+		names[aggregate.Name] = true
+	}
+	for _, expression := range q.Expressions {
+		names[expression.Name] = true
+	}
+	for _, window := range q.Windows {
+		names[window.Name] = true
+	}
+	return names
+}
+
+// ApplyHavingFilters returns the rows which pass all of query.HavingFilters. The filters must have been
+// checked with ValidateHavingFilters. A row whose value for a filter column is nil (for instance, an average
+// over zero rows) never passes.
+func ApplyHavingFilters(rows []RowMap, query *Query) []RowMap {
+	if len(query.HavingFilters) == 0 {
+		return rows
+	}
+	var results []RowMap
+rowLoop:
+	for _, row := range rows {
+		for _, filter := range query.HavingFilters {
+			if !havingFilterMatches(filter, row[filter.Column]) {
+				continue rowLoop
+			}
+		}
+		results = append(results, row)
+	}
+	return results
+}
+
+func havingFilterMatches(filter QueryFilter, value Untyped) bool {
+	if value == nil {
+		return false
+	}
+	v := UntypedToFloat64(value)
+	if filter.Type == FilterIn || filter.Type == FilterNotIn {
+		negate := filter.Type == FilterNotIn
+		for _, x := range filter.Value.([]interface{}) {
+			if v == x.(float64) {
+				return !negate
+			}
+		}
+		return negate
+	}
+	x := filter.Value.(float64)
+	switch filter.Type {
+	case FilterEqual:
+		return v == x
+	case FilterNotEqual:
+		return v != x
+	case FilterGreaterThan:
+		return v > x
+	case FilterGreaterThenOrEqual:
+		return v >= x
+	case FilterLessThan:
+		return v < x
+	case FilterLessThanOrEqual:
+		return v <= x
+	}
+	panic("unexpected filter type")
+}
@@ -1,6 +1,9 @@
 package gumshoe
 
-import "time"
+import (
+	"io/ioutil"
+	"time"
+)
 
 func schemaFixture() *Schema {
 	return &Schema{
@@ -20,6 +23,28 @@ func makeTestDB() *DB {
 	return db
 }
 
+// makeCustomTestDB returns a DB whose schema is schemaFixture's as changed by customize (if it isn't nil). If
+// diskBacked is true, the DB is kept in a new temporary directory, which the caller should remove.
+func makeCustomTestDB(diskBacked bool, customize func(schema *Schema)) *DB {
+	schema := schemaFixture()
+	if customize != nil {
+		customize(schema)
+	}
+	if diskBacked {
+		tempDir, err := ioutil.TempDir("", "gumshoe-test")
+		if err != nil {
+			panic(err)
+		}
+		schema.DiskBacked = true
+		schema.Dir = tempDir
+	}
+	db, err := NewDB(schema)
+	if err != nil {
+		panic(err)
+	}
+	return db
+}
+
 func closeTestDB(db *DB) {
 	if err := db.Close(); err != nil {
 		panic(err)
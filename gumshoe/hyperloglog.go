@@ -0,0 +1,122 @@
+// A HyperLogLog sketch for estimating the number of distinct values of a column.
+
+package gumshoe
+
+import (
+	"encoding/base64"
+	"errors"
+	"hash/fnv"
+	"math"
+)
+
+const (
+	hyperLogLogPrecision = 12 // Number of hash bits used to pick a register
+	hyperLogLogRegisters = 1 << hyperLogLogPrecision
+)
+
+// HyperLogLog is a sketch which estimates the cardinality of the set of hashes added to it. The standard error
+// of the estimate is about 1.6%. Sketches built from the same kinds of values may be merged, so the estimate
+// for the union of several sketches can be computed without access to the original values.
+//
+// A HyperLogLog is serialized (for instance, in a JSON result from a shard) as base64-encoded registers.
+type HyperLogLog struct {
+	registers []uint8
+}
+
+func NewHyperLogLog() *HyperLogLog {
+	return &HyperLogLog{registers: make([]uint8, hyperLogLogRegisters)}
+}
+
+// Add adds a (well-distributed) 64-bit hash of a value to h.
+func (h *HyperLogLog) Add(hash uint64) {
+	index := hash >> (64 - hyperLogLogPrecision)
+	// The rank is the position of the leftmost 1 bit in the remaining bits. OR-ing in a low bit caps the rank
+	// if all the remaining bits are zero.
+	rest := hash<<hyperLogLogPrecision | 1<<(hyperLogLogPrecision-1)
+	rank := uint8(1)
+	for rest&(1<<63) == 0 {
+		rank++
+		rest <<= 1
+	}
+	if rank > h.registers[index] {
+		h.registers[index] = rank
+	}
+}
+
+// Merge combines other into h so that h estimates the cardinality of the union of the two sketches.
+func (h *HyperLogLog) Merge(other *HyperLogLog) {
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Estimate returns the approximate number of distinct hashes added to h.
+func (h *HyperLogLog) Estimate() uint64 {
+	const m = float64(hyperLogLogRegisters)
+	alpha := 0.7213 / (1 + 1.079/m)
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += 1 / float64(uint64(1)<<r)
+		if r == 0 {
+			zeros++
+		}
+	}
+	estimate := alpha * m * m / sum
+	// Use linear counting for small cardinalities, where the raw estimate is heavily biased.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// MarshalBinary encodes h as its registers.
+func (h *HyperLogLog) MarshalBinary() ([]byte, error) {
+	return append([]byte(nil), h.registers...), nil
+}
+
+// MarshalText encodes h as the base64 form of its registers.
+func (h *HyperLogLog) MarshalText() ([]byte, error) {
+	b := make([]byte, base64.StdEncoding.EncodedLen(len(h.registers)))
+	base64.StdEncoding.Encode(b, h.registers)
+	return b, nil
+}
+
+func (h *HyperLogLog) UnmarshalText(text []byte) error {
+	registers := make([]uint8, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(registers, text)
+	if err != nil {
+		return err
+	}
+	return h.UnmarshalBinary(registers[:n])
+}
+
+func (h *HyperLogLog) UnmarshalBinary(registers []byte) error {
+	if len(registers) != hyperLogLogRegisters {
+		return errors.New("serialized HyperLogLog sketch has the wrong number of registers")
+	}
+	h.registers = append([]uint8(nil), registers...)
+	return nil
+}
+
+// hashBytes returns a 64-bit hash of b suitable for adding to a HyperLogLog. FNV-1a is fast but its high bits
+// are poorly distributed for short inputs, so the result is passed through a finalizing mixer.
+func hashBytes(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+	return mix64(h.Sum64())
+}
+
+func hashString(s string) uint64 { return hashBytes([]byte(s)) }
+
+// mix64 is the 64-bit finalizer from MurmurHash3.
+func mix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb3fe1a85ec53
+	h ^= h >> 33
+	return h
+}
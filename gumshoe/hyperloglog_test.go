@@ -0,0 +1,46 @@
+package gumshoe
+
+import (
+	"math"
+	"strconv"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func checkEstimate(t *testing.T, h *HyperLogLog, expected int) {
+	estimate := float64(h.Estimate())
+	if math.Abs(estimate-float64(expected))/float64(expected) > 0.05 {
+		t.Errorf("expected an estimate within 5%% of %d; got %v", expected, estimate)
+	}
+}
+
+func TestHyperLogLogEstimate(t *testing.T) {
+	h := NewHyperLogLog()
+	Assert(t, h.Estimate(), Equals, uint64(0))
+	for _, n := range []int{10, 1000, 100000} {
+		h := NewHyperLogLog()
+		for i := 0; i < n; i++ {
+			h.Add(hashString(strconv.Itoa(i)))
+			h.Add(hashString(strconv.Itoa(i))) // Duplicates don't count
+		}
+		checkEstimate(t, h, n)
+	}
+}
+
+func TestHyperLogLogMergeAndSerialization(t *testing.T) {
+	h1 := NewHyperLogLog()
+	h2 := NewHyperLogLog()
+	for i := 0; i < 20000; i++ {
+		h1.Add(hashString(strconv.Itoa(i)))
+		h2.Add(hashString(strconv.Itoa(i + 10000)))
+	}
+	text, err := h2.MarshalText()
+	Assert(t, err, IsNil)
+	decoded := new(HyperLogLog)
+	Assert(t, decoded.UnmarshalText(text), IsNil)
+	h1.Merge(decoded)
+	checkEstimate(t, h1, 30000)
+
+	Assert(t, decoded.UnmarshalText([]byte("AAAA")), NotNil)
+}
@@ -0,0 +1,232 @@
+// Parsing InfluxDB line protocol and mapping its points to rows.
+
+package gumshoe
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An InfluxPoint is a point written in InfluxDB line protocol.
+type InfluxPoint struct {
+	Measurement string
+	Tags        map[string]string
+	Fields      map[string]Untyped // Each a float64, int64, uint64, bool, or string
+	Time        time.Time
+}
+
+// An InfluxRule says how matching Influx points are inserted: each point becomes a row with its fields in
+// metric columns and its tags in dimension columns.
+type InfluxRule struct {
+	Measurement string            // The measurement of the matching points, or "*" for any point
+	Fields      map[string]string // Field names to metric columns. Other fields are dropped.
+	// Tags maps tag names (such as _measurement, for the measurement) to dimension columns. Other tags are
+	// dropped.
+	Tags map[string]string
+}
+
+// InfluxPrecision returns the duration of a timestamp unit named by the precision parameter of an Influx
+// write: "ns" (the default, if precision is ""), "us", "ms", "s", "m", or "h". The one-letter names "n" and
+// "u" of InfluxDB 1.x are accepted too.
+func InfluxPrecision(precision string) (time.Duration, error) {
+	switch precision {
+	case "", "n", "ns":
+		return time.Nanosecond, nil
+	case "u", "us":
+		return time.Microsecond, nil
+	case "ms":
+		return time.Millisecond, nil
+	case "s":
+		return time.Second, nil
+	case "m":
+		return time.Minute, nil
+	case "h":
+		return time.Hour, nil
+	}
+	return 0, fmt.Errorf("bad precision %q", precision)
+}
+
+// ParseInfluxLines parses points written in InfluxDB line protocol, one per line, with timestamps in units
+// of precision. Points without a timestamp are given the time now. Blank lines and comments are skipped.
+func ParseInfluxLines(b []byte, precision time.Duration, now time.Time) ([]InfluxPoint, error) {
+	var points []InfluxPoint
+	for i, line := range bytes.Split(b, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		point, err := parseInfluxLine(string(line), precision, now)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", i+1, err)
+		}
+		points = append(points, point)
+	}
+	return points, nil
+}
+
+func parseInfluxLine(line string, precision time.Duration, now time.Time) (InfluxPoint, error) {
+	point := InfluxPoint{Tags: make(map[string]string), Fields: make(map[string]Untyped), Time: now}
+	end := influxIndex(line, " ", false)
+	if end < 0 {
+		return point, fmt.Errorf("no fields")
+	}
+	key, rest := line[:end], strings.TrimLeft(line[end:], " ")
+	if end = influxIndex(rest, " ", true); end >= 0 {
+		timestamp := strings.TrimSpace(rest[end:])
+		rest = rest[:end]
+		ts, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return point, fmt.Errorf("bad timestamp %q", timestamp)
+		}
+		point.Time = time.Unix(0, ts*int64(precision))
+	}
+
+	tags := influxSplit(key, ",", false)
+	if point.Measurement = influxUnescape(tags[0]); point.Measurement == "" {
+		return point, fmt.Errorf("no measurement")
+	}
+	for _, tag := range tags[1:] {
+		name, value, err := influxPair(tag)
+		if err != nil {
+			return point, err
+		}
+		point.Tags[name] = influxUnescape(value)
+	}
+	for _, field := range influxSplit(rest, ",", true) {
+		name, value, err := influxPair(field)
+		if err != nil {
+			return point, err
+		}
+		if point.Fields[name], err = parseInfluxFieldValue(value); err != nil {
+			return point, fmt.Errorf("field %q: %s", name, err)
+		}
+	}
+	return point, nil
+}
+
+// influxIndex returns the index of the first byte of s in chars which isn't escaped with a backslash (or, if
+// quotes is true, inside a quoted string), or -1 if there is none.
+func influxIndex(s, chars string, quotes bool) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case quotes && s[i] == '"':
+			quoted = !quoted
+		case !quoted && strings.IndexByte(chars, s[i]) >= 0:
+			return i
+		}
+	}
+	return -1
+}
+
+// influxSplit splits s around the bytes in chars which aren't escaped or quoted (as for influxIndex).
+func influxSplit(s, chars string, quotes bool) []string {
+	var parts []string
+	for {
+		i := influxIndex(s, chars, quotes)
+		if i < 0 {
+			return append(parts, s)
+		}
+		parts = append(parts, s[:i])
+		s = s[i+1:]
+	}
+}
+
+// influxPair splits a tag or field (name=value) and unescapes its name, but not its value.
+func influxPair(s string) (name, value string, err error) {
+	i := influxIndex(s, "=", false)
+	if i <= 0 || i == len(s)-1 {
+		return "", "", fmt.Errorf("bad tag or field %q", s)
+	}
+	return influxUnescape(s[:i]), s[i+1:], nil
+}
+
+func influxUnescape(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+func parseInfluxFieldValue(s string) (Untyped, error) {
+	switch {
+	case s[0] == '"':
+		if len(s) < 2 || s[len(s)-1] != '"' {
+			return nil, fmt.Errorf("unterminated string %s", s)
+		}
+		return influxUnescape(s[1 : len(s)-1]), nil
+	case s[len(s)-1] == 'i':
+		return strconv.ParseInt(s[:len(s)-1], 10, 64)
+	case s[len(s)-1] == 'u':
+		return strconv.ParseUint(s[:len(s)-1], 10, 64)
+	}
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	return strconv.ParseFloat(s, 64)
+}
+
+// InfluxRows maps points to rows for insertion using the first of rules which matches each point. It also
+// returns the number of points left out: those which no rule matches or which have none of their rule's
+// fields. Booleans are inserted as 1 and 0. Tag values for numeric dimension columns are parsed as numbers;
+// a row with a tag value which isn't a number (or a string field) is left for the insert to reject.
+func (s *Schema) InfluxRows(points []InfluxPoint, rules []InfluxRule) (rows []RowMap, dropped int) {
+	for _, point := range points {
+		var rule *InfluxRule
+		for i := range rules {
+			if rules[i].Measurement == "*" || rules[i].Measurement == point.Measurement {
+				rule = &rules[i]
+				break
+			}
+		}
+		if rule == nil {
+			dropped++
+			continue
+		}
+		row := make(RowMap)
+		for field, column := range rule.Fields {
+			value, ok := point.Fields[field]
+			if !ok {
+				continue
+			}
+			if b, ok := value.(bool); ok {
+				value = 0.0
+				if b {
+					value = 1.0
+				}
+			}
+			row[column] = value
+		}
+		if len(row) == 0 {
+			dropped++
+			continue
+		}
+		for tag, column := range rule.Tags {
+			value, ok := point.Tags[tag]
+			if tag == "_measurement" {
+				value, ok = point.Measurement, true
+			}
+			if ok {
+				row[column] = s.labelValue(column, value)
+			}
+		}
+		row[s.TimestampColumn.Name] = float64(point.Time.Unix())
+		rows = append(rows, row)
+	}
+	return rows, dropped
+}
@@ -0,0 +1,72 @@
+package gumshoe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestParseInfluxLines(t *testing.T) {
+	now := time.Unix(100, 0)
+	points, err := ParseInfluxLines([]byte(`# A comment
+cpu,host=a,region=us\ west usage=0.5,cores=4i,up=t,note="a \"b\", c" 1500000000
+
+my\,cpu usage=1
+`), time.Millisecond, now)
+	Assert(t, err, IsNil)
+	Assert(t, points, DeepEquals, []InfluxPoint{
+		{
+			Measurement: "cpu",
+			Tags:        map[string]string{"host": "a", "region": "us west"},
+			Fields:      map[string]Untyped{"usage": 0.5, "cores": int64(4), "up": true, "note": `a "b", c`},
+			Time:        time.Unix(1500000, 0),
+		},
+		{
+			Measurement: "my,cpu",
+			Tags:        map[string]string{},
+			Fields:      map[string]Untyped{"usage": 1.0},
+			Time:        now,
+		},
+	})
+
+	for _, line := range []string{
+		"cpu", "cpu usage", "cpu usage=x", "cpu usage=1 soon", `cpu note="a`, ",a=b c=1",
+	} {
+		_, err := ParseInfluxLines([]byte(line), time.Nanosecond, now)
+		Assert(t, err, NotNil)
+	}
+}
+
+func TestInfluxRows(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	points, err := ParseInfluxLines([]byte(`cpu,host=a usage=3,up=true 3600
+cpu,host=b up=false 7201
+cpu,host=c other=1 3600
+mem,host=a used=1 3600
+`), time.Second, time.Now())
+	Assert(t, err, IsNil)
+	rules := []InfluxRule{
+		{
+			Measurement: "cpu",
+			Fields:      map[string]string{"usage": "metric1"},
+			Tags:        map[string]string{"host": "dim1"},
+		},
+		{Measurement: "cpu", Fields: map[string]string{"up": "metric1"}},
+	}
+	rows, dropped := db.InfluxRows(points, rules)
+	// The first rule matches every cpu point, so those without usage are dropped, as is the mem point.
+	Assert(t, dropped, Equals, 3)
+	Assert(t, rows, DeepEquals, []RowMap{{"at": hour(1), "dim1": "a", "metric1": 3.0}})
+
+	rules[0].Fields = map[string]string{"up": "metric1"}
+	rules[0].Tags = map[string]string{"_measurement": "dim1"}
+	rows, dropped = db.InfluxRows(points, rules)
+	Assert(t, dropped, Equals, 2)
+	Assert(t, rows[1], DeepEquals, RowMap{"at": hour(2) + 1, "dim1": "cpu", "metric1": 0.0})
+	insertRows(db, rows[1:])
+	Assert(t, runQuery(db, createQuery())[0]["rowCount"], util.DeepConvertibleEquals, 1)
+}
@@ -2,9 +2,11 @@ package gumshoe
 
 import (
 	"bytes"
+	"fmt"
 	"time"
 
 	"github.com/philc/gumshoedb/internal/b"
+	"github.com/philc/gumshoedb/internal/metrics"
 )
 
 type insertionRow struct {
@@ -19,23 +21,119 @@ func (db *DB) HandleInserts() {
 		case <-db.shutdown:
 			return
 		case insert := <-db.inserts:
-			insert.Err <- db.insertRows(insert.Rows)
+			if db.batchIDSet[insert.BatchID] {
+				insert.Err <- DuplicateBatchErr
+				continue
+			}
+			if err := db.appendWAL(insert.BatchID, insert.Rows, insert.SkipInvalid); err != nil {
+				insert.Err <- fmt.Errorf("cannot write to the WAL: %s", err)
+				continue
+			}
+			var lateCutoff time.Time
+			if db.LateArrivalWindow > 0 {
+				lateCutoff = time.Now().Add(-db.LateArrivalWindow)
+			}
+			held := len(db.heldRows)
+			rowErrors, err := db.insertRows(insert.Rows, insert.SkipInvalid, lateCutoff)
+			insert.HeldRows = len(db.heldRows) - held
+			if viewErr := db.insertIntoViews(); err == nil {
+				err = viewErr
+			}
+			insert.RowErrors = rowErrors
+			if err == nil {
+				db.addBatchID(insert.BatchID)
+			}
+			insert.Err <- err
 		case errCh := <-db.flushSignals:
 			errCh <- db.flush()
+		case req := <-db.deletes:
+			req.Err <- db.deleteRows(req)
+		case req := <-db.rollups:
+			req.Err <- db.rollup(req)
+		case req := <-db.retentions:
+			req.Err <- db.setRetention(req)
 		}
 	}
 }
 
-// insertRows puts each row into the memtable, combining with other rows if possible. This should only be
-// called by the insertion goroutine.
-func (db *DB) insertRows(rows []UnpackedRow) error {
+// A LateRowError is the error for inserting a row whose timestamp is further in the past than the DB's late
+// arrival window (see RunConfig.LateArrivalWindow).
+type LateRowError struct {
+	Timestamp time.Time
+	Window    time.Duration
+}
+
+func (e *LateRowError) Error() string {
+	return fmt.Sprintf("row timestamp (%s) is older than the late arrival window (%s)",
+		e.Timestamp.UTC().Format(time.RFC3339), e.Window)
+}
+
+// addBatchID records the ID of a successfully inserted batch, forgetting the oldest ID if there are more than
+// maxBatchIDs. This should only be called by the insertion goroutine.
+func (db *DB) addBatchID(id string) {
+	if id == "" || db.batchIDSet[id] {
+		return
+	}
+	db.BatchIDs = append(db.BatchIDs, id)
+	db.batchIDSet[id] = true
+	if len(db.BatchIDs) > maxBatchIDs {
+		delete(db.batchIDSet, db.BatchIDs[0])
+		db.BatchIDs = db.BatchIDs[1:]
+	}
+}
+
+// insertRows puts each row into the memtable, combining with other rows if possible. Rows are invalid if they
+// cannot be serialized or (if lateCutoff is not zero) if they are timestamped before lateCutoff. If
+// skipInvalid is true, invalid rows are skipped and described in rowErrors; otherwise, insertRows stops at
+// the first one. Rows which overflow a string dimension column are always held or skipped (see
+// RunConfig.StringOverflow). This should only be called by the insertion goroutine.
+func (db *DB) insertRows(rows []UnpackedRow, skipInvalid bool, lateCutoff time.Time) (rowErrors []RowError,
+	err error) {
+
 	Log.Printf("Inserting %d rows", len(rows))
 	insertedRows := 0
 	droppedOldRows := 0
-	for _, unpackedRow := range rows {
+	overflowRows := 0
+	heldRows := 0
+	newRows := 0 // Rows which were not combined with existing memtable rows
+	defer func() {
+		db.backlogLock.Lock()
+		db.memTableRows += newRows
+		memTableRows := db.memTableRows
+		db.backlogLock.Unlock()
+		metrics.Count("insert.rows", float64(insertedRows))
+		metrics.Count("insert.dropped", float64(droppedOldRows))
+		metrics.Count("insert.overflow", float64(overflowRows))
+		metrics.Gauge("memtable.rows", float64(memTableRows))
+		metrics.Gauge("memtable.bytes", float64(memTableRows*db.RowSize))
+	}()
+	for i, unpackedRow := range rows {
+		// Check for late rows before serializing, which may add values to the dimension tables.
+		if timestamp, ok := numericValue(unpackedRow.RowMap[db.TimestampColumn.Name]); ok && !lateCutoff.IsZero() &&
+			time.Unix(int64(timestamp), 0).Before(lateCutoff) {
+			err := &LateRowError{time.Unix(int64(timestamp), 0), db.LateArrivalWindow}
+			if skipInvalid {
+				rowErrors = append(rowErrors, RowError{Row: i, Error: err.Error(), Late: true})
+				continue
+			}
+			return nil, err
+		}
 		row, err := db.serializeRowMap(unpackedRow.RowMap)
+		if overflow, ok := err.(*StringOverflowError); ok {
+			overflowRows++
+			if db.holdForPromotion(unpackedRow, overflow) {
+				heldRows++
+			} else {
+				rowErrors = append(rowErrors, RowError{Row: i, Error: err.Error(), Overflow: true})
+			}
+			continue
+		}
 		if err != nil {
-			return err
+			if skipInvalid {
+				rowErrors = append(rowErrors, RowError{Row: i, Error: err.Error()})
+				continue
+			}
+			return nil, err
 		}
 		db.latestTimestampLock.Lock()
 		if row.Timestamp.After(db.latestTimestamp) {
@@ -48,6 +146,11 @@ func (db *DB) insertRows(rows []UnpackedRow) error {
 			droppedOldRows++
 			continue
 		}
+		if expiry, ok := db.rowExpiry(row.Dimensions, timestamp.Add(db.IntervalDuration)); ok &&
+			!expiry.After(time.Now()) {
+			droppedOldRows++
+			continue
+		}
 
 		interval, ok := db.memTable.Intervals[timestamp]
 		if !ok {
@@ -69,12 +172,17 @@ func (db *DB) insertRows(rows []UnpackedRow) error {
 				Count:  unpackedRow.Count,
 				Metric: []byte(row.Metrics),
 			}
+			newRows++
 		}
 		interval.Tree.Set([]byte(row.Dimensions), value)
 		insertedRows++
+		if len(db.views) > 0 {
+			db.viewRows = append(db.viewRows, unpackedRow)
+		}
 	}
-	Log.Printf("Inserted %d rows succesfully; dropped %d out-of-retention rows", insertedRows, droppedOldRows)
-	return nil
+	Log.Printf("Inserted %d rows succesfully; dropped %d out-of-retention rows and %d invalid rows; "+
+		"held %d rows", insertedRows, droppedOldRows, len(rowErrors), heldRows)
+	return rowErrors, nil
 }
 
 func (db *DB) intervalStartOutOfRetention(timestamp time.Time) bool {
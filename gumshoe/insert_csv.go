@@ -0,0 +1,171 @@
+// Reading rows to insert from CSV.
+
+package gumshoe
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// csvInsertBatchSize is the number of rows InsertCSV inserts at once.
+const csvInsertBatchSize = 10000
+
+// A CSVReader reads rows for insertion from CSV which starts with a header row of column names.
+type CSVReader struct {
+	r       *csv.Reader
+	columns []csvColumn // For each CSV field
+	row     int         // The index of the next row (not counting the header)
+}
+
+type csvColumn struct {
+	name     string // The schema column, or "" if the field is ignored
+	isTime   bool
+	isString bool
+}
+
+// NewCSVReader reads the header row from r and maps each CSV column to a column of s. If mapping is nil,
+// the CSV columns must be named the same as the schema columns. Otherwise, mapping gives the schema column
+// for each CSV column name, and CSV columns missing from mapping are ignored.
+func (s *Schema) NewCSVReader(r io.Reader, mapping map[string]string) (*CSVReader, error) {
+	reader := csv.NewReader(r)
+	reader.ReuseRecord = true
+	header, err := reader.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, fmt.Errorf("CSV has no header row")
+		}
+		return nil, err
+	}
+	c := &CSVReader{r: reader, columns: make([]csvColumn, len(header))}
+	seen := make(map[string]bool)
+	for i, field := range header {
+		name := field
+		if mapping != nil {
+			if name = mapping[field]; name == "" {
+				continue
+			}
+		}
+		if s.isDroppedColumn(name) {
+			continue
+		}
+		column := csvColumn{name: name}
+		if name == s.TimestampColumn.Name {
+			column.isTime = true
+		} else if index, ok := s.DimensionNameToIndex[name]; ok {
+			column.isString = s.DimensionColumns[index].String
+		} else if _, ok := s.MetricNameToIndex[name]; !ok {
+			return nil, fmt.Errorf("CSV column %q: %q is not a valid column name", field, name)
+		}
+		if seen[name] {
+			return nil, fmt.Errorf("CSV column %q: more than one CSV column maps to %q", field, name)
+		}
+		seen[name] = true
+		c.columns[i] = column
+	}
+	return c, nil
+}
+
+// Read returns the next row. Empty fields are left out of the row (that is, they are nil for dimensions and
+// 0 for metrics). Timestamps may be Unix times or RFC 3339 times; the other numeric values may be any
+// numbers. At the end of the input, Read returns io.EOF.
+func (c *CSVReader) Read() (RowMap, error) {
+	record, err := c.r.Read()
+	if err != nil {
+		if err == io.EOF {
+			return nil, err
+		}
+		return nil, fmt.Errorf("CSV row %d: %s", c.row, err)
+	}
+	row := make(RowMap, len(record))
+	for i, field := range record {
+		column := c.columns[i]
+		if column.name == "" || field == "" {
+			continue
+		}
+		if column.isString {
+			row[column.name] = field
+			continue
+		}
+		// Integers are kept as json.Numbers, so that 64-bit integers are inserted exactly.
+		if _, err := strconv.ParseInt(field, 10, 64); err == nil {
+			row[column.name] = json.Number(field)
+			continue
+		}
+		if _, err := strconv.ParseUint(field, 10, 64); err == nil {
+			row[column.name] = json.Number(field)
+			continue
+		}
+		value, err := strconv.ParseFloat(field, 64)
+		if err != nil && column.isTime {
+			var t time.Time
+			if t, err = time.Parse(time.RFC3339, field); err == nil {
+				value = float64(t.Unix())
+			}
+		}
+		if err != nil {
+			return nil, fmt.Errorf("CSV row %d: bad value %q for column %q", c.row, field, column.name)
+		}
+		row[column.name] = value
+	}
+	c.row++
+	return row, nil
+}
+
+// ParseCSVMapping parses a mapping for NewCSVReader from pairs of the form "csvColumn:schemaColumn" (as
+// given in the map parameters of an insert). It returns nil if there are no pairs.
+func ParseCSVMapping(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	mapping := make(map[string]string)
+	for _, pair := range pairs {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf(`bad CSV column mapping %q (expected "csvColumn:schemaColumn")`, pair)
+		}
+		mapping[parts[0]] = parts[1]
+	}
+	return mapping, nil
+}
+
+// InsertCSV inserts the rows of CSV read from r (see Schema.NewCSVReader for the format and the meaning of
+// mapping). Rows are inserted in batches as they are read, so that large inputs aren't held in memory.
+// InsertCSV returns the number of rows inserted; if there is an error, the rows before the bad one may have
+// been inserted.
+func (db *DB) InsertCSV(r io.Reader, mapping map[string]string) (int, error) {
+	reader, err := db.Schema.NewCSVReader(r, mapping)
+	if err != nil {
+		return 0, err
+	}
+	inserted := 0
+	batch := make([]RowMap, 0, csvInsertBatchSize)
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return inserted, err
+		}
+		batch = append(batch, row)
+		if len(batch) == csvInsertBatchSize {
+			if err := db.Insert(batch); err != nil {
+				return inserted, err
+			}
+			inserted += len(batch)
+			batch = make([]RowMap, 0, csvInsertBatchSize)
+		}
+	}
+	if len(batch) > 0 {
+		if err := db.Insert(batch); err != nil {
+			return inserted, err
+		}
+		inserted += len(batch)
+	}
+	return inserted, nil
+}
@@ -0,0 +1,61 @@
+package gumshoe
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestInsertCSV(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	csv := "at,dim1,metric1\n" +
+		"0,string1,1\n" +
+		"1970-01-01T00:00:00Z,string2,2\n" +
+		"0,,3\n"
+	n, err := db.InsertCSV(strings.NewReader(csv), nil)
+	Assert(t, err, IsNil)
+	Assert(t, n, Equals, 3)
+	Assert(t, db.Flush(), IsNil)
+
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepEqualsUnordered, []RowMap{
+		{"dim1": "string1", "metric1": 1, "rowCount": 1},
+		{"dim1": "string2", "metric1": 2, "rowCount": 1},
+		{"dim1": nil, "metric1": 3, "rowCount": 1},
+	})
+}
+
+func TestInsertCSVWithMapping(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	csv := "time,name,clicks,ignored\n0,string1,5,x\n"
+	mapping := map[string]string{"time": "at", "name": "dim1", "clicks": "metric1"}
+	n, err := db.InsertCSV(strings.NewReader(csv), mapping)
+	Assert(t, err, IsNil)
+	Assert(t, n, Equals, 1)
+	Assert(t, db.Flush(), IsNil)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 5)
+}
+
+func TestInsertCSVErrors(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	_, err := db.InsertCSV(strings.NewReader("at,bogus\n0,1\n"), nil)
+	Assert(t, err.Error(), Equals, `CSV column "bogus": "bogus" is not a valid column name`)
+
+	n, err := db.InsertCSV(strings.NewReader("at,metric1\n0,1\n0,abc\n"), nil)
+	Assert(t, n, Equals, 0)
+	Assert(t, err.Error(), Equals, `CSV row 1: bad value "abc" for column "metric1"`)
+
+	_, err = ParseCSVMapping([]string{"time"})
+	Assert(t, err, NotNil)
+}
@@ -0,0 +1,363 @@
+// Encoding and decoding row batches for insertion in the protobuf format defined by rows.proto.
+
+package gumshoe
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"sort"
+	"strconv"
+)
+
+// ProtobufContentType is the content type of a RowBatch (see rows.proto) sent to /insert.
+const ProtobufContentType = "application/x-protobuf"
+
+// IsProtobufContentType reports whether contentType (the value of a Content-Type header) is
+// ProtobufContentType.
+func IsProtobufContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && mediaType == ProtobufContentType
+}
+
+// Protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// Field numbers from rows.proto
+const (
+	protoBatchRows   = 1
+	protoRowColumns  = 1
+	protoEntryKey    = 1
+	protoEntryValue  = 2
+	protoValueNumber = 1
+	protoValueInt    = 2
+	protoValueUint   = 3
+	protoValueString = 4
+)
+
+var errProtoTruncated = errors.New("protobuf row batch is truncated")
+
+// protoReader reads the fields of one protobuf message.
+type protoReader struct {
+	b []byte
+}
+
+func (r *protoReader) done() bool { return len(r.b) == 0 }
+
+func (r *protoReader) varint() (uint64, error) {
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		return 0, errProtoTruncated
+	}
+	r.b = r.b[n:]
+	return v, nil
+}
+
+// field reads the key of the next field.
+func (r *protoReader) field() (num uint64, wireType int, err error) {
+	key, err := r.varint()
+	if err != nil {
+		return 0, 0, err
+	}
+	return key >> 3, int(key & 7), nil
+}
+
+func (r *protoReader) bytes() ([]byte, error) {
+	n, err := r.varint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(len(r.b)) {
+		return nil, errProtoTruncated
+	}
+	b := r.b[:n]
+	r.b = r.b[n:]
+	return b, nil
+}
+
+func (r *protoReader) fixed64() (uint64, error) {
+	if len(r.b) < 8 {
+		return 0, errProtoTruncated
+	}
+	v := binary.LittleEndian.Uint64(r.b)
+	r.b = r.b[8:]
+	return v, nil
+}
+
+// skip skips the value of a field of an unknown type.
+func (r *protoReader) skip(wireType int) error {
+	var err error
+	switch wireType {
+	case protoVarint:
+		_, err = r.varint()
+	case protoFixed64:
+		_, err = r.fixed64()
+	case protoBytes:
+		_, err = r.bytes()
+	case protoFixed32:
+		if len(r.b) < 4 {
+			return errProtoTruncated
+		}
+		r.b = r.b[4:]
+	default:
+		return fmt.Errorf("unsupported protobuf wire type %d", wireType)
+	}
+	return err
+}
+
+// expectWireType checks the wire type of a known field.
+func expectWireType(num uint64, wireType, want int) error {
+	if wireType != want {
+		return fmt.Errorf("protobuf field %d has wire type %d (expected %d)", num, wireType, want)
+	}
+	return nil
+}
+
+// DecodeRowBatch decodes a protobuf RowBatch into rows for insertion. Doubles become float64s, integers
+// become json.Numbers (so that 64-bit integers are exact, as with a JSON decoder using UseNumber), and
+// strings become strings; empty Values become nils.
+func DecodeRowBatch(b []byte) ([]RowMap, error) {
+	var rows []RowMap
+	r := &protoReader{b}
+	for !r.done() {
+		num, wireType, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		if num != protoBatchRows {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := expectWireType(num, wireType, protoBytes); err != nil {
+			return nil, err
+		}
+		rowBytes, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		row, err := decodeProtoRow(rowBytes)
+		if err != nil {
+			return nil, fmt.Errorf("row %d: %s", len(rows), err)
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func decodeProtoRow(b []byte) (RowMap, error) {
+	row := make(RowMap)
+	r := &protoReader{b}
+	for !r.done() {
+		num, wireType, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		if num != protoRowColumns {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := expectWireType(num, wireType, protoBytes); err != nil {
+			return nil, err
+		}
+		entry, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		name, value, err := decodeProtoColumn(entry)
+		if err != nil {
+			return nil, err
+		}
+		row[name] = value
+	}
+	return row, nil
+}
+
+// decodeProtoColumn decodes a map entry of Row.columns.
+func decodeProtoColumn(b []byte) (name string, value Untyped, err error) {
+	r := &protoReader{b}
+	for !r.done() {
+		num, wireType, err := r.field()
+		if err != nil {
+			return "", nil, err
+		}
+		switch num {
+		case protoEntryKey, protoEntryValue:
+			if err := expectWireType(num, wireType, protoBytes); err != nil {
+				return "", nil, err
+			}
+			field, err := r.bytes()
+			if err != nil {
+				return "", nil, err
+			}
+			if num == protoEntryKey {
+				name = string(field)
+			} else if value, err = decodeProtoValue(field); err != nil {
+				return "", nil, fmt.Errorf("column %q: %s", name, err)
+			}
+		default:
+			if err := r.skip(wireType); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	return name, value, nil
+}
+
+func decodeProtoValue(b []byte) (Untyped, error) {
+	var value Untyped
+	r := &protoReader{b}
+	for !r.done() {
+		num, wireType, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		switch num {
+		case protoValueNumber:
+			if err := expectWireType(num, wireType, protoFixed64); err != nil {
+				return nil, err
+			}
+			bits, err := r.fixed64()
+			if err != nil {
+				return nil, err
+			}
+			value = math.Float64frombits(bits)
+		case protoValueInt, protoValueUint:
+			if err := expectWireType(num, wireType, protoVarint); err != nil {
+				return nil, err
+			}
+			v, err := r.varint()
+			if err != nil {
+				return nil, err
+			}
+			if num == protoValueInt {
+				i := int64(v>>1) ^ -int64(v&1) // zigzag
+				value = json.Number(strconv.FormatInt(i, 10))
+			} else {
+				value = json.Number(strconv.FormatUint(v, 10))
+			}
+		case protoValueString:
+			if err := expectWireType(num, wireType, protoBytes); err != nil {
+				return nil, err
+			}
+			s, err := r.bytes()
+			if err != nil {
+				return nil, err
+			}
+			value = string(s)
+		default:
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return value, nil
+}
+
+// EncodeRowBatch encodes rows as a protobuf RowBatch. Row values may be nil, strings, json.Numbers, or any of
+// Go's numeric types (integers are encoded as integers, and so keep their precision); columns are written in
+// sorted order.
+func EncodeRowBatch(rows []RowMap) ([]byte, error) {
+	var batch, row, entry, value []byte
+	for i, rowMap := range rows {
+		names := make([]string, 0, len(rowMap))
+		for name := range rowMap {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		row = row[:0]
+		for _, name := range names {
+			var err error
+			if value, err = appendProtoValue(value[:0], rowMap[name]); err != nil {
+				return nil, fmt.Errorf("row %d: column %q: %s", i, name, err)
+			}
+			entry = appendProtoBytes(entry[:0], protoEntryKey, []byte(name))
+			entry = appendProtoBytes(entry, protoEntryValue, value)
+			row = appendProtoBytes(row, protoRowColumns, entry)
+		}
+		batch = appendProtoBytes(batch, protoBatchRows, row)
+	}
+	return batch, nil
+}
+
+func appendProtoKey(b []byte, num uint64, wireType int) []byte {
+	return binary.AppendUvarint(b, num<<3|uint64(wireType))
+}
+
+func appendProtoBytes(b []byte, num uint64, field []byte) []byte {
+	b = appendProtoKey(b, num, protoBytes)
+	b = binary.AppendUvarint(b, uint64(len(field)))
+	return append(b, field...)
+}
+
+func appendProtoValue(b []byte, v Untyped) ([]byte, error) {
+	switch v := v.(type) {
+	case nil:
+		return b, nil
+	case string:
+		return appendProtoBytes(b, protoValueString, []byte(v)), nil
+	case float64:
+		return appendProtoDouble(b, v), nil
+	case float32:
+		return appendProtoDouble(b, float64(v)), nil
+	case int:
+		return appendProtoInt(b, int64(v)), nil
+	case int8:
+		return appendProtoInt(b, int64(v)), nil
+	case int16:
+		return appendProtoInt(b, int64(v)), nil
+	case int32:
+		return appendProtoInt(b, int64(v)), nil
+	case int64:
+		return appendProtoInt(b, v), nil
+	case uint:
+		return appendProtoUint(b, uint64(v)), nil
+	case uint8:
+		return appendProtoUint(b, uint64(v)), nil
+	case uint16:
+		return appendProtoUint(b, uint64(v)), nil
+	case uint32:
+		return appendProtoUint(b, uint64(v)), nil
+	case uint64:
+		return appendProtoUint(b, v), nil
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 64); err == nil {
+			return appendProtoInt(b, i), nil
+		}
+		if u, err := strconv.ParseUint(string(v), 10, 64); err == nil {
+			return appendProtoUint(b, u), nil
+		}
+		f, err := v.Float64()
+		if err != nil {
+			return nil, err
+		}
+		return appendProtoDouble(b, f), nil
+	}
+	return nil, fmt.Errorf("unsupported value type %T", v)
+}
+
+func appendProtoDouble(b []byte, v float64) []byte {
+	b = appendProtoKey(b, protoValueNumber, protoFixed64)
+	return binary.LittleEndian.AppendUint64(b, math.Float64bits(v))
+}
+
+func appendProtoInt(b []byte, v int64) []byte {
+	b = appendProtoKey(b, protoValueInt, protoVarint)
+	return binary.AppendUvarint(b, uint64(v<<1)^uint64(v>>63)) // zigzag
+}
+
+func appendProtoUint(b []byte, v uint64) []byte {
+	b = appendProtoKey(b, protoValueUint, protoVarint)
+	return binary.AppendUvarint(b, v)
+}
@@ -0,0 +1,68 @@
+package gumshoe
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestEncodeRowBatch(t *testing.T) {
+	b, err := EncodeRowBatch([]RowMap{{"a": uint32(1)}})
+	Assert(t, err, IsNil)
+	// RowBatch{rows: [Row{columns: {"a": Value{uint_value: 1}}}]}
+	Assert(t, b, DeepEquals, []byte{0x0a, 0x09, 0x0a, 0x07, 0x0a, 0x01, 'a', 0x12, 0x02, 0x18, 0x01})
+}
+
+func TestRowBatchRoundTrip(t *testing.T) {
+	rows := []RowMap{
+		{"at": 1400000000, "dim1": "string1", "metric1": uint32(4000000000)},
+		{"at": 1400000000, "dim1": nil, "metric1": -2.5},
+		{},
+	}
+	b, err := EncodeRowBatch(rows)
+	Assert(t, err, IsNil)
+	decoded, err := DecodeRowBatch(b)
+	Assert(t, err, IsNil)
+	Assert(t, decoded, DeepEquals, []RowMap{
+		{"at": json.Number("1400000000"), "dim1": "string1", "metric1": json.Number("4000000000")},
+		{"at": json.Number("1400000000"), "dim1": nil, "metric1": -2.5},
+		{},
+	})
+}
+
+func TestRowBatchLargeIntegers(t *testing.T) {
+	rows := []RowMap{{"a": uint64(1<<64 - 1), "b": int64(-1 << 63), "c": json.Number("9007199254740993")}}
+	b, err := EncodeRowBatch(rows)
+	Assert(t, err, IsNil)
+	decoded, err := DecodeRowBatch(b)
+	Assert(t, err, IsNil)
+	Assert(t, decoded, DeepEquals, []RowMap{{
+		"a": json.Number("18446744073709551615"),
+		"b": json.Number("-9223372036854775808"),
+		"c": json.Number("9007199254740993"),
+	}})
+}
+
+func TestDecodeRowBatchErrors(t *testing.T) {
+	b, err := EncodeRowBatch([]RowMap{{"dim1": "string1"}})
+	Assert(t, err, IsNil)
+	_, err = DecodeRowBatch(b[:len(b)-1])
+	Assert(t, err, NotNil)
+}
+
+func TestInsertProtobufRows(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	b, err := EncodeRowBatch([]RowMap{{"at": 0, "dim1": "string1", "metric1": uint32(3)}})
+	Assert(t, err, IsNil)
+	rows, err := DecodeRowBatch(b)
+	Assert(t, err, IsNil)
+	insertRows(db, rows)
+
+	results := runQuery(db, createQuery())
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 3)
+}
@@ -1,7 +1,8 @@
 package gumshoe
 
 import (
-	"io/ioutil"
+	"context"
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -141,11 +142,42 @@ func TestInsertOverflow(t *testing.T) {
 	for i := 0; i < 257; i++ {
 		rows = append(rows, RowMap{"at": hour(0), "dim1": strconv.Itoa(i), "metric1": 1.0})
 	}
-	Assert(t, db.Insert(rows), NotNil)
+	// Only the row which overflows the dimension table is rejected (see RejectStringOverflow).
+	Assert(t, db.Insert(rows), IsNil)
+	Assert(t, db.Flush(), IsNil)
+	Assert(t, len(db.GetDimensionTables()["dim1"]), Equals, 256)
 	rows = []RowMap{{"at": hour(0), "dim1": "0", "metric1": 1000.0}}
 	Assert(t, db.Insert(rows), NotNil)
 }
 
+func TestInsertExact64BitIntegers(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	schema := *db.Schema
+	closeTestDB(db)
+	Assert(t, os.RemoveAll(schema.Dir), IsNil)
+	schema.DimensionColumns = []DimensionColumn{makeDimensionColumn("dim1", "int64", false)}
+	schema.MetricColumns = []MetricColumn{makeMetricColumn("metric1", "uint64")}
+	schema.Initialize()
+	db, err := NewDB(&schema)
+	Assert(t, err, IsNil)
+
+	// These aren't exact as float64s. The rows go through the WAL, which keeps them exact too.
+	rows := []RowMap{
+		{"at": json.Number("0"), "dim1": json.Number("-9007199254740993"), "metric1": json.Number("1")},
+		{"at": 0.0, "dim1": json.Number("-9007199254740993"), "metric1": json.Number("18446744073709551613")},
+	}
+	Assert(t, db.Insert(rows), IsNil)
+	crashTestDB(db)
+	db, err = NewDB(&schema)
+	Assert(t, err, IsNil)
+	defer closeTestDB(db)
+	Assert(t, db.Flush(), IsNil)
+	Assert(t, db.GetDebugRows(), DeepEquals, []UnpackedRow{
+		{RowMap{"at": uint32(0), "dim1": int64(-9007199254740993), "metric1": uint64(18446744073709551614)}, 2},
+	})
+}
+
 func TestInsertDropsRowsOutOfRetention(t *testing.T) {
 	db := makeTestDB()
 	db.FixedRetention = true
@@ -161,20 +193,7 @@ func TestInsertDropsRowsOutOfRetention(t *testing.T) {
 	Assert(t, db.GetDebugRows(), util.DeepEqualsUnordered, []UnpackedRow{{rows[0], 1}})
 }
 
-func makeTestPersistentDB() *DB {
-	tempDir, err := ioutil.TempDir("", "gumshoe-persistence-test")
-	if err != nil {
-		panic(err)
-	}
-	schema := schemaFixture()
-	schema.DiskBacked = true
-	schema.Dir = tempDir
-	db, err := NewDB(schema)
-	if err != nil {
-		panic(err)
-	}
-	return db
-}
+func makeTestPersistentDB() *DB { return makeCustomTestDB(true, nil) }
 
 func physicalRows(db *DB) int {
 	resp := db.MakeRequest()
@@ -232,3 +251,131 @@ func TestOldIntervalsAreDeleted(t *testing.T) {
 		t.Fatalf("expected segment file at %s to exist", secondGenSegmentFilename)
 	}
 }
+
+func TestReplacedIntervalsOutliveRequests(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	defer closeTestDB(db)
+
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": hour(1), "dim1": "string1", "metric1": 1.0},
+	})
+	oldSegmentFilename := filepath.Join(db.Dir, "interval.0.generation0000.segment0000.dat")
+
+	// A request holding the old StaticTable doesn't hold up a flush replacing one of its intervals.
+	resp := db.MakeRequest()
+	insertRow(db, RowMap{"at": 0.0, "dim1": "string1", "metric1": 2.0})
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 4)
+	_, err := os.Stat(oldSegmentFilename)
+	Assert(t, err, IsNil)
+	result, err := resp.StaticTable.InvokeQuery(context.Background(), createQuery())
+	Assert(t, err, IsNil)
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 2)
+
+	// The old interval is cleaned up once the request is done.
+	resp.Done()
+	_, err = os.Stat(oldSegmentFilename)
+	Assert(t, os.IsNotExist(err), IsTrue)
+	_, err = os.Stat(filepath.Join(db.Dir, "interval.3600.generation0000.segment0000.dat"))
+	Assert(t, err, IsNil)
+}
+
+func TestDuplicateBatchesAreIgnored(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	rows := []RowMap{{"at": 0.0, "dim1": "string1", "metric1": 1.0}}
+	Assert(t, db.InsertBatch("a", rows), IsNil)
+	Assert(t, db.InsertBatch("a", rows), Equals, DuplicateBatchErr)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, db.InsertBatch("b", rows), IsNil)
+	crashTestDB(db)
+
+	// The batch IDs are remembered across the flush and the WAL replay.
+	db, err := OpenDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	Assert(t, db.InsertBatch("a", rows), Equals, DuplicateBatchErr)
+	Assert(t, db.InsertBatch("b", rows), Equals, DuplicateBatchErr)
+	Assert(t, db.InsertBatch("c", rows), IsNil)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 3)
+}
+
+func TestInsertBacklogIsClearedByFlush(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	Assert(t, db.Insert([]RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": 0.0, "dim1": "string2", "metric1": 1.0},
+	}), IsNil)
+	rows, bytes := db.GetInsertBacklog()
+	Assert(t, rows, Equals, 2) // The first two rows are combined
+	Assert(t, bytes, Equals, 2*db.RowSize)
+
+	Assert(t, db.Flush(), IsNil)
+	rows, bytes = db.GetInsertBacklog()
+	Assert(t, rows, Equals, 0)
+	Assert(t, bytes, Equals, 0)
+}
+
+func TestInsertSkippingInvalidRows(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	rowErrors, err := db.InsertSkippingInvalid("", []RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": 0.0, "dim1": "string1", "bogus": 1.0},
+		{"at": 0.0, "dim1": 3.0, "metric1": 1.0},
+		{"at": 0.0, "dim1": "string2", "metric1": 2.0},
+	})
+	Assert(t, err, IsNil)
+	Assert(t, len(rowErrors), Equals, 2)
+	Assert(t, rowErrors[0].Row, Equals, 1)
+	Assert(t, rowErrors[1].Row, Equals, 2)
+	Assert(t, rowErrors[1].Error, Equals, "expected string value for dimension dim1")
+
+	Assert(t, db.Flush(), IsNil)
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 3)
+}
+
+func TestLateRowsAreRejected(t *testing.T) {
+	schema := schemaFixture()
+	schema.LateArrivalWindow = time.Hour
+	db, err := NewDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+
+	now := float64(time.Now().Unix())
+	twoHoursAgo := float64(time.Now().Add(-2 * time.Hour).Unix())
+	err = db.Insert([]RowMap{{"at": twoHoursAgo, "dim1": "a", "metric1": 1.0}})
+	lateErr, ok := err.(*LateRowError)
+	Assert(t, ok, IsTrue)
+	Assert(t, lateErr.Window, Equals, time.Hour)
+
+	rowErrors, err := db.InsertSkippingInvalid("", []RowMap{
+		{"at": now, "dim1": "a", "metric1": 1.0},
+		{"at": twoHoursAgo, "dim1": "b", "metric1": 2.0},
+	})
+	Assert(t, err, IsNil)
+	Assert(t, len(rowErrors), Equals, 1)
+	Assert(t, rowErrors[0].Row, Equals, 1)
+	Assert(t, rowErrors[0].Late, IsTrue)
+
+	// The late row's dimension value was not added.
+	Assert(t, db.Flush(), IsNil)
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"a"})
+}
@@ -3,6 +3,8 @@ package gumshoe
 import (
 	"bytes"
 	"fmt"
+	"hash"
+	"hash/crc32"
 	"io"
 	"math"
 	"os"
@@ -14,10 +16,154 @@ import (
 )
 
 // A Segment is an immutable chunk of memory that is part of the data in an interval. It may be backed by a
-// memory-mapped file.
+// memory-mapped file. Bytes holds the segment as it's stored, so the rows of a compressed segment (see
+// segment_codec.go) are only decoded, and those of a segment with an old row layout (see Interval.Layout)
+// only converted, when they're read; use Schema.SegmentRows to get the rows.
 type Segment struct {
 	File  *os.File // Nil if this segment is not backed by a file
 	Bytes mmap.MMap
+
+	compressed bool    // Whether Bytes is encoded by Schema.encodeSegment
+	layout     *Schema // The schema with the old row layout of Bytes, or nil if it has the schema's layout
+	locked     bool    // Whether Bytes is locked into memory (see StaticTable.updateSegmentLocks)
+}
+
+// SegmentRows returns the rows of seg, a segment of an interval of a DB with schema s, in s's row layout. The
+// rows of a compressed segment or one with an old row layout are decoded into *buf, which is reused (and
+// grown as needed) by each call, or into a new slice if buf is nil; they're only valid until buf is next
+// used.
+func (s *Schema) SegmentRows(seg *Segment, buf *[]byte) []byte {
+	if !seg.compressed && seg.layout == nil {
+		return seg.Bytes
+	}
+	var dst []byte
+	if buf != nil {
+		dst = *buf
+	}
+	var rows []byte
+	if seg.layout == nil {
+		rows = s.decodeSegmentRows(dst, seg)
+	} else if !seg.compressed {
+		rows = s.convertRows(dst, seg.layout, seg.Bytes)
+	} else {
+		decoded := scanBuffers.Get().(*[]byte)
+		*decoded = seg.layout.decodeSegmentRows(*decoded, seg)
+		rows = s.convertRows(dst, seg.layout, *decoded)
+		scanBuffers.Put(decoded)
+	}
+	if buf != nil {
+		*buf = rows
+	}
+	return rows
+}
+
+// decodeSegmentRows decodes the rows of a compressed segment with s's row layout into dst (see
+// decodeSegment).
+func (s *Schema) decodeSegmentRows(dst []byte, seg *Segment) []byte {
+	rows, err := s.decodeSegment(dst, seg.Bytes)
+	if err != nil {
+		// The segment was decoded when it was loaded, unless segment verification is turned off.
+		panic(err)
+	}
+	return rows
+}
+
+// segmentNumRows returns the number of rows of seg without decoding them.
+func (s *Schema) segmentNumRows(seg *Segment) int {
+	stored := s
+	if seg.layout != nil {
+		stored = seg.layout
+	}
+	if !seg.compressed {
+		return len(seg.Bytes) / stored.RowSize
+	}
+	// The header was checked when the segment was loaded.
+	numRows, _, _ := stored.readSegmentHeader(seg.Bytes)
+	return numRows
+}
+
+// close unmaps and closes the segment's file, if it has one.
+func (seg *Segment) close() error {
+	if seg.File == nil {
+		return nil
+	}
+	if err := seg.Bytes.Unmap(); err != nil {
+		return err
+	}
+	return seg.File.Close()
+}
+
+// segmentChecksumTable is used for the checksums of segment files (Interval.Checksums).
+var segmentChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// loadSegment opens segment i of iv. The segment file is memory-mapped, and a compressed one is left encoded.
+// If verify is true, the segment file is checked against its checksum (if iv has checksums), and a
+// compressed one is decoded once to check it.
+func (s *Schema) loadSegment(iv *Interval, i int, verify bool) (*Segment, error) {
+	return s.loadSegmentFile(iv, i, iv.SegmentFilename(s, i), verify)
+}
+
+// loadSegmentFile is like loadSegment, but reads segment i of iv from filename rather than from s.Dir.
+func (s *Schema) loadSegmentFile(iv *Interval, i int, filename string, verify bool) (*Segment, error) {
+	if iv.Layout != 0 {
+		return s.loadOldLayoutSegmentFile(iv, i, filename, verify)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	mapped, err := mmap.Map(f, mmap.RDONLY, 0)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	segment := &Segment{File: f, Bytes: mapped, compressed: iv.Compressed}
+	s.adviseSegment(segment)
+	switch {
+	case iv.Compressed:
+		if _, _, err = s.readSegmentHeader(mapped); err != nil {
+			err = &CorruptSegmentError{filename, err.Error()}
+		}
+	case len(mapped)%s.RowSize != 0:
+		err = &CorruptSegmentError{filename, "its size is not a multiple of the row size"}
+	}
+	if err == nil && verify {
+		err = iv.verifySegment(filename, i, mapped)
+	}
+	if err == nil && verify && iv.Compressed {
+		buf := scanBuffers.Get().(*[]byte)
+		if *buf, err = s.decodeSegment(*buf, mapped); err != nil {
+			err = &CorruptSegmentError{filename, err.Error()}
+		}
+		scanBuffers.Put(buf)
+	}
+	if err != nil {
+		segment.close()
+		return nil, err
+	}
+	return segment, nil
+}
+
+// A CorruptSegmentError is returned when opening a DB with a damaged segment file.
+type CorruptSegmentError struct {
+	Filename string
+	Problem  string
+}
+
+func (e *CorruptSegmentError) Error() string {
+	return fmt.Sprintf("segment file %s is corrupt: %s", e.Filename, e.Problem)
+}
+
+// verifySegment checks the contents of segment file i against its checksum. Intervals written before
+// checksums were added have none, and aren't checked.
+func (iv *Interval) verifySegment(filename string, i int, contents []byte) error {
+	if i >= len(iv.Checksums) {
+		return nil
+	}
+	if crc32.Checksum(contents, segmentChecksumTable) != iv.Checksums[i] {
+		return &CorruptSegmentError{filename, "checksum mismatch"}
+	}
+	return nil
 }
 
 type Interval struct {
@@ -27,6 +173,46 @@ type Interval struct {
 	Segments    []*Segment `json:"-"`
 	NumSegments int        // Maintained separately for JSON encoding
 	NumRows     int
+	Compressed  bool `json:",omitempty"` // Whether the segment files are compressed (see segment_codec.go)
+
+	// Cold is set if the segment files have been moved to the cold store (see RunConfig.ColdStore). The
+	// segments of a cold interval aren't loaded; they're fetched into the DB's coldCache when needed.
+	Cold bool `json:",omitempty"`
+
+	// The CRC-32C checksum of each segment file (as stored, so compressed if Compressed). Nil if the interval
+	// isn't disk-backed or was written before checksums were added.
+	Checksums []uint32 `json:",omitempty"`
+
+	// The zone map of each segment, used to skip segments in scans. Nil if the interval was written before zone
+	// maps were added.
+	ZoneMaps []ZoneMap `json:",omitempty"`
+
+	// BloomFilters is set if the interval has a bloom filter file (see RunConfig.BloomFilterColumns). The bloom
+	// filters are loaded into blooms, which has an entry for each segment.
+	BloomFilters bool `json:",omitempty"`
+	blooms       []segmentBloomFilters
+
+	// Layout identifies the row layout of the interval if it was written before the schema's columns were
+	// changed (see Schema.CheckColumnChanges): it is one more than the index of the layout in Schema.Layouts.
+	// It's 0 if the interval has the schema's row layout. The segments of an interval with an old layout are
+	// converted to the schema's row layout as they're loaded, so they're never memory-mapped.
+	Layout int `json:",omitempty"`
+
+	// Rollup is the number of rollup rules (RunConfig.Rollups) which have been applied to the interval's rows.
+	// It's 0 if the interval hasn't been rolled up, or has been rewritten with new rows since.
+	Rollup int `json:",omitempty"`
+	// DimensionRetention is the number of dimension retention rules (RunConfig.DimensionRetention) which have
+	// been applied to the interval's rows, likewise.
+	DimensionRetention int `json:",omitempty"`
+
+	// The earliest time at which a row expires because of its TTL (see RunConfig.TTLColumn); nil if no rows
+	// have TTLs.
+	Expiry *time.Time `json:",omitempty"`
+}
+
+// expired reports whether any rows of iv have expired by now.
+func (iv *Interval) expired(now time.Time) bool {
+	return iv.Expiry != nil && !iv.Expiry.After(now)
 }
 
 // An intervalCursor holds the necessary state to iterate through all the keys of an Interval, in order,
@@ -38,6 +224,7 @@ type intervalCursor struct {
 	Interval     *Interval
 	SegmentIndex int
 	Offset       int
+	rows         []byte // The rows of the segment before SegmentIndex
 }
 
 func (iv *Interval) cursor(s *Schema) *intervalCursor {
@@ -50,19 +237,19 @@ func (iv *Interval) cursor(s *Schema) *intervalCursor {
 // Next reads forward throught the Interval and returns the next key/val pair with count. ok indicates whether
 // iteration should stop.
 func (ic *intervalCursor) Next() (key, val []byte, count int, more bool) {
-	if ic.SegmentIndex >= len(ic.Interval.Segments) {
-		return nil, nil, 0, false
-	}
-	segment := ic.Interval.Segments[ic.SegmentIndex]
-	if ic.Offset >= len(segment.Bytes) {
+	for ic.Offset >= len(ic.rows) {
+		if ic.SegmentIndex >= len(ic.Interval.Segments) {
+			return nil, nil, 0, false
+		}
+		// Each segment is decoded into a fresh slice, since the caller may still be using the last key.
+		ic.rows = ic.SegmentRows(ic.Interval.Segments[ic.SegmentIndex], nil)
 		ic.Offset = 0
 		ic.SegmentIndex++
-		return ic.Next()
 	}
 
-	key = segment.Bytes[ic.Offset+ic.DimensionStartOffset : ic.Offset+ic.MetricStartOffset]
-	val = segment.Bytes[ic.Offset+ic.MetricStartOffset : ic.Offset+ic.RowSize]
-	count = int(*(*uint32)(unsafe.Pointer(&segment.Bytes[ic.Offset])))
+	key = ic.rows[ic.Offset+ic.DimensionStartOffset : ic.Offset+ic.MetricStartOffset]
+	val = ic.rows[ic.Offset+ic.MetricStartOffset : ic.Offset+ic.RowSize]
+	count = int(*(*uint32)(unsafe.Pointer(&ic.rows[ic.Offset])))
 	ic.Offset += ic.RowSize
 	return key, val, count, true
 }
@@ -76,16 +263,25 @@ type writeOnlyInterval struct {
 	CurSegment     io.Writer
 	CurSegmentSize int
 	buffers        []*bytes.Buffer // Used if !DiskBacked
+	curFile        io.WriteCloser  // The file of the current segment, if it's written directly to disk
+	curChecksum    hash.Hash32     // The checksum of curFile
+	zoneMaps       *zoneMapWriter
+	bloomValues    *bloomFilterWriter
+	now            time.Time // Rows which have expired by now are left out
 }
 
-func newWriteOnlyInterval(diskBacked bool, generation int, start, end time.Time) *writeOnlyInterval {
+func newWriteOnlyInterval(s *Schema, generation int, start, end time.Time) *writeOnlyInterval {
 	return &writeOnlyInterval{
 		Interval: Interval{
 			Generation: generation,
 			Start:      start,
 			End:        end,
+			Compressed: s.DiskBacked && s.CompressSegments,
 		},
-		DiskBacked: diskBacked,
+		DiskBacked:  s.DiskBacked,
+		zoneMaps:    newZoneMapWriter(s),
+		bloomValues: newBloomFilterWriter(s),
+		now:         time.Now(),
 	}
 }
 
@@ -107,10 +303,18 @@ func (iv *writeOnlyInterval) writeKeyValCount(key, val []byte, count uint32) err
 
 // appendRow appends a new row with count to interval. (It writes multiple rows if the count is too large to
 // represent directly). Rows must be inserted in increasing key (dimension) order, with one call for each row
-// of a given key.
+// of a given key. A row whose TTL has expired is skipped.
 func (iv *writeOnlyInterval) appendRow(s *Schema, dimensions, metrics []byte, count int) error {
+	if expiry, ok := s.rowExpiry(dimensions, iv.End); ok {
+		if !expiry.After(iv.now) {
+			return nil
+		}
+		if iv.Expiry == nil || expiry.Before(*iv.Expiry) {
+			iv.Expiry = &expiry
+		}
+	}
 	if iv.CurSegmentSize+s.RowSize > s.SegmentSize {
-		if err := iv.closeCurrentSegment(); err != nil {
+		if err := iv.closeCurrentSegment(s); err != nil {
 			return err
 		}
 		iv.CurSegmentSize = 0
@@ -126,14 +330,28 @@ func (iv *writeOnlyInterval) appendRow(s *Schema, dimensions, metrics []byte, co
 		panic("count greater than MaxUint32 is unrepresentable with uint32 for column count")
 	}
 	iv.CurSegmentSize += s.RowSize
+	iv.zoneMaps.add(iv.ZoneMaps[len(iv.ZoneMaps)-1], dimensions)
+	iv.bloomValues.add(dimensions)
 	return iv.writeKeyValCount(dimensions, metrics, uint32(count))
 }
 
-// freeze opens segment files as readonly mmaps and returns an immutable *Interval. iv should not be used
+// freeze opens segment files as readonly mmaps and returns an immutable *Interval. With VerifySegmentsAlways,
+// the mapped files are checked against the checksums computed as they were written. iv should not be used
 // after calling freeze.
 func (iv *writeOnlyInterval) freeze(s *Schema) (*Interval, error) {
-	if err := iv.closeCurrentSegment(); err != nil {
-		return nil, err
+	if iv.CurSegment != nil {
+		if err := iv.closeCurrentSegment(s); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(iv.blooms) > 0 {
+		iv.BloomFilters = true
+		if iv.DiskBacked {
+			if err := iv.storeBloomFilters(s); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	iv.Segments = make([]*Segment, iv.NumSegments)
@@ -142,49 +360,70 @@ func (iv *writeOnlyInterval) freeze(s *Schema) (*Interval, error) {
 			iv.Segments[i] = &Segment{Bytes: iv.buffers[i].Bytes()}
 			continue
 		}
-		filename := iv.SegmentFilename(s, i)
-		f, err := os.Open(filename)
-		if err != nil {
-			return nil, err
-		}
-		mapped, err := mmap.Map(f, mmap.RDONLY, 0)
+		segment, err := s.loadSegment(&iv.Interval, i, s.SegmentVerification == VerifySegmentsAlways)
 		if err != nil {
 			return nil, err
 		}
-		iv.Segments[i] = &Segment{File: f, Bytes: mapped}
+		iv.Segments[i] = segment
 	}
 	return &iv.Interval, nil
 }
 
 func (iv *writeOnlyInterval) openFreshSegment(s *Schema) error {
 	defer func() { iv.NumSegments++ }()
+	iv.ZoneMaps = append(iv.ZoneMaps, make(ZoneMap, len(s.DimensionColumns)))
 
-	if !iv.DiskBacked {
+	if !iv.DiskBacked || iv.Compressed {
 		iv.CurSegment = new(bytes.Buffer)
 		return nil
 	}
 
-	filename := iv.SegmentFilename(s, iv.NumSegments)
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	f, err := s.createSegmentFile(iv.SegmentFilename(s, iv.NumSegments))
 	if err != nil {
 		return err
 	}
-	iv.CurSegment = f
+	iv.curFile = f
+	iv.curChecksum = crc32.New(segmentChecksumTable)
+	iv.CurSegment = io.MultiWriter(f, iv.curChecksum)
 	return nil
 }
 
-func (iv *writeOnlyInterval) closeCurrentSegment() error {
-	if iv.DiskBacked {
-		return iv.CurSegment.(*os.File).Close()
+func (iv *writeOnlyInterval) closeCurrentSegment(s *Schema) error {
+	if len(s.BloomFilterIndexes) > 0 {
+		iv.blooms = append(iv.blooms, iv.bloomValues.finishSegment())
 	}
-	iv.buffers = append(iv.buffers, iv.CurSegment.(*bytes.Buffer))
-	return nil
+	if iv.curFile != nil {
+		iv.Checksums = append(iv.Checksums, iv.curChecksum.Sum32())
+		err := iv.curFile.Close()
+		iv.curFile = nil
+		return err
+	}
+	buf := iv.CurSegment.(*bytes.Buffer)
+	if !iv.Compressed {
+		iv.buffers = append(iv.buffers, buf)
+		return nil
+	}
+	// The rows aren't kept; freeze maps the encoded file like any other.
+	encoded := s.encodeSegment(buf.Bytes())
+	iv.Checksums = append(iv.Checksums, crc32.Checksum(encoded, segmentChecksumTable))
+	f, err := s.createSegmentFile(iv.SegmentFilename(s, iv.NumSegments-1))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(encoded); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 func (iv *Interval) SegmentFilename(s *Schema, segmentIndex int) string {
-	name := fmt.Sprintf("interval.%d.generation%04d.segment%04d.dat",
-		iv.Start.Unix(), iv.Generation, segmentIndex)
-	return filepath.Join(s.Dir, name)
+	return filepath.Join(s.Dir, iv.segmentName(segmentIndex))
+}
+
+// segmentName is the base name of a segment file. Cold segment files have the same name in the cold store.
+func (iv *Interval) segmentName(segmentIndex int) string {
+	return fmt.Sprintf("interval.%d.generation%04d.segment%04d.dat", iv.Start.Unix(), iv.Generation, segmentIndex)
 }
 
 // WriteMemInterval writes out the data in memInterval to a fresh Interval with generation 0. Note that no
@@ -194,7 +433,7 @@ func (s *Schema) WriteMemInterval(memInterval *MemInterval) (*Interval, error) {
 	if err != nil {
 		return nil, err
 	}
-	interval := newWriteOnlyInterval(s.DiskBacked, 0, memInterval.Start, memInterval.End)
+	interval := newWriteOnlyInterval(s, 0, memInterval.Start, memInterval.End)
 	for {
 		key, val, err := cursor.Next()
 		if err != nil {
@@ -210,6 +449,24 @@ func (s *Schema) WriteMemInterval(memInterval *MemInterval) (*Interval, error) {
 	return interval.freeze(s)
 }
 
+// rewriteInterval writes out the rows of staticInterval which have not expired (see RunConfig.TTLColumn) to a
+// fresh Interval with generation staticInterval.Generation+1.
+func (s *Schema) rewriteInterval(staticInterval *Interval) (*Interval, error) {
+	interval := newWriteOnlyInterval(s, staticInterval.Generation+1,
+		staticInterval.Start, staticInterval.End)
+	cursor := staticInterval.cursor(s)
+	for {
+		key, val, count, more := cursor.Next()
+		if !more {
+			break
+		}
+		if err := interval.appendRow(s, key, val, count); err != nil {
+			return nil, err
+		}
+	}
+	return interval.freeze(s)
+}
+
 // WriteCombinedInterval writes out the combined data from memInterval and staticInterval to a fresh Interval
 // with generation staticInterval.Generation+1.
 func (s *Schema) WriteCombinedInterval(memInterval *MemInterval,
@@ -226,7 +483,7 @@ func (s *Schema) WriteCombinedInterval(memInterval *MemInterval,
 		return nil, err
 	}
 	staticCursor := staticInterval.cursor(s)
-	interval := newWriteOnlyInterval(s.DiskBacked, staticInterval.Generation+1,
+	interval := newWriteOnlyInterval(s, staticInterval.Generation+1,
 		memInterval.Start, memInterval.End)
 
 	// Do an initial read from both mem and static, then loop and compare, advancing one or both (a classic
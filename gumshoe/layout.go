@@ -0,0 +1,290 @@
+// Changing the columns of an existing DB: columns may be appended to the schema or dropped from it, and
+// string dimension columns may be widened. Intervals written with the old columns keep their row layout until
+// they're rewritten.
+
+package gumshoe
+
+import (
+	"fmt"
+	"sync"
+	"unsafe"
+)
+
+// A RowLayout is the columns of the rows of an interval written with an earlier version of the schema.
+type RowLayout struct {
+	DimensionColumns []DimensionColumn
+	MetricColumns    []MetricColumn
+
+	schemaOnce sync.Once
+	schema     *Schema // Made by Schema.storedLayoutSchema
+}
+
+func (s *Schema) rowLayout() *RowLayout {
+	return &RowLayout{DimensionColumns: s.DimensionColumns, MetricColumns: s.MetricColumns}
+}
+
+func (l *RowLayout) equal(other *RowLayout) bool {
+	if len(l.DimensionColumns) != len(other.DimensionColumns) {
+		return false
+	}
+	if len(l.MetricColumns) != len(other.MetricColumns) {
+		return false
+	}
+	for i, col := range l.DimensionColumns {
+		if col != other.DimensionColumns[i] {
+			return false
+		}
+	}
+	for i, col := range l.MetricColumns {
+		if col != other.MetricColumns[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// layoutSchema returns a copy of s with the columns of layout.
+func (s *Schema) layoutSchema(layout *RowLayout) *Schema {
+	changed := *s
+	changed.DimensionColumns = layout.DimensionColumns
+	changed.MetricColumns = layout.MetricColumns
+	changed.Initialize()
+	return &changed
+}
+
+func (s *Schema) isDroppedColumn(name string) bool {
+	for _, dropped := range s.DroppedColumns {
+		if dropped == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckColumnChanges returns an error describing a difference between s and old, unless s is the same as old
+// except that it may drop some of old's columns (which must be listed in s.DroppedColumns), add columns after
+// old's remaining columns, and widen string dimension columns. A DB saved with old may be opened with s.
+func (s *Schema) CheckColumnChanges(old *Schema) error {
+	kept := &RowLayout{}
+	for _, col := range old.DimensionColumns {
+		if s.isDroppedColumn(col.Name) {
+			continue
+		}
+		if i, ok := s.DimensionNameToIndex[col.Name]; ok && widensStringColumn(col, s.DimensionColumns[i]) {
+			col = s.DimensionColumns[i]
+		}
+		kept.DimensionColumns = append(kept.DimensionColumns, col)
+	}
+	for _, col := range old.MetricColumns {
+		if !s.isDroppedColumn(col.Name) {
+			kept.MetricColumns = append(kept.MetricColumns, col)
+		}
+	}
+	for _, name := range s.DroppedColumns {
+		_, isDimension := s.DimensionNameToIndex[name]
+		_, isMetric := s.MetricNameToIndex[name]
+		if isDimension || isMetric {
+			return fmt.Errorf("Schemas do not match: dropped column %q is still a column", name)
+		}
+	}
+	if len(s.DimensionColumns) < len(kept.DimensionColumns) || len(s.MetricColumns) < len(kept.MetricColumns) {
+		return old.layoutSchema(kept).Equivalent(s)
+	}
+	prefix := &RowLayout{
+		DimensionColumns: s.DimensionColumns[:len(kept.DimensionColumns)],
+		MetricColumns:    s.MetricColumns[:len(kept.MetricColumns)],
+	}
+	return old.layoutSchema(kept).Equivalent(s.layoutSchema(prefix))
+}
+
+// storedLayoutSchema returns a copy of s with the columns of layout, which is one of s.Layouts. It's made
+// once for each layout, and shared by all the segments with that layout.
+func (s *Schema) storedLayoutSchema(layout *RowLayout) *Schema {
+	layout.schemaOnce.Do(func() { layout.schema = s.layoutSchema(layout) })
+	return layout.schema
+}
+
+// loadOldLayoutSegmentFile loads a segment of iv, which has an old row layout (iv.Layout). The segment is
+// kept as it's stored, like any other, and its rows are converted to s's layout when they're read (see
+// Schema.SegmentRows).
+func (s *Schema) loadOldLayoutSegmentFile(iv *Interval, i int, filename string,
+	verify bool) (*Segment, error) {
+	old := s.storedLayoutSchema(s.Layouts[iv.Layout-1])
+	current := *iv
+	current.Layout = 0
+	segment, err := old.loadSegmentFile(&current, i, filename, verify)
+	if err != nil {
+		return nil, err
+	}
+	segment.layout = old
+	return segment, nil
+}
+
+// convertRows converts rows with the layout of old to s's layout. The columns which old doesn't have are nil
+// (dimensions) or zero (metrics). The values of widened string dimension columns are converted to their new
+// types. The converted rows are written into dst if it has the capacity for them, and into a new slice
+// otherwise.
+func (s *Schema) convertRows(dst []byte, old *Schema, rows []byte) []byte {
+	// The index of each of s's columns in old, or -1.
+	dimensionIndexes := make([]int, len(s.DimensionColumns))
+	for i, col := range s.DimensionColumns {
+		dimensionIndexes[i] = -1
+		if j, ok := old.DimensionNameToIndex[col.Name]; ok {
+			dimensionIndexes[i] = j
+		}
+	}
+	metricIndexes := make([]int, len(s.MetricColumns))
+	for i, col := range s.MetricColumns {
+		metricIndexes[i] = -1
+		if j, ok := old.MetricNameToIndex[col.Name]; ok {
+			metricIndexes[i] = j
+		}
+	}
+
+	numRows := len(rows) / old.RowSize
+	size := numRows * s.RowSize
+	var converted []byte
+	if cap(dst) >= size {
+		converted = dst[:size]
+		// The new metric columns aren't written below, so whatever was converted into dst before is cleared.
+		for i := range converted {
+			converted[i] = 0
+		}
+	} else {
+		converted = make([]byte, size)
+	}
+	for r := 0; r < numRows; r++ {
+		src := rows[r*old.RowSize : (r+1)*old.RowSize]
+		dst := converted[r*s.RowSize : (r+1)*s.RowSize]
+		copy(dst, src[:countColumnWidth])
+		oldDimensions := DimensionBytes(src[old.DimensionStartOffset:old.MetricStartOffset])
+		dimensions := DimensionBytes(dst[s.DimensionStartOffset:s.MetricStartOffset])
+		for i, j := range dimensionIndexes {
+			if j < 0 || oldDimensions.IsNil(j) {
+				dimensions.setNil(i)
+				continue
+			}
+			col := s.DimensionColumns[i]
+			cell := oldDimensions[old.DimensionOffsets[j]:]
+			if oldType := old.DimensionColumns[j].Type; oldType != col.Type {
+				value := UntypedToFloat64(NumericCellValue(unsafe.Pointer(&cell[0]), oldType))
+				setRowValue(unsafe.Pointer(&dimensions[s.DimensionOffsets[i]]), col.Type, value)
+				continue
+			}
+			copy(dimensions[s.DimensionOffsets[i]:], cell[:col.Width])
+		}
+		oldMetrics := src[old.MetricStartOffset:]
+		metrics := dst[s.MetricStartOffset:]
+		for i, j := range metricIndexes {
+			if j >= 0 {
+				width := s.MetricColumns[i].Width
+				copy(metrics[s.MetricOffsets[i]:], oldMetrics[old.MetricOffsets[j]:][:width])
+			}
+		}
+	}
+	return converted
+}
+
+// changeColumns prepares t, which was saved with the schema old, to be used with s, which may have changed
+// old's columns (see Schema.CheckColumnChanges). It records old's row layout as that of the existing
+// intervals and moves the zone maps and dimension tables to their columns' new indexes (see
+// recordOldLayout). Layouts which no intervals use any more are removed. changed is set if the metadata needs
+// to be written out again; the dimension table files returned are no longer needed once it has been.
+func (t *StaticTable) changeColumns(old, s *Schema) (changed bool, obsoleteFiles []string, err error) {
+	s.Layouts = old.Layouts
+	if !old.rowLayout().equal(s.rowLayout()) {
+		changed = true
+		obsoleteFiles, err = t.recordOldLayout(old, s)
+		if err != nil {
+			return false, nil, err
+		}
+	}
+
+	// Remove unused layouts and renumber the rest.
+	used := make(map[int]bool)
+	for _, interval := range t.Intervals {
+		used[interval.Layout] = true
+	}
+	var layouts []*RowLayout
+	renumbered := make(map[int]int)
+	for i, layout := range s.Layouts {
+		if used[i+1] {
+			layouts = append(layouts, layout)
+			renumbered[i+1] = len(layouts)
+		}
+	}
+	if len(layouts) < len(s.Layouts) {
+		changed = true
+	}
+	s.Layouts = layouts
+	for _, interval := range t.Intervals {
+		interval.Layout = renumbered[interval.Layout]
+	}
+	return changed, obsoleteFiles, nil
+}
+
+// recordOldLayout adds old's row layout to s.Layouts and gives it to the intervals with the current layout.
+// The zone maps of all intervals are indexed by s's columns afterwards.
+func (t *StaticTable) recordOldLayout(old, s *Schema) (obsoleteFiles []string, err error) {
+	s.Layouts = append(append([]*RowLayout(nil), s.Layouts...), old.rowLayout())
+	// The new index of each of old's dimension columns, or -1 if it was dropped.
+	newIndexes := make([]int, len(old.DimensionColumns))
+	for i, col := range old.DimensionColumns {
+		newIndexes[i] = -1
+		if j, ok := s.DimensionNameToIndex[col.Name]; ok {
+			newIndexes[i] = j
+		}
+	}
+
+	for _, interval := range t.Intervals {
+		if interval.Layout == 0 {
+			interval.Layout = len(s.Layouts)
+		}
+		for k, zoneMap := range interval.ZoneMaps {
+			moved := make(ZoneMap, len(s.DimensionColumns))
+			for i, r := range zoneMap {
+				if i < len(newIndexes) && newIndexes[i] >= 0 {
+					moved[newIndexes[i]] = r
+				}
+			}
+			interval.ZoneMaps[k] = moved
+		}
+	}
+
+	// Dimension table files are named by column index, so the tables of columns with new indexes are written
+	// out again (with a generation higher than any of the existing files).
+	generation := 0
+	for _, dimTable := range t.DimensionTables {
+		if dimTable != nil && dimTable.Generation > generation {
+			generation = dimTable.Generation
+		}
+	}
+	dimTables := NewDimensionTablesForSchema(s)
+	for i, dimTable := range t.DimensionTables {
+		if dimTable == nil {
+			continue
+		}
+		j := newIndexes[i]
+		if j == i || dimTable.Generation == 0 {
+			if j >= 0 {
+				dimTables[j] = dimTable
+			}
+			continue
+		}
+		obsoleteFiles = append(obsoleteFiles, dimTable.Filename(old, i))
+		if j < 0 {
+			continue
+		}
+		if err := dimTable.Load(old, i); err != nil {
+			return nil, err
+		}
+		generation++
+		moved := newDimensionTable(generation, dimTable.Values)
+		if err := moved.Store(s, j); err != nil {
+			return nil, err
+		}
+		dimTables[j] = moved
+	}
+	t.DimensionTables = dimTables
+	return obsoleteFiles, nil
+}
@@ -0,0 +1,174 @@
+package gumshoe
+
+import (
+	"compress/gzip"
+	"encoding/gob"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// A LookupTable is a small mapping from the values of a grouping column (such as customer IDs) to labels
+// (such as customer names). Queries may use lookup tables to add labels to their grouped results. A
+// LookupTable is not modified after it is registered; registering a table with the same name replaces it.
+type LookupTable struct {
+	Name    string
+	Version int // Distinguishes successive tables registered with the same name
+	Values  map[string]string
+}
+
+// A QueryLookup adds the column Name to each result row by looking up the value of the grouping named Column
+// in the lookup table Table. (Numeric grouping values are looked up by their decimal representation.) If the
+// value is not in the table, the result is null.
+type QueryLookup struct {
+	Table  string
+	Column string
+	Name   string
+}
+
+var lookupTableNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+const (
+	lookupTableFilePrefix = "lookup."
+	lookupTableFileSuffix = ".gob.gz"
+)
+
+// RegisterLookupTable adds a lookup table to the DB (or replaces the existing table with the same name). A
+// disk-backed DB stores the table beside its dimension tables.
+func (db *DB) RegisterLookupTable(name string, values map[string]string) error {
+	if db.ReadOnly {
+		return ReadOnlyErr
+	}
+	if !lookupTableNameRegexp.MatchString(name) {
+		return fmt.Errorf("bad lookup table name %q (must be made of letters, digits, and underscores)", name)
+	}
+	db.lookupTablesLock.Lock()
+	defer db.lookupTablesLock.Unlock()
+	db.lookupTablesVersion++
+	table := &LookupTable{Name: name, Version: db.lookupTablesVersion, Values: values}
+	if db.DiskBacked {
+		if err := table.store(db.Dir); err != nil {
+			return err
+		}
+	}
+	db.lookupTables[name] = table
+	return nil
+}
+
+// GetLookupTable returns the lookup table with the given name, or nil if there is no such table.
+func (db *DB) GetLookupTable(name string) *LookupTable {
+	db.lookupTablesLock.Lock()
+	defer db.lookupTablesLock.Unlock()
+	return db.lookupTables[name]
+}
+
+// GetQueryLookupTables returns the lookup tables used by query.Lookups, in order. It is an error if a table
+// doesn't exist or a lookup column isn't one of query's groupings.
+func (db *DB) GetQueryLookupTables(query *Query) ([]*LookupTable, error) {
+	db.lookupTablesLock.Lock()
+	defer db.lookupTablesLock.Unlock()
+	var tables []*LookupTable
+	for _, lookup := range query.Lookups {
+		found := false
+		for _, grouping := range query.Groupings {
+			if grouping.Name == lookup.Column {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%q (used for a lookup) is not the name of a grouping", lookup.Column)
+		}
+		table, ok := db.lookupTables[lookup.Table]
+		if !ok {
+			return nil, fmt.Errorf("no such lookup table: %q", lookup.Table)
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+// ApplyLookups adds the labels for each of query.Lookups to rows. tables are the corresponding lookup tables
+// (see GetQueryLookupTables).
+func ApplyLookups(rows []RowMap, query *Query, tables []*LookupTable) {
+	for i, lookup := range query.Lookups {
+		for _, row := range rows {
+			value := row[lookup.Column]
+			if value == nil {
+				row[lookup.Name] = nil
+				continue
+			}
+			if label, ok := tables[i].Values[fmt.Sprint(value)]; ok {
+				row[lookup.Name] = label
+			} else {
+				row[lookup.Name] = nil
+			}
+		}
+	}
+}
+
+func lookupTableFilename(dir, name string) string {
+	return filepath.Join(dir, lookupTableFilePrefix+name+lookupTableFileSuffix)
+}
+
+// store atomically writes t to dir by writing a tempfile and moving it into place.
+func (t *LookupTable) store(dir string) error {
+	filename := lookupTableFilename(dir, t.Name)
+	tmpFilename := filename + ".tmp"
+	f, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(f)
+	if err := gob.NewEncoder(gz).Encode(t.Values); err != nil {
+		f.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// loadLookupTables reads all the lookup tables stored in db.Dir.
+func (db *DB) loadLookupTables() error {
+	filenames, err := filepath.Glob(filepath.Join(db.Dir, lookupTableFilePrefix+"*"+lookupTableFileSuffix))
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(filename), lookupTableFilePrefix),
+			lookupTableFileSuffix)
+		values, err := loadLookupTableValues(filename)
+		if err != nil {
+			return fmt.Errorf("cannot load lookup table %q: %s", name, err)
+		}
+		db.lookupTablesVersion++
+		db.lookupTables[name] = &LookupTable{Name: name, Version: db.lookupTablesVersion, Values: values}
+	}
+	return nil
+}
+
+func loadLookupTableValues(filename string) (map[string]string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	var values map[string]string
+	if err := gob.NewDecoder(gz).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
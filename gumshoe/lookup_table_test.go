@@ -0,0 +1,54 @@
+package gumshoe
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func runWithLookups(db *DB, lookups []QueryLookup) ([]RowMap, error) {
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	query.Lookups = lookups
+	return db.GetQueryResult(context.Background(), query)
+}
+
+func TestQueryLookupsLabelGroups(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 3.0},
+		{"at": 0.0, "dim1": "b", "metric1": 7.0},
+	})
+	Assert(t, db.RegisterLookupTable("names", map[string]string{"a": "Alice"}), IsNil)
+
+	expected := []RowMap{
+		{"dim1": "a", "metric1": 3, "rowCount": 1, "name": "Alice"},
+		{"dim1": "b", "metric1": 7, "rowCount": 1, "name": nil},
+	}
+	results, err := runWithLookups(db, []QueryLookup{{"names", "dim1", "name"}})
+	Assert(t, err, IsNil)
+	Assert(t, results, util.DeepEqualsUnordered, expected)
+
+	// Lookup tables are persisted.
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+	results, err = runWithLookups(db, []QueryLookup{{"names", "dim1", "name"}})
+	Assert(t, err, IsNil)
+	Assert(t, results, util.DeepEqualsUnordered, expected)
+
+	_, err = runWithLookups(db, []QueryLookup{{"nonexistent", "dim1", "name"}})
+	Assert(t, err, NotNil)
+	_, err = runWithLookups(db, []QueryLookup{{"names", "metric1", "name"}})
+	Assert(t, err, NotNil)
+}
+
+func TestRegisterLookupTableChecksName(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	Assert(t, db.RegisterLookupTable("../names", map[string]string{}), NotNil)
+}
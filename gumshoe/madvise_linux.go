@@ -0,0 +1,13 @@
+package gumshoe
+
+import "syscall"
+
+func madvise(b []byte, advice SegmentAdvice) error {
+	switch advice {
+	case AdviseRandom:
+		return syscall.Madvise(b, syscall.MADV_RANDOM)
+	case AdviseWillNeed:
+		return syscall.Madvise(b, syscall.MADV_WILLNEED)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package gumshoe
+
+import "errors"
+
+func madvise(b []byte, advice SegmentAdvice) error {
+	if advice == AdviseNormal {
+		return nil
+	}
+	return errors.New("madvise is only supported on Linux")
+}
@@ -0,0 +1,109 @@
+// Functions for ordering and limiting query results.
+
+package gumshoe
+
+import (
+	"fmt"
+	"sort"
+)
+
+// ValidateOrderBy checks that q's OrderBy keys refer to columns in q's results and that its Limit is
+// non-negative.
+func (q *Query) ValidateOrderBy() error {
+	if q.Limit < 0 {
+		return fmt.Errorf("bad limit (must be non-negative): %d", q.Limit)
+	}
+	names := q.aggregateNames()
+	for _, grouping := range q.Groupings {
+		names[grouping.Name] = true
+	}
+	for _, order := range q.OrderBy {
+		if !names[order.Column] {
+			return fmt.Errorf("%q (used for ordering) is not the name of an aggregate, expression, window, "+
+				"or grouping", order.Column)
+		}
+	}
+	return nil
+}
+
+// OrderAndLimitRows sorts rows according to query.OrderBy and then truncates them to query.Limit rows (if it
+// is positive). Rows are sorted in place. Nil values sort before all others.
+func OrderAndLimitRows(rows []RowMap, query *Query) []RowMap {
+	if len(query.OrderBy) > 0 {
+		sort.Stable(rowsByOrder{rows, query.OrderBy})
+	}
+	if query.Limit > 0 && len(rows) > query.Limit {
+		rows = rows[:query.Limit]
+	}
+	return rows
+}
+
+type rowsByOrder struct {
+	rows   []RowMap
+	orders []QueryOrder
+}
+
+func (r rowsByOrder) Len() int      { return len(r.rows) }
+func (r rowsByOrder) Swap(i, j int) { r.rows[i], r.rows[j] = r.rows[j], r.rows[i] }
+
+func (r rowsByOrder) Less(i, j int) bool {
+	for _, order := range r.orders {
+		cmp := CompareUntyped(r.rows[i][order.Column], r.rows[j][order.Column])
+		if cmp == 0 {
+			continue
+		}
+		if order.Direction == OrderDescending {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+	return false
+}
+
+// SortRowsByGrouping sorts rows in place by the value of query's first grouping (if any), in ascending order
+// according to CompareUntyped. Shards sort their results this way for the router, which can then merge them
+// as they stream in.
+func SortRowsByGrouping(rows []RowMap, query *Query) {
+	if len(query.Groupings) == 0 {
+		return
+	}
+	sort.Stable(rowsByOrder{rows, []QueryOrder{{Column: query.Groupings[0].Name}}})
+}
+
+// CompareUntyped returns -1, 0, or 1 according to whether u1 is less than, equal to, or greater than u2. nil
+// is less than every other value and numbers are less than strings.
+func CompareUntyped(u1, u2 Untyped) int {
+	switch {
+	case u1 == nil && u2 == nil:
+		return 0
+	case u1 == nil:
+		return -1
+	case u2 == nil:
+		return 1
+	}
+	s1, isString1 := u1.(string)
+	s2, isString2 := u2.(string)
+	switch {
+	case isString1 && isString2:
+		switch {
+		case s1 < s2:
+			return -1
+		case s1 > s2:
+			return 1
+		}
+		return 0
+	case isString1:
+		return 1
+	case isString2:
+		return -1
+	}
+	f1 := UntypedToFloat64(u1)
+	f2 := UntypedToFloat64(u2)
+	switch {
+	case f1 < f2:
+		return -1
+	case f1 > f2:
+		return 1
+	}
+	return 0
+}
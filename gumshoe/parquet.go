@@ -0,0 +1,281 @@
+// Writing rows in the Apache Parquet format.
+
+package gumshoe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// parquetRowGroupSize is the number of rows a ParquetWriter buffers before writing them out as a row group.
+const parquetRowGroupSize = 100000
+
+const parquetMagic = "PAR1"
+
+// Constants from the Parquet format (parquet.thrift)
+const (
+	parquetTypeBoolean           = 0
+	parquetTypeInt32             = 1
+	parquetTypeInt64             = 2
+	parquetTypeInt96             = 3
+	parquetTypeFloat             = 4
+	parquetTypeDouble            = 5
+	parquetTypeByteArray         = 6
+	parquetTypeFixedLenByteArray = 7
+
+	parquetRequired = 0
+	parquetOptional = 1
+	parquetRepeated = 2
+
+	parquetConvertedUTF8            = 0
+	parquetConvertedDecimal         = 5
+	parquetConvertedDate            = 6
+	parquetConvertedTimestampMillis = 9
+	parquetConvertedTimestampMicros = 10
+	parquetConvertedUint32          = 13
+	parquetConvertedUint64          = 14
+
+	parquetEncodingPlain           = 0
+	parquetEncodingPlainDictionary = 2
+	parquetEncodingRLE             = 3
+	parquetEncodingRLEDictionary   = 8
+
+	parquetCodecUncompressed = 0
+	parquetCodecSnappy       = 1
+	parquetCodecGzip         = 2
+
+	parquetPageData       = 0
+	parquetPageDictionary = 2
+	parquetPageDataV2     = 3
+)
+
+// A ParquetWriter writes rows to a Parquet file, in row groups of parquetRowGroupSize rows. Every column is
+// optional (a nil value is a null); the values are uncompressed and plainly encoded, each column chunk in a
+// single data page.
+type ParquetWriter struct {
+	w       io.Writer
+	offset  int64 // The number of bytes written to w
+	columns []arrowColumn
+	rows    []RowMap // The rows of the next row group
+
+	numRows   int64
+	rowGroups []parquetRowGroup
+}
+
+type parquetRowGroup struct {
+	numRows int64
+	chunks  []parquetColumnChunk
+}
+
+type parquetColumnChunk struct {
+	offset int64 // Of the data page
+	size   int64 // Of the data page, including its header
+}
+
+// NewParquetWriter writes the start of a Parquet file to w and returns a ParquetWriter for rows with the
+// given columns of s. The types of the columns are as in Arrow results: integral columns (including the
+// timestamp column and any column s doesn't have, such as a count) are 64-bit integers, float columns are
+// doubles, and string dimension columns are UTF-8 strings.
+func (s *Schema) NewParquetWriter(w io.Writer, columns []string) (*ParquetWriter, error) {
+	pw := &ParquetWriter{w: w}
+	for _, name := range columns {
+		pw.columns = append(pw.columns, arrowColumn{name, s.arrowColumnType(name)})
+	}
+	if err := pw.write([]byte(parquetMagic)); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+func (pw *ParquetWriter) write(b []byte) error {
+	n, err := pw.w.Write(b)
+	pw.offset += int64(n)
+	return err
+}
+
+// Write adds a row, writing out a row group if enough rows are buffered.
+func (pw *ParquetWriter) Write(row RowMap) error {
+	pw.rows = append(pw.rows, row)
+	if len(pw.rows) < parquetRowGroupSize {
+		return nil
+	}
+	return pw.writeRowGroup()
+}
+
+// Close writes any buffered rows and the file metadata. It doesn't close the underlying io.Writer.
+func (pw *ParquetWriter) Close() error {
+	if len(pw.rows) > 0 {
+		if err := pw.writeRowGroup(); err != nil {
+			return err
+		}
+	}
+	metadata := pw.fileMetadata()
+	footer := make([]byte, len(metadata)+8)
+	copy(footer, metadata)
+	binary.LittleEndian.PutUint32(footer[len(metadata):], uint32(len(metadata)))
+	copy(footer[len(metadata)+4:], parquetMagic)
+	return pw.write(footer)
+}
+
+func (pw *ParquetWriter) writeRowGroup() error {
+	group := parquetRowGroup{numRows: int64(len(pw.rows))}
+	for _, column := range pw.columns {
+		page := parquetDataPage(column, pw.rows)
+		chunk := parquetColumnChunk{offset: pw.offset, size: int64(len(page))}
+		if err := pw.write(page); err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+	}
+	pw.rowGroups = append(pw.rowGroups, group)
+	pw.numRows += group.numRows
+	pw.rows = pw.rows[:0]
+	return nil
+}
+
+// parquetDataPage encodes the values of column in rows as a data page (with its header). The page holds the
+// definition levels (1 for a value, 0 for a null) in the RLE encoding, followed by the values which aren't
+// null.
+func parquetDataPage(column arrowColumn, rows []RowMap) []byte {
+	var levels, values []byte
+	var b [8]byte
+	run, runLevel := 0, byte(0)
+	endRun := func() {
+		if run > 0 {
+			levels = appendUvarint(levels, uint64(run)<<1)
+			levels = append(levels, runLevel)
+		}
+	}
+	for _, row := range rows {
+		value := row[column.name]
+		level := byte(0)
+		if value != nil {
+			level = 1
+			switch column.typ {
+			case arrowInt64:
+				binary.LittleEndian.PutUint64(b[:], uint64(UntypedToInt(value)))
+				values = append(values, b[:]...)
+			case arrowFloat64:
+				binary.LittleEndian.PutUint64(b[:], math.Float64bits(UntypedToFloat64(value)))
+				values = append(values, b[:]...)
+			case arrowUtf8:
+				s, ok := value.(string)
+				if !ok {
+					s = fmt.Sprint(value)
+				}
+				binary.LittleEndian.PutUint32(b[:], uint32(len(s)))
+				values = append(append(values, b[:4]...), s...)
+			}
+		}
+		if level != runLevel {
+			endRun()
+			run, runLevel = 0, level
+		}
+		run++
+	}
+	endRun()
+
+	body := make([]byte, 4, 4+len(levels)+len(values))
+	binary.LittleEndian.PutUint32(body, uint32(len(levels)))
+	body = append(append(body, levels...), values...)
+
+	w := new(thriftWriter)
+	w.beginStruct() // PageHeader
+	w.i32Field(1, parquetPageData)
+	w.i32Field(2, int32(len(body))) // uncompressed_page_size
+	w.i32Field(3, int32(len(body))) // compressed_page_size
+	w.field(5, thriftStruct)
+	w.beginStruct() // DataPageHeader
+	w.i32Field(1, int32(len(rows)))
+	w.i32Field(2, parquetEncodingPlain)
+	w.i32Field(3, parquetEncodingRLE) // Definition levels
+	w.i32Field(4, parquetEncodingRLE) // Repetition levels (which are omitted, as no column is repeated)
+	w.endStruct()
+	w.endStruct()
+	return append(w.buf, body...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// fileMetadata encodes the FileMetaData of the file.
+func (pw *ParquetWriter) fileMetadata() []byte {
+	w := new(thriftWriter)
+	w.beginStruct()
+	w.i32Field(1, 1) // version
+
+	w.field(2, thriftList) // schema
+	w.list(len(pw.columns)+1, thriftStruct)
+	w.beginStruct() // The root
+	w.stringField(4, "schema")
+	w.i32Field(5, int32(len(pw.columns))) // num_children
+	w.endStruct()
+	for _, column := range pw.columns {
+		w.beginStruct()
+		w.i32Field(1, column.parquetType())
+		w.i32Field(3, parquetOptional)
+		w.stringField(4, column.name)
+		if column.typ == arrowUtf8 {
+			w.i32Field(6, parquetConvertedUTF8)
+		}
+		w.endStruct()
+	}
+
+	w.i64Field(3, pw.numRows)
+
+	w.field(4, thriftList) // row_groups
+	w.list(len(pw.rowGroups), thriftStruct)
+	for _, group := range pw.rowGroups {
+		var size int64
+		for _, chunk := range group.chunks {
+			size += chunk.size
+		}
+		w.beginStruct()
+		w.field(1, thriftList) // columns
+		w.list(len(group.chunks), thriftStruct)
+		for i, chunk := range group.chunks {
+			column := pw.columns[i]
+			w.beginStruct() // ColumnChunk
+			w.i64Field(2, chunk.offset)
+			w.field(3, thriftStruct)
+			w.beginStruct() // ColumnMetaData
+			w.i32Field(1, column.parquetType())
+			w.field(2, thriftList) // encodings
+			w.list(2, thriftI32)
+			w.i32(parquetEncodingPlain)
+			w.i32(parquetEncodingRLE)
+			w.field(3, thriftList) // path_in_schema
+			w.list(1, thriftBinary)
+			w.string(column.name)
+			w.i32Field(4, parquetCodecUncompressed)
+			w.i64Field(5, group.numRows)
+			w.i64Field(6, chunk.size) // total_uncompressed_size
+			w.i64Field(7, chunk.size) // total_compressed_size
+			w.i64Field(9, chunk.offset)
+			w.endStruct()
+			w.endStruct()
+		}
+		w.i64Field(2, size)
+		w.i64Field(3, group.numRows)
+		w.endStruct()
+	}
+
+	w.stringField(6, "gumshoedb") // created_by
+	w.endStruct()
+	return w.buf
+}
+
+func (c arrowColumn) parquetType() int32 {
+	switch c.typ {
+	case arrowFloat64:
+		return parquetTypeDouble
+	case arrowUtf8:
+		return parquetTypeByteArray
+	}
+	return parquetTypeInt64
+}
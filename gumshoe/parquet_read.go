@@ -0,0 +1,628 @@
+// Reading rows to insert from Apache Parquet files.
+
+package gumshoe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strconv"
+)
+
+// parquetCodecNames are the names of the Parquet compression codecs, for errors about unsupported ones.
+var parquetCodecNames = []string{"UNCOMPRESSED", "SNAPPY", "GZIP", "LZO", "BROTLI", "LZ4", "ZSTD", "LZ4_RAW"}
+
+// A ParquetReader reads rows for insertion from a Parquet file, a row group at a time. Only flat files are
+// supported (every column is a top-level, unrepeated field). Pages may be compressed with Snappy or gzip,
+// and values may be plainly or dictionary encoded, in either version of data page. Timestamps (of any unit,
+// including the legacy INT96 timestamps) and dates become Unix times in seconds; booleans become 0 or 1.
+//
+// ReadRowGroup may be called concurrently.
+type ParquetReader struct {
+	r         io.ReaderAt
+	size      int64
+	columns   []parquetColumn // For each column of the file
+	rowGroups []map[int]interface{}
+	numRows   int64
+}
+
+type parquetColumn struct {
+	parquetName string
+	name        string // The schema column, or "" if the column is ignored
+	isCount     bool
+	isString    bool
+
+	typ            int64 // The physical type
+	typeLength     int   // Of fixed-length byte arrays
+	optional       bool
+	unsigned       bool
+	unitsPerSecond int64 // For timestamps; 0 otherwise
+	isDate         bool
+}
+
+// NewParquetReader reads the metadata of the Parquet file of the given size in r and maps each Parquet
+// column to a column of s, as NewCSVReader does with CSV columns: if mapping is nil, the Parquet columns must
+// be named the same as the schema columns; otherwise, mapping gives the schema column for each Parquet column
+// name, and Parquet columns missing from mapping are ignored. If countColumn is not empty, the integer
+// Parquet column with that name (such as the rowCount column written by a ParquetWriter for a DB's rows)
+// gives the number of inserted rows each row stands for.
+func (s *Schema) NewParquetReader(r io.ReaderAt, size int64, mapping map[string]string,
+	countColumn string) (*ParquetReader, error) {
+
+	metadata, err := readParquetMetadata(r, size)
+	if err != nil {
+		return nil, err
+	}
+	elements := thriftListField(metadata, 2)
+	if len(elements) == 0 {
+		return nil, fmt.Errorf("the Parquet file has no schema")
+	}
+	root, _ := elements[0].(map[int]interface{})
+	if n := thriftInt(root, 5, 0); n != int64(len(elements)-1) {
+		return nil, fmt.Errorf("the Parquet file has nested columns, which are not supported")
+	}
+	pr := &ParquetReader{r: r, size: size, numRows: thriftInt(metadata, 3, 0)}
+	seen := make(map[string]bool)
+	for _, element := range elements[1:] {
+		element, _ := element.(map[int]interface{})
+		column, err := s.parquetColumn(element, mapping, countColumn)
+		if err != nil {
+			return nil, err
+		}
+		if column.name != "" {
+			if seen[column.name] {
+				return nil, fmt.Errorf("Parquet column %q: more than one Parquet column maps to %q",
+					column.parquetName, column.name)
+			}
+			seen[column.name] = true
+		}
+		pr.columns = append(pr.columns, column)
+	}
+	if !seen[s.TimestampColumn.Name] {
+		return nil, fmt.Errorf("no Parquet column maps to the timestamp column (%q)", s.TimestampColumn.Name)
+	}
+	for _, group := range thriftListField(metadata, 4) {
+		group, _ := group.(map[int]interface{})
+		pr.rowGroups = append(pr.rowGroups, group)
+	}
+	return pr, nil
+}
+
+// readParquetMetadata reads and decodes the FileMetaData at the end of a Parquet file.
+func readParquetMetadata(r io.ReaderAt, size int64) (map[int]interface{}, error) {
+	notParquet := fmt.Errorf("not a Parquet file")
+	if size < 12 {
+		return nil, notParquet
+	}
+	var magic [4]byte
+	if _, err := r.ReadAt(magic[:], 0); err != nil {
+		return nil, err
+	}
+	var footer [8]byte
+	if _, err := r.ReadAt(footer[:], size-8); err != nil {
+		return nil, err
+	}
+	if string(magic[:]) != parquetMagic || string(footer[4:]) != parquetMagic {
+		return nil, notParquet
+	}
+	length := int64(binary.LittleEndian.Uint32(footer[:]))
+	if length > size-12 {
+		return nil, fmt.Errorf("bad Parquet metadata length (%d)", length)
+	}
+	b := make([]byte, length)
+	if _, err := r.ReadAt(b, size-8-length); err != nil {
+		return nil, err
+	}
+	tr := &thriftReader{buf: b}
+	metadata := tr.readStruct()
+	if tr.err != nil {
+		return nil, fmt.Errorf("bad Parquet metadata: %s", tr.err)
+	}
+	return metadata, nil
+}
+
+// parquetColumn describes the Parquet column given by a SchemaElement and maps it to a column of s.
+func (s *Schema) parquetColumn(element map[int]interface{}, mapping map[string]string,
+	countColumn string) (parquetColumn, error) {
+
+	column := parquetColumn{
+		parquetName: thriftStringField(element, 4),
+		typ:         thriftInt(element, 1, -1),
+		typeLength:  int(thriftInt(element, 2, 0)),
+	}
+	fail := func(format string, args ...interface{}) (parquetColumn, error) {
+		return column, fmt.Errorf("Parquet column %q: %s", column.parquetName, fmt.Sprintf(format, args...))
+	}
+	if thriftInt(element, 5, 0) > 0 {
+		return fail("nested columns are not supported")
+	}
+	switch thriftInt(element, 3, parquetRequired) {
+	case parquetOptional:
+		column.optional = true
+	case parquetRepeated:
+		return fail("repeated columns are not supported")
+	}
+
+	// The types which change how values are read
+	logical := thriftStructField(element, 10)
+	switch thriftInt(element, 6, -1) {
+	case parquetConvertedDecimal:
+		return fail("decimals are not supported")
+	case parquetConvertedDate:
+		column.isDate = true
+	case parquetConvertedTimestampMillis:
+		column.unitsPerSecond = 1e3
+	case parquetConvertedTimestampMicros:
+		column.unitsPerSecond = 1e6
+	case parquetConvertedUint32, parquetConvertedUint64:
+		column.unsigned = true
+	}
+	if logical[5] != nil {
+		return fail("decimals are not supported")
+	}
+	if timestamp := thriftStructField(logical, 8); timestamp != nil {
+		unit := thriftStructField(timestamp, 2)
+		switch {
+		case unit[1] != nil:
+			column.unitsPerSecond = 1e3
+		case unit[2] != nil:
+			column.unitsPerSecond = 1e6
+		case unit[3] != nil:
+			column.unitsPerSecond = 1e9
+		}
+	}
+	switch column.typ {
+	case parquetTypeBoolean, parquetTypeInt32, parquetTypeInt64, parquetTypeInt96, parquetTypeFloat,
+		parquetTypeDouble, parquetTypeByteArray:
+	case parquetTypeFixedLenByteArray:
+		if column.typeLength <= 0 {
+			return fail("bad fixed length (%d)", column.typeLength)
+		}
+	default:
+		return fail("unknown type %d", column.typ)
+	}
+
+	if countColumn != "" && column.parquetName == countColumn {
+		if column.typ != parquetTypeInt32 && column.typ != parquetTypeInt64 {
+			return fail("the count column must hold integers")
+		}
+		column.isCount = true
+		return column, nil
+	}
+	name := column.parquetName
+	if mapping != nil {
+		if name = mapping[column.parquetName]; name == "" {
+			return column, nil
+		}
+	}
+	if s.isDroppedColumn(name) {
+		return column, nil
+	}
+	if name != s.TimestampColumn.Name {
+		if index, ok := s.DimensionNameToIndex[name]; ok {
+			column.isString = s.DimensionColumns[index].String
+		} else if _, ok := s.MetricNameToIndex[name]; !ok {
+			return fail("%q is not a valid column name", name)
+		}
+	}
+	column.name = name
+	return column, nil
+}
+
+// NumRows returns the number of rows in the file.
+func (pr *ParquetReader) NumRows() int64 { return pr.numRows }
+
+// NumRowGroups returns the number of row groups in the file.
+func (pr *ParquetReader) NumRowGroups() int { return len(pr.rowGroups) }
+
+// ReadRowGroup reads the rows of the row group with the given index. Null values are left out of the rows
+// (that is, they are nil for dimensions and 0 for metrics), as are the values of the columns which aren't
+// mapped to a schema column. Integers are kept as json.Numbers, so that 64-bit integers are inserted
+// exactly.
+func (pr *ParquetReader) ReadRowGroup(i int) ([]UnpackedRow, error) {
+	group := pr.rowGroups[i]
+	chunks := thriftListField(group, 1)
+	if len(chunks) != len(pr.columns) {
+		return nil, fmt.Errorf("Parquet row group %d has %d column chunks for %d columns", i, len(chunks),
+			len(pr.columns))
+	}
+	numRows := int(thriftInt(group, 3, 0))
+	rows := make([]UnpackedRow, numRows)
+	for j := range rows {
+		rows[j] = UnpackedRow{make(RowMap), 1}
+	}
+	for j, column := range pr.columns {
+		if column.name == "" && !column.isCount {
+			continue
+		}
+		chunk, _ := chunks[j].(map[int]interface{})
+		values, err := pr.readColumnChunk(column, chunk, numRows)
+		if err != nil {
+			return nil, fmt.Errorf("Parquet row group %d, column %q: %s", i, column.parquetName, err)
+		}
+		for k, value := range values {
+			if value == nil {
+				continue
+			}
+			if column.isCount {
+				switch v := value.(type) {
+				case int64:
+					rows[k].Count = int(v)
+				case uint64:
+					rows[k].Count = int(v)
+				}
+				continue
+			}
+			rows[k].RowMap[column.name] = insertableParquetValue(value, column.isString)
+		}
+	}
+	return rows, nil
+}
+
+// insertableParquetValue converts a value read from a Parquet file to the form Insert takes.
+func insertableParquetValue(value interface{}, isString bool) Untyped {
+	switch v := value.(type) {
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10))
+	case uint64:
+		return json.Number(strconv.FormatUint(v, 10))
+	case bool:
+		if v {
+			return json.Number("1")
+		}
+		return json.Number("0")
+	case string:
+		if !isString {
+			// Allow numbers written as strings, as in CSV.
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				return json.Number(v)
+			}
+		}
+	}
+	return value
+}
+
+// readColumnChunk reads the numRows values of a column chunk (described by a ColumnChunk), with nil for each
+// null.
+func (pr *ParquetReader) readColumnChunk(column parquetColumn, chunk map[int]interface{},
+	numRows int) ([]interface{}, error) {
+
+	if thriftStringField(chunk, 1) != "" {
+		return nil, fmt.Errorf("column chunks in other files are not supported")
+	}
+	meta := thriftStructField(chunk, 3)
+	codec := thriftInt(meta, 4, parquetCodecUncompressed)
+	if codec != parquetCodecUncompressed && codec != parquetCodecSnappy && codec != parquetCodecGzip {
+		name := strconv.FormatInt(codec, 10)
+		if codec >= 0 && codec < int64(len(parquetCodecNames)) {
+			name = parquetCodecNames[codec]
+		}
+		return nil, fmt.Errorf("the %s compression codec is not supported", name)
+	}
+	start := thriftInt(meta, 9, 0)
+	if offset := thriftInt(meta, 11, 0); offset > 0 && offset < start {
+		start = offset // The dictionary page
+	}
+	length := thriftInt(meta, 7, 0)
+	if start < 4 || length < 0 || start+length > pr.size {
+		return nil, fmt.Errorf("bad column chunk offset or length")
+	}
+	buf := make([]byte, length)
+	if _, err := pr.r.ReadAt(buf, start); err != nil {
+		return nil, err
+	}
+
+	values := make([]interface{}, 0, numRows)
+	var dictionary []interface{}
+	for pos := 0; len(values) < numRows; {
+		if pos >= len(buf) {
+			return nil, fmt.Errorf("the column chunk ends after %d of %d values", len(values), numRows)
+		}
+		tr := &thriftReader{buf: buf, pos: pos}
+		header := tr.readStruct()
+		if tr.err != nil {
+			return nil, fmt.Errorf("bad page header: %s", tr.err)
+		}
+		size := int(thriftInt(header, 3, -1))
+		if size < 0 || tr.pos+size > len(buf) {
+			return nil, fmt.Errorf("bad page size")
+		}
+		page := buf[tr.pos : tr.pos+size]
+		uncompressedSize := int(thriftInt(header, 2, 0))
+		pos = tr.pos + size
+
+		var pageValues []interface{}
+		var err error
+		switch thriftInt(header, 1, -1) {
+		case parquetPageDictionary:
+			pageHeader := thriftStructField(header, 7)
+			data, err := decompressParquetPage(codec, page, uncompressedSize)
+			if err != nil {
+				return nil, err
+			}
+			encoding := thriftInt(pageHeader, 2, parquetEncodingPlain)
+			if encoding != parquetEncodingPlain && encoding != parquetEncodingPlainDictionary {
+				return nil, fmt.Errorf("unsupported dictionary encoding %d", encoding)
+			}
+			if dictionary, err = column.decodePlain(data, int(thriftInt(pageHeader, 1, 0))); err != nil {
+				return nil, err
+			}
+			continue
+		case parquetPageData:
+			pageHeader := thriftStructField(header, 5)
+			data, err := decompressParquetPage(codec, page, uncompressedSize)
+			if err != nil {
+				return nil, err
+			}
+			var levels []byte
+			if column.optional {
+				if encoding := thriftInt(pageHeader, 3, parquetEncodingRLE); encoding != parquetEncodingRLE {
+					return nil, fmt.Errorf("unsupported definition level encoding %d", encoding)
+				}
+				if len(data) < 4 || int(binary.LittleEndian.Uint32(data)) > len(data)-4 {
+					return nil, fmt.Errorf("bad definition levels")
+				}
+				n := 4 + int(binary.LittleEndian.Uint32(data))
+				levels, data = data[4:n], data[n:]
+			}
+			pageValues, err = column.decodePage(data, levels, int(thriftInt(pageHeader, 1, 0)),
+				thriftInt(pageHeader, 2, parquetEncodingPlain), dictionary)
+		case parquetPageDataV2:
+			pageHeader := thriftStructField(header, 8)
+			repetitionLength := int(thriftInt(pageHeader, 6, 0))
+			definitionLength := int(thriftInt(pageHeader, 5, 0))
+			if repetitionLength < 0 || definitionLength < 0 || repetitionLength+definitionLength > len(page) {
+				return nil, fmt.Errorf("bad level lengths")
+			}
+			levels := page[repetitionLength : repetitionLength+definitionLength]
+			if !column.optional {
+				levels = nil
+			}
+			data := page[repetitionLength+definitionLength:]
+			if compressed, ok := pageHeader[7].(bool); !ok || compressed {
+				data, err = decompressParquetPage(codec, data, uncompressedSize-repetitionLength-definitionLength)
+				if err != nil {
+					return nil, err
+				}
+			}
+			pageValues, err = column.decodePage(data, levels, int(thriftInt(pageHeader, 1, 0)),
+				thriftInt(pageHeader, 4, parquetEncodingPlain), dictionary)
+		default: // Index pages
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, pageValues...)
+	}
+	if len(values) > numRows {
+		return nil, fmt.Errorf("the column chunk has %d values for %d rows", len(values), numRows)
+	}
+	return values, nil
+}
+
+func decompressParquetPage(codec int64, data []byte, uncompressedSize int) ([]byte, error) {
+	var b []byte
+	var err error
+	switch codec {
+	case parquetCodecUncompressed:
+		return data, nil
+	case parquetCodecSnappy:
+		b, err = snappyDecode(data)
+	case parquetCodecGzip:
+		var r *gzip.Reader
+		if r, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			b, err = ioutil.ReadAll(r)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot decompress page: %s", err)
+	}
+	if len(b) != uncompressedSize {
+		return nil, fmt.Errorf("a page decompressed to %d bytes rather than %d", len(b), uncompressedSize)
+	}
+	return b, nil
+}
+
+// decodePage decodes the n values of a data page with the given encoding, where levels holds the definition
+// levels (RLE-encoded, without a length), or is nil if the column isn't optional.
+func (c parquetColumn) decodePage(data, levels []byte, n int, encoding int64,
+	dictionary []interface{}) ([]interface{}, error) {
+
+	present := n
+	var defined []int
+	if levels != nil {
+		var err error
+		if defined, err = decodeParquetHybrid(levels, 1, n); err != nil {
+			return nil, fmt.Errorf("bad definition levels: %s", err)
+		}
+		present = 0
+		for _, level := range defined {
+			present += level
+		}
+	}
+
+	var values []interface{}
+	switch encoding {
+	case parquetEncodingPlain:
+		var err error
+		if values, err = c.decodePlain(data, present); err != nil {
+			return nil, err
+		}
+	case parquetEncodingPlainDictionary, parquetEncodingRLEDictionary:
+		if dictionary == nil {
+			return nil, fmt.Errorf("a dictionary-encoded page has no dictionary")
+		}
+		if len(data) == 0 {
+			return nil, fmt.Errorf("bad dictionary indices")
+		}
+		indices, err := decodeParquetHybrid(data[1:], int(data[0]), present)
+		if err != nil {
+			return nil, fmt.Errorf("bad dictionary indices: %s", err)
+		}
+		values = make([]interface{}, present)
+		for i, index := range indices {
+			if index >= len(dictionary) {
+				return nil, fmt.Errorf("dictionary index %d is out of range", index)
+			}
+			values[i] = dictionary[index]
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %d (only the plain and dictionary encodings are supported)",
+			encoding)
+	}
+
+	if defined == nil {
+		return values, nil
+	}
+	withNulls := make([]interface{}, n)
+	for i, level := range defined {
+		if level == 1 {
+			withNulls[i], values = values[0], values[1:]
+		}
+	}
+	return withNulls, nil
+}
+
+// decodePlain decodes n plainly encoded values.
+func (c parquetColumn) decodePlain(data []byte, n int) ([]interface{}, error) {
+	short := fmt.Errorf("the page ends before its values do")
+	width := map[int64]int{
+		parquetTypeInt32:             4,
+		parquetTypeInt64:             8,
+		parquetTypeInt96:             12,
+		parquetTypeFloat:             4,
+		parquetTypeDouble:            8,
+		parquetTypeFixedLenByteArray: c.typeLength,
+	}[c.typ]
+	if c.typ == parquetTypeBoolean {
+		if len(data) < (n+7)/8 {
+			return nil, short
+		}
+	} else if width > 0 && len(data)/width < n {
+		return nil, short
+	}
+	values := make([]interface{}, n)
+	pos := 0
+	for i := range values {
+		switch c.typ {
+		case parquetTypeBoolean:
+			values[i] = data[i/8]&(1<<uint(i%8)) != 0
+		case parquetTypeInt32:
+			v := binary.LittleEndian.Uint32(data[pos:])
+			if c.unsigned {
+				values[i] = uint64(v)
+			} else {
+				values[i] = c.convertInt(int64(int32(v)))
+			}
+		case parquetTypeInt64:
+			v := binary.LittleEndian.Uint64(data[pos:])
+			if c.unsigned {
+				values[i] = v
+			} else {
+				values[i] = c.convertInt(int64(v))
+			}
+		case parquetTypeInt96:
+			// Nanoseconds within the day and a Julian day number
+			nanoseconds := int64(binary.LittleEndian.Uint64(data[pos:]))
+			day := int64(binary.LittleEndian.Uint32(data[pos+8:]))
+			values[i] = (day-2440588)*86400 + nanoseconds/1e9
+		case parquetTypeFloat:
+			values[i] = float64(math.Float32frombits(binary.LittleEndian.Uint32(data[pos:])))
+		case parquetTypeDouble:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(data[pos:]))
+		case parquetTypeByteArray:
+			if len(data)-pos < 4 {
+				return nil, short
+			}
+			length := int(binary.LittleEndian.Uint32(data[pos:]))
+			pos += 4
+			if length > len(data)-pos {
+				return nil, short
+			}
+			values[i] = string(data[pos : pos+length])
+			pos += length
+			continue
+		case parquetTypeFixedLenByteArray:
+			values[i] = string(data[pos : pos+width])
+		}
+		pos += width
+	}
+	return values, nil
+}
+
+// convertInt converts timestamps and dates to Unix times in seconds.
+func (c parquetColumn) convertInt(v int64) int64 {
+	switch {
+	case c.unitsPerSecond > 0:
+		return v / c.unitsPerSecond
+	case c.isDate:
+		return v * 86400
+	}
+	return v
+}
+
+// decodeParquetHybrid decodes n values of the given bit width in Parquet's hybrid of run-length and
+// bit-packed encodings.
+func decodeParquetHybrid(data []byte, bitWidth, n int) ([]int, error) {
+	if bitWidth > 32 {
+		return nil, fmt.Errorf("bad bit width %d", bitWidth)
+	}
+	values := make([]int, 0, n)
+	pos := 0
+	for len(values) < n {
+		header, k := binary.Uvarint(data[pos:])
+		if k <= 0 {
+			return nil, fmt.Errorf("the data ends after %d of %d values", len(values), n)
+		}
+		pos += k
+		if header&1 == 1 {
+			// Bit-packed groups of 8 values, least significant bit first
+			count := int(header>>1) * 8
+			if count > n-len(values) {
+				count = n - len(values)
+			}
+			if (count*bitWidth+7)/8 > len(data)-pos {
+				return nil, fmt.Errorf("a bit-packed run is truncated")
+			}
+			for i := 0; i < count; i++ {
+				v := 0
+				for bit := 0; bit < bitWidth; bit++ {
+					b := i*bitWidth + bit
+					if data[pos+b/8]&(1<<uint(b%8)) != 0 {
+						v |= 1 << uint(bit)
+					}
+				}
+				values = append(values, v)
+			}
+			pos += int(header>>1) * bitWidth
+			if pos > len(data) {
+				pos = len(data)
+			}
+			continue
+		}
+		// A run of one value, in the fewest whole bytes
+		count := header >> 1
+		if count > uint64(n-len(values)) {
+			count = uint64(n - len(values))
+		}
+		width := (bitWidth + 7) / 8
+		if width > len(data)-pos {
+			return nil, fmt.Errorf("a run is truncated")
+		}
+		v := 0
+		for i := width - 1; i >= 0; i-- {
+			v = v<<8 | int(data[pos+i])
+		}
+		pos += width
+		for ; count > 0; count-- {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,305 @@
+package gumshoe
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestParquetReaderReadsWriterOutput(t *testing.T) {
+	schema := schemaFixture()
+	schema.MetricColumns = append(schema.MetricColumns, makeMetricColumn("metric2", "float64"))
+	schema.Initialize()
+	var buf bytes.Buffer
+	w, err := schema.NewParquetWriter(&buf, []string{"at", "dim1", "metric1", "metric2", "rowCount"})
+	Assert(t, err, IsNil)
+	Assert(t, w.Write(RowMap{"at": int64(0), "dim1": "a", "metric1": 3, "metric2": 1.5, "rowCount": 2}), IsNil)
+	Assert(t, w.Write(RowMap{"at": int64(3600), "dim1": nil, "metric1": 0, "metric2": -2.0, "rowCount": 1}),
+		IsNil)
+	Assert(t, w.Close(), IsNil)
+
+	r, err := schema.NewParquetReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil, "rowCount")
+	Assert(t, err, IsNil)
+	Assert(t, r.NumRows(), Equals, int64(2))
+	Assert(t, r.NumRowGroups(), Equals, 1)
+	rows, err := r.ReadRowGroup(0)
+	Assert(t, err, IsNil)
+	Assert(t, rows, DeepEquals, []UnpackedRow{
+		{RowMap{"at": json.Number("0"), "dim1": "a", "metric1": json.Number("3"), "metric2": 1.5}, 2},
+		{RowMap{"at": json.Number("3600"), "metric1": json.Number("0"), "metric2": -2.0}, 1},
+	})
+}
+
+// parquetTestColumn is a column of a file made by parquetTestFile: a SchemaElement and the pages of the
+// column's chunk in the file's one row group.
+type parquetTestColumn struct {
+	name          string
+	typ           int32
+	repetition    int32
+	convertedType int32 // Or -1
+	codec         int32
+	pages         [][]byte
+}
+
+// parquetTestFile writes a Parquet file with a single row group of numRows rows.
+func parquetTestFile(numRows int, columns []parquetTestColumn) []byte {
+	file := []byte(parquetMagic)
+	var offsets, sizes []int64
+	for _, column := range columns {
+		offsets = append(offsets, int64(len(file)))
+		for _, page := range column.pages {
+			file = append(file, page...)
+		}
+		sizes = append(sizes, int64(len(file))-offsets[len(offsets)-1])
+	}
+
+	w := new(thriftWriter)
+	w.beginStruct()
+	w.i32Field(1, 1)
+	w.field(2, thriftList)
+	w.list(len(columns)+1, thriftStruct)
+	w.beginStruct()
+	w.stringField(4, "schema")
+	w.i32Field(5, int32(len(columns)))
+	w.endStruct()
+	for _, column := range columns {
+		w.beginStruct()
+		w.i32Field(1, column.typ)
+		w.i32Field(3, column.repetition)
+		w.stringField(4, column.name)
+		if column.convertedType >= 0 {
+			w.i32Field(6, column.convertedType)
+		}
+		w.endStruct()
+	}
+	w.i64Field(3, int64(numRows))
+	w.field(4, thriftList)
+	w.list(1, thriftStruct)
+	w.beginStruct()
+	w.field(1, thriftList)
+	w.list(len(columns), thriftStruct)
+	for i, column := range columns {
+		w.beginStruct()
+		w.i64Field(2, offsets[i])
+		w.field(3, thriftStruct)
+		w.beginStruct()
+		w.i32Field(1, column.typ)
+		w.field(2, thriftList)
+		w.list(0, thriftI32)
+		w.field(3, thriftList)
+		w.list(1, thriftBinary)
+		w.string(column.name)
+		w.i32Field(4, column.codec)
+		w.i64Field(5, int64(numRows))
+		w.i64Field(6, sizes[i])
+		w.i64Field(7, sizes[i])
+		w.i64Field(9, offsets[i])
+		w.endStruct()
+		w.endStruct()
+	}
+	w.i64Field(3, int64(numRows))
+	w.endStruct()
+	w.endStruct()
+
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(w.buf)))
+	file = append(append(file, w.buf...), length[:]...)
+	return append(file, parquetMagic...)
+}
+
+// parquetTestPage encodes a page header of the given type (whose type-specific header, the field with ID
+// headerID, is written by writeHeader) followed by body, which is data of the given uncompressed size.
+func parquetTestPage(typ int32, headerID int16, uncompressedSize int, body []byte,
+	writeHeader func(w *thriftWriter)) []byte {
+
+	w := new(thriftWriter)
+	w.beginStruct()
+	w.i32Field(1, typ)
+	w.i32Field(2, int32(uncompressedSize))
+	w.i32Field(3, int32(len(body)))
+	w.field(headerID, thriftStruct)
+	w.beginStruct()
+	writeHeader(w)
+	w.endStruct()
+	w.endStruct()
+	return append(w.buf, body...)
+}
+
+// snappyLiteral encodes b (of at most 65536 bytes) as Snappy data with a single literal.
+func snappyLiteral(b []byte) []byte {
+	out := appendUvarint(nil, uint64(len(b)))
+	out = append(out, 61<<2, byte(len(b)-1), byte((len(b)-1)>>8))
+	return append(out, b...)
+}
+
+func TestParquetReaderEncodings(t *testing.T) {
+	// at: timestamps in milliseconds, in an uncompressed version 2 data page
+	at := make([]byte, 24)
+	binary.LittleEndian.PutUint64(at[8:], 3600000)
+	binary.LittleEndian.PutUint64(at[16:], 3600000)
+	atPage := parquetTestPage(parquetPageDataV2, 8, len(at), at, func(w *thriftWriter) {
+		w.i32Field(1, 3)
+		w.i32Field(2, 0)
+		w.i32Field(3, 3)
+		w.i32Field(4, parquetEncodingPlain)
+		w.i32Field(5, 0)
+		w.i32Field(6, 0)
+		w.field(7, thriftFalse) // is_compressed
+	})
+
+	// dim1: "y", null, "x", dictionary encoded and compressed with Snappy
+	dictionary := []byte{1, 0, 0, 0, 'x', 1, 0, 0, 0, 'y'}
+	dictionaryPage := parquetTestPage(parquetPageDictionary, 7, len(dictionary), snappyLiteral(dictionary),
+		func(w *thriftWriter) {
+			w.i32Field(1, 2)
+			w.i32Field(2, parquetEncodingPlainDictionary)
+		})
+	// Definition levels 1, 0, 1 and indices 1, 0 (each in a bit-packed run with a width of 1)
+	dim1 := []byte{2, 0, 0, 0, 3, 5, 1, 3, 1}
+	dim1Page := parquetTestPage(parquetPageData, 5, len(dim1), snappyLiteral(dim1), func(w *thriftWriter) {
+		w.i32Field(1, 3)
+		w.i32Field(2, parquetEncodingRLEDictionary)
+		w.i32Field(3, parquetEncodingRLE)
+		w.i32Field(4, parquetEncodingRLE)
+	})
+
+	// metric1: 5, 6, 7 as 32-bit integers, compressed with gzip
+	metric1 := []byte{5, 0, 0, 0, 6, 0, 0, 0, 7, 0, 0, 0}
+	var gzipped bytes.Buffer
+	gw := gzip.NewWriter(&gzipped)
+	gw.Write(metric1)
+	gw.Close()
+	metric1Page := parquetTestPage(parquetPageData, 5, len(metric1), gzipped.Bytes(), func(w *thriftWriter) {
+		w.i32Field(1, 3)
+		w.i32Field(2, parquetEncodingPlain)
+	})
+
+	// count: 1, 2, 1 in a run-length encoded dictionary page
+	countDictionary := []byte{1, 0, 0, 0, 2, 0, 0, 0}
+	countDictionaryPage := parquetTestPage(parquetPageDictionary, 7, len(countDictionary), countDictionary,
+		func(w *thriftWriter) {
+			w.i32Field(1, 2)
+			w.i32Field(2, parquetEncodingPlain)
+		})
+	count := []byte{1, 2, 0, 2, 1, 2, 0} // Runs of one 0, one 1, and one 0
+	countPage := parquetTestPage(parquetPageData, 5, len(count), count, func(w *thriftWriter) {
+		w.i32Field(1, 3)
+		w.i32Field(2, parquetEncodingPlainDictionary)
+	})
+
+	file := parquetTestFile(3, []parquetTestColumn{
+		{"at", parquetTypeInt64, parquetRequired, parquetConvertedTimestampMillis, parquetCodecUncompressed,
+			[][]byte{atPage}},
+		{"dim1", parquetTypeByteArray, parquetOptional, parquetConvertedUTF8, parquetCodecSnappy,
+			[][]byte{dictionaryPage, dim1Page}},
+		{"metric1", parquetTypeInt32, parquetRequired, -1, parquetCodecGzip, [][]byte{metric1Page}},
+		{"count", parquetTypeInt32, parquetRequired, -1, parquetCodecUncompressed,
+			[][]byte{countDictionaryPage, countPage}},
+	})
+
+	schema := schemaFixture()
+	schema.Initialize()
+	r, err := schema.NewParquetReader(bytes.NewReader(file), int64(len(file)), nil, "count")
+	Assert(t, err, IsNil)
+	rows, err := r.ReadRowGroup(0)
+	Assert(t, err, IsNil)
+	Assert(t, rows, DeepEquals, []UnpackedRow{
+		{RowMap{"at": json.Number("0"), "dim1": "y", "metric1": json.Number("5")}, 1},
+		{RowMap{"at": json.Number("3600"), "metric1": json.Number("6")}, 2},
+		{RowMap{"at": json.Number("3600"), "dim1": "x", "metric1": json.Number("7")}, 1},
+	})
+
+	// Mapping the columns, ignoring metric1
+	mapping := map[string]string{"at": "at", "dim1": "dim1", "count": "metric1"}
+	r, err = schema.NewParquetReader(bytes.NewReader(file), int64(len(file)), mapping, "")
+	Assert(t, err, IsNil)
+	rows, err = r.ReadRowGroup(0)
+	Assert(t, err, IsNil)
+	Assert(t, rows[1], DeepEquals,
+		UnpackedRow{RowMap{"at": json.Number("3600"), "metric1": json.Number("2")}, 1})
+}
+
+func TestParquetReaderErrors(t *testing.T) {
+	schema := schemaFixture()
+	schema.Initialize()
+	newReader := func(file []byte, mapping map[string]string) error {
+		r, err := schema.NewParquetReader(bytes.NewReader(file), int64(len(file)), mapping, "")
+		if err != nil {
+			return err
+		}
+		_, err = r.ReadRowGroup(0)
+		return err
+	}
+
+	Assert(t, newReader([]byte("a,b,c\n1,2,3\n"), nil).Error(), Equals, "not a Parquet file")
+
+	page := parquetTestPage(parquetPageData, 5, 8, make([]byte, 8), func(w *thriftWriter) {
+		w.i32Field(1, 1)
+		w.i32Field(2, parquetEncodingPlain)
+	})
+	column := parquetTestColumn{"at", parquetTypeInt64, parquetRequired, -1, parquetCodecUncompressed,
+		[][]byte{page}}
+	Assert(t, newReader(parquetTestFile(1, []parquetTestColumn{column}), nil), IsNil)
+
+	bogus := column
+	bogus.name = "bogus"
+	Assert(t, newReader(parquetTestFile(1, []parquetTestColumn{column, bogus}), nil).Error(), Equals,
+		`Parquet column "bogus": "bogus" is not a valid column name`)
+	Assert(t, newReader(parquetTestFile(1, []parquetTestColumn{bogus}), map[string]string{}).Error(), Equals,
+		`no Parquet column maps to the timestamp column ("at")`)
+
+	zstd := column
+	zstd.codec = 6
+	Assert(t, newReader(parquetTestFile(1, []parquetTestColumn{zstd}), nil).Error(), Equals,
+		`Parquet row group 0, column "at": the ZSTD compression codec is not supported`)
+
+	decimal := column
+	decimal.convertedType = parquetConvertedDecimal
+	Assert(t, newReader(parquetTestFile(1, []parquetTestColumn{decimal}), nil).Error(), Equals,
+		`Parquet column "at": decimals are not supported`)
+
+	repeated := column
+	repeated.repetition = parquetRepeated
+	Assert(t, newReader(parquetTestFile(1, []parquetTestColumn{repeated}), nil).Error(), Equals,
+		`Parquet column "at": repeated columns are not supported`)
+
+	// A row group with more rows than the column chunk has values
+	Assert(t, newReader(parquetTestFile(2, []parquetTestColumn{column}), nil).Error(), Equals,
+		`Parquet row group 0, column "at": the column chunk ends after 1 of 2 values`)
+}
+
+func TestSnappyDecode(t *testing.T) {
+	// The literal "abc" and a copy of 9 bytes from 3 bytes back (which overlaps the bytes it writes)
+	b, err := snappyDecode([]byte{12, 2 << 2, 'a', 'b', 'c', 5<<2 | 1, 3})
+	Assert(t, err, IsNil)
+	Assert(t, string(b), Equals, "abcabcabcabc")
+
+	// A copy with a 2-byte offset
+	b, err = snappyDecode([]byte{6, 2 << 2, 'x', 'y', 'z', 2<<2 | 2, 3, 0})
+	Assert(t, err, IsNil)
+	Assert(t, string(b), Equals, "xyzxyz")
+
+	b, err = snappyDecode(snappyLiteral(bytes.Repeat([]byte("q"), 1000)))
+	Assert(t, err, IsNil)
+	Assert(t, len(b), Equals, 1000)
+
+	_, err = snappyDecode([]byte{12, 2 << 2, 'a', 'b', 'c', 5<<2 | 1, 4}) // The offset is too far back
+	Assert(t, err, Equals, errBadSnappy)
+	_, err = snappyDecode([]byte{4, 2 << 2, 'a', 'b', 'c'}) // The wrong length
+	Assert(t, err, Equals, errBadSnappy)
+}
+
+func TestDecodeParquetHybrid(t *testing.T) {
+	// A run of five 3s, then bit-packed 0 through 7 (3 bits each), then a run of two 1s
+	data := []byte{10, 3, 3, 0x88, 0xc6, 0xfa, 4, 1}
+	values, err := decodeParquetHybrid(data, 3, 15)
+	Assert(t, err, IsNil)
+	Assert(t, values, DeepEquals, []int{3, 3, 3, 3, 3, 0, 1, 2, 3, 4, 5, 6, 7, 1, 1})
+
+	_, err = decodeParquetHybrid(data, 3, 16)
+	Assert(t, err, NotNil)
+}
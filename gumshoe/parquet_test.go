@@ -0,0 +1,75 @@
+package gumshoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestParquetWriter(t *testing.T) {
+	schema := schemaFixture()
+	schema.MetricColumns = append(schema.MetricColumns, makeMetricColumn("metric2", "float64"))
+	schema.Initialize()
+	columns := []string{"at", "dim1", "metric2", "rowCount"}
+	var buf bytes.Buffer
+	w, err := schema.NewParquetWriter(&buf, columns)
+	Assert(t, err, IsNil)
+	Assert(t, w.Write(RowMap{"at": int64(0), "dim1": "a", "metric2": 1.5, "rowCount": 2}), IsNil)
+	Assert(t, w.Write(RowMap{"at": int64(3600), "dim1": nil, "metric2": 0.0, "rowCount": 1}), IsNil)
+	Assert(t, w.Write(RowMap{"at": int64(3600), "dim1": "bc", "metric2": -2.0, "rowCount": 1}), IsNil)
+	Assert(t, w.Close(), IsNil)
+
+	b := buf.Bytes()
+	Assert(t, string(b[:4]), Equals, parquetMagic)
+	Assert(t, string(b[len(b)-4:]), Equals, parquetMagic)
+	metadataLen := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	r := &thriftReader{buf: b, pos: len(b) - 8 - metadataLen}
+	metadata := r.readStruct()
+	Assert(t, r.pos, Equals, len(b)-8)
+	Assert(t, metadata[3], Equals, int64(3)) // num_rows
+
+	elements := metadata[2].([]interface{})
+	Assert(t, len(elements), Equals, 5)
+	Assert(t, elements[0].(map[int]interface{})[5], Equals, int64(4)) // num_children
+	var types []int64
+	for i, element := range elements[1:] {
+		fields := element.(map[int]interface{})
+		Assert(t, string(fields[4].([]byte)), Equals, columns[i])
+		types = append(types, fields[1].(int64))
+	}
+	Assert(t, types, DeepEquals, []int64{parquetTypeInt64, parquetTypeByteArray, parquetTypeDouble,
+		parquetTypeInt64})
+
+	rowGroups := metadata[4].([]interface{})
+	Assert(t, len(rowGroups), Equals, 1)
+	chunks := rowGroups[0].(map[int]interface{})[1].([]interface{})
+	Assert(t, len(chunks), Equals, 4)
+
+	// Read the strings of dim1.
+	chunk := chunks[1].(map[int]interface{})[3].(map[int]interface{})
+	r = &thriftReader{buf: b, pos: int(chunk[9].(int64))}
+	page := r.readStruct()
+	Assert(t, page[5].(map[int]interface{})[1], Equals, int64(3)) // num_values
+	body := b[r.pos : r.pos+int(page[2].(int64))]
+	Assert(t, int64(r.pos+len(body))-chunk[9].(int64), Equals, chunk[6].(int64))
+	levelsLen := int(binary.LittleEndian.Uint32(body))
+	// Runs of one 1, one 0, and one 1
+	Assert(t, body[4:4+levelsLen], DeepEquals, []byte{2, 1, 2, 0, 2, 1})
+	Assert(t, body[4+levelsLen:], DeepEquals, []byte{1, 0, 0, 0, 'a', 2, 0, 0, 0, 'b', 'c'})
+
+	// Read the doubles of metric2.
+	chunk = chunks[2].(map[int]interface{})[3].(map[int]interface{})
+	r = &thriftReader{buf: b, pos: int(chunk[9].(int64))}
+	page = r.readStruct()
+	body = b[r.pos : r.pos+int(page[2].(int64))]
+	levelsLen = int(binary.LittleEndian.Uint32(body))
+	Assert(t, body[4:4+levelsLen], DeepEquals, []byte{6, 1})
+	var values []float64
+	for i := 4 + levelsLen; i < len(body); i += 8 {
+		values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(body[i:])))
+	}
+	Assert(t, values, DeepEquals, []float64{1.5, 0, -2})
+}
@@ -6,7 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
 	"strings"
+	"time"
 )
 
 func ParseJSONQuery(r io.Reader) (*Query, error) {
@@ -22,6 +24,47 @@ type Query struct {
 	Aggregates []QueryAggregate
 	Groupings  []QueryGrouping
 	Filters    []QueryFilter
+	// Lookups label the aggregated results using lookup tables.
+	Lookups []QueryLookup `json:",omitempty"`
+	// Expressions add computed columns to the aggregated results.
+	Expressions []QueryExpression `json:",omitempty"`
+	// Windows add columns computed over neighboring time buckets. They require grouping by time.
+	Windows []QueryWindow `json:",omitempty"`
+	// HavingFilters are applied to the aggregated results. Their columns are aggregate, expression, or window
+	// names or "rowCount".
+	HavingFilters []QueryFilter `json:",omitempty"`
+	OrderBy       []QueryOrder  `json:",omitempty"` // Sort keys for the results, in priority order
+	Limit         int           `json:",omitempty"` // If positive, the maximum number of results to return
+	// SampleRate, if set, is the approximate fraction of rows to scan. Sums and row counts are scaled up to
+	// estimate the totals.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+	// Fill, if set, adds empty rows for the time buckets with no data. It requires grouping by time.
+	Fill *TimeFill `json:",omitempty"`
+}
+
+// TimeBucketDuration returns the size of the time buckets that q groups rows into, given the name of the
+// timestamp column and the DB's interval duration (the precision of stored timestamps). ok is false if q does
+// not group by the timestamp column.
+func (q *Query) TimeBucketDuration(timestampColumn string,
+	intervalDuration time.Duration) (d time.Duration, ok bool) {
+
+	if len(q.Groupings) == 0 || q.Groupings[0].Column != timestampColumn {
+		return 0, false
+	}
+	d = time.Duration(q.Groupings[0].TimeTransform) * time.Second
+	if d < intervalDuration {
+		d = intervalDuration
+	}
+	return d, true
+}
+
+// SampleStride returns n such that a scan for q visits every nth row. It is 1 if q is not sampled. The
+// actual sample rate is 1/n.
+func (q *Query) SampleStride() int {
+	if q.SampleRate <= 0 || q.SampleRate >= 1 {
+		return 1
+	}
+	return int(math.Floor(1/q.SampleRate + 0.5))
 }
 
 func (q *Query) String() string {
@@ -43,7 +86,9 @@ type QueryAggregate struct {
 
 type QueryGrouping struct {
 	// This provides a means of specifying an optional date truncation function, assuming the column is a
-	// timestamp. It makes it possible to group by time intervals (minute, hour, day).
+	// timestamp. It makes it possible to group by time intervals (minute, hour, day, or any duration such as
+	// "6h"). Timestamps are only stored to the precision of the DB's interval duration, so buckets smaller than
+	// that aren't useful.
 	TimeTransform TimeTruncationType `json:",omitempty"`
 	Column        string
 	Name          string
@@ -55,6 +100,13 @@ type QueryFilter struct {
 	Value  Untyped
 }
 
+// A QueryOrder is a key for sorting query results. The column is the name of an aggregate, expression,
+// window, or grouping in the query, or "rowCount".
+type QueryOrder struct {
+	Column    string
+	Direction OrderDirection `json:",omitempty"`
+}
+
 func (a *QueryAggregate) UnmarshalJSON(b []byte) error {
 	var agg struct {
 		Type   AggregateType
@@ -71,6 +123,22 @@ func (a *QueryAggregate) UnmarshalJSON(b []byte) error {
 	return nil
 }
 
+func (l *QueryLookup) UnmarshalJSON(b []byte) error {
+	var lookup struct {
+		Table  string
+		Column string
+		Name   string
+	}
+	if err := json.Unmarshal(b, &lookup); err != nil {
+		return err
+	}
+	*l = QueryLookup(lookup)
+	if l.Name == "" {
+		l.Name = l.Table
+	}
+	return nil
+}
+
 func (g *QueryGrouping) UnmarshalJSON(b []byte) error {
 	errInvalid := fmt.Errorf("invalid grouping: %q", b)
 	if len(b) < 2 {
@@ -104,14 +172,43 @@ type AggregateType int
 const (
 	AggregateSum AggregateType = iota
 	AggregateAvg
+	AggregateDistinct // Approximate count of distinct values of a dimension column
+	AggregateP50      // Approximate percentiles of a metric column
+	AggregateP95
+	AggregateP99
+	AggregateRate // Sum of a metric column per second of each time bucket
 )
 
+// Quantile returns the quantile estimated by a percentile aggregate type (for instance, 0.95 for
+// AggregateP95). ok is false if t is not a percentile aggregate.
+func (t AggregateType) Quantile() (q float64, ok bool) {
+	switch t {
+	case AggregateP50:
+		return 0.5, true
+	case AggregateP95:
+		return 0.95, true
+	case AggregateP99:
+		return 0.99, true
+	}
+	return 0, false
+}
+
 func (t AggregateType) MarshalJSON() ([]byte, error) {
 	switch t {
 	case AggregateSum:
 		return []byte(`"sum"`), nil
 	case AggregateAvg:
 		return []byte(`"average"`), nil
+	case AggregateDistinct:
+		return []byte(`"distinct"`), nil
+	case AggregateP50:
+		return []byte(`"p50"`), nil
+	case AggregateP95:
+		return []byte(`"p95"`), nil
+	case AggregateP99:
+		return []byte(`"p99"`), nil
+	case AggregateRate:
+		return []byte(`"rate"`), nil
 	default:
 		panic("bad type")
 	}
@@ -127,21 +224,40 @@ func (t *AggregateType) UnmarshalJSON(b []byte) error {
 		*t = AggregateSum
 	case "average":
 		*t = AggregateAvg
+	case "distinct":
+		*t = AggregateDistinct
+	case "p50":
+		*t = AggregateP50
+	case "p95":
+		*t = AggregateP95
+	case "p99":
+		*t = AggregateP99
+	case "rate":
+		*t = AggregateRate
 	default:
 		return fmt.Errorf("bad aggregate type: %q", name)
 	}
 	return nil
 }
 
+// TimeTruncationType is the size, in seconds, of the buckets that timestamps are truncated to.
 type TimeTruncationType int
 
 const (
-	TimeTruncationNone TimeTruncationType = iota
-	TimeTruncationMinute
-	TimeTruncationHour
-	TimeTruncationDay
+	TimeTruncationNone   TimeTruncationType = 0
+	TimeTruncationMinute TimeTruncationType = 60
+	TimeTruncationHour   TimeTruncationType = 60 * 60
+	TimeTruncationDay    TimeTruncationType = 24 * 60 * 60
 )
 
+// TruncateTimestamp truncates timestamp to the start of its bucket.
+func (t TimeTruncationType) TruncateTimestamp(timestamp int64) int64 {
+	if t == TimeTruncationNone {
+		return timestamp
+	}
+	return timestamp - timestamp%int64(t)
+}
+
 func (t TimeTruncationType) MarshalJSON() ([]byte, error) {
 	var name string
 	switch t {
@@ -154,7 +270,10 @@ func (t TimeTruncationType) MarshalJSON() ([]byte, error) {
 	case TimeTruncationDay:
 		name = "day"
 	default:
-		panic("bad time truncation type")
+		if t < 0 {
+			panic("bad time truncation type")
+		}
+		name = (time.Duration(t) * time.Second).String()
 	}
 	return []byte(fmt.Sprintf("%q", name)), nil
 }
@@ -177,21 +296,63 @@ func (t *TimeTruncationType) UnmarshalJSON(b []byte) error {
 	case "day":
 		*t = TimeTruncationDay
 	default:
-		return fmt.Errorf("bad time truncation function: %q", name)
+		d, err := time.ParseDuration(name)
+		if err != nil {
+			return fmt.Errorf("bad time truncation function: %q", name)
+		}
+		if d < time.Second || d%time.Second != 0 || d > math.MaxUint32*time.Second {
+			return fmt.Errorf("time truncation duration must be a positive whole number of seconds: %q", name)
+		}
+		*t = TimeTruncationType(d / time.Second)
+	}
+	return nil
+}
+
+type OrderDirection int
+
+const (
+	OrderAscending OrderDirection = iota
+	OrderDescending
+)
+
+func (d OrderDirection) MarshalJSON() ([]byte, error) {
+	switch d {
+	case OrderAscending:
+		return []byte(`"asc"`), nil
+	case OrderDescending:
+		return []byte(`"desc"`), nil
+	default:
+		panic("bad order direction")
+	}
+}
+
+func (d *OrderDirection) UnmarshalJSON(b []byte) error {
+	var name string
+	if err := json.Unmarshal(b, &name); err != nil {
+		return err
+	}
+	switch name {
+	case "asc":
+		*d = OrderAscending
+	case "desc":
+		*d = OrderDescending
+	default:
+		return fmt.Errorf("bad order direction: %q", name)
 	}
 	return nil
 }
 
 // See FilterType definitions in type_gen.go
 
-func (t FilterType) MarshalJSON() ([]byte, error) {
+func (t FilterType) name() string {
 	if int(t) >= len(filterTypeToName) {
 		panic("bad filter type")
 	}
-	name := filterTypeToName[t]
-	return []byte(fmt.Sprintf("%q", name)), nil
+	return filterTypeToName[t]
 }
 
+func (t FilterType) MarshalJSON() ([]byte, error) { return []byte(fmt.Sprintf("%q", t.name())), nil }
+
 func (t *FilterType) UnmarshalJSON(b []byte) error {
 	var name string
 	if err := json.Unmarshal(b, &name); err != nil {
@@ -1,6 +1,7 @@
 package gumshoe
 
 import (
+	"encoding/json"
 	"strings"
 	"testing"
 
@@ -37,3 +38,39 @@ func TestParseQueryDefaultNames(t *testing.T) {
 	Assert(t, query.Groupings[1].Column, Equals, "dim2")
 	Assert(t, query.Groupings[1].Name, Equals, "dim2")
 }
+
+func TestParseQueryOrderByAndLimit(t *testing.T) {
+	const queryString = `
+		{
+	   "aggregates": [{"type": "sum", "column": "metric1"}],
+	   "orderBy": [{"column": "metric1", "direction": "desc"}, {"column": "rowCount"}],
+	   "limit": 10
+		}`
+	query, err := ParseJSONQuery(strings.NewReader(queryString))
+	Assert(t, err, IsNil)
+
+	Assert(t, query.OrderBy, DeepEquals, []QueryOrder{{"metric1", OrderDescending}, {"rowCount", OrderAscending}})
+	Assert(t, query.Limit, Equals, 10)
+}
+
+func TestParseQueryTimeTruncationDurations(t *testing.T) {
+	const queryString = `
+		{
+	   "aggregates": [{"type": "sum", "column": "metric1"}],
+	   "groupings": [{"column": "at", "timeTransform": "5m"}, {"column": "at", "timeTransform": "hour"}]
+		}`
+	query, err := ParseJSONQuery(strings.NewReader(queryString))
+	Assert(t, err, IsNil)
+
+	Assert(t, query.Groupings[0].TimeTransform, Equals, TimeTruncationType(5*60))
+	Assert(t, query.Groupings[1].TimeTransform, Equals, TimeTruncationHour)
+
+	b, err := json.Marshal(query.Groupings[0].TimeTransform)
+	Assert(t, err, IsNil)
+	Assert(t, string(b), Equals, `"5m0s"`)
+
+	for _, bad := range []string{`"fortnight"`, `"-5m"`, `"1500ms"`} {
+		var truncation TimeTruncationType
+		Assert(t, json.Unmarshal([]byte(bad), &truncation), NotNil)
+	}
+}
@@ -3,9 +3,14 @@
 package gumshoe
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math"
+	"regexp"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 )
@@ -18,16 +23,36 @@ func (u UntypedBytes) Pointer() unsafe.Pointer { return unsafe.Pointer(&u[0]) }
 
 type rowAggregate struct {
 	GroupByValue Untyped
-	Sums         []Untyped // Corresponds to query.Aggregates
+	Sums         []Untyped      // Corresponds to the sum and average aggregates in query.Aggregates
+	Sketches     []*HyperLogLog // Corresponds to the distinct aggregates in query.Aggregates
+	Digests      []*TDigest     // Corresponds to the percentile aggregates in query.Aggregates
 	Count        uint32
 }
 
 type scanParams struct {
 	TimestampFilterFuncs []timestampFilterFunc
 	FilterFuncs          []filterFunc
+	ZoneFilters          []zoneFilter // For skipping segments by their zone maps
+	BloomQueries         []bloomQuery // For skipping segments by their bloom filters
 	SumColumns           []MetricColumn
 	SumFuncs             []sumFunc
+	DistinctFuncs        []distinctFunc
+	PercentileFuncs      []percentileFunc
 	Grouping             *groupingParams
+	SampleStride         int             // The scan visits every SampleStride-th row
+	Done                 <-chan struct{} // Closed if the query is canceled
+	Progress             *QueryProgress  // Nil unless the query's progress is being tracked
+}
+
+// canceled reports whether the query has been canceled, in which case scans should stop early (their partial
+// results are discarded).
+func (p *scanParams) canceled() bool {
+	select {
+	case <-p.Done:
+		return true
+	default:
+		return false
+	}
 }
 
 // groupingParams contains all configuration needed to perform the user's group by query.
@@ -35,6 +60,11 @@ type groupingParams struct {
 	OnTimestampColumn bool
 	ColumnIndex       int
 	TransformFunc     transformFunc
+	// With slice grouping (see sliceGroupingRange), the groups are indexed by dimension value (or, for a
+	// string column, dimension table index) minus SliceMin, and there are SliceSize of them.
+	UseSlice  bool
+	SliceMin  int
+	SliceSize int
 }
 
 type (
@@ -42,11 +72,44 @@ type (
 	filterFunc          func(row RowBytes) bool
 	timestampFilterFunc func(timestamp uint32) bool
 	sumFunc             func(sum UntypedBytes, metrics MetricBytes)
+	distinctFunc        func(sketch *HyperLogLog, row RowBytes)
+	percentileFunc      func(digest *TDigest, row RowBytes)
 )
 
 // TODO(caleb): Wherever we use falseFilterFunc, we can optimize by immediately returning an empty result.
 var falseFilterFunc = func(RowBytes) bool { return false }
 
+var trueFilterFunc = func(RowBytes) bool { return true }
+
+// emptyInFilterFunc returns the filter for an 'in' (or, if negate is set, 'not in') filter which can match
+// no values.
+func emptyInFilterFunc(negate bool) filterFunc {
+	if negate {
+		return trueFilterFunc
+	}
+	return falseFilterFunc
+}
+
+// IntervalMatches reports whether the interval starting at start is scanned by q: that is, whether the
+// start passes each of the query's filters on the timestamp column (named timestampColumn). The router uses
+// this to skip shards which hold none of the intervals a query needs.
+func (q *Query) IntervalMatches(timestampColumn string, start time.Time) (bool, error) {
+	timestamp := uint32(start.Unix())
+	for _, filter := range q.Filters {
+		if filter.Column != timestampColumn {
+			continue
+		}
+		f, err := makeTimestampFilterFunc(filter)
+		if err != nil {
+			return false, err
+		}
+		if !f(timestamp) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
 func (p *scanParams) AllTimestampFilterFuncsMatch(intervalTimestamp time.Time) bool {
 	timestamp := uint32(intervalTimestamp.Unix())
 	for _, f := range p.TimestampFilterFuncs {
@@ -57,19 +120,123 @@ func (p *scanParams) AllTimestampFilterFuncsMatch(intervalTimestamp time.Time) b
 	return true
 }
 
-// InvokeQuery runs query on a StaticTable. It returns a slice of aggregated row results.
-func (s *StaticTable) InvokeQuery(query *Query) ([]RowMap, error) {
+// InvokeQuery runs query on a StaticTable. It returns a slice of aggregated row results. If ctx is canceled
+// or its deadline passes before the scan is finished, the scan is aborted and ctx's error is returned.
+func (s *StaticTable) InvokeQuery(ctx context.Context, query *Query) ([]RowMap, error) {
+	return s.invokeQuery(ctx, query, false)
+}
+
+// InvokeQuerySketches is like InvokeQuery, but the results of approximate aggregates are sketches rather than
+// final estimates: *HyperLogLogs for distinct aggregates and *TDigests for percentile aggregates. This allows
+// the results to be merged with those of other tables. Because the results are partial, the query's
+// expressions, having filters, ordering, and limit are not applied.
+func (s *StaticTable) InvokeQuerySketches(ctx context.Context, query *Query) ([]RowMap, error) {
+	return s.invokeQuery(ctx, query, true)
+}
+
+func (s *StaticTable) invokeQuery(ctx context.Context, query *Query, sketches bool) ([]RowMap, error) {
 	Log.Println("Running query:", query)
-	sumColumns := make([]MetricColumn, len(query.Aggregates))
-	sumFuncs := make([]sumFunc, len(query.Aggregates))
-	for i, aggregate := range query.Aggregates {
+	params, err := s.makeScanParams(query)
+	if err != nil {
+		return nil, err
+	}
+	params.Done = ctx.Done()
+	params.Progress = queryProgressFrom(ctx)
+
+	Log.Printf("Query: grouping=%t, %d timestamp filter funcs, %d sum columns, %d distinct columns, "+
+		"%d percentile columns, %d filter funcs", params.Grouping != nil, len(params.TimestampFilterFuncs),
+		len(params.SumColumns), len(params.DistinctFuncs), len(params.PercentileFuncs), len(params.FilterFuncs))
+
+	start := time.Now()
+	rows, stats, err := s.scan(params)
+	if err != nil {
+		return nil, err
+	}
+	Log.Printf("Query: scan completed in %s; %d intervals skipped; %d intervals scanned; "+
+		"%d segments skipped; %d rows scanned", time.Since(start), stats.Get(statIntervalsSkipped),
+		stats.Get(statIntervalsScanned), stats.Get(statSegmentsSkipped), stats.Get(statRowsScanned))
+	if err := ctx.Err(); err != nil {
+		Log.Printf("Query: aborted (%s)", err)
+		return nil, err
+	}
+	if params.SampleStride > 1 {
+		scaleRowAggregates(rows, params.SampleStride)
+	}
+
+	results := s.postProcessScanRows(rows, query, params.Grouping, sketches)
+	if sketches {
+		// Sketch results are only partial; filling, expressions, windows, filtering, and ordering must wait
+		// until they've been merged.
+		return results, nil
+	}
+	bucket, _ := query.TimeBucketDuration(s.TimestampColumn.Name, s.IntervalDuration)
+	results, err = ApplyTimeFill(results, query, s.TimestampColumn.Name, bucket)
+	if err != nil {
+		return nil, err
+	}
+	ApplyExpressions(results, query)
+	ApplyWindows(results, query, bucket)
+	return OrderAndLimitRows(ApplyHavingFilters(results, query), query), nil
+}
+
+// makeScanParams validates query and compiles it into the functions used to scan s.
+func (s *StaticTable) makeScanParams(query *Query) (*scanParams, error) {
+	if err := query.ValidateExpressions(); err != nil {
+		return nil, err
+	}
+	if err := query.ValidateWindows(); err != nil {
+		return nil, err
+	}
+	if err := query.ValidateHavingFilters(); err != nil {
+		return nil, err
+	}
+	if err := query.ValidateOrderBy(); err != nil {
+		return nil, err
+	}
+	if _, ok := query.TimeBucketDuration(s.TimestampColumn.Name, s.IntervalDuration); !ok {
+		for _, aggregate := range query.Aggregates {
+			if aggregate.Type == AggregateRate {
+				return nil, fmt.Errorf("rate aggregate %q requires grouping by %s", aggregate.Name,
+					s.TimestampColumn.Name)
+			}
+		}
+		if query.Fill != nil {
+			return nil, fmt.Errorf("fill requires grouping by %s", s.TimestampColumn.Name)
+		}
+		if len(query.Windows) > 0 {
+			return nil, fmt.Errorf("windows require grouping by %s", s.TimestampColumn.Name)
+		}
+	}
+	if query.SampleRate < 0 || query.SampleRate > 1 {
+		return nil, fmt.Errorf("sample rate must be between 0 and 1; got %v", query.SampleRate)
+	}
+	var (
+		sumColumns      []MetricColumn
+		sumFuncs        []sumFunc
+		distinctFuncs   []distinctFunc
+		percentileFuncs []percentileFunc
+	)
+	for _, aggregate := range query.Aggregates {
+		if aggregate.Type == AggregateDistinct {
+			index, ok := s.DimensionNameToIndex[aggregate.Column]
+			if !ok {
+				return nil, fmt.Errorf("%s (selected for distinct count) is not a valid dimension column name",
+					aggregate.Column)
+			}
+			distinctFuncs = append(distinctFuncs, s.makeDistinctFunc(index))
+			continue
+		}
 		index, ok := s.MetricNameToIndex[aggregate.Column]
 		if !ok {
 			return nil, fmt.Errorf("%s (selected for aggregation) is not a valid metric column name",
 				aggregate.Column)
 		}
-		sumFuncs[i] = s.makeSumFunc(aggregate, index)
-		sumColumns[i] = s.MetricColumns[index]
+		if _, ok := aggregate.Type.Quantile(); ok {
+			percentileFuncs = append(percentileFuncs, s.makePercentileFunc(index))
+			continue
+		}
+		sumFuncs = append(sumFuncs, s.makeSumFunc(aggregate, index))
+		sumColumns = append(sumColumns, s.MetricColumns[index])
 	}
 
 	// NOTE(philc): For now, only support one level of grouping. We intend to support multiple levels.
@@ -107,9 +274,11 @@ func (s *StaticTable) InvokeQuery(query *Query) ([]RowMap, error) {
 
 	var timestampFilterFuncs []timestampFilterFunc
 	var filterFuncs []filterFunc
+	var zoneFilters []zoneFilter
+	var bloomQueries []bloomQuery
 	for _, queryFilter := range query.Filters {
 		if queryFilter.Column == s.TimestampColumn.Name {
-			filter, err := s.makeTimestampFilterFunc(queryFilter)
+			filter, err := makeTimestampFilterFunc(queryFilter)
 			if err != nil {
 				return nil, err
 			}
@@ -121,6 +290,12 @@ func (s *StaticTable) InvokeQuery(query *Query) ([]RowMap, error) {
 		var filter filterFunc
 		if index, ok := s.DimensionNameToIndex[queryFilter.Column]; ok {
 			filter, err = s.makeDimensionFilterFunc(queryFilter, index)
+			if zf, ok := s.makeZoneFilter(queryFilter, index); ok {
+				zoneFilters = append(zoneFilters, zf)
+			}
+			if q, ok := s.makeBloomQuery(queryFilter, index); ok {
+				bloomQueries = append(bloomQueries, q)
+			}
 		} else if index, ok := s.MetricNameToIndex[queryFilter.Column]; ok {
 			filter, err = s.makeMetricFilterFunc(queryFilter, index)
 		} else {
@@ -135,33 +310,43 @@ func (s *StaticTable) InvokeQuery(query *Query) ([]RowMap, error) {
 	params := &scanParams{
 		TimestampFilterFuncs: timestampFilterFuncs,
 		FilterFuncs:          filterFuncs,
+		ZoneFilters:          zoneFilters,
+		BloomQueries:         bloomQueries,
 		SumColumns:           sumColumns,
 		SumFuncs:             sumFuncs,
+		DistinctFuncs:        distinctFuncs,
+		PercentileFuncs:      percentileFuncs,
 		Grouping:             grouping,
+		SampleStride:         query.SampleStride(),
 	}
-
-	Log.Printf("Query: grouping=%t, %d timestamp filter funcs, %d sum columns, %d filter funcs",
-		grouping != nil, len(timestampFilterFuncs), len(sumColumns), len(filterFuncs))
-
-	start := time.Now()
-	rows, stats := s.scan(params)
-	Log.Printf("Query: scan completed in %s; %d intervals skipped; %d intervals scanned; %d rows scanned",
-		time.Since(start), stats.Get(statIntervalsSkipped), stats.Get(statIntervalsScanned),
-		stats.Get(statRowsScanned))
-
-	return s.postProcessScanRows(rows, query, grouping), nil
+	if grouping != nil {
+		grouping.UseSlice, grouping.SliceMin, grouping.SliceSize = s.sliceGroupingRange(params)
+	}
+	return params, nil
 }
 
 type scanPartial struct {
-	Sums  []UntypedBytes
-	Count uint32
+	Sums     []UntypedBytes
+	Sketches []*HyperLogLog
+	Digests  []*TDigest
+	Count    uint32
 }
 
 func makeScanPartial(params *scanParams) *scanPartial {
-	partial := &scanPartial{Sums: make([]UntypedBytes, len(params.SumColumns))}
+	partial := &scanPartial{
+		Sums:     make([]UntypedBytes, len(params.SumColumns)),
+		Sketches: make([]*HyperLogLog, len(params.DistinctFuncs)),
+		Digests:  make([]*TDigest, len(params.PercentileFuncs)),
+	}
 	for i, col := range params.SumColumns {
 		partial.Sums[i] = make(UntypedBytes, typeWidths[TypeToBigType[col.Type]])
 	}
+	for i := range partial.Sketches {
+		partial.Sketches[i] = NewHyperLogLog()
+	}
+	for i := range partial.Digests {
+		partial.Digests[i] = NewTDigest()
+	}
 	return partial
 }
 
@@ -169,23 +354,42 @@ func combineScanPartials(results []*scanPartial, params *scanParams, groupByValu
 	result := &rowAggregate{
 		GroupByValue: groupByValue,
 		Sums:         make([]Untyped, len(params.SumColumns)),
+		Sketches:     make([]*HyperLogLog, len(params.DistinctFuncs)),
+		Digests:      make([]*TDigest, len(params.PercentileFuncs)),
 	}
 	for i, col := range params.SumColumns {
 		result.Sums[i] = untypedZero(TypeToBigType[col.Type])
 	}
+	for i := range result.Sketches {
+		result.Sketches[i] = NewHyperLogLog()
+	}
+	for i := range result.Digests {
+		result.Digests[i] = NewTDigest()
+	}
 	for _, partial := range results {
 		for i, col := range params.SumColumns {
 			typ := TypeToBigType[col.Type]
 			partialSum := NumericCellValue(partial.Sums[i].Pointer(), typ)
 			result.Sums[i] = sumUntyped(result.Sums[i], partialSum, typ)
 		}
+		for i, sketch := range partial.Sketches {
+			result.Sketches[i].Merge(sketch)
+		}
+		for i, digest := range partial.Digests {
+			result.Digests[i].Merge(digest)
+		}
 		result.Count += partial.Count
 	}
 	return result
 }
 
+// A scanFunc scans some of the segments of an interval and returns a partial result, to be combined with the
+// others by the matching combine function.
+type scanFunc func(stats *scanStats, params *scanParams, timestamp time.Time, interval *Interval,
+	segments segmentRange) interface{}
+
 type scanRequest struct {
-	scanFunc  func(*scanStats, *scanParams, time.Time, *Interval) interface{}
+	scanFunc  scanFunc
 	partialCh chan interface{}
 	wg        *sync.WaitGroup
 
@@ -193,6 +397,74 @@ type scanRequest struct {
 	params    *scanParams
 	timestamp time.Time
 	interval  *Interval
+	segments  segmentRange
+}
+
+// A segmentRange is the run of an interval's segments, from start (inclusive) to end (exclusive), which one
+// scanRequest scans.
+type segmentRange struct {
+	start, end int
+}
+
+// splitSegments divides n segments into at most k ranges of nearly equal size. There's always at least one
+// range (which is empty if n is 0).
+func splitSegments(n, k int) []segmentRange {
+	if k > n {
+		k = n
+	}
+	if k < 1 {
+		k = 1
+	}
+	ranges := make([]segmentRange, k)
+	for i := range ranges {
+		ranges[i] = segmentRange{start: i * n / k, end: (i + 1) * n / k}
+	}
+	return ranges
+}
+
+// initialSampleOffset is the offset of the first sampled row in the segment at index start of interval, when
+// sampling every rowStride bytes from the start of the interval.
+func (s *Schema) initialSampleOffset(interval *Interval, start, rowStride int) int {
+	offset := 0
+	for _, segment := range interval.Segments[:start] {
+		offset = nextSampleOffset(offset, s.segmentNumRows(segment)*s.RowSize, rowStride)
+	}
+	return offset
+}
+
+// scanBuffers holds the buffers which scans decode compressed segments into (see Schema.SegmentRows), so
+// that only the segments being scanned are held decoded in memory.
+var scanBuffers = sync.Pool{New: func() interface{} { return new([]byte) }}
+
+// SetQueryParallelism changes the number of scans (of intervals, or runs of their segments) which may run in
+// parallel (and those of the DB's views). A scan already running isn't interrupted.
+func (db *DB) SetQueryParallelism(n int) error {
+	if n < 1 {
+		return fmt.Errorf("bad query parallelism (must be positive): %d", n)
+	}
+	db.setQueryWorkers(n)
+	for _, view := range db.views {
+		view.setQueryWorkers(n)
+	}
+	return nil
+}
+
+// setQueryWorkers starts or stops query workers until there are n of them.
+func (db *DB) setQueryWorkers(n int) {
+	db.workersLock.Lock()
+	defer db.workersLock.Unlock()
+	for atomic.LoadInt32(&db.numWorkers) < int32(n) {
+		go db.RunQueryWorker()
+		atomic.AddInt32(&db.numWorkers, 1)
+	}
+	for atomic.LoadInt32(&db.numWorkers) > int32(n) {
+		select {
+		case db.stopWorker <- struct{}{}:
+			atomic.AddInt32(&db.numWorkers, -1)
+		case <-db.shutdown:
+			return
+		}
+	}
 }
 
 func (db *DB) RunQueryWorker() {
@@ -200,20 +472,23 @@ func (db *DB) RunQueryWorker() {
 		select {
 		case <-db.shutdown:
 			return
+		case <-db.stopWorker:
+			return
 		case r := <-db.scanRequests:
-			r.partialCh <- r.scanFunc(r.stats, r.params, r.timestamp, r.interval)
+			r.partialCh <- r.scanFunc(r.stats, r.params, r.timestamp, r.interval, r.segments)
 			r.wg.Done()
 		}
 	}
 }
 
-func (s *StaticTable) scan(params *scanParams) ([]*rowAggregate, *scanStats) {
+func (s *StaticTable) scan(params *scanParams) ([]*rowAggregate, *scanStats, error) {
 	var (
 		stats     = newScanStats()
 		partialCh = make(chan interface{})
 		wg        sync.WaitGroup
+		fetchErr  error // The first error fetching a cold interval, if any
 
-		scanFunc    func(*scanStats, *scanParams, time.Time, *Interval) interface{}
+		scanFunc    scanFunc
 		combineFunc func(partials []interface{}, params *scanParams) []*rowAggregate
 	)
 
@@ -221,7 +496,7 @@ func (s *StaticTable) scan(params *scanParams) ([]*rowAggregate, *scanStats) {
 	case params.Grouping == nil:
 		scanFunc = s.scanSimple
 		combineFunc = combineSimple
-	case s.useSliceGrouping(params):
+	case params.Grouping.UseSlice:
 		scanFunc = s.scanSliceGrouping
 		combineFunc = combineSliceGrouping
 	default:
@@ -230,24 +505,70 @@ func (s *StaticTable) scan(params *scanParams) ([]*rowAggregate, *scanStats) {
 	}
 
 	go func() {
+		// Pick out the intervals to scan first, so that their segments can be spread across the workers: when
+		// there are fewer intervals than workers, the segments of each interval are split into ranges which are
+		// scanned in parallel (with their partial results combined like those of separate intervals).
+		var timestamps []time.Time
 		for timestamp, interval := range s.Intervals {
 			if !params.AllTimestampFilterFuncsMatch(timestamp) {
 				stats.Inc(statIntervalsSkipped)
 				continue
 			}
-			stats.Inc(statIntervalsScanned)
-			wg.Add(1)
-			s.scanRequests <- &scanRequest{
-				scanFunc:  scanFunc,
-				partialCh: partialCh,
-				wg:        &wg,
-				stats:     stats,
-				params:    params,
-				timestamp: timestamp,
-				interval:  interval,
+			if interval.Cold && !params.anySegmentMayMatch(interval) {
+				// Don't fetch it for nothing.
+				stats.Inc(statIntervalsSkipped)
+				continue
+			}
+			timestamps = append(timestamps, timestamp)
+		}
+		for _, timestamp := range timestamps {
+			params.Progress.addTotal(s.Intervals[timestamp].NumSegments)
+		}
+		rangesPerInterval := 1
+		if len(timestamps) > 0 {
+			workers := int(atomic.LoadInt32(s.numWorkers))
+			rangesPerInterval = (workers + len(timestamps) - 1) / len(timestamps)
+		}
+
+		// Cold intervals are fetched (if they aren't cached) before their scans are scheduled, and held until all
+		// the scans are done.
+		var releases []func()
+	intervalLoop:
+		for _, timestamp := range timestamps {
+			interval, release, err := s.coldCache.acquire(s.Intervals[timestamp])
+			if err != nil {
+				fetchErr = err
+				break
+			}
+			releases = append(releases, release)
+			for i, segments := range splitSegments(len(interval.Segments), rangesPerInterval) {
+				request := &scanRequest{
+					scanFunc:  scanFunc,
+					partialCh: partialCh,
+					wg:        &wg,
+					stats:     stats,
+					params:    params,
+					timestamp: timestamp,
+					interval:  interval,
+					segments:  segments,
+				}
+				wg.Add(1)
+				select {
+				case s.scanRequests <- request:
+					if i == 0 {
+						stats.Inc(statIntervalsScanned)
+					}
+				case <-params.Done:
+					// Don't bother scheduling any more scans; the partial results are going to be discarded.
+					wg.Done()
+					break intervalLoop
+				}
 			}
 		}
 		wg.Wait()
+		for _, release := range releases {
+			release()
+		}
 		close(partialCh)
 	}()
 
@@ -255,49 +576,119 @@ func (s *StaticTable) scan(params *scanParams) ([]*rowAggregate, *scanStats) {
 	for partial := range partialCh {
 		partials = append(partials, partial)
 	}
+	if fetchErr != nil {
+		return nil, nil, fetchErr
+	}
 
-	return combineFunc(partials, params), stats
+	return combineFunc(partials, params), stats, nil
 }
 
-// sliceGroupingSizeLimit is the cardinality of string dimension
+// sliceGroupingSizeLimit is the number of groups (the cardinality
+// of a string dimension, or the range of an integer one)
 // beyond which we use a map, rather than a slice, for grouping.
 // It's a var rather than a const so tests can adjust it.
 // This value was chosen as:
 //   500k * 8 bytes / pointer = 4MB max slice allocation per partial.
 var sliceGroupingSizeLimit int = 500e3
 
-func (s *StaticTable) useSliceGrouping(params *scanParams) bool {
+// sliceGroupingRange reports whether params can group using a slice rather than a map, and if so, the range
+// of values the slice covers, [min, min+size). For a string column, the values are dimension table indexes.
+// For an integer column, the range is that of the column in the zone maps of the intervals to be scanned, so
+// that a wide column with values close together can use a slice, and a narrow one doesn't need a slice
+// covering its whole type; without zone maps, only 1- and 2-byte columns can use a slice.
+func (s *StaticTable) sliceGroupingRange(params *scanParams) (ok bool, min, size int) {
 	// TODO(caleb): We should be able to use slice groupings here.
 	// It requires a two-phase grouping:
 	// - Scan using a slice to group on the un-transformed dimension value
 	// - Collapse into the final result by grouping on the transformed values
 	if params.Grouping.TransformFunc != nil {
-		return false
+		return false, 0, 0
 	}
 	// TODO(caleb): We should definitely be able to use a slice for timestamp grouping.
 	if params.Grouping.OnTimestampColumn {
-		return false
+		return false, 0, 0
 	}
-	groupingColumn := s.DimensionColumns[params.Grouping.ColumnIndex]
-	if groupingColumn.Width <= 2 {
-		return true
+	index := params.Grouping.ColumnIndex
+	groupingColumn := s.DimensionColumns[index]
+	if groupingColumn.String {
+		size = s.DimensionTables[index].Size
+		return size <= sliceGroupingSizeLimit, 0, size
+	}
+	if groupingColumn.Type == TypeFloat32 || groupingColumn.Type == TypeFloat64 {
+		return false, 0, 0
+	}
+	if lo, hi, ok := s.zoneMapRange(params, index); ok {
+		switch {
+		case lo > hi: // Every value is nil.
+			return true, 0, 0
+		// The ranges of 64-bit columns are only exact up to 2^53.
+		case hi-lo < float64(sliceGroupingSizeLimit) && lo > -(1<<53) && hi < 1<<53:
+			return true, int(lo), int(hi-lo) + 1
+		}
+	}
+	switch groupingColumn.Type {
+	case TypeUint8, TypeUint16:
+		return true, 0, 1 << uint(8*groupingColumn.Width)
+	case TypeInt8:
+		return true, math.MinInt8, 1 << 8
+	case TypeInt16:
+		return true, math.MinInt16, 1 << 16
+	}
+	return false, 0, 0
+}
+
+// zoneMapRange returns the smallest and largest values of dimension column index in the intervals which
+// params may scan, according to their zone maps. ok is false if any of those intervals lacks zone maps. If
+// the column has no non-nil values in the intervals, lo > hi.
+func (s *StaticTable) zoneMapRange(params *scanParams, index int) (lo, hi float64, ok bool) {
+	lo, hi = math.Inf(1), math.Inf(-1)
+	for timestamp, interval := range s.Intervals {
+		if !params.AllTimestampFilterFuncsMatch(timestamp) {
+			continue
+		}
+		if len(interval.ZoneMaps) != interval.NumSegments {
+			return 0, 0, false
+		}
+		for _, zoneMap := range interval.ZoneMaps {
+			if r := zoneMap[index]; r != nil {
+				lo = math.Min(lo, r.Min)
+				hi = math.Max(hi, r.Max)
+			}
+		}
 	}
-	return groupingColumn.String &&
-		s.DimensionTables[params.Grouping.ColumnIndex].Size <= sliceGroupingSizeLimit
+	return lo, hi, true
 }
 
-func (s *StaticTable) scanSimple(stats *scanStats, params *scanParams, _ time.Time, interval *Interval) interface{} {
+func (s *StaticTable) scanSimple(stats *scanStats, params *scanParams, _ time.Time, interval *Interval,
+	segments segmentRange) interface{} {
 	var (
-		filterFuncs = params.FilterFuncs
-		sumFuncs    = params.SumFuncs
-		partial     = makeScanPartial(params)
+		filterFuncs     = params.FilterFuncs
+		sumFuncs        = params.SumFuncs
+		distinctFuncs   = params.DistinctFuncs
+		percentileFuncs = params.PercentileFuncs
+		rowStride       = s.RowSize * params.SampleStride
+		sampleOffset    = s.initialSampleOffset(interval, segments.start, rowStride)
+		partial         = makeScanPartial(params)
 	)
-	for _, segment := range interval.Segments {
-		stats.Add(statRowsScanned, len(segment.Bytes)/s.RowSize)
+	buf := scanBuffers.Get().(*[]byte)
+	defer scanBuffers.Put(buf)
+	for segmentIndex := segments.start; segmentIndex < segments.end; segmentIndex++ {
+		segment := interval.Segments[segmentIndex]
+		if params.canceled() {
+			break
+		}
+		params.Progress.addScanned()
+		if !params.segmentMayMatch(interval, segmentIndex) {
+			stats.Inc(statSegmentsSkipped)
+			sampleOffset = nextSampleOffset(sampleOffset, s.segmentNumRows(segment)*s.RowSize, rowStride)
+			continue
+		}
+		rows := s.SegmentRows(segment, buf)
+		stats.Add(statRowsScanned, len(rows)/s.RowSize)
 
 	rowLoop:
-		for i := 0; i < len(segment.Bytes); i += s.RowSize {
-			row := RowBytes(segment.Bytes[i : i+s.RowSize])
+		for i := sampleOffset; i < len(rows); i += rowStride {
+			row := RowBytes(rows[i : i+s.RowSize])
 
 			// Run each filter to see if we should skip this row.
 			for _, filter := range filterFuncs {
@@ -312,8 +703,19 @@ func (s *StaticTable) scanSimple(stats *scanStats, params *scanParams, _ time.Ti
 				sumFn(partial.Sums[i], metrics)
 			}
 
+			// Add each distinct-counted dimension value to its sketch.
+			for i, distinctFn := range distinctFuncs {
+				distinctFn(partial.Sketches[i], row)
+			}
+
+			// Add each percentile metric value to its digest.
+			for i, percentileFn := range percentileFuncs {
+				percentileFn(partial.Digests[i], row)
+			}
+
 			partial.Count += row.count(s.Schema)
 		}
+		sampleOffset = nextSampleOffset(sampleOffset, len(rows), rowStride)
 	}
 	return partial
 }
@@ -331,25 +733,13 @@ type sliceGroupPartials struct {
 	nilPartial    *scanPartial
 }
 
-func (s *StaticTable) scanSliceGrouping(stats *scanStats, params *scanParams, _ time.Time, interval *Interval) interface{} {
+func (s *StaticTable) scanSliceGrouping(stats *scanStats, params *scanParams, _ time.Time, interval *Interval,
+	segments segmentRange) interface{} {
 	groupingColumn := s.DimensionColumns[params.Grouping.ColumnIndex]
-	width := groupingColumn.Width
-	var sliceGroupSize int
-	switch {
-	case groupingColumn.String:
-		sliceGroupSize = s.DimensionTables[params.Grouping.ColumnIndex].Size
-	case width <= 2:
-		sliceGroupSize = 1 << uint(8*width)
-	default:
-		panic("trying to use slice grouping for wide (>2 byte), non-string column")
-	}
 
 	// Sanity checks.
-	if params.Grouping.OnTimestampColumn {
-		panic("using slices for timestamp column group is unhandled")
-	}
-	if params.Grouping.TransformFunc != nil {
-		panic("using slices for grouping with transform func")
+	if !params.Grouping.UseSlice {
+		panic("using slice grouping for a grouping which needs a map")
 	}
 
 	var (
@@ -360,18 +750,36 @@ func (s *StaticTable) scanSliceGrouping(stats *scanStats, params *scanParams, _
 		getDimensionValueAsIntFunc = makeGetDimensionValueAsIntFuncGen(groupingColumn.Type)
 		filterFuncs                = params.FilterFuncs
 		sumFuncs                   = params.SumFuncs
+		distinctFuncs              = params.DistinctFuncs
+		percentileFuncs            = params.PercentileFuncs
+		rowStride                  = s.RowSize * params.SampleStride
+		sampleOffset               = s.initialSampleOffset(interval, segments.start, rowStride)
 
-		slicePartials   = make([]*scanPartial, sliceGroupSize)
+		sliceMin        = params.Grouping.SliceMin
+		slicePartials   = make([]*scanPartial, params.Grouping.SliceSize)
 		nilGroupPartial *scanPartial
 		partial         *scanPartial // The current partial at each iteration
 	)
 
-	for _, segment := range interval.Segments {
-		stats.Add(statRowsScanned, len(segment.Bytes)/s.RowSize)
+	buf := scanBuffers.Get().(*[]byte)
+	defer scanBuffers.Put(buf)
+	for segmentIndex := segments.start; segmentIndex < segments.end; segmentIndex++ {
+		segment := interval.Segments[segmentIndex]
+		if params.canceled() {
+			break
+		}
+		params.Progress.addScanned()
+		if !params.segmentMayMatch(interval, segmentIndex) {
+			stats.Inc(statSegmentsSkipped)
+			sampleOffset = nextSampleOffset(sampleOffset, s.segmentNumRows(segment)*s.RowSize, rowStride)
+			continue
+		}
+		rows := s.SegmentRows(segment, buf)
+		stats.Add(statRowsScanned, len(rows)/s.RowSize)
 
 	rowLoop:
-		for i := 0; i < len(segment.Bytes); i += s.RowSize {
-			row := RowBytes(segment.Bytes[i : i+s.RowSize])
+		for i := sampleOffset; i < len(rows); i += rowStride {
+			row := RowBytes(rows[i : i+s.RowSize])
 
 			// Run each filter to see if we should skip this row.
 			for _, filter := range filterFuncs {
@@ -389,7 +797,7 @@ func (s *StaticTable) scanSliceGrouping(stats *scanStats, params *scanParams, _
 				}
 			} else {
 				cell := unsafe.Pointer(&row[valueOffset])
-				index := getDimensionValueAsIntFunc(cell)
+				index := getDimensionValueAsIntFunc(cell) - sliceMin
 				partial = slicePartials[index]
 				if partial == nil {
 					partial = makeScanPartial(params)
@@ -403,8 +811,19 @@ func (s *StaticTable) scanSliceGrouping(stats *scanStats, params *scanParams, _
 				sumFn(partial.Sums[i], metrics)
 			}
 
+			// Add each distinct-counted dimension value to its sketch.
+			for i, distinctFn := range distinctFuncs {
+				distinctFn(partial.Sketches[i], row)
+			}
+
+			// Add each percentile metric value to its digest.
+			for i, percentileFn := range percentileFuncs {
+				percentileFn(partial.Digests[i], row)
+			}
+
 			partial.Count += row.count(s.Schema)
 		}
+		sampleOffset = nextSampleOffset(sampleOffset, len(rows), rowStride)
 	}
 
 	return &sliceGroupPartials{slicePartials, nilGroupPartial}
@@ -438,14 +857,16 @@ func combineSliceGrouping(boxedPartials []interface{}, params *scanParams) []*ro
 				}
 			}
 			if len(singleIndexPartials) > 0 {
-				results = append(results, combineScanPartials(singleIndexPartials, params, i))
+				groupByValue := i + params.Grouping.SliceMin
+				results = append(results, combineScanPartials(singleIndexPartials, params, groupByValue))
 			}
 		}
 	}
 	return results
 }
 
-func (s *StaticTable) scanMapGrouping(stats *scanStats, params *scanParams, timestamp time.Time, interval *Interval) interface{} {
+func (s *StaticTable) scanMapGrouping(stats *scanStats, params *scanParams, timestamp time.Time,
+	interval *Interval, segments segmentRange) interface{} {
 	var groupingColumn Column
 	if params.Grouping.OnTimestampColumn {
 		groupingColumn = s.TimestampColumn
@@ -469,6 +890,10 @@ func (s *StaticTable) scanMapGrouping(stats *scanStats, params *scanParams, time
 		getDimensionValueFunc = makeGetDimensionValueFuncGen(groupingColumn.Type)
 		filterFuncs           = params.FilterFuncs
 		sumFuncs              = params.SumFuncs
+		distinctFuncs         = params.DistinctFuncs
+		percentileFuncs       = params.PercentileFuncs
+		rowStride             = s.RowSize * params.SampleStride
+		sampleOffset          = s.initialSampleOffset(interval, segments.start, rowStride)
 
 		mapPartials = make(map[Untyped]*scanPartial)
 		partial     *scanPartial
@@ -487,12 +912,25 @@ func (s *StaticTable) scanMapGrouping(stats *scanStats, params *scanParams, time
 		mapPartials[key] = partial
 	}
 
-	for _, segment := range interval.Segments {
-		stats.Add(statRowsScanned, len(segment.Bytes)/s.RowSize)
+	buf := scanBuffers.Get().(*[]byte)
+	defer scanBuffers.Put(buf)
+	for segmentIndex := segments.start; segmentIndex < segments.end; segmentIndex++ {
+		segment := interval.Segments[segmentIndex]
+		if params.canceled() {
+			break
+		}
+		params.Progress.addScanned()
+		if !params.segmentMayMatch(interval, segmentIndex) {
+			stats.Inc(statSegmentsSkipped)
+			sampleOffset = nextSampleOffset(sampleOffset, s.segmentNumRows(segment)*s.RowSize, rowStride)
+			continue
+		}
+		rows := s.SegmentRows(segment, buf)
+		stats.Add(statRowsScanned, len(rows)/s.RowSize)
 
 	rowLoop:
-		for i := 0; i < len(segment.Bytes); i += s.RowSize {
-			row := RowBytes(segment.Bytes[i : i+s.RowSize])
+		for i := sampleOffset; i < len(rows); i += rowStride {
+			row := RowBytes(rows[i : i+s.RowSize])
 
 			// Run each filter to see if we should skip this row.
 			for _, filter := range filterFuncs {
@@ -526,8 +964,19 @@ func (s *StaticTable) scanMapGrouping(stats *scanStats, params *scanParams, time
 				sumFn(partial.Sums[i], metrics)
 			}
 
+			// Add each distinct-counted dimension value to its sketch.
+			for i, distinctFn := range distinctFuncs {
+				distinctFn(partial.Sketches[i], row)
+			}
+
+			// Add each percentile metric value to its digest.
+			for i, percentileFn := range percentileFuncs {
+				percentileFn(partial.Digests[i], row)
+			}
+
 			partial.Count += row.count(s.Schema)
 		}
+		sampleOffset = nextSampleOffset(sampleOffset, len(rows), rowStride)
 	}
 
 	return mapPartials
@@ -561,16 +1010,42 @@ func combineMapGrouping(boxedPartials []interface{}, params *scanParams) []*rowA
 	return results
 }
 
-func (s *StaticTable) postProcessScanRows(aggregates []*rowAggregate, query *Query, grouping *groupingParams) []RowMap {
+func (s *StaticTable) postProcessScanRows(aggregates []*rowAggregate, query *Query, grouping *groupingParams,
+	sketches bool) []RowMap {
+
+	bucket, _ := query.TimeBucketDuration(s.TimestampColumn.Name, s.IntervalDuration)
 	rows := make([]RowMap, len(aggregates))
 	for i, aggregate := range aggregates {
 		row := make(RowMap)
-		for i, queryAggregate := range query.Aggregates {
+		var sumIndex, sketchIndex, digestIndex int
+		for _, queryAggregate := range query.Aggregates {
 			switch queryAggregate.Type {
 			case AggregateSum:
-				row[queryAggregate.Name] = aggregate.Sums[i]
+				row[queryAggregate.Name] = aggregate.Sums[sumIndex]
+				sumIndex++
 			case AggregateAvg:
-				row[queryAggregate.Name] = UntypedToFloat64(aggregate.Sums[i]) / float64(aggregate.Count)
+				row[queryAggregate.Name] = UntypedToFloat64(aggregate.Sums[sumIndex]) / float64(aggregate.Count)
+				sumIndex++
+			case AggregateRate:
+				row[queryAggregate.Name] = UntypedToFloat64(aggregate.Sums[sumIndex]) / bucket.Seconds()
+				sumIndex++
+			case AggregateDistinct:
+				sketch := aggregate.Sketches[sketchIndex]
+				if sketches {
+					row[queryAggregate.Name] = sketch
+				} else {
+					row[queryAggregate.Name] = sketch.Estimate()
+				}
+				sketchIndex++
+			default: // percentiles
+				digest := aggregate.Digests[digestIndex]
+				if sketches {
+					row[queryAggregate.Name] = digest
+				} else {
+					q, _ := queryAggregate.Type.Quantile()
+					row[queryAggregate.Name] = untypedQuantile(digest, q)
+				}
+				digestIndex++
 			}
 		}
 		if grouping != nil {
@@ -590,36 +1065,116 @@ func (s *StaticTable) postProcessScanRows(aggregates []*rowAggregate, query *Que
 	return rows
 }
 
+// nextSampleOffset returns the offset at which to start sampling rows in the next segment so that the
+// sample stride is kept across segments, given the offset used for a segment of length n.
+func nextSampleOffset(offset, n, stride int) int {
+	if offset >= n {
+		return offset - n
+	}
+	return (stride - (n-offset)%stride) % stride
+}
+
+// scaleRowAggregates scales up the sums and counts of aggregates computed from a sample of every
+// stride-th row to estimate the totals. (Distinct counts and percentiles are left as they are.)
+func scaleRowAggregates(aggregates []*rowAggregate, stride int) {
+	for _, aggregate := range aggregates {
+		for i, sum := range aggregate.Sums {
+			switch sum := sum.(type) {
+			case uint64:
+				aggregate.Sums[i] = sum * uint64(stride)
+			case int64:
+				aggregate.Sums[i] = sum * int64(stride)
+			case float64:
+				aggregate.Sums[i] = sum * float64(stride)
+			default:
+				panic("unexpected sum type")
+			}
+		}
+		aggregate.Count *= uint32(stride)
+	}
+}
+
 func (s *StaticTable) makeSumFunc(aggregate QueryAggregate, index int) sumFunc {
 	col := s.MetricColumns[index]
 	offset := s.MetricOffsets[index]
 	return makeSumFuncGen(col.Type)(offset)
 }
 
-// makeTimeTruncationFunc returns a function which, given a cell, performs a date truncation transformation.
-// intervalName should be one of "minute", "hour", or "day".
+// makeDistinctFunc returns a function which adds the hash of a row's value for the dimension column at index
+// to a sketch. Nil values are not counted. String values are hashed by their contents (not by their
+// dimension table index) so that sketches from different tables may be merged.
+func (s *StaticTable) makeDistinctFunc(index int) distinctFunc {
+	col := s.DimensionColumns[index]
+	nilOffset := s.DimensionStartOffset + index>>3
+	mask := byte(1) << byte(index&7)
+	valueOffset := s.DimensionStartOffset + s.DimensionOffsets[index]
+
+	if col.String {
+		values := s.DimensionTables[index].Values
+		hashes := make([]uint64, len(values))
+		for i, value := range values {
+			hashes[i] = hashString(value)
+		}
+		getDimensionValueAsIntFunc := makeGetDimensionValueAsIntFuncGen(col.Type)
+		return func(sketch *HyperLogLog, row RowBytes) {
+			if row[nilOffset]&mask > 0 {
+				return
+			}
+			sketch.Add(hashes[getDimensionValueAsIntFunc(unsafe.Pointer(&row[valueOffset]))])
+		}
+	}
+
+	valueEnd := valueOffset + col.Width
+	return func(sketch *HyperLogLog, row RowBytes) {
+		if row[nilOffset]&mask > 0 {
+			return
+		}
+		sketch.Add(hashBytes(row[valueOffset:valueEnd]))
+	}
+}
+
+// makePercentileFunc returns a function which adds a row's value for the metric column at index to a digest.
+// A collapsed row's metric value is the sum over the rows it combines, so it is added as the average value
+// weighted by the row's count.
+func (s *StaticTable) makePercentileFunc(index int) percentileFunc {
+	col := s.MetricColumns[index]
+	offset := s.MetricStartOffset + s.MetricOffsets[index]
+	getValueFunc := makeGetCellValueAsFloat64FuncGen(col.Type)
+	schema := s.Schema
+	return func(digest *TDigest, row RowBytes) {
+		count := float64(row.count(schema))
+		digest.Add(getValueFunc(unsafe.Pointer(&row[offset]))/count, count)
+	}
+}
+
+// untypedQuantile returns the estimated quantile q of digest, or nil if digest is empty.
+func untypedQuantile(digest *TDigest, q float64) Untyped {
+	value := digest.Quantile(q)
+	if math.IsNaN(value) {
+		return nil
+	}
+	return value
+}
+
+// makeTimeTruncationFunc returns a function which, given a cell, performs a date truncation transformation
+// to the start of the cell's truncationType-sized time bucket.
 func (s *StaticTable) makeTimeTruncationFunc(truncationType TimeTruncationType, column Column) (transformFunc, error) {
 	if column.Type != TypeUint32 {
 		return nil, errors.New("cannot apply timestamp truncation to non-uint32 column")
 	}
-	var divisor int
-	switch truncationType {
-	case TimeTruncationMinute:
-		divisor = 60
-	case TimeTruncationHour:
-		divisor = 60 * 60
-	case TimeTruncationDay:
-		divisor = 60 * 60 * 24
-	}
+	divisor := int(truncationType)
 	return func(cell unsafe.Pointer) Untyped {
 		value := int(*(*uint32)(cell))
 		return value - (value % divisor)
 	}, nil
 }
 
-func (s *StaticTable) makeTimestampFilterFunc(filter QueryFilter) (timestampFilterFunc, error) {
-	if filter.Type == FilterIn {
-		return s.makeTimestampFilterFuncIn(filter)
+func makeTimestampFilterFunc(filter QueryFilter) (timestampFilterFunc, error) {
+	switch filter.Type {
+	case FilterIn, FilterNotIn:
+		return makeTimestampFilterFuncIn(filter)
+	case FilterPrefix, FilterRegex, FilterEqualFold, FilterInFold:
+		return nil, fmt.Errorf("%q filters may only be used with string dimension columns", filter.Type.name())
 	}
 
 	value, ok := filter.Value.(float64)
@@ -630,32 +1185,38 @@ func (s *StaticTable) makeTimestampFilterFunc(filter QueryFilter) (timestampFilt
 	return makeTimestampFilterFuncSimpleGen(filter.Type)(timestamp), nil
 }
 
-func (s *StaticTable) makeTimestampFilterFuncIn(filter QueryFilter) (timestampFilterFunc, error) {
+// makeTimestampFilterFuncIn makes a timestamp filter for an 'in' or 'not in' filter.
+func makeTimestampFilterFuncIn(filter QueryFilter) (timestampFilterFunc, error) {
+	name := filter.Type.name()
 	values, ok := filter.Value.([]interface{})
 	if !ok {
-		return nil, fmt.Errorf("timestamp column 'in' filter must be given an array; got %v", filter.Value)
+		return nil, fmt.Errorf("timestamp column '%s' filter must be given an array; got %v", name, filter.Value)
 	}
 	timestamps := make([]uint32, len(values))
 	for i, v := range values {
 		float, ok := v.(float64)
 		if !ok {
-			return nil, fmt.Errorf("timestamp column 'in' filter list must include numeric values; got %v", v)
+			return nil, fmt.Errorf("timestamp column '%s' filter list must include numeric values; got %v", name, v)
 		}
 		timestamps[i] = uint32(float)
 	}
+	negate := filter.Type == FilterNotIn
 	return func(timestamp uint32) bool {
 		for _, t := range timestamps {
 			if t == timestamp {
-				return true
+				return !negate
 			}
 		}
-		return false
+		return negate
 	}, nil
 }
 
 func (s *StaticTable) makeDimensionFilterFunc(filter QueryFilter, index int) (filterFunc, error) {
-	if filter.Type == FilterIn {
+	switch filter.Type {
+	case FilterIn, FilterNotIn:
 		return s.makeDimensionFilterFuncIn(filter, index)
+	case FilterPrefix, FilterRegex, FilterEqualFold, FilterInFold:
+		return s.makeDimensionFilterFuncMatch(filter, index)
 	}
 
 	col := s.DimensionColumns[index]
@@ -702,13 +1263,17 @@ func (s *StaticTable) makeDimensionFilterFunc(filter QueryFilter, index int) (fi
 	return filterGenFunc(value, nilOffset, mask, valueOffset), nil
 }
 
+// makeDimensionFilterFuncIn makes a filter for an 'in' or 'not in' filter on a dimension column. A nil
+// dimension value is in the list if the list includes null.
 func (s *StaticTable) makeDimensionFilterFuncIn(filter QueryFilter, index int) (filterFunc, error) {
+	name := filter.Type.name()
+	negate := filter.Type == FilterNotIn
 	valueSlice, ok := filter.Value.([]interface{})
 	if !ok {
-		return nil, fmt.Errorf("'in' queries require a list for comparison; got %v", filter.Value)
+		return nil, fmt.Errorf("'%s' queries require a list for comparison; got %v", name, filter.Value)
 	}
 	if len(valueSlice) == 0 {
-		return falseFilterFunc, nil
+		return emptyInFilterFunc(negate), nil
 	}
 
 	col := s.DimensionColumns[index]
@@ -729,14 +1294,15 @@ func (s *StaticTable) makeDimensionFilterFuncIn(filter QueryFilter, index int) (
 			}
 			str, ok := v.(string)
 			if !ok {
-				return nil, fmt.Errorf("'in' queries on dimension %q take string or null values; got %v", col.Name, v)
+				return nil, fmt.Errorf("'%s' queries on dimension %q take string or null values; got %v",
+					name, col.Name, v)
 			}
 			if dimIndex, ok := s.DimensionTables[index].Get(str); ok {
 				dimIndices = append(dimIndices, dimIndex)
 			}
 		}
 		if len(dimIndices) == 0 && !acceptNil {
-			return falseFilterFunc, nil
+			return emptyInFilterFunc(negate), nil
 		}
 		values = dimIndices
 		isString = true
@@ -749,7 +1315,8 @@ func (s *StaticTable) makeDimensionFilterFuncIn(filter QueryFilter, index int) (
 			}
 			float, ok := v.(float64)
 			if !ok {
-				err := fmt.Errorf("'in' queries on dimension %q take numeric or null values; got %v", col.Name, v)
+				err := fmt.Errorf("'%s' queries on dimension %q take numeric or null values; got %v",
+					name, col.Name, v)
 				return nil, err
 			}
 			floats = append(floats, float)
@@ -757,13 +1324,76 @@ func (s *StaticTable) makeDimensionFilterFuncIn(filter QueryFilter, index int) (
 		values = floats
 	}
 
-	filterGenFunc := makeDimensionFilterFuncInGen(col.Type, isString)
+	filterGenFunc := makeDimensionFilterFuncInGen(col.Type, isString, negate)
 	return filterGenFunc(values, acceptNil, nilOffset, mask, valueOffset), nil
 }
 
+// makeDimensionFilterFuncMatch makes a filter for a prefix, regex, or case-insensitive equality filter on a
+// string dimension column. The matching values are found in the dimension table up front, so the filter itself
+// is an 'in' filter on their indices. Regexes must match the entire value. Nil values never match.
+func (s *StaticTable) makeDimensionFilterFuncMatch(filter QueryFilter, index int) (filterFunc, error) {
+	col := s.DimensionColumns[index]
+	if !col.String {
+		return nil, fmt.Errorf("%q filters may only be used with string dimension columns (%q is numeric)",
+			filter.Type.name(), col.Name)
+	}
+	var match func(string) bool
+	if filter.Type == FilterInFold {
+		values, ok := filter.Value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("'%s' filters require a list for comparison; got %v", filter.Type.name(),
+				filter.Value)
+		}
+		folded := make(map[string]bool)
+		for _, v := range values {
+			str, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("'%s' filters require a list of strings; got %v", filter.Type.name(), v)
+			}
+			folded[strings.ToLower(str)] = true
+		}
+		match = func(value string) bool { return folded[strings.ToLower(value)] }
+	} else {
+		pattern, ok := filter.Value.(string)
+		if !ok {
+			return nil, fmt.Errorf("%q filters require a string value; got %v", filter.Type.name(), filter.Value)
+		}
+		switch filter.Type {
+		case FilterPrefix:
+			match = func(value string) bool { return strings.HasPrefix(value, pattern) }
+		case FilterEqualFold:
+			match = func(value string) bool { return strings.EqualFold(value, pattern) }
+		default:
+			re, err := regexp.Compile("^(?:" + pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("bad regex filter: %s", err)
+			}
+			match = re.MatchString
+		}
+	}
+
+	var dimIndices []uint32
+	for i, value := range s.DimensionTables[index].Values {
+		if match(value) {
+			dimIndices = append(dimIndices, uint32(i))
+		}
+	}
+	if len(dimIndices) == 0 {
+		return falseFilterFunc, nil
+	}
+	mask := byte(1) << byte(index&7)
+	nilOffset := s.DimensionStartOffset + index>>3
+	valueOffset := s.DimensionStartOffset + s.DimensionOffsets[index]
+	filterGenFunc := makeDimensionFilterFuncInGen(col.Type, true, false)
+	return filterGenFunc(dimIndices, false, nilOffset, mask, valueOffset), nil
+}
+
 func (s *StaticTable) makeMetricFilterFunc(filter QueryFilter, index int) (filterFunc, error) {
-	if filter.Type == FilterIn {
+	switch filter.Type {
+	case FilterIn, FilterNotIn:
 		return s.makeMetricFilterFuncIn(filter, index)
+	case FilterPrefix, FilterRegex, FilterEqualFold, FilterInFold:
+		return nil, fmt.Errorf("%q filters may only be used with string dimension columns", filter.Type.name())
 	}
 
 	float, ok := filter.Value.(float64)
@@ -775,19 +1405,22 @@ func (s *StaticTable) makeMetricFilterFunc(filter QueryFilter, index int) (filte
 	return makeMetricFilterFuncSimpleGen(col.Type, filter.Type)(float, offset), nil
 }
 
+// makeMetricFilterFuncIn makes a filter for an 'in' or 'not in' filter on a metric column.
 func (s *StaticTable) makeMetricFilterFuncIn(filter QueryFilter, index int) (filterFunc, error) {
+	name := filter.Type.name()
+	negate := filter.Type == FilterNotIn
 	values, ok := filter.Value.([]interface{})
 	if !ok {
-		return nil, fmt.Errorf("'in' queries require a list for comparison; got %v", filter.Value)
+		return nil, fmt.Errorf("'%s' queries require a list for comparison; got %v", name, filter.Value)
 	}
 	if len(values) == 0 {
-		return falseFilterFunc, nil
+		return emptyInFilterFunc(negate), nil
 	}
 	floats := make([]float64, len(values))
 	for i, v := range values {
 		float, ok := v.(float64)
 		if !ok {
-			return nil, fmt.Errorf("'in' queries on metric columns take numeric values only; got %v", v)
+			return nil, fmt.Errorf("'%s' queries on metric columns take numeric values only; got %v", name, v)
 		}
 		floats[i] = float
 	}
@@ -795,7 +1428,7 @@ func (s *StaticTable) makeMetricFilterFuncIn(filter QueryFilter, index int) (fil
 	offset := s.MetricStartOffset + s.MetricOffsets[index]
 	// TODO(philc): A hash table may be more efficient for longer lists. We should determine what that list
 	// size is and use a hash table in that case.
-	return makeMetricFilterFuncInGen(col.Type)(floats, offset), nil
+	return makeMetricFilterFuncInGen(col.Type, negate)(floats, offset), nil
 }
 
 type scanStat int
@@ -804,6 +1437,7 @@ const (
 	statIntervalsSkipped scanStat = iota
 	statIntervalsScanned
 	statRowsScanned
+	statSegmentsSkipped
 )
 
 type scanStats struct {
@@ -4,6 +4,7 @@
 package gumshoe
 
 import (
+	"context"
 	"fmt"
 	"testing"
 
@@ -27,7 +28,7 @@ func setup(b *testing.B) {
 }
 
 func mustGetBenchmarkQueryResult(query *Query) []RowMap {
-	results, err := benchmarkDB.GetQueryResult(query)
+	results, err := benchmarkDB.GetQueryResult(context.Background(), query)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,46 @@
+package gumshoe
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// A QueryProgress counts the segments scanned by a running query, so that a server can show how far along
+// its slow queries are. A query run with a context from WithQueryProgress updates it as it goes.
+type QueryProgress struct {
+	scanned int64 // Segments scanned (or skipped by their zone maps or bloom filters)
+	total   int64 // Segments of the intervals to be scanned, once they've been picked
+}
+
+type queryProgressKey struct{}
+
+// WithQueryProgress returns a copy of ctx which makes the queries run with it update p.
+func WithQueryProgress(ctx context.Context, p *QueryProgress) context.Context {
+	return context.WithValue(ctx, queryProgressKey{}, p)
+}
+
+// queryProgressFrom returns the QueryProgress of ctx, or nil if it has none.
+func queryProgressFrom(ctx context.Context) *QueryProgress {
+	p, _ := ctx.Value(queryProgressKey{}).(*QueryProgress)
+	return p
+}
+
+// Segments returns the number of segments scanned so far and the number to be scanned in all (which is 0
+// until the query has picked the intervals to scan).
+func (p *QueryProgress) Segments() (scanned, total int) {
+	return int(atomic.LoadInt64(&p.scanned)), int(atomic.LoadInt64(&p.total))
+}
+
+// The methods below may be called on a nil QueryProgress, which does nothing.
+
+func (p *QueryProgress) addTotal(n int) {
+	if p != nil {
+		atomic.AddInt64(&p.total, int64(n))
+	}
+}
+
+func (p *QueryProgress) addScanned() {
+	if p != nil {
+		atomic.AddInt64(&p.scanned, 1)
+	}
+}
@@ -0,0 +1,31 @@
+package gumshoe
+
+import (
+	"context"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestQueryProgress(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": hour(1), "dim1": "string1", "metric1": 1.0},
+		{"at": hour(2), "dim1": "string1", "metric1": 1.0},
+	})
+
+	progress := new(QueryProgress)
+	query := createQuery()
+	query.Filters = []QueryFilter{{Type: FilterLessThan, Column: "at", Value: hour(2)}}
+	_, err := db.GetQueryResult(WithQueryProgress(context.Background(), progress), query)
+	Assert(t, err, IsNil)
+	// The last interval is skipped.
+	scanned, total := progress.Segments()
+	Assert(t, scanned, Equals, 2)
+	Assert(t, total, Equals, 2)
+
+	// Queries without a QueryProgress don't track one.
+	Assert(t, queryProgressFrom(context.Background()), IsNil)
+}
@@ -1,7 +1,11 @@
 package gumshoe
 
 import (
+	"context"
+	"strconv"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/philc/gumshoedb/internal/util"
 
@@ -36,7 +40,7 @@ func createTestDBForNilQueryTests() *DB {
 }
 
 func runQuery(db *DB, query *Query) []RowMap {
-	results, err := db.GetQueryResult(query)
+	results, err := db.GetQueryResult(context.Background(), query)
 	if err != nil {
 		panic(err)
 	}
@@ -194,6 +198,56 @@ func TestQueryGroupingByAHighCardinalityStringColumn(t *testing.T) {
 	})
 }
 
+func TestQueryGroupingByANumericColumn(t *testing.T) {
+	schema := schemaFixture()
+	schema.DimensionColumns = append(schema.DimensionColumns,
+		makeDimensionColumn("dim2", "int32", false), makeDimensionColumn("dim3", "int8", false))
+	db, err := NewDB(schema)
+	Assert(t, err, IsNil)
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "", "dim2": 1e6, "dim3": -5.0, "metric1": 1.0},
+		{"at": hour(1), "dim1": "", "dim2": 1e6 + 2, "dim3": 3.0, "metric1": 2.0},
+		{"at": hour(1), "dim1": "", "dim2": nil, "dim3": -5.0, "metric1": 4.0},
+	})
+
+	groupingPlan := func(column string) string {
+		query := createQuery()
+		query.Groupings = []QueryGrouping{{TimeTruncationNone, column, column}}
+		plan, err := db.GetQueryPlan(query)
+		Assert(t, err, IsNil)
+		return plan.Grouping
+	}
+	// The range of dim2 is small enough for a slice, even though the column is wide.
+	Assert(t, groupingPlan("dim2"), Equals, "slice")
+	Assert(t, runWithGroupBy(db, QueryGrouping{TimeTruncationNone, "dim2", "dim2"}), util.DeepEqualsUnordered,
+		[]RowMap{
+			{"dim2": 1e6, "rowCount": 1, "metric1": 1},
+			{"dim2": 1e6 + 2, "rowCount": 1, "metric1": 2},
+			{"dim2": nil, "rowCount": 1, "metric1": 4},
+		})
+	Assert(t, runWithGroupBy(db, QueryGrouping{TimeTruncationNone, "dim3", "dim3"}), util.DeepEqualsUnordered,
+		[]RowMap{
+			{"dim3": -5, "rowCount": 2, "metric1": 5},
+			{"dim3": 3, "rowCount": 1, "metric1": 2},
+		})
+
+	limit := sliceGroupingSizeLimit
+	defer func() {
+		sliceGroupingSizeLimit = limit
+	}()
+	sliceGroupingSizeLimit = 2
+	// A 1-byte column can always use a slice covering its whole type.
+	Assert(t, groupingPlan("dim2"), Equals, "map")
+	Assert(t, groupingPlan("dim3"), Equals, "slice")
+	Assert(t, runWithGroupBy(db, QueryGrouping{TimeTruncationNone, "dim2", "dim2"}), util.DeepEqualsUnordered,
+		[]RowMap{
+			{"dim2": 1e6, "rowCount": 1, "metric1": 1},
+			{"dim2": 1e6 + 2, "rowCount": 1, "metric1": 2},
+			{"dim2": nil, "rowCount": 1, "metric1": 4},
+		})
+}
+
 func TestQueryGroupingWithATimeTransformFunction(t *testing.T) {
 	db := makeTestDB()
 	defer closeTestDB(db)
@@ -212,6 +266,23 @@ func TestQueryGroupingWithATimeTransformFunction(t *testing.T) {
 	})
 }
 
+func TestQueryGroupingWithADurationTimeTransform(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	// at is truncated to 6 hour buckets, so these points are from buckets 0, 0, and 1.
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "", "metric1": 1.0},
+		{"at": hour(5), "dim1": "", "metric1": 2.0},
+		{"at": hour(7), "dim1": "", "metric1": 3.0},
+	})
+
+	result := runWithGroupBy(db, QueryGrouping{TimeTruncationType(6 * 60 * 60), "at", "groupbykey"})
+	Assert(t, result, util.DeepEqualsUnordered, []RowMap{
+		{"groupbykey": 0, "rowCount": 2, "metric1": 3},
+		{"groupbykey": hour(6), "rowCount": 1, "metric1": 3},
+	})
+}
+
 func TestQueryAggregateWithNilValues(t *testing.T) {
 	db := createTestDBForNilQueryTests()
 	defer closeTestDB(db)
@@ -283,3 +354,488 @@ func TestQuerySumsOverflowIndividualColumnTypes(t *testing.T) {
 	results := runQuery(db, createQuery())
 	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 8589934590)
 }
+
+func TestQueryDistinctCountsDimensionValues(t *testing.T) {
+	schema := schemaFixture()
+	schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("dim2", "uint8", false))
+	db, err := NewDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "dim2": 1.0, "metric1": 1.0},
+		{"at": 0.0, "dim1": "b", "dim2": 1.0, "metric1": 1.0},
+		{"at": hour(1), "dim1": "a", "dim2": 2.0, "metric1": 1.0},
+		{"at": hour(1), "dim1": nil, "dim2": 3.0, "metric1": 1.0},
+	})
+
+	query := &Query{
+		Aggregates: []QueryAggregate{
+			{Type: AggregateDistinct, Column: "dim1", Name: "dim1"},
+			{Type: AggregateSum, Column: "metric1", Name: "metric1"},
+			{Type: AggregateDistinct, Column: "dim2", Name: "dim2"},
+		},
+	}
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{
+		{"dim1": 2, "metric1": 4, "dim2": 3, "rowCount": 4},
+	})
+
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "at", "at"}}
+	results = runQuery(db, query)
+	Assert(t, results, util.DeepEqualsUnordered, []RowMap{
+		{"at": 0, "dim1": 2, "metric1": 2, "dim2": 1, "rowCount": 2},
+		{"at": hour(1), "dim1": 1, "metric1": 2, "dim2": 2, "rowCount": 2},
+	})
+}
+
+func TestQueryPercentiles(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	// Use distinct dimension values so that the rows are not collapsed together.
+	var rows []RowMap
+	for i := 1; i <= 100; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim1": strconv.Itoa(i), "metric1": float64(i)})
+	}
+	insertRows(db, rows)
+
+	query := &Query{
+		Aggregates: []QueryAggregate{
+			{Type: AggregateP50, Column: "metric1", Name: "p50"},
+			{Type: AggregateP99, Column: "metric1", Name: "p99"},
+		},
+	}
+	results := runQuery(db, query)
+	Assert(t, len(results), Equals, 1)
+	Assert(t, results[0]["p50"], util.DeepConvertibleEquals, 50.5)
+	Assert(t, results[0]["p99"], util.DeepConvertibleEquals, 99.5)
+
+	query.Filters = []QueryFilter{{FilterEqual, "dim1", "none"}}
+	results = runQuery(db, query)
+	Assert(t, results[0]["p50"], IsNil)
+}
+
+func TestQueryOrderByAndLimit(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 3.0},
+		{"at": 0.0, "dim1": "b", "metric1": 1.0},
+		{"at": 0.0, "dim1": "c", "metric1": 2.0},
+		{"at": 0.0, "dim1": "d", "metric1": 2.0},
+		{"at": 0.0, "dim1": nil, "metric1": 5.0},
+	})
+
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	query.OrderBy = []QueryOrder{{"metric1", OrderDescending}, {"dim1", OrderAscending}}
+	query.Limit = 4
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{
+		{"dim1": nil, "metric1": 5, "rowCount": 1},
+		{"dim1": "a", "metric1": 3, "rowCount": 1},
+		{"dim1": "c", "metric1": 2, "rowCount": 1},
+		{"dim1": "d", "metric1": 2, "rowCount": 1},
+	})
+
+	query.OrderBy = []QueryOrder{{"dim1", OrderAscending}}
+	query.Limit = 2
+	results = runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{
+		{"dim1": nil, "metric1": 5, "rowCount": 1},
+		{"dim1": "a", "metric1": 3, "rowCount": 1},
+	})
+
+	query.OrderBy = []QueryOrder{{"dim2", OrderAscending}}
+	_, err := db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+}
+
+func TestSortRowsByGrouping(t *testing.T) {
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	rows := []RowMap{
+		{"dim1": "b", "rowCount": 1},
+		{"dim1": 2.0, "rowCount": 2},
+		{"dim1": nil, "rowCount": 3},
+		{"dim1": "a", "rowCount": 4},
+		{"dim1": uint32(1), "rowCount": 5},
+	}
+	SortRowsByGrouping(rows, query)
+	Assert(t, rows, util.DeepConvertibleEquals, []RowMap{
+		{"dim1": nil, "rowCount": 3},
+		{"dim1": 1, "rowCount": 5},
+		{"dim1": 2, "rowCount": 2},
+		{"dim1": "a", "rowCount": 4},
+		{"dim1": "b", "rowCount": 1},
+	})
+}
+
+func TestIntervalMatches(t *testing.T) {
+	query := createQuery()
+	query.Filters = []QueryFilter{
+		{FilterGreaterThenOrEqual, "at", hour(1)},
+		{FilterNotIn, "at", []interface{}{hour(2)}},
+		{FilterEqual, "dim1", "a"},
+	}
+	for _, tt := range []struct {
+		start float64
+		want  bool
+	}{
+		{0, false},
+		{hour(1), true},
+		{hour(2), false},
+		{hour(3), true},
+	} {
+		matches, err := query.IntervalMatches("at", time.Unix(int64(tt.start), 0))
+		Assert(t, err, IsNil)
+		Assert(t, matches, Equals, tt.want)
+	}
+}
+
+func TestQueryHavingFilters(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 3.0},
+		{"at": hour(1), "dim1": "a", "metric1": 3.0},
+		{"at": 0.0, "dim1": "b", "metric1": 1.0},
+		{"at": 0.0, "dim1": "c", "metric1": 5.0},
+	})
+
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	query.HavingFilters = []QueryFilter{{FilterGreaterThan, "metric1", 2.0}}
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepEqualsUnordered, []RowMap{
+		{"dim1": "a", "metric1": 6, "rowCount": 2},
+		{"dim1": "c", "metric1": 5, "rowCount": 1},
+	})
+
+	query.HavingFilters = append(query.HavingFilters, QueryFilter{FilterIn, "rowCount", inList(1)})
+	results = runQuery(db, query)
+	Assert(t, results, util.DeepEqualsUnordered, []RowMap{
+		{"dim1": "c", "metric1": 5, "rowCount": 1},
+	})
+
+	query.HavingFilters = []QueryFilter{{FilterGreaterThan, "dim1", 2.0}}
+	_, err := db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+}
+
+func TestQueryFiltersRowsUsingPrefixAndRegex(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "10.1", "metric1": 1.0},
+		{"at": 0.0, "dim1": "10.2", "metric1": 2.0},
+		{"at": 0.0, "dim1": "210.1", "metric1": 4.0},
+		{"at": 0.0, "dim1": nil, "metric1": 8.0},
+	})
+
+	results := runWithFilter(db, QueryFilter{FilterPrefix, "dim1", "10."})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 3)
+
+	results = runWithFilter(db, QueryFilter{FilterRegex, "dim1", "10.*"})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 3)
+
+	results = runWithFilter(db, QueryFilter{FilterRegex, "dim1", `\d+\.1`})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 5)
+
+	// Matches zero rows.
+	results = runWithFilter(db, QueryFilter{FilterPrefix, "dim1", "3"})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 0)
+
+	query := createQuery()
+	query.Filters = []QueryFilter{{FilterPrefix, "metric1", "1"}}
+	_, err := db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+	query.Filters = []QueryFilter{{FilterRegex, "dim1", "("}}
+	_, err = db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+}
+
+func TestQueryFiltersRowsUsingNotIn(t *testing.T) {
+	db := createTestDBForNilQueryTests()
+	defer closeTestDB(db)
+
+	results := runWithFilter(db, QueryFilter{FilterNotIn, "dim1", inList("a")})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 6)
+
+	results = runWithFilter(db, QueryFilter{FilterNotIn, "dim1", inList("a", nil)})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 2)
+
+	results = runWithFilter(db, QueryFilter{FilterNotIn, "metric1", inList(1, 4)})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 2)
+
+	results = runWithFilter(db, QueryFilter{FilterNotIn, "at", inList(0)})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 0)
+
+	// These match all rows.
+	results = runWithFilter(db, QueryFilter{FilterNotIn, "dim1", inList()})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 7)
+	results = runWithFilter(db, QueryFilter{FilterNotIn, "dim1", inList("non-existent")})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 7)
+}
+
+func TestQueryFiltersRowsCaseInsensitively(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "App", "metric1": 1.0},
+		{"at": 0.0, "dim1": "app", "metric1": 2.0},
+		{"at": 0.0, "dim1": "APP", "metric1": 4.0},
+		{"at": 0.0, "dim1": "other", "metric1": 8.0},
+		{"at": 0.0, "dim1": nil, "metric1": 16.0},
+	})
+
+	results := runWithFilter(db, QueryFilter{FilterEqualFold, "dim1", "aPp"})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 7)
+
+	results = runWithFilter(db, QueryFilter{FilterInFold, "dim1", inList("app", "OTHER")})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 15)
+
+	results = runWithFilter(db, QueryFilter{FilterEqualFold, "dim1", "non-existent"})
+	Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 0)
+
+	query := createQuery()
+	query.Filters = []QueryFilter{{FilterEqualFold, "metric1", "app"}}
+	_, err := db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+}
+
+func TestQueryExpressions(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 3.0},
+		{"at": 0.0, "dim1": "b", "metric1": 5.0},
+	})
+
+	query := createQuery()
+	query.Expressions = []QueryExpression{
+		{"perRow", "metric1 / rowCount"},
+		{"doubled", "perRow * 2"},
+	}
+	query.HavingFilters = []QueryFilter{{FilterGreaterThan, "doubled", 1.0}}
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{
+		{"metric1": 8, "rowCount": 2, "perRow": 4, "doubled": 8},
+	})
+
+	query.Expressions = []QueryExpression{{"bad", "metric1 / nonexistent"}}
+	query.HavingFilters = nil
+	_, err := db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+}
+
+func TestQueryMovingAverages(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 2.0},
+		{"at": hour(1), "dim1": "a", "metric1": 4.0},
+		{"at": hour(2), "dim1": "a", "metric1": 9.0},
+		{"at": hour(4), "dim1": "a", "metric1": 1.0},
+	})
+
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "at", "at"}}
+	query.Windows = []QueryWindow{{"smooth", "moving_avg(metric1, 2 buckets)"}}
+	query.OrderBy = []QueryOrder{{"at", OrderAscending}}
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{
+		{"at": 0, "metric1": 2, "rowCount": 1, "smooth": 2.0},
+		{"at": hour(1), "metric1": 4, "rowCount": 1, "smooth": 3.0},
+		{"at": hour(2), "metric1": 9, "rowCount": 1, "smooth": 6.5},
+		{"at": hour(4), "metric1": 1, "rowCount": 1, "smooth": 1.0},
+	})
+
+	// With a fill, empty buckets count as zeros.
+	query.Fill = &TimeFill{}
+	results = runQuery(db, query)
+	Assert(t, results[4]["smooth"], Equals, 0.5)
+
+	badWindows := []string{"moving_avg(metric1)", "moving_avg(metric1, 0)", "moving_avg(nonexistent, 2)"}
+	for _, window := range badWindows {
+		query.Windows = []QueryWindow{{"bad", window}}
+		_, err := db.GetQueryResult(context.Background(), query)
+		Assert(t, err, NotNil)
+	}
+
+	query.Windows = []QueryWindow{{"smooth", "moving_avg(metric1, 2)"}}
+	query.Fill = nil
+	query.OrderBy = nil
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	_, err := db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+}
+
+func TestQueryIsAbortedWhenContextIsCanceled(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 1.0},
+		{"at": hour(1), "dim1": "b", "metric1": 2.0},
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := db.GetQueryResult(ctx, createQuery())
+	Assert(t, err, Equals, context.Canceled)
+}
+
+func TestQuerySampling(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	var rows []RowMap
+	for i := 0; i < 100; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim1": strconv.Itoa(i), "metric1": 2.0})
+	}
+	insertRows(db, rows)
+
+	query := createQuery()
+	query.SampleRate = 0.1
+	Assert(t, query.SampleStride(), Equals, 10)
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{{"metric1": 200, "rowCount": 100}})
+
+	query.SampleRate = 1.5
+	_, err := db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+}
+
+func TestQueryRates(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 3600.0},
+		{"at": hour(1), "dim1": "a", "metric1": 7200.0},
+		{"at": hour(6), "dim1": "a", "metric1": 720.0},
+	})
+
+	query := createQuery()
+	query.Aggregates = []QueryAggregate{{AggregateRate, "metric1", "metric1Rate"}}
+	query.Groupings = []QueryGrouping{{TimeTruncationType(6 * 60 * 60), "at", "at"}}
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepEqualsUnordered, []RowMap{
+		{"at": 0, "metric1Rate": 0.5, "rowCount": 2},
+		{"at": hour(6), "metric1Rate": 1.0 / 30, "rowCount": 1},
+	})
+
+	// Without a transform, the buckets are the intervals.
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "at", "at"}}
+	results = runQuery(db, query)
+	Assert(t, results, util.DeepEqualsUnordered, []RowMap{
+		{"at": 0, "metric1Rate": 1.0, "rowCount": 1},
+		{"at": hour(1), "metric1Rate": 2.0, "rowCount": 1},
+		{"at": hour(6), "metric1Rate": 0.2, "rowCount": 1},
+	})
+
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	_, err := db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+}
+
+func TestQueryFillsEmptyTimeBuckets(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+	insertRows(db, []RowMap{
+		{"at": hour(1), "dim1": "a", "metric1": 1.0},
+		{"at": hour(3), "dim1": "a", "metric1": 2.0},
+	})
+
+	query := createQuery()
+	query.Aggregates = []QueryAggregate{
+		{AggregateSum, "metric1", "metric1"},
+		{AggregateAvg, "metric1", "avgMetric1"},
+	}
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "at", "at"}}
+	query.Fill = &TimeFill{}
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{
+		{"at": hour(1), "metric1": 1, "avgMetric1": 1.0, "rowCount": 1},
+		{"at": hour(2), "metric1": 0, "avgMetric1": nil, "rowCount": 0},
+		{"at": hour(3), "metric1": 2, "avgMetric1": 2.0, "rowCount": 1},
+	})
+
+	// The range is taken from the timestamp filters.
+	query.Filters = []QueryFilter{
+		{FilterGreaterThenOrEqual, "at", hour(0)},
+		{FilterLessThan, "at", hour(5)},
+	}
+	results = runQuery(db, query)
+	Assert(t, len(results), Equals, 5)
+	Assert(t, results[0]["at"], util.DeepConvertibleEquals, 0)
+	Assert(t, results[4]["at"], util.DeepConvertibleEquals, hour(4))
+
+	// A supplied range overrides the filters.
+	start, end := int64(hour(1)), int64(hour(6))
+	query.Fill = &TimeFill{Start: &start, End: &end}
+	results = runQuery(db, query)
+	Assert(t, len(results), Equals, 6)
+	Assert(t, results[0]["at"], util.DeepConvertibleEquals, hour(1))
+
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	_, err := db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+}
+
+func TestSetQueryParallelism(t *testing.T) {
+	db := createTestDBForFilterTests()
+	defer closeTestDB(db)
+
+	Assert(t, db.SetQueryParallelism(0), NotNil)
+	for _, n := range []int{1, 8, 2} {
+		Assert(t, db.SetQueryParallelism(n), IsNil)
+		Assert(t, int(atomic.LoadInt32(&db.numWorkers)), Equals, n)
+		results := runQuery(db, createQuery())
+		Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, 3)
+	}
+}
+
+func TestSplitSegments(t *testing.T) {
+	Assert(t, splitSegments(0, 4), DeepEquals, []segmentRange{{0, 0}})
+	Assert(t, splitSegments(2, 4), DeepEquals, []segmentRange{{0, 1}, {1, 2}})
+	Assert(t, splitSegments(10, 1), DeepEquals, []segmentRange{{0, 10}})
+	Assert(t, splitSegments(10, 3), DeepEquals, []segmentRange{{0, 3}, {3, 6}, {6, 10}})
+}
+
+func TestParallelSegmentScans(t *testing.T) {
+	schema := schemaFixture()
+	schema.Initialize()
+	schema.SegmentSize = 4 * schema.RowSize
+	schema.QueryParallelism = 4
+	db, err := NewDB(schema)
+	Assert(t, err, IsNil)
+	defer closeTestDB(db)
+	var rows []RowMap
+	for i := 0; i < 100; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim1": strconv.Itoa(i), "metric1": 2.0})
+	}
+	insertRows(db, rows)
+
+	// The one interval's 25 segments are scanned in 4 parts.
+	query := createQuery()
+	results := runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{{"metric1": 200, "rowCount": 100}})
+
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	results = runQuery(db, query)
+	Assert(t, len(results), Equals, 100)
+	for _, row := range results {
+		Assert(t, row["metric1"], util.DeepConvertibleEquals, 2)
+		Assert(t, row["rowCount"], util.DeepConvertibleEquals, 1)
+	}
+
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "at", "at"}}
+	results = runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{{"at": 0, "metric1": 200, "rowCount": 100}})
+
+	// Sampling picks the same rows as a sequential scan would.
+	query = createQuery()
+	query.SampleRate = 0.1
+	results = runQuery(db, query)
+	Assert(t, results, util.DeepConvertibleEquals, []RowMap{{"metric1": 200, "rowCount": 100}})
+}
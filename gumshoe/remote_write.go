@@ -0,0 +1,238 @@
+// Decoding Prometheus remote write requests and mapping their samples to rows.
+
+package gumshoe
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Field numbers from Prometheus's remote write protobuf schema (prompb)
+const (
+	promWriteTimeseries = 1
+	promSeriesLabels    = 1
+	promSeriesSamples   = 2
+	promLabelName       = 1
+	promLabelValue      = 2
+	promSampleValue     = 1
+	promSampleTimestamp = 2
+)
+
+// A RemoteWriteSeries is a time series from a Prometheus remote write request.
+type RemoteWriteSeries struct {
+	Labels  map[string]string // Including the metric name, as __name__
+	Samples []RemoteWriteSample
+}
+
+// A RemoteWriteSample is a value of a series at a time, given in Unix milliseconds.
+type RemoteWriteSample struct {
+	Value       float64
+	TimestampMS int64
+}
+
+// A RemoteWriteRule says how the samples of matching Prometheus series are inserted: each sample becomes a
+// row with its value in Column and the series' labels in dimension columns.
+type RemoteWriteRule struct {
+	Metric string // The metric name of the matching series, or "*" for any series
+	Column string // The metric column for the samples' values
+	// Labels maps label names (such as __name__, for the metric name) to dimension columns. Other labels are
+	// dropped.
+	Labels map[string]string
+}
+
+// DecodeRemoteWrite decodes the body of a Prometheus remote write request: a Snappy-compressed protobuf
+// WriteRequest. Metadata, exemplars, and native histograms are ignored.
+func DecodeRemoteWrite(b []byte) ([]RemoteWriteSeries, error) {
+	b, err := snappyDecode(b)
+	if err != nil {
+		return nil, err
+	}
+	var series []RemoteWriteSeries
+	r := &protoReader{b}
+	for !r.done() {
+		num, wireType, err := r.field()
+		if err != nil {
+			return nil, err
+		}
+		if num != promWriteTimeseries {
+			if err := r.skip(wireType); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if err := expectWireType(num, wireType, protoBytes); err != nil {
+			return nil, err
+		}
+		seriesBytes, err := r.bytes()
+		if err != nil {
+			return nil, err
+		}
+		s, err := decodePromSeries(seriesBytes)
+		if err != nil {
+			return nil, fmt.Errorf("series %d: %s", len(series), err)
+		}
+		series = append(series, s)
+	}
+	return series, nil
+}
+
+func decodePromSeries(b []byte) (RemoteWriteSeries, error) {
+	s := RemoteWriteSeries{Labels: make(map[string]string)}
+	r := &protoReader{b}
+	for !r.done() {
+		num, wireType, err := r.field()
+		if err != nil {
+			return s, err
+		}
+		switch num {
+		case promSeriesLabels, promSeriesSamples:
+			if err := expectWireType(num, wireType, protoBytes); err != nil {
+				return s, err
+			}
+			field, err := r.bytes()
+			if err != nil {
+				return s, err
+			}
+			if num == promSeriesLabels {
+				name, value, err := decodePromLabel(field)
+				if err != nil {
+					return s, err
+				}
+				s.Labels[name] = value
+				continue
+			}
+			sample, err := decodePromSample(field)
+			if err != nil {
+				return s, err
+			}
+			s.Samples = append(s.Samples, sample)
+		default:
+			if err := r.skip(wireType); err != nil {
+				return s, err
+			}
+		}
+	}
+	return s, nil
+}
+
+func decodePromLabel(b []byte) (name, value string, err error) {
+	r := &protoReader{b}
+	for !r.done() {
+		num, wireType, err := r.field()
+		if err != nil {
+			return "", "", err
+		}
+		switch num {
+		case promLabelName, promLabelValue:
+			if err := expectWireType(num, wireType, protoBytes); err != nil {
+				return "", "", err
+			}
+			field, err := r.bytes()
+			if err != nil {
+				return "", "", err
+			}
+			if num == promLabelName {
+				name = string(field)
+			} else {
+				value = string(field)
+			}
+		default:
+			if err := r.skip(wireType); err != nil {
+				return "", "", err
+			}
+		}
+	}
+	return name, value, nil
+}
+
+func decodePromSample(b []byte) (RemoteWriteSample, error) {
+	var sample RemoteWriteSample
+	r := &protoReader{b}
+	for !r.done() {
+		num, wireType, err := r.field()
+		if err != nil {
+			return sample, err
+		}
+		switch num {
+		case promSampleValue:
+			if err := expectWireType(num, wireType, protoFixed64); err != nil {
+				return sample, err
+			}
+			bits, err := r.fixed64()
+			if err != nil {
+				return sample, err
+			}
+			sample.Value = math.Float64frombits(bits)
+		case promSampleTimestamp:
+			if err := expectWireType(num, wireType, protoVarint); err != nil {
+				return sample, err
+			}
+			v, err := r.varint()
+			if err != nil {
+				return sample, err
+			}
+			sample.TimestampMS = int64(v)
+		default:
+			if err := r.skip(wireType); err != nil {
+				return sample, err
+			}
+		}
+	}
+	return sample, nil
+}
+
+// RemoteWriteRows maps the samples of series to rows for insertion using the first of rules which matches
+// each series. It also returns the number of samples left out: those of series which no rule matches, and
+// NaNs (which include Prometheus's staleness markers). Label values for numeric dimension columns are parsed
+// as numbers; a row with a label value which isn't a number is left for the insert to reject.
+func (s *Schema) RemoteWriteRows(series []RemoteWriteSeries, rules []RemoteWriteRule) (rows []RowMap,
+	dropped int) {
+
+	for _, ts := range series {
+		var rule *RemoteWriteRule
+		for i := range rules {
+			if rules[i].Metric == "*" || rules[i].Metric == ts.Labels["__name__"] {
+				rule = &rules[i]
+				break
+			}
+		}
+		if rule == nil {
+			dropped += len(ts.Samples)
+			continue
+		}
+		dimensions := make(RowMap)
+		for label, column := range rule.Labels {
+			value, ok := ts.Labels[label]
+			if !ok {
+				continue
+			}
+			dimensions[column] = s.labelValue(column, value)
+		}
+		for _, sample := range ts.Samples {
+			if math.IsNaN(sample.Value) {
+				dropped++
+				continue
+			}
+			row := make(RowMap, len(dimensions)+2)
+			for column, value := range dimensions {
+				row[column] = value
+			}
+			row[s.TimestampColumn.Name] = float64(sample.TimestampMS / 1000)
+			row[rule.Column] = sample.Value
+			rows = append(rows, row)
+		}
+	}
+	return rows, dropped
+}
+
+// labelValue returns the value to insert in the dimension column for a label (or tag) value: the value parsed
+// as a number if column is numeric, and otherwise the value itself.
+func (s *Schema) labelValue(column, value string) Untyped {
+	if i, ok := s.DimensionNameToIndex[column]; ok && !s.DimensionColumns[i].String {
+		if f, err := strconv.ParseFloat(value, 64); err == nil {
+			return f
+		}
+	}
+	return value
+}
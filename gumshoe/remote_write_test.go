@@ -0,0 +1,74 @@
+package gumshoe
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// remoteWriteRequest encodes series as the Snappy-compressed protobuf body of a remote write request.
+func remoteWriteRequest(series []RemoteWriteSeries) []byte {
+	var req []byte
+	for _, s := range series {
+		var ts []byte
+		for name, value := range s.Labels {
+			label := appendProtoBytes(nil, promLabelName, []byte(name))
+			label = appendProtoBytes(label, promLabelValue, []byte(value))
+			ts = appendProtoBytes(ts, promSeriesLabels, label)
+		}
+		for _, sample := range s.Samples {
+			b := appendProtoDouble(nil, sample.Value)
+			b = appendProtoKey(b, promSampleTimestamp, protoVarint)
+			b = binary.AppendUvarint(b, uint64(sample.TimestampMS))
+			ts = appendProtoBytes(ts, promSeriesSamples, b)
+		}
+		req = appendProtoBytes(req, promWriteTimeseries, ts)
+	}
+	return snappyLiteral(req)
+}
+
+func TestRemoteWrite(t *testing.T) {
+	series := []RemoteWriteSeries{
+		{
+			Labels: map[string]string{"__name__": "requests_total", "handler": "/query", "instance": "a"},
+			Samples: []RemoteWriteSample{
+				{Value: 3, TimestampMS: int64(hour(1)) * 1000},
+				{Value: math.NaN(), TimestampMS: int64(hour(1))*1000 + 500}, // A staleness marker
+			},
+		},
+		{
+			Labels:  map[string]string{"__name__": "requests_total", "handler": "/insert"},
+			Samples: []RemoteWriteSample{{Value: 2, TimestampMS: int64(hour(2))*1000 + 1500}},
+		},
+		{
+			Labels:  map[string]string{"__name__": "up"},
+			Samples: []RemoteWriteSample{{Value: 1, TimestampMS: int64(hour(2)) * 1000}},
+		},
+	}
+	decoded, err := DecodeRemoteWrite(remoteWriteRequest(series))
+	Assert(t, err, IsNil)
+	Assert(t, len(decoded), Equals, 3)
+	Assert(t, decoded[0].Labels, DeepEquals, series[0].Labels)
+	Assert(t, decoded[1].Samples, DeepEquals, series[1].Samples)
+	_, err = DecodeRemoteWrite([]byte("not snappy"))
+	Assert(t, err, NotNil)
+
+	db := makeTestDB()
+	defer closeTestDB(db)
+	rules := []RemoteWriteRule{
+		{Metric: "requests_total", Column: "metric1", Labels: map[string]string{"handler": "dim1"}},
+	}
+	rows, dropped := db.RemoteWriteRows(decoded, rules)
+	// The NaN and the unmatched series are dropped.
+	Assert(t, dropped, Equals, 2)
+	Assert(t, rows, DeepEquals, []RowMap{
+		{"at": hour(1), "dim1": "/query", "metric1": 3.0},
+		{"at": hour(2) + 1, "dim1": "/insert", "metric1": 2.0},
+	})
+	insertRows(db, rows)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 5)
+}
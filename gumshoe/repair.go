@@ -0,0 +1,316 @@
+package gumshoe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A RepairAction is a change RepairDir made to a DB's metadata, saying what data was discarded.
+type RepairAction struct {
+	Filename string // The file which was discarded (or the metadata file)
+	Action   string
+}
+
+func (a *RepairAction) String() string { return fmt.Sprintf("%s: %s", a.Filename, a.Action) }
+
+// RepairDir salvages the DB in dir, which must be closed, by rewriting its metadata to the most recent state
+// its files can support. A string dimension column whose dimension table file is missing or unreadable falls
+// back to the newest readable earlier generation of the table, if its file is still there. An interval whose
+// segment files are missing, corrupt (including checksum mismatches), or inconsistent with the metadata or
+// the dimension tables falls back likewise to the newest earlier generation whose segment files are all
+// usable; otherwise it's dropped. Cold intervals aren't checked. Unreadable bloom filter files are dropped,
+// leaving their intervals to be scanned without them.
+//
+// If the metadata file itself can't be read, it is rebuilt from the files in dir, with the newest usable
+// generation of each interval and dimension table; schema (which is otherwise unused) must give the DB's
+// columns. A rebuilt DB loses its cold intervals and the other state kept in the metadata, such as the
+// recent batch IDs.
+//
+// RepairDir returns what it discarded, in order. Unless dryRun is set or there was nothing to discard, the
+// old metadata file (if any) is renamed with the suffix ".before-repair" and a new one is written. The
+// discarded files are left in place (gumtool vacuum removes them).
+func RepairDir(dir string, schema *Schema, dryRun bool) ([]*RepairAction, error) {
+	metadataFilename := filepath.Join(dir, MetadataFilename)
+	var actions []*RepairAction
+	action := func(filename, format string, args ...interface{}) {
+		actions = append(actions, &RepairAction{filename, fmt.Sprintf(format, args...)})
+	}
+
+	db := new(DB)
+	rebuild := false
+	b, err := ioutil.ReadFile(metadataFilename)
+	if err == nil {
+		err = json.Unmarshal(b, db)
+	}
+	if err != nil {
+		if schema == nil {
+			return nil, fmt.Errorf("cannot read the metadata (%s); a schema is needed to rebuild it", err)
+		}
+		action(metadataFilename, "the metadata cannot be read (%s); rebuilding it from the files", err)
+		rebuild = true
+		saved := *schema
+		db = &DB{Schema: &saved, StaticTable: &StaticTable{
+			Intervals:       make(IntervalMap),
+			DimensionTables: make([]*DimensionTable, len(schema.DimensionColumns)),
+		}}
+	}
+	s := db.Schema
+	s.Initialize()
+	s.DiskBacked = true
+	s.Dir = dir
+
+	files, err := findGenerationFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	// The dimension tables are repaired first, as the intervals' values must be within them.
+	dimensionSizes := make([]int, len(s.DimensionColumns))
+	for i, col := range s.DimensionColumns {
+		if !col.String {
+			continue
+		}
+		current := db.StaticTable.DimensionTables[i]
+		var generations []int
+		if current != nil {
+			err := current.Load(s, i)
+			if err == nil {
+				dimensionSizes[i] = current.Size
+				continue
+			}
+			action(current.Filename(s, i), "discarded generation %d of the dimension table of %s (%s)",
+				current.Generation, col.Name, err)
+		} else if !rebuild {
+			action(metadataFilename, "there is no dimension table for the string column %s", col.Name)
+		}
+		for _, generation := range files.dimensionTables[i] {
+			if current == nil || generation < current.Generation {
+				generations = append(generations, generation)
+			}
+		}
+		var table *DimensionTable
+		for _, generation := range generations {
+			t := &DimensionTable{Generation: generation}
+			if err := t.read(s, i); err != nil {
+				action(t.Filename(s, i), "discarded generation %d of the dimension table of %s (%s)",
+					generation, col.Name, err)
+				continue
+			}
+			t.Size = len(t.Values)
+			table = t
+			break
+		}
+		switch {
+		case table != nil && current != nil:
+			action(table.Filename(s, i), "using generation %d of the dimension table of %s, with %d of its %d "+
+				"values", table.Generation, col.Name, table.Size, current.Size)
+		case table == nil && (current != nil || len(generations) > 0):
+			action(metadataFilename, "no dimension table of %s can be read; all its values are lost", col.Name)
+		}
+		if table == nil {
+			table = &DimensionTable{ValueToIndex: make(map[string]uint32)}
+		}
+		db.StaticTable.DimensionTables[i] = table
+		dimensionSizes[i] = table.Size
+	}
+
+	intervals := db.StaticTable.Intervals
+	if rebuild {
+		for unix, generations := range files.segments {
+			latest := generations[0]
+			start := time.Unix(unix, 0)
+			intervals[start] = &Interval{
+				Generation:  latest,
+				Start:       start,
+				End:         start.Add(s.IntervalDuration),
+				NumSegments: files.numSegments[segmentFiles{unix, latest}],
+				NumRows:     -1, // Unknown
+				Compressed:  s.CompressSegments,
+			}
+		}
+	}
+	for _, interval := range intervals.sorted() {
+		if interval.Cold {
+			continue
+		}
+		problem := s.checkIntervalFiles(interval, dimensionSizes)
+		if problem == "" {
+			if interval.BloomFilters {
+				if err := interval.loadBloomFilters(s); err != nil {
+					action(interval.BloomFilename(s), "discarded the bloom filters of interval %d (%s)",
+						interval.Start.Unix(), err)
+					interval.BloomFilters = false
+				}
+			}
+			continue
+		}
+		action(interval.SegmentFilename(s, 0), "discarded generation %d of interval %d (%s)",
+			interval.Generation, interval.Start.Unix(), problem)
+
+		var restored *Interval
+		for _, generation := range files.segments[interval.Start.Unix()] {
+			if generation >= interval.Generation {
+				continue
+			}
+			candidate := *interval
+			candidate.Generation = generation
+			candidate.NumSegments = files.numSegments[segmentFiles{interval.Start.Unix(), generation}]
+			candidate.NumRows = -1
+			candidate.Checksums = nil
+			candidate.ZoneMaps = nil
+			candidate.BloomFilters = false
+			// The rollup and dimension retention rules are applied again.
+			candidate.Rollup = 0
+			candidate.DimensionRetention = 0
+			if problem := s.checkIntervalFiles(&candidate, dimensionSizes); problem != "" {
+				action(candidate.SegmentFilename(s, 0), "discarded generation %d of interval %d (%s)",
+					generation, interval.Start.Unix(), problem)
+				continue
+			}
+			restored = &candidate
+			break
+		}
+		if restored == nil {
+			if !rebuild {
+				action(metadataFilename, "dropped interval %d; its %d row(s) are lost", interval.Start.Unix(),
+					interval.NumRows)
+			} else {
+				action(metadataFilename, "dropped interval %d", interval.Start.Unix())
+			}
+			delete(intervals, interval.Start)
+			continue
+		}
+		if !rebuild {
+			action(restored.SegmentFilename(s, 0), "using generation %d of interval %d, with %d row(s) rather "+
+				"than %d", restored.Generation, interval.Start.Unix(), restored.NumRows, interval.NumRows)
+		} else {
+			action(restored.SegmentFilename(s, 0), "using generation %d of interval %d, with %d row(s)",
+				restored.Generation, interval.Start.Unix(), restored.NumRows)
+		}
+		intervals[interval.Start] = restored
+	}
+
+	if dryRun || len(actions) == 0 {
+		return actions, nil
+	}
+	if fileExists(metadataFilename) {
+		if err := os.Rename(metadataFilename, metadataFilename+".before-repair"); err != nil {
+			return nil, err
+		}
+	}
+	if err := db.writeMetadataFile(); err != nil {
+		return nil, err
+	}
+	return actions, nil
+}
+
+// checkIntervalFiles describes the first problem found with the segment files of iv, or returns "" if they're
+// all usable: every segment file must exist, be readable and match its checksum (if iv has checksums), and
+// have values of string dimension columns within their tables (whose sizes are given by dimensionSizes), and
+// the segments must hold iv.NumRows rows. If iv.NumRows is negative, it's set to the number of rows.
+func (s *Schema) checkIntervalFiles(iv *Interval, dimensionSizes []int) string {
+	if iv.Layout < 0 || iv.Layout > len(s.Layouts) {
+		return fmt.Sprintf("it has an unknown row layout (%d)", iv.Layout)
+	}
+	if n := len(iv.Checksums); n > 0 && n != iv.NumSegments {
+		return fmt.Sprintf("it has %d checksums for %d segments", n, iv.NumSegments)
+	}
+	numRows := 0
+	for i := 0; i < iv.NumSegments; i++ {
+		segment, err := s.loadSegment(iv, i, true)
+		if err != nil {
+			switch err := err.(type) {
+			case *CorruptSegmentError:
+				return fmt.Sprintf("segment %d: %s", i, err.Problem)
+			default:
+				if os.IsNotExist(err) {
+					return fmt.Sprintf("segment %d is missing", i)
+				}
+				return fmt.Sprintf("segment %d: %s", i, err)
+			}
+		}
+		rows := s.SegmentRows(segment, nil)
+		numRows += len(rows) / s.RowSize
+		problems := s.checkDimensionBounds(rows, dimensionSizes)
+		segment.close()
+		if len(problems) > 0 {
+			return fmt.Sprintf("segment %d: %s", i, problems[0])
+		}
+	}
+	if iv.NumRows < 0 {
+		iv.NumRows = numRows
+	} else if numRows != iv.NumRows {
+		return fmt.Sprintf("its segments hold %d row(s), but it should have %d", numRows, iv.NumRows)
+	}
+	return ""
+}
+
+// generationFiles lists the generations of the segment and dimension table files in a DB directory.
+type generationFiles struct {
+	segments        map[int64][]int // The generations of each interval (by start time), newest first
+	numSegments     map[segmentFiles]int
+	dimensionTables map[int][]int // The generations of each dimension column's table, newest first
+}
+
+type segmentFiles struct {
+	start      int64 // Unix time
+	generation int
+}
+
+func findGenerationFiles(dir string) (*generationFiles, error) {
+	files := &generationFiles{
+		segments:        make(map[int64][]int),
+		numSegments:     make(map[segmentFiles]int),
+		dimensionTables: make(map[int][]int),
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "interval.*.segment*.dat"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		var start int64
+		var generation, segment int
+		_, err := fmt.Sscanf(filepath.Base(name), "interval.%d.generation%d.segment%d.dat", &start, &generation,
+			&segment)
+		if err != nil {
+			continue
+		}
+		key := segmentFiles{start, generation}
+		if _, ok := files.numSegments[key]; !ok {
+			files.segments[key.start] = append(files.segments[key.start], generation)
+		}
+		// A missing segment in the middle is found when the segments are loaded.
+		if segment >= files.numSegments[key] {
+			files.numSegments[key] = segment + 1
+		}
+	}
+	names, err = filepath.Glob(filepath.Join(dir, "dimension.index*.generation*.gob.gz"))
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		var index, generation int
+		if _, err := fmt.Sscanf(filepath.Base(name), "dimension.index%d.generation%d.gob.gz", &index,
+			&generation); err != nil {
+			continue
+		}
+		files.dimensionTables[index] = append(files.dimensionTables[index], generation)
+	}
+	for _, generations := range files.segments {
+		sort.Sort(sort.Reverse(sort.IntSlice(generations)))
+	}
+	for _, generations := range files.dimensionTables {
+		sort.Sort(sort.Reverse(sort.IntSlice(generations)))
+	}
+	return files, nil
+}
+
+func fileExists(filename string) bool {
+	_, err := os.Stat(filename)
+	return err == nil
+}
@@ -0,0 +1,108 @@
+package gumshoe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestRepairDir(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": hour(1), "dim1": "string1", "metric1": 1.0},
+	})
+	// Keep the first generation of the first interval, which the next flush replaces.
+	resp := db.MakeRequest()
+	var first, second *Interval
+	for _, interval := range resp.StaticTable.Intervals {
+		if interval.Start.Unix() == 0 {
+			first = interval
+		} else {
+			second = interval
+		}
+	}
+	resp.Done()
+	oldFilename := first.SegmentFilename(db.Schema, 0)
+	oldSegment, err := ioutil.ReadFile(oldFilename)
+	Assert(t, err, IsNil)
+	insertRow(db, RowMap{"at": 0.0, "dim1": "string2", "metric1": 1.0})
+	resp = db.MakeRequest()
+	newFilename := resp.StaticTable.Intervals[first.Start].SegmentFilename(db.Schema, 0)
+	resp.Done()
+	schema := db.Schema
+	closeTestDB(db)
+
+	// The latest generation of the first interval is lost, and the segment of the second is truncated.
+	Assert(t, newFilename != oldFilename, IsTrue)
+	Assert(t, ioutil.WriteFile(oldFilename, oldSegment, 0666), IsNil)
+	Assert(t, os.Remove(newFilename), IsNil)
+	Assert(t, os.Truncate(second.SegmentFilename(schema, 0), 1), IsNil)
+	metadataFilename := filepath.Join(schema.Dir, MetadataFilename)
+	metadata, err := ioutil.ReadFile(metadataFilename)
+	Assert(t, err, IsNil)
+
+	expected := []string{
+		newFilename + ": discarded generation 1 of interval 0 (segment 0 is missing)",
+		oldFilename + ": using generation 0 of interval 0, with 1 row(s) rather than 2",
+		second.SegmentFilename(schema, 0) + ": discarded generation 0 of interval 3600 (segment 0: its size " +
+			"is not a multiple of the row size)",
+		metadataFilename + ": dropped interval 3600; its 1 row(s) are lost",
+	}
+	actions, err := RepairDir(schema.Dir, nil, true)
+	Assert(t, err, IsNil)
+	Assert(t, repairActionStrings(actions), DeepEquals, expected)
+	// A dry run changes nothing.
+	unchanged, err := ioutil.ReadFile(metadataFilename)
+	Assert(t, err, IsNil)
+	Assert(t, unchanged, DeepEquals, metadata)
+
+	actions, err = RepairDir(schema.Dir, nil, false)
+	Assert(t, err, IsNil)
+	Assert(t, repairActionStrings(actions), DeepEquals, expected)
+	backup, err := ioutil.ReadFile(metadataFilename + ".before-repair")
+	Assert(t, err, IsNil)
+	Assert(t, backup, DeepEquals, metadata)
+	problems, err := VerifyDir(schema.Dir, true)
+	Assert(t, err, IsNil)
+	Assert(t, problems, IsNil)
+	actions, err = RepairDir(schema.Dir, nil, false)
+	Assert(t, err, IsNil)
+	Assert(t, actions, IsNil)
+
+	db, err = OpenDBDir(schema.Dir)
+	Assert(t, err, IsNil)
+	Assert(t, db.GetDebugRows(), DeepEquals, []UnpackedRow{
+		{RowMap{"at": uint32(0), "dim1": "string1", "metric1": uint32(1)}, 1},
+	})
+	closeTestDB(db)
+
+	// Without its metadata, the DB is rebuilt from its files with the given schema.
+	Assert(t, ioutil.WriteFile(metadataFilename, []byte(`{"Schema": {`), 0666), IsNil)
+	_, err = RepairDir(schema.Dir, nil, false)
+	Assert(t, err, NotNil)
+	actions, err = RepairDir(schema.Dir, schemaFixture(), false)
+	Assert(t, err, IsNil)
+	Assert(t, len(actions), Equals, 3)
+	Assert(t, actions[2].String(), Equals, metadataFilename+": dropped interval 3600")
+
+	db, err = OpenDBDir(schema.Dir)
+	Assert(t, err, IsNil)
+	defer closeTestDB(db)
+	Assert(t, db.GetDebugRows(), DeepEquals, []UnpackedRow{
+		{RowMap{"at": uint32(0), "dim1": "string1", "metric1": uint32(1)}, 1},
+	})
+	Assert(t, db.GetDimensionTables()["dim1"], DeepEquals, []string{"string1", "string2"})
+}
+
+func repairActionStrings(actions []*RepairAction) []string {
+	var s []string
+	for _, action := range actions {
+		s = append(s, action.String())
+	}
+	return s
+}
@@ -1,6 +1,11 @@
 package gumshoe
 
-import "time"
+import (
+	"context"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/metrics"
+)
 
 // DB request methods (all named Get*) are for retrieving DB information at a high level.
 
@@ -9,15 +14,16 @@ type Request struct {
 	Resp chan *Response
 }
 
-// A Response is the response to a Request. The current StaticTable is returned back to the requester, along
-// with a channel to indicate when the user is done using it.
+// A Response is the response to a Request. The current StaticTable is returned back to the requester, who
+// must call Done when finished using it.
 type Response struct {
 	StaticTable *StaticTable
-	done        chan struct{}
 }
 
+// Done releases the intervals of r.StaticTable, cleaning up those which have since been replaced (see
+// intervalUsers).
 func (r *Response) Done() {
-	r.done <- struct{}{}
+	r.StaticTable.users.release(r.StaticTable.Intervals)
 }
 
 func (db *DB) MakeRequest() *Response {
@@ -26,10 +32,68 @@ func (db *DB) MakeRequest() *Response {
 	return <-respCh
 }
 
-func (db *DB) GetQueryResult(query *Query) ([]RowMap, error) {
+// GetQueryResult runs query against the DB's current StaticTable. The query is aborted with an error if ctx
+// is done before it finishes.
+func (db *DB) GetQueryResult(ctx context.Context, query *Query) ([]RowMap, error) {
+	return db.getQueryResult(ctx, query, false)
+}
+
+// GetQueryResultSketches is like GetQueryResult, but returns mergeable sketches rather than final estimates
+// for approximate aggregates. See StaticTable.InvokeQuerySketches.
+func (db *DB) GetQueryResultSketches(ctx context.Context, query *Query) ([]RowMap, error) {
+	return db.getQueryResult(ctx, query, true)
+}
+
+func (db *DB) getQueryResult(ctx context.Context, query *Query, sketches bool) ([]RowMap, error) {
+	lookupTables, err := db.GetQueryLookupTables(query)
+	if err != nil {
+		return nil, err
+	}
+	// The query may be answered by a view; the lookup tables are still the DB's.
+	resp := db.queryDB(query).MakeRequest()
+	defer resp.Done()
+	start := time.Now()
+	rows, err := resp.StaticTable.invokeQuery(ctx, query, sketches)
+	if err != nil {
+		return nil, err
+	}
+	// Grouped queries are much more expensive, so they're timed separately.
+	if len(query.Groupings) > 0 {
+		metrics.Since("query.scan.grouped", start)
+	} else {
+		metrics.Since("query.scan.ungrouped", start)
+	}
+	ApplyLookups(rows, query, lookupTables)
+	return rows, nil
+}
+
+// GetQueryPlan describes how query would be run against the current StaticTable of the DB (or of the view
+// which would answer it), without running it.
+func (db *DB) GetQueryPlan(query *Query) (*QueryPlan, error) {
+	source := db.queryDB(query)
+	resp := source.MakeRequest()
+	defer resp.Done()
+	plan, err := resp.StaticTable.ExplainQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	for _, view := range db.views {
+		if view.DB == source {
+			plan.View = view.name
+		}
+	}
+	return plan, nil
+}
+
+// GetIntervalGenerations returns the current generation of each interval in the DB, keyed by start time.
+func (db *DB) GetIntervalGenerations() map[time.Time]int {
 	resp := db.MakeRequest()
 	defer resp.Done()
-	return resp.StaticTable.InvokeQuery(query)
+	generations := make(map[time.Time]int)
+	for t, interval := range resp.StaticTable.Intervals {
+		generations[t] = interval.Generation
+	}
+	return generations
 }
 
 func (db *DB) GetDimensionTables() map[string][]string {
@@ -51,6 +115,24 @@ func (db *DB) GetLatestTimestamp() time.Time {
 	return db.latestTimestamp
 }
 
+// GetInsertBacklog returns the number of rows which have been inserted but not yet flushed: the physical rows
+// in the memtable plus the rows in inserts waiting to be applied (for instance, during a flush). bytes is an
+// estimate of the memory those rows use.
+func (db *DB) GetInsertBacklog() (rows, bytes int) {
+	db.backlogLock.Lock()
+	defer db.backlogLock.Unlock()
+	rows = db.queuedRows + db.memTableRows
+	return rows, rows * db.RowSize
+}
+
+// GetHeldRows returns the number of inserted rows which are held back until the DB is reopened with a full
+// string dimension column widened (see PromoteStringOverflow). Queries don't see them until then.
+func (db *DB) GetHeldRows() int {
+	db.backlogLock.Lock()
+	defer db.backlogLock.Unlock()
+	return db.numHeldRows
+}
+
 func (db *DB) GetOldestIntervalTimestamp() time.Time {
 	resp := db.MakeRequest()
 	defer resp.Done()
@@ -85,8 +167,9 @@ func (db *DB) GetDebugRows() []UnpackedRow {
 	var results []UnpackedRow
 	for _, interval := range resp.StaticTable.Intervals.sorted() {
 		for _, segment := range interval.Segments {
-			for i := 0; i < len(segment.Bytes); i += db.RowSize {
-				row := RowBytes(segment.Bytes[i : i+db.RowSize])
+			rows := db.SegmentRows(segment, nil)
+			for i := 0; i < len(rows); i += db.RowSize {
+				row := RowBytes(rows[i : i+db.RowSize])
 				unpacked := db.DeserializeRow(row)
 				// The RowMap doesn't have an attached timestamp column yet.
 				unpacked.RowMap[db.TimestampColumn.Name] = uint32(interval.Start.Unix())
@@ -0,0 +1,43 @@
+// Changing the retention of a running DB.
+
+package gumshoe
+
+import (
+	"fmt"
+	"time"
+)
+
+type retentionRequest struct {
+	Retention time.Duration
+	Err       chan error
+}
+
+// SetRetention changes the DB's retention period (turning on FixedRetention, if it was off) and flushes the
+// DB, which drops the intervals outside the new period. A disk-backed DB saves the retention with its
+// metadata, and it takes precedence over RunConfig.Retention when the DB is opened again.
+func (db *DB) SetRetention(retention time.Duration) error {
+	if db.ReadOnly {
+		return ReadOnlyErr
+	}
+	if retention <= 0 {
+		return fmt.Errorf("the retention period must be positive (got %s)", retention)
+	}
+	req := &retentionRequest{Retention: retention, Err: make(chan error)}
+	db.retentions <- req
+	return <-req.Err
+}
+
+// setRetention carries out req. This should only be called by the insertion goroutine.
+func (db *DB) setRetention(req *retentionRequest) error {
+	for _, view := range db.views {
+		if err := view.SetRetention(req.Retention); err != nil {
+			return fmt.Errorf("cannot set the retention of view %s: %s", view.name, err)
+		}
+	}
+	Log.Printf("Changing the retention from %s to %s", db.Retention, req.Retention)
+	db.FixedRetention = true
+	db.Retention = req.Retention
+	db.SavedRetention = req.Retention
+	// The flush saves the retention with the metadata.
+	return db.flush()
+}
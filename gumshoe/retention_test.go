@@ -0,0 +1,38 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestSetRetention(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	db.FixedRetention = true
+	db.Retention = 7 * 24 * time.Hour
+
+	start := Time(time.Now())
+	insertRows(db, []RowMap{
+		{"at": start.hoursBack(72), "dim1": "string1", "metric1": 1.0},
+		{"at": start.hoursBack(12), "dim1": "string1", "metric1": 1.0},
+	})
+	Assert(t, physicalRows(db), Equals, 2)
+
+	// Setting the retention drops the intervals outside it right away.
+	Assert(t, db.SetRetention(0), NotNil)
+	Assert(t, db.SetRetention(24*time.Hour), IsNil)
+	Assert(t, physicalRows(db), Equals, 1)
+
+	// The retention is kept when the DB is opened with its old configuration.
+	closeTestDB(db)
+	db.Retention = 7 * 24 * time.Hour
+	db, err := OpenDB(db.Schema)
+	Assert(t, err, IsNil)
+	defer closeTestDB(db)
+	Assert(t, db.Retention, Equals, 24*time.Hour)
+	insertRows(db, []RowMap{{"at": start.hoursBack(72), "dim1": "string1", "metric1": 1.0}})
+	Assert(t, physicalRows(db), Equals, 1)
+}
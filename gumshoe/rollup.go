@@ -0,0 +1,225 @@
+// Rolling up old intervals into coarser rows (see RunConfig.Rollups).
+
+package gumshoe
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/b"
+)
+
+// A RollupRule says how to roll up intervals which ended more than After ago: the rows of each Resolution
+// (a multiple of the interval duration) of time are combined into the interval starting at its beginning, and
+// the DropDimensions columns are set to nil, so that rows differing only in those columns are merged.
+type RollupRule struct {
+	After          time.Duration
+	Resolution     time.Duration
+	DropDimensions []string
+}
+
+// A DimensionRetentionRule drops the Dimensions columns (setting them to nil) from the rows of the intervals
+// which ended more than After ago, so that the rows which differ only in those columns are merged. Metrics are
+// summed exactly, as when rows are inserted.
+type DimensionRetentionRule struct {
+	After      time.Duration
+	Dimensions []string
+}
+
+type rollupRequest struct {
+	RolledUp int // The number of intervals rewritten; set by the inserter (before sending on Err)
+	Err      chan error
+}
+
+// Rollup applies the DB's rollup rules (RunConfig.Rollups) and dimension retention rules
+// (RunConfig.DimensionRetention) to the intervals old enough for them and returns the number of intervals
+// which were rewritten. An interval which has been rolled up isn't rewritten again until it's old enough for
+// the next rule, or rows are inserted into it. Rolled-up rows are timestamped with the start of their
+// interval, like any others, so a query sees the rows of each Resolution of time at its start (and the age of
+// rolled-up rows, for dimension retention, is that of the first interval of their Resolution).
+func (db *DB) Rollup() (int, error) {
+	if db.ReadOnly {
+		return 0, ReadOnlyErr
+	}
+	req := &rollupRequest{Err: make(chan error)}
+	db.rollups <- req
+	err := <-req.Err
+	return req.RolledUp, err
+}
+
+// rollupLevel returns the number of rollup rules which apply to the interval starting at start by now (the
+// rules are applied in order, so this is one more than the index of the last one which applies) and the start
+// of the interval its rows are combined into. The level is 0 if no rule applies yet.
+func (s *Schema) rollupLevel(start, now time.Time) (level int, bucket time.Time) {
+	for i := len(s.Rollups) - 1; i >= 0; i-- {
+		rule := s.Rollups[i]
+		bucket = start.Truncate(rule.Resolution)
+		// The whole bucket must be old enough, so that all its intervals are at the same level.
+		if !bucket.Add(rule.Resolution).After(now.Add(-rule.After)) {
+			return i + 1, bucket
+		}
+	}
+	return 0, time.Time{}
+}
+
+// dimensionRetentionLevel returns the number of dimension retention rules which apply to the interval
+// starting at start by now. Like retention, the age of the interval's rows is measured from its end.
+func (s *Schema) dimensionRetentionLevel(start, now time.Time) int {
+	end := start.Add(s.IntervalDuration)
+	level := 0
+	for i, rule := range s.DimensionRetention {
+		if !end.After(now.Add(-rule.After)) {
+			level = i + 1
+		}
+	}
+	return level
+}
+
+// rollup carries out req. This should only be called by the insertion goroutine.
+func (db *DB) rollup(req *rollupRequest) error {
+	if len(db.Rollups) == 0 && len(db.DimensionRetention) == 0 {
+		return nil
+	}
+	for _, view := range db.views {
+		if _, err := view.Rollup(); err != nil {
+			return fmt.Errorf("cannot roll up view %s: %s", view.name, err)
+		}
+	}
+	now := time.Now()
+	intervals := make(map[time.Time]*Interval)
+	buckets := make(map[time.Time][]*Interval)
+	levels := make(map[time.Time]int)
+	for key, interval := range db.StaticTable.Intervals {
+		level, bucket := db.rollupLevel(key, now)
+		if level == 0 {
+			// The interval is its own bucket, which is only rewritten for dimension retention.
+			bucket = key
+		}
+		buckets[bucket] = append(buckets[bucket], interval)
+		levels[bucket] = level
+	}
+
+	var intervalsForCleanup []*Interval
+	for bucket, bucketIntervals := range buckets {
+		level := levels[bucket]
+		retentionLevel := db.dimensionRetentionLevel(bucket, now)
+		if len(bucketIntervals) == 1 && bucketIntervals[0].Start.Equal(bucket) &&
+			bucketIntervals[0].Rollup == level && bucketIntervals[0].DimensionRetention == retentionLevel {
+			intervals[bucket] = bucketIntervals[0]
+			continue
+		}
+		newInterval, err := db.rollUpIntervals(bucketIntervals, bucket, level, retentionLevel)
+		if err != nil {
+			return fmt.Errorf("cannot roll up intervals: %s", err)
+		}
+		req.RolledUp += len(bucketIntervals)
+		intervalsForCleanup = append(intervalsForCleanup, bucketIntervals...)
+		if newInterval.NumRows > 0 {
+			intervals[bucket] = newInterval
+		}
+	}
+	Log.Printf("Rolled up %d intervals", req.RolledUp)
+	if len(intervalsForCleanup) == 0 {
+		return nil
+	}
+
+	newStaticTable := NewStaticTable(db.Schema)
+	newStaticTable.Intervals = intervals
+	newStaticTable.DimensionTables = db.StaticTable.DimensionTables
+	db.swapStaticTable(newStaticTable)
+
+	if db.DiskBacked {
+		if err := db.writeMetadataFile(); err != nil {
+			return fmt.Errorf("error writing metadata: %s", err)
+		}
+		db.cleanUpOldIntervals(intervalsForCleanup)
+	}
+	return nil
+}
+
+// rollUpIntervals combines the rows of intervals, leaving out the columns dropped by the first level rollup
+// rules and the first retentionLevel dimension retention rules, into a fresh interval starting at bucket. The
+// rows are combined in memory.
+func (db *DB) rollUpIntervals(intervals []*Interval, bucket time.Time, level, retentionLevel int) (
+	*Interval, error) {
+
+	var droppedNames []string
+	for _, rule := range db.Rollups[:level] {
+		droppedNames = append(droppedNames, rule.DropDimensions...)
+	}
+	for _, rule := range db.DimensionRetention[:retentionLevel] {
+		droppedNames = append(droppedNames, rule.Dimensions...)
+	}
+	var dropped []int
+	for _, name := range droppedNames {
+		if i, ok := db.DimensionNameToIndex[name]; ok {
+			dropped = append(dropped, i)
+		}
+	}
+
+	tree := b.TreeNew(bytes.Compare)
+	generation := 0
+	for _, interval := range intervals {
+		if interval.Generation >= generation {
+			generation = interval.Generation + 1
+		}
+		loaded, release, err := db.coldCache.acquire(interval)
+		if err != nil {
+			return nil, err
+		}
+		cursor := loaded.cursor(db.Schema)
+		for {
+			key, val, count, more := cursor.Next()
+			if !more {
+				break
+			}
+			dimensions := make(DimensionBytes, len(key))
+			copy(dimensions, key)
+			for _, i := range dropped {
+				dimensions.setNil(i)
+				cell := dimensions[db.DimensionOffsets[i]:][:db.DimensionColumns[i].Width]
+				for j := range cell {
+					cell[j] = 0
+				}
+			}
+			value, ok := tree.Get([]byte(dimensions))
+			if ok {
+				MetricBytes(value.Metric).add(db.Schema, MetricBytes(val))
+				value.Count += count
+			} else {
+				metrics := make([]byte, len(val))
+				copy(metrics, val)
+				value = b.MetricWithCount{Count: count, Metric: metrics}
+			}
+			tree.Set([]byte(dimensions), value)
+		}
+		release()
+	}
+
+	newInterval := newWriteOnlyInterval(db.Schema, generation, bucket, bucket.Add(db.IntervalDuration))
+	if cursor, err := tree.SeekFirst(); err == nil {
+		for {
+			key, val, err := cursor.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := newInterval.appendRow(db.Schema, key, val.Metric, val.Count); err != nil {
+				return nil, err
+			}
+		}
+	} else if err != io.EOF {
+		return nil, err
+	}
+	iv, err := newInterval.freeze(db.Schema)
+	if err != nil {
+		return nil, err
+	}
+	iv.Rollup = level
+	iv.DimensionRetention = retentionLevel
+	return iv, nil
+}
@@ -0,0 +1,125 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func makeTestRollupDB() *DB {
+	return makeCustomTestDB(true, func(schema *Schema) {
+		schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("dim2", "uint8", true))
+		schema.Rollups = []RollupRule{
+			{After: 24 * time.Hour, Resolution: 2 * time.Hour, DropDimensions: []string{"dim2"}},
+		}
+	})
+}
+
+func TestRollup(t *testing.T) {
+	db := makeTestRollupDB()
+	defer os.RemoveAll(db.Dir)
+
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "dim2": "x", "metric1": 1.0},
+		{"at": 0.0, "dim1": "a", "dim2": "y", "metric1": 2.0},
+		{"at": hour(1), "dim1": "a", "dim2": "z", "metric1": 4.0},
+		{"at": hour(1), "dim1": "b", "dim2": "x", "metric1": 8.0},
+		{"at": hour(2), "dim1": "a", "dim2": "x", "metric1": 16.0},
+	})
+	Assert(t, physicalRows(db), Equals, 5)
+
+	rolledUp, err := db.Rollup()
+	Assert(t, err, IsNil)
+	Assert(t, rolledUp, Equals, 3)
+	Assert(t, physicalRows(db), Equals, 3)
+	Assert(t, len(db.GetIntervalGenerations()), Equals, 2)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 31)
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	Assert(t, runQuery(db, query), util.DeepConvertibleEquals, []RowMap{
+		{"dim1": "a", "metric1": 23, "rowCount": 4},
+		{"dim1": "b", "metric1": 8, "rowCount": 1},
+	})
+
+	// Rolled-up intervals aren't rewritten again.
+	rolledUp, err = db.Rollup()
+	Assert(t, err, IsNil)
+	Assert(t, rolledUp, Equals, 0)
+
+	// A row inserted later is combined into the rolled-up interval by the next rollup.
+	insertRows(db, []RowMap{{"at": hour(1), "dim1": "b", "dim2": "y", "metric1": 32.0}})
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+	rolledUp, err = db.Rollup()
+	Assert(t, err, IsNil)
+	Assert(t, rolledUp, Equals, 2)
+	Assert(t, physicalRows(db), Equals, 3)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 63)
+}
+
+func TestRollupLevel(t *testing.T) {
+	schema := schemaFixture()
+	schema.Rollups = []RollupRule{
+		{After: 24 * time.Hour, Resolution: 2 * time.Hour},
+		{After: 48 * time.Hour, Resolution: 24 * time.Hour},
+	}
+	now := time.Unix(int64(hour(24*10+1)), 0)
+	for _, tt := range []struct {
+		hoursAgo int
+		level    int
+		bucket   time.Time
+	}{
+		{1, 0, time.Time{}},
+		{25, 0, time.Time{}}, // The rest of its bucket is too recent
+		{26, 1, now.Add(-27 * time.Hour)},
+		{27, 1, now.Add(-27 * time.Hour)},
+		{49, 1, now.Add(-49 * time.Hour)},
+		{73, 2, now.Add(-73 * time.Hour)},
+	} {
+		level, bucket := schema.rollupLevel(now.Add(-time.Duration(tt.hoursAgo)*time.Hour), now)
+		Assert(t, level, Equals, tt.level)
+		Assert(t, bucket, Equals, tt.bucket)
+	}
+}
+
+func TestDimensionRetention(t *testing.T) {
+	db := makeCustomTestDB(true, func(schema *Schema) {
+		schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("dim2", "uint8", true))
+		schema.DimensionRetention = []DimensionRetentionRule{{After: 24 * time.Hour, Dimensions: []string{"dim2"}}}
+	})
+	defer os.RemoveAll(db.Dir)
+	defer closeTestDB(db)
+
+	start := Time(time.Now())
+	insertRows(db, []RowMap{
+		{"at": start.hoursBack(48), "dim1": "a", "dim2": "x", "metric1": 1.0},
+		{"at": start.hoursBack(48), "dim1": "a", "dim2": "y", "metric1": 2.0},
+		{"at": start.hoursBack(47), "dim1": "a", "dim2": "x", "metric1": 4.0},
+		{"at": start.hoursBack(0), "dim1": "a", "dim2": "x", "metric1": 8.0},
+		{"at": start.hoursBack(0), "dim1": "a", "dim2": "y", "metric1": 16.0},
+	})
+	Assert(t, physicalRows(db), Equals, 5)
+
+	// The old intervals lose dim2 but keep their timestamps.
+	rewritten, err := db.Rollup()
+	Assert(t, err, IsNil)
+	Assert(t, rewritten, Equals, 2)
+	Assert(t, physicalRows(db), Equals, 4)
+	Assert(t, len(db.GetIntervalGenerations()), Equals, 3)
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim2", "dim2"}}
+	query.OrderBy = []QueryOrder{{Column: "metric1"}}
+	Assert(t, runQuery(db, query), util.DeepConvertibleEquals, []RowMap{
+		{"dim2": nil, "metric1": 7, "rowCount": 3},
+		{"dim2": "x", "metric1": 8, "rowCount": 1},
+		{"dim2": "y", "metric1": 16, "rowCount": 1},
+	})
+
+	rewritten, err = db.Rollup()
+	Assert(t, err, IsNil)
+	Assert(t, rewritten, Equals, 0)
+}
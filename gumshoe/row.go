@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"strconv"
 	"time"
 	"unsafe"
 )
@@ -89,29 +90,26 @@ func (db *DB) setDimensionValue(dimensions DimensionBytes, index int, value Unty
 		if !ok {
 			return fmt.Errorf("expected string value for dimension %s", column.Name)
 		}
-		dimValueIndex, ok := db.StaticTable.DimensionTables[index].Get(stringValue)
-		if !ok {
-			dimValueIndex, _ = db.memTable.DimensionTables[index].GetAndMaybeSet(stringValue)
-			// The index in a MemTable's dimension table must be offset by the size of the StaticTable's dimension
-			// table (with which it will be later combined).
-			dimValueIndex += uint32(len(db.StaticTable.DimensionTables[index].Values))
-		}
-		if float64(dimValueIndex) > typeMaxes[column.Type] {
-			return fmt.Errorf("adding a new value (%v) to dimension %s overflows the dimension table",
-				value, column.Name)
+		dimValueIndex, err := db.stringDimensionIndex(index, stringValue)
+		if err != nil {
+			return err
 		}
 		setRowValue(unsafe.Pointer(&dimensions[db.DimensionOffsets[index]]), column.Type, float64(dimValueIndex))
 		return nil
 	}
 
-	float, ok := value.(float64)
+	float, ok := numericValue(value)
 	if !ok {
 		return fmt.Errorf("expected numeric value for dimension %s", column.Name)
 	}
+	cell := unsafe.Pointer(&dimensions[db.DimensionOffsets[index]])
+	if setExactInteger(cell, column.Type, value) {
+		return nil
+	}
 	if float > typeMaxes[column.Type] {
 		return fmt.Errorf("value %v too large for dimension %s (type %s)", value, column.Name, column.Type)
 	}
-	setRowValue(unsafe.Pointer(&dimensions[db.DimensionOffsets[index]]), column.Type, float)
+	setRowValue(cell, column.Type, float)
 	return nil
 }
 
@@ -123,17 +121,61 @@ func (db *DB) setMetricValue(metrics MetricBytes, index int, value Untyped) erro
 		return nil
 	}
 
-	float, ok := value.(float64)
+	float, ok := numericValue(value)
 	if !ok {
 		return fmt.Errorf("expected numeric value for metric %s", column.Name)
 	}
+	cell := unsafe.Pointer(&metrics[db.MetricOffsets[index]])
+	if setExactInteger(cell, column.Type, value) {
+		return nil
+	}
 	if float > typeMaxes[column.Type] {
 		return fmt.Errorf("value %v too large for column %s (type %s)", value, column.Name, column.Type)
 	}
-	setRowValue(unsafe.Pointer(&metrics[db.MetricOffsets[index]]), column.Type, value.(float64))
+	setRowValue(cell, column.Type, float)
 	return nil
 }
 
+// numericValue returns an inserted value for a numeric column as a float64. The value may be a float64 or a
+// json.Number (as from a JSON decoder using UseNumber, or from DecodeRowBatch).
+func numericValue(value Untyped) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// setExactInteger sets cell, of type typ, to value if value is a json.Number holding an integer which fits in
+// typ and typ is a 64-bit integer type. Such values are stored exactly, rather than being rounded to a
+// float64. It returns whether cell was set.
+func setExactInteger(cell unsafe.Pointer, typ Type, value Untyped) bool {
+	n, ok := value.(json.Number)
+	if !ok {
+		return false
+	}
+	switch typ {
+	case TypeInt64:
+		i, err := strconv.ParseInt(string(n), 10, 64)
+		if err != nil {
+			return false
+		}
+		*(*int64)(cell) = i
+		return true
+	case TypeUint64:
+		u, err := strconv.ParseUint(string(n), 10, 64)
+		if err != nil {
+			return false
+		}
+		*(*uint64)(cell) = u
+		return true
+	}
+	return false
+}
+
 // serializeRowMap takes a RowMap (in the form from deserialized JSON -- in particular, with numbers as
 // floats) and maps each key to the appropriate column (including adding new entries to the memTable's
 // dimension tables). Note that this should only be called from the inserter goroutine.
@@ -143,7 +185,7 @@ func (db *DB) serializeRowMap(rowMap RowMap) (*insertionRow, error) {
 	if !ok {
 		return nil, fmt.Errorf("row must have a value for the timestamp column (%q)", timestampColumnName)
 	}
-	timestampUnix, ok := timestamp.(float64)
+	timestampUnix, ok := numericValue(timestamp)
 	if !ok {
 		return nil, fmt.Errorf("timestamp column (%q) must have a numeric value", timestampColumnName)
 	}
@@ -170,8 +212,14 @@ func (db *DB) serializeRowMap(rowMap RowMap) (*insertionRow, error) {
 			return nil, err
 		}
 	}
+	droppedColumns := 0
+	for _, name := range db.DroppedColumns {
+		if _, ok := rowMap[name]; ok {
+			droppedColumns++
+		}
+	}
 	// Sanity check that we didn't get extra fields
-	expectedFields := 1 + len(db.DimensionColumns) + len(db.MetricColumns) - missingColumns
+	expectedFields := 1 + len(db.DimensionColumns) + len(db.MetricColumns) - missingColumns + droppedColumns
 	if len(rowMap) > expectedFields {
 		return nil, fmt.Errorf("extra (unrecognized) columns in insertion row")
 	}
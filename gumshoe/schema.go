@@ -3,7 +3,9 @@ package gumshoe
 import (
 	"fmt"
 	"runtime"
+	"sort"
 	"time"
+	"unsafe"
 
 	"github.com/philc/gumshoedb/internal/github.com/dustin/go-humanize"
 )
@@ -50,6 +52,14 @@ type Schema struct {
 	DiskBacked bool   `json:"-"`
 	Dir        string `json:"-"` // Path to persist a DB
 
+	// DroppedColumns names columns which were removed from the schema. Their values are ignored on insert, and
+	// they're skipped when the intervals written before they were dropped are scanned, and removed from those
+	// intervals when they're rewritten.
+	DroppedColumns []string `json:",omitempty"`
+	// Layouts are the row layouts of the intervals which were written with earlier columns (see
+	// Interval.Layout). Layouts which are no longer used are removed when the DB is opened.
+	Layouts []*RowLayout `json:",omitempty"`
+
 	// NOTE(caleb) the runtime configuration options are technically not part of the "schema" but we'll keep
 	// them here for convenience.
 	RunConfig `json:"-"`
@@ -67,14 +77,91 @@ type Schema struct {
 	MetricWidth          int   `json:"-"`
 	NilBytes             int   `json:"-"`
 	RowSize              int   `json:"-"`
+
+	TTLDimensionIndex  int   `json:"-"` // The index of RunConfig.TTLColumn in DimensionColumns, or -1
+	BloomFilterIndexes []int `json:"-"` // The indexes of RunConfig.BloomFilterColumns in DimensionColumns
 }
 
 type RunConfig struct {
 	FixedRetention   bool          // Whether to truncate old data
 	Retention        time.Duration // How long to save data if FixedRetention is true
 	QueryParallelism int
+
+	// TTLColumn optionally names a numeric dimension column giving the number of days to keep each row. Rows
+	// with a (non-zero) TTL are deleted sooner than the retention period if the TTL is shorter. Like
+	// retention, TTLs are measured from the end of a row's interval.
+	TTLColumn string
+
+	// LateArrivalWindow, if positive, is how far in the past an inserted row's timestamp may be. Older rows
+	// are rejected with a LateRowError, rather than being merged into (and rewriting) older intervals.
+	LateArrivalWindow time.Duration
+
+	// CompressSegments makes flushes write segment files in a compressed columnar format (see
+	// segment_codec.go). Compressed segments are memory-mapped as they're stored and decoded into a scan buffer
+	// each time they're scanned, so this trades query time for disk space and memory. Existing intervals are
+	// compressed (or decompressed) as they are rewritten.
+	CompressSegments bool
+
+	// SegmentVerification says when segment files are checked against their checksums.
+	SegmentVerification SegmentVerification
+
+	// SegmentAdvice is the paging advice given for memory-mapped segment files.
+	SegmentAdvice SegmentAdvice
+	// MlockWindow, if positive, locks the segments of the intervals which ended within this long ago into
+	// memory, so that queries of recent data never wait on the disk.
+	MlockWindow time.Duration
+	// DirectIO makes flushes write segment files with O_DIRECT, so that they don't push the segments being
+	// queried out of the page cache. (Where O_DIRECT isn't supported, the files are written normally.) The
+	// segment files, the metadata file, and the directory are synced to disk as each flush commits.
+	DirectIO bool
+
+	// ColdStore, if set, is where the segment files of intervals which ended more than ColdAfter ago are moved
+	// (at flush time) to save local disk space. Queries and rewrites of cold intervals fetch their segments
+	// back into a local cache, which is limited to ColdCacheSize bytes (if positive) of intervals not in use.
+	ColdStore     ColdStore
+	ColdAfter     time.Duration
+	ColdCacheSize int
+
+	// BloomFilterColumns names string dimension columns for which each segment gets a bloom filter of the
+	// values it contains, so that scans can skip the segments which can't match an equality or 'in' filter on
+	// the column. This is worthwhile for high-cardinality columns. The bloom filters of an interval are kept
+	// in a file beside its segments (see Interval.BloomFilename).
+	BloomFilterColumns []string
+
+	// StringOverflow says what happens to an inserted row with a new value for a string dimension column whose
+	// dimension table is full.
+	StringOverflow StringOverflowPolicy
+
+	// Rollups are the rules, in order of increasing age, by which DB.Rollup combines the rows of old intervals
+	// into fewer, coarser rows. Each rule's After and Resolution must be at least those of the previous rule,
+	// and its Resolution a multiple of the previous one's (and of the interval duration).
+	Rollups []RollupRule
+
+	// DimensionRetention are the rules, in order of increasing age, by which DB.Rollup sets dimension columns
+	// to nil in old intervals, collapsing the rows which differ only in those columns (see
+	// DimensionRetentionRule). Unlike rollups, this keeps the timestamps of the rows.
+	DimensionRetention []DimensionRetentionRule
+
+	// Views are materialized views of the DB, which answer the queries they can (see View). A query is
+	// answered by the first view which can answer it, so views should be listed from smallest to largest.
+	Views []View
+
+	// ReadOnly opens an existing DB without changing anything in its directory: the write-ahead log isn't
+	// replayed, and inserts, flushes (so retention isn't applied), deletes, rollups, and registering lookup
+	// tables fail with ReadOnlyErr. The DB's columns can't be changed, and only the views which already exist
+	// with their columns are used. The directory is locked with a shared lock, so several read-only DBs (but
+	// not a writable one) may use it at once.
+	ReadOnly bool
 }
 
+type SegmentVerification int
+
+const (
+	VerifySegmentsOnOpen SegmentVerification = iota // When the DB is opened
+	VerifySegmentsNever
+	VerifySegmentsAlways // When the DB is opened and also after each segment is written
+)
+
 // Initialize fills in the derived fields of s.
 func (s *Schema) Initialize() {
 	s.RunConfig.fillDefaults()
@@ -114,6 +201,33 @@ func (s *Schema) Initialize() {
 	for _, col := range s.MetricColumns {
 		s.RowSize += col.Width
 	}
+
+	s.TTLDimensionIndex = -1
+	if i, ok := s.DimensionNameToIndex[s.TTLColumn]; ok && !s.DimensionColumns[i].String {
+		s.TTLDimensionIndex = i
+	}
+
+	s.BloomFilterIndexes = nil
+	for _, name := range s.BloomFilterColumns {
+		if i, ok := s.DimensionNameToIndex[name]; ok && s.DimensionColumns[i].String {
+			s.BloomFilterIndexes = append(s.BloomFilterIndexes, i)
+		}
+	}
+}
+
+// rowExpiry returns the time at which a row with the given dimensions in the interval ending at end expires
+// because of its TTL. ok is false if the row has no TTL.
+func (s *Schema) rowExpiry(dimensions DimensionBytes, end time.Time) (expiry time.Time, ok bool) {
+	i := s.TTLDimensionIndex
+	if i < 0 || dimensions.IsNil(i) {
+		return time.Time{}, false
+	}
+	cell := unsafe.Pointer(&dimensions[s.DimensionOffsets[i]])
+	days := UntypedToFloat64(NumericCellValue(cell, s.DimensionColumns[i].Type))
+	if days <= 0 {
+		return time.Time{}, false
+	}
+	return end.Add(time.Duration(days * float64(24*time.Hour))), true
 }
 
 // fillDefaults sets fields of c to reasonable default values if they are currently set to the zero value for
@@ -162,3 +276,55 @@ func (s *Schema) Equivalent(other *Schema) (err error) {
 	}
 	return nil
 }
+
+// Differences describes the ways in which other differs from s that matter for combining their query results:
+// the timestamp column, the names and types of the dimension and metric columns (but not their order), and the
+// interval duration. It returns nil if there are none.
+func (s *Schema) Differences(other *Schema) []string {
+	var diffs []string
+	ts, otherTS := s.TimestampColumn, other.TimestampColumn
+	if ts.Name != otherTS.Name || ts.Type != otherTS.Type {
+		diffs = append(diffs, fmt.Sprintf("timestamp column is %s (%s); expected %s (%s)", otherTS.Name,
+			otherTS.Type, ts.Name, ts.Type))
+	}
+	describe := func(schema *Schema) map[string]string {
+		columns := make(map[string]string)
+		for _, col := range schema.DimensionColumns {
+			kind := "dimension"
+			if col.String {
+				kind = "string dimension"
+			}
+			columns[col.Name] = fmt.Sprintf("%s %s", col.Type, kind)
+		}
+		for _, col := range schema.MetricColumns {
+			columns[col.Name] = fmt.Sprintf("%s metric", col.Type)
+		}
+		return columns
+	}
+	expected, got := describe(s), describe(other)
+	var names []string
+	for name := range expected {
+		names = append(names, name)
+	}
+	for name := range got {
+		if _, ok := expected[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		switch e, g := expected[name], got[name]; {
+		case g == "":
+			diffs = append(diffs, fmt.Sprintf("column %s is missing; expected %s", name, e))
+		case e == "":
+			diffs = append(diffs, fmt.Sprintf("unexpected column %s (%s)", name, g))
+		case e != g:
+			diffs = append(diffs, fmt.Sprintf("column %s is %s; expected %s", name, g, e))
+		}
+	}
+	if s.IntervalDuration != other.IntervalDuration {
+		diffs = append(diffs, fmt.Sprintf("interval duration is %s; expected %s", other.IntervalDuration,
+			s.IntervalDuration))
+	}
+	return diffs
+}
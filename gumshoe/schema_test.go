@@ -0,0 +1,195 @@
+package gumshoe
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// withAppendedColumns returns a copy of schema with columns appended. It has more than 8 dimension columns,
+// so its rows have an extra nil byte.
+func withAppendedColumns(schema *Schema) *Schema {
+	appended := *schema
+	appended.DimensionColumns = append([]DimensionColumn(nil), schema.DimensionColumns...)
+	for _, name := range []string{"dim2", "dim3", "dim4", "dim5", "dim6", "dim7", "dim8"} {
+		appended.DimensionColumns = append(appended.DimensionColumns, makeDimensionColumn(name, "uint8", false))
+	}
+	appended.DimensionColumns = append(appended.DimensionColumns, makeDimensionColumn("dim9", "uint16", true))
+	appended.MetricColumns = append(append([]MetricColumn(nil), schema.MetricColumns...),
+		makeMetricColumn("metric2", "int16"))
+	appended.Initialize()
+	return &appended
+}
+
+func TestOpeningDBWithAppendedColumns(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		db := makeTestPersistentDB()
+		db.CompressSegments = compress
+		insertRows(db, []RowMap{
+			{"at": 0.0, "dim1": "a", "metric1": 1.0},
+			{"at": hour(1), "dim1": "b", "metric1": 2.0},
+		})
+		closeTestDB(db)
+
+		db, err := OpenDB(withAppendedColumns(db.Schema))
+		Assert(t, err, IsNil)
+		Assert(t, db.GetDebugRows(), util.DeepConvertibleEquals, []UnpackedRow{
+			{RowMap{"at": 0, "dim1": "a", "dim2": nil, "dim3": nil, "dim4": nil, "dim5": nil, "dim6": nil,
+				"dim7": nil, "dim8": nil, "dim9": nil, "metric1": 1, "metric2": 0}, 1},
+			{RowMap{"at": hour(1), "dim1": "b", "dim2": nil, "dim3": nil, "dim4": nil, "dim5": nil, "dim6": nil,
+				"dim7": nil, "dim8": nil, "dim9": nil, "metric1": 2, "metric2": 0}, 1},
+		})
+
+		// Rewriting an interval gives it the new layout; the other interval keeps the old one.
+		insertRows(db, []RowMap{{"at": 0.0, "dim1": "a", "dim9": "x", "metric1": 1.0, "metric2": -3.0}})
+		db = reopenTestDB(db)
+		resp := db.MakeRequest()
+		for _, interval := range resp.StaticTable.Intervals {
+			if interval.Start.Unix() == 0 {
+				Assert(t, interval.Layout, Equals, 0)
+			} else {
+				// The old interval's segment is kept mapped as it's stored, and its rows converted when read.
+				Assert(t, interval.Layout, Equals, 1)
+				segment := interval.Segments[0]
+				Assert(t, segment.layout, NotNil)
+				b, err := ioutil.ReadFile(interval.SegmentFilename(db.Schema, 0))
+				Assert(t, err, IsNil)
+				Assert(t, []byte(segment.Bytes), DeepEquals, b)
+			}
+		}
+		resp.Done()
+		Assert(t, len(db.Layouts), Equals, 1)
+		Assert(t, len(db.Layouts[0].DimensionColumns), Equals, 1)
+
+		query := createQuery()
+		query.Aggregates = append(query.Aggregates, QueryAggregate{AggregateSum, "metric2", "metric2"})
+		query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim9", "dim9"}}
+		query.OrderBy = []QueryOrder{{"dim9", OrderAscending}}
+		Assert(t, runQuery(db, query), util.DeepConvertibleEquals, []RowMap{
+			{"dim9": nil, "metric1": 3, "metric2": 0, "rowCount": 2},
+			{"dim9": "x", "metric1": 1, "metric2": -3, "rowCount": 1},
+		})
+		closeTestDB(db)
+	}
+}
+
+func TestOpeningDBWithRemovedColumnsFails(t *testing.T) {
+	db := makeTestPersistentDB()
+	schema := withAppendedColumns(db.Schema)
+	closeTestDB(db)
+	schema.MetricColumns = nil
+	schema.Initialize()
+	_, err := OpenDB(schema)
+	Assert(t, err, NotNil)
+}
+
+func TestDroppingColumns(t *testing.T) {
+	db := makeTestPersistentDB()
+	schema := *db.Schema
+	schema.DimensionColumns = []DimensionColumn{
+		makeDimensionColumn("dim1", "uint8", true),
+		makeDimensionColumn("dim2", "uint8", true),
+		makeDimensionColumn("dim3", "int16", false),
+	}
+	schema.MetricColumns = []MetricColumn{
+		makeMetricColumn("metric1", "uint32"),
+		makeMetricColumn("metric2", "uint8"),
+	}
+	closeTestDB(db)
+	Assert(t, os.RemoveAll(schema.Dir), IsNil)
+	db, err := NewDB(&schema)
+	Assert(t, err, IsNil)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "a", "dim2": "x", "dim3": 1.0, "metric1": 1.0, "metric2": 2.0},
+		{"at": hour(1), "dim1": "b", "dim2": "y", "dim3": 2.0, "metric1": 3.0, "metric2": 4.0},
+	})
+	closeTestDB(db)
+
+	dropped := schema
+	dropped.DimensionColumns = schema.DimensionColumns[1:]
+	dropped.MetricColumns = schema.MetricColumns[1:]
+	dropped.DroppedColumns = []string{"dim1", "metric1"}
+	dropped.Initialize()
+	db, err = OpenDB(&dropped)
+	Assert(t, err, IsNil)
+	defer func() { closeTestDB(db) }()
+	Assert(t, db.GetDebugRows(), util.DeepConvertibleEquals, []UnpackedRow{
+		{RowMap{"at": 0, "dim2": "x", "dim3": 1, "metric2": 2}, 1},
+		{RowMap{"at": hour(1), "dim2": "y", "dim3": 2, "metric2": 4}, 1},
+	})
+	// Dimension tables are stored by column index, so dim2's table is moved, and dim1's is removed.
+	dimensionFiles, err := filepath.Glob(filepath.Join(dropped.Dir, "dimension.*"))
+	Assert(t, err, IsNil)
+	Assert(t, len(dimensionFiles), Equals, 1)
+	Assert(t, filepath.Base(dimensionFiles[0]), Equals, "dimension.index0.generation2.gob.gz")
+
+	// Values of dropped columns are ignored.
+	insertRows(db, []RowMap{{"at": 0.0, "dim1": "c", "dim2": "x", "dim3": 1.0, "metric1": 5.0, "metric2": 1.0}})
+	query := createQuery()
+	_, err = db.GetQueryResult(context.Background(), query)
+	Assert(t, err, NotNil)
+	query.Aggregates = []QueryAggregate{{AggregateSum, "metric2", "metric2"}}
+	query.Filters = []QueryFilter{{FilterEqual, "dim3", 1.0}}
+	Assert(t, runQuery(db, query)[0]["metric2"], util.DeepConvertibleEquals, 3)
+
+	// The interval which was rewritten has the new layout; the old layout is still used by the other one,
+	// whose segment is kept mapped with the dropped columns' bytes rather than converted when it's loaded.
+	db = reopenTestDB(db)
+	Assert(t, len(db.Layouts), Equals, 1)
+	resp := db.MakeRequest()
+	for _, interval := range resp.StaticTable.Intervals {
+		if interval.Layout == 0 {
+			continue
+		}
+		segment := interval.Segments[0]
+		Assert(t, segment.layout, NotNil)
+		Assert(t, len(segment.Bytes), Equals, segment.layout.RowSize)
+		Assert(t, len(db.SegmentRows(segment, nil)), Equals, db.RowSize)
+	}
+	resp.Done()
+	Assert(t, db.GetDebugRows(), util.DeepConvertibleEquals, []UnpackedRow{
+		{RowMap{"at": 0, "dim2": "x", "dim3": 1, "metric2": 3}, 2},
+		{RowMap{"at": hour(1), "dim2": "y", "dim3": 2, "metric2": 4}, 1},
+	})
+
+	// Once no interval uses the old layout, it's removed.
+	insertRows(db, []RowMap{{"at": hour(1), "dim2": "y", "dim3": 2.0, "metric2": 1.0}})
+	db = reopenTestDB(db)
+	Assert(t, len(db.Layouts), Equals, 0)
+}
+
+func TestDroppedColumnsMustBeListed(t *testing.T) {
+	db := makeTestPersistentDB()
+	schema := *db.Schema
+	closeTestDB(db)
+	schema.DimensionColumns = nil
+	schema.Initialize()
+	_, err := OpenDB(&schema)
+	Assert(t, err, NotNil)
+}
+
+func TestSchemaDifferences(t *testing.T) {
+	schema := schemaFixture()
+	Assert(t, schema.Differences(schemaFixture()), IsNil)
+
+	other := schemaFixture()
+	other.DimensionColumns = []DimensionColumn{makeDimensionColumn("dim1", "uint32", false)}
+	other.MetricColumns = []MetricColumn{
+		makeMetricColumn("metric1", "float64"),
+		makeMetricColumn("metric2", "int8"),
+	}
+	other.IntervalDuration = 24 * time.Hour
+	Assert(t, schema.Differences(other), DeepEquals, []string{
+		"column dim1 is uint32 dimension; expected uint32 string dimension",
+		"column metric1 is float64 metric; expected uint32 metric",
+		"unexpected column metric2 (int8 metric)",
+		"interval duration is 24h0m0s; expected 1h0m0s",
+	})
+}
@@ -0,0 +1,264 @@
+// The compressed format of segment files (see RunConfig.CompressSegments).
+//
+// A compressed segment stores its rows column by column. Each fixed-width field of the row layout (the count,
+// the nil bytes, and each dimension and metric) is encoded separately, using whichever of these encodings is
+// smallest for its values:
+//
+//   - raw: the values, one after another
+//   - run-length: (value, run length) pairs, which suits the leading dimensions (rows are sorted by their
+//     dimensions) and counts (which are mostly 1)
+//   - dictionary: up to 256 distinct values followed by a one-byte index for each row, which suits other
+//     low-cardinality dimensions
+//
+// Rows don't store timestamps (all the rows of an interval share its start time), so there is no timestamp
+// column to encode.
+//
+// The file is segmentMagic, the number of rows as a uvarint, and then for each field an encoding byte
+// followed by the encoded values. Lengths and run lengths are uvarints.
+
+package gumshoe
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+const segmentMagic = "GSEG\x01"
+
+const (
+	segmentEncodingRaw byte = iota
+	segmentEncodingRunLength
+	segmentEncodingDictionary
+)
+
+var errCorruptSegment = errors.New("corrupt compressed segment")
+
+// segmentField is a fixed-width field of the row layout.
+type segmentField struct {
+	offset, width int
+}
+
+// segmentFields returns the fields of the row layout, in order.
+func (s *Schema) segmentFields() []segmentField {
+	fields := []segmentField{{0, countColumnWidth}, {s.DimensionStartOffset, s.NilBytes}}
+	for i, col := range s.DimensionColumns {
+		fields = append(fields, segmentField{s.DimensionStartOffset + s.DimensionOffsets[i], col.Width})
+	}
+	for i, col := range s.MetricColumns {
+		fields = append(fields, segmentField{s.MetricStartOffset + s.MetricOffsets[i], col.Width})
+	}
+	return fields
+}
+
+// encodeSegment encodes the rows of an uncompressed segment.
+func (s *Schema) encodeSegment(rows []byte) []byte {
+	numRows := len(rows) / s.RowSize
+	buf := append([]byte(segmentMagic), binary.AppendUvarint(nil, uint64(numRows))...)
+	for _, field := range s.segmentFields() {
+		values := make([][]byte, numRows)
+		for i := range values {
+			start := i*s.RowSize + field.offset
+			values[i] = rows[start : start+field.width]
+		}
+		best := appendRawField(nil, values)
+		if encoded := appendRunLengthField(nil, values); len(encoded) < len(best) {
+			best = encoded
+		}
+		if encoded, ok := appendDictionaryField(nil, values); ok && len(encoded) < len(best) {
+			best = encoded
+		}
+		buf = append(buf, best...)
+	}
+	return buf
+}
+
+func appendRawField(b []byte, values [][]byte) []byte {
+	b = append(b, segmentEncodingRaw)
+	for _, v := range values {
+		b = append(b, v...)
+	}
+	return b
+}
+
+func appendRunLengthField(b []byte, values [][]byte) []byte {
+	var runs []byte
+	numRuns := 0
+	for i := 0; i < len(values); {
+		j := i + 1
+		for j < len(values) && bytes.Equal(values[j], values[i]) {
+			j++
+		}
+		runs = append(runs, values[i]...)
+		runs = binary.AppendUvarint(runs, uint64(j-i))
+		numRuns++
+		i = j
+	}
+	b = append(b, segmentEncodingRunLength)
+	b = binary.AppendUvarint(b, uint64(numRuns))
+	return append(b, runs...)
+}
+
+// appendDictionaryField encodes values using a dictionary. ok is false if there are too many distinct values.
+func appendDictionaryField(b []byte, values [][]byte) (encoded []byte, ok bool) {
+	indexes := make(map[string]byte)
+	var dictionary [][]byte
+	rowIndexes := make([]byte, len(values))
+	for i, v := range values {
+		index, ok := indexes[string(v)]
+		if !ok {
+			if len(dictionary) == 256 {
+				return nil, false
+			}
+			index = byte(len(dictionary))
+			indexes[string(v)] = index
+			dictionary = append(dictionary, v)
+		}
+		rowIndexes[i] = index
+	}
+	b = append(b, segmentEncodingDictionary)
+	b = binary.AppendUvarint(b, uint64(len(dictionary)))
+	for _, v := range dictionary {
+		b = append(b, v...)
+	}
+	return append(b, rowIndexes...), true
+}
+
+// segmentDecoder reads an encoded segment.
+type segmentDecoder struct {
+	b []byte
+}
+
+func (d *segmentDecoder) uvarint() (int, error) {
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 || v > math.MaxInt32 {
+		return 0, errCorruptSegment
+	}
+	d.b = d.b[n:]
+	return int(v), nil
+}
+
+func (d *segmentDecoder) next(n int) ([]byte, error) {
+	if n < 0 || n > len(d.b) {
+		return nil, errCorruptSegment
+	}
+	b := d.b[:n]
+	d.b = d.b[n:]
+	return b, nil
+}
+
+// readSegmentHeader checks the header of an encoded segment and returns its number of rows and a decoder for
+// the fields which follow.
+func (s *Schema) readSegmentHeader(encoded []byte) (numRows int, d *segmentDecoder, err error) {
+	if !bytes.HasPrefix(encoded, []byte(segmentMagic)) {
+		return 0, nil, fmt.Errorf("compressed segment has a bad header")
+	}
+	d = &segmentDecoder{encoded[len(segmentMagic):]}
+	if numRows, err = d.uvarint(); err != nil {
+		return 0, nil, err
+	}
+	if numRows > math.MaxInt32/s.RowSize {
+		return 0, nil, errCorruptSegment
+	}
+	return numRows, d, nil
+}
+
+// decodeSegment decodes a segment written by encodeSegment into its uncompressed rows. The rows are decoded
+// into dst if it has the capacity for them, and into a new slice otherwise.
+func (s *Schema) decodeSegment(dst, encoded []byte) ([]byte, error) {
+	numRows, d, err := s.readSegmentHeader(encoded)
+	if err != nil {
+		return nil, err
+	}
+	size := numRows * s.RowSize
+	var rows []byte
+	if cap(dst) >= size {
+		rows = dst[:size]
+		// Clear whatever was decoded into dst before.
+		for i := range rows {
+			rows[i] = 0
+		}
+	} else {
+		rows = make([]byte, size)
+	}
+	for _, field := range s.segmentFields() {
+		if err := d.decodeField(rows, field, numRows, s.RowSize); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.b) > 0 {
+		return nil, errCorruptSegment
+	}
+	return rows, nil
+}
+
+// decodeField decodes the values of field into rows.
+func (d *segmentDecoder) decodeField(rows []byte, field segmentField, numRows, rowSize int) error {
+	encoding, err := d.next(1)
+	if err != nil {
+		return err
+	}
+	set := func(row int, value []byte) { copy(rows[row*rowSize+field.offset:], value) }
+	switch encoding[0] {
+	case segmentEncodingRaw:
+		for row := 0; row < numRows; row++ {
+			value, err := d.next(field.width)
+			if err != nil {
+				return err
+			}
+			set(row, value)
+		}
+	case segmentEncodingRunLength:
+		numRuns, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		row := 0
+		for i := 0; i < numRuns; i++ {
+			value, err := d.next(field.width)
+			if err != nil {
+				return err
+			}
+			length, err := d.uvarint()
+			if err != nil {
+				return err
+			}
+			if row+length > numRows {
+				return errCorruptSegment
+			}
+			for end := row + length; row < end; row++ {
+				set(row, value)
+			}
+		}
+		if row != numRows {
+			return errCorruptSegment
+		}
+	case segmentEncodingDictionary:
+		size, err := d.uvarint()
+		if err != nil {
+			return err
+		}
+		if size > 256 {
+			return errCorruptSegment
+		}
+		dictionary, err := d.next(size * field.width)
+		if err != nil {
+			return err
+		}
+		indexes, err := d.next(numRows)
+		if err != nil {
+			return err
+		}
+		for row, index := range indexes {
+			if int(index) >= size {
+				return errCorruptSegment
+			}
+			set(row, dictionary[int(index)*field.width:(int(index)+1)*field.width])
+		}
+	default:
+		return fmt.Errorf("compressed segment has unknown encoding %d", encoding[0])
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package gumshoe
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestSegmentEncodingRoundTrip(t *testing.T) {
+	db := makeTestDB()
+	defer closeTestDB(db)
+
+	// The counts and nil bytes are all the same (so they're run-length encoded), metric1 has few values (so
+	// it's dictionary encoded), and dim1 has many (so it's stored raw).
+	var rows []RowMap
+	for i := 0; i < 1000; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim1": fmt.Sprint("string", i), "metric1": float64(i % 3)})
+	}
+	if err := db.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, db.Flush(), IsNil)
+
+	resp := db.MakeRequest()
+	defer resp.Done()
+	for _, interval := range resp.StaticTable.Intervals {
+		for _, segment := range interval.Segments {
+			encoded := db.encodeSegment(segment.Bytes)
+			Assert(t, len(encoded) < len(segment.Bytes), IsTrue)
+			decoded, err := db.decodeSegment(nil, encoded)
+			Assert(t, err, IsNil)
+			Assert(t, decoded, DeepEquals, []byte(segment.Bytes))
+			// A buffer which is reused is overwritten entirely.
+			dirty := make([]byte, len(segment.Bytes)+10)
+			for i := range dirty {
+				dirty[i] = 0xff
+			}
+			decoded, err = db.decodeSegment(dirty, encoded)
+			Assert(t, err, IsNil)
+			Assert(t, decoded, DeepEquals, []byte(segment.Bytes))
+
+			_, err = db.decodeSegment(nil, encoded[:len(encoded)-1])
+			Assert(t, err, NotNil)
+		}
+	}
+}
+
+func TestCompressedSegmentsArePersisted(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	db.CompressSegments = true
+
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": 0.0, "dim1": "string2", "metric1": 2.0},
+	})
+	insertRows(db, []RowMap{{"at": 0.0, "dim1": "string1", "metric1": 3.0}})
+	db = reopenTestDB(db)
+	defer func() { closeTestDB(db) }()
+
+	resp := db.MakeRequest()
+	Assert(t, len(resp.StaticTable.Intervals), Equals, 1)
+	var interval *Interval
+	for _, interval = range resp.StaticTable.Intervals {
+	}
+	Assert(t, interval.Compressed, IsTrue)
+	b, err := ioutil.ReadFile(interval.SegmentFilename(db.Schema, 0))
+	Assert(t, err, IsNil)
+	Assert(t, strings.HasPrefix(string(b), segmentMagic), IsTrue)
+	// The segment is kept as it's stored, and only decoded when it's scanned.
+	Assert(t, []byte(interval.Segments[0].Bytes), DeepEquals, b)
+	Assert(t, db.segmentNumRows(interval.Segments[0]), Equals, 2)
+	resp.Done()
+
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	Assert(t, runQuery(db, query), util.DeepEqualsUnordered, []RowMap{
+		{"dim1": "string1", "metric1": 4, "rowCount": 2},
+		{"dim1": "string2", "metric1": 2, "rowCount": 1},
+	})
+
+	// Turning off compression decompresses the interval when it's next rewritten.
+	db.CompressSegments = false
+	insertRows(db, []RowMap{{"at": 0.0, "dim1": "string2", "metric1": 1.0}})
+	resp = db.MakeRequest()
+	for _, interval := range resp.StaticTable.Intervals {
+		Assert(t, interval.Compressed, IsFalse)
+	}
+	resp.Done()
+	db = reopenTestDB(db)
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 7)
+}
@@ -0,0 +1,60 @@
+// Controlling how the memory-mapped segment files are paged in (see RunConfig.SegmentAdvice and
+// RunConfig.MlockWindow).
+
+package gumshoe
+
+import "time"
+
+// SegmentAdvice is the paging advice (madvise) given to the kernel for memory-mapped segment files.
+type SegmentAdvice int
+
+const (
+	AdviseNormal SegmentAdvice = iota
+	// AdviseRandom (MADV_RANDOM) turns off readahead, which avoids reading in unneeded pages when a DB is much
+	// larger than memory.
+	AdviseRandom
+	// AdviseWillNeed (MADV_WILLNEED) reads in segments in the background as soon as they are mapped, so that
+	// queries are fast soon after a DB is opened.
+	AdviseWillNeed
+)
+
+// adviseSegment gives the configured advice for a memory-mapped segment. Errors are only logged, since the
+// advice is just a hint.
+func (s *Schema) adviseSegment(segment *Segment) {
+	if segment.File == nil {
+		return
+	}
+	if err := madvise(segment.Bytes, s.SegmentAdvice); err != nil {
+		Log.Println("error advising segment:", err)
+	}
+}
+
+// updateSegmentLocks locks the memory-mapped segments of the intervals which ended within MlockWindow of now
+// into memory, and unlocks the segments of older intervals. If locking fails (typically because of
+// RLIMIT_MEMLOCK), the error is logged and the remaining segments are left alone until the next update. It
+// should only be called by the inserter goroutine, or before it starts.
+func (s *StaticTable) updateSegmentLocks(now time.Time) {
+	if s.MlockWindow <= 0 {
+		return
+	}
+	cutoff := now.Add(-s.MlockWindow)
+	for _, interval := range s.Intervals {
+		lock := interval.End.After(cutoff)
+		for _, segment := range interval.Segments {
+			if segment.File == nil || segment.locked == lock {
+				continue
+			}
+			var err error
+			if lock {
+				err = segment.Bytes.Lock()
+			} else {
+				err = segment.Bytes.Unlock()
+			}
+			if err != nil {
+				Log.Println("error locking segments into memory:", err)
+				return
+			}
+			segment.locked = lock
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestRecentSegmentsAreLocked(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	db.SegmentAdvice = AdviseWillNeed
+	db.MlockWindow = 3 * time.Hour
+	defer func() { closeTestDB(db) }()
+
+	now := time.Now()
+	insertRows(db, []RowMap{
+		{"at": float64(now.Unix()), "dim1": "string1", "metric1": 1.0},
+		{"at": float64(now.Add(-24 * time.Hour).Unix()), "dim1": "string1", "metric1": 1.0},
+	})
+	db = reopenTestDB(db)
+
+	resp := db.MakeRequest()
+	defer resp.Done()
+	Assert(t, len(resp.StaticTable.Intervals), Equals, 2)
+	for _, interval := range resp.StaticTable.Intervals {
+		recent := interval.End.After(now.Add(-time.Hour))
+		for _, segment := range interval.Segments {
+			Assert(t, segment.locked, Equals, recent)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+// Assigning rows to the partitions of a sharded cluster, as the router does.
+
+package gumshoe
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"time"
+)
+
+// HashPartition returns the partition, of n, to which row is assigned under hash-based sharding: a CRC-32 of
+// the JSON encodings of its timestamp and dimension values (in schema order), modulo n.
+func (s *Schema) HashPartition(row RowMap, n int) int {
+	crc := crc32.NewIEEE()
+	encoder := json.NewEncoder(crc)
+	if err := encoder.Encode(hashValue(row[s.TimestampColumn.Name])); err != nil {
+		panic(err)
+	}
+	for _, col := range s.DimensionColumns {
+		if err := encoder.Encode(hashValue(row[col.Name])); err != nil {
+			panic(err)
+		}
+	}
+	return int(crc.Sum32()) % n
+}
+
+// hashValue converts a json.Number to a float64 (as numbers were decoded before inserts used json.Numbers) so
+// that rows are still assigned to the same partitions.
+func hashValue(v interface{}) interface{} {
+	if n, ok := v.(json.Number); ok {
+		if f, err := n.Float64(); err == nil {
+			return f
+		}
+	}
+	return v
+}
+
+// IntervalPartition returns the partition, of n, holding the interval starting at start under time-based
+// sharding. The intervals are dealt out to the partitions in turn.
+func (s *Schema) IntervalPartition(start time.Time, n int) int {
+	return int(start.Unix()/int64(s.IntervalDuration/time.Second)) % n
+}
+
+// TimePartition returns the partition, of n, of row under time-based sharding. If the row's timestamp isn't
+// a number, it returns false (and the row may go anywhere: the shard will reject it).
+func (s *Schema) TimePartition(row RowMap, n int) (int, bool) {
+	timestamp, ok := hashValue(row[s.TimestampColumn.Name]).(float64)
+	if !ok || timestamp < 0 {
+		return 0, false
+	}
+	return s.IntervalPartition(time.Unix(int64(timestamp), 0).Truncate(s.IntervalDuration), n), true
+}
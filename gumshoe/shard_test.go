@@ -0,0 +1,36 @@
+package gumshoe
+
+import (
+	"encoding/json"
+	"hash/crc32"
+	"testing"
+	"time"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestHashPartition(t *testing.T) {
+	schema := schemaFixture()
+	schema.Initialize()
+	row := RowMap{"at": 3600.0, "dim1": "a", "metric1": 5.0}
+	// The metrics aren't hashed.
+	expected := int(crc32.ChecksumIEEE([]byte("3600\n\"a\"\n"))) % 7
+	Assert(t, schema.HashPartition(row, 7), Equals, expected)
+	Assert(t, schema.HashPartition(RowMap{"at": json.Number("3600"), "dim1": "a"}, 7), Equals, expected)
+	Assert(t, schema.HashPartition(RowMap{"at": 3600.0, "dim1": nil}, 7), Equals,
+		int(crc32.ChecksumIEEE([]byte("3600\nnull\n")))%7)
+}
+
+func TestTimePartition(t *testing.T) {
+	schema := schemaFixture()
+	schema.Initialize()
+	Assert(t, schema.IntervalPartition(time.Unix(5*3600, 0), 3), Equals, 2)
+	p, ok := schema.TimePartition(RowMap{"at": json.Number("18000"), "dim1": "a"}, 3)
+	Assert(t, ok, IsTrue)
+	Assert(t, p, Equals, 2)
+	p, ok = schema.TimePartition(RowMap{"at": 4*3600 + 59.0}, 3)
+	Assert(t, ok, IsTrue)
+	Assert(t, p, Equals, 1)
+	_, ok = schema.TimePartition(RowMap{"at": "yesterday"}, 3)
+	Assert(t, ok, IsFalse)
+}
@@ -0,0 +1,80 @@
+// Decoding the Snappy block format, which is how most Parquet files are compressed.
+
+package gumshoe
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+var errBadSnappy = errors.New("malformed Snappy data")
+
+// snappyDecode decompresses a Snappy block: the uvarint length of the decompressed data followed by a
+// sequence of literals and copies of earlier output.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, i := binary.Uvarint(src)
+	if i <= 0 || n > uint64(len(src))*32 { // No element expands its bytes more than 32-fold
+		return nil, errBadSnappy
+	}
+	dst := make([]byte, 0, n)
+	for i < len(src) {
+		tag := src[i]
+		i++
+		var length, offset int
+		switch tag & 3 {
+		case 0: // Literal
+			length = int(tag >> 2)
+			if length >= 60 {
+				extra := length - 59
+				if i+extra > len(src) {
+					return nil, errBadSnappy
+				}
+				length = 0
+				for j := extra - 1; j >= 0; j-- {
+					length = length<<8 | int(src[i+j])
+				}
+				i += extra
+			}
+			length++
+			if length <= 0 || i+length > len(src) {
+				return nil, errBadSnappy
+			}
+			dst = append(dst, src[i:i+length]...)
+			i += length
+			continue
+		case 1: // Copy with a 1-byte offset
+			if i >= len(src) {
+				return nil, errBadSnappy
+			}
+			length = 4 + int(tag>>2&7)
+			offset = int(tag&0xe0)<<3 | int(src[i])
+			i++
+		case 2: // Copy with a 2-byte offset
+			if i+2 > len(src) {
+				return nil, errBadSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[i:]))
+			i += 2
+		case 3: // Copy with a 4-byte offset
+			if i+4 > len(src) {
+				return nil, errBadSnappy
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[i:]))
+			i += 4
+		}
+		if offset <= 0 || offset > len(dst) || uint64(len(dst)+length) > n {
+			return nil, errBadSnappy
+		}
+		// The copy may overlap the bytes it appends, so it goes a byte at a time.
+		for start := len(dst) - offset; length > 0; length-- {
+			dst = append(dst, dst[start])
+			start++
+		}
+	}
+	if uint64(len(dst)) != n {
+		return nil, errBadSnappy
+	}
+	return dst, nil
+}
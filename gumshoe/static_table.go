@@ -3,12 +3,9 @@ package gumshoe
 import (
 	"encoding/json"
 	"fmt"
-	"os"
 	"sort"
 	"sync"
 	"time"
-
-	mmap "github.com/philc/gumshoedb/internal/github.com/edsrzf/mmap-go"
 )
 
 // StaticTable is an immutable snapshot of the DB's data.
@@ -17,7 +14,9 @@ type StaticTable struct {
 	Intervals       IntervalMap
 	DimensionTables []*DimensionTable // Same length as the number of dimensions; non-string columns are nil.
 	scanRequests    chan *scanRequest // Handle to DB's worker pool.
-	wg              *sync.WaitGroup   // For outstanding requests, to know when we can GC this StaticTable.
+	numWorkers      *int32            // Handle to the size of DB's worker pool (read atomically).
+	coldCache       *coldCache        // Handle to DB's cache of cold intervals (nil if there's no cold store).
+	users           *intervalUsers    // Handle to DB's counts of the requests using each interval.
 }
 
 // IntervalMap is a type that implements JSON conversions for map[time.Time]*Interval. (This doesn't work
@@ -77,14 +76,12 @@ func NewStaticTable(schema *Schema) *StaticTable {
 		Schema:          schema,
 		Intervals:       make(map[time.Time]*Interval),
 		DimensionTables: NewDimensionTablesForSchema(schema),
-		wg:              new(sync.WaitGroup),
 	}
 	return staticTable
 }
 
 func (s *StaticTable) initialize(schema *Schema) error {
 	s.Schema = schema
-	s.wg = new(sync.WaitGroup)
 
 	// Load dimension tables
 	for i, col := range schema.DimensionColumns {
@@ -98,32 +95,104 @@ func (s *StaticTable) initialize(schema *Schema) error {
 
 	// Load each interval/segment
 	for _, interval := range s.Intervals {
-		interval.Segments = make([]*Segment, interval.NumSegments)
-		for i := 0; i < interval.NumSegments; i++ {
-
-			f, err := os.Open(interval.SegmentFilename(schema, i))
-			if err != nil {
+		if interval.BloomFilters {
+			// The bloom filters of cold intervals are kept locally.
+			if err := interval.loadBloomFilters(schema); err != nil {
 				return err
 			}
-			mapped, err := mmap.Map(f, mmap.RDONLY, 0)
+		}
+		if interval.Cold {
+			// Cold segments are fetched when they're needed.
+			if schema.ColdStore == nil {
+				return errNoColdStore
+			}
+			continue
+		}
+		interval.Segments = make([]*Segment, interval.NumSegments)
+		numRows := 0
+		for i := 0; i < interval.NumSegments; i++ {
+			segment, err := schema.loadSegment(interval, i, schema.SegmentVerification != VerifySegmentsNever)
 			if err != nil {
 				return err
 			}
-			interval.Segments[i] = &Segment{File: f, Bytes: mapped}
+			interval.Segments[i] = segment
+			numRows += schema.segmentNumRows(segment)
+		}
+		// This catches truncated segment files even if they have no checksums.
+		if numRows != interval.NumRows {
+			filename := interval.SegmentFilename(schema, interval.NumSegments-1)
+			problem := fmt.Sprintf("the interval has %d rows (expected %d)", numRows, interval.NumRows)
+			return &CorruptSegmentError{filename, problem}
 		}
 	}
 
 	return nil
 }
 
+// handleRequest hands s to req, which uses all of its intervals until it's done. This must be called by the
+// request goroutine, so that no request starts using an interval after it's retired.
 func (s *StaticTable) handleRequest(req *Request) {
-	s.wg.Add(1)
-	go func() {
-		done := make(chan struct{})
-		req.Resp <- &Response{StaticTable: s, done: done}
-		<-done
-		s.wg.Done()
-	}()
+	s.users.acquire(s.Intervals)
+	go func() { req.Resp <- &Response{StaticTable: s} }()
+}
+
+// intervalUsers counts the requests using each interval. When a new StaticTable replaces an interval (with a
+// new generation, or by dropping it), the requests using the old one carry on with it, and its files are only
+// cleaned up once they're all done. Requests don't hold up the swaps of the intervals they aren't using.
+type intervalUsers struct {
+	mu      sync.Mutex
+	counts  map[*Interval]int
+	retired map[*Interval]func() // The cleanup of each retired interval which is still in use
+}
+
+func newIntervalUsers() *intervalUsers {
+	return &intervalUsers{
+		counts:  make(map[*Interval]int),
+		retired: make(map[*Interval]func()),
+	}
+}
+
+func (u *intervalUsers) acquire(intervals IntervalMap) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	for _, interval := range intervals {
+		u.counts[interval]++
+	}
+}
+
+// release finishes a request's use of intervals, running the cleanups of the retired intervals which are no
+// longer in use.
+func (u *intervalUsers) release(intervals IntervalMap) {
+	var cleanups []func()
+	u.mu.Lock()
+	for _, interval := range intervals {
+		u.counts[interval]--
+		if u.counts[interval] > 0 {
+			continue
+		}
+		delete(u.counts, interval)
+		if cleanup, ok := u.retired[interval]; ok {
+			cleanups = append(cleanups, cleanup)
+			delete(u.retired, interval)
+		}
+	}
+	u.mu.Unlock()
+	for _, cleanup := range cleanups {
+		cleanup()
+	}
+}
+
+// retire calls cleanup once no request is using interval, which is no longer in the current StaticTable:
+// right away if none is, or else when the last one is done.
+func (u *intervalUsers) retire(interval *Interval, cleanup func()) {
+	u.mu.Lock()
+	if u.counts[interval] > 0 {
+		u.retired[interval] = cleanup
+		u.mu.Unlock()
+		return
+	}
+	u.mu.Unlock()
+	cleanup()
 }
 
 func (s *StaticTable) debugPrint() {
@@ -132,12 +201,13 @@ func (s *StaticTable) debugPrint() {
 		fmt.Printf("Interval [start = %s]\n\n", interval.Start)
 		for i, segment := range interval.Segments {
 			fmt.Printf("  Segment %d\n", i)
-			for j := 0; j < len(segment.Bytes); j += s.RowSize {
-				fmt.Printf("  % x", segment.Bytes[j:j+countColumnWidth])
+			rows := s.SegmentRows(segment, nil)
+			for j := 0; j < len(rows); j += s.RowSize {
+				fmt.Printf("  % x", rows[j:j+countColumnWidth])
 				dimColumnStartOffset := j + s.DimensionStartOffset + s.NilBytes
-				fmt.Printf(" ][ % x", segment.Bytes[j+s.DimensionStartOffset:dimColumnStartOffset])
-				fmt.Printf(" | % x", segment.Bytes[dimColumnStartOffset:j+s.MetricStartOffset])
-				fmt.Printf(" ][ % x\n", segment.Bytes[j+s.MetricStartOffset:j+s.RowSize])
+				fmt.Printf(" ][ % x", rows[j+s.DimensionStartOffset:dimColumnStartOffset])
+				fmt.Printf(" | % x", rows[dimColumnStartOffset:j+s.MetricStartOffset])
+				fmt.Printf(" ][ % x\n", rows[j+s.MetricStartOffset:j+s.RowSize])
 			}
 			fmt.Println()
 		}
@@ -146,10 +216,11 @@ func (s *StaticTable) debugPrint() {
 }
 
 type StaticTableStats struct {
-	Intervals int
-	Segments  int
-	Rows      int
-	Bytes     int
+	Intervals     int
+	ColdIntervals int // Intervals in the cold store, which aren't counted in Bytes or CompressionRatio
+	Segments      int
+	Rows          int
+	Bytes         int
 
 	// CompressionRatio is the ratio of logical rows in the table to the stored rows in this StaticTable. For
 	// instance, if the rows are completely uncollapsible, then the count is 1 for every row and the compression
@@ -173,16 +244,24 @@ func (s *StaticTable) stats() *StaticTableStats {
 		ByInterval: make(map[time.Time]*IntervalStats),
 	}
 
+	var buf []byte // Compressed segments are decoded into buf
 	logicalRows := 0
 	physicalRows := 0
+	localPhysicalRows := 0
 	for t, interval := range s.Intervals {
 		stats.Segments += interval.NumSegments
 		physicalRows += interval.NumRows
+		if interval.Cold {
+			stats.ColdIntervals++
+		} else {
+			localPhysicalRows += interval.NumRows
+		}
 		intervalBytes := 0
 		for _, segment := range interval.Segments {
 			intervalBytes += len(segment.Bytes)
-			for cursor := 0; cursor < len(segment.Bytes); cursor += s.RowSize {
-				row := RowBytes(segment.Bytes[cursor : cursor+s.RowSize])
+			rows := s.SegmentRows(segment, &buf)
+			for cursor := 0; cursor < len(rows); cursor += s.RowSize {
+				row := RowBytes(rows[cursor : cursor+s.RowSize])
 				logicalRows += int(row.count(s.Schema))
 			}
 		}
@@ -191,6 +270,6 @@ func (s *StaticTable) stats() *StaticTableStats {
 	}
 
 	stats.Rows = physicalRows
-	stats.CompressionRatio = float64(logicalRows) / float64(physicalRows)
+	stats.CompressionRatio = float64(logicalRows) / float64(localPhysicalRows)
 	return stats
 }
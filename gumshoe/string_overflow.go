@@ -0,0 +1,164 @@
+// Handling inserted values which don't fit in the dimension table of a string dimension column (see
+// RunConfig.StringOverflow).
+
+package gumshoe
+
+import "fmt"
+
+// StringOverflowPolicy says what happens to an inserted row with a new value for a string dimension column
+// whose dimension table is full: that is, the value's index in the table wouldn't fit in the column's type.
+type StringOverflowPolicy int
+
+const (
+	// RejectStringOverflow rejects each overflowing row with a RowError (even if the insert doesn't skip
+	// invalid rows) and inserts the rest of the rows.
+	RejectStringOverflow StringOverflowPolicy = iota
+	// OtherStringOverflow stores the overflowing values as OtherValue, for which the last index of the column
+	// is kept.
+	OtherStringOverflow
+	// PromoteStringOverflow holds back the overflowing rows, and the next flush records that the column is to
+	// be widened to the next larger unsigned type. The columns of an open DB can't change, so the column is
+	// widened, and the held rows are inserted, when the DB is next opened; the rows are kept in the WAL until
+	// then. Rows which can't be held (because the DB isn't disk-backed or the column is already a uint32) are
+	// rejected.
+	PromoteStringOverflow
+)
+
+// OtherValue is the value stored for values which overflow a string dimension column with
+// OtherStringOverflow.
+const OtherValue = "(other)"
+
+// A StringOverflowError is the error for inserting a new value into a string dimension column whose
+// dimension table is full.
+type StringOverflowError struct {
+	Column string
+	Value  string
+}
+
+func (e *StringOverflowError) Error() string {
+	return fmt.Sprintf("adding a new value (%s) to dimension %s overflows the dimension table",
+		e.Value, e.Column)
+}
+
+// stringDimensionIndex returns the index for value in the dimension table of the string dimension column
+// index, adding value to the memtable's dimension table if it's new. It returns a StringOverflowError if the
+// table is full, unless the value is stored as OtherValue instead (see OtherStringOverflow).
+func (db *DB) stringDimensionIndex(index int, value string) (uint32, error) {
+	column := db.DimensionColumns[index]
+	max := typeMaxes[column.Type]
+	if db.StringOverflow == OtherStringOverflow {
+		if i, ok := db.stringValueIndex(index, value, max-1); ok {
+			return i, nil
+		}
+		if i, ok := db.stringValueIndex(index, OtherValue, max); ok {
+			return i, nil
+		}
+	} else if i, ok := db.stringValueIndex(index, value, max); ok {
+		return i, nil
+	}
+	return 0, &StringOverflowError{Column: column.Name, Value: value}
+}
+
+// stringValueIndex returns the index of value in the dimension table of the string dimension column index.
+// A new value is added to the memtable's dimension table unless its index would be more than max.
+func (db *DB) stringValueIndex(index int, value string, max float64) (uint32, bool) {
+	staticTable := db.StaticTable.DimensionTables[index]
+	if i, ok := staticTable.Get(value); ok {
+		return i, true
+	}
+	// The index in a MemTable's dimension table must be offset by the size of the StaticTable's dimension
+	// table (with which it will be later combined).
+	offset := uint32(len(staticTable.Values))
+	memTable := db.memTable.DimensionTables[index]
+	if i, ok := memTable.Get(value); ok {
+		return offset + i, true
+	}
+	if float64(offset)+float64(len(memTable.Values)) > max {
+		return 0, false
+	}
+	i, _ := memTable.GetAndMaybeSet(value)
+	return offset + i, true
+}
+
+// holdForPromotion holds back row, which overflows a string dimension column, until the DB is reopened with
+// the column widened (see PromoteStringOverflow). It returns false if the row can't be held. This should only
+// be called by the inserter goroutine.
+func (db *DB) holdForPromotion(row UnpackedRow, err *StringOverflowError) bool {
+	if db.StringOverflow != PromoteStringOverflow || !db.DiskBacked {
+		return false
+	}
+	column := db.DimensionColumns[db.DimensionNameToIndex[err.Column]]
+	typ, ok := promotedType(column.Type)
+	if !ok {
+		return false
+	}
+	if db.PromotedColumns == nil {
+		db.PromotedColumns = make(map[string]Type)
+	}
+	db.PromotedColumns[column.Name] = typ
+	db.heldRows = append(db.heldRows, row)
+	db.backlogLock.Lock()
+	db.numHeldRows = len(db.heldRows)
+	db.backlogLock.Unlock()
+	return true
+}
+
+// promotedType returns the type to which a string dimension column of type typ is widened by
+// PromoteStringOverflow.
+func promotedType(typ Type) (Type, bool) {
+	switch {
+	case typeMaxes[typ] < typeMaxes[TypeUint16]:
+		return TypeUint16, true
+	case typeMaxes[typ] < typeMaxes[TypeUint32]:
+		return TypeUint32, true
+	}
+	return typ, false
+}
+
+// widensStringColumn reports whether to is a string dimension column which can hold all the values of the
+// string dimension column from (having an integer type at least as large).
+func widensStringColumn(from, to DimensionColumn) bool {
+	if !from.String || !to.String || from.Name != to.Name {
+		return false
+	}
+	if to.Type == TypeFloat32 || to.Type == TypeFloat64 {
+		return false
+	}
+	return typeMaxes[to.Type] >= typeMaxes[from.Type]
+}
+
+// widenStringColumns changes the type of each string dimension column of s named in types to the given type,
+// if that's wider. It returns whether any column changed. s must be initialized again afterwards.
+func (s *Schema) widenStringColumns(types map[string]Type) bool {
+	changed := false
+	for name, typ := range types {
+		i, ok := s.DimensionNameToIndex[name]
+		if !ok || !s.DimensionColumns[i].String || s.DimensionColumns[i].Type == typ {
+			continue
+		}
+		widened := s.DimensionColumns[i]
+		widened.Type = typ
+		widened.Width = typeWidths[typ]
+		if !widensStringColumn(s.DimensionColumns[i], widened) {
+			continue
+		}
+		if !changed {
+			// The columns may be shared with another schema.
+			s.DimensionColumns = append([]DimensionColumn(nil), s.DimensionColumns...)
+			changed = true
+		}
+		s.DimensionColumns[i] = widened
+	}
+	return changed
+}
+
+// stringColumnTypes returns the types of the string dimension columns of s, keyed by name.
+func (s *Schema) stringColumnTypes() map[string]Type {
+	types := make(map[string]Type)
+	for _, col := range s.DimensionColumns {
+		if col.String {
+			types[col.Name] = col.Type
+		}
+	}
+	return types
+}
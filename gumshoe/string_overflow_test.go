@@ -0,0 +1,105 @@
+package gumshoe
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// makeStringOverflowTestDB returns a DB whose dim1 is a string:uint8 column, which overflows with its 257th
+// value.
+func makeStringOverflowTestDB(policy StringOverflowPolicy, diskBacked bool) *DB {
+	return makeCustomTestDB(diskBacked, func(schema *Schema) {
+		schema.DimensionColumns = []DimensionColumn{makeDimensionColumn("dim1", "uint8", true)}
+		schema.StringOverflow = policy
+	})
+}
+
+// distinctRows returns n rows whose dim1 values are "0", "1", and so on.
+func distinctRows(n int) []RowMap {
+	var rows []RowMap
+	for i := 0; i < n; i++ {
+		rows = append(rows, RowMap{"at": 0.0, "dim1": strconv.Itoa(i), "metric1": 1.0})
+	}
+	return rows
+}
+
+func sumWhereDim1Equals(db *DB, value string) interface{} {
+	query := createQuery()
+	query.Filters = []QueryFilter{{FilterEqual, "dim1", value}}
+	return runQuery(db, query)[0]["metric1"]
+}
+
+func TestRejectStringOverflow(t *testing.T) {
+	db := makeStringOverflowTestDB(RejectStringOverflow, false)
+	defer closeTestDB(db)
+
+	rowErrors, err := db.InsertSkippingInvalid("", distinctRows(300))
+	Assert(t, err, IsNil)
+	Assert(t, len(rowErrors), Equals, 44)
+	Assert(t, rowErrors[0].Row, Equals, 256)
+	Assert(t, rowErrors[0].Overflow, IsTrue)
+	// Rows with existing values can still be inserted.
+	insertRows(db, distinctRows(10))
+	Assert(t, len(db.GetDimensionTables()["dim1"]), Equals, 256)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 266)
+}
+
+func TestOtherStringOverflow(t *testing.T) {
+	db := makeStringOverflowTestDB(OtherStringOverflow, false)
+	defer closeTestDB(db)
+
+	insertRows(db, distinctRows(300))
+	Assert(t, len(db.GetDimensionTables()["dim1"]), Equals, 256)
+	Assert(t, sumWhereDim1Equals(db, "254"), util.DeepConvertibleEquals, 1)
+	Assert(t, sumWhereDim1Equals(db, OtherValue), util.DeepConvertibleEquals, 45)
+
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "254", "metric1": 1.0},
+		{"at": 0.0, "dim1": "new", "metric1": 1.0},
+	})
+	Assert(t, sumWhereDim1Equals(db, "254"), util.DeepConvertibleEquals, 2)
+	Assert(t, sumWhereDim1Equals(db, OtherValue), util.DeepConvertibleEquals, 46)
+}
+
+func TestPromoteStringOverflow(t *testing.T) {
+	db := makeStringOverflowTestDB(PromoteStringOverflow, true)
+	narrow := *db.Schema
+
+	// The overflowing rows are held until the DB is reopened, and reported as held.
+	rowErrors, heldRows, err := db.InsertWithResult("", distinctRows(300), false)
+	Assert(t, err, IsNil)
+	Assert(t, len(rowErrors), Equals, 0)
+	Assert(t, heldRows, Equals, 44)
+	Assert(t, db.GetHeldRows(), Equals, 44)
+	Assert(t, db.Flush(), IsNil)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 256)
+	Assert(t, db.PromotedColumns, DeepEquals, map[string]Type{"dim1": TypeUint16})
+	insertRows(db, distinctRows(10))
+
+	// They're replayed from the WAL into the memtable.
+	db = reopenTestDB(db)
+	Assert(t, db.DimensionColumns[0].Type, Equals, TypeUint16)
+	Assert(t, len(db.PromotedColumns), Equals, 0)
+	Assert(t, db.GetHeldRows(), Equals, 0)
+	Assert(t, len(db.Layouts), Equals, 1)
+	Assert(t, db.Flush(), IsNil)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 310)
+	Assert(t, sumWhereDim1Equals(db, "5"), util.DeepConvertibleEquals, 2)
+	Assert(t, sumWhereDim1Equals(db, "299"), util.DeepConvertibleEquals, 1)
+	Assert(t, narrow.DimensionColumns[0].Type, Equals, TypeUint8)
+
+	// The column stays widened when the DB is opened with the original schema. The old layout was only used by
+	// the interval which has been rewritten.
+	insertRows(db, distinctRows(1))
+	closeTestDB(db)
+	db, err = OpenDB(&narrow)
+	Assert(t, err, IsNil)
+	defer closeTestDB(db)
+	Assert(t, db.DimensionColumns[0].Type, Equals, TypeUint16)
+	Assert(t, len(db.Layouts), Equals, 0)
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 311)
+}
@@ -0,0 +1,155 @@
+// A t-digest sketch for estimating quantiles of a metric column.
+
+package gumshoe
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"math"
+	"sort"
+)
+
+// tDigestCompression bounds the number of centroids kept by a TDigest (there are at most a small multiple of
+// this many). Larger values give more accurate quantiles at the cost of space.
+const tDigestCompression = 100
+
+type centroid struct {
+	Mean   float64
+	Weight float64
+}
+
+type byMean []centroid
+
+func (c byMean) Len() int           { return len(c) }
+func (c byMean) Less(i, j int) bool { return c[i].Mean < c[j].Mean }
+func (c byMean) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+
+// TDigest is a sketch (see Dunning's "Computing Extremely Accurate Quantiles Using t-Digests") which
+// estimates quantiles of the weighted values added to it. It is most accurate at the extreme quantiles.
+// Digests may be merged, so the quantiles of the union of several digests can be computed without access to
+// the original values.
+//
+// A TDigest is serialized (for instance, in a JSON result from a shard) as base64-encoded centroids.
+type TDigest struct {
+	centroids []centroid // Sorted by mean
+	buffer    []centroid // Values not yet merged into centroids
+	weight    float64
+}
+
+func NewTDigest() *TDigest { return new(TDigest) }
+
+// Add adds value to d with the given weight.
+func (d *TDigest) Add(value, weight float64) {
+	d.buffer = append(d.buffer, centroid{value, weight})
+	d.weight += weight
+	if len(d.buffer) >= 5*tDigestCompression {
+		d.compress()
+	}
+}
+
+// Merge adds all the values summarized by other to d.
+func (d *TDigest) Merge(other *TDigest) {
+	d.buffer = append(d.buffer, other.centroids...)
+	d.buffer = append(d.buffer, other.buffer...)
+	d.weight += other.weight
+	d.compress()
+}
+
+// compress merges the buffered values into the centroids, combining adjacent centroids as long as the
+// result is small enough for its position in the distribution.
+func (d *TDigest) compress() {
+	if len(d.buffer) == 0 {
+		return
+	}
+	all := append(d.centroids, d.buffer...)
+	sort.Sort(byMean(all))
+	var merged []centroid
+	cur := all[0]
+	weightSoFar := 0.0
+	for _, c := range all[1:] {
+		q := (weightSoFar + (cur.Weight+c.Weight)/2) / d.weight
+		if cur.Weight+c.Weight <= 4*d.weight*q*(1-q)/tDigestCompression {
+			cur.Weight += c.Weight
+			cur.Mean += (c.Mean - cur.Mean) * c.Weight / cur.Weight
+			continue
+		}
+		weightSoFar += cur.Weight
+		merged = append(merged, cur)
+		cur = c
+	}
+	d.centroids = append(merged, cur)
+	d.buffer = nil
+}
+
+// Quantile returns the estimated value at quantile q (0 <= q <= 1) of the values in d. If d is empty, the
+// result is NaN.
+func (d *TDigest) Quantile(q float64) float64 {
+	d.compress()
+	if len(d.centroids) == 0 {
+		return math.NaN()
+	}
+	target := q * d.weight
+	cumulative := 0.0
+	for i, c := range d.centroids {
+		mid := cumulative + c.Weight/2
+		if target < mid {
+			if i == 0 {
+				return c.Mean
+			}
+			// Interpolate between the centers of the neighboring centroids.
+			prev := d.centroids[i-1]
+			prevMid := cumulative - prev.Weight/2
+			return prev.Mean + (c.Mean-prev.Mean)*(target-prevMid)/(mid-prevMid)
+		}
+		cumulative += c.Weight
+	}
+	return d.centroids[len(d.centroids)-1].Mean
+}
+
+// MarshalBinary encodes d as the means and weights of its centroids.
+func (d *TDigest) MarshalBinary() ([]byte, error) {
+	d.compress()
+	b := make([]byte, 16*len(d.centroids))
+	for i, c := range d.centroids {
+		binary.LittleEndian.PutUint64(b[16*i:], math.Float64bits(c.Mean))
+		binary.LittleEndian.PutUint64(b[16*i+8:], math.Float64bits(c.Weight))
+	}
+	return b, nil
+}
+
+// MarshalText encodes d as the base64 form of its binary encoding.
+func (d *TDigest) MarshalText() ([]byte, error) {
+	b, err := d.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	text := make([]byte, base64.StdEncoding.EncodedLen(len(b)))
+	base64.StdEncoding.Encode(text, b)
+	return text, nil
+}
+
+func (d *TDigest) UnmarshalText(text []byte) error {
+	b := make([]byte, base64.StdEncoding.DecodedLen(len(text)))
+	n, err := base64.StdEncoding.Decode(b, text)
+	if err != nil {
+		return err
+	}
+	return d.UnmarshalBinary(b[:n])
+}
+
+func (d *TDigest) UnmarshalBinary(b []byte) error {
+	if len(b)%16 != 0 {
+		return errors.New("serialized t-digest has a partial centroid")
+	}
+	*d = TDigest{centroids: make([]centroid, len(b)/16)}
+	for i := range d.centroids {
+		c := centroid{
+			Mean:   math.Float64frombits(binary.LittleEndian.Uint64(b[16*i:])),
+			Weight: math.Float64frombits(binary.LittleEndian.Uint64(b[16*i+8:])),
+		}
+		d.centroids[i] = c
+		d.weight += c.Weight
+	}
+	return nil
+}
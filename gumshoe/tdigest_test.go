@@ -0,0 +1,43 @@
+package gumshoe
+
+import (
+	"math"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func checkQuantile(t *testing.T, d *TDigest, q, expected, tolerance float64) {
+	if value := d.Quantile(q); math.Abs(value-expected) > tolerance {
+		t.Errorf("expected quantile %v to be within %v of %v; got %v", q, tolerance, expected, value)
+	}
+}
+
+func TestTDigestQuantiles(t *testing.T) {
+	d := NewTDigest()
+	Assert(t, math.IsNaN(d.Quantile(0.5)), IsTrue)
+	for i := 0; i < 10000; i++ {
+		d.Add(float64(i), 1)
+	}
+	checkQuantile(t, d, 0.5, 5000, 50)
+	checkQuantile(t, d, 0.95, 9500, 20)
+	checkQuantile(t, d, 0.99, 9900, 10)
+}
+
+func TestTDigestMergeAndSerialization(t *testing.T) {
+	d1 := NewTDigest()
+	d2 := NewTDigest()
+	for i := 0; i < 5000; i++ {
+		d1.Add(float64(i), 1)
+		d2.Add(float64(i+5000), 1)
+	}
+	text, err := d2.MarshalText()
+	Assert(t, err, IsNil)
+	decoded := NewTDigest()
+	Assert(t, decoded.UnmarshalText(text), IsNil)
+	d1.Merge(decoded)
+	checkQuantile(t, d1, 0.5, 5000, 50)
+	checkQuantile(t, d1, 0.99, 9900, 10)
+
+	Assert(t, decoded.UnmarshalText([]byte("AAAA")), NotNil)
+}
@@ -0,0 +1,235 @@
+// A minimal reader and writer for the Thrift compact protocol, enough for the metadata of Parquet files.
+
+package gumshoe
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Thrift compact protocol types
+const (
+	thriftTrue   = 1
+	thriftFalse  = 2
+	thriftI8     = 3
+	thriftI16    = 4
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftDouble = 7
+	thriftBinary = 8
+	thriftList   = 9
+	thriftSet    = 10
+	thriftMap    = 11
+	thriftStruct = 12
+)
+
+// thriftWriter encodes a Thrift struct. Fields must be written in increasing order within each struct.
+type thriftWriter struct {
+	buf       []byte
+	lastField []int16 // The ID of the last field written in each of the open structs
+}
+
+func (w *thriftWriter) varint(v uint64) { w.buf = appendUvarint(w.buf, v) }
+
+func zigzag(v int64) uint64 { return uint64(v<<1) ^ uint64(v>>63) }
+
+// beginStruct starts a struct, either the outermost one or the value of a field or list element.
+func (w *thriftWriter) beginStruct() {
+	w.lastField = append(w.lastField, 0)
+}
+
+func (w *thriftWriter) endStruct() {
+	w.buf = append(w.buf, 0) // Stop
+	w.lastField = w.lastField[:len(w.lastField)-1]
+}
+
+// field writes the header of the field with the given ID and type in the current struct.
+func (w *thriftWriter) field(id int16, typ byte) {
+	last := &w.lastField[len(w.lastField)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf = append(w.buf, byte(delta)<<4|typ)
+	} else {
+		w.buf = append(w.buf, typ)
+		w.varint(zigzag(int64(id)))
+	}
+	*last = id
+}
+
+// list writes the header of a list of n elements of the given type.
+func (w *thriftWriter) list(n int, typ byte) {
+	if n < 15 {
+		w.buf = append(w.buf, byte(n)<<4|typ)
+		return
+	}
+	w.buf = append(w.buf, 0xf0|typ)
+	w.varint(uint64(n))
+}
+
+func (w *thriftWriter) i32(v int32) { w.varint(zigzag(int64(v))) }
+func (w *thriftWriter) i64(v int64) { w.varint(zigzag(v)) }
+
+func (w *thriftWriter) string(s string) {
+	w.varint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *thriftWriter) i32Field(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.i32(v)
+}
+
+func (w *thriftWriter) i64Field(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.i64(v)
+}
+
+func (w *thriftWriter) stringField(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.string(s)
+}
+
+var errBadThrift = errors.New("malformed Thrift data")
+
+// thriftReader decodes Thrift structs into maps from field IDs to values: int64s for integers, bools,
+// float64s, []byte binaries, []interface{} lists and sets, and nested maps for structs. Maps are skipped.
+// After an error, the reader returns zero values and err is set.
+type thriftReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.buf) {
+		r.err = errBadThrift
+		return 0
+	}
+	r.pos++
+	return r.buf[r.pos-1]
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.buf[r.pos:])
+	if n <= 0 {
+		r.err = errBadThrift
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *thriftReader) varint() int64 {
+	v := r.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+// size reads the size of a binary or collection, which must fit in the rest of the input (every element of a
+// collection takes at least a byte).
+func (r *thriftReader) size() int {
+	n := r.uvarint()
+	if n > uint64(len(r.buf)-r.pos) {
+		r.err = errBadThrift
+		return 0
+	}
+	return int(n)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	if r.err != nil {
+		return nil
+	}
+	switch typ {
+	case thriftTrue, thriftFalse: // Only in lists and sets (a field's type gives its value)
+		return r.byte() == thriftTrue
+	case thriftI8:
+		return int64(int8(r.byte()))
+	case thriftI16, thriftI32, thriftI64:
+		return r.varint()
+	case thriftDouble:
+		if len(r.buf)-r.pos < 8 {
+			r.err = errBadThrift
+			return nil
+		}
+		r.pos += 8
+		return math.Float64frombits(binary.LittleEndian.Uint64(r.buf[r.pos-8:]))
+	case thriftBinary:
+		n := r.size()
+		r.pos += n
+		return r.buf[r.pos-n : r.pos]
+	case thriftList, thriftSet:
+		header := r.byte()
+		n := int(header >> 4)
+		if n == 15 {
+			n = r.size()
+		}
+		list := make([]interface{}, 0, n)
+		for i := 0; i < n && r.err == nil; i++ {
+			list = append(list, r.value(header&0xf))
+		}
+		return list
+	case thriftMap:
+		n := r.size()
+		if n > 0 {
+			types := r.byte()
+			for i := 0; i < n && r.err == nil; i++ {
+				r.value(types >> 4)
+				r.value(types & 0xf)
+			}
+		}
+		return nil
+	case thriftStruct:
+		return r.readStruct()
+	}
+	r.err = errBadThrift
+	return nil
+}
+
+func (r *thriftReader) readStruct() map[int]interface{} {
+	fields := make(map[int]interface{})
+	last := 0
+	for r.err == nil {
+		header := r.byte()
+		if header == 0 {
+			return fields
+		}
+		if delta := int(header >> 4); delta > 0 {
+			last += delta
+		} else {
+			last = int(r.varint())
+		}
+		switch typ := header & 0xf; typ {
+		case thriftTrue, thriftFalse:
+			fields[last] = typ == thriftTrue
+		default:
+			fields[last] = r.value(typ)
+		}
+	}
+	return nil
+}
+
+// thriftInt returns the integer field id of a struct read by a thriftReader, or def if it's missing.
+func thriftInt(fields map[int]interface{}, id int, def int64) int64 {
+	if v, ok := fields[id].(int64); ok {
+		return v
+	}
+	return def
+}
+
+func thriftStructField(fields map[int]interface{}, id int) map[int]interface{} {
+	v, _ := fields[id].(map[int]interface{})
+	return v
+}
+
+func thriftListField(fields map[int]interface{}, id int) []interface{} {
+	v, _ := fields[id].([]interface{})
+	return v
+}
+
+func thriftStringField(fields map[int]interface{}, id int) string {
+	v, _ := fields[id].([]byte)
+	return string(v)
+}
@@ -0,0 +1,66 @@
+package gumshoe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func makeTestTTLDB() *DB {
+	return makeCustomTestDB(false, func(schema *Schema) {
+		schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("ttl", "uint8", false))
+		schema.TTLColumn = "ttl"
+	})
+}
+
+func TestRowsWithExpiredTTLsAreDroppedOnInsert(t *testing.T) {
+	db := makeTestTTLDB()
+	defer closeTestDB(db)
+
+	twoDaysAgo := float64(time.Now().Add(-48 * time.Hour).Unix())
+	insertRows(db, []RowMap{
+		{"at": twoDaysAgo, "dim1": "a", "ttl": 1.0, "metric1": 1.0},
+		{"at": twoDaysAgo, "dim1": "b", "ttl": 3.0, "metric1": 2.0},
+		{"at": twoDaysAgo, "dim1": "c", "ttl": 0.0, "metric1": 4.0},
+		{"at": twoDaysAgo, "dim1": "d", "metric1": 8.0},
+	})
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 14)
+
+	// The interval records when its next row expires.
+	resp := db.MakeRequest()
+	defer resp.Done()
+	Assert(t, len(resp.StaticTable.Intervals), Equals, 1)
+	for _, interval := range resp.StaticTable.Intervals {
+		Assert(t, *interval.Expiry, Equals, interval.End.Add(3*24*time.Hour))
+	}
+}
+
+func TestIntervalsWithExpiredRowsAreRewrittenOnFlush(t *testing.T) {
+	db := makeTestTTLDB()
+	defer closeTestDB(db)
+
+	// Insert the rows without TTLs in effect, as though the TTLs expire after the insert.
+	ttlIndex := db.TTLDimensionIndex
+	db.TTLDimensionIndex = -1
+	twoDaysAgo := float64(time.Now().Add(-48 * time.Hour).Unix())
+	insertRows(db, []RowMap{
+		{"at": twoDaysAgo, "dim1": "a", "ttl": 1.0, "metric1": 1.0},
+		{"at": twoDaysAgo, "dim1": "b", "ttl": 3.0, "metric1": 2.0},
+		{"at": twoDaysAgo, "dim1": "c", "metric1": 4.0},
+	})
+	Assert(t, physicalRows(db), Equals, 3)
+
+	db.TTLDimensionIndex = ttlIndex
+	for _, interval := range db.StaticTable.Intervals {
+		expiry := time.Now().Add(-time.Minute)
+		interval.Expiry = &expiry
+	}
+	Assert(t, db.Flush(), IsNil)
+	Assert(t, physicalRows(db), Equals, 2)
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 6)
+}
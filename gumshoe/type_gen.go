@@ -238,6 +238,11 @@ const (
 	FilterLessThan           FilterType = iota
 	FilterLessThanOrEqual    FilterType = iota
 	FilterIn                 FilterType = iota
+	FilterNotIn              FilterType = iota
+	FilterPrefix             FilterType = iota
+	FilterRegex              FilterType = iota
+	FilterEqualFold          FilterType = iota
+	FilterInFold             FilterType = iota
 )
 
 var filterTypeToName = []string{
@@ -248,16 +253,26 @@ var filterTypeToName = []string{
 	FilterLessThan:           "<",
 	FilterLessThanOrEqual:    "<=",
 	FilterIn:                 "in",
+	FilterNotIn:              "not in",
+	FilterPrefix:             "prefix",
+	FilterRegex:              "regex",
+	FilterEqualFold:          "ieq",
+	FilterInFold:             "iin",
 }
 
 var filterNameToType = map[string]FilterType{
-	"=":  FilterEqual,
-	"!=": FilterNotEqual,
-	">":  FilterGreaterThan,
-	">=": FilterGreaterThenOrEqual,
-	"<":  FilterLessThan,
-	"<=": FilterLessThanOrEqual,
-	"in": FilterIn,
+	"=":      FilterEqual,
+	"!=":     FilterNotEqual,
+	">":      FilterGreaterThan,
+	">=":     FilterGreaterThenOrEqual,
+	"<":      FilterLessThan,
+	"<=":     FilterLessThanOrEqual,
+	"in":     FilterIn,
+	"not in": FilterNotIn,
+	"prefix": FilterPrefix,
+	"regex":  FilterRegex,
+	"ieq":    FilterEqualFold,
+	"iin":    FilterInFold,
 }
 
 func makeSumFuncGen(typ Type) func(offset int) sumFunc {
@@ -405,6 +420,41 @@ func makeGetDimensionValueAsIntFuncGen(typ Type) func(cell unsafe.Pointer) int {
 	panic("unreached")
 }
 
+func makeGetCellValueAsFloat64FuncGen(typ Type) func(cell unsafe.Pointer) float64 {
+
+	if typ == TypeUint8 {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*uint8)(cell)) }
+	}
+	if typ == TypeInt8 {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*int8)(cell)) }
+	}
+	if typ == TypeUint16 {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*uint16)(cell)) }
+	}
+	if typ == TypeInt16 {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*int16)(cell)) }
+	}
+	if typ == TypeUint32 {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*uint32)(cell)) }
+	}
+	if typ == TypeInt32 {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*int32)(cell)) }
+	}
+	if typ == TypeFloat32 {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*float32)(cell)) }
+	}
+	if typ == TypeUint64 {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*uint64)(cell)) }
+	}
+	if typ == TypeInt64 {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*int64)(cell)) }
+	}
+	if typ == TypeFloat64 {
+		return func(cell unsafe.Pointer) float64 { return float64(*(*float64)(cell)) }
+	}
+	panic("unreached")
+}
+
 func makeTimestampFilterFuncSimpleGen(filter FilterType) func(timestamp uint32) timestampFilterFunc {
 
 	if filter == FilterEqual {
@@ -2670,9 +2720,33 @@ func makeDimensionFilterFuncSimpleGen(typ Type, filter FilterType, isString bool
 	panic("unreached")
 }
 
-func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, bool, int, byte, int) filterFunc {
+// The 'in' filter funcs are also used for 'not in' filters (with negate == true).
 
-	if typ == TypeUint8 && isString == true {
+func makeDimensionFilterFuncInGen(typ Type, isString, negate bool) func(interface{}, bool, int, byte, int) filterFunc {
+
+	if typ == TypeUint8 && isString == true && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []uint8
+
+			for _, v := range values.([]uint32) {
+
+				typedValues = append(typedValues, uint8(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*uint8)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeUint8 && isString == true && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
 			var typedValues []uint8
 
@@ -2694,7 +2768,29 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeUint8 && isString == false {
+	if typ == TypeUint8 && isString == false && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []uint8
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, uint8(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*uint8)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeUint8 && isString == false && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
 			var typedValues []uint8
 
@@ -2716,7 +2812,29 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeInt8 && isString == true {
+	if typ == TypeInt8 && isString == true && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []int8
+
+			for _, v := range values.([]uint32) {
+
+				typedValues = append(typedValues, int8(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*int8)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeInt8 && isString == true && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
 			var typedValues []int8
 
@@ -2738,7 +2856,29 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeInt8 && isString == false {
+	if typ == TypeInt8 && isString == false && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []int8
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, int8(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*int8)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeInt8 && isString == false && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
 			var typedValues []int8
 
@@ -2760,7 +2900,29 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeUint16 && isString == true {
+	if typ == TypeUint16 && isString == true && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []uint16
+
+			for _, v := range values.([]uint32) {
+
+				typedValues = append(typedValues, uint16(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*uint16)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeUint16 && isString == true && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
 			var typedValues []uint16
 
@@ -2782,7 +2944,29 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeUint16 && isString == false {
+	if typ == TypeUint16 && isString == false && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []uint16
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, uint16(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*uint16)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeUint16 && isString == false && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
 			var typedValues []uint16
 
@@ -2804,7 +2988,7 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeInt16 && isString == true {
+	if typ == TypeInt16 && isString == true && negate == true {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
 			var typedValues []int16
 
@@ -2814,23 +2998,23 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
-					return acceptNil
+					return !acceptNil
 				}
 				value := *(*int16)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
-						return true
+						return false
 					}
 				}
-				return false
+				return true
 			}
 		}
 	}
-	if typ == TypeInt16 && isString == false {
+	if typ == TypeInt16 && isString == true && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
 			var typedValues []int16
 
-			for _, v := range values.([]float64) {
+			for _, v := range values.([]uint32) {
 
 				typedValues = append(typedValues, int16(v))
 			}
@@ -2848,41 +3032,41 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeUint32 && isString == true {
+	if typ == TypeInt16 && isString == false && negate == true {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []uint32
+			var typedValues []int16
 
-			for _, v := range values.([]uint32) {
+			for _, v := range values.([]float64) {
 
-				typedValues = append(typedValues, uint32(v))
+				typedValues = append(typedValues, int16(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
-					return acceptNil
+					return !acceptNil
 				}
-				value := *(*uint32)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*int16)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
-						return true
+						return false
 					}
 				}
-				return false
+				return true
 			}
 		}
 	}
-	if typ == TypeUint32 && isString == false {
+	if typ == TypeInt16 && isString == false && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []uint32
+			var typedValues []int16
 
 			for _, v := range values.([]float64) {
 
-				typedValues = append(typedValues, uint32(v))
+				typedValues = append(typedValues, int16(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
 					return acceptNil
 				}
-				value := *(*uint32)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*int16)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
 						return true
@@ -2892,41 +3076,41 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeInt32 && isString == true {
+	if typ == TypeUint32 && isString == true && negate == true {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []int32
+			var typedValues []uint32
 
 			for _, v := range values.([]uint32) {
 
-				typedValues = append(typedValues, int32(v))
+				typedValues = append(typedValues, uint32(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
-					return acceptNil
+					return !acceptNil
 				}
-				value := *(*int32)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*uint32)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
-						return true
+						return false
 					}
 				}
-				return false
+				return true
 			}
 		}
 	}
-	if typ == TypeInt32 && isString == false {
+	if typ == TypeUint32 && isString == true && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []int32
+			var typedValues []uint32
 
-			for _, v := range values.([]float64) {
+			for _, v := range values.([]uint32) {
 
-				typedValues = append(typedValues, int32(v))
+				typedValues = append(typedValues, uint32(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
 					return acceptNil
 				}
-				value := *(*int32)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*uint32)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
 						return true
@@ -2936,41 +3120,41 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeFloat32 && isString == true {
+	if typ == TypeUint32 && isString == false && negate == true {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []float32
+			var typedValues []uint32
 
-			for _, v := range values.([]uint32) {
+			for _, v := range values.([]float64) {
 
-				typedValues = append(typedValues, float32(v))
+				typedValues = append(typedValues, uint32(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
-					return acceptNil
+					return !acceptNil
 				}
-				value := *(*float32)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*uint32)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
-						return true
+						return false
 					}
 				}
-				return false
+				return true
 			}
 		}
 	}
-	if typ == TypeFloat32 && isString == false {
+	if typ == TypeUint32 && isString == false && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []float32
+			var typedValues []uint32
 
 			for _, v := range values.([]float64) {
 
-				typedValues = append(typedValues, float32(v))
+				typedValues = append(typedValues, uint32(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
 					return acceptNil
 				}
-				value := *(*float32)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*uint32)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
 						return true
@@ -2980,41 +3164,41 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeUint64 && isString == true {
+	if typ == TypeInt32 && isString == true && negate == true {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []uint64
+			var typedValues []int32
 
 			for _, v := range values.([]uint32) {
 
-				typedValues = append(typedValues, uint64(v))
+				typedValues = append(typedValues, int32(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
-					return acceptNil
+					return !acceptNil
 				}
-				value := *(*uint64)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*int32)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
-						return true
+						return false
 					}
 				}
-				return false
+				return true
 			}
 		}
 	}
-	if typ == TypeUint64 && isString == false {
+	if typ == TypeInt32 && isString == true && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []uint64
+			var typedValues []int32
 
-			for _, v := range values.([]float64) {
+			for _, v := range values.([]uint32) {
 
-				typedValues = append(typedValues, uint64(v))
+				typedValues = append(typedValues, int32(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
 					return acceptNil
 				}
-				value := *(*uint64)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*int32)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
 						return true
@@ -3024,41 +3208,41 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeInt64 && isString == true {
+	if typ == TypeInt32 && isString == false && negate == true {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []int64
+			var typedValues []int32
 
-			for _, v := range values.([]uint32) {
+			for _, v := range values.([]float64) {
 
-				typedValues = append(typedValues, int64(v))
+				typedValues = append(typedValues, int32(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
-					return acceptNil
+					return !acceptNil
 				}
-				value := *(*int64)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*int32)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
-						return true
+						return false
 					}
 				}
-				return false
+				return true
 			}
 		}
 	}
-	if typ == TypeInt64 && isString == false {
+	if typ == TypeInt32 && isString == false && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []int64
+			var typedValues []int32
 
 			for _, v := range values.([]float64) {
 
-				typedValues = append(typedValues, int64(v))
+				typedValues = append(typedValues, int32(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
 					return acceptNil
 				}
-				value := *(*int64)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*int32)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
 						return true
@@ -3068,41 +3252,41 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	if typ == TypeFloat64 && isString == true {
+	if typ == TypeFloat32 && isString == true && negate == true {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []float64
+			var typedValues []float32
 
 			for _, v := range values.([]uint32) {
 
-				typedValues = append(typedValues, float64(v))
+				typedValues = append(typedValues, float32(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
-					return acceptNil
+					return !acceptNil
 				}
-				value := *(*float64)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*float32)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
-						return true
+						return false
 					}
 				}
-				return false
+				return true
 			}
 		}
 	}
-	if typ == TypeFloat64 && isString == false {
+	if typ == TypeFloat32 && isString == true && negate == false {
 		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
-			var typedValues []float64
+			var typedValues []float32
 
-			for _, v := range values.([]float64) {
+			for _, v := range values.([]uint32) {
 
-				typedValues = append(typedValues, float64(v))
+				typedValues = append(typedValues, float32(v))
 			}
 			return func(row RowBytes) bool {
 				if row[nilOffset]&mask > 0 {
 					return acceptNil
 				}
-				value := *(*float64)(unsafe.Pointer(&row[valueOffset]))
+				value := *(*float32)(unsafe.Pointer(&row[valueOffset]))
 				for _, v := range typedValues {
 					if value == v {
 						return true
@@ -3112,9 +3296,317 @@ func makeDimensionFilterFuncInGen(typ Type, isString bool) func(interface{}, boo
 			}
 		}
 	}
-	panic("unreached")
-}
-
+	if typ == TypeFloat32 && isString == false && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []float32
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, float32(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*float32)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeFloat32 && isString == false && negate == false {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []float32
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, float32(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return acceptNil
+				}
+				value := *(*float32)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return true
+					}
+				}
+				return false
+			}
+		}
+	}
+	if typ == TypeUint64 && isString == true && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []uint64
+
+			for _, v := range values.([]uint32) {
+
+				typedValues = append(typedValues, uint64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*uint64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeUint64 && isString == true && negate == false {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []uint64
+
+			for _, v := range values.([]uint32) {
+
+				typedValues = append(typedValues, uint64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return acceptNil
+				}
+				value := *(*uint64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return true
+					}
+				}
+				return false
+			}
+		}
+	}
+	if typ == TypeUint64 && isString == false && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []uint64
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, uint64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*uint64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeUint64 && isString == false && negate == false {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []uint64
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, uint64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return acceptNil
+				}
+				value := *(*uint64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return true
+					}
+				}
+				return false
+			}
+		}
+	}
+	if typ == TypeInt64 && isString == true && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []int64
+
+			for _, v := range values.([]uint32) {
+
+				typedValues = append(typedValues, int64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*int64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeInt64 && isString == true && negate == false {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []int64
+
+			for _, v := range values.([]uint32) {
+
+				typedValues = append(typedValues, int64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return acceptNil
+				}
+				value := *(*int64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return true
+					}
+				}
+				return false
+			}
+		}
+	}
+	if typ == TypeInt64 && isString == false && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []int64
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, int64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*int64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeInt64 && isString == false && negate == false {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []int64
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, int64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return acceptNil
+				}
+				value := *(*int64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return true
+					}
+				}
+				return false
+			}
+		}
+	}
+	if typ == TypeFloat64 && isString == true && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []float64
+
+			for _, v := range values.([]uint32) {
+
+				typedValues = append(typedValues, float64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*float64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeFloat64 && isString == true && negate == false {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []float64
+
+			for _, v := range values.([]uint32) {
+
+				typedValues = append(typedValues, float64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return acceptNil
+				}
+				value := *(*float64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return true
+					}
+				}
+				return false
+			}
+		}
+	}
+	if typ == TypeFloat64 && isString == false && negate == true {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []float64
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, float64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return !acceptNil
+				}
+				value := *(*float64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeFloat64 && isString == false && negate == false {
+		return func(values interface{}, acceptNil bool, nilOffset int, mask byte, valueOffset int) filterFunc {
+			var typedValues []float64
+
+			for _, v := range values.([]float64) {
+
+				typedValues = append(typedValues, float64(v))
+			}
+			return func(row RowBytes) bool {
+				if row[nilOffset]&mask > 0 {
+					return acceptNil
+				}
+				value := *(*float64)(unsafe.Pointer(&row[valueOffset]))
+				for _, v := range typedValues {
+					if value == v {
+						return true
+					}
+				}
+				return false
+			}
+		}
+	}
+	panic("unreached")
+}
+
 func makeMetricFilterFuncSimpleGen(typ Type, filter FilterType) func(value float64, offset int) filterFunc {
 
 	if typ == TypeUint8 && filter == FilterEqual {
@@ -3600,9 +4092,26 @@ func makeMetricFilterFuncSimpleGen(typ Type, filter FilterType) func(value float
 	panic("unreached")
 }
 
-func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filterFunc {
+func makeMetricFilterFuncInGen(typ Type, negate bool) func(floats []float64, offset int) filterFunc {
 
-	if typ == TypeUint8 {
+	if typ == TypeUint8 && negate == true {
+		return func(floats []float64, offset int) filterFunc {
+			typedValues := make([]uint8, len(floats))
+			for i, f := range floats {
+				typedValues[i] = uint8(f)
+			}
+			return func(row RowBytes) bool {
+				value := *(*uint8)(unsafe.Pointer(&row[offset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeUint8 && negate == false {
 		return func(floats []float64, offset int) filterFunc {
 			typedValues := make([]uint8, len(floats))
 			for i, f := range floats {
@@ -3619,7 +4128,24 @@ func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filt
 			}
 		}
 	}
-	if typ == TypeInt8 {
+	if typ == TypeInt8 && negate == true {
+		return func(floats []float64, offset int) filterFunc {
+			typedValues := make([]int8, len(floats))
+			for i, f := range floats {
+				typedValues[i] = int8(f)
+			}
+			return func(row RowBytes) bool {
+				value := *(*int8)(unsafe.Pointer(&row[offset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeInt8 && negate == false {
 		return func(floats []float64, offset int) filterFunc {
 			typedValues := make([]int8, len(floats))
 			for i, f := range floats {
@@ -3636,7 +4162,24 @@ func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filt
 			}
 		}
 	}
-	if typ == TypeUint16 {
+	if typ == TypeUint16 && negate == true {
+		return func(floats []float64, offset int) filterFunc {
+			typedValues := make([]uint16, len(floats))
+			for i, f := range floats {
+				typedValues[i] = uint16(f)
+			}
+			return func(row RowBytes) bool {
+				value := *(*uint16)(unsafe.Pointer(&row[offset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeUint16 && negate == false {
 		return func(floats []float64, offset int) filterFunc {
 			typedValues := make([]uint16, len(floats))
 			for i, f := range floats {
@@ -3653,7 +4196,24 @@ func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filt
 			}
 		}
 	}
-	if typ == TypeInt16 {
+	if typ == TypeInt16 && negate == true {
+		return func(floats []float64, offset int) filterFunc {
+			typedValues := make([]int16, len(floats))
+			for i, f := range floats {
+				typedValues[i] = int16(f)
+			}
+			return func(row RowBytes) bool {
+				value := *(*int16)(unsafe.Pointer(&row[offset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeInt16 && negate == false {
 		return func(floats []float64, offset int) filterFunc {
 			typedValues := make([]int16, len(floats))
 			for i, f := range floats {
@@ -3670,7 +4230,24 @@ func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filt
 			}
 		}
 	}
-	if typ == TypeUint32 {
+	if typ == TypeUint32 && negate == true {
+		return func(floats []float64, offset int) filterFunc {
+			typedValues := make([]uint32, len(floats))
+			for i, f := range floats {
+				typedValues[i] = uint32(f)
+			}
+			return func(row RowBytes) bool {
+				value := *(*uint32)(unsafe.Pointer(&row[offset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeUint32 && negate == false {
 		return func(floats []float64, offset int) filterFunc {
 			typedValues := make([]uint32, len(floats))
 			for i, f := range floats {
@@ -3687,7 +4264,24 @@ func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filt
 			}
 		}
 	}
-	if typ == TypeInt32 {
+	if typ == TypeInt32 && negate == true {
+		return func(floats []float64, offset int) filterFunc {
+			typedValues := make([]int32, len(floats))
+			for i, f := range floats {
+				typedValues[i] = int32(f)
+			}
+			return func(row RowBytes) bool {
+				value := *(*int32)(unsafe.Pointer(&row[offset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeInt32 && negate == false {
 		return func(floats []float64, offset int) filterFunc {
 			typedValues := make([]int32, len(floats))
 			for i, f := range floats {
@@ -3704,7 +4298,24 @@ func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filt
 			}
 		}
 	}
-	if typ == TypeFloat32 {
+	if typ == TypeFloat32 && negate == true {
+		return func(floats []float64, offset int) filterFunc {
+			typedValues := make([]float32, len(floats))
+			for i, f := range floats {
+				typedValues[i] = float32(f)
+			}
+			return func(row RowBytes) bool {
+				value := *(*float32)(unsafe.Pointer(&row[offset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeFloat32 && negate == false {
 		return func(floats []float64, offset int) filterFunc {
 			typedValues := make([]float32, len(floats))
 			for i, f := range floats {
@@ -3721,7 +4332,24 @@ func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filt
 			}
 		}
 	}
-	if typ == TypeUint64 {
+	if typ == TypeUint64 && negate == true {
+		return func(floats []float64, offset int) filterFunc {
+			typedValues := make([]uint64, len(floats))
+			for i, f := range floats {
+				typedValues[i] = uint64(f)
+			}
+			return func(row RowBytes) bool {
+				value := *(*uint64)(unsafe.Pointer(&row[offset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeUint64 && negate == false {
 		return func(floats []float64, offset int) filterFunc {
 			typedValues := make([]uint64, len(floats))
 			for i, f := range floats {
@@ -3738,7 +4366,24 @@ func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filt
 			}
 		}
 	}
-	if typ == TypeInt64 {
+	if typ == TypeInt64 && negate == true {
+		return func(floats []float64, offset int) filterFunc {
+			typedValues := make([]int64, len(floats))
+			for i, f := range floats {
+				typedValues[i] = int64(f)
+			}
+			return func(row RowBytes) bool {
+				value := *(*int64)(unsafe.Pointer(&row[offset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeInt64 && negate == false {
 		return func(floats []float64, offset int) filterFunc {
 			typedValues := make([]int64, len(floats))
 			for i, f := range floats {
@@ -3755,7 +4400,24 @@ func makeMetricFilterFuncInGen(typ Type) func(floats []float64, offset int) filt
 			}
 		}
 	}
-	if typ == TypeFloat64 {
+	if typ == TypeFloat64 && negate == true {
+		return func(floats []float64, offset int) filterFunc {
+			typedValues := make([]float64, len(floats))
+			for i, f := range floats {
+				typedValues[i] = float64(f)
+			}
+			return func(row RowBytes) bool {
+				value := *(*float64)(unsafe.Pointer(&row[offset]))
+				for _, v := range typedValues {
+					if value == v {
+						return false
+					}
+				}
+				return true
+			}
+		}
+	}
+	if typ == TypeFloat64 && negate == false {
 		return func(floats []float64, offset int) filterFunc {
 			typedValues := make([]float64, len(floats))
 			for i, f := range floats {
@@ -0,0 +1,159 @@
+package gumshoe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"unsafe"
+)
+
+// A VerifyProblem is an inconsistency between a DB's metadata and its files, found by VerifyDir.
+type VerifyProblem struct {
+	Filename string // The file with the problem (the metadata file, if a file is missing from it)
+	Problem  string
+}
+
+func (p *VerifyProblem) String() string { return fmt.Sprintf("%s: %s", p.Filename, p.Problem) }
+
+// VerifyDir checks the files of the DB in dir against its metadata without opening the DB: every dimension
+// table and bloom filter file referred to must be readable and the right size, every local segment file must
+// exist, be readable (and match its checksum, if checksums is set), and hold whole rows, each interval must
+// have as many rows as its metadata says, and every value of a string dimension column must be within its
+// dimension table. Segments in the cold store aren't checked. It returns every problem found; the error is
+// only for a DB whose metadata can't be read.
+//
+// A flush of a DB in use may remove the files of the generations it replaces, so the DB should be closed.
+func VerifyDir(dir string, checksums bool) ([]*VerifyProblem, error) {
+	metadataFilename := filepath.Join(dir, MetadataFilename)
+	b, err := ioutil.ReadFile(metadataFilename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, DBDoesNotExistErr
+		}
+		return nil, err
+	}
+	db := new(DB)
+	if err := json.Unmarshal(b, db); err != nil {
+		return nil, err
+	}
+	schema := db.Schema
+	schema.Initialize()
+	schema.DiskBacked = true
+	schema.Dir = dir
+
+	var problems []*VerifyProblem
+	problem := func(filename, format string, args ...interface{}) {
+		problems = append(problems, &VerifyProblem{filename, fmt.Sprintf(format, args...)})
+	}
+
+	// The number of values in each string dimension column's table.
+	dimensionSizes := make([]int, len(schema.DimensionColumns))
+	for i, col := range schema.DimensionColumns {
+		if !col.String {
+			continue
+		}
+		if i >= len(db.StaticTable.DimensionTables) || db.StaticTable.DimensionTables[i] == nil {
+			problem(metadataFilename, "there is no dimension table for the string column %s", col.Name)
+			continue
+		}
+		dimTable := db.StaticTable.DimensionTables[i]
+		dimensionSizes[i] = dimTable.Size
+		filename := dimTable.Filename(schema, i)
+		if _, err := os.Stat(filename); os.IsNotExist(err) && dimTable.Size > 0 {
+			problem(filename, "the dimension table of %s (with %d values) is missing", col.Name, dimTable.Size)
+			continue
+		}
+		if err := dimTable.Load(schema, i); err != nil {
+			problem(filename, "%s", err)
+		}
+	}
+
+	for _, interval := range db.StaticTable.Intervals.sorted() {
+		if n := len(interval.Checksums); n > 0 && n != interval.NumSegments {
+			problem(metadataFilename, "interval %d has %d checksums for %d segments", interval.Start.Unix(), n,
+				interval.NumSegments)
+		}
+		if n := len(interval.ZoneMaps); n > 0 && n != interval.NumSegments {
+			problem(metadataFilename, "interval %d has %d zone maps for %d segments", interval.Start.Unix(), n,
+				interval.NumSegments)
+		}
+		if interval.BloomFilters {
+			if err := interval.loadBloomFilters(schema); err != nil {
+				problem(interval.BloomFilename(schema), "%s", err)
+			}
+		}
+		if interval.Cold {
+			continue
+		}
+		if interval.Layout < 0 || interval.Layout > len(schema.Layouts) {
+			problem(metadataFilename, "interval %d has an unknown row layout (%d)", interval.Start.Unix(),
+				interval.Layout)
+			continue
+		}
+		numRows := 0
+		complete := true // Whether every segment was read
+		for i := 0; i < interval.NumSegments; i++ {
+			filename := interval.SegmentFilename(schema, i)
+			segment, err := schema.loadSegment(interval, i, checksums)
+			if err != nil {
+				complete = false
+				switch err := err.(type) {
+				case *CorruptSegmentError:
+					problem(filename, "%s", err.Problem)
+				default:
+					if os.IsNotExist(err) {
+						problem(filename, "the segment file is missing")
+					} else {
+						problem(filename, "%s", err)
+					}
+				}
+				continue
+			}
+			rows := schema.SegmentRows(segment, nil)
+			numRows += len(rows) / schema.RowSize
+			for _, p := range schema.checkDimensionBounds(rows, dimensionSizes) {
+				problem(filename, "%s", p)
+			}
+			if err := segment.close(); err != nil {
+				return nil, err
+			}
+		}
+		if complete && numRows != interval.NumRows {
+			problem(metadataFilename, "the segments of interval %d hold %d row(s), but it should have %d",
+				interval.Start.Unix(), numRows, interval.NumRows)
+		}
+	}
+	return problems, nil
+}
+
+// checkDimensionBounds describes the string dimension columns of rows which have values beyond the end of
+// their dimension tables (whose sizes are given by dimensionSizes).
+func (s *Schema) checkDimensionBounds(rows []byte, dimensionSizes []int) []string {
+	var problems []string
+	for i, col := range s.DimensionColumns {
+		if !col.String {
+			continue
+		}
+		getIndex := makeGetDimensionValueAsIntFuncGen(col.Type)
+		bad, max := 0, 0
+		for r := 0; r+s.RowSize <= len(rows); r += s.RowSize {
+			dimensions := DimensionBytes(rows[r+s.DimensionStartOffset : r+s.MetricStartOffset])
+			if dimensions.IsNil(i) {
+				continue
+			}
+			if index := getIndex(unsafe.Pointer(&dimensions[s.DimensionOffsets[i]])); index >= dimensionSizes[i] {
+				bad++
+				if index > max {
+					max = index
+				}
+			}
+		}
+		if bad > 0 {
+			problems = append(problems, fmt.Sprintf("%d row(s) have values of %s beyond its dimension table "+
+				"(the largest is %d; the table has %d values)", bad, col.Name, max, dimensionSizes[i]))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,70 @@
+package gumshoe
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestVerifyDir(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+	insertRows(db, []RowMap{
+		{"at": 0.0, "dim1": "string1", "metric1": 1.0},
+		{"at": 0.0, "dim1": "string2", "metric1": 1.0},
+		{"at": hour(1), "dim1": "string1", "metric1": 1.0},
+		{"at": hour(1), "dim1": "string2", "metric1": 1.0},
+	})
+	resp := db.MakeRequest()
+	var first, second string
+	for _, interval := range resp.StaticTable.Intervals {
+		if interval.Start.Unix() == 0 {
+			first = interval.SegmentFilename(db.Schema, 0)
+		} else {
+			second = interval.SegmentFilename(db.Schema, 0)
+		}
+	}
+	resp.Done()
+	schema := db.Schema
+	closeTestDB(db)
+
+	problems, err := VerifyDir(schema.Dir, true)
+	Assert(t, err, IsNil)
+	Assert(t, problems, IsNil)
+
+	// Point the second row of the first interval past the end of the dimension table, and cut the second row
+	// from the segment of the second interval.
+	f, err := os.OpenFile(first, os.O_WRONLY, 0)
+	Assert(t, err, IsNil)
+	_, err = f.WriteAt([]byte{0xff, 0xff, 0xff, 0x00}, int64(schema.RowSize+schema.DimensionStartOffset+
+		schema.DimensionOffsets[0]))
+	Assert(t, err, IsNil)
+	f.Close()
+	Assert(t, os.Truncate(second, int64(schema.RowSize)), IsNil)
+
+	problems, err = VerifyDir(schema.Dir, false)
+	Assert(t, err, IsNil)
+	Assert(t, len(problems), Equals, 2)
+	Assert(t, problems[0].Filename, Equals, first)
+	Assert(t, strings.Contains(problems[0].Problem, "1 row(s) have values of dim1 beyond"), IsTrue)
+	Assert(t, problems[1].Filename, Equals, filepath.Join(schema.Dir, MetadataFilename))
+	Assert(t, problems[1].Problem, Equals, "the segments of interval 3600 hold 1 row(s), but it should have 2")
+
+	// With checksums, neither segment matches its checksum.
+	problems, err = VerifyDir(schema.Dir, true)
+	Assert(t, err, IsNil)
+	Assert(t, len(problems), Equals, 2)
+	Assert(t, problems[0].Problem, Equals, "checksum mismatch")
+	Assert(t, problems[1].Problem, Equals, "checksum mismatch")
+
+	Assert(t, os.Remove(second), IsNil)
+	problems, err = VerifyDir(schema.Dir, false)
+	Assert(t, err, IsNil)
+	Assert(t, problems[1], DeepEquals, &VerifyProblem{second, "the segment file is missing"})
+
+	_, err = VerifyDir(filepath.Join(schema.Dir, "missing"), false)
+	Assert(t, err, Equals, DBDoesNotExistErr)
+}
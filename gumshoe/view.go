@@ -0,0 +1,341 @@
+// Materialized views: smaller tables of a DB's rows, with only some of its columns, which answer the queries
+// they can instead of the DB (see RunConfig.Views).
+
+package gumshoe
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// A View is a materialized view of a DB: a table of the DB's rows with only the named columns, in which rows
+// that differ only in the other columns are collapsed together. A view is kept up to date as rows are
+// inserted into, deleted from, and rolled up in the DB, and it's flushed along with the DB.
+type View struct {
+	Name             string
+	DimensionColumns []string
+	MetricColumns    []string
+}
+
+// A viewDB is the DB holding a view.
+type viewDB struct {
+	*DB
+	name string
+}
+
+// ViewsDir is the directory, in a disk-backed DB's directory, holding the DB of each of its views (in a
+// directory named after the view).
+const ViewsDir = "views"
+
+// viewSchema returns the schema of the DB holding the view v of a DB with schema s.
+func (s *Schema) viewSchema(v View) *Schema {
+	view := &Schema{
+		TimestampColumn:  s.TimestampColumn,
+		SegmentSize:      s.SegmentSize,
+		IntervalDuration: s.IntervalDuration,
+		DiskBacked:       s.DiskBacked,
+		RunConfig:        s.RunConfig,
+	}
+	if s.DiskBacked {
+		view.Dir = filepath.Join(s.Dir, ViewsDir, v.Name)
+	}
+	for _, col := range s.DimensionColumns {
+		if containsString(v.DimensionColumns, col.Name) {
+			view.DimensionColumns = append(view.DimensionColumns, col)
+		}
+	}
+	for _, col := range s.MetricColumns {
+		if containsString(v.MetricColumns, col.Name) {
+			view.MetricColumns = append(view.MetricColumns, col)
+		}
+	}
+	// Rows are checked against the late arrival window by the DB before they're inserted into its views, and
+	// the segment files of the views' intervals would collide with the DB's in the cold store.
+	view.LateArrivalWindow = 0
+	view.ColdStore = nil
+	view.Views = nil
+	view.Initialize()
+	return view
+}
+
+func containsString(values []string, s string) bool {
+	for _, t := range values {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// openViews opens (or creates) the DB's views. A view which is new, or whose columns have changed, is filled
+// in from the DB's rows. If removeUndefined is set, the saved views which are no longer among the DB's views
+// are deleted. A read-only DB only opens the views which are saved with the same columns, and leaves the rest
+// alone.
+func (db *DB) openViews(removeUndefined bool) error {
+	var views []*viewDB
+	for _, v := range db.Views {
+		view, err := db.openView(v)
+		if err != nil {
+			return fmt.Errorf("cannot open view %s: %s", v.Name, err)
+		}
+		if view != nil {
+			views = append(views, &viewDB{DB: view, name: v.Name})
+		}
+	}
+	db.views = views
+	if !db.DiskBacked || db.ReadOnly || !removeUndefined {
+		return nil
+	}
+
+	dir := filepath.Join(db.Dir, ViewsDir)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, info := range infos {
+		if db.isView(info.Name()) {
+			continue
+		}
+		Log.Printf("Deleting view %s, which is no longer defined", info.Name())
+		if err := os.RemoveAll(filepath.Join(dir, info.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (db *DB) isView(name string) bool {
+	for _, v := range db.Views {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// openView opens the saved DB of v, or (if it doesn't exist or has different columns) creates and fills it.
+// If the DB is read-only, the result is nil instead of a new view.
+func (db *DB) openView(v View) (*DB, error) {
+	schema := db.viewSchema(v)
+	if !schema.DiskBacked {
+		return NewDB(schema)
+	}
+	saved, err := readSavedSchema(schema.Dir)
+	if err == nil && sameColumnNames(saved, schema) {
+		return OpenDB(schema)
+	}
+	if err != nil && err != DBDoesNotExistErr {
+		return nil, err
+	}
+	if db.ReadOnly {
+		Log.Printf("View %s is missing or has different columns; not using it in the read-only DB", v.Name)
+		return nil, nil
+	}
+	if err == nil {
+		Log.Printf("The columns of view %s have changed; rebuilding it", v.Name)
+	}
+	// A view which was never flushed may have been partly filled.
+	if err := os.RemoveAll(schema.Dir); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(schema.Dir), 0755); err != nil {
+		return nil, err
+	}
+	view, err := NewDB(schema)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.fillView(view); err != nil {
+		return nil, err
+	}
+	return view, nil
+}
+
+// readSavedSchema returns the schema of the DB saved in dir.
+func readSavedSchema(dir string) (*Schema, error) {
+	f, err := os.Open(filepath.Join(dir, MetadataFilename))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, DBDoesNotExistErr
+		}
+		return nil, err
+	}
+	defer f.Close()
+	saved := new(DB)
+	if err := json.NewDecoder(f).Decode(saved); err != nil {
+		return nil, err
+	}
+	return saved.Schema, nil
+}
+
+// sameColumnNames reports whether s and other have the same dimension and metric columns, by name.
+func sameColumnNames(s, other *Schema) bool {
+	if len(s.DimensionColumns) != len(other.DimensionColumns) {
+		return false
+	}
+	if len(s.MetricColumns) != len(other.MetricColumns) {
+		return false
+	}
+	for i, col := range s.DimensionColumns {
+		if col.Name != other.DimensionColumns[i].Name {
+			return false
+		}
+	}
+	for i, col := range s.MetricColumns {
+		if col.Name != other.MetricColumns[i].Name {
+			return false
+		}
+	}
+	return true
+}
+
+// fillView inserts the DB's rows into view, which is empty. The DB is flushed first, so that all of its rows
+// are in the static table.
+func (db *DB) fillView(view *DB) error {
+	if err := db.Flush(); err != nil {
+		return err
+	}
+	resp := db.MakeRequest()
+	defer resp.Done()
+	for t, interval := range resp.StaticTable.Intervals {
+		loaded, release, err := db.coldCache.acquire(interval)
+		if err != nil {
+			return err
+		}
+		var rows []UnpackedRow
+		for _, segment := range loaded.Segments {
+			segmentRows := db.SegmentRows(segment, nil)
+			for i := 0; i < len(segmentRows); i += db.RowSize {
+				row := db.DeserializeRow(RowBytes(segmentRows[i : i+db.RowSize]))
+				for name, value := range row.RowMap {
+					row.RowMap[name] = insertableValue(value)
+				}
+				row.RowMap[db.TimestampColumn.Name] = float64(t.Unix())
+				rows = append(rows, view.projectRow(row))
+			}
+		}
+		release()
+		if err := view.InsertUnpacked(rows); err != nil {
+			return err
+		}
+	}
+	return view.Flush()
+}
+
+// insertableValue converts a value of a deserialized row into one which can be inserted again. Integers are
+// converted to json.Numbers, so that 64-bit values are inserted exactly.
+func insertableValue(value Untyped) Untyped {
+	switch value.(type) {
+	case nil, string:
+		return value
+	case float32, float64:
+		return UntypedToFloat64(value)
+	}
+	return json.Number(fmt.Sprint(value))
+}
+
+// projectRow returns row with only the columns of db.
+func (db *DB) projectRow(row UnpackedRow) UnpackedRow {
+	projected := UnpackedRow{RowMap: make(RowMap), Count: row.Count}
+	for name, value := range row.RowMap {
+		_, isDimension := db.DimensionNameToIndex[name]
+		_, isMetric := db.MetricNameToIndex[name]
+		if isDimension || isMetric || name == db.TimestampColumn.Name {
+			projected.RowMap[name] = value
+		}
+	}
+	return projected
+}
+
+// insertIntoViews inserts the rows which have been inserted into the DB since the last call (db.viewRows)
+// into each of its views. This should only be called by the insertion goroutine.
+func (db *DB) insertIntoViews() error {
+	rows := db.viewRows
+	db.viewRows = nil
+	if len(rows) == 0 {
+		return nil
+	}
+	for _, view := range db.views {
+		projected := make([]UnpackedRow, len(rows))
+		for j, row := range rows {
+			projected[j] = view.projectRow(row)
+		}
+		req := &InsertRequest{Rows: projected, SkipInvalid: true}
+		if err := view.insert(req); err != nil {
+			return fmt.Errorf("cannot insert into view %s: %s", view.name, err)
+		}
+		if len(req.RowErrors) > 0 {
+			Log.Printf("%d rows could not be inserted into view %s (the first error: %s)",
+				len(req.RowErrors), view.name, req.RowErrors[0].Error)
+		}
+	}
+	return nil
+}
+
+// checkViewsCanDelete returns an error unless each of the DB's views has all the columns of filters (which
+// must be timestamp or dimension filters), so that rows can be deleted from the views like the DB.
+func (db *DB) checkViewsCanDelete(filters []QueryFilter) error {
+	for _, view := range db.views {
+		for _, filter := range filters {
+			if filter.Column == db.TimestampColumn.Name {
+				continue
+			}
+			if _, ok := view.DimensionNameToIndex[filter.Column]; !ok {
+				return fmt.Errorf("cannot delete rows by %q, which is not a dimension column of view %s",
+					filter.Column, view.name)
+			}
+		}
+	}
+	return nil
+}
+
+// queryDB returns the DB which answers query: the first of the DB's views which has all the columns that
+// query scans, if the view gives the same results as the DB, or else the DB itself. Percentile aggregates,
+// metric filters, and sampling depend on how rows are collapsed together, so queries with them are always
+// answered by the DB.
+func (db *DB) queryDB(query *Query) *DB {
+	if query.SampleRate > 0 {
+		return db
+	}
+	for _, aggregate := range query.Aggregates {
+		if _, ok := aggregate.Type.Quantile(); ok {
+			return db
+		}
+	}
+	for _, view := range db.views {
+		if view.canAnswer(query) {
+			return view.DB
+		}
+	}
+	return db
+}
+
+// canAnswer reports whether db, a view, has all the columns that query scans (without metric filters).
+func (db *DB) canAnswer(query *Query) bool {
+	for _, aggregate := range query.Aggregates {
+		names := db.MetricNameToIndex
+		if aggregate.Type == AggregateDistinct {
+			names = db.DimensionNameToIndex
+		}
+		if _, ok := names[aggregate.Column]; !ok {
+			return false
+		}
+	}
+	for _, grouping := range query.Groupings {
+		if _, ok := db.DimensionNameToIndex[grouping.Column]; !ok && grouping.Column != db.TimestampColumn.Name {
+			return false
+		}
+	}
+	for _, filter := range query.Filters {
+		if _, ok := db.DimensionNameToIndex[filter.Column]; !ok && filter.Column != db.TimestampColumn.Name {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package gumshoe
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// makeViewTestDB returns a DB with the given views, and the columns dim2 and metric2 besides the fixture's.
+func makeViewTestDB(views []View) *DB {
+	return makeCustomTestDB(true, func(schema *Schema) {
+		schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("dim2", "uint8", true))
+		schema.MetricColumns = append(schema.MetricColumns, makeMetricColumn("metric2", "uint32"))
+		schema.Views = views
+	})
+}
+
+var viewTestRows = []RowMap{
+	{"at": 0.0, "dim1": "a", "dim2": "x", "metric1": 1.0, "metric2": 1.0},
+	{"at": 0.0, "dim1": "a", "dim2": "y", "metric1": 2.0, "metric2": 1.0},
+	{"at": 0.0, "dim1": "b", "dim2": "x", "metric1": 4.0, "metric2": 1.0},
+	{"at": hour(1), "dim1": "a", "dim2": "z", "metric1": 8.0, "metric2": 1.0},
+}
+
+func queryView(t *testing.T, db *DB, query *Query) (view string, result []RowMap) {
+	plan, err := db.GetQueryPlan(query)
+	Assert(t, err, IsNil)
+	return plan.View, runQuery(db, query)
+}
+
+func TestViewAnswersQueries(t *testing.T) {
+	db := makeViewTestDB([]View{
+		{Name: "by_dim1", DimensionColumns: []string{"dim1"}, MetricColumns: []string{"metric1"}},
+	})
+	defer os.RemoveAll(db.Dir)
+	insertRows(db, viewTestRows)
+	Assert(t, physicalRows(db), Equals, 4)
+	Assert(t, physicalRows(db.views[0].DB), Equals, 3)
+
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim1", "dim1"}}
+	view, result := queryView(t, db, query)
+	Assert(t, view, Equals, "by_dim1")
+	Assert(t, result, util.DeepConvertibleEquals, []RowMap{
+		{"dim1": "a", "metric1": 11, "rowCount": 3},
+		{"dim1": "b", "metric1": 4, "rowCount": 1},
+	})
+
+	// Queries using other columns, or metric filters, are answered by the DB.
+	query.Filters = []QueryFilter{{FilterEqual, "dim2", "x"}}
+	view, result = queryView(t, db, query)
+	Assert(t, view, Equals, "")
+	Assert(t, len(result), Equals, 2)
+	query.Filters = []QueryFilter{{FilterGreaterThan, "metric1", 1.0}}
+	view, _ = queryView(t, db, query)
+	Assert(t, view, Equals, "")
+
+	// Rows are deleted from the view too, if it can apply the filters.
+	start, end := time.Unix(0, 0), time.Unix(int64(hour(2)), 0)
+	_, err := db.DeleteRows([]QueryFilter{{FilterEqual, "dim2", "x"}}, start, end)
+	Assert(t, err, NotNil)
+	deleted, err := db.DeleteRows([]QueryFilter{{FilterEqual, "dim1", "b"}}, start, end)
+	Assert(t, err, IsNil)
+	Assert(t, deleted, Equals, 1)
+
+	db = reopenTestDB(db)
+	defer closeTestDB(db)
+	query.Filters = nil
+	view, result = queryView(t, db, query)
+	Assert(t, view, Equals, "by_dim1")
+	Assert(t, result, util.DeepConvertibleEquals, []RowMap{{"dim1": "a", "metric1": 11, "rowCount": 3}})
+}
+
+func TestNewViewIsFilledFromDB(t *testing.T) {
+	db := makeViewTestDB(nil)
+	schema := db.Schema
+	defer os.RemoveAll(schema.Dir)
+	insertRows(db, viewTestRows)
+	// This row is only in the WAL when the DB is reopened.
+	Assert(t, db.Insert([]RowMap{{"at": hour(1), "dim1": "b", "dim2": "x", "metric1": 16.0}}), IsNil)
+	crashTestDB(db)
+
+	schema.Views = []View{
+		{Name: "by_dim2", DimensionColumns: []string{"dim2"}, MetricColumns: []string{"metric1"}},
+	}
+	db, err := OpenDB(schema)
+	Assert(t, err, IsNil)
+	query := createQuery()
+	query.Groupings = []QueryGrouping{{TimeTruncationNone, "dim2", "dim2"}}
+	query.OrderBy = []QueryOrder{{Column: "dim2"}}
+	view, result := queryView(t, db, query)
+	Assert(t, view, Equals, "by_dim2")
+	Assert(t, result, util.DeepConvertibleEquals, []RowMap{
+		{"dim2": "x", "metric1": 21, "rowCount": 3},
+		{"dim2": "y", "metric1": 2, "rowCount": 1},
+		{"dim2": "z", "metric1": 8, "rowCount": 1},
+	})
+
+	// Opening the DB without its schema leaves the views alone, but a view which is no longer defined is
+	// deleted.
+	closeTestDB(db)
+	db, err = OpenDBDir(schema.Dir)
+	Assert(t, err, IsNil)
+	closeTestDB(db)
+	_, err = os.Stat(schema.viewSchema(View{Name: "by_dim2"}).Dir)
+	Assert(t, err, IsNil)
+	schema.Views = nil
+	db, err = OpenDB(schema)
+	Assert(t, err, IsNil)
+	defer closeTestDB(db)
+	_, err = os.Stat(schema.viewSchema(View{Name: "by_dim2"}).Dir)
+	Assert(t, os.IsNotExist(err), IsTrue)
+}
@@ -0,0 +1,202 @@
+// A write-ahead log of the rows inserted since the last flush.
+
+package gumshoe
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// WALFilename is the name of the write-ahead log in a disk-backed DB's directory. Each insert is appended to
+// the log (as a line of JSON; see walEntry) before it is applied to the memtable, and the log is emptied
+// after each flush. Opening a DB replays the log, so rows that were inserted but not yet flushed survive a
+// crash.
+const WALFilename = "wal.log"
+
+// nextWALFilename is the name of the log which replaces the WAL after a flush while rows are held for
+// widening a column (see DB.writeNextWAL).
+const nextWALFilename = "wal.log.next"
+
+type walEntry struct {
+	Seq         uint64 `json:",omitempty"` // Increases with each entry; 0 in logs written before it was added
+	BatchID     string `json:",omitempty"`
+	Rows        []UnpackedRow
+	SkipInvalid bool `json:",omitempty"`
+}
+
+// openWAL replays the rows in db's write-ahead log (if any) into the memtable and opens the log for
+// appending. This must be called before the inserter goroutine starts.
+func (db *DB) openWAL() error {
+	if err := db.recoverNextWAL(); err != nil {
+		return err
+	}
+	filename := filepath.Join(db.Dir, WALFilename)
+	size, err := db.replayWAL(filename)
+	if err != nil {
+		return err
+	}
+	// Drop any bad entry at the end so that new entries will follow the good ones.
+	if err := os.Truncate(filename, size); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	db.wal = f
+	return nil
+}
+
+// replayWAL inserts the rows in the log into the memtable and returns the size of the valid part of the log.
+func (db *DB) replayWAL(filename string) (size int64, err error) {
+	// New entries follow the flushed ones even if the log is gone.
+	db.walSeq = db.FlushedWALSeq
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var batches int
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// An entry without a trailing newline was only partially written (and never acknowledged).
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+		var entry walEntry
+		// Numbers are decoded as json.Numbers so that 64-bit integers stay exact.
+		decoder := json.NewDecoder(bytes.NewReader(line))
+		decoder.UseNumber()
+		if err := decoder.Decode(&entry); err != nil {
+			Log.Printf("Stopping WAL replay at a bad entry (after %d batches): %s", batches, err)
+			break
+		}
+		if entry.Seq > db.walSeq {
+			db.walSeq = entry.Seq
+		}
+		// An entry up to FlushedWALSeq, or a batch which is already in the metadata, was flushed before the WAL
+		// could be truncated.
+		flushed := entry.Seq != 0 && entry.Seq <= db.FlushedWALSeq
+		if !flushed && !db.batchIDSet[entry.BatchID] {
+			// An insert that failed the first time fails the same way again (having inserted the same rows
+			// before the bad one), so the error is only logged.
+			// The rows were accepted when they were first inserted, so they aren't checked for lateness again.
+			if _, err := db.insertRows(entry.Rows, entry.SkipInvalid, time.Time{}); err != nil {
+				Log.Printf("Error replaying WAL entry: %s", err)
+			} else {
+				db.addBatchID(entry.BatchID)
+			}
+		}
+		batches++
+		size += int64(len(line))
+	}
+	Log.Printf("Replayed %d batches of rows from the WAL", batches)
+	return size, nil
+}
+
+// appendWAL durably appends a batch of rows to the write-ahead log. It is a no-op unless db is disk-backed.
+func (db *DB) appendWAL(batchID string, rows []UnpackedRow, skipInvalid bool) error {
+	if db.wal == nil {
+		return nil
+	}
+	b, err := json.Marshal(walEntry{db.walSeq + 1, batchID, rows, skipInvalid})
+	if err != nil {
+		return err
+	}
+	db.walSeq++
+	if _, err := db.wal.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return db.wal.Sync()
+}
+
+// writeNextWAL writes the rows held for widening a column (see PromoteStringOverflow) to a new log, which
+// replaces the WAL once the flush has written its metadata (see replaceWAL). The held rows must be logged
+// again, in an entry after the flush's FlushedWALSeq, because their original entries are skipped as flushed
+// when the WAL is replayed. This is called before the metadata is written, so the held rows are on disk
+// either way: until the metadata is written, the current WAL is the one replayed (see recoverNextWAL).
+func (db *DB) writeNextWAL() (*os.File, error) {
+	filename := filepath.Join(db.Dir, nextWALFilename)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(walEntry{db.walSeq + 1, "", db.heldRows, true})
+	if err == nil {
+		db.walSeq++
+		if _, err = f.Write(append(b, '\n')); err == nil {
+			err = f.Sync()
+		}
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(filename)
+		return nil, err
+	}
+	return f, nil
+}
+
+// replaceWAL makes next, from writeNextWAL, the write-ahead log in place of the flushed one. (If the rename
+// is lost in a crash, recoverNextWAL makes it again.) If it can't, the held rows are appended to the current
+// log instead.
+func (db *DB) replaceWAL(next *os.File) error {
+	if err := os.Rename(next.Name(), filepath.Join(db.Dir, WALFilename)); err != nil {
+		next.Close()
+		os.Remove(next.Name())
+		if appendErr := db.appendWAL("", db.heldRows, true); appendErr != nil {
+			return appendErr
+		}
+		return err
+	}
+	db.wal.Close()
+	db.wal = next
+	return nil
+}
+
+// recoverNextWAL finishes or abandons a replacement of the WAL (see writeNextWAL) which was interrupted by a
+// crash. If the flush wrote its metadata, the held rows' entry immediately follows FlushedWALSeq, and the
+// next log replaces the WAL; otherwise the current WAL still has the held rows, and the next log is removed.
+func (db *DB) recoverNextWAL() error {
+	filename := filepath.Join(db.Dir, nextWALFilename)
+	f, err := os.Open(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	line, err := bufio.NewReader(f).ReadBytes('\n')
+	f.Close()
+	var entry struct{ Seq uint64 }
+	if err == nil {
+		err = json.Unmarshal(line, &entry)
+	}
+	if err == nil && entry.Seq == db.FlushedWALSeq+1 {
+		Log.Println("Replacing the WAL with the held rows logged by the last flush")
+		return os.Rename(filename, filepath.Join(db.Dir, WALFilename))
+	}
+	return os.Remove(filename)
+}
+
+// truncateWAL empties the write-ahead log after the memtable has been flushed.
+func (db *DB) truncateWAL() error {
+	if db.wal == nil {
+		return nil
+	}
+	if err := db.wal.Truncate(0); err != nil {
+		return err
+	}
+	return db.wal.Sync()
+}
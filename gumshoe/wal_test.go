@@ -0,0 +1,192 @@
+package gumshoe
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// crashTestDB shuts down db's goroutines and releases its files without flushing the memtable.
+func crashTestDB(db *DB) {
+	close(db.shutdown)
+	if err := db.wal.Close(); err != nil {
+		panic(err)
+	}
+	if err := db.removeFlock(); err != nil {
+		panic(err)
+	}
+}
+
+func TestWALIsReplayedAfterCrash(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	insertRows(db, []RowMap{{"at": 0.0, "dim1": "string1", "metric1": 1.0}})
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "string1", "metric1": 2.0}}); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+
+	db, err := OpenDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 3)
+
+	// The flush emptied the WAL.
+	stat, err := os.Stat(filepath.Join(db.Dir, WALFilename))
+	Assert(t, err, IsNil)
+	Assert(t, stat.Size(), Equals, int64(0))
+}
+
+func TestWALIsReplayedIntoNewDB(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "string1", "metric1": 5.0}}); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+
+	db, err := NewDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 5)
+}
+
+func TestWALReplayIgnoresTornEntry(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "string1", "metric1": 1.0}}); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+
+	filename := filepath.Join(db.Dir, WALFilename)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`{"Rows":[{"RowMap":{"at":0,"dim1":"string1","metr`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	db, err = NewDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "string1", "metric1": 2.0}}); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+
+	// The torn entry was dropped, so the entry appended after it replays too.
+	db, err = NewDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 3)
+}
+
+func TestWALReplaySkipsFlushedEntries(t *testing.T) {
+	db := makeTestPersistentDB()
+	defer os.RemoveAll(db.Dir)
+
+	// The rows are flushed, but the DB crashes before the WAL is truncated (simulated by restoring it).
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "string1", "metric1": 1.0}}); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(db.Dir, WALFilename)
+	wal, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+	if err := ioutil.WriteFile(filename, wal, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Insert([]RowMap{{"at": 0.0, "dim1": "string1", "metric1": 2.0}}); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+
+	// Only the entry appended after the flush is replayed.
+	db, err = OpenDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	result := runQuery(db, createQuery())
+	Assert(t, result[0]["metric1"], util.DeepConvertibleEquals, 3)
+}
+
+func TestHeldRowsSurviveCrashDuringFlush(t *testing.T) {
+	db := makeStringOverflowTestDB(PromoteStringOverflow, true)
+	defer os.RemoveAll(db.Dir)
+
+	// The flush writes its metadata, but the DB crashes before the WAL is replaced by the one with the held
+	// rows (simulated by restoring the flushed WAL and moving the new one back).
+	insertRows(db, distinctRows(300))
+	filename := filepath.Join(db.Dir, WALFilename)
+	wal, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	crashTestDB(db)
+	if err := os.Rename(filename, filepath.Join(db.Dir, nextWALFilename)); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filename, wal, 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	// The held rows are replayed once.
+	db, err = OpenDB(db.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeTestDB(db)
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	Assert(t, runQuery(db, createQuery())[0]["metric1"], util.DeepConvertibleEquals, 300)
+	_, err = os.Stat(filepath.Join(db.Dir, nextWALFilename))
+	Assert(t, os.IsNotExist(err), IsTrue)
+}
@@ -0,0 +1,104 @@
+// Window functions over time-grouped query results.
+
+package gumshoe
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// A QueryWindow computes a new column for each result row of a query grouped by time from the rows in the
+// surrounding time buckets. The only window function is moving_avg, the average of a column over the row's
+// time bucket and the buckets preceding it. For example:
+//
+//	{"name": "smoothClicks", "window": "moving_avg(clicks, 6 buckets)"}
+//
+// The column may be an aggregate, "rowCount", or an expression. Buckets with no result row (or a null value)
+// are left out of the average; use a TimeFill to count empty buckets as zeros.
+type QueryWindow struct {
+	Name   string
+	Window string
+}
+
+var windowRegexp = regexp.MustCompile(`^\s*moving_avg\(\s*([^,\s]+)\s*,\s*(\d+)(?:\s+buckets?)?\s*\)\s*$`)
+
+// parseWindow parses a window such as "moving_avg(clicks, 6 buckets)" into its column and size.
+func parseWindow(window string) (column string, size int, err error) {
+	matches := windowRegexp.FindStringSubmatch(window)
+	if matches == nil {
+		return "", 0, fmt.Errorf(`expected a window of the form "moving_avg(column, n buckets)"`)
+	}
+	size, err = strconv.Atoi(matches[2])
+	if err != nil || size < 1 {
+		return "", 0, fmt.Errorf("window size must be a positive number of buckets; got %s", matches[2])
+	}
+	return matches[1], size, nil
+}
+
+// ValidateWindows checks that each of q's windows parses and refers to an aggregate, expression, or earlier
+// window. (The query must also be grouped by time; that is checked separately.)
+func (q *Query) ValidateWindows() error {
+	names := map[string]bool{"rowCount": true}
+	for _, aggregate := range q.Aggregates {
+		names[aggregate.Name] = true
+	}
+	for _, expression := range q.Expressions {
+		names[expression.Name] = true
+	}
+	for _, window := range q.Windows {
+		column, _, err := parseWindow(window.Window)
+		if err != nil {
+			return fmt.Errorf("bad window %q: %s", window.Name, err)
+		}
+		if !names[column] {
+			return fmt.Errorf("%q (in window %q) is not the name of an aggregate, expression, or earlier window",
+				column, window.Name)
+		}
+		names[window.Name] = true
+	}
+	return nil
+}
+
+// ApplyWindows computes each of query.Windows for each row and adds the results to the rows. The windows must
+// have been checked with ValidateWindows. bucket is the size of the time buckets (see
+// Query.TimeBucketDuration).
+func ApplyWindows(rows []RowMap, query *Query, bucket time.Duration) {
+	if len(query.Windows) == 0 {
+		return
+	}
+	timeColumn := query.Groupings[0].Name
+	byTime := make(map[int64]RowMap, len(rows))
+	for _, row := range rows {
+		byTime[int64(UntypedToFloat64(row[timeColumn]))] = row
+	}
+	step := int64(bucket / time.Second)
+	for _, window := range query.Windows {
+		column, size, err := parseWindow(window.Window)
+		if err != nil {
+			panic("invalid window")
+		}
+		// Compute all the averages before adding any, since the window's name may be the same as its column.
+		averages := make([]Untyped, len(rows))
+		for i, row := range rows {
+			t := int64(UntypedToFloat64(row[timeColumn]))
+			var sum float64
+			var n int
+			for j := 0; j < size; j++ {
+				other, ok := byTime[t-int64(j)*step]
+				if !ok || other[column] == nil {
+					continue
+				}
+				sum += UntypedToFloat64(other[column])
+				n++
+			}
+			if n > 0 {
+				averages[i] = sum / float64(n)
+			}
+		}
+		for i, row := range rows {
+			row[window.Name] = averages[i]
+		}
+	}
+}
@@ -0,0 +1,19 @@
+// The binary form of the streaming query result format used between a router and its shards.
+
+package gumshoe
+
+import "encoding/gob"
+
+// BinaryStreamContentType is the content type of the binary streaming query result format. A router asks a
+// shard for it by sending this content type in the Accept header of a "format=stream" query; a shard which
+// supports it responds with this Content-Type (older shards respond with the JSON stream).
+//
+// The stream is a sequence of gob-encoded values: a header map[string]int followed by the RowMaps. Unlike
+// JSON, the values keep their types (so large integers don't lose precision) and sketches are sent in their
+// binary encodings as *HyperLogLog and *TDigest values.
+const BinaryStreamContentType = "application/x-gumshoe-gob"
+
+func init() {
+	gob.Register(new(HyperLogLog))
+	gob.Register(new(TDigest))
+}
@@ -0,0 +1,43 @@
+package gumshoe
+
+import (
+	"bytes"
+	"encoding/gob"
+	"testing"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestBinaryStreamRoundTrip(t *testing.T) {
+	sketch := NewHyperLogLog()
+	sketch.Add(1)
+	sketch.Add(2)
+	digest := NewTDigest()
+	digest.Add(3, 1)
+	row := RowMap{
+		"dim1":     "a",
+		"dim2":     nil,
+		"metric1":  uint64(1<<63 + 1), // Not representable as a float64
+		"metric2":  1.5,
+		"distinct": sketch,
+		"p50":      digest,
+		"rowCount": uint32(2),
+	}
+
+	var buf bytes.Buffer
+	encoder := gob.NewEncoder(&buf)
+	Assert(t, encoder.Encode(map[string]int{"num_rows": 1}), IsNil)
+	Assert(t, encoder.Encode(row), IsNil)
+
+	decoder := gob.NewDecoder(&buf)
+	var header map[string]int
+	Assert(t, decoder.Decode(&header), IsNil)
+	Assert(t, header["num_rows"], Equals, 1)
+	decoded := make(RowMap)
+	Assert(t, decoder.Decode(&decoded), IsNil)
+	Assert(t, decoded["metric1"], Equals, uint64(1<<63+1))
+	Assert(t, decoded["rowCount"], Equals, uint32(2))
+	Assert(t, decoded["dim2"], IsNil)
+	Assert(t, decoded["distinct"].(*HyperLogLog).Estimate(), Equals, sketch.Estimate())
+	Assert(t, decoded["p50"].(*TDigest).Quantile(0.5), Equals, digest.Quantile(0.5))
+}
@@ -0,0 +1,179 @@
+// Zone maps: the range of each numeric dimension in each segment, for skipping segments in scans.
+
+package gumshoe
+
+import (
+	"encoding/json"
+	"fmt"
+	"unsafe"
+)
+
+// A ZoneMap records the range of the values of each dimension column in a segment. It is indexed by
+// dimension column; the range is nil for string columns and for columns with no non-nil values in the segment
+// (NaNs don't count, either).
+type ZoneMap []*ZoneRange
+
+// A ZoneRange is the smallest and largest value of a column in a segment, as float64s. (For 64-bit integer
+// columns, these may be rounded.)
+type ZoneRange struct {
+	Min, Max float64
+}
+
+// The metadata has a zone map for every segment, so ranges are encoded compactly, as [min, max].
+
+func (r *ZoneRange) MarshalJSON() ([]byte, error) { return json.Marshal([2]float64{r.Min, r.Max}) }
+
+func (r *ZoneRange) UnmarshalJSON(b []byte) error {
+	var minMax []float64
+	if err := json.Unmarshal(b, &minMax); err != nil {
+		return err
+	}
+	if len(minMax) != 2 {
+		return fmt.Errorf("bad zone range %s", b)
+	}
+	r.Min, r.Max = minMax[0], minMax[1]
+	return nil
+}
+
+// A zoneMapWriter builds the zone maps of the segments of a writeOnlyInterval.
+type zoneMapWriter struct {
+	*Schema
+	valueFuncs []func(cell unsafe.Pointer) float64 // Nil for string columns
+}
+
+func newZoneMapWriter(s *Schema) *zoneMapWriter {
+	w := &zoneMapWriter{Schema: s, valueFuncs: make([]func(unsafe.Pointer) float64, len(s.DimensionColumns))}
+	for i, col := range s.DimensionColumns {
+		if !col.String {
+			w.valueFuncs[i] = makeGetCellValueAsFloat64FuncGen(col.Type)
+		}
+	}
+	return w
+}
+
+// add widens the ranges of zoneMap to include the dimensions of a row.
+func (w *zoneMapWriter) add(zoneMap ZoneMap, dimensions DimensionBytes) {
+	for i, valueFunc := range w.valueFuncs {
+		if valueFunc == nil || dimensions.IsNil(i) {
+			continue
+		}
+		v := valueFunc(unsafe.Pointer(&dimensions[w.DimensionOffsets[i]]))
+		if v != v { // NaN
+			continue
+		}
+		r := zoneMap[i]
+		switch {
+		case r == nil:
+			zoneMap[i] = &ZoneRange{v, v}
+		case v < r.Min:
+			r.Min = v
+		case v > r.Max:
+			r.Max = v
+		}
+	}
+}
+
+// A zoneFilter reports whether a segment may contain rows passing a filter on a dimension column, given the
+// column's range in the segment (nil if it has no non-nil values there).
+type zoneFilter struct {
+	index    int
+	mayMatch func(r *ZoneRange) bool
+}
+
+// makeZoneFilter makes a zone filter for filter, which is on dimension column index. ok is false if the filter
+// can't be checked against zone maps.
+//
+// A zone filter compares the filter's value, converted to the column's type as the row filter does, with the
+// range as float64s. Converting to float64 never reorders values but may make unequal 64-bit integers equal,
+// so a segment is only skipped if the comparison is strict.
+func (s *StaticTable) makeZoneFilter(filter QueryFilter, index int) (zf zoneFilter, ok bool) {
+	col := s.DimensionColumns[index]
+	if col.String {
+		return zf, false
+	}
+	valueFunc := makeGetCellValueAsFloat64FuncGen(col.Type)
+	convert := func(f float64) float64 {
+		var cell [8]byte
+		setRowValue(unsafe.Pointer(&cell[0]), col.Type, f)
+		return valueFunc(unsafe.Pointer(&cell[0]))
+	}
+
+	// All the filters below are false for nil values, so a segment with no non-nil values can't match.
+	var mayMatch func(r *ZoneRange) bool
+	switch filter.Type {
+	case FilterEqual, FilterGreaterThan, FilterGreaterThenOrEqual, FilterLessThan, FilterLessThanOrEqual:
+		f, ok := filter.Value.(float64)
+		if !ok {
+			return zf, false
+		}
+		v := convert(f)
+		switch filter.Type {
+		case FilterEqual:
+			mayMatch = func(r *ZoneRange) bool { return r != nil && !(v < r.Min || v > r.Max) }
+		case FilterGreaterThan, FilterGreaterThenOrEqual:
+			mayMatch = func(r *ZoneRange) bool { return r != nil && !(r.Max < v) }
+		default:
+			mayMatch = func(r *ZoneRange) bool { return r != nil && !(r.Min > v) }
+		}
+	case FilterIn:
+		list, ok := filter.Value.([]interface{})
+		if !ok || len(list) == 0 {
+			return zf, false
+		}
+		values := make([]float64, len(list))
+		for i, v := range list {
+			f, ok := v.(float64)
+			if !ok {
+				// Includes null, which matches nil values.
+				return zf, false
+			}
+			values[i] = convert(f)
+		}
+		mayMatch = func(r *ZoneRange) bool {
+			if r == nil {
+				return false
+			}
+			for _, v := range values {
+				if !(v < r.Min || v > r.Max) {
+					return true
+				}
+			}
+			return false
+		}
+	default:
+		return zf, false
+	}
+	return zoneFilter{index, mayMatch}, true
+}
+
+// segmentMayMatch reports whether segment i of interval may contain rows which pass the query's filters,
+// according to the segment's zone map and bloom filters. Intervals written before zone maps (or bloom
+// filters) were added are always scanned.
+func (p *scanParams) segmentMayMatch(interval *Interval, i int) bool {
+	if i < len(interval.ZoneMaps) {
+		zoneMap := interval.ZoneMaps[i]
+		for _, zf := range p.ZoneFilters {
+			if !zf.mayMatch(zoneMap[zf.index]) {
+				return false
+			}
+		}
+	}
+	if i < len(interval.blooms) {
+		for _, q := range p.BloomQueries {
+			if !q.mayMatch(interval.blooms[i]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// anySegmentMayMatch reports whether segmentMayMatch is true for any segment of interval.
+func (p *scanParams) anySegmentMayMatch(interval *Interval) bool {
+	for i := 0; i < interval.NumSegments; i++ {
+		if p.segmentMayMatch(interval, i) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,111 @@
+package gumshoe
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/util"
+
+	. "github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+// makeZoneMapTestDB returns a DB whose one interval has segments of 4 rows, with dim2 values 0-3, 4-7, and so
+// on, and a final segment holding a row with a nil dim2.
+func makeZoneMapTestDB() *DB {
+	db := makeCustomTestDB(false, func(schema *Schema) {
+		schema.DimensionColumns = append(schema.DimensionColumns, makeDimensionColumn("dim2", "int16", false))
+		schema.Initialize()
+		schema.SegmentSize = 4 * schema.RowSize
+	})
+	var rows []RowMap
+	for i := 0; i < 20; i++ {
+		// Rows are ordered by dim1's dimension table index (the order the strings are first seen), then dim2.
+		rows = append(rows, RowMap{"at": 0.0, "dim1": string('a' + rune(i)), "dim2": float64(i), "metric1": 1.0})
+	}
+	rows = append(rows, RowMap{"at": 0.0, "dim1": "z", "dim2": nil, "metric1": 1.0})
+	insertRows(db, rows)
+	return db
+}
+
+func TestZoneMapsAreRecorded(t *testing.T) {
+	db := makeZoneMapTestDB()
+	defer closeTestDB(db)
+	resp := db.MakeRequest()
+	defer resp.Done()
+
+	for _, interval := range resp.StaticTable.Intervals {
+		Assert(t, len(interval.ZoneMaps), Equals, 6)
+		Assert(t, interval.ZoneMaps[0][0], IsNil) // A string column
+		Assert(t, *interval.ZoneMaps[0][1], Equals, ZoneRange{0, 3})
+		Assert(t, *interval.ZoneMaps[4][1], Equals, ZoneRange{16, 19})
+		Assert(t, interval.ZoneMaps[5][1], IsNil)
+	}
+}
+
+func TestZoneMapsSkipSegments(t *testing.T) {
+	db := makeZoneMapTestDB()
+	defer closeTestDB(db)
+
+	for _, testCase := range []struct {
+		filter   QueryFilter
+		segments int // Segments which may match
+		sum      int
+	}{
+		{QueryFilter{FilterEqual, "dim2", 5.0}, 1, 1},
+		{QueryFilter{FilterEqual, "dim2", 100.0}, 0, 0},
+		{QueryFilter{FilterGreaterThenOrEqual, "dim2", 15.0}, 2, 5},
+		{QueryFilter{FilterGreaterThan, "dim2", 16.0}, 1, 3},
+		{QueryFilter{FilterLessThan, "dim2", 4.0}, 2, 4},
+		{QueryFilter{FilterLessThanOrEqual, "dim2", 3.5}, 1, 4},
+		{QueryFilter{FilterIn, "dim2", []interface{}{1.0, 18.0}}, 2, 2},
+		// These can't skip any segments.
+		{QueryFilter{FilterNotEqual, "dim2", 5.0}, 6, 20},
+		{QueryFilter{FilterIn, "dim2", []interface{}{1.0, nil}}, 6, 2},
+		{QueryFilter{FilterEqual, "dim2", nil}, 6, 1},
+	} {
+		query := createQuery()
+		query.Filters = []QueryFilter{testCase.filter}
+
+		resp := db.MakeRequest()
+		params, err := resp.StaticTable.makeScanParams(query)
+		Assert(t, err, IsNil)
+		segments := 0
+		for _, interval := range resp.StaticTable.Intervals {
+			for i := range interval.Segments {
+				if params.segmentMayMatch(interval, i) {
+					segments++
+				}
+			}
+		}
+		resp.Done()
+		Assert(t, segments, Equals, testCase.segments)
+
+		results := runQuery(db, query)
+		Assert(t, results[0]["metric1"], util.DeepConvertibleEquals, testCase.sum)
+	}
+}
+
+func TestIntervalsWithoutZoneMapsAreScanned(t *testing.T) {
+	db := makeZoneMapTestDB()
+	defer closeTestDB(db)
+	resp := db.MakeRequest()
+	defer resp.Done()
+
+	query := createQuery()
+	query.Filters = []QueryFilter{{FilterEqual, "dim2", 100.0}}
+	params, err := resp.StaticTable.makeScanParams(query)
+	Assert(t, err, IsNil)
+	interval := &Interval{Start: time.Unix(0, 0), Segments: []*Segment{{}}}
+	Assert(t, params.segmentMayMatch(interval, 0), IsTrue)
+}
+
+func TestZoneMapJSON(t *testing.T) {
+	zoneMap := ZoneMap{nil, {-1, 2.5}}
+	b, err := json.Marshal(zoneMap)
+	Assert(t, err, IsNil)
+	Assert(t, string(b), Equals, "[null,[-1,2.5]]")
+	var decoded ZoneMap
+	Assert(t, json.Unmarshal(b, &decoded), IsNil)
+	Assert(t, decoded, DeepEquals, zoneMap)
+}
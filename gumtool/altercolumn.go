@@ -0,0 +1,107 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func init() {
+	commandsByName["alter-column"] = command{
+		description: "rewrite a GumshoeDB database to a new database with a different type for one column",
+		fn:          alterColumn,
+	}
+}
+
+func alterColumn(args []string) {
+	flags := flag.NewFlagSet("gumtool alter-column", flag.ExitOnError)
+	oldDBPath := flags.String("old-db-path", "", "Path of old DB directory")
+	newDBPath := flags.String("new-db-path", "", "Path of new DB directory")
+	column := flags.String("column", "", "Name of the column to change")
+	typ := flags.String("type", "", `New type of the column (such as "uint32" or "string:uint16")`)
+	parallelism := flags.Int("parallelism", 4, "Parallelism for reading old DB")
+	numOpenFiles := flags.Int("rlimit-nofile", 10000, "The value to set RLIMIT_NOFILE")
+	flushSegments := flags.Int("flush-segments", 500, "Flush after every N (old) segments")
+	flags.Parse(args)
+
+	if *oldDBPath == "" || *newDBPath == "" || *column == "" || *typ == "" {
+		log.Fatal("-old-db-path, -new-db-path, -column, and -type are required")
+	}
+
+	// Attempt to raise the open file limit; necessary for big migrations
+	setRlimit(*numOpenFiles)
+
+	oldDB, err := gumshoe.OpenDBDir(*oldDBPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer oldDB.Close()
+
+	schema, err := alteredSchema(oldDB.Schema, *column, *typ)
+	if err != nil {
+		log.Fatal(err)
+	}
+	schema.DiskBacked = true
+	schema.Dir = *newDBPath
+	newDB, err := gumshoe.NewDB(schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer newDB.Close()
+
+	if err := migrateDBs(newDB, oldDB, *parallelism, *flushSegments); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("done")
+}
+
+// alteredSchema returns a copy of schema in which the column called name has the type typ (as written in a
+// config file, such as "uint32" or "string:uint16"). The column must stay a string column or a numeric one.
+// Narrowing a column is allowed, but migrating to the new schema fails if any value doesn't fit.
+func alteredSchema(schema *gumshoe.Schema, name, typ string) (*gumshoe.Schema, error) {
+	isString := strings.HasPrefix(typ, "string:")
+	typ = strings.TrimPrefix(typ, "string:")
+
+	altered := *schema
+	altered.DimensionColumns = append([]gumshoe.DimensionColumn(nil), schema.DimensionColumns...)
+	altered.MetricColumns = append([]gumshoe.MetricColumn(nil), schema.MetricColumns...)
+	// The new DB's intervals are all written with the new schema.
+	altered.Layouts = nil
+
+	var oldType, newType gumshoe.Type
+	if i, ok := schema.DimensionNameToIndex[name]; ok {
+		oldCol := schema.DimensionColumns[i]
+		if isString != oldCol.String {
+			return nil, fmt.Errorf("column %q cannot be changed between a string and a numeric column", name)
+		}
+		col, err := gumshoe.MakeDimensionColumn(name, typ, isString)
+		if err != nil {
+			return nil, err
+		}
+		altered.DimensionColumns[i] = col
+		oldType, newType = oldCol.Type, col.Type
+	} else if i, ok := schema.MetricNameToIndex[name]; ok {
+		if isString {
+			return nil, fmt.Errorf("metric column (%q) cannot have a string type", name)
+		}
+		col, err := gumshoe.MakeMetricColumn(name, typ)
+		if err != nil {
+			return nil, err
+		}
+		altered.MetricColumns[i] = col
+		oldType, newType = schema.MetricColumns[i].Type, col.Type
+	} else {
+		return nil, fmt.Errorf("%q is not a dimension or metric column", name)
+	}
+
+	if newType == oldType {
+		return nil, fmt.Errorf("column %q already has type %s", name, newType)
+	}
+	if err := conversionAllowable(newType, oldType); err != nil {
+		return nil, err
+	}
+	return &altered, nil
+}
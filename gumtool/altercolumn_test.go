@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/util"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestAlterColumn(t *testing.T) {
+	oldDB, err := gumshoe.NewDB(schemaFixture(&migrateTestSchema{
+		[]migrateTestDimensions{{"dim1", "uint8", false}, {"dim2", "uint8", true}},
+		[]migrateTestMetrics{{"metric1", "uint8"}},
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldDB.Close()
+	rows := []gumshoe.RowMap{
+		{"at": 0.0, "dim1": 255.0, "dim2": "a", "metric1": 1.0},
+		{"at": 0.0, "dim1": 1.0, "dim2": "b", "metric1": 255.0},
+	}
+	if err := oldDB.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := oldDB.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, testCase := range []struct {
+		column, typ string
+	}{
+		{"dim1", "uint16"},
+		{"dim2", "string:uint16"},
+		{"metric1", "uint32"},
+	} {
+		schema, err := alteredSchema(oldDB.Schema, testCase.column, testCase.typ)
+		a.Assert(t, err, a.IsNil)
+		newDB, err := gumshoe.NewDB(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.Assert(t, migrateDBs(newDB, oldDB, 4, 10), a.IsNil)
+		a.Assert(t, newDB.GetDebugRows(), util.DeepConvertibleEquals, oldDB.GetDebugRows())
+		a.Assert(t, newDB.RowSize > oldDB.RowSize, a.IsTrue)
+		newDB.Close()
+	}
+
+	for _, testCase := range []struct {
+		column, typ string
+	}{
+		{"dim1", "uint8"},         // Unchanged
+		{"dim1", "string:uint16"}, // Numeric to string
+		{"dim2", "uint16"},        // String to numeric
+		{"metric1", "float32"},    // Integer to float
+		{"at", "uint64"},          // The timestamp column
+		{"dim3", "uint8"},
+	} {
+		_, err := alteredSchema(oldDB.Schema, testCase.column, testCase.typ)
+		a.Assert(t, err, a.NotNil)
+	}
+}
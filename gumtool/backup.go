@@ -0,0 +1,273 @@
+// Incremental backups of a GumshoeDB database.
+//
+// A backup directory holds the DB's segment and dimension table files (in files/) and a manifest for each
+// backup listing the files it needs. These files are never modified once written: when an interval or a
+// dimension table changes, a new generation is written with a new filename. So each backup only copies the
+// files which have appeared since the last backup's manifest, and unchanged files are shared between backups.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func init() {
+	commandsByName["backup"] = command{
+		description: "back up a GumshoeDB database, copying only the files changed since the last backup",
+		fn:          backup,
+	}
+	commandsByName["restore"] = command{
+		description: "restore a GumshoeDB database from a backup",
+		fn:          restore,
+	}
+}
+
+const (
+	backupFilesDir = "files"
+	// A backup starts over if a file is removed by a flush while it's being copied; it gives up after this
+	// many tries.
+	maxBackupAttempts = 5
+)
+
+type backupManifest struct {
+	Time          time.Time
+	Files         []string        // The names of the files (in files/) needed to restore the DB
+	Metadata      json.RawMessage // The DB's metadata file
+	ColdIntervals int             // Intervals in the DB's cold store, which aren't backed up
+}
+
+// manifestName sorts chronologically.
+func manifestName(t time.Time) string {
+	return "manifest." + t.UTC().Format("20060102T150405.000000000Z") + ".json"
+}
+
+func backup(args []string) {
+	flags := flag.NewFlagSet("gumtool backup", flag.ExitOnError)
+	dir := flags.String("dir", "", "the GumshoeDB database directory to back up")
+	backupDir := flags.String("backup-dir", "", "the backup directory (created if it doesn't exist)")
+	flags.Parse(args)
+
+	if *dir == "" || *backupDir == "" {
+		fatalln("-dir and -backup-dir must be provided")
+	}
+	start := time.Now()
+	manifest, copied, err := backupDB(*dir, *backupDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Backed up %d files (%d new) in %s", len(manifest.Files), copied, time.Since(start))
+	if manifest.ColdIntervals > 0 {
+		log.Printf("%d intervals in cold storage were not backed up", manifest.ColdIntervals)
+	}
+}
+
+func restore(args []string) {
+	flags := flag.NewFlagSet("gumtool restore", flag.ExitOnError)
+	backupDir := flags.String("backup-dir", "", "the backup directory")
+	name := flags.String("manifest", "", "the manifest of the backup to restore (by default, the latest)")
+	dir := flags.String("dir", "", "the directory for the restored database (it must not exist)")
+	flags.Parse(args)
+
+	if *backupDir == "" || *dir == "" {
+		fatalln("-backup-dir and -dir must be provided")
+	}
+	manifest, err := restoreDB(*backupDir, *name, *dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Restored the backup from %s", manifest.Time)
+	if manifest.ColdIntervals > 0 {
+		log.Printf("The restored DB has %d intervals in cold storage; it needs the same cold store to open",
+			manifest.ColdIntervals)
+	}
+}
+
+// backupDB backs up the DB in dir to backupDir, which may hold previous backups of the DB. Files listed in the
+// latest previous manifest are not copied again. backupDB returns the new manifest and the number of files
+// copied. The DB may be in use; the backup reflects its most recent flush.
+func backupDB(dir, backupDir string) (manifest *backupManifest, copied int, err error) {
+	if err := os.MkdirAll(filepath.Join(backupDir, backupFilesDir), 0755); err != nil {
+		return nil, 0, err
+	}
+	previous, err := latestManifest(backupDir)
+	if err != nil {
+		return nil, 0, err
+	}
+	backedUp := make(map[string]bool)
+	if previous != nil {
+		for _, name := range previous.Files {
+			backedUp[name] = true
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		manifest, err = readBackupFiles(dir)
+		if err != nil {
+			return nil, 0, err
+		}
+		err = nil
+		for _, name := range manifest.Files {
+			if backedUp[name] {
+				continue
+			}
+			err = copyFileAtomic(filepath.Join(dir, name), filepath.Join(backupDir, backupFilesDir, name))
+			if err != nil {
+				break
+			}
+			backedUp[name] = true
+			copied++
+		}
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) || attempt == maxBackupAttempts {
+			return nil, 0, err
+		}
+		log.Printf("%s was removed during the backup (probably by a flush); starting over", err)
+	}
+
+	manifest.Time = time.Now()
+	b, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, 0, err
+	}
+	filename := filepath.Join(backupDir, manifestName(manifest.Time))
+	if err := writeFileAtomic(filename, bytes.NewReader(b)); err != nil {
+		return nil, 0, err
+	}
+	return manifest, copied, nil
+}
+
+// readBackupFiles returns a manifest (without a time) for the current state of the DB in dir.
+func readBackupFiles(dir string) (*backupManifest, error) {
+	metadata, err := ioutil.ReadFile(filepath.Join(dir, gumshoe.MetadataFilename))
+	if err != nil {
+		return nil, err
+	}
+	db := new(gumshoe.DB)
+	if err := json.Unmarshal(metadata, db); err != nil {
+		return nil, err
+	}
+	// The schema has no Dir, so the filenames are relative to dir.
+	manifest := &backupManifest{Metadata: metadata}
+	for i, dimTable := range db.StaticTable.DimensionTables {
+		if dimTable == nil || dimTable.Generation == 0 {
+			continue
+		}
+		manifest.Files = append(manifest.Files, dimTable.Filename(db.Schema, i))
+	}
+	for _, interval := range db.StaticTable.Intervals {
+		if interval.BloomFilters {
+			manifest.Files = append(manifest.Files, interval.BloomFilename(db.Schema))
+		}
+		if interval.Cold {
+			manifest.ColdIntervals++
+			continue
+		}
+		for i := 0; i < interval.NumSegments; i++ {
+			manifest.Files = append(manifest.Files, interval.SegmentFilename(db.Schema, i))
+		}
+	}
+	sort.Strings(manifest.Files)
+	return manifest, nil
+}
+
+// latestManifest returns the most recent manifest in backupDir, or nil if there are none.
+func latestManifest(backupDir string) (*backupManifest, error) {
+	names, err := filepath.Glob(filepath.Join(backupDir, "manifest.*.json"))
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	sort.Strings(names)
+	return readManifest(names[len(names)-1])
+}
+
+func readManifest(filename string) (*backupManifest, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(backupManifest)
+	if err := json.Unmarshal(b, manifest); err != nil {
+		return nil, fmt.Errorf("bad manifest %s: %s", filename, err)
+	}
+	return manifest, nil
+}
+
+// restoreDB restores the backup in backupDir with the given manifest name (or the latest, if name is "") to a
+// new DB in dir.
+func restoreDB(backupDir, name, dir string) (*backupManifest, error) {
+	var manifest *backupManifest
+	var err error
+	if name == "" {
+		manifest, err = latestManifest(backupDir)
+		if err == nil && manifest == nil {
+			err = fmt.Errorf("no backups found in %s", backupDir)
+		}
+	} else {
+		manifest, err = readManifest(filepath.Join(backupDir, name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return nil, err
+	}
+	for _, name := range manifest.Files {
+		if err := copyFileAtomic(filepath.Join(backupDir, backupFilesDir, name), filepath.Join(dir, name)); err != nil {
+			return nil, err
+		}
+	}
+	// The metadata goes last so that an incomplete restore isn't mistaken for a DB.
+	filename := filepath.Join(dir, gumshoe.MetadataFilename)
+	if err := writeFileAtomic(filename, bytes.NewReader(manifest.Metadata)); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func copyFileAtomic(src, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return writeFileAtomic(dst, f)
+}
+
+// writeFileAtomic writes the contents of r to filename by way of a synced temporary file, so that filename is
+// either complete or missing.
+func writeFileAtomic(filename string, r io.Reader) error {
+	tmpFilename := filename + ".tmp"
+	f, err := os.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpFilename)
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
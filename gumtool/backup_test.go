@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestBackupsAreIncremental(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gumtool-backup-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	schema := schemaFixture(&migrateTestSchema{
+		[]migrateTestDimensions{{"dim1", "uint32", false}},
+		[]migrateTestMetrics{{"metric1", "uint32"}},
+	})
+	schema.DiskBacked = true
+	schema.Dir = filepath.Join(tempDir, "db")
+	db, err := gumshoe.NewDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	backupDir := filepath.Join(tempDir, "backup")
+
+	insert := func(at float64) {
+		rows := []gumshoe.RowMap{
+			{"at": at, "dim1": 1.0, "metric1": 1.0},
+			{"at": at, "dim1": 2.0, "metric1": 1.0},
+		}
+		if err := db.Insert(rows); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	insert(0)
+	manifest, copied, err := backupDB(schema.Dir, backupDir)
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, copied, a.Equals, 1)
+	a.Assert(t, len(manifest.Files), a.Equals, 1)
+
+	// Only the new interval's segment is copied.
+	insert(60 * 60)
+	manifest, copied, err = backupDB(schema.Dir, backupDir)
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, copied, a.Equals, 1)
+	a.Assert(t, len(manifest.Files), a.Equals, 2)
+
+	restoredDir := filepath.Join(tempDir, "restored")
+	_, err = restoreDB(backupDir, "", restoredDir)
+	a.Assert(t, err, a.IsNil)
+	restored, err := gumshoe.OpenDBDir(restoredDir)
+	a.Assert(t, err, a.IsNil)
+	defer restored.Close()
+	a.Assert(t, restored.GetDebugRows(), a.DeepEquals, db.GetDebugRows())
+}
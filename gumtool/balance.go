@@ -121,11 +121,19 @@ func balance(args []string) {
 		}
 		f, err := sftpClient.Open(dest.config)
 		if err != nil {
-			log.Fatalf("Error opening toml config at %s:%s: %s", dest.host, dest.config, err)
+			log.Fatalf("Error opening config at %s:%s: %s", dest.host, dest.config, err)
+		}
+		var schema *gumshoe.Schema
+		switch strings.ToLower(path.Ext(dest.config)) {
+		case ".json":
+			_, schema, err = config.LoadJSONConfig(f, nil)
+		case ".yaml", ".yml":
+			_, schema, err = config.LoadYAMLConfig(f, nil)
+		default:
+			_, schema, err = config.LoadTOMLConfig(f)
 		}
-		_, schema, err := config.LoadTOMLConfig(f)
 		if err != nil {
-			log.Fatalf("Error loading config TOML from %s: %s", dest.host, err)
+			log.Fatalf("Error loading config from %s: %s", dest.host, err)
 		}
 		f.Close()
 		if err := sourceDBs[0].Schema.Equivalent(schema); err != nil {
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/config"
+)
+
+func init() {
+	commandsByName["bench"] = command{
+		description: "load a synthetic dataset into a new database and time a mix of queries over it",
+		fn:          bench,
+	}
+}
+
+// benchQueryKinds are the kinds of query in a benchmark's mix: sums of the metric columns, the same sums of
+// the rows with one value of a dimension column, and the sums grouped by a dimension column.
+var benchQueryKinds = []string{"aggregate", "filter", "groupby"}
+
+// benchInsertBatchSize is the number of rows inserted at once when loading a benchmark's dataset.
+const benchInsertBatchSize = 10000
+
+func bench(args []string) {
+	flags := flag.NewFlagSet("gumtool bench", flag.ExitOnError)
+	configFile := flags.String("config", "config.toml", "the DB config whose schema the dataset follows")
+	dir := flags.String("dir", "", "the directory in which to create the database, which is left in place "+
+		"(by default, the database is only in memory)")
+	numRows := flags.Int("rows", 1000000, "the number of rows to generate")
+	numIntervals := flags.Int("intervals", 24, "the number of (most recent) intervals over which to spread "+
+		"the rows")
+	cardinality := flags.Int("cardinality", 100, "the number of distinct values of each dimension column "+
+		"(at most the number its type can hold)")
+	numQueries := flags.Int("queries", 1000, "the number of queries to run")
+	concurrency := flags.Int("concurrency", 4, "the number of queries to run at once")
+	mixFlag := flags.String("mix", "aggregate=1,filter=1,groupby=1",
+		"the relative frequencies of the kinds of query: "+strings.Join(benchQueryKinds, ", "))
+	seed := flags.Int64("seed", 1, "the seed for generating the dataset and queries")
+	flags.Parse(args)
+
+	if *numRows < 1 || *numIntervals < 1 || *cardinality < 1 || *numQueries < 1 || *concurrency < 1 {
+		fatalln("-rows, -intervals, -cardinality, -queries, and -concurrency must be positive")
+	}
+	mix, err := parseBenchMix(*mixFlag)
+	if err != nil {
+		fatalln(err)
+	}
+
+	_, schema, err := config.LoadConfig(*configFile, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	schema.DiskBacked = *dir != ""
+	schema.Dir = *dir
+	g := newBenchGenerator(schema, *numIntervals, *cardinality, *seed)
+	queries, err := g.queries(mix, *numQueries)
+	if err != nil {
+		fatalln(err)
+	}
+	db, err := gumshoe.NewDB(schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	elapsed, err := loadBenchRows(db, g, *numRows)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("Loaded %d rows in %s (%.0f rows/s)\n\n", *numRows, elapsed, float64(*numRows)/elapsed.Seconds())
+
+	results, elapsed, err := runBenchQueries(db, queries, *concurrency)
+	if err != nil {
+		log.Fatal(err)
+	}
+	printBenchResults(os.Stdout, results, elapsed)
+}
+
+// parseBenchMix parses a query mix of the form "kind=weight,..." into the weight of each kind.
+func parseBenchMix(s string) (map[string]int, error) {
+	mix := make(map[string]int)
+	total := 0
+	for _, part := range strings.Split(s, ",") {
+		pair := strings.SplitN(part, "=", 2)
+		if len(pair) != 2 {
+			return nil, fmt.Errorf("bad query mix entry %q (expected kind=weight)", part)
+		}
+		known := false
+		for _, kind := range benchQueryKinds {
+			known = known || pair[0] == kind
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown query kind %q", pair[0])
+		}
+		weight, err := strconv.Atoi(pair[1])
+		if err != nil || weight < 0 {
+			return nil, fmt.Errorf("bad weight %q for query kind %s", pair[1], pair[0])
+		}
+		mix[pair[0]] = weight
+		total += weight
+	}
+	if total == 0 {
+		return nil, fmt.Errorf("the query mix is empty")
+	}
+	return mix, nil
+}
+
+// A benchGenerator generates the rows of a synthetic dataset with a given schema, and queries over them.
+type benchGenerator struct {
+	schema        *gumshoe.Schema
+	rand          *rand.Rand
+	start         time.Time // Of the first interval
+	numIntervals  int
+	cardinalities []int // Of each dimension column
+}
+
+// newBenchGenerator makes a benchGenerator for rows spread over the numIntervals intervals up to the current
+// one, with cardinality distinct values of each dimension column (or as many as the column can hold).
+func newBenchGenerator(schema *gumshoe.Schema, numIntervals, cardinality int, seed int64) *benchGenerator {
+	current := time.Now().Truncate(schema.IntervalDuration)
+	g := &benchGenerator{
+		schema:       schema,
+		rand:         rand.New(rand.NewSource(seed)),
+		start:        current.Add(-time.Duration(numIntervals-1) * schema.IntervalDuration),
+		numIntervals: numIntervals,
+	}
+	for _, col := range schema.DimensionColumns {
+		n := cardinality
+		// Stay within the positive range of the narrow types (and the dimension tables of string columns).
+		if col.Width < 4 {
+			if max := 1 << uint(8*col.Width-1); n > max {
+				n = max
+			}
+		}
+		g.cardinalities = append(g.cardinalities, n)
+	}
+	return g
+}
+
+func (g *benchGenerator) row() gumshoe.RowMap {
+	row := make(gumshoe.RowMap)
+	interval := g.start.Add(time.Duration(g.rand.Intn(g.numIntervals)) * g.schema.IntervalDuration)
+	offset := time.Duration(g.rand.Int63n(int64(g.schema.IntervalDuration/time.Second))) * time.Second
+	row[g.schema.TimestampColumn.Name] = float64(interval.Add(offset).Unix())
+	for i, col := range g.schema.DimensionColumns {
+		row[col.Name] = g.dimensionValue(i)
+	}
+	for _, col := range g.schema.MetricColumns {
+		row[col.Name] = float64(g.rand.Intn(10))
+	}
+	return row
+}
+
+// dimensionValue returns a random value of the dimension column with the given index.
+func (g *benchGenerator) dimensionValue(i int) gumshoe.Untyped {
+	col := g.schema.DimensionColumns[i]
+	n := g.rand.Intn(g.cardinalities[i])
+	if col.String {
+		return fmt.Sprintf("%s-%d", col.Name, n)
+	}
+	return float64(n)
+}
+
+// A benchQuery is a query of a benchmark and its kind.
+type benchQuery struct {
+	kind  string
+	query *gumshoe.Query
+}
+
+// queries generates n queries, choosing their kinds at random according to mix.
+func (g *benchGenerator) queries(mix map[string]int, n int) ([]benchQuery, error) {
+	if len(g.schema.DimensionColumns) == 0 && mix["filter"]+mix["groupby"] > 0 {
+		return nil, fmt.Errorf("the schema has no dimension columns to filter or group by")
+	}
+	total := 0
+	for _, weight := range mix {
+		total += weight
+	}
+	queries := make([]benchQuery, n)
+	for i := range queries {
+		r := g.rand.Intn(total)
+		var kind string
+		for _, kind = range benchQueryKinds {
+			if r < mix[kind] {
+				break
+			}
+			r -= mix[kind]
+		}
+		query := &gumshoe.Query{}
+		for _, col := range g.schema.MetricColumns {
+			query.Aggregates = append(query.Aggregates,
+				gumshoe.QueryAggregate{Type: gumshoe.AggregateSum, Column: col.Name, Name: col.Name})
+		}
+		switch kind {
+		case "filter":
+			dim := g.rand.Intn(len(g.schema.DimensionColumns))
+			query.Filters = []gumshoe.QueryFilter{{
+				Type:   gumshoe.FilterEqual,
+				Column: g.schema.DimensionColumns[dim].Name,
+				Value:  g.dimensionValue(dim),
+			}}
+		case "groupby":
+			col := g.schema.DimensionColumns[g.rand.Intn(len(g.schema.DimensionColumns))]
+			query.Groupings = []gumshoe.QueryGrouping{{Column: col.Name, Name: col.Name}}
+		}
+		queries[i] = benchQuery{kind, query}
+	}
+	return queries, nil
+}
+
+// loadBenchRows inserts n rows made by g into db and flushes them, returning how long that took.
+func loadBenchRows(db *gumshoe.DB, g *benchGenerator, n int) (time.Duration, error) {
+	start := time.Now()
+	batch := make([]gumshoe.RowMap, 0, benchInsertBatchSize)
+	for i := 0; i < n; i++ {
+		batch = append(batch, g.row())
+		if len(batch) == benchInsertBatchSize || i == n-1 {
+			if err := db.Insert(batch); err != nil {
+				return 0, err
+			}
+			batch = batch[:0]
+		}
+	}
+	if err := db.Flush(); err != nil {
+		return 0, err
+	}
+	return time.Since(start), nil
+}
+
+// A benchResult is the latency of one query of a benchmark.
+type benchResult struct {
+	kind    string
+	latency time.Duration
+}
+
+// runBenchQueries runs queries against db, concurrency at a time. It returns the latency of each query and
+// the time taken to run them all.
+func runBenchQueries(db *gumshoe.DB, queries []benchQuery, concurrency int) ([]benchResult, time.Duration,
+	error) {
+
+	results := make([]benchResult, len(queries))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				queryStart := time.Now()
+				_, err := db.GetQueryResult(context.Background(), queries[i].query)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("%s query: %s", queries[i].kind, err)
+					}
+					mu.Unlock()
+				}
+				results[i] = benchResult{queries[i].kind, time.Since(queryStart)}
+			}
+		}()
+	}
+	for i := range queries {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	return results, time.Since(start), firstErr
+}
+
+// printBenchResults writes the throughput of the queries, which ran in elapsed, and the percentiles of
+// their latencies, by kind and overall.
+func printBenchResults(w io.Writer, results []benchResult, elapsed time.Duration) {
+	latencies := make(map[string][]time.Duration)
+	for _, result := range results {
+		latencies[result.kind] = append(latencies[result.kind], result.latency)
+		latencies["all"] = append(latencies["all"], result.latency)
+	}
+	fmt.Fprintf(w, "Ran %d queries in %s (%.1f queries/s)\n\n", len(results), elapsed,
+		float64(len(results))/elapsed.Seconds())
+	fmt.Fprintf(w, "%-12s%10s%12s%12s%12s%12s\n", "kind", "queries", "p50", "p90", "p99", "max")
+	for _, kind := range append(benchQueryKinds, "all") {
+		l := latencies[kind]
+		if len(l) == 0 {
+			continue
+		}
+		sort.Slice(l, func(i, j int) bool { return l[i] < l[j] })
+		fmt.Fprintf(w, "%-12s%10d%12s%12s%12s%12s\n", kind, len(l), percentile(l, 0.5), percentile(l, 0.9),
+			percentile(l, 0.99), percentile(l, 1))
+	}
+}
+
+// percentile returns the p-th quantile (by the nearest rank) of sorted, rounded for display.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i].Round(10 * time.Microsecond)
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/util"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestParseBenchMix(t *testing.T) {
+	mix, err := parseBenchMix("aggregate=2,groupby=1")
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, mix, a.DeepEquals, map[string]int{"aggregate": 2, "groupby": 1})
+	for _, s := range []string{"", "aggregate", "join=1", "filter=-1", "filter=x", "aggregate=0"} {
+		_, err := parseBenchMix(s)
+		a.Assert(t, err, a.NotNil)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 100; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	a.Assert(t, percentile(latencies, 0.5), a.Equals, 50*time.Millisecond)
+	a.Assert(t, percentile(latencies, 0.99), a.Equals, 99*time.Millisecond)
+	a.Assert(t, percentile(latencies, 1), a.Equals, 100*time.Millisecond)
+	a.Assert(t, percentile(latencies[:1], 0.5), a.Equals, time.Millisecond)
+}
+
+func TestBench(t *testing.T) {
+	schema := schemaFixture(&migrateTestSchema{
+		[]migrateTestDimensions{{"dim1", "uint8", true}, {"dim2", "int16", false}},
+		[]migrateTestMetrics{{"metric1", "uint32"}},
+	})
+	db, err := gumshoe.NewDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	g := newBenchGenerator(db.Schema, 3, 1000, 1)
+	a.Assert(t, g.cardinalities, a.DeepEquals, []int{128, 1000})
+	_, err = loadBenchRows(db, g, 500)
+	a.Assert(t, err, a.IsNil)
+	result, err := db.GetQueryResult(context.Background(), &gumshoe.Query{
+		Aggregates: []gumshoe.QueryAggregate{{Type: gumshoe.AggregateSum, Column: "metric1", Name: "metric1"}},
+	})
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, result[0]["rowCount"], util.DeepConvertibleEquals, 500)
+
+	mix, err := parseBenchMix("aggregate=1,filter=1,groupby=1")
+	a.Assert(t, err, a.IsNil)
+	queries, err := g.queries(mix, 30)
+	a.Assert(t, err, a.IsNil)
+	results, _, err := runBenchQueries(db, queries, 2)
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, len(results), a.Equals, 30)
+
+	var buf bytes.Buffer
+	printBenchResults(&buf, results, time.Second)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	a.Assert(t, lines[0], a.Equals, "Ran 30 queries in 1s (30.0 queries/s)")
+	a.Assert(t, strings.Fields(lines[len(lines)-1])[:2], a.DeepEquals, []string{"all", "30"})
+}
@@ -38,23 +38,40 @@ func clean(args []string) {
 		fatalln(err)
 	}
 
-	var expectedDimensionFiles []string
-	for i, dimTable := range db.StaticTable.DimensionTables {
+	files := referencedFiles(db.Schema, db.StaticTable)
+	warnMissingAndRemoveExtras(files.dimensionTables, "dimension table", *dir, "dimension.*.gob.gz")
+	warnMissingAndRemoveExtras(files.segments, "interval", *dir, "interval.*.dat")
+	warnMissingAndRemoveExtras(files.bloomFilters, "bloom filter", *dir, "interval.*.bloom")
+}
+
+// dbFiles are the base names of the files of a DB's data.
+type dbFiles struct {
+	dimensionTables []string
+	segments        []string // Only those stored locally
+	bloomFilters    []string
+}
+
+// referencedFiles returns the files of the data in st, a StaticTable of a DB with schema s.
+func referencedFiles(s *gumshoe.Schema, st *gumshoe.StaticTable) *dbFiles {
+	files := new(dbFiles)
+	for i, dimTable := range st.DimensionTables {
 		if dimTable == nil || dimTable.Generation == 0 {
 			continue
 		}
-		expectedDimensionFiles = append(expectedDimensionFiles, dimTable.Filename(db.Schema, i))
+		files.dimensionTables = append(files.dimensionTables, filepath.Base(dimTable.Filename(s, i)))
 	}
-
-	var expectedIntervalFiles []string
-	for _, interval := range db.StaticTable.Intervals {
+	for _, interval := range st.Intervals {
+		if interval.BloomFilters {
+			files.bloomFilters = append(files.bloomFilters, filepath.Base(interval.BloomFilename(s)))
+		}
+		if interval.Cold {
+			continue
+		}
 		for i := 0; i < interval.NumSegments; i++ {
-			expectedIntervalFiles = append(expectedIntervalFiles, interval.SegmentFilename(db.Schema, i))
+			files.segments = append(files.segments, filepath.Base(interval.SegmentFilename(s, i)))
 		}
 	}
-
-	warnMissingAndRemoveExtras(expectedDimensionFiles, "dimension table", *dir, "dimension.*.gob.gz")
-	warnMissingAndRemoveExtras(expectedIntervalFiles, "interval", *dir, "interval.*.dat")
+	return files
 }
 
 func warnMissingAndRemoveExtras(expected []string, typeDescription, dir, glob string) {
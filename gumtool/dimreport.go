@@ -0,0 +1,281 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"unsafe"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func init() {
+	commandsByName["dim-report"] = command{
+		description: "report each dimension's cardinality, size, and the savings from dropping or re-bucketing it",
+		fn:          dimReport,
+	}
+}
+
+func dimReport(args []string) {
+	flags := flag.NewFlagSet("gumtool dim-report", flag.ExitOnError)
+	dir := flags.String("dir", "", "the GumshoeDB database directory to report on")
+	var bucketFlags stringsFlag
+	flags.Var(&bucketFlags, "bucket", "a numeric dimension column and bucket size (such as age=10) for which "+
+		"to estimate the savings from rounding its values down to multiples of the size (may be repeated)")
+	parallelism := flags.Int("parallelism", 4, "Parallelism for reading the DB")
+	numOpenFiles := flags.Int("rlimit-nofile", 10000, "The value to set RLIMIT_NOFILE")
+	flags.Parse(args)
+
+	if *dir == "" {
+		fatalln("-dir must be provided")
+	}
+	buckets := make(map[string]float64)
+	for _, s := range bucketFlags {
+		pair := strings.SplitN(s, "=", 2)
+		if len(pair) != 2 {
+			fatalf("bad -bucket %q (expected column=size)\n", s)
+		}
+		size, err := strconv.ParseFloat(pair[1], 64)
+		if err != nil || size <= 0 {
+			fatalf("bad bucket size %q for column %s\n", pair[1], pair[0])
+		}
+		buckets[pair[0]] = size
+	}
+
+	setRlimit(*numOpenFiles)
+
+	// The dimension tables' file sizes are read from the metadata, as by gumtool inspect.
+	layout, err := inspectDB(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dimTableBytes := make(map[string]int64)
+	for _, table := range layout.DimensionTables {
+		dimTableBytes[table.Column] = table.Bytes
+	}
+
+	db, err := gumshoe.OpenDBDirReadOnly(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	report, err := makeDimReport(db, dimTableBytes, buckets, *parallelism)
+	if err != nil {
+		fatalln(err)
+	}
+	report.print()
+}
+
+// A dimensionReport describes how much of a DB's segment data each of its dimension columns accounts for.
+type dimensionReport struct {
+	NumRows  int   // The number of (collapsed) rows in the segments
+	RowBytes int64 // The total size of those rows
+	Columns  []dimColumnReport
+}
+
+type dimColumnReport struct {
+	Column      string
+	Cardinality int // The number of distinct non-nil values in the rows
+	NilRows     int
+	// Bytes is the size of the column's values in the rows, plus its dimension table for a string column.
+	Bytes int64
+	// DropSavings estimates the bytes saved by deleting the column: its Bytes, and the rows which would collapse
+	// together without it.
+	DropSavings int64
+	// BucketSize, if not 0, is the size of the buckets for which BucketSavings estimates the bytes saved by
+	// the rows which would collapse together if the column's values were rounded down to multiples of it.
+	BucketSize    float64
+	BucketSavings int64
+}
+
+// makeDimReport reads every segment of db. dimTableBytes gives the size of the dimension table of each string
+// column and buckets gives the bucket sizes to estimate savings for, by column.
+func makeDimReport(db *gumshoe.DB, dimTableBytes map[string]int64, buckets map[string]float64,
+	parallelism int) (*dimensionReport, error) {
+
+	for name := range buckets {
+		i, ok := db.DimensionNameToIndex[name]
+		if !ok {
+			return nil, fmt.Errorf("%q is not a dimension column", name)
+		}
+		if db.DimensionColumns[i].String {
+			return nil, fmt.Errorf("string column %q cannot be re-bucketed", name)
+		}
+	}
+
+	resp := db.MakeRequest()
+	defer resp.Done()
+
+	// Rows collapse within an interval, so each interval is read by one worker.
+	var allIntervals [][]*timestampSegment
+	for t, interval := range resp.StaticTable.Intervals {
+		var segments []*timestampSegment
+		for _, segment := range interval.Segments {
+			segments = append(segments, &timestampSegment{segment, t})
+		}
+		allIntervals = append(allIntervals, segments)
+	}
+	progress := NewProgress("intervals processed", len(allIntervals))
+	progress.Print()
+	intervals := make(chan []*timestampSegment)
+	partials := make([]*dimStats, parallelism)
+
+	var wg sync.WaitGroup
+	wg.Add(parallelism)
+	for i := 0; i < parallelism; i++ {
+		i := i
+		go func() {
+			defer wg.Done()
+			partial := newDimStats(db, buckets)
+			for segments := range intervals {
+				partial.addInterval(segments)
+				progress.Add(1)
+			}
+			partials[i] = partial
+		}()
+	}
+	for _, segments := range allIntervals {
+		intervals <- segments
+	}
+	close(intervals)
+	wg.Wait()
+
+	total := partials[0]
+	for _, partial := range partials[1:] {
+		total.merge(partial)
+	}
+
+	report := &dimensionReport{NumRows: total.numRows, RowBytes: int64(total.numRows * db.RowSize)}
+	for i, col := range db.DimensionColumns {
+		cr := dimColumnReport{
+			Column:      col.Name,
+			Cardinality: len(total.values[i]),
+			NilRows:     total.nilRows[i],
+			Bytes:       int64(total.numRows*col.Width) + dimTableBytes[col.Name],
+		}
+		cr.DropSavings = cr.Bytes + int64((total.numRows-total.rowsWithoutColumn[i])*(db.RowSize-col.Width))
+		if size, ok := buckets[col.Name]; ok {
+			cr.BucketSize = size
+			cr.BucketSavings = int64((total.numRows - total.rowsBucketed[i]) * db.RowSize)
+		}
+		report.Columns = append(report.Columns, cr)
+	}
+	return report, nil
+}
+
+// dimStats accumulates the counts behind a dimensionReport over some intervals.
+type dimStats struct {
+	db      *gumshoe.DB
+	buckets []float64 // By dimension column; 0 if the column isn't re-bucketed
+	numRows int
+	values  []map[string]struct{} // The distinct (serialized) values of each column
+	nilRows []int
+	// The numbers of rows there would be if each column were deleted or re-bucketed.
+	rowsWithoutColumn []int
+	rowsBucketed      []int
+}
+
+func newDimStats(db *gumshoe.DB, buckets map[string]float64) *dimStats {
+	n := len(db.DimensionColumns)
+	s := &dimStats{
+		db:                db,
+		buckets:           make([]float64, n),
+		values:            make([]map[string]struct{}, n),
+		nilRows:           make([]int, n),
+		rowsWithoutColumn: make([]int, n),
+		rowsBucketed:      make([]int, n),
+	}
+	for i, col := range db.DimensionColumns {
+		s.buckets[i] = buckets[col.Name]
+		s.values[i] = make(map[string]struct{})
+	}
+	return s
+}
+
+// addInterval counts the rows of the segments of one interval.
+func (s *dimStats) addInterval(segments []*timestampSegment) {
+	db := s.db
+	// The rows of the interval, keyed by their dimensions with one column changed, for each column.
+	withoutColumn := make([]map[string]struct{}, len(db.DimensionColumns))
+	bucketed := make([]map[string]struct{}, len(db.DimensionColumns))
+	for i := range withoutColumn {
+		withoutColumn[i] = make(map[string]struct{})
+		if s.buckets[i] > 0 {
+			bucketed[i] = make(map[string]struct{})
+		}
+	}
+	key := make([]byte, db.MetricStartOffset-db.DimensionStartOffset)
+	var buf []byte
+	for _, segment := range segments {
+		rows := db.SegmentRows(segment.Segment, &buf)
+		for j := 0; j < len(rows); j += db.RowSize {
+			s.numRows++
+			dimensions := gumshoe.DimensionBytes(rows[j+db.DimensionStartOffset : j+db.MetricStartOffset])
+			for i, col := range db.DimensionColumns {
+				offset := db.DimensionOffsets[i]
+				cell := dimensions[offset : offset+col.Width]
+				isNil := dimensions.IsNil(i)
+				if isNil {
+					s.nilRows[i]++
+				} else {
+					s.values[i][string(cell)] = struct{}{}
+				}
+
+				copy(key, dimensions)
+				key[i>>3] &^= 1 << byte(i&7)
+				for k := range key[offset : offset+col.Width] {
+					key[offset+k] = 0
+				}
+				withoutColumn[i][string(key)] = struct{}{}
+				if bucketed[i] != nil {
+					bucket := "nil"
+					if !isNil {
+						value := gumshoe.UntypedToFloat64(gumshoe.NumericCellValue(unsafe.Pointer(&cell[0]), col.Type))
+						bucket = strconv.FormatFloat(math.Floor(value/s.buckets[i]), 'g', -1, 64)
+					}
+					bucketed[i][string(key)+bucket] = struct{}{}
+				}
+			}
+		}
+	}
+	for i := range withoutColumn {
+		s.rowsWithoutColumn[i] += len(withoutColumn[i])
+		s.rowsBucketed[i] += len(bucketed[i])
+	}
+}
+
+func (s *dimStats) merge(other *dimStats) {
+	s.numRows += other.numRows
+	for i := range s.values {
+		for value := range other.values[i] {
+			s.values[i][value] = struct{}{}
+		}
+		s.nilRows[i] += other.nilRows[i]
+		s.rowsWithoutColumn[i] += other.rowsWithoutColumn[i]
+		s.rowsBucketed[i] += other.rowsBucketed[i]
+	}
+}
+
+func (r *dimensionReport) print() {
+	fmt.Printf("%d rows (%s)\n", r.NumRows, humanBytes(r.RowBytes))
+	if r.NumRows == 0 {
+		return
+	}
+	fmt.Println()
+	fmt.Printf("%-34s%12s%12s%12s%8s%14s%20s\n",
+		"column", "cardinality", "nil rows", "size", "%", "drop saves", "bucket saves")
+	for _, col := range r.Columns {
+		bucketSavings := ""
+		if col.BucketSize > 0 {
+			bucketSavings = fmt.Sprintf("%s (%g)", humanBytes(col.BucketSavings), col.BucketSize)
+		}
+		fmt.Printf("%-34s%12d%12d%12s%8.1f%14s%20s\n", col.Column, col.Cardinality, col.NilRows,
+			humanBytes(col.Bytes), percent(int(col.Bytes), int(r.RowBytes)), humanBytes(col.DropSavings),
+			bucketSavings)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestMakeDimReport(t *testing.T) {
+	schema := schemaFixture(&migrateTestSchema{
+		[]migrateTestDimensions{{"dim1", "uint8", true}, {"dim2", "uint16", false}},
+		[]migrateTestMetrics{{"metric1", "uint32"}},
+	})
+	db, err := gumshoe.NewDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows := []gumshoe.RowMap{
+		{"at": 0.0, "dim1": "a", "dim2": 1.0, "metric1": 1.0},
+		{"at": 0.0, "dim1": "a", "dim2": 2.0, "metric1": 1.0},
+		{"at": 0.0, "dim1": "b", "dim2": 1.0, "metric1": 1.0},
+		{"at": 0.0, "dim1": "b", "dim2": 12.0, "metric1": 1.0},
+		{"at": 3600.0, "dim1": "a", "dim2": 1.0, "metric1": 1.0},
+		{"at": 3600.0, "dim1": "c", "dim2": nil, "metric1": 1.0},
+	}
+	if err := db.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = makeDimReport(db, nil, map[string]float64{"dim1": 10}, 2)
+	a.Assert(t, err, a.NotNil)
+	_, err = makeDimReport(db, nil, map[string]float64{"dim3": 10}, 2)
+	a.Assert(t, err, a.NotNil)
+
+	report, err := makeDimReport(db, map[string]int64{"dim1": 100}, map[string]float64{"dim2": 10}, 2)
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, report.NumRows, a.Equals, 6)
+	a.Assert(t, report.RowBytes, a.Equals, int64(6*db.RowSize))
+	a.Assert(t, report.Columns, a.DeepEquals, []dimColumnReport{
+		{
+			Column:      "dim1",
+			Cardinality: 3,
+			Bytes:       6*1 + 100,
+			// Without dim1, the rows with dim2 = 1 in the first interval collapse.
+			DropSavings: 6*1 + 100 + 1*int64(db.RowSize-1),
+		},
+		{
+			Column:      "dim2",
+			Cardinality: 3,
+			NilRows:     1,
+			Bytes:       6 * 2,
+			// Without dim2, the rows of each dim1 value in the first interval collapse.
+			DropSavings: 6*2 + 2*int64(db.RowSize-2),
+			BucketSize:  10,
+			// Rounded down to multiples of 10, the rows with dim1 = "a" in the first interval collapse.
+			BucketSavings: 1 * int64(db.RowSize),
+		},
+	})
+}
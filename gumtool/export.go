@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func init() {
+	commandsByName["export"] = command{
+		description: "write the rows of a GumshoeDB database to a CSV or Parquet file",
+		fn:          export,
+	}
+}
+
+func export(args []string) {
+	flags := flag.NewFlagSet("gumtool export", flag.ExitOnError)
+	dir := flags.String("dir", "", "the GumshoeDB database directory to export")
+	format := flags.String("format", "csv", "the output format: csv or parquet")
+	start := flags.String("start", "", "export the intervals starting at or after this time "+
+		"(RFC 3339 or Unix seconds); by default, the first interval")
+	end := flags.String("end", "", "export the intervals starting before this time (RFC 3339 or Unix seconds); "+
+		"by default, the last interval")
+	out := flags.String("out", "", "the file to write (by default, stdout)")
+	flags.Parse(args)
+
+	if *dir == "" {
+		fatalln("-dir must be provided")
+	}
+	var startTime, endTime time.Time
+	var err error
+	if *start != "" {
+		if startTime, err = parseExportTime(*start); err != nil {
+			fatalln("bad -start:", err)
+		}
+	}
+	if *end != "" {
+		if endTime, err = parseExportTime(*end); err != nil {
+			fatalln("bad -end:", err)
+		}
+	}
+
+	db, err := gumshoe.OpenDBDirReadOnly(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	// log.Fatal doesn't run deferred functions, so the file is closed (and the error checked) explicitly.
+	var f *os.File
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		if f, err = os.Create(*out); err != nil {
+			log.Fatal(err)
+		}
+		w = f
+	}
+	bw := bufio.NewWriter(w)
+	rw, err := newExportWriter(bw, db.Schema, *format)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := exportRows(rw, db, startTime, endTime)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := bw.Flush(); err != nil {
+		log.Fatal(err)
+	}
+	if f != nil {
+		if err := f.Close(); err != nil {
+			log.Fatal(err)
+		}
+	}
+	log.Printf("Exported %d rows", n)
+}
+
+// parseExportTime parses s as either an RFC 3339 time or a number of seconds since the Unix epoch.
+func parseExportTime(s string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// An exportWriter writes the exported rows in some format.
+type exportWriter interface {
+	Write(row gumshoe.RowMap) error
+	Close() error // Writes out anything buffered
+}
+
+// delimitedExportWriter adapts a gumshoe.DelimitedWriter to an exportWriter.
+type delimitedExportWriter struct {
+	*gumshoe.DelimitedWriter
+}
+
+func (w delimitedExportWriter) Close() error { return w.Flush() }
+
+// exportColumns returns the columns of the exported rows of a DB with schema s: the timestamp column, the
+// dimension columns, the metric columns, and rowCount, the number of inserted rows which were collapsed into
+// each row.
+func exportColumns(s *gumshoe.Schema) []string {
+	columns := []string{s.TimestampColumn.Name}
+	for _, col := range s.DimensionColumns {
+		columns = append(columns, col.Name)
+	}
+	for _, col := range s.MetricColumns {
+		columns = append(columns, col.Name)
+	}
+	return append(columns, "rowCount")
+}
+
+func newExportWriter(w io.Writer, s *gumshoe.Schema, format string) (exportWriter, error) {
+	switch format {
+	case "csv":
+		dw, err := gumshoe.NewDelimitedWriter(w, exportColumns(s), ',')
+		if err != nil {
+			return nil, err
+		}
+		return delimitedExportWriter{dw}, nil
+	case "parquet":
+		return s.NewParquetWriter(w, exportColumns(s))
+	}
+	return nil, fmt.Errorf("unknown export format %q", format)
+}
+
+// exportRows writes the rows of the intervals of db which start in [start, end) to w, in order of time. A
+// zero start or end leaves that end of the range open. Cold intervals are skipped. It returns the number of
+// rows written.
+func exportRows(w exportWriter, db *gumshoe.DB, start, end time.Time) (int, error) {
+	resp := db.MakeRequest()
+	defer resp.Done()
+
+	var timestamps []time.Time
+	for t := range resp.StaticTable.Intervals {
+		if (start.IsZero() || !t.Before(start)) && (end.IsZero() || t.Before(end)) {
+			timestamps = append(timestamps, t)
+		}
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i].Before(timestamps[j]) })
+
+	var buf []byte // Compressed segments are decoded into buf
+	n := 0
+	for _, t := range timestamps {
+		interval := resp.StaticTable.Intervals[t]
+		if interval.Cold {
+			log.Printf("Skipping the interval at %s, which is in cold storage", t)
+			continue
+		}
+		for _, segment := range interval.Segments {
+			rows := db.SegmentRows(segment, &buf)
+			for i := 0; i < len(rows); i += db.RowSize {
+				row := db.DeserializeRow(gumshoe.RowBytes(rows[i : i+db.RowSize]))
+				row.RowMap[db.TimestampColumn.Name] = t.Unix()
+				row.RowMap["rowCount"] = row.Count
+				if err := w.Write(row.RowMap); err != nil {
+					return n, err
+				}
+				n++
+			}
+		}
+	}
+	return n, w.Close()
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestExportRows(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gumtool-export-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	schema := schemaFixture(&migrateTestSchema{
+		[]migrateTestDimensions{{"dim1", "uint8", true}, {"dim2", "float32", false}},
+		[]migrateTestMetrics{{"metric1", "uint32"}},
+	})
+	schema.DiskBacked = true
+	schema.Dir = tempDir
+	db, err := gumshoe.NewDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows := []gumshoe.RowMap{
+		{"at": 0.0, "dim1": "a", "dim2": 1.5, "metric1": 1.0},
+		{"at": 0.0, "dim1": "a", "dim2": 1.5, "metric1": 2.0},
+		{"at": 3600.0, "dim1": "b", "dim2": nil, "metric1": 3.0},
+		{"at": 7200.0, "dim1": nil, "dim2": 2.0, "metric1": 4.0},
+	}
+	if err := db.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	w, err := newExportWriter(&buf, db.Schema, "csv")
+	a.Assert(t, err, a.IsNil)
+	n, err := exportRows(w, db, time.Time{}, time.Unix(7200, 0))
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, n, a.Equals, 2)
+	a.Assert(t, buf.String(), a.Equals, "at,dim1,dim2,metric1,rowCount\n0,a,1.5,3,2\n3600,b,,3,1\n")
+
+	buf.Reset()
+	w, err = newExportWriter(&buf, db.Schema, "parquet")
+	a.Assert(t, err, a.IsNil)
+	n, err = exportRows(w, db, time.Unix(3600, 0), time.Time{})
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, n, a.Equals, 2)
+	b := buf.Bytes()
+	a.Assert(t, string(b[:4]), a.Equals, "PAR1")
+	a.Assert(t, string(b[len(b)-4:]), a.Equals, "PAR1")
+
+	_, err = newExportWriter(&buf, db.Schema, "json")
+	a.Assert(t, err, a.NotNil)
+}
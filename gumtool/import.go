@@ -0,0 +1,130 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/wait"
+)
+
+func init() {
+	commandsByName["import"] = command{
+		description: "load the rows of a Parquet file directly into a GumshoeDB database",
+		fn:          importFile,
+	}
+}
+
+func importFile(args []string) {
+	flags := flag.NewFlagSet("gumtool import", flag.ExitOnError)
+	var mappingPairs stringsFlag
+	dir := flags.String("dir", "", "the GumshoeDB database directory to load the rows into")
+	format := flags.String("format", "parquet", "the input format (only parquet is supported)")
+	in := flags.String("in", "", "the file to import")
+	flags.Var(&mappingPairs, "map", "comma-separated inputColumn:schemaColumn pairs mapping the input columns "+
+		"to schema columns (by default, the columns must have the same names as the schema columns)")
+	countColumn := flags.String("count-column", "rowCount", "the input column, if any, which gives the number "+
+		"of inserted rows each row stands for (as written by gumtool export)")
+	parallelism := flags.Int("parallelism", 4, "the number of row groups to read at once")
+	flushRowGroups := flags.Int("flush-row-groups", 20, "flush after importing each N row groups")
+	flags.Parse(args)
+
+	if *dir == "" || *in == "" {
+		fatalln("-dir and -in must be provided")
+	}
+	if *format != "parquet" {
+		fatalf("unsupported import format %q (only parquet is supported)\n", *format)
+	}
+	mapping, err := gumshoe.ParseCSVMapping(mappingPairs)
+	if err != nil {
+		fatalln(err)
+	}
+
+	db, err := gumshoe.OpenDBDir(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	f, err := os.Open(*in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	stat, err := f.Stat()
+	if err != nil {
+		log.Fatal(err)
+	}
+	r, err := db.Schema.NewParquetReader(f, stat.Size(), mapping, *countColumn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := importParquet(db, r, *parallelism, *flushRowGroups)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Imported %d rows", n)
+}
+
+// importParquet inserts the rows of r into db, reading parallelism row groups at once and flushing after
+// each flushRowGroups row groups (and at the end). The flushes write out the new intervals concurrently. It
+// returns the number of rows imported.
+func importParquet(db *gumshoe.DB, r *gumshoe.ParquetReader, parallelism, flushRowGroups int) (int, error) {
+	progress := NewProgress("row groups imported", r.NumRowGroups())
+	progress.Print()
+	var imported int64
+	rowGroups := make(chan int)
+	var wg wait.Group
+	for i := 0; i < parallelism; i++ {
+		wg.Go(func(quit <-chan struct{}) error {
+			for {
+				select {
+				case <-quit:
+					return nil
+				case i, ok := <-rowGroups:
+					if !ok {
+						return nil
+					}
+					rows, err := r.ReadRowGroup(i)
+					if err != nil {
+						return err
+					}
+					if err := db.InsertUnpacked(rows); err != nil {
+						return fmt.Errorf("Parquet row group %d: %s", i, err)
+					}
+					atomic.AddInt64(&imported, int64(len(rows)))
+					progress.Add(1)
+				}
+			}
+		})
+	}
+
+	wg.Go(func(quit <-chan struct{}) error {
+		flushRowGroupCount := 0
+		for i := 0; i < r.NumRowGroups(); i++ {
+			select {
+			case <-quit:
+				return nil
+			case rowGroups <- i:
+				flushRowGroupCount++
+				if flushRowGroupCount == flushRowGroups {
+					flushRowGroupCount = 0
+					if err := db.Flush(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		close(rowGroups)
+		return nil
+	})
+
+	if err := wg.Wait(); err != nil {
+		return int(imported), err
+	}
+	return int(imported), db.Flush()
+}
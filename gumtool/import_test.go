@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestImportParquet(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gumtool-import-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	newDB := func(name string) *gumshoe.DB {
+		schema := schemaFixture(&migrateTestSchema{
+			[]migrateTestDimensions{{"dim1", "uint8", true}, {"dim2", "float32", false}},
+			[]migrateTestMetrics{{"metric1", "uint32"}},
+		})
+		schema.DiskBacked = true
+		schema.Dir = filepath.Join(tempDir, name)
+		db, err := gumshoe.NewDB(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return db
+	}
+	exportCSV := func(db *gumshoe.DB) string {
+		var buf bytes.Buffer
+		w, err := newExportWriter(&buf, db.Schema, "csv")
+		a.Assert(t, err, a.IsNil)
+		_, err = exportRows(w, db, time.Time{}, time.Time{})
+		a.Assert(t, err, a.IsNil)
+		return buf.String()
+	}
+
+	db := newDB("old")
+	defer db.Close()
+	rows := []gumshoe.RowMap{
+		{"at": 0.0, "dim1": "a", "dim2": 1.5, "metric1": 1.0},
+		{"at": 0.0, "dim1": "a", "dim2": 1.5, "metric1": 2.0},
+		{"at": 3600.0, "dim1": "b", "dim2": nil, "metric1": 3.0},
+		{"at": 7200.0, "dim1": nil, "dim2": 2.0, "metric1": 4.0},
+	}
+	if err := db.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w, err := newExportWriter(&buf, db.Schema, "parquet")
+	a.Assert(t, err, a.IsNil)
+	_, err = exportRows(w, db, time.Time{}, time.Time{})
+	a.Assert(t, err, a.IsNil)
+
+	imported := newDB("new")
+	defer imported.Close()
+	r, err := imported.Schema.NewParquetReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()), nil, "rowCount")
+	a.Assert(t, err, a.IsNil)
+	n, err := importParquet(imported, r, 2, 1)
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, n, a.Equals, 3)
+	a.Assert(t, exportCSV(imported), a.Equals, exportCSV(db))
+	a.Assert(t, exportCSV(imported), a.Equals,
+		"at,dim1,dim2,metric1,rowCount\n0,a,1.5,3,2\n3600,b,,3,1\n7200,,2,4,1\n")
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/dustin/go-humanize"
+)
+
+func init() {
+	commandsByName["inspect"] = command{
+		description: "show where a GumshoeDB database's disk space goes",
+		fn:          inspect,
+	}
+}
+
+func inspect(args []string) {
+	flags := flag.NewFlagSet("gumtool inspect", flag.ExitOnError)
+	dir := flags.String("db", "", "the GumshoeDB database directory to inspect")
+	flags.Parse(args)
+
+	if *dir == "" {
+		fatalln("-db must be provided")
+	}
+
+	layout, err := inspectDB(*dir)
+	if err != nil {
+		fatalln(err)
+	}
+	layout.print()
+}
+
+// A dbLayout describes the files of a DB directory, as read from its metadata (so the DB may be in use).
+type dbLayout struct {
+	Intervals       []intervalLayout // By start time
+	DimensionTables []dimensionTableLayout
+	MetadataBytes   int64
+	WALBytes        int64
+	ViewBytes       map[string]int64 // The total size of each view's directory, by name
+	TotalBytes      int64            // Everything above, excluding cold segments
+}
+
+type intervalLayout struct {
+	Start        time.Time
+	Generation   int
+	NumSegments  int
+	NumRows      int
+	Cold         bool  // The segments are in the cold store, so they aren't counted
+	SegmentBytes int64 // The total size of the segment files
+	BloomBytes   int64
+}
+
+type dimensionTableLayout struct {
+	Column    string
+	NumValues int
+	Bytes     int64
+}
+
+func inspectDB(dir string) (*dbLayout, error) {
+	metadata, err := ioutil.ReadFile(filepath.Join(dir, gumshoe.MetadataFilename))
+	if err != nil {
+		return nil, err
+	}
+	db := new(gumshoe.DB)
+	if err := json.Unmarshal(metadata, db); err != nil {
+		return nil, err
+	}
+	// The schema has no Dir, so the filenames are relative to dir.
+	layout := &dbLayout{MetadataBytes: int64(len(metadata)), ViewBytes: make(map[string]int64)}
+	if layout.WALBytes, err = fileSize(filepath.Join(dir, gumshoe.WALFilename)); err != nil {
+		return nil, err
+	}
+	layout.TotalBytes = layout.MetadataBytes + layout.WALBytes
+
+	for i, dimTable := range db.StaticTable.DimensionTables {
+		if dimTable == nil {
+			continue
+		}
+		table := dimensionTableLayout{Column: db.DimensionColumns[i].Name, NumValues: dimTable.Size}
+		if dimTable.Generation > 0 {
+			table.Bytes, err = fileSize(filepath.Join(dir, dimTable.Filename(db.Schema, i)))
+			if err != nil {
+				return nil, err
+			}
+		}
+		layout.DimensionTables = append(layout.DimensionTables, table)
+		layout.TotalBytes += table.Bytes
+	}
+
+	for _, interval := range db.StaticTable.Intervals {
+		iv := intervalLayout{
+			Start:       interval.Start,
+			Generation:  interval.Generation,
+			NumSegments: interval.NumSegments,
+			NumRows:     interval.NumRows,
+			Cold:        interval.Cold,
+		}
+		if interval.BloomFilters {
+			if iv.BloomBytes, err = fileSize(filepath.Join(dir, interval.BloomFilename(db.Schema))); err != nil {
+				return nil, err
+			}
+		}
+		if !interval.Cold {
+			for i := 0; i < interval.NumSegments; i++ {
+				size, err := fileSize(filepath.Join(dir, interval.SegmentFilename(db.Schema, i)))
+				if err != nil {
+					return nil, err
+				}
+				iv.SegmentBytes += size
+			}
+		}
+		layout.Intervals = append(layout.Intervals, iv)
+		layout.TotalBytes += iv.SegmentBytes + iv.BloomBytes
+	}
+	sort.Slice(layout.Intervals, func(i, j int) bool {
+		return layout.Intervals[i].Start.Before(layout.Intervals[j].Start)
+	})
+
+	viewDirs, err := filepath.Glob(filepath.Join(dir, gumshoe.ViewsDir, "*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, viewDir := range viewDirs {
+		var size int64
+		err := filepath.Walk(viewDir, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if !info.IsDir() {
+				size += info.Size()
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		layout.ViewBytes[filepath.Base(viewDir)] = size
+		layout.TotalBytes += size
+	}
+	return layout, nil
+}
+
+// fileSize returns the size of the file at filename, or 0 if there's no such file.
+func fileSize(filename string) (int64, error) {
+	info, err := os.Stat(filename)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+func (l *dbLayout) print() {
+	fmt.Println("Intervals:")
+	fmt.Printf("%-22s%12s%10s%12s%12s%10s%12s\n",
+		"start", "generation", "segments", "rows", "data", "bloom", "total")
+	var numSegments, numRows int
+	var segmentBytes, bloomBytes int64
+	for _, iv := range l.Intervals {
+		segments := humanBytes(iv.SegmentBytes)
+		if iv.Cold {
+			segments = "(cold)"
+		}
+		fmt.Printf("%-22s%12d%10d%12d%12s%10s%12s\n", iv.Start.UTC().Format("2006-01-02 15:04 MST"),
+			iv.Generation, iv.NumSegments, iv.NumRows, segments, humanBytes(iv.BloomBytes),
+			humanBytes(iv.SegmentBytes+iv.BloomBytes))
+		numSegments += iv.NumSegments
+		numRows += iv.NumRows
+		segmentBytes += iv.SegmentBytes
+		bloomBytes += iv.BloomBytes
+	}
+	fmt.Printf("%-22s%12s%10d%12d%12s%10s%12s\n", fmt.Sprintf("(%d intervals)", len(l.Intervals)), "",
+		numSegments, numRows, humanBytes(segmentBytes), humanBytes(bloomBytes),
+		humanBytes(segmentBytes+bloomBytes))
+
+	fmt.Println("\nDimension tables:")
+	fmt.Printf("%-34s%12s%12s\n", "column", "values", "size")
+	for _, table := range l.DimensionTables {
+		fmt.Printf("%-34s%12d%12s\n", table.Column, table.NumValues, humanBytes(table.Bytes))
+	}
+
+	if len(l.ViewBytes) > 0 {
+		fmt.Println("\nViews:")
+		var names []string
+		for name := range l.ViewBytes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Printf("%-34s%12s\n", name, humanBytes(l.ViewBytes[name]))
+		}
+	}
+
+	fmt.Println()
+	fmt.Printf("%-34s%12s\n", "metadata", humanBytes(l.MetadataBytes))
+	fmt.Printf("%-34s%12s\n", "write-ahead log", humanBytes(l.WALBytes))
+	fmt.Printf("%-34s%12s\n", "total (excluding cold segments)", humanBytes(l.TotalBytes))
+}
+
+func humanBytes(n int64) string { return humanize.Bytes(uint64(n)) }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestInspectDB(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gumtool-inspect-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	schema := schemaFixture(&migrateTestSchema{
+		[]migrateTestDimensions{{"dim1", "uint8", true}},
+		[]migrateTestMetrics{{"metric1", "uint32"}},
+	})
+	schema.DiskBacked = true
+	schema.Dir = tempDir
+	db, err := gumshoe.NewDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []gumshoe.RowMap{
+		{"at": 0.0, "dim1": "a", "metric1": 1.0},
+		{"at": 0.0, "dim1": "b", "metric1": 1.0},
+		{"at": 7200.0, "dim1": "a", "metric1": 1.0},
+	}
+	if err := db.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	layout, err := inspectDB(tempDir)
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, len(layout.Intervals), a.Equals, 2)
+	a.Assert(t, layout.Intervals[0].Start.Unix(), a.Equals, int64(0))
+	a.Assert(t, layout.Intervals[0].NumRows, a.Equals, 2)
+	a.Assert(t, layout.Intervals[1].NumRows, a.Equals, 1)
+	a.Assert(t, layout.Intervals[0].SegmentBytes, a.Equals, int64(2*schema.RowSize))
+	a.Assert(t, len(layout.DimensionTables), a.Equals, 1)
+	a.Assert(t, layout.DimensionTables[0].Column, a.Equals, "dim1")
+	a.Assert(t, layout.DimensionTables[0].NumValues, a.Equals, 2)
+	a.Assert(t, layout.DimensionTables[0].Bytes > 0, a.IsTrue)
+	total := layout.MetadataBytes + layout.WALBytes + layout.DimensionTables[0].Bytes
+	for _, iv := range layout.Intervals {
+		total += iv.SegmentBytes + iv.BloomBytes
+	}
+	a.Assert(t, layout.TotalBytes, a.Equals, total)
+
+	if _, err := inspectDB(tempDir + "-missing"); err == nil {
+		t.Error("expected an error inspecting a missing DB")
+	}
+}
@@ -3,7 +3,6 @@ package main
 import (
 	"flag"
 	"log"
-	"os"
 
 	"github.com/philc/gumshoedb/gumshoe"
 	"github.com/philc/gumshoedb/internal/config"
@@ -22,50 +21,62 @@ func merge(args []string) {
 	flags := flag.NewFlagSet("gumtool merge", flag.ExitOnError)
 	var (
 		newConfigFilename string
+		outDir            string
 		oldDBPaths        stringsFlag
 		parallelism       int
 		numOpenFiles      int
 		flushSegments     int
 	)
 	flags.StringVar(&newConfigFilename, "new-db-config", "", "Filename of the new DB config")
-	flags.Var(&oldDBPaths, "db-paths", "Paths to dirs of DBs to merge")
+	flags.StringVar(&outDir, "out", "", "Dir of the new DB, which gets the schema of the merged DBs "+
+		"(instead of -new-db-config)")
+	flags.Var(&oldDBPaths, "db-paths", "Paths to dirs of DBs to merge (which may also be given as arguments)")
 	flags.IntVar(&parallelism, "parallelism", 4, "Parallelism for merge workers")
 	flags.IntVar(&numOpenFiles, "rlimit-nofile", 10000, "Value for RLIMIT_NOFILE")
 	flags.IntVar(&flushSegments, "flush-segments", 500, "Flush after merging each N segments")
 	flags.Parse(args)
+	oldDBPaths = append(oldDBPaths, flags.Args()...)
 
 	if len(oldDBPaths) == 0 {
 		log.Fatalln("Need at least one entry in -db-paths; got 0")
 	}
+	if (newConfigFilename == "") == (outDir == "") {
+		log.Fatalln("Exactly one of -new-db-config and -out must be given")
+	}
 
 	setRlimit(numOpenFiles)
 
-	f, err := os.Open(newConfigFilename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-	_, schema, err := config.LoadTOMLConfig(f)
-	if err != nil {
-		log.Fatal(err)
-	}
-	newDB, err := gumshoe.NewDB(schema)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer newDB.Close()
-
 	dbs := make([]*gumshoe.DB, len(oldDBPaths))
 	for i, path := range oldDBPaths {
 		db, err := gumshoe.OpenDBDir(path)
 		if err != nil {
 			log.Fatalf("Error opening DB at %s: %s", path, err)
 		}
+		dbs[i] = db
+	}
+
+	var schema *gumshoe.Schema
+	var schemaSource string
+	if outDir != "" {
+		schema = mergedSchema(dbs[0].Schema, outDir)
+		schemaSource = "DB at " + oldDBPaths[0]
+	} else {
+		var err error
+		if _, schema, err = config.LoadConfig(newConfigFilename, nil); err != nil {
+			log.Fatal(err)
+		}
+		schemaSource = "config at " + newConfigFilename
+	}
+	for i, db := range dbs {
 		if err := db.Schema.Equivalent(schema); err != nil {
-			log.Fatalf("Schema of DB at %s didn't match config at %s: %s", path, newConfigFilename, err)
+			log.Fatalf("Schema of DB at %s didn't match %s: %s", oldDBPaths[i], schemaSource, err)
 		}
-		dbs[i] = db
 	}
+	newDB, err := gumshoe.NewDB(schema)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer newDB.Close()
 
 	for _, db := range dbs {
 		log.Printf("Merging db %s", db.Schema.Dir)
@@ -76,6 +87,17 @@ func merge(args []string) {
 	}
 }
 
+// mergedSchema returns a copy of schema, the schema of the DBs being merged, for a new DB in dir.
+func mergedSchema(schema *gumshoe.Schema, dir string) *gumshoe.Schema {
+	merged := *schema
+	merged.Dir = dir
+	// The new DB's intervals are all written with the current layout.
+	merged.Layouts = nil
+	// The source DB may be opened read-only, but the new DB is written.
+	merged.ReadOnly = false
+	return &merged
+}
+
 func mergeDB(newDB, db *gumshoe.DB, parallelism, flushSegments int) error {
 	resp := db.MakeRequest()
 	defer resp.Done()
@@ -137,27 +159,28 @@ func mergeDB(newDB, db *gumshoe.DB, parallelism, flushSegments int) error {
 }
 
 func mergeSegment(newDB, db *gumshoe.DB, segment *timestampSegment) error {
-	// NOTE(caleb): Have to do more nasty float conversion in this function. See NOTE(caleb) in migrate.go.
-	at := float64(segment.at.Unix())
-	rows := make([]gumshoe.UnpackedRow, 0, len(segment.Bytes)/db.RowSize)
-	for i := 0; i < len(segment.Bytes); i += db.RowSize {
-		row := gumshoe.RowBytes(segment.Bytes[i : i+db.RowSize])
+	segmentRows := db.SegmentRows(segment.Segment, nil)
+	rows := make([]gumshoe.UnpackedRow, 0, len(segmentRows)/db.RowSize)
+	for i := 0; i < len(segmentRows); i += db.RowSize {
+		row := gumshoe.RowBytes(segmentRows[i : i+db.RowSize])
 		unpacked := db.DeserializeRow(row)
-		unpacked.RowMap[db.TimestampColumn.Name] = at
-		for _, dim := range db.Schema.DimensionColumns {
-			if dim.String {
-				continue
-			}
-			value := unpacked.RowMap[dim.Name]
-			if value == nil {
-				continue
-			}
-			convertValueToFloat64(unpacked.RowMap, dim.Name)
-		}
-		for _, dim := range db.Schema.MetricColumns {
-			convertValueToFloat64(unpacked.RowMap, dim.Name)
-		}
+		unpacked.RowMap[db.TimestampColumn.Name] = float64(segment.at.Unix())
+		convertRowToFloat64s(db, unpacked.RowMap)
 		rows = append(rows, unpacked)
 	}
 	return newDB.InsertUnpacked(rows)
 }
+
+// convertRowToFloat64s converts the numeric values of a deserialized row of db to float64s, so that it can be
+// inserted.
+func convertRowToFloat64s(db *gumshoe.DB, row gumshoe.RowMap) {
+	// NOTE(caleb): Have to do more nasty float conversion in this function. See NOTE(caleb) in migrate.go.
+	for _, dim := range db.Schema.DimensionColumns {
+		if !dim.String && row[dim.Name] != nil {
+			convertValueToFloat64(row, dim.Name)
+		}
+	}
+	for _, dim := range db.Schema.MetricColumns {
+		convertValueToFloat64(row, dim.Name)
+	}
+}
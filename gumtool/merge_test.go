@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestMergeDBs(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gumtool-merge-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	shards := [][]gumshoe.RowMap{
+		{
+			{"at": 0.0, "dim1": "a", "dim2": 1.5, "metric1": 1.0},
+			{"at": 3600.0, "dim1": "b", "dim2": nil, "metric1": 2.0},
+		},
+		{
+			{"at": 0.0, "dim1": "c", "dim2": nil, "metric1": 3.0},
+			{"at": 0.0, "dim1": "a", "dim2": 1.5, "metric1": 4.0}, // Collapses with the first shard's first row
+		},
+	}
+	var dbs []*gumshoe.DB
+	for i, rows := range shards {
+		schema := schemaFixture(&migrateTestSchema{
+			[]migrateTestDimensions{{"dim1", "uint8", true}, {"dim2", "float32", false}},
+			[]migrateTestMetrics{{"metric1", "uint32"}},
+		})
+		schema.DiskBacked = true
+		schema.Dir = filepath.Join(tempDir, fmt.Sprintf("shard%d", i))
+		db, err := gumshoe.NewDB(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Insert(rows); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = gumshoe.OpenDBDir(schema.Dir); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		dbs = append(dbs, db)
+	}
+
+	schema := mergedSchema(dbs[0].Schema, filepath.Join(tempDir, "out"))
+	a.Assert(t, dbs[1].Schema.Equivalent(schema), a.IsNil)
+	newDB, err := gumshoe.NewDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer newDB.Close()
+	for _, db := range dbs {
+		a.Assert(t, mergeDB(newDB, db, 2, 1), a.IsNil)
+	}
+
+	// The segments are merged in no particular order, so neither are the dimension table's values.
+	dim1 := append([]string(nil), newDB.GetDimensionTables()["dim1"]...)
+	sort.Strings(dim1)
+	a.Assert(t, dim1, a.DeepEquals, []string{"a", "b", "c"})
+	var buf bytes.Buffer
+	w, err := newExportWriter(&buf, newDB.Schema, "csv")
+	a.Assert(t, err, a.IsNil)
+	_, err = exportRows(w, newDB, time.Time{}, time.Time{})
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, buf.String(), a.Equals, "at,dim1,dim2,metric1,rowCount\n0,a,1.5,5,2\n0,c,,3,1\n3600,b,,2,1\n")
+}
@@ -8,7 +8,6 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"os"
 	"reflect"
 	"sync"
 	"time"
@@ -42,12 +41,7 @@ func migrate(args []string) {
 	}
 	defer oldDB.Close()
 
-	f, err := os.Open(*newConfigFilename)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-	_, schema, err := config.LoadTOMLConfig(f)
+	_, schema, err := config.LoadConfig(*newConfigFilename, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -155,9 +149,10 @@ func migrateSegment(newDB, oldDB *gumshoe.DB, segment *timestampSegment,
 	convert func(gumshoe.UnpackedRow)) error {
 
 	at := uint32(segment.at.Unix())
-	rows := make([]gumshoe.UnpackedRow, 0, len(segment.Bytes)/oldDB.RowSize)
-	for i := 0; i < len(segment.Bytes); i += oldDB.RowSize {
-		row := gumshoe.RowBytes(segment.Bytes[i : i+oldDB.RowSize])
+	segmentRows := oldDB.SegmentRows(segment.Segment, nil)
+	rows := make([]gumshoe.UnpackedRow, 0, len(segmentRows)/oldDB.RowSize)
+	for i := 0; i < len(segmentRows); i += oldDB.RowSize {
+		row := gumshoe.RowBytes(segmentRows[i : i+oldDB.RowSize])
 		unpacked := oldDB.DeserializeRow(row)
 		// Attach a timestamp
 		unpacked.RowMap[oldDB.TimestampColumn.Name] = at
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func init() {
+	commandsByName["query"] = command{
+		description: "send a query to a GumshoeDB server or router and print the results",
+		fn:          query,
+	}
+}
+
+func query(args []string) {
+	flags := flag.NewFlagSet("gumtool query", flag.ExitOnError)
+	addr := flags.String("addr", "http://localhost:9000", "the URL of the server or router")
+	table := flags.String("table", "", "the name of the table to query (by default, the main DB)")
+	queryFlag := flags.String("q", "", "the query JSON")
+	file := flags.String("file", "", `a file containing the query JSON ("-" for stdin)`)
+	format := flags.String("format", "table", `the output format: "table", "csv", or "json"`)
+	apiKey := flags.String("api-key", "", "the API key to send with the query")
+	apiKeyHeader := flags.String("api-key-header", "X-API-Key", "the header in which to send the API key")
+	timeout := flags.Duration("timeout", time.Minute, "how long to wait for each query")
+	repeat := flags.Int("repeat", 1, "the number of times to run the query (0 for forever with -watch)")
+	watch := flags.Duration("watch", 0, "if set, how long to wait between runs of the query")
+	flags.Parse(args)
+
+	switch *format {
+	case "table", "csv", "json":
+	default:
+		fatalf("unknown format %q\n", *format)
+	}
+	if *repeat < 0 || (*repeat == 0 && *watch == 0) {
+		fatalln("-repeat must be positive (or 0 with -watch)")
+	}
+	body, err := readQuery(*queryFlag, *file)
+	if err != nil {
+		fatalln(err)
+	}
+	// The results are printed in the order of the query's columns, if the query can be parsed.
+	var columns []string
+	if q, err := gumshoe.ParseJSONQuery(bytes.NewReader(body)); err == nil {
+		columns = q.ResultColumns()
+	}
+	url := strings.TrimSuffix(*addr, "/")
+	if *table != "" {
+		url += "/tables/" + *table
+	}
+	url += "/query"
+	client := &http.Client{Timeout: *timeout}
+	header := make(http.Header)
+	header.Set("Content-Type", "application/json")
+	if *apiKey != "" {
+		header.Set(*apiKeyHeader, *apiKey)
+	}
+
+	var latencies []time.Duration
+	for i := 0; *repeat == 0 || i < *repeat; i++ {
+		if i > 0 && *watch > 0 {
+			time.Sleep(*watch)
+		}
+		start := time.Now()
+		result, err := runRemoteQuery(client, url, header, body)
+		if err != nil {
+			fatalln(err)
+		}
+		latencies = append(latencies, time.Since(start))
+		if *watch > 0 && *format == "table" {
+			fmt.Printf("%s\n", start.Format(time.RFC3339))
+		}
+		if err := writeQueryResult(os.Stdout, result, columns, *format); err != nil {
+			fatalln(err)
+		}
+		if *watch > 0 && *format == "table" {
+			fmt.Println()
+		}
+	}
+	if len(latencies) > 1 {
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		var total time.Duration
+		for _, l := range latencies {
+			total += l
+		}
+		mean := (total / time.Duration(len(latencies))).Round(time.Millisecond)
+		fmt.Fprintf(os.Stderr, "Ran %d times: min %s, mean %s, max %s\n", len(latencies),
+			latencies[0].Round(time.Millisecond), mean, latencies[len(latencies)-1].Round(time.Millisecond))
+	}
+}
+
+// readQuery returns the query JSON given directly by q or else read from file.
+func readQuery(q, file string) ([]byte, error) {
+	switch {
+	case q != "" && file != "":
+		return nil, fmt.Errorf("only one of -q and -file may be given")
+	case q != "":
+		return []byte(q), nil
+	case file == "-":
+		return ioutil.ReadAll(os.Stdin)
+	case file != "":
+		return ioutil.ReadFile(file)
+	}
+	return nil, fmt.Errorf("a query must be given with -q or -file")
+}
+
+// A remoteQueryResult is the JSON response to a query.
+type remoteQueryResult struct {
+	Results    []map[string]interface{} `json:"results"`
+	DurationMS int                      `json:"duration_ms"`
+	SampleRate float64                  `json:"sample_rate"`
+}
+
+// runRemoteQuery posts the query JSON body to url with header.
+func runRemoteQuery(client *http.Client, url string, header http.Header, body []byte) (*remoteQueryResult,
+	error) {
+
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return nil, fmt.Errorf("query failed (%s): %s", resp.Status, strings.TrimSpace(string(message)))
+	}
+	result := new(remoteQueryResult)
+	decoder := json.NewDecoder(resp.Body)
+	// Large integers are printed as they were sent.
+	decoder.UseNumber()
+	if err := decoder.Decode(result); err != nil {
+		return nil, fmt.Errorf("cannot decode the query results: %s", err)
+	}
+	return result, nil
+}
+
+// writeQueryResult writes the rows of result to w in the given format. The columns are written in the order
+// of columns, followed by any others in alphabetical order.
+func writeQueryResult(w io.Writer, result *remoteQueryResult, columns []string, format string) error {
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		for _, row := range result.Results {
+			if err := encoder.Encode(row); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	known := make(map[string]bool)
+	for _, column := range columns {
+		known[column] = true
+	}
+	var extra []string
+	for _, row := range result.Results {
+		for column := range row {
+			if !known[column] {
+				known[column] = true
+				extra = append(extra, column)
+			}
+		}
+	}
+	sort.Strings(extra)
+	columns = append(append([]string(nil), columns...), extra...)
+	// Columns which no row has are left out (for instance, a query's grouping columns may be renamed).
+	var present []string
+	for _, column := range columns {
+		for _, row := range result.Results {
+			if _, ok := row[column]; ok {
+				present = append(present, column)
+				break
+			}
+		}
+	}
+	columns = present
+
+	if format == "csv" {
+		cw := csv.NewWriter(w)
+		if err := cw.Write(columns); err != nil {
+			return err
+		}
+		record := make([]string, len(columns))
+		for _, row := range result.Results {
+			for i, column := range columns {
+				record[i] = formatQueryValue(row[column])
+			}
+			if err := cw.Write(record); err != nil {
+				return err
+			}
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(columns, "\t"))
+	for _, row := range result.Results {
+		values := make([]string, len(columns))
+		for i, column := range columns {
+			values[i] = formatQueryValue(row[column])
+		}
+		fmt.Fprintln(tw, strings.Join(values, "\t"))
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	summary := fmt.Sprintf("(%d rows in %d ms", len(result.Results), result.DurationMS)
+	if result.SampleRate > 0 {
+		summary += fmt.Sprintf(", sampled at %g", result.SampleRate)
+	}
+	_, err := fmt.Fprintln(w, summary+")")
+	return err
+}
+
+// formatQueryValue formats a value of a query result for printing. Nil values (of nil dimensions) are empty.
+func formatQueryValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
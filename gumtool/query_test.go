@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestRunRemoteQuery(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-API-Key") != "secret" {
+			http.Error(w, "bad API key", http.StatusUnauthorized)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != "/tables/events/query" || string(body) != `{"aggregates": []}` {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"results": [{"country": "us", "clicks": 18446744073709551615, "rowCount": 2}, ` +
+			`{"country": null, "clicks": 1.5, "rowCount": 1}], "duration_ms": 3}`))
+	}))
+	defer server.Close()
+
+	header := make(http.Header)
+	client := &http.Client{}
+	body := []byte(`{"aggregates": []}`)
+	_, err := runRemoteQuery(client, server.URL+"/tables/events/query", header, body)
+	a.Assert(t, err.Error(), a.Equals, "query failed (401 Unauthorized): bad API key")
+
+	header.Set("X-API-Key", "secret")
+	result, err := runRemoteQuery(client, server.URL+"/tables/events/query", header, body)
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, len(result.Results), a.Equals, 2)
+	a.Assert(t, result.DurationMS, a.Equals, 3)
+
+	// The query's columns come first; the rest are in alphabetical order.
+	var buf bytes.Buffer
+	a.Assert(t, writeQueryResult(&buf, result, []string{"country", "missing"}, "table"), a.IsNil)
+	a.Assert(t, buf.String(), a.Equals, ""+
+		"country  clicks                rowCount\n"+
+		"us       18446744073709551615  2\n"+
+		"         1.5                   1\n"+
+		"(2 rows in 3 ms)\n")
+
+	buf.Reset()
+	a.Assert(t, writeQueryResult(&buf, result, []string{"country"}, "csv"), a.IsNil)
+	a.Assert(t, buf.String(), a.Equals, "country,clicks,rowCount\nus,18446744073709551615,2\n,1.5,1\n")
+}
+
+func TestReadQuery(t *testing.T) {
+	b, err := readQuery(`{"aggregates": []}`, "")
+	a.Assert(t, err, a.IsNil)
+	a.Assert(t, string(b), a.Equals, `{"aggregates": []}`)
+	_, err = readQuery("", "")
+	a.Assert(t, err, a.NotNil)
+	_, err = readQuery("{}", "query.json")
+	a.Assert(t, err, a.NotNil)
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/config"
+)
+
+func init() {
+	commandsByName["repair"] = command{
+		description: "salvage a damaged GumshoeDB database by discarding its unusable files",
+		fn:          repair,
+	}
+}
+
+func repair(args []string) {
+	flags := flag.NewFlagSet("gumtool repair", flag.ExitOnError)
+	dir := flags.String("dir", "", "the GumshoeDB database directory to repair (the server must be stopped)")
+	configFile := flags.String("config", "", "the DB config, whose schema is used if the metadata can't be read")
+	dryRun := flags.Bool("dry-run", false, "only print what would be discarded")
+	flags.Parse(args)
+
+	if *dir == "" {
+		fatalln("-dir must be provided")
+	}
+	var schema *gumshoe.Schema
+	if *configFile != "" {
+		var err error
+		if _, schema, err = config.LoadConfig(*configFile, nil); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	actions, err := gumshoe.RepairDir(*dir, schema, *dryRun)
+	if err != nil {
+		fatalln(err)
+	}
+	for _, action := range actions {
+		fmt.Println(action)
+	}
+	switch {
+	case len(actions) == 0:
+		fmt.Println("Found nothing to repair.")
+	case *dryRun:
+		fmt.Println("Dry run; nothing was changed.")
+	default:
+		fmt.Printf("Wrote new metadata; the old metadata is in %s.before-repair.\n", gumshoe.MetadataFilename)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/wait"
+)
+
+func init() {
+	commandsByName["split"] = command{
+		description: "split a GumshoeDB database into one database for each partition of a routed cluster",
+		fn:          split,
+	}
+}
+
+func split(args []string) {
+	flags := flag.NewFlagSet("gumtool split", flag.ExitOnError)
+	dir := flags.String("dir", "", "the GumshoeDB database directory to split")
+	out := flags.String("out", "", "the directory in which to create the new databases (named 0, 1, ...)")
+	numShards := flags.Int("shards", 0, "the number of partitions (replica sets of shards) of the cluster")
+	sharding := flags.String("sharding", "hash",
+		`how rows are assigned to partitions, as by the router: "hash" (by their dimensions) or "time" `+
+			`(by their intervals)`)
+	parallelism := flags.Int("parallelism", 4, "Parallelism for split workers")
+	numOpenFiles := flags.Int("rlimit-nofile", 10000, "Value for RLIMIT_NOFILE")
+	flushSegments := flags.Int("flush-segments", 500, "Flush after splitting each N segments")
+	flags.Parse(args)
+
+	if *dir == "" || *out == "" {
+		fatalln("-dir and -out must be provided")
+	}
+	if *numShards < 1 {
+		fatalln("-shards must be at least 1")
+	}
+	if *sharding != "hash" && *sharding != "time" {
+		fatalf("unknown sharding strategy %q\n", *sharding)
+	}
+
+	setRlimit(*numOpenFiles)
+
+	db, err := gumshoe.OpenDBDirReadOnly(*dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	newDBs := make([]*gumshoe.DB, *numShards)
+	for i := range newDBs {
+		newDB, err := gumshoe.NewDB(mergedSchema(db.Schema, filepath.Join(*out, strconv.Itoa(i))))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer newDB.Close()
+		newDBs[i] = newDB
+	}
+
+	if err := splitDB(newDBs, db, *sharding, *parallelism, *flushSegments); err != nil {
+		log.Fatalln("Error splitting:", err)
+	}
+	fmt.Println("done")
+}
+
+// splitDB inserts each row of db into the one of newDBs which holds its partition, as assigned by the router
+// with the given sharding strategy. Rows are hashed with their interval's start time in place of the
+// timestamp they were inserted with (which isn't stored).
+func splitDB(newDBs []*gumshoe.DB, db *gumshoe.DB, sharding string, parallelism, flushSegments int) error {
+	resp := db.MakeRequest()
+	defer resp.Done()
+
+	allSegments := findSegments(resp.StaticTable)
+	progress := NewProgress("segments processed", len(allSegments))
+	progress.Print()
+	segments := make(chan *timestampSegment)
+	var wg wait.Group
+	for i := 0; i < parallelism; i++ {
+		wg.Go(func(quit <-chan struct{}) error {
+			for {
+				select {
+				case <-quit:
+					return nil
+				case segment, ok := <-segments:
+					if !ok {
+						return nil
+					}
+					if err := splitSegment(newDBs, db, sharding, segment); err != nil {
+						return err
+					}
+					progress.Add(1)
+				}
+			}
+		})
+	}
+
+	flushAll := func() error {
+		for _, newDB := range newDBs {
+			if err := newDB.Flush(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	wg.Go(func(quit <-chan struct{}) error {
+		flushSegmentCount := 0
+		for _, segment := range allSegments {
+			select {
+			case <-quit:
+				return nil
+			case segments <- segment:
+				flushSegmentCount++
+				if flushSegmentCount == flushSegments {
+					flushSegmentCount = 0
+					if err := flushAll(); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		close(segments)
+		return nil
+	})
+
+	if err := wg.Wait(); err != nil {
+		return err
+	}
+	return flushAll()
+}
+
+func splitSegment(newDBs []*gumshoe.DB, db *gumshoe.DB, sharding string, segment *timestampSegment) error {
+	partitions := make([][]gumshoe.UnpackedRow, len(newDBs))
+	segmentRows := db.SegmentRows(segment.Segment, nil)
+	for i := 0; i < len(segmentRows); i += db.RowSize {
+		row := gumshoe.RowBytes(segmentRows[i : i+db.RowSize])
+		unpacked := db.DeserializeRow(row)
+		unpacked.RowMap[db.TimestampColumn.Name] = float64(segment.at.Unix())
+		var p int
+		if sharding == "time" {
+			p = db.Schema.IntervalPartition(segment.at, len(newDBs))
+		} else {
+			// The dimension values are hashed before they're converted, so that they encode as the inserted
+			// values did (for instance, a float32 0.1 as 0.1 rather than 0.10000000149011612).
+			p = db.Schema.HashPartition(unpacked.RowMap, len(newDBs))
+		}
+		convertRowToFloat64s(db, unpacked.RowMap)
+		partitions[p] = append(partitions[p], unpacked)
+	}
+	for p, rows := range partitions {
+		if len(rows) == 0 {
+			continue
+		}
+		if err := newDBs[p].InsertUnpacked(rows); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/util"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestSplitDB(t *testing.T) {
+	for _, sharding := range []string{"hash", "time"} {
+		tempDir, err := ioutil.TempDir("", "gumtool-split-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(tempDir)
+		schema := schemaFixture(&migrateTestSchema{
+			[]migrateTestDimensions{{"dim1", "uint8", true}, {"dim2", "float32", false}},
+			[]migrateTestMetrics{{"metric1", "uint32"}},
+		})
+		schema.DiskBacked = true
+		schema.Dir = filepath.Join(tempDir, "db")
+		db, err := gumshoe.NewDB(schema)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var rows []gumshoe.RowMap
+		for i := 0; i < 40; i++ {
+			rows = append(rows, gumshoe.RowMap{
+				"at":      float64(i % 4 * 3600),
+				"dim1":    fmt.Sprint("value", i),
+				"dim2":    0.1,
+				"metric1": float64(i),
+			})
+		}
+		if err := db.Insert(rows); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		// Like gumtool split, read the rows from the DB opened read-only.
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if db, err = gumshoe.OpenDBDirReadOnly(schema.Dir); err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		const numShards = 3
+		newDBs := make([]*gumshoe.DB, numShards)
+		for i := range newDBs {
+			newDB, err := gumshoe.NewDB(mergedSchema(db.Schema, filepath.Join(tempDir, fmt.Sprint(i))))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer newDB.Close()
+			newDBs[i] = newDB
+		}
+		a.Assert(t, splitDB(newDBs, db, sharding, 2, 1), a.IsNil)
+
+		// Each row (identified by its dim1 value) is in the DB of the partition the router would send it to.
+		expected := make([][]string, numShards)
+		for _, row := range rows {
+			var p int
+			if sharding == "time" {
+				p, _ = db.Schema.TimePartition(row, numShards)
+			} else {
+				p = db.Schema.HashPartition(row, numShards)
+			}
+			expected[p] = append(expected[p], row["dim1"].(string))
+		}
+		for i, newDB := range newDBs {
+			var actual []string
+			for _, row := range newDB.GetDebugRows() {
+				actual = append(actual, row.RowMap["dim1"].(string))
+			}
+			a.Assert(t, actual, util.DeepEqualsUnordered, expected[i])
+		}
+	}
+}
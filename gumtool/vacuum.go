@@ -0,0 +1,132 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/dustin/go-humanize"
+)
+
+func init() {
+	commandsByName["vacuum"] = command{
+		description: "remove the files a GumshoeDB database no longer uses",
+		fn:          vacuum,
+	}
+}
+
+func vacuum(args []string) {
+	flags := flag.NewFlagSet("gumtool vacuum", flag.ExitOnError)
+	dir := flags.String("dir", "", "the GumshoeDB database directory to vacuum")
+	flags.Parse(args)
+
+	if *dir == "" {
+		fatalln("-dir must be provided")
+	}
+
+	// The views are DBs of their own.
+	dirs := []string{*dir}
+	viewMetadata, err := filepath.Glob(filepath.Join(*dir, gumshoe.ViewsDir, "*", gumshoe.MetadataFilename))
+	if err != nil {
+		fatalln(err)
+	}
+	for _, filename := range viewMetadata {
+		dirs = append(dirs, filepath.Dir(filename))
+	}
+
+	var total uint64
+	for _, dir := range dirs {
+		result, err := vacuumDB(dir)
+		if err != nil {
+			fatalln(err)
+		}
+		fmt.Printf("%s: removed %d unused file(s) (%s); metadata went from %s to %s\n", dir,
+			len(result.Removed), humanize.Bytes(result.Reclaimed),
+			humanize.Bytes(result.MetadataBefore), humanize.Bytes(result.MetadataAfter))
+		total += result.Reclaimed
+		if result.MetadataBefore > result.MetadataAfter {
+			total += result.MetadataBefore - result.MetadataAfter
+		}
+	}
+	fmt.Printf("Reclaimed %s in total.\n", humanize.Bytes(total))
+}
+
+type vacuumResult struct {
+	Removed   []string // The base names of the files removed
+	Reclaimed uint64   // The total size of the removed files
+
+	// The size of the metadata file before and after it was rewritten.
+	MetadataBefore uint64
+	MetadataAfter  uint64
+}
+
+// The patterns of the files in a DB directory which are only kept if the metadata refers to them. Temporary
+// files are left behind by writes which were interrupted before they were renamed into place.
+var vacuumGlobs = []string{"dimension.*.gob.gz", "interval.*.dat", "interval.*.bloom", "*.tmp"}
+
+// vacuumDB opens the DB in dir (which can't be in use), flushes it, and removes the files in the directory
+// which its metadata doesn't refer to, such as the segments of a generation written by a flush which crashed
+// before committing it. Opening and flushing the DB also rewrites the metadata without the row layouts which
+// no longer have any intervals, and empties the write-ahead log.
+func vacuumDB(dir string) (*vacuumResult, error) {
+	metadataFilename := filepath.Join(dir, gumshoe.MetadataFilename)
+	info, err := os.Stat(metadataFilename)
+	if err != nil {
+		return nil, err
+	}
+	result := &vacuumResult{MetadataBefore: uint64(info.Size())}
+
+	db, err := gumshoe.OpenDBDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Flush(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	resp := db.MakeRequest()
+	files := referencedFiles(db.Schema, resp.StaticTable)
+	resp.Done()
+	referenced := make(map[string]bool)
+	for _, names := range [][]string{files.dimensionTables, files.segments, files.bloomFilters} {
+		for _, name := range names {
+			referenced[name] = true
+		}
+	}
+
+	for _, glob := range vacuumGlobs {
+		filenames, err := filepath.Glob(filepath.Join(dir, glob))
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		for _, filename := range filenames {
+			if referenced[filepath.Base(filename)] {
+				continue
+			}
+			info, err := os.Stat(filename)
+			if err == nil {
+				err = os.Remove(filename)
+			}
+			if err != nil {
+				db.Close()
+				return nil, err
+			}
+			result.Removed = append(result.Removed, filepath.Base(filename))
+			result.Reclaimed += uint64(info.Size())
+		}
+	}
+	if err := db.Close(); err != nil {
+		return nil, err
+	}
+
+	info, err = os.Stat(metadataFilename)
+	if err != nil {
+		return nil, err
+	}
+	result.MetadataAfter = uint64(info.Size())
+	return result, nil
+}
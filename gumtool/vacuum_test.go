@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/a"
+)
+
+func TestVacuumRemovesUnusedFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "gumtool-vacuum-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tempDir)
+	schema := schemaFixture(&migrateTestSchema{
+		[]migrateTestDimensions{{"dim1", "uint32", false}},
+		[]migrateTestMetrics{{"metric1", "uint32"}},
+	})
+	schema.DiskBacked = true
+	schema.Dir = tempDir
+	db, err := gumshoe.NewDB(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows := []gumshoe.RowMap{{"at": 0.0, "dim1": 1.0, "metric1": 1.0}}
+	if err := db.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// This row is only in the WAL, which vacuuming flushes.
+	if err := db.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	expected := db.GetDebugRows()
+	expected[0].Count++
+	expected[0].RowMap["metric1"] = uint32(2)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Files left behind by an interrupted flush.
+	orphans := []string{"interval.0.generation0007.segment0000.dat", "dimension.index0.generation3.gob.gz"}
+	for _, name := range orphans {
+		if err := ioutil.WriteFile(filepath.Join(tempDir, name), []byte("orphan"), 0666); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	result, err := vacuumDB(tempDir)
+	a.Assert(t, err, a.IsNil)
+	sort.Strings(result.Removed)
+	sort.Strings(orphans)
+	a.Assert(t, result.Removed, a.DeepEquals, orphans)
+	a.Assert(t, result.Reclaimed, a.Equals, uint64(12))
+
+	db, err = gumshoe.OpenDBDir(tempDir)
+	a.Assert(t, err, a.IsNil)
+	defer db.Close()
+	a.Assert(t, db.GetDebugRows(), a.DeepEquals, expected)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func init() {
+	commandsByName["verify"] = command{
+		description: "check a GumshoeDB database's files against its metadata",
+		fn:          verify,
+	}
+}
+
+func verify(args []string) {
+	flags := flag.NewFlagSet("gumtool verify", flag.ExitOnError)
+	dir := flags.String("dir", "", "the GumshoeDB database directory to verify")
+	checksums := flags.Bool("checksums", false, "also check the segment files against their checksums")
+	flags.Parse(args)
+
+	if *dir == "" {
+		fatalln("-dir must be provided")
+	}
+
+	// The views are DBs of their own.
+	dirs := []string{*dir}
+	viewMetadata, err := filepath.Glob(filepath.Join(*dir, gumshoe.ViewsDir, "*", gumshoe.MetadataFilename))
+	if err != nil {
+		fatalln(err)
+	}
+	for _, filename := range viewMetadata {
+		dirs = append(dirs, filepath.Dir(filename))
+	}
+
+	numProblems := 0
+	for _, dir := range dirs {
+		problems, err := gumshoe.VerifyDir(dir, *checksums)
+		if err != nil {
+			fatalf("%s: %s\n", dir, err)
+		}
+		for _, problem := range problems {
+			fmt.Println(problem)
+		}
+		numProblems += len(problems)
+	}
+	if numProblems > 0 {
+		fatalf("Found %d problem(s).\n", numProblems)
+	}
+	fmt.Printf("Verified %d DB(s); found no problems.\n", len(dirs))
+}
@@ -0,0 +1,114 @@
+// Package auth authenticates HTTP requests by API key and authorizes them according to the key's role.
+package auth
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// A Role determines which endpoints a key may use. Each role may do everything the lesser roles may.
+type Role int
+
+const (
+	RoleNone  Role = iota // Anonymous requests
+	RoleRead              // Queries, dimension and lookup tables, and status
+	RoleWrite             // Inserts
+	RoleAdmin             // Deleting rows, registering lookup tables, /admin, and /debug
+)
+
+var roleNames = map[string]Role{
+	"read":  RoleRead,
+	"write": RoleWrite,
+	"admin": RoleAdmin,
+}
+
+// ParseRole parses a role name: "read", "write", or "admin".
+func ParseRole(s string) (Role, error) {
+	if role, ok := roleNames[s]; ok {
+		return role, nil
+	}
+	return RoleNone, fmt.Errorf("unknown role %q (must be read, write, or admin)", s)
+}
+
+func (r Role) String() string {
+	for name, role := range roleNames {
+		if role == r {
+			return name
+		}
+	}
+	return "none"
+}
+
+// RequiredRole returns the role needed to make req. Requests to a table (under /tables/{name}) need the same
+// roles as the corresponding requests to the default DB.
+func RequiredRole(req *http.Request) Role {
+	path := req.URL.Path
+	if strings.HasPrefix(path, "/tables/") {
+		if i := strings.IndexByte(path[len("/tables/"):], '/'); i >= 0 {
+			path = path[len("/tables/")+i:]
+		}
+	}
+	switch {
+	case strings.HasPrefix(path, "/admin/"), strings.HasPrefix(path, "/debug/"):
+		return RoleAdmin
+	case req.Method == "DELETE" && path == "/rows":
+		return RoleAdmin
+	case req.Method == "PUT" && strings.HasPrefix(path, "/lookup_tables/"):
+		return RoleAdmin
+	case path == "/insert", path == "/prometheus/write", path == "/write":
+		return RoleWrite
+	}
+	return RoleRead
+}
+
+// NewHandler returns a handler which passes requests on to h only if they give (in the header named header)
+// a key whose role permits them (see RequiredRole); other requests are rejected with a 401 (for a missing or
+// unknown key) or a 403. If keys is empty, every request is allowed. /healthz and /readyz never need a key,
+// and if anonymousStatusz is true, neither does /statusz (so that health checks don't need one).
+func NewHandler(h http.Handler, header string, keys map[string]Role, anonymousStatusz bool) http.Handler {
+	if len(keys) == 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if anonymousStatusz && r.URL.Path == "/statusz" || r.URL.Path == "/healthz" || r.URL.Path == "/readyz" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		key := r.Header.Get(header)
+		if key == "" {
+			http.Error(w, "an API key is required (in the "+header+" header)", http.StatusUnauthorized)
+			return
+		}
+		role, ok := keys[key]
+		if !ok {
+			http.Error(w, "unknown API key", http.StatusUnauthorized)
+			return
+		}
+		if required := RequiredRole(r); role < required {
+			msg := fmt.Sprintf("this API key has the %s role; %s %s requires %s", role, r.Method, r.URL.Path,
+				required)
+			http.Error(w, msg, http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// NewTransport returns an http.RoundTripper which adds key (in the header named header) to each request
+// before passing it on to t. This is used by the router to authenticate itself to the shards.
+func NewTransport(t http.RoundTripper, header, key string) http.RoundTripper {
+	return &keyTransport{t, header, key}
+}
+
+type keyTransport struct {
+	http.RoundTripper
+	header, key string
+}
+
+func (t *keyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// A RoundTripper must not modify the request.
+	req = req.Clone(req.Context())
+	req.Header.Set(t.header, t.key)
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	keys := map[string]Role{"r": RoleRead, "w": RoleWrite, "a": RoleAdmin}
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "X-API-Key", keys, true)
+
+	for _, tt := range []struct {
+		method     string
+		path       string
+		key        string
+		wantStatus int
+	}{
+		{"GET", "/statusz", "", 200},
+		{"GET", "/healthz", "", 200},
+		{"GET", "/readyz", "", 200},
+		{"POST", "/query", "", 401},
+		{"POST", "/query", "bogus", 401},
+		{"POST", "/query", "r", 200},
+		{"POST", "/query", "w", 200},
+		{"PUT", "/insert", "r", 403},
+		{"PUT", "/insert", "w", 200},
+		{"POST", "/prometheus/write", "r", 403},
+		{"POST", "/prometheus/write", "w", 200},
+		{"POST", "/write", "r", 403},
+		{"POST", "/tables/events/write", "w", 200},
+		{"GET", "/lookup_tables/x", "r", 200},
+		{"PUT", "/lookup_tables/x", "w", 403},
+		{"PUT", "/lookup_tables/x", "a", 200},
+		{"DELETE", "/rows", "w", 403},
+		{"DELETE", "/rows", "a", 200},
+		{"PUT", "/admin/retention", "w", 403},
+		{"PUT", "/admin/retention", "a", 200},
+		{"GET", "/debug/rows", "r", 403},
+		{"GET", "/tables", "r", 200},
+		{"POST", "/tables/events/query", "r", 200},
+		{"PUT", "/tables/events/insert", "r", 403},
+		{"PUT", "/tables/events/insert", "w", 200},
+		{"PUT", "/tables/events/admin/retention", "w", 403},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.key != "" {
+			req.Header.Set("X-API-Key", tt.key)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s %s with key %q: got status %d; want %d", tt.method, tt.path, tt.key, rec.Code,
+				tt.wantStatus)
+		}
+	}
+}
+
+func TestHandlerWithoutKeys(t *testing.T) {
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), "X-API-Key", nil, false)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("PUT", "/admin/retention", nil))
+	if rec.Code != 200 {
+		t.Errorf("got status %d; want 200", rec.Code)
+	}
+}
+
+func TestTransport(t *testing.T) {
+	var got string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("X-API-Key")
+	}))
+	defer server.Close()
+	client := &http.Client{Transport: NewTransport(http.DefaultTransport, "X-API-Key", "secret")}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got != "secret" {
+		t.Errorf("got key %q; want %q", got, "secret")
+	}
+}
@@ -4,10 +4,14 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/auth"
 
 	"github.com/philc/gumshoedb/internal/github.com/BurntSushi/toml"
 	"github.com/philc/gumshoedb/internal/github.com/dustin/go-humanize"
@@ -16,22 +20,73 @@ import (
 // All struct fields with a toml tag are required (see checkUndefinedFields).
 
 type Schema struct {
-	SegmentSize      string      `toml:"segment_size"`
-	IntervalDuration Duration    `toml:"interval_duration"`
-	TimestampColumn  [2]string   `toml:"timestamp_column"`
-	DimensionColumns [][2]string `toml:"dimension_columns"`
-	MetricColumns    [][2]string `toml:"metric_columns"`
+	SegmentSize        string      `toml:"segment_size"`
+	IntervalDuration   Duration    `toml:"interval_duration"`
+	TimestampColumn    [2]string   `toml:"timestamp_column"`
+	DimensionColumns   [][2]string `toml:"dimension_columns"`
+	MetricColumns      [][2]string `toml:"metric_columns"`
+	BloomFilterColumns []string    `toml:"bloom_filter_columns"`
+	DroppedColumns     []string    `toml:"dropped_columns"`
 }
 
 type Config struct {
-	ListenAddr       string   `toml:"listen_addr"`
-	StatsdAddr       string   `toml:"statsd_addr"`
-	OpenFileLimit    int      `toml:"open_file_limit"`
-	DatabaseDir      string   `toml:"database_dir"`
-	FlushInterval    Duration `toml:"flush_interval"`
-	QueryParallelism int      `toml:"query_parallelism"`
-	RetentionDays    int      `toml:"retention_days"`
-	Schema           Schema   `toml:"schema"`
+	ListenAddr                string     `toml:"listen_addr"`
+	TLSCertFile               string     `toml:"tls_cert_file"`
+	TLSKeyFile                string     `toml:"tls_key_file"`
+	TLSClientCAFile           string     `toml:"tls_client_ca_file"`
+	APIKeys                   [][]string `toml:"api_keys"`
+	APIKeyHeader              string     `toml:"api_key_header"`
+	AnonymousStatusz          bool       `toml:"anonymous_statusz"`
+	ShardAPIKey               string     `toml:"shard_api_key"`
+	StatsdAddr                string     `toml:"statsd_addr"`
+	OpenFileLimit             int        `toml:"open_file_limit"`
+	DatabaseDir               string     `toml:"database_dir"`
+	FlushInterval             Duration   `toml:"flush_interval"`
+	QueryParallelism          int        `toml:"query_parallelism"`
+	QueryTimeout              Duration   `toml:"query_timeout"`
+	QueryCacheSize            int        `toml:"query_cache_size"`
+	SlowQueryThreshold        Duration   `toml:"slow_query_threshold"`
+	SlowQueryLogSize          int        `toml:"slow_query_log_size"`
+	MaxConcurrentQueries      int        `toml:"max_concurrent_queries"`
+	QueryQueueSize            int        `toml:"query_queue_size"`
+	MaxConcurrentBatchQueries int        `toml:"max_concurrent_batch_queries"`
+	BatchQueryQueueSize       int        `toml:"batch_query_queue_size"`
+	MaxDecompressedBodySize   ByteSize   `toml:"max_decompressed_body_size"`
+	GzipShardInserts          bool       `toml:"gzip_shard_inserts"`
+	GzipQueryStreams          bool       `toml:"gzip_query_streams"`
+	ShardGRPC                 bool       `toml:"shard_grpc"`
+	ShardTLS                  bool       `toml:"shard_tls"`
+	ShardTLSCAFile            string     `toml:"shard_tls_ca_file"`
+	ShardTLSCertFile          string     `toml:"shard_tls_cert_file"`
+	ShardTLSKeyFile           string     `toml:"shard_tls_key_file"`
+	MaxPendingInsertRows      int        `toml:"max_pending_insert_rows"`
+	MaxPendingInsertBytes     ByteSize   `toml:"max_pending_insert_bytes"`
+	InsertRateLimit           float64    `toml:"insert_rate_limit"`
+	InsertRateBurst           int        `toml:"insert_rate_burst"`
+	InsertRateLimitHeader     string     `toml:"insert_rate_limit_header"`
+	RetentionDays             int        `toml:"retention_days"`
+	TTLColumn                 string     `toml:"ttl_column"`
+	LateArrivalWindow         Duration   `toml:"late_arrival_window"`
+	StringOverflow            string     `toml:"string_overflow"`
+	CompressSegments          bool       `toml:"compress_segments"`
+	SegmentVerification       string     `toml:"segment_verification"`
+	SegmentAdvice             string     `toml:"segment_advice"`
+	MlockWindow               Duration   `toml:"mlock_window"`
+	DirectIO                  bool       `toml:"direct_io"`
+	ColdStorageDir            string     `toml:"cold_storage_dir"`
+	ColdStorageURL            string     `toml:"cold_storage_url"`
+	ColdAfter                 Duration   `toml:"cold_after"`
+	ColdCacheSize             ByteSize   `toml:"cold_cache_size"`
+	Rollups                   [][]string `toml:"rollups"`
+	DimensionRetention        [][]string `toml:"dimension_retention"`
+	Views                     [][]string `toml:"views"`
+	RemoteWrite               [][]string `toml:"remote_write"`
+	InfluxWrite               [][]string `toml:"influx_write"`
+	GraphiteAddr              string     `toml:"graphite_addr"`
+	Graphite                  [][]string `toml:"graphite"`
+	ReadOnly                  bool       `toml:"read_only"`
+	Tables                    [][]string `toml:"tables"`
+	Schema                    Schema     `toml:"schema"`
 }
 
 // Produces a gumshoe Schema based on a Config's values.
@@ -42,6 +97,9 @@ func (c *Config) makeSchema() (*gumshoe.Schema, error) {
 	case "":
 		return nil, errors.New("database directory must be provided. Use 'MEMORY' to specify an in-memory DB.")
 	case "MEMORY":
+		if c.ReadOnly {
+			return nil, errors.New("an in-memory DB cannot be read-only")
+		}
 		diskBacked = false
 	default:
 		dir = c.DatabaseDir
@@ -119,9 +177,138 @@ func (c *Config) makeSchema() (*gumshoe.Schema, error) {
 	if c.QueryParallelism < 1 {
 		return nil, fmt.Errorf("bad query parallelism (must be positive): %d", c.QueryParallelism)
 	}
+	if c.QueryTimeout.Duration < 0 {
+		return nil, fmt.Errorf("query timeout is negative: %s", c.QueryTimeout)
+	}
+	if c.QueryCacheSize < 0 {
+		return nil, fmt.Errorf("query cache size is negative: %d", c.QueryCacheSize)
+	}
+	if c.SlowQueryThreshold.Duration < 0 {
+		return nil, fmt.Errorf("slow query threshold is negative: %s", c.SlowQueryThreshold)
+	}
+	if c.SlowQueryLogSize < 0 {
+		return nil, fmt.Errorf("slow query log size is negative: %d", c.SlowQueryLogSize)
+	}
+	if c.MaxConcurrentQueries < 1 {
+		return nil, fmt.Errorf("bad max concurrent queries (must be positive): %d", c.MaxConcurrentQueries)
+	}
+	if c.QueryQueueSize < 0 {
+		return nil, fmt.Errorf("query queue size is negative: %d", c.QueryQueueSize)
+	}
+	if c.MaxConcurrentBatchQueries < 1 {
+		return nil, fmt.Errorf("bad max concurrent batch queries (must be positive): %d",
+			c.MaxConcurrentBatchQueries)
+	}
+	if c.BatchQueryQueueSize < 0 {
+		return nil, fmt.Errorf("batch query queue size is negative: %d", c.BatchQueryQueueSize)
+	}
+	if c.MaxDecompressedBodySize.Bytes < 1024 {
+		return nil, fmt.Errorf("max decompressed body size is too small: %s", c.MaxDecompressedBodySize)
+	}
+	if c.MaxPendingInsertRows < 0 {
+		return nil, fmt.Errorf("max pending insert rows is negative: %d", c.MaxPendingInsertRows)
+	}
 	if c.RetentionDays < 1 {
 		return nil, fmt.Errorf("retention days is too small: %d", c.RetentionDays)
 	}
+	if c.InsertRateLimit < 0 {
+		return nil, fmt.Errorf("insert rate limit is negative: %g", c.InsertRateLimit)
+	}
+	if c.InsertRateLimit > 0 && c.InsertRateBurst < 1 {
+		return nil, fmt.Errorf("bad insert rate burst (must be positive): %d", c.InsertRateBurst)
+	}
+	if c.LateArrivalWindow.Duration < 0 {
+		return nil, fmt.Errorf("late arrival window is negative: %s", c.LateArrivalWindow)
+	}
+	if c.TTLColumn != "" {
+		ok := false
+		for _, col := range dimensions {
+			if col.Name == c.TTLColumn {
+				if col.String {
+					return nil, fmt.Errorf("TTL column (%q) cannot be a string column", c.TTLColumn)
+				}
+				ok = true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("TTL column (%q) is not a dimension column", c.TTLColumn)
+		}
+	}
+	for _, name := range c.Schema.BloomFilterColumns {
+		ok := false
+		for _, col := range dimensions {
+			if col.Name == name {
+				if !col.String {
+					return nil, fmt.Errorf("bloom filter column (%q) must be a string column", name)
+				}
+				ok = true
+			}
+		}
+		if !ok {
+			return nil, fmt.Errorf("bloom filter column (%q) is not a dimension column", name)
+		}
+	}
+	for _, name := range c.Schema.DroppedColumns {
+		for _, col := range dimensions {
+			if col.Name == name {
+				return nil, fmt.Errorf("dropped column (%q) is still a dimension column", name)
+			}
+		}
+		for _, col := range metrics {
+			if col.Name == name {
+				return nil, fmt.Errorf("dropped column (%q) is still a metric column", name)
+			}
+		}
+	}
+	stringOverflow, ok := stringOverflowPolicies[c.StringOverflow]
+	if !ok {
+		return nil, fmt.Errorf(`bad string overflow policy %q (must be "reject", "other", or "promote")`,
+			c.StringOverflow)
+	}
+	if stringOverflow == gumshoe.PromoteStringOverflow && !diskBacked {
+		return nil, errors.New(`string_overflow = "promote" requires a disk-backed DB`)
+	}
+	segmentVerification, ok := segmentVerifications[c.SegmentVerification]
+	if !ok {
+		return nil, fmt.Errorf(`bad segment verification %q (must be "open", "never", or "always")`,
+			c.SegmentVerification)
+	}
+	segmentAdvice, ok := segmentAdvices[c.SegmentAdvice]
+	if !ok {
+		return nil, fmt.Errorf(`bad segment advice %q (must be "normal", "random", or "willneed")`, c.SegmentAdvice)
+	}
+	if c.MlockWindow.Duration < 0 {
+		return nil, fmt.Errorf("mlock window is negative: %s", c.MlockWindow)
+	}
+	var coldStore gumshoe.ColdStore
+	if c.ColdStorageDir != "" || c.ColdStorageURL != "" {
+		if c.ColdStorageDir != "" && c.ColdStorageURL != "" {
+			return nil, errors.New("cold_storage_dir and cold_storage_url can't both be set")
+		}
+		if !diskBacked {
+			return nil, errors.New("cold storage requires a disk-backed DB")
+		}
+		if c.ColdAfter.Duration <= 0 {
+			return nil, fmt.Errorf("cold_after must be positive when using cold storage (got %s)", c.ColdAfter)
+		}
+		if c.ColdStorageDir != "" {
+			coldStore = gumshoe.DirColdStore(c.ColdStorageDir)
+		} else if coldStore, err = parseColdStorageURL(c.ColdStorageURL); err != nil {
+			return nil, err
+		}
+	}
+	rollups, err := parseRollups(c.Rollups, dimensions, c.Schema.IntervalDuration.Duration)
+	if err != nil {
+		return nil, err
+	}
+	dimensionRetention, err := parseDimensionRetention(c.DimensionRetention, dimensions, c.TTLColumn)
+	if err != nil {
+		return nil, err
+	}
+	views, err := parseViews(c.Views, dimensions, metrics, c.TTLColumn)
+	if err != nil {
+		return nil, err
+	}
 	if segmentSize < 100 {
 		return nil, fmt.Errorf("segment size seems too small: %s", c.Schema.SegmentSize)
 	}
@@ -137,13 +324,422 @@ func (c *Config) makeSchema() (*gumshoe.Schema, error) {
 		IntervalDuration: c.Schema.IntervalDuration.Duration,
 		DiskBacked:       diskBacked,
 		Dir:              dir,
+		DroppedColumns:   c.Schema.DroppedColumns,
 		RunConfig: gumshoe.RunConfig{
-			FixedRetention: true,
-			Retention:      time.Duration(c.RetentionDays) * 24 * time.Hour,
+			FixedRetention:      true,
+			Retention:           time.Duration(c.RetentionDays) * 24 * time.Hour,
+			TTLColumn:           c.TTLColumn,
+			LateArrivalWindow:   c.LateArrivalWindow.Duration,
+			StringOverflow:      stringOverflow,
+			CompressSegments:    c.CompressSegments,
+			SegmentVerification: segmentVerification,
+			SegmentAdvice:       segmentAdvice,
+			MlockWindow:         c.MlockWindow.Duration,
+			DirectIO:            c.DirectIO,
+			ColdStore:           coldStore,
+			ColdAfter:           c.ColdAfter.Duration,
+			ColdCacheSize:       int(c.ColdCacheSize.Bytes),
+			BloomFilterColumns:  c.Schema.BloomFilterColumns,
+			Rollups:             rollups,
+			DimensionRetention:  dimensionRetention,
+			Views:               views,
+			ReadOnly:            c.ReadOnly,
 		},
 	}, nil
 }
 
+var stringOverflowPolicies = map[string]gumshoe.StringOverflowPolicy{
+	"reject":  gumshoe.RejectStringOverflow,
+	"other":   gumshoe.OtherStringOverflow,
+	"promote": gumshoe.PromoteStringOverflow,
+}
+
+var segmentVerifications = map[string]gumshoe.SegmentVerification{
+	"open":   gumshoe.VerifySegmentsOnOpen,
+	"never":  gumshoe.VerifySegmentsNever,
+	"always": gumshoe.VerifySegmentsAlways,
+}
+
+var segmentAdvices = map[string]gumshoe.SegmentAdvice{
+	"normal":   gumshoe.AdviseNormal,
+	"random":   gumshoe.AdviseRandom,
+	"willneed": gumshoe.AdviseWillNeed,
+}
+
+// parseColdStorageURL makes the cold store for a cold_storage_url, which names a bucket of an S3-compatible
+// object store and a prefix for the object keys, such as "s3://bucket/events/?region=us-west-2". The region
+// defaults to us-east-1, and the endpoint parameter (such as endpoint=https://storage.googleapis.com) to
+// AWS's endpoint for the region. The credentials are read from the environment variables AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY, and (if set) AWS_SESSION_TOKEN, so that they needn't be in the config file.
+func parseColdStorageURL(s string) (*gumshoe.S3ColdStore, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "s3" || u.Host == "" {
+		return nil, fmt.Errorf("bad cold storage URL %q (must be like s3://bucket/prefix/)", s)
+	}
+	store := &gumshoe.S3ColdStore{
+		Endpoint:     u.Query().Get("endpoint"),
+		Region:       u.Query().Get("region"),
+		Bucket:       u.Host,
+		Prefix:       strings.TrimPrefix(u.Path, "/"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+	}
+	if store.Prefix != "" && !strings.HasSuffix(store.Prefix, "/") {
+		store.Prefix += "/"
+	}
+	if store.Region == "" {
+		store.Region = "us-east-1"
+	}
+	if store.Endpoint == "" {
+		store.Endpoint = "https://s3." + store.Region + ".amazonaws.com"
+	}
+	if store.AccessKey == "" || store.SecretKey == "" {
+		return nil, errors.New("cold_storage_url requires AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY to be set")
+	}
+	return store, nil
+}
+
+// parseRollups parses rollup rules, each written as the age at which the rule applies, its resolution, and
+// the names of the dimension columns it drops (such as ["168h", "24h", "city", "hostname"]).
+func parseRollups(rules [][]string, dimensions []gumshoe.DimensionColumn,
+	intervalDuration time.Duration) ([]gumshoe.RollupRule, error) {
+
+	var rollups []gumshoe.RollupRule
+	for _, fields := range rules {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("rollup %q must give an age and a resolution", fields)
+		}
+		after, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad rollup age: %s", err)
+		}
+		resolution, err := time.ParseDuration(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("bad rollup resolution: %s", err)
+		}
+		if after <= 0 {
+			return nil, fmt.Errorf("rollup age must be positive (got %s)", after)
+		}
+		previous := gumshoe.RollupRule{Resolution: intervalDuration}
+		if len(rollups) > 0 {
+			previous = rollups[len(rollups)-1]
+		}
+		if after < previous.After {
+			return nil, fmt.Errorf("rollups must be in order of age (%s is before %s)", after, previous.After)
+		}
+		if resolution < previous.Resolution || resolution%previous.Resolution != 0 {
+			return nil, fmt.Errorf("rollup resolution %s must be a multiple of %s", resolution, previous.Resolution)
+		}
+		for _, name := range fields[2:] {
+			ok := false
+			for _, col := range dimensions {
+				if col.Name == name {
+					ok = true
+				}
+			}
+			if !ok {
+				return nil, fmt.Errorf("rollup column (%q) is not a dimension column", name)
+			}
+		}
+		rule := gumshoe.RollupRule{After: after, Resolution: resolution, DropDimensions: fields[2:]}
+		rollups = append(rollups, rule)
+	}
+	return rollups, nil
+}
+
+// parseDimensionRetention parses dimension retention rules, each written as the age at which the rule applies
+// followed by the names of the dimension columns it drops (such as ["336h", "hostname"]).
+func parseDimensionRetention(rules [][]string, dimensions []gumshoe.DimensionColumn,
+	ttlColumn string) ([]gumshoe.DimensionRetentionRule, error) {
+
+	var retention []gumshoe.DimensionRetentionRule
+	for _, fields := range rules {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("dimension retention %q must give an age and at least one column", fields)
+		}
+		after, err := time.ParseDuration(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("bad dimension retention age: %s", err)
+		}
+		if after <= 0 {
+			return nil, fmt.Errorf("dimension retention age must be positive (got %s)", after)
+		}
+		if len(retention) > 0 && after < retention[len(retention)-1].After {
+			return nil, fmt.Errorf("dimension retention must be in order of age (%s is before %s)",
+				after, retention[len(retention)-1].After)
+		}
+		for _, name := range fields[1:] {
+			ok := false
+			for _, col := range dimensions {
+				if col.Name == name {
+					ok = true
+				}
+			}
+			if !ok {
+				return nil, fmt.Errorf("dimension retention column (%q) is not a dimension column", name)
+			}
+			// Otherwise rows would lose their TTLs.
+			if name == ttlColumn {
+				return nil, fmt.Errorf("the TTL column (%q) cannot be dropped by dimension retention", name)
+			}
+		}
+		retention = append(retention, gumshoe.DimensionRetentionRule{After: after, Dimensions: fields[1:]})
+	}
+	return retention, nil
+}
+
+// parseViews parses materialized view definitions, each written as the view's name followed by the names of
+// its columns (such as ["by_country", "country", "visits"]).
+func parseViews(definitions [][]string, dimensions []gumshoe.DimensionColumn, metrics []gumshoe.MetricColumn,
+	ttlColumn string) ([]gumshoe.View, error) {
+
+	var views []gumshoe.View
+	names := make(map[string]bool)
+	for _, fields := range definitions {
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("view %q must give a name and at least one column", fields)
+		}
+		view := gumshoe.View{Name: fields[0]}
+		if view.Name == "" || view.Name[0] == '.' || strings.ContainsAny(view.Name, `/\`) {
+			return nil, fmt.Errorf("bad view name %q", view.Name)
+		}
+		if names[view.Name] {
+			return nil, fmt.Errorf("duplicate view name %q", view.Name)
+		}
+		names[view.Name] = true
+	columns:
+		for _, name := range fields[1:] {
+			for _, col := range dimensions {
+				if col.Name == name {
+					view.DimensionColumns = append(view.DimensionColumns, name)
+					continue columns
+				}
+			}
+			for _, col := range metrics {
+				if col.Name == name {
+					view.MetricColumns = append(view.MetricColumns, name)
+					continue columns
+				}
+			}
+			return nil, fmt.Errorf("view column (%q) is not a dimension or metric column", name)
+		}
+		// Otherwise rows would outlive their TTLs in the view.
+		if ttlColumn != "" && !contains(view.DimensionColumns, ttlColumn) {
+			return nil, fmt.Errorf("view %q must include the TTL column (%q)", view.Name, ttlColumn)
+		}
+		views = append(views, view)
+	}
+	return views, nil
+}
+
+// A Table is one of the additional DBs listed in a config's tables, with its own config file.
+type Table struct {
+	Name   string
+	Config *Config
+	Schema *gumshoe.Schema
+}
+
+// checkTables checks the table list, each written as the table's name and the path of its config file (such
+// as ["events", "events.toml"]).
+func (c *Config) checkTables() error {
+	names := make(map[string]bool)
+	for _, fields := range c.Tables {
+		if len(fields) != 2 {
+			return fmt.Errorf("table %q must give a name and a config file", fields)
+		}
+		name := fields[0]
+		if name == "" || name[0] == '.' || strings.ContainsAny(name, `/\`) {
+			return fmt.Errorf("bad table name %q", name)
+		}
+		if names[name] {
+			return fmt.Errorf("duplicate table name %q", name)
+		}
+		names[name] = true
+	}
+	return nil
+}
+
+// LoadTables loads the config file of each of c's tables. The tables' DBs must be in separate directories.
+func (c *Config) LoadTables() ([]Table, error) {
+	dirs := map[string]bool{c.DatabaseDir: true}
+	var tables []Table
+	for _, fields := range c.Tables {
+		table := Table{Name: fields[0]}
+		var err error
+		table.Config, table.Schema, err = LoadConfig(fields[1], nil)
+		if err != nil {
+			return nil, fmt.Errorf("error loading the config of table %q: %s", table.Name, err)
+		}
+		if len(table.Config.Tables) > 0 {
+			return nil, fmt.Errorf("the config of table %q cannot list tables", table.Name)
+		}
+		if dir := table.Config.DatabaseDir; dir != "MEMORY" {
+			if dirs[dir] {
+				return nil, fmt.Errorf("table %q has the same database_dir (%q) as another DB", table.Name, dir)
+			}
+			dirs[dir] = true
+		}
+		tables = append(tables, table)
+	}
+	return tables, nil
+}
+
+func contains(values []string, s string) bool {
+	for _, t := range values {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
+
+// APIKeyRoles parses api_keys, each written as a key and its role (such as ["3f9a01c2", "read"]).
+func (c *Config) APIKeyRoles() (map[string]auth.Role, error) {
+	keys := make(map[string]auth.Role)
+	for _, fields := range c.APIKeys {
+		if len(fields) != 2 {
+			return nil, errors.New("each API key must be given as a key and a role")
+		}
+		if fields[0] == "" {
+			return nil, errors.New("API keys cannot be empty")
+		}
+		if _, ok := keys[fields[0]]; ok {
+			return nil, errors.New("duplicate API key")
+		}
+		role, err := auth.ParseRole(fields[1])
+		if err != nil {
+			return nil, err
+		}
+		keys[fields[0]] = role
+	}
+	if len(keys) > 0 && c.APIKeyHeader == "" {
+		return nil, errors.New("api_key_header is required with api_keys")
+	}
+	return keys, nil
+}
+
+// RemoteWriteRules parses the rules for Prometheus remote writes, each written as a metric name (or "*" for
+// any metric), the metric column for its samples' values, and any label mappings of the form label=dimension
+// (such as ["http_requests_total", "requests", "handler=path", "code=status"]).
+func (c *Config) RemoteWriteRules(schema *gumshoe.Schema) ([]gumshoe.RemoteWriteRule, error) {
+	var rules []gumshoe.RemoteWriteRule
+	for _, fields := range c.RemoteWrite {
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("remote write rule %q must give a metric name and a metric column", fields)
+		}
+		rule := gumshoe.RemoteWriteRule{Metric: fields[0], Column: fields[1], Labels: make(map[string]string)}
+		if !hasMetric(schema, rule.Column) {
+			return nil, fmt.Errorf("remote write column (%q) is not a metric column", rule.Column)
+		}
+		for _, mapping := range fields[2:] {
+			parts := strings.SplitN(mapping, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, fmt.Errorf("bad remote write label mapping %q (must be label=dimension)", mapping)
+			}
+			if !hasDimension(schema, parts[1]) {
+				return nil, fmt.Errorf("remote write label mapping %q is not to a dimension column", mapping)
+			}
+			rule.Labels[parts[0]] = parts[1]
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// InfluxRules parses the rules for Influx line protocol writes, each written as a measurement (or "*" for any
+// measurement) followed by mappings of the form key=column (such as ["cpu", "usage_idle=idle", "host=host"]).
+// A mapping to a metric column is of a field, and a mapping to a dimension column is of a tag (or, for the
+// key _measurement, of the measurement).
+func (c *Config) InfluxRules(schema *gumshoe.Schema) ([]gumshoe.InfluxRule, error) {
+	var rules []gumshoe.InfluxRule
+	for _, fields := range c.InfluxWrite {
+		if len(fields) < 2 || fields[0] == "" {
+			return nil, fmt.Errorf("influx write rule %q must give a measurement and a field mapping", fields)
+		}
+		rule := gumshoe.InfluxRule{
+			Measurement: fields[0],
+			Fields:      make(map[string]string),
+			Tags:        make(map[string]string),
+		}
+		for _, mapping := range fields[1:] {
+			parts := strings.SplitN(mapping, "=", 2)
+			if len(parts) != 2 || parts[0] == "" {
+				return nil, fmt.Errorf("bad influx write mapping %q (must be key=column)", mapping)
+			}
+			switch {
+			case hasMetric(schema, parts[1]):
+				rule.Fields[parts[0]] = parts[1]
+			case hasDimension(schema, parts[1]):
+				rule.Tags[parts[0]] = parts[1]
+			default:
+				return nil, fmt.Errorf("influx write mapping %q is not to a metric or dimension column", mapping)
+			}
+		}
+		if len(rule.Fields) == 0 {
+			return nil, fmt.Errorf("influx write rule %q must map a field to a metric column", fields)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// GraphiteRules parses the rules for Graphite metrics, each written as a pattern and a metric column (such as
+// ["servers.{host}.cpu.*", "cpu"]).
+func (c *Config) GraphiteRules(schema *gumshoe.Schema) ([]gumshoe.GraphiteRule, error) {
+	var rules []gumshoe.GraphiteRule
+	for _, fields := range c.Graphite {
+		if len(fields) != 2 || fields[0] == "" {
+			return nil, fmt.Errorf("graphite rule %q must give a pattern and a metric column", fields)
+		}
+		rule := gumshoe.GraphiteRule{Nodes: strings.Split(fields[0], "."), Column: fields[1]}
+		if !hasMetric(schema, rule.Column) {
+			return nil, fmt.Errorf("graphite column (%q) is not a metric column", rule.Column)
+		}
+		for _, node := range rule.Nodes {
+			if strings.HasPrefix(node, "{") && strings.HasSuffix(node, "}") {
+				if !hasDimension(schema, node[1:len(node)-1]) {
+					return nil, fmt.Errorf("graphite pattern %q names %s, which is not a dimension column",
+						fields[0], node)
+				}
+			} else if node == "" || strings.ContainsAny(node, "{}") {
+				return nil, fmt.Errorf("bad graphite pattern %q", fields[0])
+			}
+		}
+		rules = append(rules, rule)
+	}
+	if c.GraphiteAddr != "" {
+		if len(rules) == 0 {
+			return nil, errors.New("graphite_addr is set but there are no graphite rules")
+		}
+		if c.ReadOnly {
+			return nil, errors.New("a read-only DB cannot listen for graphite metrics")
+		}
+	}
+	return rules, nil
+}
+
+func hasMetric(schema *gumshoe.Schema, name string) bool {
+	for _, col := range schema.MetricColumns {
+		if col.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasDimension(schema *gumshoe.Schema, name string) bool {
+	for _, col := range schema.DimensionColumns {
+		if col.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
 func parseColumn(col [2]string) (name, typ string, isString bool) {
 	name = col[0]
 	typ = col[1]
@@ -166,7 +762,46 @@ func (d *Duration) UnmarshalText(text []byte) error {
 
 func (d Duration) MarshalText() ([]byte, error) { return []byte(d.Duration.String()), nil }
 
+// ByteSize is a number of bytes written in a human-readable form, such as "64MB".
+type ByteSize struct {
+	Bytes uint64
+}
+
+func (b *ByteSize) UnmarshalText(text []byte) error {
+	var err error
+	b.Bytes, err = humanize.ParseBytes(string(text))
+	return err
+}
+
+func (b ByteSize) MarshalText() ([]byte, error) { return []byte(b.String()), nil }
+
+func (b ByteSize) String() string { return humanize.Bytes(b.Bytes) }
+
+// LoadConfig reads and checks the config file at path, and returns it along with the schema it describes. The
+// format of the file is given by its extension: .json for JSON (see LoadJSONConfig), .yaml or .yml for YAML
+// (see LoadYAMLConfig), and TOML otherwise. The values in overrides replace those in the file.
+func LoadConfig(path string, overrides Overrides) (*Config, *gumshoe.Schema, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		return LoadJSONConfig(f, overrides)
+	case ".yaml", ".yml":
+		return LoadYAMLConfig(f, overrides)
+	}
+	return LoadTOMLConfigWithOverrides(f, overrides)
+}
+
+// LoadTOMLConfig reads and checks a TOML config, and returns it along with the schema it describes.
 func LoadTOMLConfig(r io.Reader) (*Config, *gumshoe.Schema, error) {
+	return LoadTOMLConfigWithOverrides(r, nil)
+}
+
+// LoadTOMLConfigWithOverrides is LoadTOMLConfig, with the values in overrides replacing those in the file.
+func LoadTOMLConfigWithOverrides(r io.Reader, overrides Overrides) (*Config, *gumshoe.Schema, error) {
 	config := new(Config)
 	meta, err := toml.DecodeReader(r, config)
 	if err != nil {
@@ -175,9 +810,35 @@ func LoadTOMLConfig(r io.Reader) (*Config, *gumshoe.Schema, error) {
 	if err := checkUndefinedFields(meta, config); err != nil {
 		return nil, nil, err
 	}
-	schema, err := config.makeSchema()
+	return config.finishLoading(overrides)
+}
+
+// finishLoading applies overrides to a freshly decoded config, checks it, and makes its schema.
+func (c *Config) finishLoading(overrides Overrides) (*Config, *gumshoe.Schema, error) {
+	if err := overrides.apply(c); err != nil {
+		return nil, nil, err
+	}
+	if err := c.checkTLS(); err != nil {
+		return nil, nil, err
+	}
+	if _, err := c.APIKeyRoles(); err != nil {
+		return nil, nil, err
+	}
+	if err := c.checkTables(); err != nil {
+		return nil, nil, err
+	}
+	schema, err := c.makeSchema()
 	if err != nil {
 		return nil, nil, err
 	}
-	return config, schema, nil
+	if _, err := c.RemoteWriteRules(schema); err != nil {
+		return nil, nil, err
+	}
+	if _, err := c.InfluxRules(schema); err != nil {
+		return nil, nil, err
+	}
+	if _, err := c.GraphiteRules(schema); err != nil {
+		return nil, nil, err
+	}
+	return c, schema, nil
 }
@@ -0,0 +1,65 @@
+package config
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/BurntSushi/toml"
+)
+
+// LoadJSONConfig reads and checks a JSON config, and returns it along with the schema it describes. A JSON
+// config has the same settings as a TOML one, under the same names (with the schema settings in a "schema"
+// object), and all of them are required. Durations and byte sizes are strings, as in TOML.
+func LoadJSONConfig(r io.Reader, overrides Overrides) (*Config, *gumshoe.Schema, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	config := new(Config)
+	if err := decodeJSONFields(b, reflect.ValueOf(config).Elem(), nil); err != nil {
+		return nil, nil, err
+	}
+	return config.finishLoading(overrides)
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+
+// decodeJSONFields decodes the JSON object b into the fields of the struct v by their TOML names, recursing
+// into nested structs (such as the schema). Every such field must be given in b; other keys are ignored.
+func decodeJSONFields(b []byte, v reflect.Value, prefix []string) error {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		if len(prefix) == 0 {
+			return fmt.Errorf("bad JSON config: %s", err)
+		}
+		return fmt.Errorf("bad value for config field %q: %s", toml.Key(prefix), err)
+	}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Field(i)
+		tag := v.Type().Field(i).Tag.Get("toml")
+		if !field.CanSet() || tag == "" || tag == "-" {
+			continue
+		}
+		name := append(append([]string(nil), prefix...), tag)
+		raw, ok := fields[tag]
+		if !ok {
+			return fmt.Errorf("field %q not provided in config", toml.Key(name))
+		}
+		if field.Kind() == reflect.Struct && !field.Addr().Type().Implements(textUnmarshalerType) {
+			if err := decodeJSONFields(raw, field, name); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := json.Unmarshal(raw, field.Addr().Interface()); err != nil {
+			return fmt.Errorf("bad value for config field %q: %s", toml.Key(name), err)
+		}
+	}
+	return nil
+}
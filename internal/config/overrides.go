@@ -0,0 +1,101 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/philc/gumshoedb/internal/github.com/BurntSushi/toml"
+)
+
+// EnvPrefix begins the names of the environment variables which override config values (see EnvOverrides).
+const EnvPrefix = "GUMSHOE_"
+
+// Overrides are config values given outside of the config file, keyed by their TOML names ("listen_addr", or
+// "schema.segment_size" for a setting in a table). A value is TOML (such as 10, true, or [["a", "b"]]) or, if
+// it isn't valid TOML for the setting, a bare string (such as :9000 or 1h).
+//
+// Overrides is a flag.Value: each use of the flag sets one value, as name=value.
+type Overrides map[string]string
+
+// EnvOverrides returns the overrides given by environment variables: the value of GUMSHOE_LISTEN_ADDR
+// overrides listen_addr, GUMSHOE_SCHEMA_SEGMENT_SIZE overrides schema.segment_size, and so on.
+func EnvOverrides() Overrides {
+	overrides := make(Overrides)
+	for _, name := range nestedTOMLFields(reflect.ValueOf(new(Config)), nil) {
+		key := strings.Join(name, ".")
+		if value, ok := os.LookupEnv(EnvPrefix + strings.ToUpper(strings.Join(name, "_"))); ok {
+			overrides[key] = value
+		}
+	}
+	return overrides
+}
+
+func (o Overrides) String() string {
+	var pairs []string
+	for key, value := range o {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+func (o Overrides) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 {
+		return fmt.Errorf("config override %q is not of the form name=value", s)
+	}
+	o[parts[0]] = parts[1]
+	return nil
+}
+
+// apply sets the overridden values in c.
+func (o Overrides) apply(c *Config) error {
+	known := make(map[string]bool)
+	for _, name := range nestedTOMLFields(reflect.ValueOf(c), nil) {
+		known[strings.Join(name, ".")] = true
+	}
+	keys := make([]string, 0, len(o))
+	for key := range o {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if !known[key] {
+			return fmt.Errorf("cannot override unknown config setting %q", key)
+		}
+		name := strings.Split(key, ".")
+		table := ""
+		if len(name) > 1 {
+			table = "[" + strings.Join(name[:len(name)-1], ".") + "]\n"
+		}
+		// The value is decoded into an empty Config (as the decoder doesn't overwrite slices) and copied over.
+		setting := table + name[len(name)-1] + " = "
+		decoded := new(Config)
+		if _, err := toml.Decode(setting+o[key], decoded); err != nil {
+			decoded = new(Config)
+			if _, err := toml.Decode(setting+strconv.Quote(o[key]), decoded); err != nil {
+				return fmt.Errorf("bad override of config setting %s: %s", key, err)
+			}
+		}
+		tomlField(reflect.ValueOf(c), name).Set(tomlField(reflect.ValueOf(decoded), name))
+	}
+	return nil
+}
+
+// tomlField returns the field of the struct v (or a pointer to one) with the nested TOML name.
+func tomlField(v reflect.Value, name []string) reflect.Value {
+	v = reflect.Indirect(v)
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).Tag.Get("toml") == name[0] {
+			if len(name) == 1 {
+				return v.Field(i)
+			}
+			return tomlField(v.Field(i), name[1:])
+		}
+	}
+	panic("no config field " + name[0])
+}
@@ -0,0 +1,90 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// checkTLS checks that the TLS settings are consistent.
+func (c *Config) checkTLS() error {
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return errors.New("tls_cert_file and tls_key_file must be given together")
+	}
+	if c.TLSClientCAFile != "" && c.TLSCertFile == "" {
+		return errors.New("tls_client_ca_file requires tls_cert_file and tls_key_file")
+	}
+	if (c.ShardTLSCertFile == "") != (c.ShardTLSKeyFile == "") {
+		return errors.New("shard_tls_cert_file and shard_tls_key_file must be given together")
+	}
+	if !c.ShardTLS && (c.ShardTLSCAFile != "" || c.ShardTLSCertFile != "") {
+		return errors.New("shard_tls_ca_file and shard_tls_cert_file require shard_tls")
+	}
+	return nil
+}
+
+// ServerTLSConfig returns the TLS configuration for serving HTTPS, or nil if tls_cert_file is not set (in
+// which case the server speaks plain HTTP). If tls_client_ca_file is set, clients must present a certificate
+// signed by one of its CAs.
+func (c *Config) ServerTLSConfig() (*tls.Config, error) {
+	if c.TLSCertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	conf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if c.TLSClientCAFile != "" {
+		pool, err := loadCertPool(c.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return conf, nil
+}
+
+// ShardTLSConfig returns the TLS configuration for the router's connections to the shards, or nil if shard_tls
+// is false. The shards' certificates are verified against the CAs in shard_tls_ca_file (or the system's CAs),
+// and the router presents the certificate in shard_tls_cert_file, if given, to shards which require one.
+func (c *Config) ShardTLSConfig() (*tls.Config, error) {
+	if !c.ShardTLS {
+		return nil, nil
+	}
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	if c.ShardTLSCAFile != "" {
+		pool, err := loadCertPool(c.ShardTLSCAFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.RootCAs = pool
+	}
+	if c.ShardTLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.ShardTLSCertFile, c.ShardTLSKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+	return conf, nil
+}
+
+// loadCertPool reads the PEM-encoded CA certificates in filename.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", filename)
+	}
+	return pool, nil
+}
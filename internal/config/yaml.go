@@ -0,0 +1,27 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/philc/gumshoedb/gumshoe"
+
+	"github.com/philc/gumshoedb/internal/github.com/go-yaml/yaml"
+)
+
+// LoadYAMLConfig reads and checks a YAML config, and returns it along with the schema it describes. A YAML
+// config is a mapping with the same settings as a JSON config (see LoadJSONConfig).
+func LoadYAMLConfig(r io.Reader, overrides Overrides) (*Config, *gumshoe.Schema, error) {
+	var fields map[string]interface{}
+	if err := yaml.NewDecoder(r).Decode(&fields); err != nil {
+		return nil, nil, fmt.Errorf("bad YAML config: %s", err)
+	}
+	// The decoded YAML has the same shape as the JSON would, so it's converted and loaded as JSON.
+	b, err := json.Marshal(fields)
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad YAML config: %s", err)
+	}
+	return LoadJSONConfig(bytes.NewReader(b), overrides)
+}
@@ -0,0 +1,47 @@
+// Package debug serves runtime debugging endpoints (profiles, expvars, and goroutine dumps) for the server
+// and router. They're served on their own address, which shouldn't be reachable from outside the cluster.
+package debug
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"runtime"
+)
+
+// Handler returns a handler for the debugging endpoints:
+//
+//	/debug/pprof/       net/http/pprof's profiles (CPU, heap, goroutines, and so on)
+//	/debug/vars         expvar's variables (including runtime.MemStats)
+//	/debug/goroutines   a dump of every goroutine's stack
+func Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.HandleFunc("/debug/goroutines", handleGoroutines)
+	return mux
+}
+
+// handleGoroutines writes the stacks of all the goroutines.
+func handleGoroutines(w http.ResponseWriter, r *http.Request) {
+	buf := make([]byte, 1<<20)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write(buf)
+}
+
+// ListenAndServe serves Handler on addr.
+func ListenAndServe(addr string) error {
+	return http.ListenAndServe(addr, Handler())
+}
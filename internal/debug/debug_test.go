@@ -0,0 +1,36 @@
+package debug
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandler(t *testing.T) {
+	server := httptest.NewServer(Handler())
+	defer server.Close()
+
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/debug/goroutines", "goroutine "},
+		{"/debug/vars", `"memstats"`},
+		{"/debug/pprof/", "goroutine"},
+	} {
+		resp, err := server.Client().Get(server.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != 200 || !strings.Contains(string(b), tt.want) {
+			t.Errorf("GET %s: got status %d and body %.100q; want 200 and a body containing %q",
+				tt.path, resp.StatusCode, b, tt.want)
+		}
+	}
+}
@@ -0,0 +1,315 @@
+// Package grafana implements the API of Grafana's JSON datasource (/search and /query), translating Grafana's
+// panel requests into GumshoeDB queries so that dashboards can read from a server or router directly.
+package grafana
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+// A Source is what a datasource reads from: a server's DB or a router's shards.
+type Source struct {
+	Schema *gumshoe.Schema
+	// QueryHandler answers JSON queries as /query does. Each of Grafana's targets is sent to it as a query with
+	// the headers (such as the API key) of Grafana's request.
+	QueryHandler http.Handler
+	// DimensionValues returns the values of a string dimension column.
+	DimensionValues func(column string) ([]string, error)
+}
+
+// NewHandler returns a handler for the datasource API of source. It serves POSTs to paths ending in /search
+// and /query, and answers any other request (such as Grafana's test of the datasource) with a 200.
+func NewHandler(source *Source) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/search"):
+			source.handleSearch(w, r)
+		case r.Method == "POST" && strings.HasSuffix(r.URL.Path, "/query"):
+			source.handleQuery(w, r)
+		default:
+			w.Write([]byte("ok"))
+		}
+	})
+}
+
+// handleSearch responds to a search with a list of names. The target "dimensions()" lists the dimension
+// columns and "values(name)" lists the values of the string dimension name (for template variables). Any
+// other target lists the metric columns (and rowCount) whose names contain it.
+func (s *Source) handleSearch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Target string `json:"target"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "bad search request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	target := strings.TrimSpace(req.Target)
+	results := []string{}
+	switch {
+	case target == "dimensions()":
+		for _, col := range s.Schema.DimensionColumns {
+			results = append(results, col.Name)
+		}
+	case strings.HasPrefix(target, "values(") && strings.HasSuffix(target, ")"):
+		column := strings.TrimSpace(target[len("values(") : len(target)-1])
+		i, ok := s.Schema.DimensionNameToIndex[column]
+		if !ok || !s.Schema.DimensionColumns[i].String {
+			http.Error(w, fmt.Sprintf("%q is not a string dimension column", column), http.StatusBadRequest)
+			return
+		}
+		values, err := s.DimensionValues(column)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		results = append(results, values...)
+		sort.Strings(results)
+	default:
+		for _, name := range append(s.metricNames(), "rowCount") {
+			if strings.Contains(strings.ToLower(name), strings.ToLower(target)) {
+				results = append(results, name)
+			}
+		}
+	}
+	writeJSON(w, results)
+}
+
+func (s *Source) metricNames() []string {
+	var names []string
+	for _, col := range s.Schema.MetricColumns {
+		names = append(names, col.Name)
+	}
+	return names
+}
+
+// A QueryRequest is a panel's request for data.
+type QueryRequest struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	IntervalMS   int64         `json:"intervalMs"` // The panel's preferred time between data points
+	Targets      []Target      `json:"targets"`
+	AdhocFilters []AdhocFilter `json:"adhocFilters"`
+}
+
+// A Target is a series (or table) requested by a panel. Target is a metric column, summed unless Data gives
+// another aggregate, or rowCount.
+type Target struct {
+	Target string      `json:"target"`
+	RefID  string      `json:"refId"`
+	Type   string      `json:"type"` // "timeserie" (the default) or "table"
+	Data   *TargetData `json:"data"`
+}
+
+// TargetData is the additional JSON which may be given with a target.
+type TargetData struct {
+	Aggregate gumshoe.AggregateType `json:"aggregate"`
+	Filters   []gumshoe.QueryFilter `json:"filters"`
+}
+
+// An AdhocFilter is one of a dashboard's ad hoc filters, which apply to all its targets.
+type AdhocFilter struct {
+	Key      string `json:"key"`
+	Operator string `json:"operator"` // A filter type, or "=~" for a regex
+	Value    string `json:"value"`
+}
+
+// A series is a timeserie response: a target's values, each with its Unix time in milliseconds.
+type series struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+type table struct {
+	Type    string          `json:"type"`
+	Columns []tableColumn   `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+type tableColumn struct {
+	Text string `json:"text"`
+	Type string `json:"type"`
+}
+
+func (s *Source) handleQuery(w http.ResponseWriter, r *http.Request) {
+	req := new(QueryRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "bad query request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	responses := []interface{}{}
+	for _, target := range req.Targets {
+		query, err := s.makeQuery(req, target)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows, status, err := s.runQuery(r, query)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("query for %q failed: %s", target.Target, err), status)
+			return
+		}
+		points := s.datapoints(rows, target.Target)
+		if target.Type == "table" {
+			t := &table{
+				Type:    "table",
+				Columns: []tableColumn{{"Time", "time"}, {target.Target, "number"}},
+				Rows:    [][]interface{}{},
+			}
+			for _, point := range points {
+				t.Rows = append(t.Rows, []interface{}{point[1], point[0]})
+			}
+			responses = append(responses, t)
+			continue
+		}
+		responses = append(responses, &series{Target: target.Target, Datapoints: points})
+	}
+	writeJSON(w, responses)
+}
+
+// makeQuery translates target of req into a query grouped by time over the requested range. The time buckets
+// are the request's interval rounded up to a whole number of the DB's intervals.
+func (s *Source) makeQuery(req *QueryRequest, target Target) (*gumshoe.Query, error) {
+	query := new(gumshoe.Query)
+	if target.Target != "rowCount" {
+		if _, ok := s.Schema.MetricNameToIndex[target.Target]; !ok {
+			return nil, fmt.Errorf("%q is not a metric column", target.Target)
+		}
+		aggregate := gumshoe.QueryAggregate{Type: gumshoe.AggregateSum, Column: target.Target, Name: target.Target}
+		if target.Data != nil {
+			aggregate.Type = target.Data.Aggregate
+		}
+		query.Aggregates = []gumshoe.QueryAggregate{aggregate}
+	}
+
+	timestampColumn := s.Schema.TimestampColumn.Name
+	bucket := time.Duration(req.IntervalMS) * time.Millisecond
+	interval := s.Schema.IntervalDuration
+	if bucket < interval {
+		bucket = interval
+	}
+	bucket = (bucket + interval - 1) / interval * interval
+	query.Groupings = []gumshoe.QueryGrouping{{
+		TimeTransform: gumshoe.TimeTruncationType(bucket / time.Second),
+		Column:        timestampColumn,
+		Name:          timestampColumn,
+	}}
+
+	if !req.Range.From.IsZero() {
+		// Timestamps are stored truncated to their intervals, so the interval holding From is included.
+		from := req.Range.From.Unix()
+		from -= from % int64(interval/time.Second)
+		query.Filters = append(query.Filters, gumshoe.QueryFilter{
+			Type:   gumshoe.FilterGreaterThenOrEqual,
+			Column: timestampColumn,
+			Value:  float64(from),
+		})
+	}
+	if !req.Range.To.IsZero() {
+		query.Filters = append(query.Filters, gumshoe.QueryFilter{
+			Type:   gumshoe.FilterLessThan,
+			Column: timestampColumn,
+			Value:  float64(req.Range.To.Unix()),
+		})
+	}
+	if target.Data != nil {
+		query.Filters = append(query.Filters, target.Data.Filters...)
+	}
+	for _, adhoc := range req.AdhocFilters {
+		filter, err := s.adhocFilter(adhoc)
+		if err != nil {
+			return nil, err
+		}
+		query.Filters = append(query.Filters, filter)
+	}
+	return query, nil
+}
+
+// adhocFilter translates an ad hoc filter. Its value is a number unless its column is a string dimension.
+func (s *Source) adhocFilter(adhoc AdhocFilter) (gumshoe.QueryFilter, error) {
+	filter := gumshoe.QueryFilter{Column: adhoc.Key, Value: adhoc.Value}
+	operator := adhoc.Operator
+	if operator == "=~" {
+		operator = "regex"
+	}
+	if err := json.Unmarshal([]byte(strconv.Quote(operator)), &filter.Type); err != nil {
+		return filter, fmt.Errorf("bad ad hoc filter on %q: %s", adhoc.Key, err)
+	}
+	i, ok := s.Schema.DimensionNameToIndex[adhoc.Key]
+	if ok && s.Schema.DimensionColumns[i].String {
+		return filter, nil
+	}
+	v, err := strconv.ParseFloat(adhoc.Value, 64)
+	if err != nil {
+		return filter, fmt.Errorf("bad ad hoc filter on %q: %q is not a number", adhoc.Key, adhoc.Value)
+	}
+	filter.Value = v
+	return filter, nil
+}
+
+// runQuery sends query to s.QueryHandler with the headers of r, returning the result rows or else an error
+// and the status with which to report it.
+func (s *Source) runQuery(r *http.Request, query *gumshoe.Query) ([]gumshoe.RowMap, int, error) {
+	b, err := json.Marshal(query)
+	if err != nil {
+		panic("unexpected marshal error")
+	}
+	queryReq, err := http.NewRequest("POST", "/query", bytes.NewReader(b))
+	if err != nil {
+		panic("could not make http request")
+	}
+	queryReq = queryReq.WithContext(r.Context())
+	queryReq.Header = r.Header.Clone()
+	queryReq.Header.Set("Content-Type", "application/json")
+	queryReq.Header.Del("Accept-Encoding")
+	queryReq.RemoteAddr = r.RemoteAddr
+	recorder := httptest.NewRecorder()
+	s.QueryHandler.ServeHTTP(recorder, queryReq)
+	if recorder.Code != http.StatusOK {
+		return nil, recorder.Code, fmt.Errorf("%s", strings.TrimSpace(recorder.Body.String()))
+	}
+	var result struct {
+		Results []gumshoe.RowMap `json:"results"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&result); err != nil {
+		return nil, http.StatusInternalServerError, err
+	}
+	return result.Results, http.StatusOK, nil
+}
+
+// datapoints returns the values of column in rows (grouped by time), sorted by time. Nil values (such as the
+// average of no rows) are left out.
+func (s *Source) datapoints(rows []gumshoe.RowMap, column string) [][2]float64 {
+	points := [][2]float64{}
+	for _, row := range rows {
+		v, ok := row[column].(float64)
+		t, tok := row[s.Schema.TimestampColumn.Name].(float64)
+		if !ok || !tok || math.IsNaN(v) {
+			continue
+		}
+		points = append(points, [2]float64{v, t * 1000})
+	}
+	sort.Slice(points, func(i, j int) bool { return points[i][1] < points[j][1] })
+	return points
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
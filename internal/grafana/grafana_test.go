@@ -0,0 +1,124 @@
+package grafana
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func testSource(t *testing.T, queries *[]*gumshoe.Query) *Source {
+	schema := &gumshoe.Schema{
+		TimestampColumn:  gumshoe.Column{Type: gumshoe.TypeUint32, Name: "at", Width: 4},
+		IntervalDuration: time.Hour,
+		SegmentSize:      1 << 10,
+	}
+	for _, name := range []string{"country", "age"} {
+		col, err := gumshoe.MakeDimensionColumn(name, "uint8", name == "country")
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema.DimensionColumns = append(schema.DimensionColumns, col)
+	}
+	col, err := gumshoe.MakeMetricColumn("clicks", "uint32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema.MetricColumns = []gumshoe.MetricColumn{col}
+	schema.Initialize()
+
+	return &Source{
+		Schema: schema,
+		QueryHandler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("X-API-Key") != "secret" {
+				http.Error(w, "bad API key", http.StatusUnauthorized)
+				return
+			}
+			query, err := gumshoe.ParseJSONQuery(r.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			*queries = append(*queries, query)
+			w.Write([]byte(`{"results": [{"at": 7200, "clicks": 3, "rowCount": 2}, ` +
+				`{"at": 0, "clicks": 1, "rowCount": 1}, {"at": 3600, "clicks": null, "rowCount": 0}]}`))
+		}),
+		DimensionValues: func(column string) ([]string, error) { return []string{"us", "de"}, nil },
+	}
+}
+
+func post(h http.Handler, path, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("X-API-Key", "secret")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestSearch(t *testing.T) {
+	h := NewHandler(testSource(t, nil))
+	for _, tt := range []struct {
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"", 200, `["clicks","rowCount"]`},
+		{"CLI", 200, `["clicks"]`},
+		{"dimensions()", 200, `["country","age"]`},
+		{"values(country)", 200, `["de","us"]`},
+		{"values(age)", 400, ""},
+	} {
+		rec := post(h, "/grafana/search", `{"target": "`+tt.target+`"}`)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("target %q: got status %d; want %d", tt.target, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == 200 && rec.Body.String() != tt.wantBody {
+			t.Errorf("target %q: got %s; want %s", tt.target, rec.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestQuery(t *testing.T) {
+	var queries []*gumshoe.Query
+	h := NewHandler(testSource(t, &queries))
+	rec := post(h, "/grafana/query", `{
+		"range": {"from": "1970-01-01T00:30:00Z", "to": "1970-01-01T03:00:00Z"},
+		"intervalMs": 5400000,
+		"targets": [
+			{"target": "clicks", "refId": "A", "data": {"aggregate": "average"}},
+			{"target": "rowCount", "refId": "B", "type": "table"}
+		],
+		"adhocFilters": [
+			{"key": "country", "operator": "=", "value": "us"},
+			{"key": "age", "operator": ">", "value": "20"}
+		]
+	}`)
+	if rec.Code != 200 {
+		t.Fatalf("got status %d (%s); want 200", rec.Code, rec.Body.String())
+	}
+	want := `[{"target":"clicks","datapoints":[[1,0],[3,7200000]]},` +
+		`{"type":"table","columns":[{"text":"Time","type":"time"},{"text":"rowCount","type":"number"}],` +
+		`"rows":[[0,1],[3600000,0],[7200000,2]]}]`
+	if rec.Body.String() != want {
+		t.Errorf("got %s; want %s", rec.Body.String(), want)
+	}
+
+	// The 90-minute interval is rounded up to two hours, and the range starts with the interval holding it.
+	wantQuery := `{"Aggregates":[{"Type":"average","Column":"clicks","Name":"clicks"}],` +
+		`"Groupings":[{"TimeTransform":"2h0m0s","Column":"at","Name":"at"}],` +
+		`"Filters":[{"Type":">=","Column":"at","Value":0},{"Type":"<","Column":"at","Value":10800},` +
+		`{"Type":"=","Column":"country","Value":"us"},{"Type":">","Column":"age","Value":20}]}`
+	if got := queries[0].String(); got != wantQuery {
+		t.Errorf("got query %s; want %s", got, wantQuery)
+	}
+	if len(queries[1].Aggregates) != 0 {
+		t.Errorf("got aggregates %v for rowCount; want none", queries[1].Aggregates)
+	}
+
+	if rec := post(h, "/grafana/query", `{"targets": [{"target": "nope"}]}`); rec.Code != 400 {
+		t.Errorf("got status %d for an unknown metric; want 400", rec.Code)
+	}
+}
@@ -0,0 +1,113 @@
+// Package gzipbody decompresses gzip-encoded HTTP request bodies and compresses response bodies for clients
+// which accept gzip.
+package gzipbody
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+)
+
+// NewHandler returns a handler which transparently decompresses the bodies of requests with the header
+// "Content-Encoding: gzip" before passing them on to h. Reading more than maxSize decompressed bytes from
+// such a body is an error. Bodies with "Content-Encoding: snappy" (Prometheus remote writes) are passed on as
+// they are for h to decode, and requests with other content encodings are rejected.
+func NewHandler(h http.Handler, maxSize int64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch encoding := r.Header.Get("Content-Encoding"); encoding {
+		case "", "identity", "snappy":
+			h.ServeHTTP(w, r)
+			return
+		case "gzip":
+		default:
+			http.Error(w, "unsupported Content-Encoding: "+encoding, http.StatusUnsupportedMediaType)
+			return
+		}
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, "bad gzip request body: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		r.Body = http.MaxBytesReader(w, gz, maxSize)
+		r.Header.Del("Content-Encoding")
+		r.ContentLength = -1
+		h.ServeHTTP(w, r)
+	})
+}
+
+// AcceptsGzip reports whether r's Accept-Encoding header includes gzip.
+func AcceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if strings.TrimSpace(strings.SplitN(encoding, ";", 2)[0]) == "gzip" {
+			return true
+		}
+	}
+	return false
+}
+
+// NewResponseHandler returns a handler which gzips the responses of h for clients which accept gzip (see
+// AcceptsGzip). A response to which h gives its own Content-Encoding is left alone.
+func NewResponseHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if !AcceptsGzip(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		gw := &gzipResponseWriter{ResponseWriter: w}
+		defer gw.close()
+		h.ServeHTTP(gw, r)
+	})
+}
+
+// A gzipResponseWriter decides whether to compress a response when its header is written.
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz          *gzip.Writer // nil if the response isn't compressed
+	wroteHeader bool
+}
+
+func (w *gzipResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	header := w.Header()
+	if header.Get("Content-Encoding") == "" && code != http.StatusNoContent && code != http.StatusNotModified {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		w.gz = gzip.NewWriter(w.ResponseWriter)
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *gzipResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			// Otherwise the gzipped bytes would be sniffed.
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.gz == nil {
+		return w.ResponseWriter.Write(b)
+	}
+	return w.gz.Write(b)
+}
+
+// Flush flushes the compressed data written so far to the client.
+func (w *gzipResponseWriter) Flush() {
+	if w.gz != nil {
+		w.gz.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *gzipResponseWriter) close() {
+	if w.gz != nil {
+		w.gz.Close()
+	}
+}
@@ -0,0 +1,110 @@
+package gzipbody
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func gzipString(t *testing.T, s string) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestHandler(t *testing.T) {
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(b)
+	}), 10)
+
+	for _, tt := range []struct {
+		encoding   string
+		body       []byte
+		wantStatus int
+		wantBody   string
+	}{
+		{"", []byte("hello"), 200, "hello"},
+		{"gzip", gzipString(t, "hello"), 200, "hello"},
+		{"gzip", gzipString(t, "hello, world"), 400, ""}, // Too large when decompressed
+		{"gzip", []byte("hello"), 400, ""},
+		{"snappy", []byte("hello"), 200, "hello"}, // Left for the handler
+		{"br", []byte("hello"), 415, ""},
+	} {
+		req := httptest.NewRequest("PUT", "/insert", bytes.NewReader(tt.body))
+		if tt.encoding != "" {
+			req.Header.Set("Content-Encoding", tt.encoding)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.wantStatus {
+			t.Errorf("Content-Encoding %q: got status %d; want %d", tt.encoding, rec.Code, tt.wantStatus)
+			continue
+		}
+		if tt.wantStatus == 200 && strings.TrimSpace(rec.Body.String()) != tt.wantBody {
+			t.Errorf("Content-Encoding %q: got body %q; want %q", tt.encoding, rec.Body.String(), tt.wantBody)
+		}
+	}
+}
+
+func TestResponseHandler(t *testing.T) {
+	h := NewResponseHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("encoded") == "true" {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Write(gzipString(t, "hello"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`"hello"`))
+	}))
+
+	for _, tt := range []struct {
+		path           string
+		acceptEncoding string
+		wantEncoding   string
+	}{
+		{"/query", "", ""},
+		{"/query", "gzip, deflate", "gzip"},
+		{"/query", "br;q=1.0, gzip;q=0.5", "gzip"},
+		{"/query?encoded=true", "gzip", "gzip"}, // Left alone
+	} {
+		req := httptest.NewRequest("GET", tt.path, nil)
+		if tt.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := rec.Header().Get("Content-Encoding"); got != tt.wantEncoding {
+			t.Errorf("%s with Accept-Encoding %q: got Content-Encoding %q; want %q", tt.path, tt.acceptEncoding,
+				got, tt.wantEncoding)
+			continue
+		}
+		body := rec.Body.Bytes()
+		if tt.wantEncoding == "gzip" {
+			gz, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if body, err = ioutil.ReadAll(gz); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if !strings.Contains(string(body), "hello") {
+			t.Errorf("%s with Accept-Encoding %q: got body %q; want hello", tt.path, tt.acceptEncoding, body)
+		}
+	}
+}
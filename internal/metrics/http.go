@@ -0,0 +1,107 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// routes are the routes of the server and router, with the patterns of their parameterized paths. Requests
+// for other paths are counted as "other" so that bad requests can't create any number of series.
+var routes = map[string]bool{
+	"/":                          true,
+	"/insert":                    true,
+	"/prometheus/write":          true,
+	"/write":                     true,
+	"/rows":                      true,
+	"/query":                     true,
+	"/query/explain":             true,
+	"/dimension_tables":          true,
+	"/dimension_tables/{name}":   true,
+	"/lookup_tables/{name}":      true,
+	"/admin/retention":           true,
+	"/admin/reload":              true,
+	"/admin/schema-check":        true,
+	"/debug/rows":                true,
+	"/debug/queries":             true,
+	"/debug/slow_queries":        true,
+	"/admin/queries/{id}/cancel": true,
+	"/grafana/":                  true,
+	"/grafana/search":            true,
+	"/grafana/query":             true,
+	"/metricz":                   true,
+	"/metrics":                   true,
+	"/statusz":                   true,
+	"/healthz":                   true,
+	"/readyz":                    true,
+	"/schema":                    true,
+	"/tables":                    true,
+}
+
+// RouteName returns the route of path, such as "/dimension_tables/{name}" for "/dimension_tables/country". A
+// table's routes are prefixed with "/tables/{name}".
+func RouteName(path string) string {
+	table := ""
+	if strings.HasPrefix(path, "/tables/") {
+		table = "/tables/{name}"
+		path = path[len("/tables/"):]
+		if i := strings.IndexByte(path, '/'); i >= 0 {
+			path = path[i:]
+		} else {
+			path = ""
+		}
+	}
+	for _, parent := range []string{"/dimension_tables/", "/lookup_tables/"} {
+		if strings.HasPrefix(path, parent) && len(path) > len(parent) {
+			path = parent + "{name}"
+		}
+	}
+	if strings.HasPrefix(path, "/admin/queries/") && strings.HasSuffix(path, "/cancel") {
+		path = "/admin/queries/{id}/cancel"
+	}
+	if !routes[path] || (table != "" && path == "/tables") {
+		return "other"
+	}
+	return table + path
+}
+
+// NewHandler returns a handler which counts the requests to h (as http.requests) and times them (as
+// http.request), labeled by route (see RouteName) and, for the counts, status code.
+func NewHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := RouteName(r.URL.Path)
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h.ServeHTTP(rec, r)
+		IncLabeled("http.requests", "route", route, "code", strconv.Itoa(rec.status))
+		TimeLabeled("http.request", time.Since(start), "route", route)
+	})
+}
+
+// A statusRecorder records the status code of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush passes on flushes for streamed responses.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,79 @@
+// Package metrics reports gumshoedb's metrics to statsd and exposes them to Prometheus. Every metric name is
+// given the prefix "gumshoedb.".
+//
+// Until Init is called, metrics are not sent to statsd, so the gumshoe package (and tests) can report metrics
+// without any setup.
+package metrics
+
+import (
+	"time"
+
+	"github.com/philc/gumshoedb/internal/github.com/cespare/gostc"
+)
+
+const prefix = "gumshoedb."
+
+var client *gostc.Client
+
+// Init starts sending metrics to the statsd server at addr. It must be called before any metrics are
+// reported (that is, at startup).
+func Init(addr string) error {
+	c, err := gostc.NewClient(addr)
+	if err != nil {
+		return err
+	}
+	client = c
+	return nil
+}
+
+// Count adds delta to a counter.
+func Count(name string, delta float64) {
+	recordCount(name, delta, nil)
+	if client != nil {
+		client.Count(prefix+name, delta, 1)
+	}
+}
+
+// Inc adds 1 to a counter.
+func Inc(name string) {
+	recordCount(name, 1, nil)
+	if client != nil {
+		client.Inc(prefix + name)
+	}
+}
+
+// IncLabeled adds 1 to a counter with labels, given as alternating names and values (such as "shard",
+// "host1:8080"). Labels are only seen by Prometheus; statsd gets the total over all labels.
+func IncLabeled(name string, labels ...string) {
+	recordCount(name, 1, labels)
+	if client != nil {
+		client.Inc(prefix + name)
+	}
+}
+
+// Gauge sets a gauge.
+func Gauge(name string, value float64) {
+	recordGauge(name, value)
+	if client != nil {
+		client.Gauge(prefix+name, value)
+	}
+}
+
+// Time records a timing.
+func Time(name string, d time.Duration) {
+	recordTime(name, d, nil)
+	if client != nil {
+		client.Time(prefix+name, d)
+	}
+}
+
+// TimeLabeled records a timing with labels (as for IncLabeled).
+func TimeLabeled(name string, d time.Duration, labels ...string) {
+	recordTime(name, d, labels)
+	if client != nil {
+		client.Time(prefix+name, d)
+	}
+}
+
+// Since records the time elapsed since start.
+func Since(name string, start time.Time) { Time(name, time.Since(start)) }
@@ -0,0 +1,91 @@
+package metrics
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsArePrefixed(t *testing.T) {
+	// Metrics are discarded before Init.
+	Inc("discarded")
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := Init(conn.LocalAddr().String()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { client = nil }()
+
+	Inc("insert.rows")
+	buf := make([]byte, 100)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "gumshoedb.insert.rows:1|c"; got != want {
+		t.Fatalf("got %q; want %q", got, want)
+	}
+}
+
+func TestWritePrometheus(t *testing.T) {
+	// The registry is global, so clear out the series recorded by earlier tests (or earlier runs of this one).
+	registry.Lock()
+	registry.counters = make(map[seriesKey]float64)
+	registry.gauges = make(map[seriesKey]float64)
+	registry.histograms = make(map[seriesKey]*histogram)
+	registry.Unlock()
+
+	Inc("test.inserts")
+	Inc("test.inserts")
+	IncLabeled("test.errors", "shard", "a:8080")
+	Gauge("test.rows", 12)
+	Time("test.query", 20*time.Millisecond)
+
+	var buf bytes.Buffer
+	if err := WritePrometheus(&buf); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"# TYPE gumshoedb_test_inserts_total counter\ngumshoedb_test_inserts_total 2\n",
+		`gumshoedb_test_errors_total{shard="a:8080"} 1` + "\n",
+		"# TYPE gumshoedb_test_rows gauge\ngumshoedb_test_rows 12\n",
+		"# TYPE gumshoedb_test_query_seconds histogram\n",
+		`gumshoedb_test_query_seconds_bucket{le="0.01"} 0` + "\n",
+		`gumshoedb_test_query_seconds_bucket{le="0.05"} 1` + "\n",
+		`gumshoedb_test_query_seconds_bucket{le="+Inf"} 1` + "\n",
+		"gumshoedb_test_query_seconds_count 1\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("metrics are missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestRouteName(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want string
+	}{
+		{"/query", "/query"},
+		{"/dimension_tables", "/dimension_tables"},
+		{"/dimension_tables/country", "/dimension_tables/{name}"},
+		{"/tables", "/tables"},
+		{"/tables/events/insert", "/tables/{name}/insert"},
+		{"/tables/events/lookup_tables/x", "/tables/{name}/lookup_tables/{name}"},
+		{"/admin/queries/abc/cancel", "/admin/queries/{id}/cancel"},
+		{"/grafana/query", "/grafana/query"},
+		{"/tables/events", "other"},
+		{"/wp-admin.php", "other"},
+	} {
+		if got := RouteName(tt.path); got != tt.want {
+			t.Errorf("RouteName(%q): got %q; want %q", tt.path, got, tt.want)
+		}
+	}
+}
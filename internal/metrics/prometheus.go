@@ -0,0 +1,177 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Besides being sent to statsd, every metric is kept in memory so that it can be scraped by Prometheus (see
+// Handler). Counters become Prometheus counters (named with the suffix _total), gauges become gauges, and
+// timings become histograms of seconds (named with the suffix _seconds).
+
+// timeBuckets are the upper bounds, in seconds, of the histogram buckets for timings.
+var timeBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5, 10, 30, 60}
+
+type seriesKey struct {
+	name   string
+	labels string // Formatted for the exposition format, such as `{shard="a:8080"}`; "" for none
+}
+
+type histogram struct {
+	counts []uint64 // Per bucket (not cumulative), with a final bucket for +Inf
+	sum    float64
+}
+
+var registry = struct {
+	sync.Mutex
+	counters   map[seriesKey]float64
+	gauges     map[seriesKey]float64
+	histograms map[seriesKey]*histogram
+}{
+	counters:   make(map[seriesKey]float64),
+	gauges:     make(map[seriesKey]float64),
+	histograms: make(map[seriesKey]*histogram),
+}
+
+// formatLabels formats labels, given as alternating names and values.
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	if len(labels)%2 != 0 {
+		panic("metrics: labels must be name/value pairs")
+	}
+	var parts []string
+	for i := 0; i < len(labels); i += 2 {
+		parts = append(parts, labels[i]+"="+strconv.Quote(labels[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func recordCount(name string, delta float64, labels []string) {
+	key := seriesKey{name, formatLabels(labels)}
+	registry.Lock()
+	registry.counters[key] += delta
+	registry.Unlock()
+}
+
+func recordGauge(name string, value float64) {
+	registry.Lock()
+	registry.gauges[seriesKey{name: name}] = value
+	registry.Unlock()
+}
+
+func recordTime(name string, d time.Duration, labels []string) {
+	key := seriesKey{name, formatLabels(labels)}
+	seconds := d.Seconds()
+	bucket := sort.SearchFloat64s(timeBuckets, seconds)
+	registry.Lock()
+	h := registry.histograms[key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(timeBuckets)+1)}
+		registry.histograms[key] = h
+	}
+	h.counts[bucket]++
+	h.sum += seconds
+	registry.Unlock()
+}
+
+// promName converts a metric name such as "router.query.rate-limited" to a Prometheus name such as
+// "gumshoedb_router_query_rate_limited".
+func promName(name string) string {
+	return strings.NewReplacer(".", "_", "-", "_").Replace(strings.TrimSuffix(prefix, ".") + "_" + name)
+}
+
+// WritePrometheus writes every metric in the Prometheus text exposition format.
+func WritePrometheus(w io.Writer) error {
+	type family struct {
+		typ     string
+		samples []string
+	}
+	families := make(map[string]*family)
+	add := func(name, typ, suffix, labels string, value float64) {
+		f := families[name]
+		if f == nil {
+			f = &family{typ: typ}
+			families[name] = f
+		}
+		f.samples = append(f.samples, name+suffix+labels+" "+formatValue(value))
+	}
+
+	registry.Lock()
+	for key, value := range registry.counters {
+		add(promName(key.name)+"_total", "counter", "", key.labels, value)
+	}
+	for key, value := range registry.gauges {
+		add(promName(key.name), "gauge", "", key.labels, value)
+	}
+	// Histograms are written in order so that each series' buckets stay together and in order of le.
+	var keys []seriesKey
+	for key := range registry.histograms {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].name != keys[j].name {
+			return keys[i].name < keys[j].name
+		}
+		return keys[i].labels < keys[j].labels
+	})
+	for _, key := range keys {
+		h := registry.histograms[key]
+		name := promName(key.name) + "_seconds"
+		var cumulative uint64
+		for i, count := range h.counts {
+			cumulative += count
+			le := "+Inf"
+			if i < len(timeBuckets) {
+				le = formatValue(timeBuckets[i])
+			}
+			add(name, "histogram", "_bucket", addLabel(key.labels, `le="`+le+`"`), float64(cumulative))
+		}
+		add(name, "histogram", "_sum", key.labels, h.sum)
+		add(name, "histogram", "_count", key.labels, float64(cumulative))
+	}
+	registry.Unlock()
+
+	var names []string
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := families[name]
+		if f.typ != "histogram" {
+			sort.Strings(f.samples)
+		}
+		if _, err := fmt.Fprintf(w, "# TYPE %s %s\n%s\n", name, f.typ, strings.Join(f.samples, "\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addLabel adds a formatted label (such as `le="0.1"`) to formatted labels.
+func addLabel(labels, label string) string {
+	if labels == "" {
+		return "{" + label + "}"
+	}
+	return labels[:len(labels)-1] + "," + label + "}"
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Handler serves the metrics for Prometheus to scrape.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheus(w)
+	})
+}
@@ -0,0 +1,49 @@
+package remotewrite
+
+import (
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+// NewInfluxHandler returns a handler for InfluxDB line protocol writes, such as Telegraf's influxdb output
+// sends to /write. The precision parameter gives the unit of the points' timestamps (see
+// gumshoe.InfluxPrecision). The points are mapped to rows by rules (see gumshoe.Schema.InfluxRows) and
+// inserted through insert as for NewHandler. A successful write gets a 204.
+func NewInfluxHandler(schema *gumshoe.Schema, rules []gumshoe.InfluxRule, insert http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(rules) == 0 {
+			http.Error(w, "no influx_write rules are configured", http.StatusNotFound)
+			return
+		}
+		precision, err := gumshoe.InfluxPrecision(r.URL.Query().Get("precision"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		points, err := gumshoe.ParseInfluxLines(b, precision, time.Now())
+		if err != nil {
+			http.Error(w, "bad line protocol: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows, dropped := schema.InfluxRows(points, rules)
+		metrics.Count("influx-write.dropped", float64(dropped))
+		if len(rows) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if rejected, ok := insertRows(w, r, rows, insert); ok {
+			metrics.Count("influx-write.rejected", float64(rejected))
+			metrics.Count("influx-write.points", float64(len(rows)-rejected))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
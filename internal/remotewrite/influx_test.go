@@ -0,0 +1,68 @@
+package remotewrite
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func TestInfluxHandler(t *testing.T) {
+	rules := []gumshoe.InfluxRule{
+		{
+			Measurement: "http",
+			Fields:      map[string]string{"count": "requests"},
+			Tags:        map[string]string{"path": "path"},
+		},
+	}
+	var inserted []gumshoe.RowMap
+	h := NewInfluxHandler(testSchema(t), rules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inserted, err = gumshoe.DecodeRowBatch(b); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(`{"rejected": [{"row": 1, "error": "too large"}]}`))
+	}))
+
+	write := func(url, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("POST", url, strings.NewReader(body)))
+		return rec
+	}
+	rec := write("/write?precision=s", `http,path=/query count=3i 7200
+http,path=/insert count=1e9 7201
+cpu idle=1`)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d (%s); want 204", rec.Code, rec.Body.String())
+	}
+	want := []gumshoe.RowMap{
+		{"at": 7200.0, "path": "/query", "requests": json.Number("3")},
+		{"at": 7201.0, "path": "/insert", "requests": 1e9},
+	}
+	if !reflect.DeepEqual(inserted, want) {
+		t.Errorf("got inserted rows %v; want %v", inserted, want)
+	}
+
+	for _, tt := range []struct {
+		url, body string
+	}{
+		{"/write?precision=d", "http count=1"},
+		{"/write", "http count"},
+	} {
+		if rec := write(tt.url, tt.body); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %q: got status %d; want 400", tt.url, tt.body, rec.Code)
+		}
+	}
+	h = NewInfluxHandler(testSchema(t), nil, nil)
+	if rec := write("/write", "http count=1"); rec.Code != http.StatusNotFound {
+		t.Errorf("got status %d with no rules; want 404", rec.Code)
+	}
+}
@@ -0,0 +1,93 @@
+// Package remotewrite accepts Prometheus remote writes and InfluxDB line protocol writes, inserting their
+// samples and points as rows so that service metrics can be stored alongside event data.
+package remotewrite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+// NewHandler returns a handler for Prometheus remote write requests (Snappy-compressed protobuf
+// WriteRequests). The samples are mapped to rows by rules (see gumshoe.Schema.RemoteWriteRows) and inserted
+// by sending them to insert, which handles /insert, as a protobuf RowBatch with skip_invalid=true and the
+// headers (such as the API key) of the remote write. A successful remote write gets a 204.
+func NewHandler(schema *gumshoe.Schema, rules []gumshoe.RemoteWriteRule, insert http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(rules) == 0 {
+			http.Error(w, "no remote_write rules are configured", http.StatusNotFound)
+			return
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		series, err := gumshoe.DecodeRemoteWrite(b)
+		if err != nil {
+			http.Error(w, "bad remote write request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		rows, dropped := schema.RemoteWriteRows(series, rules)
+		metrics.Count("remote-write.dropped", float64(dropped))
+		if len(rows) == 0 {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if rejected, ok := insertRows(w, r, rows, insert); ok {
+			metrics.Count("remote-write.rejected", float64(rejected))
+			metrics.Count("remote-write.samples", float64(len(rows)-rejected))
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+}
+
+// insertRows inserts rows by sending them to insert as a protobuf RowBatch with skip_invalid=true and the
+// headers of r. It returns the number of rows rejected as invalid. If the insert fails, the error (and any
+// Retry-After header) is written to w and ok is false.
+func insertRows(w http.ResponseWriter, r *http.Request, rows []gumshoe.RowMap, insert http.Handler) (
+	rejected int, ok bool) {
+
+	batch, err := gumshoe.EncodeRowBatch(rows)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	insertReq, err := http.NewRequest("PUT", "/insert?skip_invalid=true", bytes.NewReader(batch))
+	if err != nil {
+		panic("could not make http request")
+	}
+	insertReq = insertReq.WithContext(r.Context())
+	insertReq.Header = r.Header.Clone()
+	insertReq.Header.Set("Content-Type", gumshoe.ProtobufContentType)
+	insertReq.Header.Del("Content-Encoding")
+	insertReq.RemoteAddr = r.RemoteAddr
+	recorder := httptest.NewRecorder()
+	insert.ServeHTTP(recorder, insertReq)
+	if recorder.Code != http.StatusOK {
+		// Prometheus and Telegraf retry a write which failed with a 5xx or 429 (honoring Retry-After).
+		if retryAfter := recorder.Header().Get("Retry-After"); retryAfter != "" {
+			w.Header().Set("Retry-After", retryAfter)
+		}
+		message := strings.TrimSpace(recorder.Body.String())
+		http.Error(w, fmt.Sprintf("insert failed: %s", message), recorder.Code)
+		return 0, false
+	}
+	// Invalid rows (such as those with values too large for their columns) are counted and dropped, since
+	// the client would only send them again.
+	var resp struct {
+		Rejected []gumshoe.RowError `json:"rejected"`
+	}
+	if err := json.NewDecoder(recorder.Body).Decode(&resp); err != nil {
+		http.Error(w, "bad insert response: "+err.Error(), http.StatusInternalServerError)
+		return 0, false
+	}
+	return len(resp.Rejected), true
+}
@@ -0,0 +1,114 @@
+package remotewrite
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func appendField(b []byte, num uint64, field []byte) []byte {
+	b = binary.AppendUvarint(b, num<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(field)))
+	return append(b, field...)
+}
+
+// writeRequest encodes a remote write of one series with a single sample, compressed as a single Snappy
+// literal.
+func writeRequest(labels [][2]string, value float64, timestampMS int64) []byte {
+	var series []byte
+	for _, label := range labels {
+		b := appendField(nil, 1, []byte(label[0]))
+		series = appendField(series, 1, appendField(b, 2, []byte(label[1])))
+	}
+	sample := binary.LittleEndian.AppendUint64([]byte{1<<3 | 1}, math.Float64bits(value))
+	sample = binary.AppendUvarint(append(sample, 2<<3), uint64(timestampMS))
+	req := appendField(nil, 1, appendField(series, 2, sample))
+
+	out := binary.AppendUvarint(nil, uint64(len(req)))
+	out = append(out, 61<<2, byte(len(req)-1), byte((len(req)-1)>>8))
+	return append(out, req...)
+}
+
+// testSchema returns a schema with a string dimension column, path, and a metric column, requests.
+func testSchema(t *testing.T) *gumshoe.Schema {
+	schema := &gumshoe.Schema{
+		TimestampColumn:  gumshoe.Column{Type: gumshoe.TypeUint32, Name: "at", Width: 4},
+		IntervalDuration: time.Hour,
+		SegmentSize:      1 << 10,
+	}
+	col, err := gumshoe.MakeDimensionColumn("path", "uint8", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema.DimensionColumns = []gumshoe.DimensionColumn{col}
+	metric, err := gumshoe.MakeMetricColumn("requests", "float64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema.MetricColumns = []gumshoe.MetricColumn{metric}
+	schema.Initialize()
+	return schema
+}
+
+func TestHandler(t *testing.T) {
+	schema := testSchema(t)
+	rules := []gumshoe.RemoteWriteRule{
+		{Metric: "http_requests_total", Column: "requests", Labels: map[string]string{"handler": "path"}},
+	}
+
+	var inserted []gumshoe.RowMap
+	full := false
+	h := NewHandler(schema, rules, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if full {
+			w.Header().Set("Retry-After", "60")
+			http.Error(w, "too many inserted rows are waiting to be flushed", http.StatusTooManyRequests)
+			return
+		}
+		if r.URL.Query().Get("skip_invalid") != "true" || r.Header.Get("X-API-Key") != "secret" {
+			t.Errorf("got insert %s with API key %q", r.URL, r.Header.Get("X-API-Key"))
+		}
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if inserted, err = gumshoe.DecodeRowBatch(b); err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(`{"rejected": []}`))
+	}))
+
+	post := func(body []byte) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/prometheus/write", bytes.NewReader(body))
+		req.Header.Set("Content-Encoding", "snappy")
+		req.Header.Set("X-API-Key", "secret")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	labels := [][2]string{{"__name__", "http_requests_total"}, {"handler", "/query"}, {"instance", "a"}}
+	if rec := post(writeRequest(labels, 1.5, 7200500)); rec.Code != http.StatusNoContent {
+		t.Fatalf("got status %d (%s); want 204", rec.Code, rec.Body.String())
+	}
+	want := []gumshoe.RowMap{{"at": 7200.0, "path": "/query", "requests": 1.5}}
+	if !reflect.DeepEqual(inserted, want) {
+		t.Errorf("got inserted rows %v; want %v", inserted, want)
+	}
+
+	if rec := post([]byte("bogus")); rec.Code != http.StatusBadRequest {
+		t.Errorf("got status %d for a bad request; want 400", rec.Code)
+	}
+	full = true
+	rec := post(writeRequest(labels, 1, 0))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != "60" {
+		t.Errorf("got status %d with Retry-After %q for a full backlog; want 429 with 60", rec.Code,
+			rec.Header().Get("Retry-After"))
+	}
+}
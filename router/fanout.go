@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+// A fanoutTransport bounds the number of requests the router has in flight to the shards, both in total and
+// to each shard, so that many concurrent client requests (each of which fans out to every shard) don't open a
+// storm of connections. A request holds its place until the shard starts to respond: shards do the work of a
+// query before writing any of its results, and holding places while streamed results are read could deadlock
+// queries which read from every shard at once.
+type fanoutTransport struct {
+	http.RoundTripper
+	total    chan struct{} // nil for no limit
+	perShard int           // 0 for no limit
+
+	mu     sync.Mutex
+	shards map[string]chan struct{}
+}
+
+// newFanoutTransport wraps t to allow at most total requests (if positive) at once, and at most perShard (if
+// positive) to each shard. If neither is limited, it returns t.
+func newFanoutTransport(t http.RoundTripper, total, perShard int) http.RoundTripper {
+	if total <= 0 && perShard <= 0 {
+		return t
+	}
+	f := &fanoutTransport{
+		RoundTripper: t,
+		perShard:     perShard,
+		shards:       make(map[string]chan struct{}),
+	}
+	if total > 0 {
+		f.total = make(chan struct{}, total)
+	}
+	return f
+}
+
+func (f *fanoutTransport) shardSlots(shard string) chan struct{} {
+	if f.perShard <= 0 {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	slots, ok := f.shards[shard]
+	if !ok {
+		slots = make(chan struct{}, f.perShard)
+		f.shards[shard] = slots
+	}
+	return slots
+}
+
+func (f *fanoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	// The shard's slot is taken first so that requests waiting for a busy shard don't hold total slots.
+	for _, slots := range []chan struct{}{f.shardSlots(req.URL.Host), f.total} {
+		if slots == nil {
+			continue
+		}
+		slots := slots
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+	if waited := time.Since(start); waited > time.Millisecond {
+		metrics.Time("router.fanout.wait", waited)
+	}
+	return f.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+// grpcRetryInterval is how long the router uses HTTP for a shard which was found not to serve gRPC before
+// trying gRPC again (in case the shard has been upgraded since).
+const grpcRetryInterval = 5 * time.Minute
+
+// grpcMaxMessageSize is the largest QueryResponse the router accepts from a shard.
+const grpcMaxMessageSize = 16 << 20
+
+// errGRPCUnsupported is returned by a gRPC call to a shard which doesn't serve gRPC; the caller falls back
+// to HTTP.
+var errGRPCUnsupported = errors.New("the shard doesn't serve gRPC")
+
+// grpcShards records which shards don't serve gRPC, for a router with shard_grpc set. (A nil *grpcShards
+// means the router doesn't use gRPC at all.)
+type grpcShards struct {
+	mu          sync.Mutex
+	unsupported map[string]time.Time // When each shard was found not to serve gRPC
+}
+
+func newGRPCShards() *grpcShards {
+	return &grpcShards{unsupported: make(map[string]time.Time)}
+}
+
+func (g *grpcShards) enabled() bool { return g != nil }
+
+// supported reports whether the router should try gRPC for shard.
+func (g *grpcShards) supported(shard string) bool {
+	if g == nil {
+		return false
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	t, ok := g.unsupported[shard]
+	return !ok || time.Since(t) > grpcRetryInterval
+}
+
+func (g *grpcShards) setUnsupported(shard string, reason error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.unsupported[shard]; !ok {
+		Log.Printf("Shard %s doesn't serve gRPC (%s); using HTTP", shard, reason)
+	}
+	g.unsupported[shard] = time.Now()
+}
+
+// A grpcTransport sends the router's gRPC calls (requests with Content-Type application/grpc) over HTTP/2,
+// which gRPC requires, and all its other requests to the shards as usual.
+type grpcTransport struct {
+	http1 http.RoundTripper
+	http2 http.RoundTripper
+}
+
+// newGRPCTransport returns a grpcTransport which sends the router's other requests with http1. The gRPC
+// calls use TLS if tlsConfig isn't nil, and otherwise unencrypted HTTP/2.
+func newGRPCTransport(http1 http.RoundTripper, tlsConfig *tls.Config) grpcTransport {
+	http2 := &http.Transport{MaxIdleConnsPerHost: 8, TLSClientConfig: tlsConfig, Protocols: new(http.Protocols)}
+	if tlsConfig != nil {
+		http2.Protocols.SetHTTP2(true)
+	} else {
+		http2.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return grpcTransport{http1, http2}
+}
+
+func (t grpcTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Header.Get("Content-Type") == gumshoe.GRPCContentType {
+		return t.http2.RoundTrip(req)
+	}
+	return t.http1.RoundTrip(req)
+}
+
+// grpcCall calls method on shard with the request message msg and metadata header. If the call fails
+// before any response message, the error is an httpError like the one the equivalent HTTP request would
+// give; if the shard doesn't serve gRPC, it's errGRPCUnsupported. Otherwise the caller must read the
+// response messages from the body and close it.
+func (r *Router) grpcCall(ctx context.Context, shard, method string, msg []byte, header http.Header,
+	compress bool) (*http.Response, error) {
+	var body bytes.Buffer
+	if err := gumshoe.WriteGRPCMessage(&body, msg, compress); err != nil {
+		panic("unexpected gzip error")
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", r.ShardScheme+"://"+shard+method, &body)
+	if err != nil {
+		panic("could not make http request")
+	}
+	if header != nil {
+		req.Header = header.Clone()
+	}
+	req.Header.Set("Content-Type", gumshoe.GRPCContentType)
+	req.Header.Set("Te", "trailers")
+	if compress {
+		req.Header.Set("Grpc-Encoding", "gzip")
+	}
+	resp, err := r.Client.Do(req)
+	if err != nil {
+		// A shard which can't be reached can't be reached by HTTP either, but one which doesn't speak
+		// HTTP/2 (or can't otherwise handle the call) may still serve HTTP.
+		var opErr *net.OpError
+		if ctx.Err() != nil || (errors.As(err, &opErr) && opErr.Op == "dial") {
+			return nil, err
+		}
+		r.grpcShards.setUnsupported(shard, err)
+		return nil, errGRPCUnsupported
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), gumshoe.GRPCContentType) {
+		resp.Body.Close()
+		r.grpcShards.setUnsupported(shard, fmt.Errorf("got a %s response", resp.Status))
+		return nil, errGRPCUnsupported
+	}
+	if code := resp.Header.Get("Grpc-Status"); code != "" && code != strconv.Itoa(gumshoe.GRPCOK) {
+		// The call failed without sending anything. A shard without the method gives UNIMPLEMENTED with no
+		// HTTP status.
+		resp.Body.Close()
+		if code == strconv.Itoa(gumshoe.GRPCUnimplemented) && resp.Header.Get(gumshoe.GRPCStatusTrailer) == "" {
+			r.grpcShards.setUnsupported(shard, grpcStatusError(resp.Header, shard))
+			return nil, errGRPCUnsupported
+		}
+		return nil, grpcStatusError(resp.Header, shard)
+	}
+	return resp, nil
+}
+
+// grpcStatus returns the metadata holding the status of a finished call: its trailers or, if it sent none,
+// its headers.
+func grpcStatus(resp *http.Response) http.Header {
+	if resp.Trailer.Get("Grpc-Status") != "" {
+		return resp.Trailer
+	}
+	return resp.Header
+}
+
+// grpcStatusError returns the httpError for a call to shard which failed with the status in header.
+func grpcStatusError(header http.Header, shard string) error {
+	code, err := strconv.Atoi(header.Get("Grpc-Status"))
+	if err != nil {
+		return fmt.Errorf("gRPC call to shard %s ended without a status", shard)
+	}
+	status, err := strconv.Atoi(header.Get(gumshoe.GRPCStatusTrailer))
+	if err != nil {
+		status = gumshoe.HTTPStatusForGRPCCode(code)
+	}
+	msg := fmt.Sprintf("non-200 response from shard %s: %d", shard, status)
+	if m := gumshoe.UnescapeGRPCMessage(header.Get("Grpc-Message")); m != "" {
+		msg += "\n" + m
+	}
+	return httpError{msg, status, header.Get("Retry-After")}
+}
+
+// queryShardGRPC is queryShard by gRPC. The response is made to look like that of the HTTP request: its body
+// is the binary stream.
+func (r *Router) queryShardGRPC(ctx context.Context, shard string, b []byte, header http.Header,
+	sorted bool) (*http.Response, error) {
+	call := gumshoe.GRPCQueryRequest{
+		Table:  strings.TrimPrefix(r.ShardPathPrefix, "/tables/"),
+		Query:  b,
+		Sorted: sorted,
+	}
+	resp, err := r.grpcCall(ctx, shard, gumshoe.GRPCQueryPath, call.Marshal(), header, false)
+	if err != nil {
+		return nil, err
+	}
+	resp.Header.Set("Content-Type", gumshoe.BinaryStreamContentType)
+	resp.Body = &grpcStreamBody{resp: resp, body: resp.Body, shard: shard}
+	return resp, nil
+}
+
+// A grpcStreamBody reads the data of the QueryResponses of a Query call. If the call fails partway
+// through, Read returns its error.
+type grpcStreamBody struct {
+	resp  *http.Response
+	body  io.ReadCloser
+	shard string
+	data  []byte // Unread data of the current message
+}
+
+func (b *grpcStreamBody) Read(p []byte) (int, error) {
+	for len(b.data) == 0 {
+		msg, err := gumshoe.ReadGRPCMessage(b.body, grpcMaxMessageSize)
+		if err == io.EOF {
+			status := grpcStatus(b.resp)
+			if status.Get("Grpc-Status") == strconv.Itoa(gumshoe.GRPCOK) {
+				return 0, io.EOF
+			}
+			return 0, grpcStatusError(status, b.shard)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if b.data, err = gumshoe.UnmarshalGRPCQueryResponse(msg); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, b.data)
+	b.data = b.data[n:]
+	return n, nil
+}
+
+func (b *grpcStreamBody) Close() error { return b.body.Close() }
+
+// insertShardGRPC inserts batch (an encoded RowBatch) into shard by gRPC. With skipInvalid, the shard's
+// response is decoded into response.
+func (r *Router) insertShardGRPC(shard string, batch []byte, skipInvalid bool, batchID string,
+	response *insertResponse) error {
+	call := gumshoe.GRPCInsertRequest{
+		Table:       strings.TrimPrefix(r.ShardPathPrefix, "/tables/"),
+		Batch:       batch,
+		SkipInvalid: skipInvalid,
+		BatchID:     batchID,
+	}
+	resp, err := r.grpcCall(context.Background(), shard, gumshoe.GRPCInsertPath, call.Marshal(), nil,
+		r.GzipInserts)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	msg, err := gumshoe.ReadGRPCMessage(resp.Body, grpcMaxMessageSize)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	// The status follows the response message (if any).
+	io.Copy(ioutil.Discard, resp.Body)
+	if status := grpcStatus(resp); status.Get("Grpc-Status") != strconv.Itoa(gumshoe.GRPCOK) {
+		return grpcStatusError(status, shard)
+	}
+	if !skipInvalid {
+		return nil
+	}
+	var inserted gumshoe.GRPCInsertResponse
+	if err := inserted.Unmarshal(msg); err != nil {
+		return err
+	}
+	response.Rejected = inserted.Rejected
+	response.Duplicate = inserted.Duplicate
+	return nil
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+// A grpcTestShard is a test shard which serves the gRPC Shard service. It answers every query with rows (in
+// two QueryResponses) and every insert by rejecting its first row, and records the calls it gets.
+type grpcTestShard struct {
+	rows    []gumshoe.RowMap
+	queries []gumshoe.GRPCQueryRequest
+	inserts []gumshoe.GRPCInsertRequest
+	// If fail isn't nil, calls fail with these trailers instead (after the first QueryResponse, if failLate).
+	fail     http.Header
+	failLate bool
+}
+
+// newGRPCTestShard starts a test server for shard, which speaks HTTP/2 without TLS.
+func newGRPCTestShard(shard *grpcTestShard) *httptest.Server {
+	server := httptest.NewUnstartedServer(shard)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	return server
+}
+
+func (s *grpcTestShard) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	msg, err := gumshoe.ReadGRPCMessage(req.Body, 1<<20)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", gumshoe.GRPCContentType)
+	if s.fail != nil && !s.failLate {
+		for name, values := range s.fail {
+			w.Header()[name] = values
+		}
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	var responses [][]byte
+	switch req.URL.Path {
+	case gumshoe.GRPCQueryPath:
+		var call gumshoe.GRPCQueryRequest
+		if err := call.Unmarshal(msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.queries = append(s.queries, call)
+		var stream bytes.Buffer
+		encoder := gob.NewEncoder(&stream)
+		encoder.Encode(map[string]int{})
+		for _, row := range s.rows {
+			encoder.Encode(row)
+		}
+		b := stream.Bytes()
+		responses = append(responses, gumshoe.MarshalGRPCQueryResponse(b[:len(b)/2]))
+		responses = append(responses, gumshoe.MarshalGRPCQueryResponse(b[len(b)/2:]))
+	case gumshoe.GRPCInsertPath:
+		var call gumshoe.GRPCInsertRequest
+		if err := call.Unmarshal(msg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.inserts = append(s.inserts, call)
+		inserted := gumshoe.GRPCInsertResponse{Rejected: []gumshoe.RowError{{Row: 0, Error: "rejected"}}}
+		responses = append(responses, inserted.Marshal())
+	default:
+		w.Header().Set("Grpc-Status", "12")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if s.failLate {
+		responses = responses[:1]
+	}
+	for _, response := range responses {
+		gumshoe.WriteGRPCMessage(w, response, false)
+	}
+	trailers := http.Header{"Grpc-Status": {"0"}}
+	if s.failLate {
+		trailers = s.fail
+	}
+	for name, values := range trailers {
+		w.Header()[http.TrailerPrefix+name] = values
+	}
+}
+
+// newGRPCTestRouter returns a Router which uses gRPC, in front of shards.
+func newGRPCTestRouter(shards ...*httptest.Server) *Router {
+	r := newTestRouter(1, shards...)
+	r.Client = &http.Client{Transport: newGRPCTransport(http.DefaultTransport, nil)}
+	r.grpcShards = newGRPCShards()
+	return r
+}
+
+func TestGRPCQueryAndInsert(t *testing.T) {
+	shard := &grpcTestShard{rows: []gumshoe.RowMap{{"dim1": 1, "metric1": 2}, {"dim1": 2, "metric1": 3}}}
+	server := newGRPCTestShard(shard)
+	defer server.Close()
+	r := newGRPCTestRouter(server)
+	r.ShardPathPrefix = "/tables/table1"
+
+	query := `{"aggregates": [{"type": "sum", "name": "metric1", "column": "metric1"}],
+		"groupings": [{"column": "dim1", "name": "dim1"}]}`
+	result := decodeResult(t, runTestQuery(r, query, ""))
+	var rows []string
+	for _, row := range result.Results {
+		rows = append(rows, fmt.Sprintf("%v:%v", row["dim1"], row["metric1"]))
+	}
+	if want := []string{"1:2", "2:3"}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows %v; want %v", rows, want)
+	}
+	if len(shard.queries) != 1 || shard.queries[0].Table != "table1" {
+		t.Fatalf("got gRPC queries %+v; want one of table1", shard.queries)
+	}
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest("PUT", "/insert?skip_invalid=true",
+		strings.NewReader(`[{"at": 0, "dim1": 1, "metric1": 2}, {"at": 0, "dim1": 2, "metric1": 3}]`))
+	req.Header.Set(batchIDHeader, "batch1")
+	r.HandleInsert(w, req)
+	if w.Code != 200 {
+		t.Fatalf("got insert status %d: %s", w.Code, w.Body)
+	}
+	var inserted insertResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &inserted); err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted.Rejected) != 1 || inserted.Rejected[0].Row != 0 {
+		t.Errorf("got insert response %+v; want row 0 rejected", inserted)
+	}
+	if len(shard.inserts) != 1 {
+		t.Fatalf("got %d gRPC inserts; want 1", len(shard.inserts))
+	}
+	call := shard.inserts[0]
+	rowsInserted, err := gumshoe.DecodeRowBatch(call.Batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if call.Table != "table1" || !call.SkipInvalid || call.BatchID != "batch1" || len(rowsInserted) != 2 {
+		t.Errorf("got insert %+v of %d rows; want 2 rows into table1 with skip_invalid and batch1",
+			call, len(rowsInserted))
+	}
+}
+
+func TestGRPCFallsBackToHTTP(t *testing.T) {
+	// A shard which doesn't speak HTTP/2 at all, and one which does but doesn't serve gRPC.
+	http1Shard := newQueryShard(0, gumshoe.RowMap{"metric1": 1, "rowCount": 1})
+	defer http1Shard.Close()
+	http2Shard := httptest.NewUnstartedServer(http1Shard.Config.Handler)
+	http2Shard.Config.Protocols = new(http.Protocols)
+	http2Shard.Config.Protocols.SetHTTP1(true)
+	http2Shard.Config.Protocols.SetUnencryptedHTTP2(true)
+	http2Shard.Start()
+	defer http2Shard.Close()
+
+	for _, shard := range []*httptest.Server{http1Shard, http2Shard} {
+		r := newGRPCTestRouter(shard)
+		for i := 0; i < 2; i++ {
+			result := decodeResult(t, runTestQuery(r, ungroupedTestQuery, ""))
+			if len(result.Results) != 1 || result.Results[0]["metric1"] != 1.0 {
+				t.Errorf("got results %v; want metric1 1", result.Results)
+			}
+		}
+		if r.grpcShards.supported(r.Shards[0]) {
+			t.Errorf("shard %s is still taken to serve gRPC", shard.URL)
+		}
+	}
+}
+
+func TestGRPCShardErrors(t *testing.T) {
+	shard := &grpcTestShard{
+		rows: []gumshoe.RowMap{{"metric1": 1, "rowCount": 1}},
+		fail: http.Header{
+			"Grpc-Status":             {"8"},
+			"Grpc-Message":            {gumshoe.EscapeGRPCMessage("too many queries\n")},
+			gumshoe.GRPCStatusTrailer: {"429"},
+			"Retry-After":             {"3"},
+		},
+	}
+	server := newGRPCTestShard(shard)
+	defer server.Close()
+	r := newGRPCTestRouter(server)
+
+	// A call which fails outright fails the query as the HTTP request would.
+	w := runTestQuery(r, ungroupedTestQuery, "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3" ||
+		!strings.Contains(w.Body.String(), "too many queries") {
+		t.Errorf("got status %d (Retry-After %q): %s; want 429 with the shard's error",
+			w.Code, w.Header().Get("Retry-After"), w.Body)
+	}
+	// So does one which fails partway through the results.
+	shard.failLate = true
+	shard.fail = http.Header{"Grpc-Status": {"13"}, gumshoe.GRPCStatusTrailer: {"500"}}
+	if w := runTestQuery(r, ungroupedTestQuery, ""); w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d for a failed stream: %s; want 500", w.Code, w.Body)
+	}
+	if !r.grpcShards.supported(r.Shards[0]) {
+		t.Error("a shard whose gRPC calls failed is taken not to serve gRPC")
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// readyProbeTimeout bounds how long /readyz waits for each shard.
+const readyProbeTimeout = 2 * time.Second
+
+// HandleHealthz responds with a 200 as long as the router is running.
+func (r *Router) HandleHealthz(w http.ResponseWriter, req *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// HandleReadyz responds with a 200 if enough shards are ready for the router to serve requests (see
+// Router.ReadyShards), for its own DB and for each table, and a 503 otherwise.
+func (r *Router) HandleReadyz(w http.ResponseWriter, req *http.Request) {
+	ctx, cancel := context.WithTimeout(req.Context(), readyProbeTimeout)
+	defer cancel()
+	if err := r.checkReady(ctx); err != nil {
+		http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	for name, t := range r.Tables {
+		if err := t.checkReady(ctx); err != nil {
+			http.Error(w, fmt.Sprintf("not ready: table %s: %s", name, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// checkReady asks every shard whether it's ready, and returns an error if too few are.
+func (r *Router) checkReady(ctx context.Context) error {
+	ready := make(map[string]bool)
+	results := make(chan string, len(r.Shards))
+	for _, shard := range r.Shards {
+		go func(shard string) {
+			if r.shardReady(ctx, shard) {
+				results <- shard
+			} else {
+				results <- ""
+			}
+		}(shard)
+	}
+	for range r.Shards {
+		if shard := <-results; shard != "" {
+			ready[shard] = true
+		}
+	}
+	if need := r.ReadyShards; need > 0 {
+		// A table may have fewer shards than the main DB.
+		if need > len(r.Shards) {
+			need = len(r.Shards)
+		}
+		if len(ready) < need {
+			return fmt.Errorf("%d of %d shards are ready; %d are needed", len(ready), len(r.Shards), need)
+		}
+		return nil
+	}
+	for _, replicas := range r.partitions() {
+		ok := false
+		for _, shard := range replicas {
+			ok = ok || ready[shard]
+		}
+		if !ok {
+			return fmt.Errorf("no shard of the partition %v is ready", replicas)
+		}
+	}
+	return nil
+}
+
+// shardReady reports whether shard answers its /readyz with a 200.
+func (r *Router) shardReady(ctx context.Context, shard string) bool {
+	req, err := http.NewRequest("GET", r.shardURL(shard, "/readyz"), nil)
+	if err != nil {
+		panic("could not make http request")
+	}
+	resp, err := r.Client.Do(req.WithContext(ctx))
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == 200
+}
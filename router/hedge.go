@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+// hedgedQueryPartition is queryPartition for a Router with a HedgeDelay: if a replica hasn't responded within
+// the delay, the query is also sent to the next replica (and so on), and the first replica to respond wins.
+// The other queries are canceled. A shard only responds once it has run the query, so hedging cuts the
+// latency of a slow shard at the cost of running some queries twice.
+func (r *Router) hedgedQueryPartition(ctx context.Context, queryID string, replicas []string, b []byte,
+	priority string, sorted bool) (*http.Response, error) {
+	type attempt struct {
+		i    int // Index in cancels
+		resp *http.Response
+		err  error
+	}
+	results := make(chan attempt, len(replicas))
+	var cancels []context.CancelFunc
+	next := 0 // The next replica to try
+	start := func() {
+		shard := replicas[next]
+		next++
+		attemptCtx, cancel := context.WithCancel(ctx)
+		i := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := r.queryShard(attemptCtx, queryID, shard, b, priority, sorted)
+			results <- attempt{i, resp, err}
+		}()
+	}
+	// abandon cancels the attempts other than the one numbered keep (-1 for none) and closes the responses of
+	// any which are still pending.
+	abandon := func(keep, pending int) {
+		for i, cancel := range cancels {
+			if i != keep {
+				cancel()
+			}
+		}
+		go func() {
+			for ; pending > 0; pending-- {
+				if a := <-results; a.err == nil {
+					a.resp.Body.Close()
+				}
+			}
+		}()
+	}
+
+	start()
+	pending := 1
+	timer := time.NewTimer(r.HedgeDelay)
+	defer timer.Stop()
+	var err error
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(replicas) {
+				Log.Printf("[%s] no response from shard %s after %s; hedging", queryID, replicas[next-1],
+					r.HedgeDelay)
+				metrics.Inc("router.query.hedge")
+				start()
+				pending++
+				timer.Reset(r.HedgeDelay)
+			}
+		case a := <-results:
+			pending--
+			if a.err == nil {
+				abandon(a.i, pending)
+				if a.i > 0 {
+					metrics.Inc("router.query.hedge-won")
+				}
+				a.resp.Body = &cancelOnClose{a.resp.Body, cancels[a.i]}
+				return a.resp, nil
+			}
+			err = a.err
+			if ctx.Err() != nil {
+				abandon(-1, pending)
+				return nil, err
+			}
+			if he, ok := err.(httpError); ok && he.code < 500 {
+				abandon(-1, pending)
+				return nil, err
+			}
+			Log.Printf("[%s] query failed on shard %s: %s", queryID, replicas[a.i], err)
+			metrics.Inc("router.query.failover")
+			if next < len(replicas) {
+				start()
+				pending++
+			}
+		}
+	}
+	abandon(-1, 0)
+	return nil, err
+}
+
+// A cancelOnClose cancels the context of a response when its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
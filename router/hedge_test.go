@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+const ungroupedTestQuery = `{"aggregates": [{"type": "sum", "name": "metric1", "column": "metric1"}]}`
+
+func TestHedgedQueryOfSlowReplica(t *testing.T) {
+	// The first replica would answer only after the test's deadline; the hedge goes to the second, and the
+	// first one's query is canceled.
+	canceled := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// The server only notices a canceled request once the body has been read.
+		ioutil.ReadAll(req.Body)
+		select {
+		case <-time.After(10 * time.Second):
+		case <-req.Context().Done():
+			close(canceled)
+		}
+	}))
+	defer slow.Close()
+	fast := newQueryShard(0, gumshoe.RowMap{"metric1": 1, "rowCount": 1})
+	defer fast.Close()
+	r := newTestRouter(2, slow, fast)
+	r.HedgeDelay = 10 * time.Millisecond
+
+	start := time.Now()
+	result := decodeResult(t, runTestQuery(r, ungroupedTestQuery, ""))
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the hedged query took %s", elapsed)
+	}
+	if len(result.Results) != 1 || result.Results[0]["metric1"] != 1.0 {
+		t.Errorf("got results %v; want the fast replica's", result.Results)
+	}
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("the query of the slow replica wasn't canceled")
+	}
+}
+
+func TestQueryIsNotHedgedBeforeDelay(t *testing.T) {
+	first := newQueryShard(0, gumshoe.RowMap{"metric1": 1, "rowCount": 1})
+	defer first.Close()
+	second := newQueryShard(0, gumshoe.RowMap{"metric1": 2, "rowCount": 1})
+	defer second.Close()
+	r := newTestRouter(2, first, second)
+	r.HedgeDelay = time.Minute
+
+	result := decodeResult(t, runTestQuery(r, ungroupedTestQuery, ""))
+	if len(result.Results) != 1 || result.Results[0]["metric1"] != 1.0 {
+		t.Errorf("got results %v; want the first replica's", result.Results)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+// The durability modes of an insertBuffer: whether an insert is acknowledged once its rows are buffered, or
+// only once they have been sent to the shards.
+const (
+	durabilityBuffered = "buffered"
+	durabilityFlushed  = "flushed"
+)
+
+// An insertBuffer collects the rows of small inserts for each partition and sends them to the partition's
+// shards together, once there are maxRows of them or the oldest has waited maxAge.
+//
+// With durabilityFlushed, an insert waits for its rows to be flushed and fails if the flush fails. With
+// durabilityBuffered, an insert succeeds as soon as its rows are buffered; rows which then fail to be
+// flushed (or which are buffered when the router crashes) are lost.
+type insertBuffer struct {
+	r          *Router
+	maxRows    int
+	maxAge     time.Duration
+	durability string
+
+	mu      sync.Mutex
+	batches []*pendingBatch // Indexed by partition; nil if nothing is buffered
+	flushes sync.WaitGroup  // Flushes in progress
+}
+
+type pendingBatch struct {
+	rows  []gumshoe.RowMap
+	timer *time.Timer
+	done  chan struct{} // Closed once the batch has been flushed
+	err   error         // The result of the flush (set before done is closed)
+}
+
+func newInsertBuffer(r *Router, maxRows int, maxAge time.Duration, durability string) *insertBuffer {
+	return &insertBuffer{
+		r:          r,
+		maxRows:    maxRows,
+		maxAge:     maxAge,
+		durability: durability,
+		batches:    make([]*pendingBatch, len(r.Shards)/r.Replication),
+	}
+}
+
+// add buffers the rows for each partition (shardedRows is indexed by partition). With durabilityFlushed, it
+// waits until they have been flushed (or ctx is done).
+func (b *insertBuffer) add(ctx context.Context, shardedRows [][]gumshoe.RowMap) error {
+	var batches []*pendingBatch
+	b.mu.Lock()
+	for p, rows := range shardedRows {
+		if len(rows) == 0 {
+			continue
+		}
+		batch := b.batches[p]
+		if batch == nil {
+			batch = &pendingBatch{done: make(chan struct{})}
+			p := p
+			batch.timer = time.AfterFunc(b.maxAge, func() { b.flushIfPending(p, batch) })
+			b.batches[p] = batch
+		}
+		batch.rows = append(batch.rows, rows...)
+		batches = append(batches, batch)
+		if len(batch.rows) >= b.maxRows {
+			batch.timer.Stop()
+			b.startFlush(p, batch)
+		}
+	}
+	b.mu.Unlock()
+
+	if b.durability == durabilityBuffered {
+		return nil
+	}
+	for _, batch := range batches {
+		select {
+		case <-batch.done:
+			if batch.err != nil {
+				return batch.err
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// flushIfPending flushes batch if it is still buffered for partition p (and hasn't been flushed for being
+// full).
+func (b *insertBuffer) flushIfPending(p int, batch *pendingBatch) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.batches[p] == batch {
+		b.startFlush(p, batch)
+	}
+}
+
+// startFlush removes batch from the buffer and sends it to partition p's shards. b.mu must be held.
+func (b *insertBuffer) startFlush(p int, batch *pendingBatch) {
+	b.batches[p] = nil
+	b.flushes.Add(1)
+	go func() {
+		defer b.flushes.Done()
+		start := time.Now()
+		batch.err = b.r.insertPartition(b.r.partitions()[p], batch.rows, false, false, "", nil)
+		close(batch.done)
+		metrics.Since("router.insert.buffer.flush", start)
+		metrics.Count("router.insert.buffer.rows", float64(len(batch.rows)))
+		if batch.err != nil {
+			Log.Printf("Error flushing %d buffered rows: %s", len(batch.rows), batch.err)
+			metrics.Inc("router.insert.buffer.failure")
+			if b.durability == durabilityBuffered {
+				metrics.Count("router.insert.buffer.dropped", float64(len(batch.rows)))
+			}
+		}
+	}()
+}
+
+// flushAll flushes every buffered batch and waits for all flushes to finish (as at shutdown).
+func (b *insertBuffer) flushAll() {
+	b.mu.Lock()
+	for p, batch := range b.batches {
+		if batch != nil {
+			batch.timer.Stop()
+			b.startFlush(p, batch)
+		}
+	}
+	b.mu.Unlock()
+	b.flushes.Wait()
+}
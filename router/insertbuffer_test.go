@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+// newInsertShard returns a test shard which sends the rows of each insert to batches.
+func newInsertShard(batches chan<- []gumshoe.RowMap) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var rows []gumshoe.RowMap
+		if err := json.NewDecoder(req.Body).Decode(&rows); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		batches <- rows
+	}))
+}
+
+func testRows(n int) []gumshoe.RowMap {
+	var rows []gumshoe.RowMap
+	for i := 0; i < n; i++ {
+		rows = append(rows, gumshoe.RowMap{"at": 0, "dim1": "a", "metric1": i})
+	}
+	return rows
+}
+
+// expectBatch waits for a batch from an insert shard and checks its size.
+func expectBatch(t *testing.T, batches <-chan []gumshoe.RowMap, size int) {
+	t.Helper()
+	select {
+	case rows := <-batches:
+		if len(rows) != size {
+			t.Errorf("got a batch of %d rows; want %d", len(rows), size)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no batch of %d rows was flushed", size)
+	}
+}
+
+func expectNoBatch(t *testing.T, batches <-chan []gumshoe.RowMap, wait time.Duration) {
+	t.Helper()
+	select {
+	case rows := <-batches:
+		t.Fatalf("got an early batch of %d rows", len(rows))
+	case <-time.After(wait):
+	}
+}
+
+func TestInsertBufferFlushesWhenFull(t *testing.T) {
+	batches := make(chan []gumshoe.RowMap, 10)
+	shard := newInsertShard(batches)
+	defer shard.Close()
+	r := newTestRouter(1, shard)
+	b := newInsertBuffer(r, 5, time.Minute, durabilityBuffered)
+
+	if err := b.add(context.Background(), [][]gumshoe.RowMap{testRows(3)}); err != nil {
+		t.Fatal(err)
+	}
+	expectNoBatch(t, batches, 50*time.Millisecond)
+	if err := b.add(context.Background(), [][]gumshoe.RowMap{testRows(3)}); err != nil {
+		t.Fatal(err)
+	}
+	expectBatch(t, batches, 6)
+
+	// The rows of the next batch wait for flushAll.
+	if err := b.add(context.Background(), [][]gumshoe.RowMap{testRows(1)}); err != nil {
+		t.Fatal(err)
+	}
+	b.flushAll()
+	expectBatch(t, batches, 1)
+}
+
+func TestInsertBufferFlushesAfterMaxAge(t *testing.T) {
+	batches := make(chan []gumshoe.RowMap, 10)
+	shard := newInsertShard(batches)
+	defer shard.Close()
+	r := newTestRouter(1, shard)
+	b := newInsertBuffer(r, 100, 20*time.Millisecond, durabilityBuffered)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if err := b.add(context.Background(), [][]gumshoe.RowMap{testRows(2)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectBatch(t, batches, 4)
+	if elapsed := time.Since(start); elapsed < 20*time.Millisecond {
+		t.Errorf("the batch was flushed after %s; want at least 20ms", elapsed)
+	}
+
+	// With durabilityFlushed, an insert waits for the flush.
+	b.durability = durabilityFlushed
+	if err := b.add(context.Background(), [][]gumshoe.RowMap{testRows(3)}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case rows := <-batches:
+		if len(rows) != 3 {
+			t.Errorf("got a batch of %d rows; want 3", len(rows))
+		}
+	default:
+		t.Error("the insert returned before its rows were flushed")
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+// newFailingQueryShard returns a test shard which fails every query: with a server error or, if body isn't
+// empty, by writing body (a broken stream) as its response.
+func newFailingQueryShard(body string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		if body == "" {
+			http.Error(w, "shard failure", http.StatusInternalServerError)
+			return
+		}
+		w.Write([]byte(body))
+	}))
+}
+
+func TestPartialResultsWithFailedShard(t *testing.T) {
+	for _, failure := range []string{"", "{}\n{\"dim1\": \"b\", \"metric1\": 5, \"rowCount\": 1}\n{bad"} {
+		good := newQueryShard(0, gumshoe.RowMap{"dim1": "a", "metric1": 1, "rowCount": 1})
+		defer good.Close()
+		bad := newFailingQueryShard(failure)
+		defer bad.Close()
+		r := newTestRouter(1, good, bad)
+		badShard := strings.TrimPrefix(bad.URL, "http://")
+		query := fmt.Sprintf(groupedTestQuery, "")
+
+		if w := runTestQuery(r, query, ""); w.Code != http.StatusInternalServerError {
+			t.Errorf("without partial=true, got status %d; want 500", w.Code)
+		}
+
+		w := runTestQuery(r, query, "partial=true")
+		result := decodeResult(t, w)
+		// Rows the failed shard sent before failing are left out along with the rest of its results.
+		if len(result.Results) != 1 || result.Results[0]["dim1"] != "a" {
+			t.Errorf("got results %v; want only the good shard's", result.Results)
+		}
+		if want := []string{badShard}; !reflect.DeepEqual(result.FailedShards, want) {
+			t.Errorf("got failed shards %v; want %v", result.FailedShards, want)
+		}
+		if result.Coverage != 0.5 {
+			t.Errorf("got coverage %g; want 0.5", result.Coverage)
+		}
+		if got := w.Header().Get(failedShardsHeader); got != badShard {
+			t.Errorf("got %s %q; want %q", failedShardsHeader, got, badShard)
+		}
+		if got := w.Header().Get(coverageHeader); got != "0.5" {
+			t.Errorf("got %s %q; want 0.5", coverageHeader, got)
+		}
+	}
+}
+
+func TestPartialResultsOfAllOrNoShards(t *testing.T) {
+	var shards []*httptest.Server
+	for i := 0; i < 2; i++ {
+		shard := newFailingQueryShard("")
+		defer shard.Close()
+		shards = append(shards, shard)
+	}
+	r := newTestRouter(1, shards...)
+
+	// With every partition failing, there are no results to return.
+	query := fmt.Sprintf(groupedTestQuery, "")
+	if w := runTestQuery(r, query, "partial=true"); w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d; want 500", w.Code)
+	}
+
+	// A complete result has a coverage of 1 and no failed shards.
+	good := newQueryShard(0, gumshoe.RowMap{"dim1": "a", "metric1": 1, "rowCount": 1})
+	defer good.Close()
+	r = newTestRouter(1, good)
+	w := runTestQuery(r, query, "partial=true")
+	result := decodeResult(t, w)
+	if result.Coverage != 1 || len(result.FailedShards) != 0 {
+		t.Errorf("got coverage %g and failed shards %v; want 1 and none", result.Coverage, result.FailedShards)
+	}
+	if got := w.Header().Get(coverageHeader); got != "1" {
+		t.Errorf("got %s %q; want 1", coverageHeader, got)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+// A queryTracker keeps track of the queries which are running for /debug/queries.
+type queryTracker struct {
+	mu      sync.Mutex
+	next    int64
+	running map[int64]*routedQuery
+}
+
+// A routedQuery is a running query and the status of each shard it has been sent to.
+type routedQuery struct {
+	id      string
+	started time.Time
+	query   *gumshoe.Query
+	cancel  context.CancelFunc
+
+	mu     sync.Mutex
+	shards map[string]string // The status of each shard queried
+}
+
+// A RunningQuery is a query listed on /debug/queries.
+type RunningQuery struct {
+	ID      string
+	Started time.Time
+	Elapsed string
+	Query   *gumshoe.Query
+	// Shards holds the status of each shard queried so far: "running" (until it responds), "streaming" (while
+	// its results are read), "done", or the error with which it failed.
+	Shards map[string]string
+}
+
+type routedQueryKey struct{}
+
+func newQueryTracker() *queryTracker {
+	return &queryTracker{running: make(map[int64]*routedQuery)}
+}
+
+// add records that a query has started, returning a copy of ctx with which to run it (which is canceled by
+// cancel). The caller must call the returned function when it's done.
+func (t *queryTracker) add(ctx context.Context, id string,
+	query *gumshoe.Query) (queryCtx context.Context, done func()) {
+
+	ctx, cancel := context.WithCancel(ctx)
+	q := &routedQuery{
+		id:      id,
+		started: time.Now(),
+		query:   query,
+		cancel:  cancel,
+		shards:  make(map[string]string),
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := t.next
+	t.next++
+	t.running[key] = q
+	return context.WithValue(ctx, routedQueryKey{}, q), func() {
+		t.mu.Lock()
+		delete(t.running, key)
+		t.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel cancels the running queries with the given ID, returning how many there were.
+func (t *queryTracker) cancel(id string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, q := range t.running {
+		if q.id == id {
+			q.cancel()
+			n++
+		}
+	}
+	return n
+}
+
+// list returns the running queries, oldest first.
+func (t *queryTracker) list() []RunningQuery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([]int64, 0, len(t.running))
+	for key := range t.running {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	queries := make([]RunningQuery, len(keys))
+	for i, key := range keys {
+		q := t.running[key]
+		queries[i] = RunningQuery{
+			ID:      q.id,
+			Started: q.started,
+			Elapsed: time.Since(q.started).String(),
+			Query:   q.query,
+			Shards:  make(map[string]string),
+		}
+		q.mu.Lock()
+		for shard, status := range q.shards {
+			queries[i].Shards[shard] = status
+		}
+		q.mu.Unlock()
+	}
+	return queries
+}
+
+// setShardStatus records the status of shard for the tracked query of ctx, if it has one.
+func setShardStatus(ctx context.Context, shard, status string) {
+	q, ok := ctx.Value(routedQueryKey{}).(*routedQuery)
+	if !ok {
+		return
+	}
+	q.mu.Lock()
+	q.shards[shard] = status
+	q.mu.Unlock()
+}
+
+// A trackedBody marks its shard done in the query's status when the shard's response body is closed.
+type trackedBody struct {
+	io.ReadCloser
+	ctx   context.Context
+	shard string
+}
+
+func (b *trackedBody) Close() error {
+	setShardStatus(b.ctx, b.shard, "done")
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+// maxRateLimitClients bounds the number of token buckets a rateLimiter keeps. Beyond this, the buckets of
+// idle clients (which are full, and so have no state worth keeping) are dropped.
+const maxRateLimitClients = 10000
+
+// A rateLimiter limits the rate of one kind of request (queries or inserts) at the router, both for each
+// client and overall, using token buckets which hold one second's worth of requests. A client is identified
+// by its API key (given in a header) or, if it doesn't send one, by its IP address.
+type rateLimiter struct {
+	name       string  // The kind of request, for errors and metrics
+	clientRate float64 // Requests per second per client; 0 for no limit
+	globalRate float64 // Requests per second overall; 0 for no limit
+	header     string  // The API key header; "" to always use IP addresses
+	now        func() time.Time
+
+	mu      sync.Mutex
+	global  tokenBucket
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// newRateLimiter returns a rateLimiter for the given per-client and global rates, or nil if neither is
+// limited.
+func newRateLimiter(name string, clientRate, globalRate float64, header string) *rateLimiter {
+	if clientRate <= 0 && globalRate <= 0 {
+		return nil
+	}
+	l := &rateLimiter{
+		name:       name,
+		clientRate: clientRate,
+		globalRate: globalRate,
+		header:     header,
+		now:        time.Now,
+		buckets:    make(map[string]*tokenBucket),
+	}
+	l.global = tokenBucket{tokens: burst(globalRate), updated: l.now()}
+	return l
+}
+
+// burst is the size of a token bucket for rate: one second's worth of requests, and at least one.
+func burst(rate float64) float64 {
+	return math.Max(1, rate)
+}
+
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	if l.header != "" {
+		if key := r.Header.Get(l.header); key != "" {
+			return "key:" + key
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// allow takes a token from r's client's bucket and from the global bucket. If either is empty, neither is
+// taken from, and allow returns false, which limit was exceeded ("per-client" or "global"), and how long the
+// client should wait before trying again.
+func (l *rateLimiter) allow(r *http.Request) (ok bool, limit string, retryAfter time.Duration) {
+	key := l.clientKey(r)
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var bucket *tokenBucket
+	if l.clientRate > 0 {
+		bucket = l.buckets[key]
+		if bucket == nil {
+			if len(l.buckets) >= maxRateLimitClients {
+				l.removeIdle(now)
+			}
+			bucket = &tokenBucket{tokens: burst(l.clientRate), updated: now}
+			l.buckets[key] = bucket
+		}
+		bucket.refill(l.clientRate, now)
+		if bucket.tokens < 1 {
+			return false, "per-client", bucket.wait(l.clientRate)
+		}
+	}
+	if l.globalRate > 0 {
+		l.global.refill(l.globalRate, now)
+		if l.global.tokens < 1 {
+			return false, "global", l.global.wait(l.globalRate)
+		}
+		l.global.tokens--
+	}
+	if bucket != nil {
+		bucket.tokens--
+	}
+	return true, "", 0
+}
+
+func (b *tokenBucket) refill(rate float64, now time.Time) {
+	elapsed := now.Sub(b.updated).Seconds()
+	b.tokens = math.Min(burst(rate), b.tokens+elapsed*rate)
+	b.updated = now
+}
+
+// wait is how long until b has a token.
+func (b *tokenBucket) wait(rate float64) time.Duration {
+	return time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// removeIdle drops the client buckets which have refilled completely. l.mu must be held.
+func (l *rateLimiter) removeIdle(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.refill(l.clientRate, now); bucket.tokens >= burst(l.clientRate) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// allowRequest checks req against l (if it isn't nil). If req is over a limit, allowRequest responds with a
+// 429 and returns false.
+func (l *rateLimiter) allowRequest(w http.ResponseWriter, req *http.Request) bool {
+	if l == nil {
+		return true
+	}
+	ok, limit, retryAfter := l.allow(req)
+	if ok {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+	WriteError(w, fmt.Errorf("%s %s rate limit exceeded", limit, l.name), http.StatusTooManyRequests)
+	metrics.Inc("router." + l.name + ".rate-limited")
+	return false
+}
@@ -9,28 +9,41 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"crypto/rand"
+	"encoding"
 	"encoding/base32"
+	"encoding/gob"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"os"
+	"os/signal"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/auth"
 	"github.com/philc/gumshoedb/internal/config"
+	"github.com/philc/gumshoedb/internal/debug"
 	"github.com/philc/gumshoedb/internal/github.com/cespare/hutil/apachelog"
 	"github.com/philc/gumshoedb/internal/github.com/cespare/wait"
 	"github.com/philc/gumshoedb/internal/github.com/gorilla/pat"
+	"github.com/philc/gumshoedb/internal/grafana"
+	"github.com/philc/gumshoedb/internal/gzipbody"
+	"github.com/philc/gumshoedb/internal/metrics"
+	"github.com/philc/gumshoedb/internal/remotewrite"
 )
 
 const logFlags = log.Lshortfile
@@ -39,47 +52,253 @@ var (
 	Log = log.New(os.Stderr, "[router] ", logFlags)
 )
 
+// queryTimeoutHeader is the header used to tell the shards how long they have left to answer a query.
+const queryTimeoutHeader = "X-Gumshoe-Query-Timeout"
+
+// queryDeadlineHeader is the header used to tell the shards the deadline for a query (in RFC 3339 format), so
+// that they abort queries whose results would arrive too late. Shards use it in preference to
+// queryTimeoutHeader, which is still sent for older shards.
+const queryDeadlineHeader = "X-Gumshoe-Deadline"
+
+// queryPriorityHeader is the header clients use to mark a query as "interactive" (the default) or "batch".
+// It is passed along to the shards, which admit the two classes of queries separately.
+const queryPriorityHeader = "X-Gumshoe-Query-Priority"
+
+// queryIDHeader is the header used to pass the ID the router gives each query along to the shards, which
+// use it in their logs so that a query can be followed across the cluster.
+const queryIDHeader = "X-Gumshoe-Query-ID"
+
+// failedShardsHeader and coverageHeader report which shards were left out of the results of a query with
+// partial=true, and the fraction of the partitions the results cover, for formats without a place for them.
+const (
+	failedShardsHeader = "X-Gumshoe-Failed-Shards"
+	coverageHeader     = "X-Gumshoe-Coverage"
+)
+
+// sortedStreamHeader is set by a shard on a streaming query response whose rows are sorted by the query's
+// grouping (when the router asks with sorted=true).
+const sortedStreamHeader = "X-Gumshoe-Sorted"
+
+// batchIDHeader is the header clients use to identify a batch of inserted rows so that retries are not
+// double-counted. It is forwarded to each shard, which remembers the IDs of its recent batches.
+const batchIDHeader = "X-Batch-ID"
+
 type Router struct {
 	http.Handler
-	Schema *gumshoe.Schema
-	Shards []string
-	Client *http.Client
+	Schema       *gumshoe.Schema
+	Shards       []string
+	Client       *http.Client
+	QueryTimeout time.Duration // If positive, queries are aborted after this long
+	GzipInserts  bool          // Whether to gzip the inserts sent to the shards
+	// Replication is the number of shards to which each row is written. Shards are grouped into replica sets
+	// (partitions) of Replication consecutive shards, and each query goes to one replica of each partition.
+	Replication int
+	// Sharding is how rows are assigned to partitions: shardByHash or shardByTime (in which case queries
+	// filtered by time only go to the partitions holding the matching intervals).
+	Sharding string
+	// HedgeDelay, if positive, is how long a query waits for a replica before also trying the next one (see
+	// hedgedQueryPartition).
+	HedgeDelay time.Duration
+	// ReadyShards is the number of shards which must be ready for /readyz to report the router ready. If it's 0,
+	// one replica of every partition must be ready.
+	ReadyShards int
+	// InsertBuffer, if not nil, combines small inserts into larger batches for the shards.
+	InsertBuffer *insertBuffer
+	ShardScheme  string // "https" if the shards are reached over TLS; otherwise "http"
+	// ShardPathPrefix is prepended to the paths of requests to the shards: "/tables/{name}" for a table's
+	// Router, and "" for the main DB's.
+	ShardPathPrefix string
+	Tables          map[string]*Router // The tables (see config.Config.Tables), served under /tables/
+	// QueryLimiter and InsertLimiter rate limit queries and inserts, if they aren't nil.
+	QueryLimiter  *rateLimiter
+	InsertLimiter *rateLimiter
+	// RemoteWriteRules map the samples of Prometheus remote writes (to /prometheus/write) to rows.
+	RemoteWriteRules []gumshoe.RemoteWriteRule
+	// InfluxRules map the points of Influx line protocol writes (to /write) to rows.
+	InfluxRules []gumshoe.InfluxRule
+
+	queries    *queryTracker // Shared by the main DB's Router and its tables'
+	grpcShards *grpcShards   // If not nil (shard_grpc is set), queries and inserts use gRPC where they can
 }
 
+// shardURL returns the URL of path (which may include a query string) on shard.
+func (r *Router) shardURL(shard, path string) string {
+	return r.ShardScheme + "://" + shard + r.ShardPathPrefix + path
+}
+
+// HandleInsert splits the inserted rows among the shards. As with the shards' own /insert, the parameter
+// skip_invalid=true makes the shards skip invalid rows rather than failing; the response lists the skipped
+// rows (by their indices in the original insert). With format=csv, the body is CSV (with the same map
+// parameters as a shard's CSV insert); the rows are sent on to the shards as JSON. A protobuf RowBatch
+// (Content-Type application/x-protobuf) is split into protobuf RowBatches for the shards.
 func (r *Router) HandleInsert(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
+	if !r.InsertLimiter.allowRequest(w, req) {
+		return
+	}
 	var rows []gumshoe.RowMap
-	if err := json.NewDecoder(req.Body).Decode(&rows); err != nil {
+	var err error
+	protobuf := gumshoe.IsProtobufContentType(req.Header.Get("Content-Type"))
+	switch {
+	case req.URL.Query().Get("format") == "csv":
+		rows, err = r.readCSVRows(req)
+	case protobuf:
+		var b []byte
+		if b, err = ioutil.ReadAll(req.Body); err == nil {
+			rows, err = gumshoe.DecodeRowBatch(b)
+		}
+	default:
+		// Numbers are decoded as json.Numbers so that 64-bit integers are sent to the shards exactly.
+		decoder := json.NewDecoder(req.Body)
+		decoder.UseNumber()
+		err = decoder.Decode(&rows)
+	}
+	if err != nil {
 		WriteError(w, err, http.StatusBadRequest)
 		return
 	}
 	Log.Printf("Inserting %d rows", len(rows))
+	skipInvalid := req.URL.Query().Get("skip_invalid") == "true"
 
-	shardedRows := make([][]gumshoe.RowMap, len(r.Shards))
-	for _, row := range rows {
+	partitions := r.partitions()
+	shardedRows := make([][]gumshoe.RowMap, len(partitions))
+	shardedIndexes := make([][]int, len(partitions)) // Index in rows of each row in shardedRows
+	rejected := []gumshoe.RowError{}
+rowLoop:
+	for i, row := range rows {
 		// Check that the columns match the schema we have
 		for col := range row {
 			if !r.validColumnName(col) {
+				if skipInvalid {
+					msg := fmt.Sprintf("%q is not a valid column name", col)
+					rejected = append(rejected, gumshoe.RowError{Row: i, Error: msg})
+					continue rowLoop
+				}
 				writeInvalidColumnError(w, col)
 				return
 			}
 		}
-		shardIdx := r.Hash(row)
-		shardedRows[shardIdx] = append(shardedRows[shardIdx], row)
+		partition := r.Hash(row)
+		shardedRows[partition] = append(shardedRows[partition], row)
+		shardedIndexes[partition] = append(shardedIndexes[partition], i)
+	}
+	batchID := req.Header.Get(batchIDHeader)
+	// Inserts of individual batches (whose rejected rows are reported, or which may be retried) can't be
+	// combined with other inserts, so they skip the buffer.
+	if r.InsertBuffer != nil && !skipInvalid && batchID == "" {
+		if err := r.InsertBuffer.add(req.Context(), shardedRows); err != nil {
+			metrics.Inc("router.insert.failure")
+			WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		metrics.Since("router.insert", start)
+		metrics.Count("router.insert.rows", float64(len(rows)))
+		return
 	}
+	responses := make([]insertResponse, len(r.Shards)) // Indexed like r.Shards
 	var wg wait.Group
-	for i := range shardedRows {
-		i := i
+	for p := range shardedRows {
+		p := p
 		wg.Go(func(_ <-chan struct{}) error {
-			shard := r.Shards[i]
-			b, err := json.Marshal(shardedRows[i])
-			if err != nil {
-				panic("unexpected marshal error")
+			return r.insertPartition(partitions[p], shardedRows[p], protobuf, skipInvalid, batchID,
+				responses[p*r.Replication:(p+1)*r.Replication])
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		metrics.Inc("router.insert.failure")
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	metrics.Since("router.insert", start)
+	metrics.Count("router.insert.rows", float64(len(rows)))
+	if !skipInvalid {
+		return
+	}
+	duplicate := true
+	for i, resp := range responses {
+		// The replicas of a partition reject the same rows, so only the first replica's are reported.
+		p := i / r.Replication
+		if i%r.Replication == 0 {
+			for _, rowErr := range resp.Rejected {
+				rowErr.Row = shardedIndexes[p][rowErr.Row]
+				rejected = append(rejected, rowErr)
 			}
-			shardReq, err := http.NewRequest("PUT", "http://"+shard+"/insert", bytes.NewReader(b))
+		}
+		duplicate = duplicate && resp.Duplicate
+	}
+	sort.Sort(rowErrorsByRow(rejected))
+	WriteJSONResponse(w, insertResponse{Rejected: rejected, Duplicate: duplicate})
+}
+
+// insertPartition inserts rows into every replica of a partition, as protobuf or JSON (or by gRPC, to the
+// replicas which serve it). If skipInvalid is true, the replicas' responses are decoded into responses
+// (indexed like replicas).
+func (r *Router) insertPartition(replicas []string, rows []gumshoe.RowMap, protobuf, skipInvalid bool,
+	batchID string, responses []insertResponse) error {
+	var buf bytes.Buffer
+	var body io.Writer = &buf
+	var gz *gzip.Writer
+	if r.GzipInserts {
+		gz = gzip.NewWriter(&buf)
+		body = gz
+	}
+	// Rows which can't be sent as a RowBatch (because they have values which aren't valid in one) are sent as
+	// JSON, even to the replicas which serve gRPC, so that the shards reject them just as usual.
+	var batch []byte
+	grpcBatch := false
+	if protobuf || r.grpcShards.enabled() {
+		var err error
+		batch, err = gumshoe.EncodeRowBatch(rows)
+		if err != nil && protobuf {
+			panic("unexpected marshal error")
+		}
+		grpcBatch = err == nil
+	}
+	contentType := "application/json"
+	if protobuf {
+		contentType = gumshoe.ProtobufContentType
+		if _, err := body.Write(batch); err != nil {
+			panic("unexpected write error")
+		}
+	} else if err := json.NewEncoder(body).Encode(rows); err != nil {
+		panic("unexpected marshal error")
+	}
+	if gz != nil {
+		if err := gz.Close(); err != nil {
+			panic("unexpected gzip error")
+		}
+	}
+	// Every replica of the partition gets the same batch; a retry with the same batch ID is then only applied
+	// by the replicas which missed it the first time.
+	var wg wait.Group
+	for i, shard := range replicas {
+		i, shard := i, shard
+		wg.Go(func(_ <-chan struct{}) error {
+			if grpcBatch && r.grpcShards.supported(shard) {
+				var response *insertResponse
+				if skipInvalid {
+					response = &responses[i]
+				}
+				err := r.insertShardGRPC(shard, batch, skipInvalid, batchID, response)
+				if err != errGRPCUnsupported {
+					return err
+				}
+			}
+			url := r.shardURL(shard, "/insert")
+			if skipInvalid {
+				url += "?skip_invalid=true"
+			}
+			shardReq, err := http.NewRequest("PUT", url, bytes.NewReader(buf.Bytes()))
 			if err != nil {
 				panic("could not make http request")
 			}
-			shardReq.Header.Set("Content-Type", "application/json")
+			shardReq.Header.Set("Content-Type", contentType)
+			if gz != nil {
+				shardReq.Header.Set("Content-Encoding", "gzip")
+			}
+			if batchID != "" {
+				shardReq.Header.Set(batchIDHeader, batchID)
+			}
 			resp, err := r.Client.Do(shardReq)
 			if err != nil {
 				return err
@@ -88,53 +307,119 @@ func (r *Router) HandleInsert(w http.ResponseWriter, req *http.Request) {
 			if resp.StatusCode != 200 {
 				return NewHTTPError(resp, shard)
 			}
+			if skipInvalid {
+				return json.NewDecoder(resp.Body).Decode(&responses[i])
+			}
 			return nil
 		})
 	}
-	if err := wg.Wait(); err != nil {
-		WriteError(w, err, http.StatusInternalServerError)
+	return wg.Wait()
+}
+
+// readCSVRows reads all the rows of a CSV insert.
+func (r *Router) readCSVRows(req *http.Request) ([]gumshoe.RowMap, error) {
+	mapping, err := gumshoe.ParseCSVMapping(req.URL.Query()["map"])
+	if err != nil {
+		return nil, err
+	}
+	reader, err := r.Schema.NewCSVReader(req.Body, mapping)
+	if err != nil {
+		return nil, err
+	}
+	var rows []gumshoe.RowMap
+	for {
+		row, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
 	}
 }
 
-// Hash hashes the dimensions of the row to assign to a particular shard.
-func (r *Router) Hash(row gumshoe.RowMap) int {
-	crc := crc32.NewIEEE()
-	encoder := json.NewEncoder(crc)
-	if err := encoder.Encode(row[r.Schema.TimestampColumn.Name]); err != nil {
-		panic(err)
+// insertResponse is the response to an insert with skip_invalid=true (the same as a shard's).
+type insertResponse struct {
+	Rejected  []gumshoe.RowError `json:"rejected"`
+	Duplicate bool               `json:"duplicate,omitempty"` // Every shard had already inserted the batch
+}
+
+type rowErrorsByRow []gumshoe.RowError
+
+func (e rowErrorsByRow) Len() int           { return len(e) }
+func (e rowErrorsByRow) Less(i, j int) bool { return e[i].Row < e[j].Row }
+func (e rowErrorsByRow) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+
+// partitions groups the shards into their replica sets: each run of Replication consecutive shards holds
+// the same rows.
+func (r *Router) partitions() [][]string {
+	var partitions [][]string
+	for i := 0; i < len(r.Shards); i += r.Replication {
+		partitions = append(partitions, r.Shards[i:i+r.Replication])
 	}
-	for _, col := range r.Schema.DimensionColumns {
-		if err := encoder.Encode(row[col.Name]); err != nil {
-			panic(err)
+	return partitions
+}
+
+// Hash hashes the dimensions of the row to assign to a particular partition (a single shard, without
+// replication). With time-based sharding, the row is instead assigned by its interval.
+func (r *Router) Hash(row gumshoe.RowMap) int {
+	numPartitions := len(r.Shards) / r.Replication
+	if r.Sharding == shardByTime {
+		if p, ok := r.Schema.TimePartition(row, numPartitions); ok {
+			return p
 		}
 	}
-	return int(crc.Sum32()) % len(r.Shards)
+	return r.Schema.HashPartition(row, numPartitions)
 }
 
 type Result struct {
 	Results    []gumshoe.RowMap `json:"results"`
 	DurationMS int              `json:"duration_ms"`
+	SampleRate float64          `json:"sample_rate,omitempty"` // Set if the results are from a sample
+	// With partial=true, the shards which were left out of the results and the fraction of the partitions
+	// (replica sets of shards) which are covered by them.
+	FailedShards []string `json:"failed_shards,omitempty"`
+	Coverage     float64  `json:"coverage,omitempty"`
+	// With debug=true, the timing of each shard which was read, sorted by shard, to tell a slow shard from a
+	// slow merge.
+	ShardTimings []ShardTiming `json:"shard_timings,omitempty"`
+}
+
+// A ShardTiming describes how long a shard took to return its part of a query's results.
+type ShardTiming struct {
+	Shard string `json:"shard"`
+	// DurationMS is the time from when the query was sent to the shards until this shard's results were read.
+	DurationMS int    `json:"duration_ms"`
+	Rows       int    `json:"rows"`
+	Bytes      int64  `json:"bytes"` // The size of the (decompressed) results
+	Error      string `json:"error,omitempty"`
 }
 
 func (r *Router) HandleQuery(w http.ResponseWriter, req *http.Request) {
 	start := time.Now()
-	queryID := randomID() // used to make tracking a single query throught he logs easier
-	if req.URL.Query().Get("format") != "" {
-		WriteError(w, errors.New("non-standard query formats not supported"), 500)
+	if !r.QueryLimiter.allowRequest(w, req) {
 		return
 	}
-	query, err := gumshoe.ParseJSONQuery(req.Body)
+	queryID := randomID() // used to make tracking a single query throught he logs easier
+	// The router supports the same output formats as a standalone server, except for the streaming format
+	// (which is only used between the router and the shards).
+	format := req.URL.Query().Get("format")
+	switch format {
+	case "", "json", "arrow":
+	default:
+		if _, _, ok := gumshoe.DelimitedFormat(format); !ok {
+			WriteError(w, fmt.Errorf("unsupported query format %q", format), http.StatusBadRequest)
+			return
+		}
+	}
+	query, err := parseQuery(req)
 	if err != nil {
 		WriteError(w, err, http.StatusBadRequest)
 		return
 	}
 	Log.Printf("[%s] got query: %s", queryID, query)
 	for _, agg := range query.Aggregates {
-		if agg.Type == gumshoe.AggregateAvg {
-			// TODO(caleb): Handle as described in the doc.
-			WriteError(w, errors.New("average aggregates not handled by the router"), 500)
-			return
-		}
 		if !r.validColumnName(agg.Column) {
 			writeInvalidColumnError(w, agg.Column)
 			return
@@ -151,11 +436,64 @@ func (r *Router) HandleQuery(w http.ResponseWriter, req *http.Request) {
 			writeInvalidColumnError(w, filter.Column)
 			return
 		}
+		switch filter.Type {
+		case gumshoe.FilterIn, gumshoe.FilterNotIn, gumshoe.FilterInFold:
+			if _, ok := filter.Value.([]interface{}); !ok {
+				err := fmt.Errorf("'in', 'not in', and 'iin' filters require a list for comparison; got %v", filter.Value)
+				WriteError(w, err, http.StatusBadRequest)
+				return
+			}
+		}
 	}
-	b, err := json.Marshal(query)
+	if _, ok := query.TimeBucketDuration(r.Schema.TimestampColumn.Name, r.Schema.IntervalDuration); !ok {
+		for _, agg := range query.Aggregates {
+			if agg.Type == gumshoe.AggregateRate {
+				err := fmt.Errorf("rate aggregate %q requires grouping by %s", agg.Name,
+					r.Schema.TimestampColumn.Name)
+				WriteError(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+		if query.Fill != nil {
+			err := fmt.Errorf("fill requires grouping by %s", r.Schema.TimestampColumn.Name)
+			WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+		if len(query.Windows) > 0 {
+			err := fmt.Errorf("windows require grouping by %s", r.Schema.TimestampColumn.Name)
+			WriteError(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	if err := query.ValidateExpressions(); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := query.ValidateWindows(); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := query.ValidateHavingFilters(); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := query.ValidateOrderBy(); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	ctx := req.Context()
+	if r.QueryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, r.QueryTimeout)
+		defer cancel()
+	}
+	ctx, done := r.queries.add(ctx, queryID, query)
+	defer done()
+	b, err := json.Marshal(makeShardQuery(query))
 	if err != nil {
 		panic("unexpected marshal error")
 	}
+	partial := req.URL.Query().Get("partial") == "true"
 	var (
 		wg     wait.Group
 		mu     sync.Mutex // protects result, resultMap
@@ -163,86 +501,260 @@ func (r *Router) HandleQuery(w http.ResponseWriter, req *http.Request) {
 		// rest only for grouping case
 		groupingCol        string
 		groupingColIntConv bool
+		groupingTruncation gumshoe.TimeTruncationType
 		resultMap          = make(map[interface{}]*lockedRowMap)
 	)
 	if len(query.Groupings) > 0 {
 		groupingCol = query.Groupings[0].Name
 		groupingColIntConv = r.convertColumnToIntegral(query.Groupings[0].Column)
+		groupingTruncation = query.Groupings[0].TimeTransform
 	}
-	for i := range r.Shards {
-		i := i
-		wg.Go(func(_ <-chan struct{}) error {
-			shard := r.Shards[i]
-			url := "http://" + shard + "/query?format=stream"
-			resp, err := r.Client.Post(url, "application/json", bytes.NewReader(b))
-			if err != nil {
-				return err
-			}
-			defer resp.Body.Close()
-			if resp.StatusCode != 200 {
-				return NewHTTPError(resp, shard)
+	// mergeRow merges a (fully decoded) row from a shard into result or resultMap.
+	mergeRow := func(row gumshoe.RowMap) {
+		mu.Lock()
+		if len(query.Groupings) == 0 {
+			if len(result) == 0 {
+				result = []gumshoe.RowMap{row}
+			} else {
+				r.mergeRows(result[0], row, query)
 			}
-
-			decoder := json.NewDecoder(resp.Body)
-			var m map[string]int
-			if err := decoder.Decode(&m); err != nil {
-				return err
+			mu.Unlock()
+			return
+		}
+		groupByValue := row[groupingCol]
+		cur := resultMap[groupByValue]
+		if cur == nil {
+			resultMap[groupByValue] = &lockedRowMap{row: row}
+			mu.Unlock()
+			return
+		}
+		// downgrade lock
+		cur.mu.Lock()
+		mu.Unlock()
+		r.mergeRows(cur.row, row, query)
+		cur.mu.Unlock()
+	}
+	partitions := r.queryPartitions(query)
+	priority := req.Header.Get(queryPriorityHeader)
+	debug := req.URL.Query().Get("debug") == "true"
+	var (
+		sent         time.Time     // When the query was sent to the shards
+		shardTimings []ShardTiming // protected by mu
+	)
+	// readPartition reads the results of a partition's query, passing each of its rows to merge.
+	readPartition := func(resp *http.Response, merge func(gumshoe.RowMap)) (err error) {
+		defer resp.Body.Close()
+		body := &countingReader{r: resp.Body}
+		if debug {
+			mergeRow := merge
+			rows := 0
+			merge = func(row gumshoe.RowMap) {
+				rows++
+				mergeRow(row)
 			}
-
-			if len(query.Groupings) == 0 {
-				// non-grouping case
-				row := make(gumshoe.RowMap)
-				if err := decoder.Decode(&row); err != nil {
-					return err
+			defer func() {
+				timing := ShardTiming{
+					Shard:      resp.Request.URL.Host,
+					DurationMS: int(time.Since(sent).Seconds() * 1000),
+					Rows:       rows,
+					Bytes:      body.n,
 				}
-				mu.Lock()
-				if len(result) == 0 {
-					result = []gumshoe.RowMap{row}
-				} else {
-					r.mergeRows(result[0], row, query)
+				if err != nil {
+					timing.Error = err.Error()
 				}
+				mu.Lock()
+				shardTimings = append(shardTimings, timing)
 				mu.Unlock()
-				if err := decoder.Decode(&row); err != io.EOF {
-					if err == nil {
-						return errors.New("got multiple results for a non-group-by query")
-					}
-					return err
+			}()
+		}
+
+		var decoder interface {
+			Decode(interface{}) error
+		}
+		if resp.Header.Get("Content-Type") == gumshoe.BinaryStreamContentType {
+			decoder = gob.NewDecoder(body)
+		} else {
+			jsonDecoder := json.NewDecoder(body)
+			jsonDecoder.UseNumber()
+			decoder = jsonDecoder
+		}
+		var m map[string]int
+		if err := decoder.Decode(&m); err != nil {
+			return err
+		}
+
+		if len(query.Groupings) == 0 {
+			// non-grouping case
+			row := make(gumshoe.RowMap)
+			if err := decoder.Decode(&row); err != nil {
+				return err
+			}
+			if err := exactNumbers(row); err != nil {
+				return err
+			}
+			if err := decodeSketches(row, query); err != nil {
+				return err
+			}
+			merge(row)
+			if err := decoder.Decode(&row); err != io.EOF {
+				if err == nil {
+					return errors.New("got multiple results for a non-group-by query")
 				}
-				return nil
+				return err
 			}
+			return nil
+		}
 
-			// grouping case
-			var rowSize int
-			for {
-				row := make(gumshoe.RowMap, rowSize)
-				if err := decoder.Decode(&row); err != nil {
-					if err == io.EOF {
-						break
-					}
-					return err
+		// grouping case
+		var rowSize int
+		for {
+			row := make(gumshoe.RowMap, rowSize)
+			if err := decoder.Decode(&row); err != nil {
+				if err == io.EOF {
+					break
 				}
-				rowSize = len(row)
-				groupByValue := row[groupingCol]
-				if groupingColIntConv && groupByValue != nil {
-					groupByValue = int64(groupByValue.(float64))
+				return err
+			}
+			rowSize = len(row)
+			if err := exactNumbers(row); err != nil {
+				return err
+			}
+			if err := decodeSketches(row, query); err != nil {
+				return err
+			}
+			groupByValue := row[groupingCol]
+			if groupingColIntConv && groupByValue != nil {
+				// Truncate again so that rows land in the same bucket regardless of how each shard
+				// represented the bucket's timestamp.
+				groupByValue = groupingTruncation.TruncateTimestamp(integralValue(groupByValue))
+				row[groupingCol] = groupByValue
+			} else if _, ok := groupByValue.(string); !ok && groupByValue != nil {
+				// Float values may be float32s from a binary stream or float64s from a JSON one.
+				groupByValue = gumshoe.UntypedToFloat64(groupByValue)
+				row[groupingCol] = groupByValue
+			}
+			merge(row)
+		}
+		return nil
+	}
+	// fetchPartition queries one replica of a partition, passing each of its rows to merge.
+	fetchPartition := func(replicas []string, merge func(gumshoe.RowMap)) error {
+		resp, err := r.queryPartition(ctx, queryID, replicas, b, priority, false)
+		if err != nil {
+			return err
+		}
+		return readPartition(resp, merge)
+	}
+	var (
+		failedShards []string // protected by mu
+		numFailed    int      // partitions left out of partial results; protected by mu
+		partitionErr error    // protected by mu
+	)
+	sent = time.Now()
+	// The shard timings are given in the Result of an in-memory merge.
+	if canMergeStreams(query, format, partial) && !debug {
+		// Ask the shards for their rows sorted by the grouping so that they can be merged as they arrive.
+		resps := make([]*http.Response, len(partitions))
+		var openWG wait.Group
+		for i, replicas := range partitions {
+			i, replicas := i, replicas
+			openWG.Go(func(_ <-chan struct{}) error {
+				resp, err := r.queryPartition(ctx, queryID, replicas, b, priority, true)
+				resps[i] = resp
+				return err
+			})
+		}
+		err := openWG.Wait()
+		sorted := err == nil
+		for _, resp := range resps {
+			if resp == nil {
+				continue
+			}
+			if err != nil {
+				resp.Body.Close()
+			} else if resp.Header.Get(sortedStreamHeader) != "true" {
+				sorted = false
+			}
+		}
+		if err != nil {
+			metrics.Inc("router.query.failure")
+			if ctx.Err() == context.DeadlineExceeded {
+				WriteError(w, fmt.Errorf("query timed out after %s", time.Since(start)), http.StatusGatewayTimeout)
+				return
+			}
+			if ctx.Err() == context.Canceled {
+				WriteError(w, errors.New("the query was canceled"), http.StatusConflict)
+				return
+			}
+			WriteError(w, err, http.StatusInternalServerError)
+			return
+		}
+		if sorted {
+			streams := make([]*mergeStream, len(resps))
+			for i, resp := range resps {
+				streams[i] = newMergeStream(ctx, resp, readPartition)
+			}
+			merger := &streamMerger{
+				router:  r,
+				ctx:     ctx,
+				query:   query,
+				format:  format,
+				queryID: queryID,
+				start:   start,
+				streams: streams,
+			}
+			merger.writeResults(w)
+			return
+		}
+		// Some shard doesn't sort its results (it predates sorted streams), so merge them in memory as usual.
+		Log.Printf("[%s] not all shards returned sorted results; merging in memory", queryID)
+		for _, resp := range resps {
+			resp := resp
+			wg.Go(func(_ <-chan struct{}) error {
+				return readPartition(resp, mergeRow)
+			})
+		}
+	} else {
+		for _, replicas := range partitions {
+			replicas := replicas
+			wg.Go(func(_ <-chan struct{}) error {
+				if !partial {
+					return fetchPartition(replicas, mergeRow)
 				}
-				mu.Lock()
-				cur := resultMap[groupByValue]
-				if cur == nil {
-					resultMap[groupByValue] = &lockedRowMap{row: row}
+				// Buffer the partition's rows so that a replica which fails partway through its results doesn't
+				// leave some of them merged.
+				var rows []gumshoe.RowMap
+				if err := fetchPartition(replicas, func(row gumshoe.RowMap) { rows = append(rows, row) }); err != nil {
+					Log.Printf("[%s] leaving shards %s out of the partial results: %s",
+						queryID, strings.Join(replicas, ","), err)
+					mu.Lock()
+					failedShards = append(failedShards, replicas...)
+					numFailed++
+					partitionErr = err
 					mu.Unlock()
-					continue
+					return nil
 				}
-				// downgrade lock
-				cur.mu.Lock()
-				mu.Unlock()
-				r.mergeRows(cur.row, row, query)
-				cur.mu.Unlock()
-			}
-			return nil
-		})
+				for _, row := range rows {
+					mergeRow(row)
+				}
+				return nil
+			})
+		}
 	}
-	if err := wg.Wait(); err != nil {
+	err = wg.Wait()
+	if err == nil && numFailed == len(partitions) {
+		err = partitionErr
+	}
+	if err != nil {
+		metrics.Inc("router.query.failure")
+		if ctx.Err() == context.DeadlineExceeded {
+			WriteError(w, fmt.Errorf("query timed out after %s", time.Since(start)), http.StatusGatewayTimeout)
+			return
+		}
+		if ctx.Err() == context.Canceled {
+			WriteError(w, errors.New("the query was canceled"), http.StatusConflict)
+			return
+		}
 		WriteError(w, err, http.StatusInternalServerError)
 		return
 	}
@@ -253,14 +765,365 @@ func (r *Router) HandleQuery(w http.ResponseWriter, req *http.Request) {
 			result = append(result, lr.row)
 		}
 	}
+	bucket, _ := query.TimeBucketDuration(r.Schema.TimestampColumn.Name, r.Schema.IntervalDuration)
+	for _, row := range result {
+		finishRow(row, query, bucket)
+	}
+	result, err = gumshoe.ApplyTimeFill(result, query, r.Schema.TimestampColumn.Name, bucket)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	gumshoe.ApplyExpressions(result, query)
+	gumshoe.ApplyWindows(result, query, bucket)
+	result = gumshoe.OrderAndLimitRows(gumshoe.ApplyHavingFilters(result, query), query)
 
 	Log.Printf("[%s] fetched and merged query results from %d shards in %s (%d combined rows)",
-		queryID, len(r.Shards), time.Since(start), len(result))
+		queryID, len(partitions)-numFailed, time.Since(start), len(result))
+	var coverage float64
+	if partial {
+		sort.Strings(failedShards)
+		coverage = float64(len(partitions)-numFailed) / float64(len(partitions))
+		w.Header().Set(failedShardsHeader, strings.Join(failedShards, ","))
+		w.Header().Set(coverageHeader, strconv.FormatFloat(coverage, 'f', -1, 64))
+		if numFailed > 0 {
+			metrics.Inc("router.query.partial")
+		}
+	}
+	metrics.Since("router.query", start)
+	if len(query.Groupings) > 0 {
+		metrics.Since("router.query.grouped", start)
+	} else {
+		metrics.Since("router.query.ungrouped", start)
+	}
 
-	WriteJSONResponse(w, Result{
+	if format == "arrow" {
+		w.Header().Set("Content-Type", gumshoe.ArrowStreamContentType)
+		if err := r.Schema.WriteArrowRows(w, result, query); err != nil {
+			Log.Printf("[%s] error writing arrow results: %s", queryID, err)
+		}
+		return
+	}
+	if comma, contentType, ok := gumshoe.DelimitedFormat(format); ok {
+		w.Header().Set("Content-Type", contentType)
+		if err := gumshoe.WriteDelimitedRows(w, result, query.ResultColumns(), comma); err != nil {
+			// The response has already started, so there's no way to report the error to the client.
+			Log.Printf("[%s] error writing %s results: %s", queryID, format, err)
+		}
+		return
+	}
+	response := Result{
 		Results:    result,
 		DurationMS: int(time.Since(start).Seconds() * 1000),
-	})
+	}
+	if stride := query.SampleStride(); stride > 1 {
+		response.SampleRate = 1 / float64(stride)
+	}
+	if partial {
+		response.FailedShards = failedShards
+		response.Coverage = coverage
+	}
+	if debug {
+		sort.Slice(shardTimings, func(i, j int) bool { return shardTimings[i].Shard < shardTimings[j].Shard })
+		response.ShardTimings = shardTimings
+	}
+	WriteJSONResponse(w, response)
+}
+
+// queryPartition sends a shard query (b) to one replica of a partition, trying the next replica if a shard
+// cannot be reached or fails with a server error. Once a replica has begun to respond the query is committed
+// to it, as its results are merged as they stream in. If sorted is true, the shard is asked to sort its rows
+// by the query's grouping. With a HedgeDelay, slow replicas are hedged as well.
+func (r *Router) queryPartition(ctx context.Context, queryID string, replicas []string, b []byte,
+	priority string, sorted bool) (*http.Response, error) {
+	if r.HedgeDelay > 0 && len(replicas) > 1 {
+		return r.hedgedQueryPartition(ctx, queryID, replicas, b, priority, sorted)
+	}
+	var err error
+	for _, shard := range replicas {
+		var resp *http.Response
+		resp, err = r.queryShard(ctx, queryID, shard, b, priority, sorted)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		if he, ok := err.(httpError); ok && he.code < 500 {
+			break
+		}
+		if len(replicas) > 1 {
+			Log.Printf("[%s] query failed on shard %s: %s", queryID, shard, err)
+			metrics.Inc("router.query.failover")
+		}
+	}
+	return nil, err
+}
+
+// queryShard sends a shard query (b) to a single shard, by gRPC if the router uses it and the shard serves
+// it. If the shard responds with a 200, the caller must close the response body.
+func (r *Router) queryShard(ctx context.Context, queryID, shard string, b []byte, priority string,
+	sorted bool) (*http.Response, error) {
+	header := make(http.Header)
+	header.Set(queryIDHeader, queryID)
+	if deadline, ok := ctx.Deadline(); ok {
+		header.Set(queryDeadlineHeader, deadline.UTC().Format(time.RFC3339Nano))
+		header.Set(queryTimeoutHeader, time.Until(deadline).String())
+	}
+	if priority != "" {
+		header.Set(queryPriorityHeader, priority)
+	}
+	setShardStatus(ctx, shard, "running")
+	var resp *http.Response
+	err := errGRPCUnsupported
+	if r.grpcShards.supported(shard) {
+		resp, err = r.queryShardGRPC(ctx, shard, b, header, sorted)
+	}
+	if err == errGRPCUnsupported {
+		resp, err = r.queryShardHTTP(ctx, shard, b, header, sorted)
+	}
+	if err != nil {
+		setShardStatus(ctx, shard, "failed: "+err.Error())
+		return nil, err
+	}
+	setShardStatus(ctx, shard, "streaming")
+	resp.Body = &trackedBody{resp.Body, ctx, shard}
+	// Setting Accept-Encoding ourselves means the transport leaves the body compressed.
+	if resp.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			resp.Body.Close()
+			err = fmt.Errorf("bad gzipped results from shard %s: %s", shard, err)
+			setShardStatus(ctx, shard, "failed: "+err.Error())
+			return nil, err
+		}
+		resp.Body = &gzipReadCloser{gz, resp.Body}
+		resp.Header.Del("Content-Encoding")
+	}
+	return resp, nil
+}
+
+// queryShardHTTP is queryShard by HTTP, with header added to the request.
+func (r *Router) queryShardHTTP(ctx context.Context, shard string, b []byte, header http.Header,
+	sorted bool) (*http.Response, error) {
+	url := r.shardURL(shard, "/query?format=stream")
+	if sorted {
+		url += "&sorted=true"
+	}
+	shardReq, err := http.NewRequest("POST", url, bytes.NewReader(b))
+	if err != nil {
+		panic("could not make http request")
+	}
+	shardReq = shardReq.WithContext(ctx)
+	shardReq.Header = header.Clone()
+	shardReq.Header.Set("Content-Type", "application/json")
+	// Shards which support the binary stream format use it; others fall back to JSON. Likewise, shards with
+	// gzip_query_streams set gzip the results.
+	shardReq.Header.Set("Accept", gumshoe.BinaryStreamContentType)
+	shardReq.Header.Set("Accept-Encoding", "gzip")
+	resp, err := r.Client.Do(shardReq)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != 200 {
+		defer resp.Body.Close()
+		return nil, NewHTTPError(resp, shard)
+	}
+	return resp, nil
+}
+
+// A gzipReadCloser decompresses a response body, closing the body when it is closed.
+type gzipReadCloser struct {
+	*gzip.Reader
+	body io.Closer
+}
+
+func (r *gzipReadCloser) Close() error {
+	r.Reader.Close()
+	return r.body.Close()
+}
+
+// A countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// parseQuery parses the query of a request: the body of a POST, or the q parameter of a GET (which makes
+// query results linkable and cacheable).
+func parseQuery(r *http.Request) (*gumshoe.Query, error) {
+	if r.Method != "GET" {
+		return gumshoe.ParseJSONQuery(r.Body)
+	}
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		return nil, errors.New("a GET query must give the query JSON in the q parameter")
+	}
+	return gumshoe.ParseJSONQuery(strings.NewReader(q))
+}
+
+// HandleExplainQuery responds with each shard's plan for a query, keyed by shard address.
+func (r *Router) HandleExplainQuery(w http.ResponseWriter, req *http.Request) {
+	query, err := parseQuery(req)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	b, err := json.Marshal(query)
+	if err != nil {
+		panic("unexpected marshal error")
+	}
+	var (
+		wg    wait.Group
+		mu    sync.Mutex // protects plans
+		plans = make(map[string]*gumshoe.QueryPlan)
+	)
+	for _, shard := range r.Shards {
+		shard := shard
+		wg.Go(func(_ <-chan struct{}) error {
+			resp, err := r.Client.Post(r.shardURL(shard, "/query/explain"), "application/json", bytes.NewReader(b))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				return NewHTTPError(resp, shard)
+			}
+			plan := new(gumshoe.QueryPlan)
+			if err := json.NewDecoder(resp.Body).Decode(plan); err != nil {
+				return err
+			}
+			mu.Lock()
+			plans[shard] = plan
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	WriteJSONResponse(w, plans)
+}
+
+// makeShardQuery returns a copy of query suitable for sending to the shards. Averages cannot be merged
+// across shards, so each AggregateAvg is replaced by an AggregateSum; the averages are computed from the
+// merged sums and rowCounts by finishRow. Time fills, expressions, windows, having filters, ordering,
+// and limits only make sense for the merged results, so they are applied by the router rather than the
+// shards.
+func makeShardQuery(query *gumshoe.Query) *gumshoe.Query {
+	shardQuery := *query
+	shardQuery.Fill = nil
+	shardQuery.Expressions = nil
+	shardQuery.Windows = nil
+	shardQuery.HavingFilters = nil
+	shardQuery.OrderBy = nil
+	shardQuery.Limit = 0
+	shardQuery.Aggregates = make([]gumshoe.QueryAggregate, len(query.Aggregates))
+	for i, agg := range query.Aggregates {
+		if agg.Type == gumshoe.AggregateAvg || agg.Type == gumshoe.AggregateRate {
+			agg.Type = gumshoe.AggregateSum
+		}
+		shardQuery.Aggregates[i] = agg
+	}
+	return &shardQuery
+}
+
+// finishRow computes the final values of a fully merged row: the merged sum of each of the query's
+// AggregateAvg columns is replaced by the average over the row's merged rowCount (an average over zero rows
+// is null), the merged sum of each AggregateRate column is divided by the time bucket duration, and each
+// merged sketch is replaced by its estimate.
+func finishRow(row gumshoe.RowMap, query *gumshoe.Query, bucket time.Duration) {
+	for _, agg := range query.Aggregates {
+		value, ok := row[agg.Name]
+		if !ok {
+			continue
+		}
+		switch agg.Type {
+		case gumshoe.AggregateAvg:
+			count := gumshoe.UntypedToFloat64(row["rowCount"])
+			if count == 0 {
+				row[agg.Name] = nil
+				continue
+			}
+			row[agg.Name] = gumshoe.UntypedToFloat64(value) / count
+		case gumshoe.AggregateRate:
+			row[agg.Name] = gumshoe.UntypedToFloat64(value) / bucket.Seconds()
+		case gumshoe.AggregateDistinct:
+			row[agg.Name] = value.(*gumshoe.HyperLogLog).Estimate()
+		default:
+			if q, ok := agg.Type.Quantile(); ok {
+				row[agg.Name] = value.(*gumshoe.TDigest).Quantile(q)
+				if math.IsNaN(row[agg.Name].(float64)) {
+					row[agg.Name] = nil
+				}
+			}
+		}
+	}
+}
+
+// exactNumbers replaces the json.Numbers in a row from a shard's JSON stream with float64s, except for
+// integers too large to be exact as float64s (such as large sums of 64-bit columns), which become int64s or
+// uint64s.
+func exactNumbers(row gumshoe.RowMap) error {
+	for name, value := range row {
+		n, ok := value.(json.Number)
+		if !ok {
+			continue
+		}
+		f, err := n.Float64()
+		if err != nil {
+			return err
+		}
+		row[name] = f
+		if math.Abs(f) < maxExactFloat {
+			continue
+		}
+		if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+			row[name] = i
+		} else if u, err := strconv.ParseUint(string(n), 10, 64); err == nil {
+			row[name] = u
+		}
+	}
+	return nil
+}
+
+// maxExactFloat is the magnitude above which float64s can't represent every integer.
+const maxExactFloat = 1 << 53
+
+// decodeSketches replaces the serialized sketches in a row from a shard with their decoded forms so that
+// they may be merged.
+func decodeSketches(row gumshoe.RowMap, query *gumshoe.Query) error {
+	for _, agg := range query.Aggregates {
+		var sketch encoding.TextUnmarshaler
+		if agg.Type == gumshoe.AggregateDistinct {
+			sketch = new(gumshoe.HyperLogLog)
+		} else if _, ok := agg.Type.Quantile(); ok {
+			sketch = new(gumshoe.TDigest)
+		} else {
+			continue
+		}
+		switch row[agg.Name].(type) {
+		case *gumshoe.HyperLogLog, *gumshoe.TDigest:
+			// Already decoded from a binary stream
+			continue
+		}
+		text, ok := row[agg.Name].(string)
+		if !ok {
+			return fmt.Errorf("expected a serialized sketch for aggregate %q; got %v", agg.Name, row[agg.Name])
+		}
+		if err := sketch.UnmarshalText([]byte(text)); err != nil {
+			return err
+		}
+		row[agg.Name] = sketch
+	}
+	return nil
 }
 
 type lockedRowMap struct {
@@ -294,9 +1157,23 @@ func (r *Router) convertColumnToIntegral(name string) bool {
 // mergeRows merges row2 into row1.
 func (r *Router) mergeRows(row1, row2 gumshoe.RowMap, q *gumshoe.Query) {
 	for _, agg := range q.Aggregates {
+		switch sketch := row1[agg.Name].(type) {
+		case *gumshoe.HyperLogLog:
+			sketch.Merge(row2[agg.Name].(*gumshoe.HyperLogLog))
+			continue
+		case *gumshoe.TDigest:
+			sketch.Merge(row2[agg.Name].(*gumshoe.TDigest))
+			continue
+		}
 		row1[agg.Name] = r.sumColumn(row1, row2, agg.Name, r.typeForCol(agg.Column))
 	}
 	row1["rowCount"] = r.sumColumn(row1, row2, "rowCount", gumshoe.TypeInt64)
+	// Lookups are done by the shards. They should agree, but prefer any label to a missing one.
+	for _, lookup := range q.Lookups {
+		if row1[lookup.Name] == nil {
+			row1[lookup.Name] = row2[lookup.Name]
+		}
+	}
 }
 
 func (r *Router) typeForCol(col string) gumshoe.Type {
@@ -309,33 +1186,112 @@ func (r *Router) typeForCol(col string) gumshoe.Type {
 	panic("bad column in sumColumn: " + col)
 }
 
-// sumColumn figures out the appropriate types and sums the column from row1 and row2 using either int64s or
-// float64s.
+// sumColumn figures out the appropriate types and sums the column from row1 and row2 using int64s, uint64s
+// (for unsigned columns), or float64s.
 func (r *Router) sumColumn(row1, row2 gumshoe.RowMap, col string, typ gumshoe.Type) interface{} {
-	// NOTE(caleb): this function is pretty gross because of the JSON interface here. This should get cleaned up
-	// when we do a general JSON purge of gumshoeDB.
+	// Values from a JSON stream are float64s; values from a binary stream have their original types.
 	val1, ok := row1[col]
 	if !ok {
 		val1 = float64(0)
 	}
-	val2, ok := row2[col]
-	if !ok {
-		val2 = float64(0)
+	val2, ok := row2[col]
+	if !ok {
+		val2 = float64(0)
+	}
+
+	switch typ {
+	case gumshoe.TypeUint8, gumshoe.TypeUint16, gumshoe.TypeUint32, gumshoe.TypeUint64:
+		return unsignedValue(val1) + unsignedValue(val2)
+	case gumshoe.TypeInt8, gumshoe.TypeInt16, gumshoe.TypeInt32, gumshoe.TypeInt64:
+		return integralValue(val1) + integralValue(val2)
+	case gumshoe.TypeFloat32, gumshoe.TypeFloat64:
+		return gumshoe.UntypedToFloat64(val1) + gumshoe.UntypedToFloat64(val2)
+	}
+	panic("unexpected type")
+}
+
+// integralValue converts an integral value from a shard to an int64.
+func integralValue(v interface{}) int64 {
+	switch v := v.(type) {
+	case float64:
+		return int64(v)
+	case int64:
+		return v
+	case uint64:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	}
+	return int64(gumshoe.UntypedToInt(v))
+}
+
+// unsignedValue converts an integral value of an unsigned column from a shard to a uint64.
+func unsignedValue(v interface{}) uint64 {
+	switch v := v.(type) {
+	case float64:
+		return uint64(v)
+	case uint64:
+		return v
+	case int64:
+		return uint64(v)
+	case uint32:
+		return uint64(v)
+	}
+	return uint64(gumshoe.UntypedToInt(v))
+}
+
+// HandleDimensionTables responds with the union of every shard's dimension tables: for each string
+// dimension, the sorted values found on any shard.
+func (r *Router) HandleDimensionTables(w http.ResponseWriter, req *http.Request) {
+	var wg wait.Group
+	dimValues := make(map[string]map[string]struct{})
+	var mu sync.Mutex
+	for i := range r.Shards {
+		i := i
+		wg.Go(func(_ <-chan struct{}) error {
+			shard := r.Shards[i]
+			resp, err := r.Client.Get(r.shardURL(shard, "/dimension_tables"))
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				return NewHTTPError(resp, shard)
+			}
+			var result map[string][]string
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				return err
+			}
+			mu.Lock()
+			for name, values := range result {
+				set, ok := dimValues[name]
+				if !ok {
+					set = make(map[string]struct{})
+					dimValues[name] = set
+				}
+				for _, s := range values {
+					set[s] = struct{}{}
+				}
+			}
+			mu.Unlock()
+			return nil
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
 	}
 
-	switch typ {
-	case gumshoe.TypeUint8, gumshoe.TypeInt8, gumshoe.TypeUint16, gumshoe.TypeInt16,
-		gumshoe.TypeUint32, gumshoe.TypeInt32, gumshoe.TypeUint64, gumshoe.TypeInt64:
-		switch v1 := val1.(type) {
-		case int64:
-			return v1 + int64(val2.(float64))
-		case float64:
-			return int64(v1) + int64(val2.(float64))
+	results := make(map[string][]string)
+	for name, set := range dimValues {
+		values := []string{}
+		for s := range set {
+			values = append(values, s)
 		}
-	case gumshoe.TypeFloat32, gumshoe.TypeFloat64:
-		return val1.(float64) + val2.(float64)
+		sort.Strings(values)
+		results[name] = values
 	}
-	panic("unexpected type")
+	WriteJSONResponse(w, results)
 }
 
 func (r *Router) HandleSingleDimension(w http.ResponseWriter, req *http.Request) {
@@ -344,7 +1300,16 @@ func (r *Router) HandleSingleDimension(w http.ResponseWriter, req *http.Request)
 		http.Error(w, "must provide dimension name", http.StatusBadRequest)
 		return
 	}
+	results, err := r.dimensionValues(name)
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	WriteJSONResponse(w, results)
+}
 
+// dimensionValues returns the sorted values of the dimension name from all the shards' dimension tables.
+func (r *Router) dimensionValues(name string) ([]string, error) {
 	var wg wait.Group
 	dimValues := make(map[string]struct{})
 	var mu sync.Mutex
@@ -352,7 +1317,7 @@ func (r *Router) HandleSingleDimension(w http.ResponseWriter, req *http.Request)
 		i := i
 		wg.Go(func(_ <-chan struct{}) error {
 			shard := r.Shards[i]
-			resp, err := r.Client.Get("http://" + shard + "/dimension_tables/" + name)
+			resp, err := r.Client.Get(r.shardURL(shard, "/dimension_tables/"+name))
 			if err != nil {
 				return err
 			}
@@ -373,8 +1338,7 @@ func (r *Router) HandleSingleDimension(w http.ResponseWriter, req *http.Request)
 		})
 	}
 	if err := wg.Wait(); err != nil {
-		WriteError(w, err, http.StatusInternalServerError)
-		return
+		return nil, err
 	}
 
 	var results []string
@@ -382,7 +1346,119 @@ func (r *Router) HandleSingleDimension(w http.ResponseWriter, req *http.Request)
 		results = append(results, s)
 	}
 	sort.Strings(results)
-	WriteJSONResponse(w, results)
+	return results, nil
+}
+
+// debugRow is a row from a shard's /debug/rows tagged with the shard it came from. A shard which could not
+// be read is listed with an Error instead.
+type debugRow struct {
+	Shard  string
+	RowMap json.RawMessage `json:",omitempty"`
+	Count  int             `json:",omitempty"`
+	Error  string          `json:",omitempty"`
+}
+
+// defaultDebugRowLimit is the number of rows returned by /debug/rows without a limit parameter.
+const defaultDebugRowLimit = 100
+
+// HandleDebugQueries responds with the queries which are running, oldest first, along with the status of
+// each shard they've been sent to.
+func (r *Router) HandleDebugQueries(w http.ResponseWriter, req *http.Request) {
+	WriteJSONResponse(w, r.queries.list())
+}
+
+// HandleCancelQuery cancels the running queries with the given ID (as listed on /debug/queries), which also
+// cancels their requests to the shards.
+func (r *Router) HandleCancelQuery(w http.ResponseWriter, req *http.Request) {
+	id := req.URL.Query().Get(":id")
+	n := r.queries.cancel(id)
+	if n == 0 {
+		WriteError(w, fmt.Errorf("no query with ID %q is running", id), http.StatusNotFound)
+		return
+	}
+	Log.Printf("[%s] canceled %d running query(s)", id, n)
+	WriteJSONResponse(w, map[string]int{"canceled": n})
+}
+
+// HandleDebugRows responds with the rows from every shard's /debug/rows, each tagged with its shard. The JSON
+// array is streamed as the shards respond and holds at most limit (a query parameter) rows, in addition to an
+// entry for each shard which failed.
+func (r *Router) HandleDebugRows(w http.ResponseWriter, req *http.Request) {
+	limit := defaultDebugRowLimit
+	if s := req.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 {
+			WriteError(w, fmt.Errorf("invalid limit %q", s), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	flusher, _ := w.(http.Flusher)
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex // protects w, written, numRows
+		written bool
+		numRows int
+	)
+	io.WriteString(w, "[")
+	for _, shard := range r.Shards {
+		shard := shard
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rows, err := r.fetchDebugRows(shard)
+			if err != nil {
+				Log.Print(err)
+				rows = []debugRow{{Shard: shard, Error: err.Error()}}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, row := range rows {
+				if row.Error == "" {
+					if numRows == limit {
+						break
+					}
+					numRows++
+				}
+				b, err := json.Marshal(row)
+				if err != nil {
+					panic("unexpected marshal error")
+				}
+				if written {
+					io.WriteString(w, ",")
+				}
+				written = true
+				w.Write(b)
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}()
+	}
+	wg.Wait()
+	io.WriteString(w, "]\n")
+}
+
+// fetchDebugRows reads a shard's /debug/rows.
+func (r *Router) fetchDebugRows(shard string) ([]debugRow, error) {
+	resp, err := r.Client.Get(r.shardURL(shard, "/debug/rows"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, NewHTTPError(resp, shard)
+	}
+	var rows []debugRow
+	if err := json.NewDecoder(resp.Body).Decode(&rows); err != nil {
+		return nil, err
+	}
+	for i := range rows {
+		rows[i].Shard = shard
+	}
+	return rows, nil
 }
 
 type Statusz struct {
@@ -394,7 +1470,7 @@ func (r *Router) HandleStatusz(w http.ResponseWriter, req *http.Request) {
 	var status Statusz
 	var failed []string
 	for _, shard := range r.Shards {
-		resp, err := r.Client.Get("http://" + shard + "/statusz")
+		resp, err := r.Client.Get(r.shardURL(shard, "/statusz"))
 		if err != nil {
 			failed = append(failed, shard)
 			continue
@@ -426,6 +1502,210 @@ func (r *Router) HandleStatusz(w http.ResponseWriter, req *http.Request) {
 	WriteJSONResponse(w, status)
 }
 
+// schemaCheck is the result of comparing a shard's schema with the router's.
+type schemaCheck struct {
+	Shard       string   `json:"shard"`
+	Differences []string `json:"differences,omitempty"`
+	Error       string   `json:"error,omitempty"` // If the shard's schema couldn't be fetched
+}
+
+// HandleSchemaCheck fetches every shard's schema and reports the shards whose columns, types, or interval
+// duration differ from the router's (whose query results can't be merged correctly), along with any shards
+// which couldn't be checked. The response is 200 even if some shards differ; see consistent.
+func (r *Router) HandleSchemaCheck(w http.ResponseWriter, req *http.Request) {
+	checks := make([]schemaCheck, len(r.Shards))
+	var wg sync.WaitGroup
+	for i, shard := range r.Shards {
+		i, shard := i, shard
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checks[i].Shard = shard
+			schema, err := r.fetchSchema(shard)
+			if err != nil {
+				checks[i].Error = err.Error()
+				return
+			}
+			checks[i].Differences = r.Schema.Differences(schema)
+		}()
+	}
+	wg.Wait()
+
+	result := struct {
+		Consistent bool          `json:"consistent"`
+		Shards     []schemaCheck `json:"shards"` // The shards which differ or couldn't be checked
+	}{Consistent: true, Shards: []schemaCheck{}}
+	for _, check := range checks {
+		if check.Error != "" || len(check.Differences) > 0 {
+			result.Consistent = false
+			result.Shards = append(result.Shards, check)
+		}
+	}
+	if !result.Consistent {
+		metrics.Inc("router.schema-check.inconsistent")
+	}
+	WriteJSONResponse(w, result)
+}
+
+func (r *Router) fetchSchema(shard string) (*gumshoe.Schema, error) {
+	resp, err := r.Client.Get(r.shardURL(shard, "/schema"))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return nil, NewHTTPError(resp, shard)
+	}
+	var schema gumshoe.Schema
+	if err := json.NewDecoder(resp.Body).Decode(&schema); err != nil {
+		return nil, err
+	}
+	return &schema, nil
+}
+
+// HandlePutLookupTable registers a lookup table with every shard.
+func (r *Router) HandlePutLookupTable(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get(":name")
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	var values map[string]string
+	if err := json.Unmarshal(b, &values); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	var wg wait.Group
+	for _, shard := range r.Shards {
+		shard := shard
+		wg.Go(func(_ <-chan struct{}) error {
+			shardReq, err := http.NewRequest("PUT", r.shardURL(shard, "/lookup_tables/"+name), bytes.NewReader(b))
+			if err != nil {
+				panic("could not make http request")
+			}
+			shardReq.Header.Set("Content-Type", "application/json")
+			resp, err := r.Client.Do(shardReq)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				return NewHTTPError(resp, shard)
+			}
+			return nil
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+	}
+}
+
+// HandleSetRetention sends the change of retention period to every shard.
+func (r *Router) HandleSetRetention(w http.ResponseWriter, req *http.Request) {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	var wg wait.Group
+	for _, shard := range r.Shards {
+		shard := shard
+		wg.Go(func(_ <-chan struct{}) error {
+			shardReq, err := http.NewRequest("PUT", r.shardURL(shard, "/admin/retention"), bytes.NewReader(b))
+			if err != nil {
+				panic("could not make http request")
+			}
+			shardReq.Header.Set("Content-Type", "application/json")
+			resp, err := r.Client.Do(shardReq)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				return NewHTTPError(resp, shard)
+			}
+			return nil
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+	}
+}
+
+// HandleDeleteRows sends the delete request to every shard and responds with the total number of rows
+// deleted. The replicas of a partition delete the same rows, so only the first replica's count is added.
+func (r *Router) HandleDeleteRows(w http.ResponseWriter, req *http.Request) {
+	b, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	var mu sync.Mutex
+	total := 0
+	counted := make(map[string]bool)
+	for _, partition := range r.partitions() {
+		counted[partition[0]] = true
+	}
+	var wg wait.Group
+	for _, shard := range r.Shards {
+		shard := shard
+		wg.Go(func(_ <-chan struct{}) error {
+			shardReq, err := http.NewRequest("DELETE", r.shardURL(shard, "/rows"), bytes.NewReader(b))
+			if err != nil {
+				panic("could not make http request")
+			}
+			shardReq.Header.Set("Content-Type", "application/json")
+			resp, err := r.Client.Do(shardReq)
+			if err != nil {
+				return err
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != 200 {
+				return NewHTTPError(resp, shard)
+			}
+			var result struct{ Deleted int }
+			if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+				return err
+			}
+			if counted[shard] {
+				mu.Lock()
+				total += result.Deleted
+				mu.Unlock()
+			}
+			return nil
+		})
+	}
+	if err := wg.Wait(); err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	WriteJSONResponse(w, map[string]int{"deleted": total})
+}
+
+// HandleGetLookupTable responds with the contents of a lookup table. The shards all have the same lookup
+// tables, so it asks the first one.
+func (r *Router) HandleGetLookupTable(w http.ResponseWriter, req *http.Request) {
+	name := req.URL.Query().Get(":name")
+	shard := r.Shards[0]
+	resp, err := r.Client.Get(r.shardURL(shard, "/lookup_tables/"+name))
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		WriteError(w, NewHTTPError(resp, shard), http.StatusInternalServerError)
+		return
+	}
+	var values map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&values); err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	WriteJSONResponse(w, values)
+}
+
 func (r *Router) HandleUnimplemented(w http.ResponseWriter, req *http.Request) {
 	http.Error(w, "this route is not implemented in gumshoe router", http.StatusInternalServerError)
 }
@@ -448,8 +1728,9 @@ func WriteJSONResponse(w http.ResponseWriter, objectToSerialize interface{}) {
 }
 
 type httpError struct {
-	msg  string
-	code int
+	msg        string
+	code       int
+	retryAfter string // From a shard's 429 or 503 response
 }
 
 func (e httpError) Error() string {
@@ -465,13 +1746,16 @@ func NewHTTPError(resp *http.Response, shard string) error {
 		}
 		msg += "\n" + string(body)
 	}
-	return httpError{msg, resp.StatusCode}
+	return httpError{msg, resp.StatusCode, resp.Header.Get("Retry-After")}
 }
 
 func WriteError(w http.ResponseWriter, err error, status int) {
 	// a code from an httpError overrides status
 	if he, ok := err.(httpError); ok {
 		status = he.code
+		if he.retryAfter != "" {
+			w.Header().Set("Retry-After", he.retryAfter)
+		}
 	}
 	Log.Print(err)
 	http.Error(w, err.Error(), status)
@@ -492,55 +1776,310 @@ func writeInvalidColumnError(w http.ResponseWriter, name string) {
 	WriteError(w, fmt.Errorf("%q is not a valid column name", name), http.StatusBadRequest)
 }
 
-func NewRouter(shards []string, schema *gumshoe.Schema) *Router {
-	transport := &http.Transport{MaxIdleConnsPerHost: 8}
+// NewRouter returns a Router for the DB described by schema on shards, along with Routers for the tables
+// listed in conf, which are served under /tables/{name}/. A table's shards are given by tableShards; tables
+// missing from it are on the same shards as the main DB.
+func NewRouter(shards []string, replication int, schema *gumshoe.Schema, conf *config.Config,
+	tableShards map[string][]string) (*Router, error) {
+	tlsConfig, err := conf.ShardTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := conf.APIKeyRoles()
+	if err != nil {
+		return nil, err
+	}
+	var transport http.RoundTripper = &http.Transport{MaxIdleConnsPerHost: 8, TLSClientConfig: tlsConfig}
+	if conf.ShardGRPC {
+		transport = newGRPCTransport(transport, tlsConfig)
+	}
+	transport = shardMetricsTransport{transport}
+	if conf.ShardAPIKey != "" {
+		transport = auth.NewTransport(transport, conf.APIKeyHeader, conf.ShardAPIKey)
+	}
 	r := &Router{
-		Schema: schema,
-		Shards: shards,
-		Client: &http.Client{Transport: transport},
+		Schema:       schema,
+		Shards:       shards,
+		Client:       &http.Client{Transport: transport},
+		QueryTimeout: conf.QueryTimeout.Duration,
+		GzipInserts:  conf.GzipShardInserts,
+		Replication:  replication,
+		Sharding:     shardByHash,
+		ShardScheme:  "http",
+		queries:      newQueryTracker(),
+	}
+	if tlsConfig != nil {
+		r.ShardScheme = "https"
+	}
+	if conf.ShardGRPC {
+		r.grpcShards = newGRPCShards()
+	}
+	if r.RemoteWriteRules, err = conf.RemoteWriteRules(schema); err != nil {
+		return nil, err
+	}
+	if r.InfluxRules, err = conf.InfluxRules(schema); err != nil {
+		return nil, err
+	}
+	r.Handler = r.routes(conf)
+
+	tables, err := conf.LoadTables()
+	if err != nil {
+		return nil, err
+	}
+	r.Tables = make(map[string]*Router)
+	for _, table := range tables {
+		table.Schema.Initialize()
+		t := *r
+		t.Schema = table.Schema
+		t.ShardPathPrefix = "/tables/" + table.Name
+		t.Tables = nil
+		if s, ok := tableShards[table.Name]; ok {
+			t.Shards = s
+		}
+		if t.RemoteWriteRules, err = table.Config.RemoteWriteRules(table.Schema); err != nil {
+			return nil, err
+		}
+		if t.InfluxRules, err = table.Config.InfluxRules(table.Schema); err != nil {
+			return nil, err
+		}
+		if len(t.Shards)%replication != 0 {
+			return nil, fmt.Errorf("the number of shards of table %q (%d) must be a multiple of the replication "+
+				"factor (%d)", table.Name, len(t.Shards), replication)
+		}
+		t.Handler = t.routes(conf)
+		r.Tables[table.Name] = &t
 	}
+	for name := range tableShards {
+		if _, ok := r.Tables[name]; !ok {
+			return nil, fmt.Errorf("shards were given for %q, which is not a table", name)
+		}
+	}
+
+	handler := r.tablesHandler(r.Handler)
+	handler = auth.NewHandler(handler, conf.APIKeyHeader, keys, conf.AnonymousStatusz)
+	r.Handler = apachelog.NewDefaultHandler(metrics.NewHandler(handler))
+	return r, nil
+}
 
+// compressed gzips the responses of h for clients which accept gzip.
+func compressed(h http.HandlerFunc) http.HandlerFunc {
+	return gzipbody.NewResponseHandler(h).ServeHTTP
+}
+
+// routes returns the handler for r's routes.
+func (r *Router) routes(conf *config.Config) http.Handler {
 	mux := pat.New()
 
 	mux.Put("/insert", r.HandleInsert)
-	mux.Get("/dimension_tables/{name}", r.HandleSingleDimension)
-	mux.Get("/dimension_tables", r.HandleUnimplemented)
-	mux.Post("/query", r.HandleQuery)
+	mux.Add("POST", "/prometheus/write", remotewrite.NewHandler(r.Schema, r.RemoteWriteRules,
+		http.HandlerFunc(r.HandleInsert)))
+	mux.Add("POST", "/write", remotewrite.NewInfluxHandler(r.Schema, r.InfluxRules,
+		http.HandlerFunc(r.HandleInsert)))
+	mux.Get("/dimension_tables/{name}", compressed(r.HandleSingleDimension))
+	mux.Get("/dimension_tables", compressed(r.HandleDimensionTables))
+	mux.Delete("/rows", r.HandleDeleteRows)
+	mux.Put("/lookup_tables/{name}", r.HandlePutLookupTable)
+	mux.Put("/admin/retention", r.HandleSetRetention)
+	mux.Get("/admin/schema-check", r.HandleSchemaCheck)
+	mux.Get("/lookup_tables/{name}", r.HandleGetLookupTable)
+	mux.Get("/query/explain", r.HandleExplainQuery)
+	mux.Post("/query/explain", r.HandleExplainQuery)
+	mux.Get("/query", compressed(r.HandleQuery))
+	mux.Post("/query", compressed(r.HandleQuery))
+
+	grafanaHandler := grafana.NewHandler(&grafana.Source{
+		Schema:          r.Schema,
+		QueryHandler:    http.HandlerFunc(r.HandleQuery),
+		DimensionValues: r.dimensionValues,
+	})
+	mux.Add("GET", "/grafana/", grafanaHandler)
+	mux.Add("POST", "/grafana/", grafanaHandler)
 
 	mux.Get("/metricz", r.HandleUnimplemented)
-	mux.Get("/debug/rows", r.HandleUnimplemented)
+	mux.Add("GET", "/metrics", metrics.Handler())
+	mux.Get("/debug/rows", r.HandleDebugRows)
+	mux.Get("/debug/queries", r.HandleDebugQueries)
+	mux.Post("/admin/queries/{id}/cancel", r.HandleCancelQuery)
 	mux.Get("/statusz", r.HandleStatusz)
+	mux.Get("/healthz", r.HandleHealthz)
+	mux.Get("/readyz", r.HandleReadyz)
 	mux.Get("/", r.HandleRoot)
 
-	r.Handler = apachelog.NewDefaultHandler(mux)
-	return r
+	return gzipbody.NewHandler(mux, int64(conf.MaxDecompressedBodySize.Bytes))
+}
+
+// tablesHandler serves GET /tables (the sorted list of table names) and passes requests under
+// /tables/{name}/ on to the table's Router, with the prefix removed. Other requests go to h.
+func (r *Router) tablesHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/tables" && req.Method == "GET" {
+			names := []string{}
+			for name := range r.Tables {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			WriteJSONResponse(w, names)
+			return
+		}
+		if !strings.HasPrefix(req.URL.Path, "/tables/") {
+			h.ServeHTTP(w, req)
+			return
+		}
+		name := strings.SplitN(req.URL.Path[len("/tables/"):], "/", 2)[0]
+		table, ok := r.Tables[name]
+		if !ok {
+			WriteError(w, fmt.Errorf("no such table: %q", name), http.StatusNotFound)
+			return
+		}
+		http.StripPrefix("/tables/"+name, table).ServeHTTP(w, req)
+	})
+}
+
+// tableShardsFlag is a repeatable flag giving the shards of a table, as name=host1:port,host2:port.
+type tableShardsFlag map[string][]string
+
+func (f tableShardsFlag) String() string { return fmt.Sprint(map[string][]string(f)) }
+
+func (f tableShardsFlag) Set(s string) error {
+	parts := strings.SplitN(s, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("%q is not of the form name=host1:port,host2:port", s)
+	}
+	f[parts[0]] = strings.Split(parts[1], ",")
+	return nil
 }
 
 func main() {
 	configFile := flag.String("config", "config.toml", "path to a DB config (to get the schema)")
 	shardsFlag := flag.String("shards", "", "comma-separated list of shard addresses (with ports)")
+	replication := flag.Int("replication", 1,
+		"number of shards to which each row is written (each run of this many consecutive shards is a replica set)")
+	hedgeDelay := flag.Duration("hedge-delay", 0,
+		"with replication, how long to wait for a shard's query results before also querying the next replica "+
+			"(0 to never hedge)")
+	sharding := flag.String("sharding", shardByHash,
+		`how rows are assigned to shards: "hash" (by their dimensions) or "time" (by their intervals)`)
+	insertBufferRows := flag.Int("insert-buffer-rows", 0,
+		"buffer inserted rows, sending them to each shard in batches of up to this many (0 for no buffering)")
+	insertBufferAge := flag.Duration("insert-buffer-age", time.Second,
+		"with -insert-buffer-rows, the longest a row waits in the buffer")
+	insertDurability := flag.String("insert-durability", durabilityFlushed,
+		`with -insert-buffer-rows, when an insert is acknowledged: once its rows are "buffered" or once they are `+
+			`"flushed" to the shards`)
+	readyShards := flag.Int("ready-shards", 0,
+		"number of shards which must be ready for /readyz to succeed (0 to require one replica of each partition)")
 	port := flag.Int("port", 9090, "port on which to listen")
+	debugAddr := flag.String("debug-addr", "",
+		"if non-empty, address on which to serve the debugging endpoints (pprof, expvar, and goroutine dumps)")
+	queryRate := flag.Float64("query-rate-limit", 0,
+		"queries per second allowed from each client (0 for no limit)")
+	globalQueryRate := flag.Float64("global-query-rate-limit", 0,
+		"queries per second allowed from all clients together (0 for no limit)")
+	insertRate := flag.Float64("insert-rate-limit", 0,
+		"inserts per second allowed from each client (0 for no limit)")
+	globalInsertRate := flag.Float64("global-insert-rate-limit", 0,
+		"inserts per second allowed from all clients together (0 for no limit)")
+	maxShardRequests := flag.Int("max-shard-requests", 0,
+		"maximum requests in flight to all the shards together (0 for no limit)")
+	maxRequestsPerShard := flag.Int("max-requests-per-shard", 0,
+		"maximum requests in flight to each shard (0 for no limit)")
+	configOverrides := config.EnvOverrides()
+	flag.Var(configOverrides, "set", "override a config value, as name=value (repeatable; see also "+
+		config.EnvPrefix+"* environment variables)")
+	tableShards := make(tableShardsFlag)
+	flag.Var(tableShards, "table-shards",
+		"shards of a table, as name=host1:port,host2:port (repeatable; by default, a table is on -shards)")
 	flag.Parse()
 	shardAddrs := strings.Split(*shardsFlag, ",")
 	if *shardsFlag == "" || len(shardAddrs) == 0 {
 		Log.Fatal("At least one shard required")
 	}
-	f, err := os.Open(*configFile)
-	if err != nil {
-		Log.Fatal(err)
+	if *sharding != shardByHash && *sharding != shardByTime {
+		Log.Fatalf("Unknown sharding strategy %q", *sharding)
+	}
+	if *insertDurability != durabilityBuffered && *insertDurability != durabilityFlushed {
+		Log.Fatalf("Unknown insert durability %q", *insertDurability)
 	}
-	defer f.Close()
-	_, schema, err := config.LoadTOMLConfig(f)
+	if *replication < 1 || len(shardAddrs)%*replication != 0 {
+		Log.Fatalf("The number of shards (%d) must be a multiple of the replication factor (%d)",
+			len(shardAddrs), *replication)
+	}
+	conf, schema, err := config.LoadConfig(*configFile, configOverrides)
 	if err != nil {
 		Log.Fatal(err)
 	}
 	schema.Initialize()
+	if err := metrics.Init(conf.StatsdAddr); err != nil {
+		Log.Fatal(err)
+	}
+	if *debugAddr != "" {
+		go func() {
+			Log.Println("Debugging endpoints listening on", *debugAddr)
+			Log.Fatal(debug.ListenAndServe(*debugAddr))
+		}()
+	}
 
-	r := NewRouter(shardAddrs, schema)
+	r, err := NewRouter(shardAddrs, *replication, schema, conf, tableShards)
+	if err != nil {
+		Log.Fatal(err)
+	}
+	// Clients are told apart by their API keys (or IP addresses). The limits cover all the tables together.
+	r.QueryLimiter = newRateLimiter("query", *queryRate, *globalQueryRate, conf.APIKeyHeader)
+	r.InsertLimiter = newRateLimiter("insert", *insertRate, *globalInsertRate, conf.APIKeyHeader)
+	r.HedgeDelay = *hedgeDelay
+	r.ReadyShards = *readyShards
+	r.Sharding = *sharding
+	// Rollups would merge a shard's intervals into longer ones, which intervalPartition doesn't know about.
+	if r.Sharding == shardByTime && len(r.Schema.Rollups) > 0 {
+		Log.Fatal("Time-based sharding cannot be used with rollups")
+	}
+	for name, t := range r.Tables {
+		t.QueryLimiter = r.QueryLimiter
+		t.InsertLimiter = r.InsertLimiter
+		t.HedgeDelay = r.HedgeDelay
+		t.ReadyShards = r.ReadyShards
+		t.Sharding = r.Sharding
+		if t.Sharding == shardByTime && len(t.Schema.Rollups) > 0 {
+			Log.Fatalf("Time-based sharding cannot be used with rollups (in table %q)", name)
+		}
+	}
+	if *insertBufferRows > 0 {
+		routers := []*Router{r}
+		for _, t := range r.Tables {
+			routers = append(routers, t)
+		}
+		var buffers []*insertBuffer
+		for _, t := range routers {
+			t.InsertBuffer = newInsertBuffer(t, *insertBufferRows, *insertBufferAge, *insertDurability)
+			buffers = append(buffers, t.InsertBuffer)
+		}
+		// Buffered rows are flushed before shutting down.
+		go func() {
+			c := make(chan os.Signal, 1)
+			signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+			<-c
+			Log.Println("Flushing buffered inserts before shutting down")
+			for _, buffer := range buffers {
+				buffer.flushAll()
+			}
+			os.Exit(0)
+		}()
+	}
+	// The tables share r.Client, so this bounds the requests of all the tables together.
+	r.Client.Transport = newFanoutTransport(r.Client.Transport, *maxShardRequests, *maxRequestsPerShard)
+	tlsConfig, err := conf.ServerTLSConfig()
+	if err != nil {
+		Log.Fatal(err)
+	}
 	addr := fmt.Sprintf(":%d", *port)
 	server := &http.Server{
-		Addr:    addr,
-		Handler: r,
+		Addr:      addr,
+		Handler:   r,
+		TLSConfig: tlsConfig,
+	}
+	if tlsConfig != nil {
+		Log.Println("Now serving HTTPS on", addr)
+		Log.Fatal(server.ListenAndServeTLS("", ""))
 	}
 	Log.Println("Now serving on", addr)
 	Log.Fatal(server.ListenAndServe())
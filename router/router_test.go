@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+// testSchema returns the schema of the test shards: a string dimension column dim1 and a metric column
+// metric1.
+func testSchema() *gumshoe.Schema {
+	at, _ := gumshoe.MakeMetricColumn("at", "uint32")
+	dim1, _ := gumshoe.MakeDimensionColumn("dim1", "uint32", true)
+	metric1, _ := gumshoe.MakeMetricColumn("metric1", "uint32")
+	schema := &gumshoe.Schema{
+		TimestampColumn:  gumshoe.Column(at),
+		DimensionColumns: []gumshoe.DimensionColumn{dim1},
+		MetricColumns:    []gumshoe.MetricColumn{metric1},
+		SegmentSize:      1 << 10,
+		IntervalDuration: time.Hour,
+	}
+	schema.Initialize()
+	return schema
+}
+
+// newTestRouter returns a Router in front of shards (test servers), which are grouped into partitions of
+// replication shards.
+func newTestRouter(replication int, shards ...*httptest.Server) *Router {
+	r := &Router{
+		Schema:      testSchema(),
+		Client:      new(http.Client),
+		Replication: replication,
+		Sharding:    shardByHash,
+		ShardScheme: "http",
+		queries:     newQueryTracker(),
+	}
+	for _, shard := range shards {
+		r.Shards = append(r.Shards, strings.TrimPrefix(shard.URL, "http://"))
+	}
+	return r
+}
+
+// newQueryShard returns a test shard which waits for delay and then answers every query with rows, in the
+// JSON stream format (and sorted, if the router asks; the rows must be sorted by the query's grouping).
+func newQueryShard(delay time.Duration, rows ...gumshoe.RowMap) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ioutil.ReadAll(req.Body)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return
+		}
+		if req.URL.Query().Get("sorted") == "true" {
+			w.Header().Set(sortedStreamHeader, "true")
+		}
+		encoder := json.NewEncoder(w)
+		encoder.Encode(map[string]int{})
+		for _, row := range rows {
+			encoder.Encode(row)
+		}
+	}))
+}
+
+// runTestQuery sends query (as JSON) to r, with the URL parameters params, and returns the response.
+func runTestQuery(r *Router, query, params string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r.HandleQuery(w, httptest.NewRequest("POST", "/query?"+params, strings.NewReader(query)))
+	return w
+}
+
+// decodeResult decodes the Result of a successful query.
+func decodeResult(t *testing.T, w *httptest.ResponseRecorder) *Result {
+	t.Helper()
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var result Result
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return &result
+}
+
+func TestDeletedRowsAreCountedOncePerPartition(t *testing.T) {
+	var requests int32
+	var shards []*httptest.Server
+	for i := 0; i < 4; i++ {
+		shard := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.Write([]byte(`{"Deleted": 3}`))
+		}))
+		defer shard.Close()
+		shards = append(shards, shard)
+	}
+	r := newTestRouter(2, shards...)
+
+	w := httptest.NewRecorder()
+	r.HandleDeleteRows(w, httptest.NewRequest("DELETE", "/rows", strings.NewReader(`{"Start": 0, "End": 10}`)))
+	if w.Code != 200 {
+		t.Fatalf("got status %d: %s", w.Code, w.Body)
+	}
+	var result map[string]int
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	// Every replica deletes the rows, but each partition's rows are only counted once.
+	if requests != 4 {
+		t.Errorf("got %d shard requests; want 4", requests)
+	}
+	if result["deleted"] != 6 {
+		t.Errorf("got %d deleted rows; want 6", result["deleted"])
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+// A shardMetricsTransport times the router's requests to each shard (as router.shard.request) and counts the
+// ones which fail, by error or server error status (as router.shard.errors), labeled by shard. Requests
+// canceled by the router (such as the losers of hedged queries) aren't errors.
+type shardMetricsTransport struct {
+	http.RoundTripper
+}
+
+func (t shardMetricsTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	shard := req.URL.Host
+	metrics.TimeLabeled("router.shard.request", time.Since(start), "shard", shard)
+	if (err != nil && req.Context().Err() == nil) || (err == nil && resp.StatusCode >= 500) {
+		metrics.IncLabeled("router.shard.errors", "shard", shard)
+	}
+	return resp, err
+}
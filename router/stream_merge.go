@@ -0,0 +1,322 @@
+package main
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+// mergeBatchSize is the number of merged rows which are finished and written to the client at a time during a
+// streaming merge.
+const mergeBatchSize = 1000
+
+// canMergeStreams reports whether the results of query may be merged as the shards stream them in: it must be
+// a grouped query whose merged rows can each be finished on their own (unlike a time fill, windows, or
+// ordering, which need all the rows), in a format which can be written incrementally, and without partial
+// results (which are buffered per partition).
+func canMergeStreams(query *gumshoe.Query, format string, partial bool) bool {
+	return len(query.Groupings) > 0 && query.Fill == nil && len(query.Windows) == 0 &&
+		len(query.OrderBy) == 0 && format != "arrow" && !partial
+}
+
+// mergeStream is the sorted results of one partition during a streaming merge, read from the shard by a
+// separate goroutine.
+type mergeStream struct {
+	rows chan gumshoe.RowMap
+	err  error          // Set before rows is closed
+	head gumshoe.RowMap // The stream's current row
+}
+
+func newMergeStream(ctx context.Context, resp *http.Response,
+	read func(*http.Response, func(gumshoe.RowMap)) error) *mergeStream {
+	s := &mergeStream{rows: make(chan gumshoe.RowMap, 64)}
+	go func() {
+		s.err = read(resp, func(row gumshoe.RowMap) {
+			select {
+			case s.rows <- row:
+			case <-ctx.Done():
+			}
+		})
+		close(s.rows)
+	}()
+	return s
+}
+
+// next advances s to its next row. It returns false at the end of the stream.
+func (s *mergeStream) next() bool {
+	row, ok := <-s.rows
+	s.head = row
+	return ok
+}
+
+// mergeHeap orders the streams by the grouping values of their current rows.
+type mergeHeap struct {
+	groupingCol string
+	streams     []*mergeStream
+}
+
+func (h *mergeHeap) Len() int { return len(h.streams) }
+func (h *mergeHeap) Less(i, j int) bool {
+	return gumshoe.CompareUntyped(h.streams[i].head[h.groupingCol], h.streams[j].head[h.groupingCol]) < 0
+}
+func (h *mergeHeap) Swap(i, j int)      { h.streams[i], h.streams[j] = h.streams[j], h.streams[i] }
+func (h *mergeHeap) Push(x interface{}) { h.streams = append(h.streams, x.(*mergeStream)) }
+func (h *mergeHeap) Pop() interface{} {
+	s := h.streams[len(h.streams)-1]
+	h.streams = h.streams[:len(h.streams)-1]
+	return s
+}
+
+// streamMerger merges the partitions' results, sorted by the query's grouping, as they stream in and writes
+// the merged rows to the client in batches. Only the rows of the current group and of one batch are held in
+// memory, rather than the entire result set.
+type streamMerger struct {
+	router  *Router
+	ctx     context.Context
+	query   *gumshoe.Query
+	format  string
+	queryID string
+	start   time.Time
+	streams []*mergeStream
+
+	heap    *mergeHeap
+	out     resultWriter // Nil until the first rows are written
+	numRows int
+}
+
+// writeResults merges the streams and writes the results to w. If a stream fails before any results have been
+// written, the client gets an error response; afterwards the results are cut short (for JSON, leaving the
+// document incomplete).
+func (m *streamMerger) writeResults(w http.ResponseWriter) {
+	m.heap = &mergeHeap{groupingCol: m.query.Groupings[0].Name}
+	for _, s := range m.streams {
+		if s.next() {
+			m.heap.streams = append(m.heap.streams, s)
+		} else if err := m.streamErr(s); err != nil {
+			m.fail(w, err)
+			return
+		}
+	}
+	heap.Init(m.heap)
+	bucket, _ := m.query.TimeBucketDuration(m.router.Schema.TimestampColumn.Name,
+		m.router.Schema.IntervalDuration)
+	var batch []gumshoe.RowMap
+	for m.heap.Len() > 0 {
+		group, err := m.nextGroup()
+		if err != nil {
+			m.fail(w, err)
+			return
+		}
+		batch = append(batch, group...)
+		if len(batch) < mergeBatchSize && m.heap.Len() > 0 {
+			continue
+		}
+		done, err := m.writeBatch(w, batch, bucket)
+		if err != nil {
+			m.fail(w, err)
+			return
+		}
+		if done {
+			break
+		}
+		batch = batch[:0]
+	}
+	if m.out == nil {
+		m.out = m.newResultWriter(w)
+	}
+	if err := m.out.finish(int(time.Since(m.start).Seconds()*1000), m.query.SampleStride()); err != nil {
+		Log.Printf("[%s] error writing results: %s", m.queryID, err)
+	}
+
+	Log.Printf("[%s] merged query results from %d shards as they streamed in %s (%d combined rows)",
+		m.queryID, len(m.streams), time.Since(m.start), m.numRows)
+	metrics.Since("router.query", m.start)
+	metrics.Since("router.query.grouped", m.start)
+	metrics.Inc("router.query.streamed")
+}
+
+// nextGroup merges the current rows of the streams with the smallest grouping value and advances those
+// streams. Grouping values which compare as equal without being identical (such as large integers which are
+// equal as float64s) are kept as separate rows.
+func (m *streamMerger) nextGroup() ([]gumshoe.RowMap, error) {
+	key := m.heap.streams[0].head[m.heap.groupingCol]
+	var group []gumshoe.RowMap
+	for m.heap.Len() > 0 && gumshoe.CompareUntyped(m.heap.streams[0].head[m.heap.groupingCol], key) == 0 {
+		s := m.heap.streams[0]
+		group = m.addToGroup(group, s.head)
+		if s.next() {
+			heap.Fix(m.heap, 0)
+			continue
+		}
+		heap.Pop(m.heap)
+		if err := m.streamErr(s); err != nil {
+			return nil, err
+		}
+	}
+	return group, nil
+}
+
+func (m *streamMerger) addToGroup(group []gumshoe.RowMap, row gumshoe.RowMap) []gumshoe.RowMap {
+	for _, cur := range group {
+		if cur[m.heap.groupingCol] == row[m.heap.groupingCol] {
+			m.router.mergeRows(cur, row, m.query)
+			return group
+		}
+	}
+	return append(group, row)
+}
+
+// streamErr returns the reason that a stream ended early, if it did.
+func (m *streamMerger) streamErr(s *mergeStream) error {
+	if s.err != nil {
+		return s.err
+	}
+	// Rows are dropped once the query is canceled or times out.
+	return m.ctx.Err()
+}
+
+// writeBatch finishes a batch of merged rows and writes them. It returns true once the query's limit has been
+// reached.
+func (m *streamMerger) writeBatch(w http.ResponseWriter, batch []gumshoe.RowMap,
+	bucket time.Duration) (bool, error) {
+	for _, row := range batch {
+		finishRow(row, m.query, bucket)
+	}
+	gumshoe.ApplyExpressions(batch, m.query)
+	batch = gumshoe.ApplyHavingFilters(batch, m.query)
+	done := false
+	if limit := m.query.Limit; limit > 0 && m.numRows+len(batch) >= limit {
+		batch = batch[:limit-m.numRows]
+		done = true
+	}
+	if m.out == nil {
+		m.out = m.newResultWriter(w)
+	}
+	for _, row := range batch {
+		if err := m.out.writeRow(row); err != nil {
+			return false, err
+		}
+	}
+	m.numRows += len(batch)
+	if err := m.out.flush(); err != nil {
+		return false, err
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return done, nil
+}
+
+func (m *streamMerger) fail(w http.ResponseWriter, err error) {
+	metrics.Inc("router.query.failure")
+	if m.ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("query timed out after %s", time.Since(m.start))
+		if m.out == nil {
+			WriteError(w, err, http.StatusGatewayTimeout)
+			return
+		}
+	}
+	if m.ctx.Err() == context.Canceled && m.out == nil {
+		WriteError(w, errors.New("the query was canceled"), http.StatusConflict)
+		return
+	}
+	if m.out == nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	// The response has already started, so there's no way to report the error to the client.
+	Log.Printf("[%s] error merging streamed results after writing %d rows: %s", m.queryID, m.numRows, err)
+}
+
+// A resultWriter writes query results to the client a row at a time.
+type resultWriter interface {
+	writeRow(row gumshoe.RowMap) error
+	flush() error
+	// finish writes the end of the results, given the query's duration and sample stride.
+	finish(durationMS, stride int) error
+}
+
+func (m *streamMerger) newResultWriter(w http.ResponseWriter) resultWriter {
+	if comma, contentType, ok := gumshoe.DelimitedFormat(m.format); ok {
+		w.Header().Set("Content-Type", contentType)
+		writer, err := gumshoe.NewDelimitedWriter(w, m.query.ResultColumns(), comma)
+		return &delimitedResultWriter{writer, err}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return &jsonResultWriter{w: w}
+}
+
+// jsonResultWriter writes the same JSON object as the Result of an in-memory merge.
+type jsonResultWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (j *jsonResultWriter) writeRow(row gumshoe.RowMap) error {
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	prefix := ","
+	if !j.started {
+		prefix = `{"results":[`
+		j.started = true
+	}
+	if _, err := io.WriteString(j.w, prefix); err != nil {
+		return err
+	}
+	_, err = j.w.Write(b)
+	return err
+}
+
+func (j *jsonResultWriter) flush() error { return nil }
+
+func (j *jsonResultWriter) finish(durationMS, stride int) error {
+	prefix := "],"
+	if !j.started {
+		prefix = `{"results":[],`
+	}
+	tail := struct {
+		DurationMS int     `json:"duration_ms"`
+		SampleRate float64 `json:"sample_rate,omitempty"`
+	}{DurationMS: durationMS}
+	if stride > 1 {
+		tail.SampleRate = 1 / float64(stride)
+	}
+	b, err := json.Marshal(tail)
+	if err != nil {
+		return err
+	}
+	// Splice the rest of the Result's fields in after the results.
+	_, err = fmt.Fprintf(j.w, "%s%s\n", prefix, b[1:])
+	return err
+}
+
+type delimitedResultWriter struct {
+	writer *gumshoe.DelimitedWriter
+	err    error // From writing the header
+}
+
+func (d *delimitedResultWriter) writeRow(row gumshoe.RowMap) error {
+	if d.err != nil {
+		return d.err
+	}
+	return d.writer.Write(row)
+}
+
+func (d *delimitedResultWriter) flush() error {
+	if d.err != nil {
+		return d.err
+	}
+	return d.writer.Flush()
+}
+
+func (d *delimitedResultWriter) finish(durationMS, stride int) error { return d.flush() }
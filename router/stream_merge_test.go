@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+const groupedTestQuery = `{"aggregates": [{"type": "sum", "name": "metric1", "column": "metric1"}],
+	"groupings": [{"column": "dim1", "name": "dim1"}]%s}`
+
+func TestStreamMergeOfSortedShards(t *testing.T) {
+	row := func(dim1 string, metric1 int) gumshoe.RowMap {
+		return gumshoe.RowMap{"dim1": dim1, "metric1": metric1, "rowCount": 1}
+	}
+	var shards []*httptest.Server
+	for _, rows := range [][]gumshoe.RowMap{
+		{row("a", 1), row("c", 2), row("e", 3)},
+		{row("b", 4), row("c", 5), row("f", 6)},
+		{row("d", 7), row("e", 8)},
+	} {
+		shard := newQueryShard(0, rows...)
+		defer shard.Close()
+		shards = append(shards, shard)
+	}
+	r := newTestRouter(1, shards...)
+
+	// The streams are merged in order, without any ordering in the query.
+	type merged struct {
+		dim1              string
+		metric1, rowCount float64
+	}
+	results := func(rows []gumshoe.RowMap) []merged {
+		var m []merged
+		for _, row := range rows {
+			m = append(m, merged{row["dim1"].(string), row["metric1"].(float64), row["rowCount"].(float64)})
+		}
+		return m
+	}
+	got := results(decodeResult(t, runTestQuery(r, fmt.Sprintf(groupedTestQuery, ""), "")).Results)
+	want := []merged{{"a", 1, 1}, {"b", 4, 1}, {"c", 7, 2}, {"d", 7, 1}, {"e", 11, 2}, {"f", 6, 1}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+
+	// The merge stops at the limit.
+	got = results(decodeResult(t, runTestQuery(r, fmt.Sprintf(groupedTestQuery, `, "limit": 4`), "")).Results)
+	if !reflect.DeepEqual(got, want[:4]) {
+		t.Errorf("with a limit of 4, got %v; want %v", got, want[:4])
+	}
+}
+
+func TestStreamMergeFailureBeforeFirstRow(t *testing.T) {
+	good := newQueryShard(0, gumshoe.RowMap{"dim1": "a", "metric1": 1, "rowCount": 1})
+	defer good.Close()
+	bad := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set(sortedStreamHeader, "true")
+		w.Write([]byte("{}\n{bad"))
+	}))
+	defer bad.Close()
+	r := newTestRouter(1, good, bad)
+
+	// Nothing has been written yet, so the client gets an error.
+	w := runTestQuery(r, fmt.Sprintf(groupedTestQuery, ""), "")
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("got status %d; want 500", w.Code)
+	}
+}
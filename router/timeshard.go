@@ -0,0 +1,67 @@
+package main
+
+import (
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+// The sharding strategies: by a hash of each row's dimensions (and timestamp), or by its interval.
+const (
+	shardByHash = "hash"
+	shardByTime = "time"
+)
+
+// maxPrunedIntervals bounds the number of intervals queryPartitions checks before giving up on pruning and
+// sending a query to every partition.
+const maxPrunedIntervals = 100000
+
+// intervalPartition returns the partition holding the interval starting at start under time-based sharding.
+func (r *Router) intervalPartition(start time.Time) int {
+	return r.Schema.IntervalPartition(start, len(r.Shards)/r.Replication)
+}
+
+// queryPartitions returns the partitions to which query must be sent. That is every partition, unless the
+// shards are sharded by time and query's timestamp filters bound it to intervals on only some of them.
+func (r *Router) queryPartitions(query *gumshoe.Query) [][]string {
+	partitions := r.partitions()
+	if r.Sharding != shardByTime {
+		return partitions
+	}
+	timestampColumn := r.Schema.TimestampColumn.Name
+	lower, upper := query.TimestampBounds(timestampColumn)
+	if lower == nil || upper == nil || *lower < 0 {
+		return partitions
+	}
+	needed := make([]bool, len(partitions))
+	numNeeded := 0
+	start := time.Unix(*lower, 0).Truncate(r.Schema.IntervalDuration)
+	for i := 0; start.Unix() <= *upper && numNeeded < len(partitions); i++ {
+		if i == maxPrunedIntervals {
+			return partitions
+		}
+		matches, err := query.IntervalMatches(timestampColumn, start)
+		if err != nil {
+			// The shards will report the bad filter.
+			return partitions
+		}
+		if p := r.intervalPartition(start); matches && !needed[p] {
+			needed[p] = true
+			numNeeded++
+		}
+		start = start.Add(r.Schema.IntervalDuration)
+	}
+	var pruned [][]string
+	for p, ok := range needed {
+		if ok {
+			pruned = append(pruned, partitions[p])
+		}
+	}
+	if len(pruned) == 0 {
+		// No interval matches, but the query still goes to one partition to get an (empty) result.
+		pruned = partitions[:1]
+	}
+	metrics.Count("router.query.pruned-partitions", float64(len(partitions)-len(pruned)))
+	return pruned
+}
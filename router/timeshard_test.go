@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTimeShardedTestRouter returns a Router sharded by time over n shards (of one replica each), and the
+// numbers of queries each shard has received.
+func newTimeShardedTestRouter(n int) (r *Router, queries []int32, closeShards func()) {
+	queries = make([]int32, n)
+	var shards []*httptest.Server
+	for i := 0; i < n; i++ {
+		i := i
+		shards = append(shards, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			ioutil.ReadAll(req.Body)
+			atomic.AddInt32(&queries[i], 1)
+			w.Write([]byte("{}\n{\"metric1\": 1, \"rowCount\": 1}\n"))
+		})))
+	}
+	r = newTestRouter(1, shards...)
+	r.Sharding = shardByTime
+	return r, queries, func() {
+		for _, shard := range shards {
+			shard.Close()
+		}
+	}
+}
+
+// timeFilteredTestQuery returns a query summing metric1 with the given filters on the timestamp.
+func timeFilteredTestQuery(filters string) string {
+	return fmt.Sprintf(`{"aggregates": [{"type": "sum", "name": "metric1", "column": "metric1"}],
+		"filters": [%s]}`, filters)
+}
+
+func TestTimeBoundedQueryIsPruned(t *testing.T) {
+	r, queries, closeShards := newTimeShardedTestRouter(4)
+	defer closeShards()
+	hour := int64(time.Hour / time.Second)
+
+	// Intervals 1 and 2 are on partitions 1 and 2.
+	query := timeFilteredTestQuery(fmt.Sprintf(`{"type": ">=", "column": "at", "value": %d},
+		{"type": "<", "column": "at", "value": %d}`, hour, 3*hour))
+	result := decodeResult(t, runTestQuery(r, query, ""))
+	if want := []int32{0, 1, 1, 0}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("got shard queries %v; want %v", queries, want)
+	}
+	if len(result.Results) != 1 || result.Results[0]["metric1"] != 2.0 {
+		t.Errorf("got results %v; want the sum of 2 shards", result.Results)
+	}
+
+	// A range with more intervals than partitions goes to every partition.
+	query = timeFilteredTestQuery(fmt.Sprintf(`{"type": ">=", "column": "at", "value": 0},
+		{"type": "<=", "column": "at", "value": %d}`, 100*hour))
+	decodeResult(t, runTestQuery(r, query, ""))
+	if want := []int32{1, 2, 2, 1}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("got shard queries %v; want %v", queries, want)
+	}
+
+	// A range without intervals still goes to one partition, for an empty result.
+	query = timeFilteredTestQuery(fmt.Sprintf(`{"type": ">", "column": "at", "value": %d},
+		{"type": "<", "column": "at", "value": %d}`, 2*hour, 2*hour))
+	decodeResult(t, runTestQuery(r, query, ""))
+	if want := []int32{2, 2, 2, 1}; !reflect.DeepEqual(queries, want) {
+		t.Errorf("got shard queries %v; want %v", queries, want)
+	}
+}
+
+func TestUnboundedQueryIsNotPruned(t *testing.T) {
+	r, queries, closeShards := newTimeShardedTestRouter(4)
+	defer closeShards()
+	hour := int64(time.Hour / time.Second)
+
+	for _, filters := range []string{
+		"",
+		fmt.Sprintf(`{"type": ">=", "column": "at", "value": %d}`, hour),
+		fmt.Sprintf(`{"type": "<", "column": "at", "value": %d}`, 3*hour),
+	} {
+		for i := range queries {
+			queries[i] = 0
+		}
+		result := decodeResult(t, runTestQuery(r, timeFilteredTestQuery(filters), ""))
+		if want := []int32{1, 1, 1, 1}; !reflect.DeepEqual(queries, want) {
+			t.Errorf("with filters [%s]: got shard queries %v; want %v", filters, queries, want)
+		}
+		if len(result.Results) != 1 || result.Results[0]["metric1"] != 4.0 {
+			t.Errorf("with filters [%s]: got results %v; want the sum of 4 shards", filters, result.Results)
+		}
+	}
+}
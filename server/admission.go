@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// An admissionController limits the number of queries which run at once. Queries which can't run right away
+// wait in a bounded queue; when the queue is full, they are rejected.
+type admissionController struct {
+	running chan struct{} // One element per running query
+	waiting chan struct{} // One element per queued query
+
+	// Counters (accessed atomically)
+	rejected int64 // Total since startup
+}
+
+func newAdmissionController(maxRunning, maxWaiting int) *admissionController {
+	return &admissionController{
+		running: make(chan struct{}, maxRunning),
+		waiting: make(chan struct{}, maxWaiting),
+	}
+}
+
+// acquire waits for a slot to run a query. If ok is true, the caller must call release when the query is
+// done. ok is false if the queue is full or ctx is done before a slot is available.
+func (a *admissionController) acquire(ctx context.Context) (ok bool) {
+	select {
+	case a.running <- struct{}{}:
+		return true
+	default:
+	}
+	select {
+	case a.waiting <- struct{}{}:
+	default:
+		atomic.AddInt64(&a.rejected, 1)
+		return false
+	}
+	defer func() { <-a.waiting }()
+	select {
+	case a.running <- struct{}{}:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (a *admissionController) release() { <-a.running }
+
+// AdmissionStats are the query admission counters reported on /statusz.
+type AdmissionStats struct {
+	QueriesRunning  int
+	QueriesQueued   int
+	QueriesRejected int64
+}
+
+func (a *admissionController) stats() AdmissionStats {
+	return AdmissionStats{
+		QueriesRunning:  len(a.running),
+		QueriesQueued:   len(a.waiting),
+		QueriesRejected: atomic.LoadInt64(&a.rejected),
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestAdmissionController(t *testing.T) {
+	a := newAdmissionController(1, 1)
+	if !a.acquire(context.Background()) {
+		t.Fatal("expected the first query to run")
+	}
+
+	// The second query waits in the queue, and the third is rejected.
+	admitted := make(chan bool)
+	go func() { admitted <- a.acquire(context.Background()) }()
+	for a.stats().QueriesQueued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if a.acquire(context.Background()) {
+		t.Fatal("expected a query to be rejected when the queue is full")
+	}
+	if stats := a.stats(); stats.QueriesRunning != 1 || stats.QueriesRejected != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	a.release()
+	if !<-admitted {
+		t.Fatal("expected the queued query to run")
+	}
+	a.release()
+
+	// A queued query gives up when its context is done.
+	a.acquire(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if a.acquire(ctx) {
+		t.Fatal("expected a query to time out waiting")
+	}
+	if stats := a.stats(); stats.QueriesQueued != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+// A queryCache is an LRU cache of query results. Results are only valid for the data they were computed
+// from, so each entry is keyed by the query along with the generation of each interval it scanned. (A flush
+// which changes an interval increments its generation.)
+type queryCache struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List // Most recently used at the front
+	entries  map[string]*list.Element
+}
+
+type queryCacheEntry struct {
+	key       string
+	intervals []*gumshoe.IntervalPlan // The scanned intervals
+	rows      []gumshoe.RowMap
+}
+
+func newQueryCache(capacity int) *queryCache {
+	return &queryCache{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// queryCacheKey makes a cache key for query, run in the streaming format or not, according to plan and
+// using lookupTables.
+func queryCacheKey(query *gumshoe.Query, stream bool, plan *gumshoe.QueryPlan,
+	lookupTables []*gumshoe.LookupTable) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "stream=%t ", stream)
+	// The parsed query has names filled in, so the JSON encoding is a normalized form of the query.
+	if err := json.NewEncoder(&buf).Encode(query); err != nil {
+		panic("unexpected marshal error")
+	}
+	for _, interval := range plan.Intervals {
+		if interval.Scanned {
+			fmt.Fprintf(&buf, "%d:%d,", interval.Start.Unix(), interval.Generation)
+		}
+	}
+	for _, table := range lookupTables {
+		fmt.Fprintf(&buf, " lookup=%d", table.Version)
+	}
+	return buf.String()
+}
+
+func (c *queryCache) get(key string) (rows []gumshoe.RowMap, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return elem.Value.(*queryCacheEntry).rows, true
+}
+
+// add caches rows, which must not be modified afterwards.
+func (c *queryCache) add(key string, plan *gumshoe.QueryPlan, rows []gumshoe.RowMap) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		return
+	}
+	entry := &queryCacheEntry{key: key, rows: rows}
+	for _, interval := range plan.Intervals {
+		if interval.Scanned {
+			entry.intervals = append(entry.intervals, interval)
+		}
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// removeStale removes the entries computed from intervals which have since been replaced or deleted.
+// generations gives the current generation of each interval.
+func (c *queryCache) removeStale(generations map[time.Time]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		for _, interval := range elem.Value.(*queryCacheEntry).intervals {
+			if generation, ok := generations[interval.Start]; !ok || generation != interval.Generation {
+				c.remove(elem)
+				break
+			}
+		}
+		elem = next
+	}
+}
+
+func (c *queryCache) remove(elem *list.Element) {
+	c.lru.Remove(elem)
+	delete(c.entries, elem.Value.(*queryCacheEntry).key)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+func TestQueryCache(t *testing.T) {
+	hour := time.Unix(3600, 0)
+	plan := func(generation int) *gumshoe.QueryPlan {
+		return &gumshoe.QueryPlan{Intervals: []*gumshoe.IntervalPlan{
+			{Start: time.Unix(0, 0), Generation: 5, Scanned: false},
+			{Start: hour, Generation: generation, Scanned: true},
+		}}
+	}
+	query := &gumshoe.Query{Aggregates: []gumshoe.QueryAggregate{
+		{Type: gumshoe.AggregateSum, Column: "metric1", Name: "metric1"},
+	}}
+	rows := []gumshoe.RowMap{{"metric1": 1}}
+
+	cache := newQueryCache(2)
+	key1 := queryCacheKey(query, false, plan(1), nil)
+	if key1 == queryCacheKey(query, true, plan(1), nil) || key1 == queryCacheKey(query, false, plan(2), nil) {
+		t.Fatal("expected cache keys to depend on the format and interval generations")
+	}
+	cache.add(key1, plan(1), rows)
+	if _, ok := cache.get(key1); !ok {
+		t.Fatal("expected a cache hit")
+	}
+
+	// The least recently used entry is evicted.
+	cache.add("a", plan(1), rows)
+	cache.get(key1)
+	cache.add("b", plan(1), rows)
+	if _, ok := cache.get("a"); ok {
+		t.Error("expected the least recently used entry to be evicted")
+	}
+
+	// Entries which used intervals that have changed are removed.
+	cache.add("c", plan(2), rows)
+	cache.removeStale(map[time.Time]int{hour: 2})
+	if _, ok := cache.get("b"); ok {
+		t.Error("expected an entry for an old interval generation to be removed")
+	}
+	if _, ok := cache.get("c"); !ok {
+		t.Error("expected an entry for the current interval generation to be kept")
+	}
+}
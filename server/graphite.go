@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+const (
+	// graphiteBatchInterval is how often the rows received in Graphite's plaintext protocol are inserted.
+	graphiteBatchInterval = time.Second
+	// graphiteMaxBatch is the most rows inserted at once; a full batch is inserted without waiting.
+	graphiteMaxBatch = 10000
+)
+
+// ListenGraphite listens on the TCP address addr for metrics in Graphite's plaintext protocol and inserts
+// them as rows using rules (see gumshoe.Schema.GraphiteRow). It only returns if listening fails.
+func (s *Server) ListenGraphite(addr string, rules []gumshoe.GraphiteRule) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.serveGraphite(ln, rules)
+}
+
+func (s *Server) serveGraphite(ln net.Listener, rules []gumshoe.GraphiteRule) error {
+	rows := make(chan gumshoe.RowMap, graphiteMaxBatch)
+	go s.insertGraphiteRows(rows)
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go s.readGraphite(conn, rules, rows)
+	}
+}
+
+// readGraphite reads metrics from conn until it's closed, sending their rows to rows. Bad lines and metrics
+// which no rule matches are counted and skipped, since there's no way to tell the sender about them.
+func (s *Server) readGraphite(conn net.Conn, rules []gumshoe.GraphiteRule, rows chan<- gumshoe.RowMap) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		sample, err := gumshoe.ParseGraphiteLine(line, time.Now())
+		if err != nil {
+			metrics.Inc("graphite.invalid")
+			continue
+		}
+		row, ok := s.DB.GraphiteRow(sample, rules)
+		if !ok {
+			metrics.Inc("graphite.dropped")
+			continue
+		}
+		rows <- row
+	}
+	if err := scanner.Err(); err != nil {
+		Log.Printf("Error reading graphite metrics from %s: %s", conn.RemoteAddr(), err)
+	}
+}
+
+// insertGraphiteRows inserts the rows sent to rows in batches, every graphiteBatchInterval or as soon as
+// graphiteMaxBatch rows are waiting. Rows still waiting when the server shuts down are lost.
+func (s *Server) insertGraphiteRows(rows <-chan gumshoe.RowMap) {
+	ticker := time.NewTicker(graphiteBatchInterval)
+	defer ticker.Stop()
+	var batch []gumshoe.RowMap
+	for {
+		select {
+		case row := <-rows:
+			if batch = append(batch, row); len(batch) < graphiteMaxBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		s.insertGraphiteBatch(batch)
+		batch = nil
+	}
+}
+
+func (s *Server) insertGraphiteBatch(batch []gumshoe.RowMap) {
+	if s.insertBacklogFull() {
+		// Graphite senders can't be told to retry, so the rows are dropped.
+		Log.Printf("Dropping %d graphite rows: too many inserted rows are waiting to be flushed", len(batch))
+		metrics.Count("graphite.rejected", float64(len(batch)))
+		return
+	}
+	Log.Printf("Inserting %d graphite rows", len(batch))
+	rowErrors, err := s.DB.InsertSkippingInvalid("", batch)
+	if err != nil {
+		Log.Println("Error inserting graphite rows:", err)
+		metrics.Count("insert.failure", float64(len(batch)))
+		return
+	}
+	metrics.Count("insert.success", float64(len(batch)-len(rowErrors)))
+	metrics.Count("insert.failure", float64(len(rowErrors)))
+	metrics.Count("graphite.rejected", float64(len(rowErrors)))
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+// grpcChunkSize is the size at which the streamed results of a gRPC query are sent as a QueryResponse.
+const grpcChunkSize = 32 << 10
+
+// grpcHandler serves the gRPC Shard service (see gumshoe/shard.proto) in front of routes, the server's HTTP
+// routes. Each call is passed to routes as the equivalent HTTP request, with the call's metadata as its
+// headers, so that it's authenticated, admitted, and handled exactly as that request would be. Requests
+// which aren't gRPC calls go straight to routes.
+type grpcHandler struct {
+	routes  http.Handler
+	maxSize int64 // The largest request message accepted (max_decompressed_body_size)
+}
+
+func (g grpcHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" || !strings.HasPrefix(r.Header.Get("Content-Type"), gumshoe.GRPCContentType) {
+		g.routes.ServeHTTP(w, r)
+		return
+	}
+	switch encoding := r.Header.Get("Grpc-Encoding"); encoding {
+	case "", "identity", "gzip":
+	default:
+		writeGRPCStatus(w.Header(), gumshoe.GRPCUnimplemented, 0, "unsupported grpc-encoding "+encoding)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	switch r.URL.Path {
+	case gumshoe.GRPCInsertPath:
+		g.serveInsert(w, r)
+	case gumshoe.GRPCQueryPath:
+		g.serveQuery(w, r)
+	default:
+		writeGRPCStatus(w.Header(), gumshoe.GRPCUnimplemented, 0, "unknown method "+r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// serveInsert handles an Insert call as PUT /insert.
+func (g grpcHandler) serveInsert(w http.ResponseWriter, r *http.Request) {
+	var call gumshoe.GRPCInsertRequest
+	if err := g.readRequest(r, &call); err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+	path := "/insert"
+	if call.SkipInvalid {
+		path += "?skip_invalid=true"
+	}
+	req, err := httpRequest(r, "PUT", call.Table, path, call.Batch)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+	req.Header.Set("Content-Type", gumshoe.ProtobufContentType)
+	if call.BatchID != "" {
+		req.Header.Set(batchIDHeader, call.BatchID)
+	}
+	resp := &grpcResponseWriter{w: w, header: make(http.Header)}
+	g.routes.ServeHTTP(resp, req)
+	if resp.status == http.StatusOK && resp.buf.Len() > 0 {
+		var insert InsertResponse
+		if err := json.Unmarshal(resp.buf.Bytes(), &insert); err != nil {
+			writeGRPCError(w, err)
+			return
+		}
+		out := gumshoe.GRPCInsertResponse{
+			Rejected:  insert.Rejected,
+			Held:      insert.Held,
+			Duplicate: insert.Duplicate,
+		}
+		resp.buf.Reset()
+		resp.buf.Write(out.Marshal())
+	}
+	resp.finish()
+}
+
+// serveQuery handles a Query call as POST /query?format=stream, in the binary stream format.
+func (g grpcHandler) serveQuery(w http.ResponseWriter, r *http.Request) {
+	var call gumshoe.GRPCQueryRequest
+	if err := g.readRequest(r, &call); err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+	path := "/query?format=stream"
+	if call.Sorted {
+		path += "&sorted=true"
+	}
+	req, err := httpRequest(r, "POST", call.Table, path, call.Query)
+	if err != nil {
+		writeGRPCError(w, err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", gumshoe.BinaryStreamContentType)
+	// gRPC is the framing; the results aren't gzipped within it.
+	req.Header.Del("Accept-Encoding")
+	resp := &grpcResponseWriter{w: w, header: make(http.Header), stream: true}
+	g.routes.ServeHTTP(resp, req)
+	resp.finish()
+}
+
+// readRequest reads the request message of the call r into m.
+func (g grpcHandler) readRequest(r *http.Request, m interface{ Unmarshal([]byte) error }) error {
+	msg, err := gumshoe.ReadGRPCMessage(r.Body, g.maxSize)
+	if err == io.EOF {
+		return errors.New("the gRPC call has no request message")
+	}
+	if err != nil {
+		return err
+	}
+	return m.Unmarshal(msg)
+}
+
+// httpRequest returns the HTTP request equivalent to the call r: method and path (under the routes of table,
+// if it isn't "") with body, and the call's metadata as headers.
+func httpRequest(r *http.Request, method, table, path string, body []byte) (*http.Request, error) {
+	if strings.Contains(table, "/") {
+		return nil, fmt.Errorf("bad table name %q", table)
+	}
+	if table != "" {
+		path = "/tables/" + table + path
+	}
+	req, err := http.NewRequestWithContext(r.Context(), method, path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header = r.Header.Clone()
+	for name := range req.Header {
+		if strings.HasPrefix(name, "Grpc-") {
+			req.Header.Del(name)
+		}
+	}
+	req.Header.Del("Te")
+	req.Proto, req.ProtoMajor, req.ProtoMinor = r.Proto, r.ProtoMajor, r.ProtoMinor
+	req.Host = r.Host
+	req.RemoteAddr = r.RemoteAddr
+	req.RequestURI = req.URL.RequestURI()
+	req.TLS = r.TLS
+	return req, nil
+}
+
+// A grpcResponseWriter is the http.ResponseWriter of the HTTP request equivalent to a gRPC call. A stream's
+// body is sent as QueryResponse messages as it's written; otherwise the body is kept in buf, for the caller
+// to turn into the response message sent by finish. Either way, a status other than 200 fails the call.
+type grpcResponseWriter struct {
+	w       http.ResponseWriter
+	header  http.Header
+	stream  bool
+	status  int  // 0 until the status is written
+	started bool // Whether the call's response headers have been sent
+	buf     bytes.Buffer
+	err     error // From writing to w
+}
+
+func (g *grpcResponseWriter) Header() http.Header { return g.header }
+
+func (g *grpcResponseWriter) WriteHeader(status int) {
+	switch {
+	case g.status == 0:
+		g.status = status
+	case g.status == http.StatusOK && status != http.StatusOK && g.stream:
+		// The stream failed partway through (which an HTTP response can't report). The error replaces the rest
+		// of the stream.
+		g.status = status
+		g.buf.Reset()
+	}
+}
+
+func (g *grpcResponseWriter) Write(b []byte) (int, error) {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	g.buf.Write(b)
+	if g.stream && g.status == http.StatusOK && g.buf.Len() >= grpcChunkSize {
+		g.sendChunk()
+	}
+	return len(b), g.err
+}
+
+func (g *grpcResponseWriter) Flush() {
+	if g.stream && g.status == http.StatusOK {
+		g.sendChunk()
+		if f, ok := g.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// start sends the call's response headers.
+func (g *grpcResponseWriter) start() {
+	if g.started {
+		return
+	}
+	g.started = true
+	g.w.Header().Set("Content-Type", gumshoe.GRPCContentType)
+	if sorted := g.header.Get(sortedStreamHeader); sorted != "" {
+		g.w.Header().Set(sortedStreamHeader, sorted)
+	}
+	g.w.WriteHeader(http.StatusOK)
+}
+
+func (g *grpcResponseWriter) sendChunk() {
+	if g.buf.Len() == 0 || g.err != nil {
+		return
+	}
+	g.start()
+	g.err = gumshoe.WriteGRPCMessage(g.w, gumshoe.MarshalGRPCQueryResponse(g.buf.Bytes()), false)
+	g.buf.Reset()
+}
+
+// finish sends the rest of the call's response: any unsent messages, and its status.
+func (g *grpcResponseWriter) finish() {
+	if g.status == 0 {
+		g.status = http.StatusOK
+	}
+	if g.status != http.StatusOK {
+		msg := strings.TrimSpace(g.buf.String())
+		var header interface{ Set(string, string) } = g.w.Header()
+		if g.started {
+			header = trailers{g.w.Header()}
+		}
+		writeGRPCStatus(header, gumshoe.GRPCCodeForHTTPStatus(g.status), g.status, msg)
+		if retryAfter := g.header.Get("Retry-After"); retryAfter != "" {
+			header.Set("Retry-After", retryAfter)
+		}
+		g.start()
+		return
+	}
+	if g.stream {
+		g.sendChunk()
+	} else {
+		g.start()
+		g.err = gumshoe.WriteGRPCMessage(g.w, g.buf.Bytes(), false)
+	}
+	g.start()
+	writeGRPCStatus(trailers{g.w.Header()}, gumshoe.GRPCOK, 0, "")
+}
+
+// writeGRPCError fails a call before anything has been sent for it.
+func writeGRPCError(w http.ResponseWriter, err error) {
+	Log.Output(2, fmt.Sprint(err))
+	writeGRPCStatus(w.Header(), gumshoe.GRPCInvalidArgument, http.StatusBadRequest, err.Error())
+	w.WriteHeader(http.StatusOK)
+}
+
+// writeGRPCStatus sets the status of a call in header (its response headers, for a call which fails before
+// sending anything, or else its trailers). The HTTP status of the equivalent request, if it isn't 0, is
+// given in a gumshoe.GRPCStatusTrailer.
+func writeGRPCStatus(header interface{ Set(string, string) }, code, httpStatus int, msg string) {
+	header.Set("Content-Type", gumshoe.GRPCContentType)
+	header.Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		header.Set("Grpc-Message", gumshoe.EscapeGRPCMessage(msg))
+	}
+	if httpStatus != 0 {
+		header.Set(gumshoe.GRPCStatusTrailer, strconv.Itoa(httpStatus))
+	}
+}
+
+// trailers sets the trailers of a response whose headers have been sent.
+type trailers struct {
+	header http.Header
+}
+
+func (t trailers) Set(name, value string) {
+	if name != "Content-Type" {
+		t.header.Set(http.TrailerPrefix+name, value)
+	}
+}
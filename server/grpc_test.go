@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/config"
+)
+
+// newGRPCTestServer returns a test server for s which speaks HTTP/2 without TLS, and a client for it.
+func newGRPCTestServer(s *Server) (*httptest.Server, *http.Client) {
+	server := httptest.NewUnstartedServer(s)
+	server.Config.Protocols = new(http.Protocols)
+	server.Config.Protocols.SetHTTP1(true)
+	server.Config.Protocols.SetUnencryptedHTTP2(true)
+	server.Start()
+	transport := &http.Transport{Protocols: new(http.Protocols)}
+	transport.Protocols.SetUnencryptedHTTP2(true)
+	return server, &http.Client{Transport: transport}
+}
+
+// grpcCall makes a call with the request message msg, and returns the response (whose body has been read)
+// and its messages.
+func grpcCall(t *testing.T, client *http.Client, url, method string, msg []byte) (*http.Response,
+	[][]byte) {
+	t.Helper()
+	var body bytes.Buffer
+	if err := gumshoe.WriteGRPCMessage(&body, msg, true); err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", url+method, &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", gumshoe.GRPCContentType)
+	req.Header.Set("Grpc-Encoding", "gzip")
+	req.Header.Set("Te", "trailers")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 || resp.StatusCode != 200 {
+		t.Fatalf("got %s %s; want an HTTP/2 200", resp.Proto, resp.Status)
+	}
+	var msgs [][]byte
+	for {
+		msg, err := gumshoe.ReadGRPCMessage(resp.Body, 1<<20)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return resp, msgs
+}
+
+// grpcStatus returns the status of a finished call: from its trailers or, if it failed without sending
+// anything, its headers.
+func grpcStatus(resp *http.Response) (code, httpStatus, msg string) {
+	header := resp.Trailer
+	if resp.Header.Get("Grpc-Status") != "" {
+		header = resp.Header
+	}
+	return header.Get("Grpc-Status"), header.Get(gumshoe.GRPCStatusTrailer),
+		gumshoe.UnescapeGRPCMessage(header.Get("Grpc-Message"))
+}
+
+func TestGRPCInsertAndQuery(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(conf, schema)
+	server, client := newGRPCTestServer(s)
+	defer server.Close()
+
+	now := time.Now().Unix()
+	batch, err := gumshoe.EncodeRowBatch([]gumshoe.RowMap{
+		{"at": now, "dim1": 1, "metric1": 2},
+		{"at": now, "dim1": 1, "bogus": 3},
+		{"at": now, "dim1": 2, "metric1": 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insert := gumshoe.GRPCInsertRequest{Batch: batch, SkipInvalid: true, BatchID: "batch1"}
+	resp, msgs := grpcCall(t, client, server.URL, gumshoe.GRPCInsertPath, insert.Marshal())
+	if code, _, msg := grpcStatus(resp); code != "0" || len(msgs) != 1 {
+		t.Fatalf("got status %s (%s) and %d messages; want 0 and 1", code, msg, len(msgs))
+	}
+	var inserted gumshoe.GRPCInsertResponse
+	if err := inserted.Unmarshal(msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if len(inserted.Rejected) != 1 || inserted.Rejected[0].Row != 1 || inserted.Duplicate {
+		t.Fatalf("got insert response %+v; want row 1 rejected", inserted)
+	}
+	// The batch ID is passed along.
+	_, msgs = grpcCall(t, client, server.URL, gumshoe.GRPCInsertPath, insert.Marshal())
+	if err := inserted.Unmarshal(msgs[0]); err != nil || !inserted.Duplicate {
+		t.Fatalf("got insert response %+v (%v) for a retry; want a duplicate", inserted, err)
+	}
+	s.Flush()
+
+	query := gumshoe.GRPCQueryRequest{
+		Query: []byte(`{"aggregates": [{"type": "sum", "name": "metric1", "column": "metric1"}],
+			"groupings": [{"column": "dim1", "name": "dim1"}]}`),
+		Sorted: true,
+	}
+	resp, msgs = grpcCall(t, client, server.URL, gumshoe.GRPCQueryPath, query.Marshal())
+	if code, _, msg := grpcStatus(resp); code != "0" {
+		t.Fatalf("got status %s (%s); want 0", code, msg)
+	}
+	if resp.Header.Get(sortedStreamHeader) != "true" {
+		t.Error("the sorted stream isn't marked as sorted")
+	}
+	var stream []byte
+	for _, msg := range msgs {
+		data, err := gumshoe.UnmarshalGRPCQueryResponse(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, data...)
+	}
+	decoder := gob.NewDecoder(bytes.NewReader(stream))
+	var header map[string]int
+	if err := decoder.Decode(&header); err != nil {
+		t.Fatal(err)
+	}
+	var rows []string
+	for {
+		var row gumshoe.RowMap
+		if err := decoder.Decode(&row); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		rows = append(rows, fmt.Sprintf("%v:%v", row["dim1"], row["metric1"]))
+	}
+	if want := []string{"1:2", "2:4"}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("got rows %v; want %v", rows, want)
+	}
+}
+
+func TestGRPCErrors(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := newGRPCTestServer(NewServer(conf, schema))
+	defer server.Close()
+
+	for _, tt := range []struct {
+		method     string
+		msg        []byte
+		code       string
+		httpStatus string
+		err        string
+	}{
+		{gumshoe.GRPCQueryPath, (&gumshoe.GRPCQueryRequest{Query: []byte("{bad")}).Marshal(), "3", "400", ""},
+		{
+			gumshoe.GRPCQueryPath,
+			(&gumshoe.GRPCQueryRequest{Table: "bogus", Query: []byte("{}")}).Marshal(),
+			"5", "404", "no such table",
+		},
+		{gumshoe.GRPCInsertPath, []byte{0xff}, "3", "400", "truncated"},
+		{"/gumshoe.Shard/Bogus", nil, "12", "", "unknown method"},
+	} {
+		resp, msgs := grpcCall(t, client, server.URL, tt.method, tt.msg)
+		code, httpStatus, msg := grpcStatus(resp)
+		if code != tt.code || httpStatus != tt.httpStatus || !strings.Contains(msg, tt.err) || len(msgs) > 0 {
+			t.Errorf("%s: got status %s (HTTP %q) %q and %d messages; want %s (HTTP %q) with %q",
+				tt.method, code, httpStatus, msg, len(msgs), tt.code, tt.httpStatus, tt.err)
+		}
+	}
+
+	// Other requests are served as usual.
+	resp, err := client.Get(server.URL + "/healthz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Errorf("got status %d from /healthz; want 200", resp.StatusCode)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// The states of a Server, for /readyz. A Server's DB has been opened (and its WAL replayed) by the time
+// NewServer returns; it's ready once its periodic flushes are scheduled, and it stops being ready when it
+// begins to shut down.
+const (
+	stateStarting int32 = iota
+	stateReady
+	stateShuttingDown
+)
+
+// HandleHealthz responds with a 200 as long as the server is running.
+func (s *Server) HandleHealthz(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// HandleReadyz responds with a 200 if the server (and each of its tables) is ready to serve requests, and a
+// 503 otherwise.
+func (s *Server) HandleReadyz(w http.ResponseWriter, r *http.Request) {
+	if err := s.checkReady(); err != nil {
+		http.Error(w, "not ready: "+err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	for name, t := range s.Tables {
+		if err := t.checkReady(); err != nil {
+			http.Error(w, fmt.Sprintf("not ready: table %s: %s", name, err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+func (s *Server) checkReady() error {
+	switch atomic.LoadInt32(&s.state) {
+	case stateStarting:
+		return errors.New("starting up")
+	case stateShuttingDown:
+		return errors.New("shutting down")
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base32"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+)
+
+// A queryTracker keeps track of the queries which are running (or waiting to run) for /debug/queries.
+type queryTracker struct {
+	mu      sync.Mutex
+	next    int64
+	running map[int64]*RunningQuery
+}
+
+// A RunningQuery is a query listed on /debug/queries.
+type RunningQuery struct {
+	ID       string // The router's ID for the query, or one made up by the server
+	Priority string
+	Started  time.Time
+	Elapsed  string
+	Query    *gumshoe.Query
+	// The segments scanned so far, and the number to scan (0 until the query has picked its intervals).
+	SegmentsScanned int
+	SegmentsTotal   int
+
+	progress *gumshoe.QueryProgress
+	cancel   context.CancelFunc
+}
+
+func newQueryTracker() *queryTracker {
+	return &queryTracker{running: make(map[int64]*RunningQuery)}
+}
+
+// add records that a query has started, returning a copy of ctx with which to run it (which is canceled by
+// cancel). The caller must call the returned function when it's done.
+func (t *queryTracker) add(ctx context.Context, id, priority string,
+	query *gumshoe.Query) (queryCtx context.Context, done func()) {
+
+	progress := new(gumshoe.QueryProgress)
+	queryCtx, cancel := context.WithCancel(gumshoe.WithQueryProgress(ctx, progress))
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	key := t.next
+	t.next++
+	t.running[key] = &RunningQuery{
+		ID:       id,
+		Priority: priority,
+		Started:  time.Now(),
+		Query:    query,
+		progress: progress,
+		cancel:   cancel,
+	}
+	return queryCtx, func() {
+		t.mu.Lock()
+		delete(t.running, key)
+		t.mu.Unlock()
+		cancel()
+	}
+}
+
+// cancel cancels the running queries with the given ID, returning how many there were.
+func (t *queryTracker) cancel(id string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := 0
+	for _, query := range t.running {
+		if query.ID == id {
+			query.cancel()
+			n++
+		}
+	}
+	return n
+}
+
+// list returns the running queries, oldest first.
+func (t *queryTracker) list() []RunningQuery {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	keys := make([]int64, 0, len(t.running))
+	for key := range t.running {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	queries := make([]RunningQuery, len(keys))
+	for i, key := range keys {
+		queries[i] = *t.running[key]
+		queries[i].Elapsed = time.Since(queries[i].Started).String()
+		queries[i].SegmentsScanned, queries[i].SegmentsTotal = queries[i].progress.Segments()
+	}
+	return queries
+}
+
+// randomID makes up an ID for a query which didn't come from a router.
+func randomID() string {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		panic("can't read from crypto/rand")
+	}
+	return strings.ToLower(base32.StdEncoding.EncodeToString(b))
+}
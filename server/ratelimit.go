@@ -0,0 +1,138 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// maxRateLimitClients bounds the number of token buckets an insertRateLimiter keeps. Beyond this, the buckets
+// of idle clients (which are full, and so have no state worth keeping) are dropped.
+const maxRateLimitClients = 10000
+
+// An insertRateLimiter limits each client's rate of inserts using a token bucket per client. A client is
+// identified by its API key (given in a header) or, if it doesn't send one, by its IP address.
+type insertRateLimiter struct {
+	header string // The API key header; "" to always use IP addresses
+	now    func() time.Time
+
+	mu      sync.Mutex
+	rate    float64 // Inserts per second; 0 for no limit
+	burst   float64 // Bucket size
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens   float64
+	updated  time.Time
+	rejected int64 // Total since the bucket was created
+}
+
+func newInsertRateLimiter(rate float64, burst int, header string) *insertRateLimiter {
+	return &insertRateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		header:  header,
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// clientKey returns the name for r's client. API keys are hashed so that they aren't exposed on /statusz.
+func (l *insertRateLimiter) clientKey(r *http.Request) string {
+	if l.header != "" {
+		if key := r.Header.Get(l.header); key != "" {
+			sum := sha256.Sum256([]byte(key))
+			return "key:" + hex.EncodeToString(sum[:4])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// allow takes a token from the bucket of r's client. If the bucket is empty, allow returns false and how long
+// the client should wait before trying again.
+func (l *insertRateLimiter) allow(r *http.Request) (ok bool, retryAfter time.Duration) {
+	key := l.clientKey(r)
+	now := l.now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate <= 0 {
+		return true, 0
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitClients {
+			l.removeIdle(now)
+		}
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	l.refill(bucket, now)
+	if bucket.tokens < 1 {
+		bucket.rejected++
+		wait := (1 - bucket.tokens) / l.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// setLimit changes the rate (0 for no limit) and bucket size. The clients' buckets start over.
+func (l *insertRateLimiter) setLimit(rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.rate = rate
+	l.burst = float64(burst)
+	l.buckets = make(map[string]*tokenBucket)
+}
+
+func (l *insertRateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	elapsed := now.Sub(bucket.updated).Seconds()
+	bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+	bucket.updated = now
+}
+
+// removeIdle drops the buckets which have refilled completely. l.mu must be held.
+func (l *insertRateLimiter) removeIdle(now time.Time) {
+	for key, bucket := range l.buckets {
+		if l.refill(bucket, now); bucket.tokens >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// InsertRateLimitStats are the rate limit state of one client, reported on /statusz.
+type InsertRateLimitStats struct {
+	Client   string
+	Tokens   float64 // Inserts the client may make right away
+	Rejected int64
+}
+
+func (l *insertRateLimiter) stats() []InsertRateLimitStats {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	stats := make([]InsertRateLimitStats, 0, len(l.buckets))
+	for key, bucket := range l.buckets {
+		l.refill(bucket, now)
+		stats = append(stats, InsertRateLimitStats{key, bucket.tokens, bucket.rejected})
+	}
+	sort.Sort(rateLimitStatsByClient(stats))
+	return stats
+}
+
+type rateLimitStatsByClient []InsertRateLimitStats
+
+func (s rateLimitStatsByClient) Len() int           { return len(s) }
+func (s rateLimitStatsByClient) Less(i, j int) bool { return s[i].Client < s[j].Client }
+func (s rateLimitStatsByClient) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestInsertRateLimiter(t *testing.T) {
+	l := newInsertRateLimiter(2, 2, "X-API-Key")
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	newRequest := func(remoteAddr, apiKey string) *http.Request {
+		r, err := http.NewRequest("POST", "/insert", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.RemoteAddr = remoteAddr
+		if apiKey != "" {
+			r.Header.Set("X-API-Key", apiKey)
+		}
+		return r
+	}
+
+	// A client may burst up to the bucket size, and then is limited.
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.allow(newRequest("10.0.0.1:1234", "")); !ok {
+			t.Fatalf("expected insert %d to be allowed", i)
+		}
+	}
+	ok, retryAfter := l.allow(newRequest("10.0.0.1:5678", ""))
+	if ok {
+		t.Fatal("expected the client to be rate limited")
+	}
+	if retryAfter != 500*time.Millisecond {
+		t.Fatalf("got retry after %s; want 500ms", retryAfter)
+	}
+
+	// Other clients, whether told apart by IP or API key, have their own buckets.
+	if ok, _ := l.allow(newRequest("10.0.0.2:1234", "")); !ok {
+		t.Fatal("expected a different IP to be allowed")
+	}
+	if ok, _ := l.allow(newRequest("10.0.0.1:1234", "secret")); !ok {
+		t.Fatal("expected an API key client to be allowed")
+	}
+
+	// The bucket refills over time.
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow(newRequest("10.0.0.1:1234", "")); !ok {
+		t.Fatal("expected the client to be allowed after its bucket refilled")
+	}
+
+	stats := l.stats()
+	if len(stats) != 3 {
+		t.Fatalf("got stats for %d clients; want 3", len(stats))
+	}
+	for _, s := range stats {
+		if s.Client == "ip:10.0.0.1" {
+			if s.Rejected != 1 || s.Tokens != 0 {
+				t.Fatalf("unexpected stats: %+v", s)
+			}
+			continue
+		}
+		if s.Client != "ip:10.0.0.2" && (len(s.Client) != len("key:")+8 || s.Client[:4] != "key:") {
+			t.Fatalf("unexpected client name: %q", s.Client)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"time"
+
+	"github.com/philc/gumshoedb/internal/config"
+)
+
+// HandleReload re-reads the config file and applies the settings which can be changed while the server is
+// running (see reload). It responds with the list of changes.
+func (s *Server) HandleReload(w http.ResponseWriter, r *http.Request) {
+	changes, err := s.reload(*configFile)
+	if err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	WriteJSONResponse(w, map[string][]string{"changes": changes})
+}
+
+// reload reads the config file at path (with configOverrides) and the config files of the tables, and
+// applies the changes to the settings which can be changed while the server is running: flush_interval,
+// retention_days, query_parallelism, insert_rate_limit, and insert_rate_burst. Changes to other settings take
+// effect when the server is restarted. It returns a description of each change.
+func (s *Server) reload(path string) ([]string, error) {
+	conf, _, err := config.LoadConfig(path, configOverrides)
+	if err != nil {
+		return nil, err
+	}
+	tables, err := conf.LoadTables()
+	if err != nil {
+		return nil, err
+	}
+	changes, err := s.applyConfig(conf)
+	if err != nil {
+		return changes, err
+	}
+	for _, table := range tables {
+		t, ok := s.Tables[table.Name]
+		if !ok {
+			Log.Printf("Table %q is new; it will be loaded when the server is restarted", table.Name)
+			continue
+		}
+		tableChanges, err := t.applyConfig(table.Config)
+		for _, change := range tableChanges {
+			changes = append(changes, fmt.Sprintf("table %s: %s", table.Name, change))
+		}
+		if err != nil {
+			return changes, fmt.Errorf("table %s: %s", table.Name, err)
+		}
+	}
+	return changes, nil
+}
+
+// applyConfig applies the reloadable settings of conf which differ from s.Config.
+func (s *Server) applyConfig(conf *config.Config) ([]string, error) {
+	s.reloadLock.Lock()
+	defer s.reloadLock.Unlock()
+	db := "the main DB"
+	if s.Name != "" {
+		db = "table " + s.Name
+	}
+	var changes []string
+	changed := func(format string, args ...interface{}) {
+		change := fmt.Sprintf(format, args...)
+		Log.Printf("Reloaded the config of %s: %s", db, change)
+		changes = append(changes, change)
+	}
+
+	if interval := conf.FlushInterval; interval != s.Config.FlushInterval {
+		s.setFlushInterval(interval.Duration)
+		select {
+		case s.flushIntervalChanged <- struct{}{}:
+		default:
+		}
+		changed("flush_interval %s -> %s", s.Config.FlushInterval, interval)
+		s.Config.FlushInterval = interval
+	}
+	if days := conf.RetentionDays; days != s.Config.RetentionDays && !s.DB.ReadOnly {
+		if err := s.DB.SetRetention(time.Duration(days) * 24 * time.Hour); err != nil {
+			return changes, err
+		}
+		if s.queryCache != nil {
+			s.queryCache.removeStale(s.DB.GetIntervalGenerations())
+		}
+		changed("retention_days %d -> %d", s.Config.RetentionDays, days)
+		s.Config.RetentionDays = days
+	}
+	if n := conf.QueryParallelism; n != s.Config.QueryParallelism {
+		if err := s.DB.SetQueryParallelism(n); err != nil {
+			return changes, err
+		}
+		changed("query_parallelism %d -> %d", s.Config.QueryParallelism, n)
+		s.Config.QueryParallelism = n
+	}
+	if conf.InsertRateLimit != s.Config.InsertRateLimit || conf.InsertRateBurst != s.Config.InsertRateBurst {
+		s.insertLimiter.setLimit(conf.InsertRateLimit, conf.InsertRateBurst)
+		changed("insert_rate_limit %g (burst %d) -> %g (burst %d)", s.Config.InsertRateLimit,
+			s.Config.InsertRateBurst, conf.InsertRateLimit, conf.InsertRateBurst)
+		s.Config.InsertRateLimit = conf.InsertRateLimit
+		s.Config.InsertRateBurst = conf.InsertRateBurst
+	}
+
+	// Point out any other changes, which need a restart.
+	current, reloaded := *s.Config, *conf
+	reloaded.FlushInterval = current.FlushInterval
+	reloaded.RetentionDays = current.RetentionDays
+	reloaded.QueryParallelism = current.QueryParallelism
+	reloaded.InsertRateLimit = current.InsertRateLimit
+	reloaded.InsertRateBurst = current.InsertRateBurst
+	if !reflect.DeepEqual(current, reloaded) {
+		Log.Printf("Other changes to the config of %s will take effect when the server is restarted", db)
+	}
+	return changes, nil
+}
@@ -4,21 +4,36 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
-	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/auth"
 	"github.com/philc/gumshoedb/internal/config"
+	"github.com/philc/gumshoedb/internal/debug"
+	"github.com/philc/gumshoedb/internal/grafana"
+	"github.com/philc/gumshoedb/internal/gzipbody"
+	"github.com/philc/gumshoedb/internal/metrics"
+	"github.com/philc/gumshoedb/internal/remotewrite"
 
-	"github.com/philc/gumshoedb/internal/github.com/cespare/gostc"
 	"github.com/philc/gumshoedb/internal/github.com/gorilla/pat"
 )
 
@@ -28,19 +43,62 @@ const logFlags = log.Lshortfile
 var (
 	// Flags
 	configFile  = flag.String("config", "config.toml", "Configuration file to use")
-	profileAddr = flag.String("profile-addr", "", "If non-empty, address for net/http/pprof")
+	debugAddr   = flag.String("debug-addr", "", "If non-empty, address for debugging endpoints (pprof, etc.)")
+	profileAddr = flag.String("profile-addr", "", "Deprecated synonym for -debug-addr")
 
-	Log    = log.New(os.Stderr, "[server] ", logFlags)
-	statsd *gostc.Client
+	Log = log.New(os.Stderr, "[server] ", logFlags)
+
+	// Config values given by environment variables or -set flags, which replace those in the config file.
+	configOverrides config.Overrides
 
 	// Anything that needs to know about program shutdown can listen on this chan.
 	shutdown = make(chan struct{})
+	// Each DB's RunPeriodicFlushes is counted here until it has flushed for shutdown.
+	shutdownFlushes sync.WaitGroup
 )
 
+// queryTimeoutHeader is set by the router to the time remaining before its deadline for a query.
+const queryTimeoutHeader = "X-Gumshoe-Query-Timeout"
+
+// queryDeadlineHeader is set by the router to its deadline for a query (in RFC 3339 format). Unlike
+// queryTimeoutHeader, it accounts for the time the request spent reaching the shard, but it relies on the
+// router's and shard's clocks agreeing.
+const queryDeadlineHeader = "X-Gumshoe-Deadline"
+
+// queryPriorityHeader is set by clients to "interactive" (the default) or "batch". The two classes of
+// queries are admitted separately, so long-running batch queries can't delay interactive ones.
+const queryPriorityHeader = "X-Gumshoe-Query-Priority"
+
+// queryIDHeader is set by the router to its ID for a query. The server uses it in its logs and on
+// /debug/queries so that a query can be followed from the router to the shards.
+const queryIDHeader = "X-Gumshoe-Query-ID"
+
+// sortedStreamHeader is set on the response to a streaming query with sorted=true to tell the router that the
+// rows are sorted by their grouping (so that it can merge the shards' results as they stream in).
+const sortedStreamHeader = "X-Gumshoe-Sorted"
+
+// batchIDHeader is optionally set by clients on inserts to identify the batch of rows. A batch with the same ID
+// as one inserted recently is ignored, so inserts may be safely retried.
+const batchIDHeader = "X-Batch-ID"
+
 type Server struct {
 	http.Handler
-	Config *config.Config
-	DB     *gumshoe.DB
+	Config         *config.Config
+	DB             *gumshoe.DB
+	Name           string             // The table's name, or "" for the main DB
+	Tables         map[string]*Server // The tables (see config.Config.Tables), served under /tables/
+	queryCache     *queryCache        // nil if caching is disabled
+	admission      *admissionController
+	batchAdmission *admissionController
+	insertLimiter  *insertRateLimiter
+	queries        *queryTracker
+	slowQueries    *slowQueryLog
+	state          int32 // stateStarting, stateReady, or stateShuttingDown (accessed atomically)
+
+	// The flush interval can be changed by reloading the config, which signals flushIntervalChanged.
+	flushInterval        int64 // A time.Duration (accessed atomically)
+	flushIntervalChanged chan struct{}
+	reloadLock           sync.Mutex // Held while reloading the config
 }
 
 func WriteJSONResponse(w http.ResponseWriter, objectToSerialize interface{}) {
@@ -57,39 +115,232 @@ func WriteError(w http.ResponseWriter, err error, status int) {
 	http.Error(w, err.Error(), status)
 }
 
+// writeQueryError is WriteError for a query, which logs the error with the query's ID.
+func writeQueryError(w http.ResponseWriter, queryID string, err error, status int) {
+	Log.Output(2, fmt.Sprintf("[%s] %s", queryID, err))
+	http.Error(w, err.Error(), status)
+}
+
+// writeQueryCanceledError responds to a query which was canceled (with /admin/queries/{id}/cancel, or because
+// the client went away). It's a client error so that a router doesn't retry the query on another replica.
+func writeQueryCanceledError(w http.ResponseWriter, queryID string) {
+	writeQueryError(w, queryID, errors.New("the query was canceled"), http.StatusConflict)
+}
+
 func (s *Server) Flush() {
+	if s.DB.ReadOnly {
+		return
+	}
 	// NOTE(caleb): Right now there's no great way to recover from a flush error. These could occur for reasons
 	// such as the disk being full or having bad permissions. For now, we'll just log and crash hard. Note that
 	// the metadata is written atomically after a succesful flush, so restarting will return us to a consistent
 	// state (but missing any data since the previous successful flush).
-	start := time.Now()
 	if err := s.DB.Flush(); err != nil {
 		Log.Printf(">>> FATAL ERROR ON FLUSH: %s", err)
 		os.Exit(1)
 	}
-	statsd.Time("gumshoedb.flush", time.Since(start))
+	if s.queryCache != nil {
+		s.queryCache.removeStale(s.DB.GetIntervalGenerations())
+	}
 }
 
 // HandleInsert decodes an array of JSON-formatted row maps from the request body and inserts them into the
-// database.
+// database. A request repeating the batch ID (see batchIDHeader) of a recent insert succeeds without
+// inserting anything. If the client has exceeded its rate limit or too many rows are waiting to be flushed,
+// the insert is rejected with a 429. A row older than the late arrival window fails the insert with a 422.
+//
+// Normally an invalid row fails the whole insert (although the rows before it are inserted). With the
+// parameter skip_invalid=true, the invalid rows are skipped instead, and the response (an InsertResponse)
+// lists them. Rows with values which overflow a string dimension column are handled according to the
+// string_overflow option instead; rows held back by string_overflow = "promote" are counted in the response.
+//
+// With format=csv, the body is CSV rather than JSON (see handleInsertCSV). With Content-Type
+// application/x-protobuf, the body is a protobuf RowBatch (see gumshoe/rows.proto).
 func (s *Server) HandleInsert(w http.ResponseWriter, r *http.Request) {
-	decoder := json.NewDecoder(r.Body)
-	var rows []gumshoe.RowMap
-	if err := decoder.Decode(&rows); err != nil {
+	if ok, retryAfter := s.insertLimiter.allow(r); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+		WriteError(w, errors.New("insert rate limit exceeded"), http.StatusTooManyRequests)
+		metrics.Inc("insert.rate-limited")
+		return
+	}
+	if s.insertBacklogFull() {
+		// The backlog is cleared by the next flush.
+		retry := (s.getFlushInterval() + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.Itoa(int(retry)))
+		WriteError(w, errors.New("too many inserted rows are waiting to be flushed"), http.StatusTooManyRequests)
+		metrics.Inc("insert.rejected")
+		return
+	}
+	if r.URL.Query().Get("format") == "csv" {
+		s.handleInsertCSV(w, r)
+		return
+	}
+	rows, err := readInsertRows(r)
+	if err != nil {
 		WriteError(w, err, http.StatusBadRequest)
 		return
 	}
 	Log.Printf("Inserting %d rows", len(rows))
 
-	var success, failure float64
-	if err := s.DB.Insert(rows); err == nil {
-		success = float64(len(rows))
-	} else {
+	batchID := r.Header.Get(batchIDHeader)
+	skipInvalid := r.URL.Query().Get("skip_invalid") == "true"
+	rowErrors, heldRows, err := s.DB.InsertWithResult(batchID, rows, skipInvalid)
+
+	var success, failure, late float64
+	for _, rowErr := range rowErrors {
+		if rowErr.Late {
+			late++
+		}
+	}
+	_, isLate := err.(*gumshoe.LateRowError)
+	switch {
+	case err == nil:
+		success = float64(len(rows) - len(rowErrors) - heldRows)
+		failure = float64(len(rowErrors))
+	case err == gumshoe.DuplicateBatchErr:
+		Log.Printf("Ignoring duplicate batch %q", batchID)
+		metrics.Count("insert.duplicate", float64(len(rows)))
+	case isLate:
+		WriteError(w, err, http.StatusUnprocessableEntity)
+		failure = float64(len(rows))
+		late = 1
+	default:
 		WriteError(w, err, http.StatusBadRequest)
 		failure = float64(len(rows))
 	}
-	statsd.Count("gumshoedb.insert.success", success, 1)
-	statsd.Count("gumshoedb.insert.failure", failure, 1)
+	metrics.Count("insert.late", late)
+	metrics.Count("insert.success", success)
+	metrics.Count("insert.failure", failure)
+	metrics.Count("insert.held", float64(heldRows))
+	if (skipInvalid || heldRows > 0) && (err == nil || err == gumshoe.DuplicateBatchErr) {
+		resp := InsertResponse{Rejected: rowErrors, Held: heldRows, Duplicate: err != nil}
+		if resp.Rejected == nil {
+			resp.Rejected = []gumshoe.RowError{}
+		}
+		WriteJSONResponse(w, resp)
+	}
+}
+
+// readInsertRows decodes the rows of an insert from the request body, which is either a JSON array of row
+// maps or a protobuf RowBatch. JSON numbers are decoded as json.Numbers so that 64-bit integers are inserted
+// exactly.
+func readInsertRows(r *http.Request) ([]gumshoe.RowMap, error) {
+	if gumshoe.IsProtobufContentType(r.Header.Get("Content-Type")) {
+		b, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			return nil, err
+		}
+		return gumshoe.DecodeRowBatch(b)
+	}
+	var rows []gumshoe.RowMap
+	decoder := json.NewDecoder(r.Body)
+	decoder.UseNumber()
+	if err := decoder.Decode(&rows); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// handleInsertCSV inserts the rows of a CSV request body (format=csv). The CSV starts with a header row of
+// column names; the map parameters (such as map=ts:at) rename CSV columns to schema columns, in which case
+// unmapped CSV columns are ignored. The response gives the number of rows inserted.
+func (s *Server) handleInsertCSV(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get(batchIDHeader) != "" || r.URL.Query().Get("skip_invalid") != "" {
+		err := fmt.Errorf("%s and skip_invalid are not supported for CSV inserts", batchIDHeader)
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	mapping, err := gumshoe.ParseCSVMapping(r.URL.Query()["map"])
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	inserted, err := s.DB.InsertCSV(r.Body, mapping)
+	metrics.Count("insert.success", float64(inserted))
+	if err != nil {
+		WriteError(w, fmt.Errorf("error after inserting %d rows: %s", inserted, err), http.StatusBadRequest)
+		metrics.Inc("insert.csv.failure")
+		return
+	}
+	WriteJSONResponse(w, map[string]int{"inserted": inserted})
+}
+
+// InsertResponse is the response to an insert with skip_invalid=true, or to one with rows which were held
+// back by string_overflow = "promote".
+type InsertResponse struct {
+	Rejected []gumshoe.RowError `json:"rejected"` // The invalid rows, which were not inserted
+	// The rows which were held back until a full string column is widened when the server is next restarted.
+	// Queries don't see them until then.
+	Held      int  `json:"held,omitempty"`
+	Duplicate bool `json:"duplicate,omitempty"` // Nothing was inserted because of the batch ID
+}
+
+// insertBacklogFull reports whether the DB's backlog of unflushed rows has reached either of the configured
+// high-water marks.
+func (s *Server) insertBacklogFull() bool {
+	rows, bytes := s.DB.GetInsertBacklog()
+	if max := s.Config.MaxPendingInsertRows; max > 0 && rows >= max {
+		return true
+	}
+	if max := s.Config.MaxPendingInsertBytes.Bytes; max > 0 && uint64(bytes) >= max {
+		return true
+	}
+	return false
+}
+
+// DeleteRowsRequest is the body of a request to delete rows (see DB.DeleteRows). Start and End are Unix times.
+type DeleteRowsRequest struct {
+	Filters    []gumshoe.QueryFilter
+	Start, End int64
+}
+
+// HandleDeleteRows deletes the rows matching the filters and time range in the request body (a
+// DeleteRowsRequest) and responds with the number of rows deleted.
+func (s *Server) HandleDeleteRows(w http.ResponseWriter, r *http.Request) {
+	var req DeleteRowsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	deleted, err := s.DB.DeleteRows(req.Filters, time.Unix(req.Start, 0), time.Unix(req.End, 0))
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	Log.Printf("Deleted %d rows", deleted)
+	metrics.Count("delete.rows", float64(deleted))
+	if s.queryCache != nil {
+		s.queryCache.removeStale(s.DB.GetIntervalGenerations())
+	}
+	WriteJSONResponse(w, map[string]int{"deleted": deleted})
+}
+
+// RetentionRequest is the body of a request to change the retention period (see DB.SetRetention).
+type RetentionRequest struct {
+	Days int
+}
+
+// HandleSetRetention changes the retention period to the number of days in the request body (a
+// RetentionRequest), dropping the data outside the new period right away. The period is saved with the DB, so
+// it replaces retention_days when the server is restarted.
+func (s *Server) HandleSetRetention(w http.ResponseWriter, r *http.Request) {
+	var req RetentionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if req.Days < 1 {
+		WriteError(w, fmt.Errorf("retention days is too small: %d", req.Days), http.StatusBadRequest)
+		return
+	}
+	if err := s.DB.SetRetention(time.Duration(req.Days) * 24 * time.Hour); err != nil {
+		WriteError(w, err, http.StatusInternalServerError)
+		return
+	}
+	Log.Printf("Set the retention period to %d days", req.Days)
+	if s.queryCache != nil {
+		s.queryCache.removeStale(s.DB.GetIntervalGenerations())
+	}
 }
 
 // HandleDebugRows responds to the client with a JSON representation of the physical rows. It returns up to
@@ -98,6 +349,29 @@ func (s *Server) HandleDebugRows(w http.ResponseWriter, r *http.Request) {
 	WriteJSONResponse(w, s.DB.GetDebugRows())
 }
 
+// HandleDebugQueries responds with the queries which are running or waiting to run, oldest first.
+func (s *Server) HandleDebugQueries(w http.ResponseWriter, r *http.Request) {
+	WriteJSONResponse(w, s.queries.list())
+}
+
+// HandleCancelQuery cancels the running queries with the given ID (as listed on /debug/queries).
+func (s *Server) HandleCancelQuery(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Query().Get(":id")
+	n := s.queries.cancel(id)
+	if n == 0 {
+		WriteError(w, fmt.Errorf("no query with ID %q is running", id), http.StatusNotFound)
+		return
+	}
+	Log.Printf("[%s] canceled %d running query(s)", id, n)
+	WriteJSONResponse(w, map[string]int{"canceled": n})
+}
+
+// HandleDebugSlowQueries responds with the most recent slow queries (see slow_query_threshold), newest
+// first.
+func (s *Server) HandleDebugSlowQueries(w http.ResponseWriter, r *http.Request) {
+	WriteJSONResponse(w, s.slowQueries.list())
+}
+
 // HandleDimensionTables responds with the JSON-formatted contents of all the dimension tables.
 func (s *Server) HandleDimensionTables(w http.ResponseWriter, r *http.Request) {
 	WriteJSONResponse(w, s.DB.GetDimensionTables())
@@ -118,54 +392,280 @@ func (s *Server) HandleSingleDimension(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "No such dimension: "+name, http.StatusBadRequest)
 }
 
+// HandlePutLookupTable registers a lookup table, given as a JSON object mapping grouping values to labels.
+func (s *Server) HandlePutLookupTable(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	var values map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&values); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := s.DB.RegisterLookupTable(name, values); err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	Log.Printf("Registered lookup table %q with %d values", name, len(values))
+}
+
+// HandleGetLookupTable responds with the contents of a lookup table.
+func (s *Server) HandleGetLookupTable(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Query().Get(":name")
+	table := s.DB.GetLookupTable(name)
+	if table == nil {
+		http.Error(w, "No such lookup table: "+name, http.StatusNotFound)
+		return
+	}
+	WriteJSONResponse(w, table.Values)
+}
+
+// parseQuery parses the query of a request: the body of a POST, or the q parameter of a GET (which makes
+// query results linkable and cacheable).
+func parseQuery(r *http.Request) (*gumshoe.Query, error) {
+	if r.Method != "GET" {
+		return gumshoe.ParseJSONQuery(r.Body)
+	}
+	q := r.URL.Query().Get("q")
+	if q == "" {
+		return nil, errors.New("a GET query must give the query JSON in the q parameter")
+	}
+	return gumshoe.ParseJSONQuery(strings.NewReader(q))
+}
+
+// HandleExplainQuery responds with the plan for a query (which intervals would be scanned, which filters would
+// be applied, and so on) without running it.
+func (s *Server) HandleExplainQuery(w http.ResponseWriter, r *http.Request) {
+	query, err := parseQuery(r)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	plan, err := s.DB.GetQueryPlan(query)
+	if err != nil {
+		WriteError(w, err, http.StatusBadRequest)
+		return
+	}
+	WriteJSONResponse(w, plan)
+}
+
+// compressed gzips the responses of h for clients which accept gzip, except for streamed query results (for
+// the router), which are compressed only with gzip_query_streams.
+func compressed(h http.HandlerFunc) http.HandlerFunc {
+	gzipped := gzipbody.NewResponseHandler(h)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("format") == "stream" {
+			h(w, r)
+			return
+		}
+		gzipped.ServeHTTP(w, r)
+	}
+}
+
+// queryDeadline returns the deadline for a query received at start: the sooner of the configured timeout and
+// the deadline given by a router, if any. Routers which predate queryDeadlineHeader give the time remaining
+// instead. It returns the zero Time if there is no deadline.
+func (s *Server) queryDeadline(r *http.Request, start time.Time) (time.Time, error) {
+	var deadline time.Time
+	if timeout := s.Config.QueryTimeout.Duration; timeout > 0 {
+		deadline = start.Add(timeout)
+	}
+	var routerDeadline time.Time
+	if header := r.Header.Get(queryDeadlineHeader); header != "" {
+		t, err := time.Parse(time.RFC3339Nano, header)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad %s header: %s", queryDeadlineHeader, err)
+		}
+		routerDeadline = t
+	} else if header := r.Header.Get(queryTimeoutHeader); header != "" {
+		timeout, err := time.ParseDuration(header)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("bad %s header: %s", queryTimeoutHeader, err)
+		}
+		routerDeadline = start.Add(timeout)
+	}
+	if !routerDeadline.IsZero() && (deadline.IsZero() || routerDeadline.Before(deadline)) {
+		deadline = routerDeadline
+	}
+	return deadline, nil
+}
+
 // HandleQuery evaluates a query and returns an aggregated result set.
-// See the README for the query JSON structure and the structure of the results.
+// See the README for the query JSON structure and the structure of the results. The results are JSON unless
+// the format parameter is "csv", "tsv", or "arrow" (or "stream", which is used by the router).
 func (s *Server) HandleQuery(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
-	query, err := gumshoe.ParseJSONQuery(r.Body)
+	queryID := r.Header.Get(queryIDHeader)
+	if queryID == "" {
+		queryID = randomID()
+	}
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "json", "stream", "arrow":
+	default:
+		if _, _, ok := gumshoe.DelimitedFormat(format); !ok {
+			writeQueryError(w, queryID, fmt.Errorf("unknown query format %q", format), http.StatusBadRequest)
+			return
+		}
+	}
+	query, err := parseQuery(r)
 	if err != nil {
-		WriteError(w, err, http.StatusBadRequest)
+		writeQueryError(w, queryID, err, http.StatusBadRequest)
 		return
 	}
-	rows, err := s.DB.GetQueryResult(query)
+	// The query is aborted if the client goes away or it runs past the timeout. A router passes along its own
+	// deadline, which overrides the configured timeout if it is sooner.
+	ctx := r.Context()
+	deadline, err := s.queryDeadline(r, start)
 	if err != nil {
-		WriteError(w, err, http.StatusBadRequest)
+		writeQueryError(w, queryID, err, http.StatusBadRequest)
+		return
+	}
+	if !deadline.IsZero() {
+		// There's no use starting a query whose results the router has already given up on.
+		if !start.Before(deadline) {
+			metrics.Inc("query.expired")
+			writeQueryError(w, queryID, errors.New("the query's deadline passed before it could run"),
+				http.StatusGatewayTimeout)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	admission := s.admission
+	priority := r.Header.Get(queryPriorityHeader)
+	switch priority {
+	case "":
+		priority = "interactive"
+	case "interactive":
+	case "batch":
+		admission = s.batchAdmission
+	default:
+		writeQueryError(w, queryID, fmt.Errorf("bad %s header: %q", queryPriorityHeader, priority),
+			http.StatusBadRequest)
+		return
+	}
+	ctx, done := s.queries.add(ctx, queryID, priority, query)
+	defer done()
+	if !admission.acquire(ctx) {
+		if ctx.Err() == context.Canceled {
+			writeQueryCanceledError(w, queryID)
+			return
+		}
+		if ctx.Err() == context.DeadlineExceeded {
+			writeQueryError(w, queryID, fmt.Errorf("query timed out waiting to run after %s", time.Since(start)),
+				http.StatusGatewayTimeout)
+			return
+		}
+		metrics.Inc("query.rejected")
+		w.Header().Set("Retry-After", "1")
+		writeQueryError(w, queryID, errors.New("too many queries; try again later"), http.StatusServiceUnavailable)
+		return
+	}
+	defer admission.release()
+	// The streaming format is used for merging results in the router, so it needs sketches rather than final
+	// estimates for any approximate aggregates.
+	stream := format == "stream"
+	rows, err := s.runQuery(ctx, query, stream)
+	switch {
+	case err == context.Canceled:
+		writeQueryCanceledError(w, queryID)
+		return
+	case err == context.DeadlineExceeded:
+		writeQueryError(w, queryID, fmt.Errorf("query timed out after %s", time.Since(start)),
+			http.StatusGatewayTimeout)
+		return
+	case err != nil:
+		writeQueryError(w, queryID, err, http.StatusBadRequest)
 		return
 	}
 	elapsed := time.Since(start)
-	statsd.Time("gumshoedb.query", elapsed)
+	metrics.Time("query", elapsed)
+	metrics.Time("query."+priority, elapsed)
 	durationMS := int(elapsed.Seconds() * 1000)
-	if r.URL.Query().Get("format") == "stream" {
+	Log.Printf("[%s] query returned %d rows in %s", queryID, len(rows), elapsed)
+	if threshold := s.Config.SlowQueryThreshold.Duration; threshold > 0 && elapsed >= threshold {
+		s.logSlowQuery(queryID, priority, start, elapsed, query, len(rows))
+	}
+	if stream {
 		// Streaming format:
 		// Header object: {"duration_ms": 123, "num_results", 234}
 		// Then num_rows row objects.
+		// These are JSON unless the router asks for the binary form (see gumshoe.BinaryStreamContentType).
+		// With sorted=true, the rows are sorted by the query's grouping.
+		if r.URL.Query().Get("sorted") == "true" {
+			gumshoe.SortRowsByGrouping(rows, query)
+			w.Header().Set(sortedStreamHeader, "true")
+		}
 		header := map[string]int{
 			"duration_ms": durationMS,
 			"num_rows":    len(rows),
 		}
-		w.Header().Set("Content-Type", "application/json")
-		encoder := json.NewEncoder(w)
+		var out io.Writer = w
+		flush := func() {
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
+		}
+		if s.Config.GzipQueryStreams && gzipbody.AcceptsGzip(r) {
+			w.Header().Set("Content-Encoding", "gzip")
+			// Speed matters more than size here: the router is waiting for the rows.
+			gz, _ := gzip.NewWriterLevel(w, gzip.BestSpeed)
+			defer gz.Close()
+			out = gz
+			flushResponse := flush
+			flush = func() {
+				gz.Flush()
+				flushResponse()
+			}
+		}
+		var encoder interface {
+			Encode(interface{}) error
+		}
+		if r.Header.Get("Accept") == gumshoe.BinaryStreamContentType {
+			w.Header().Set("Content-Type", gumshoe.BinaryStreamContentType)
+			encoder = gob.NewEncoder(out)
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+			encoder = json.NewEncoder(out)
+		}
 		if err := encoder.Encode(header); err != nil {
-			WriteError(w, err, 500)
+			writeQueryError(w, queryID, err, 500)
 			return
 		}
 		for i, row := range rows {
 			if err := encoder.Encode(row); err != nil {
-				WriteError(w, err, 500)
+				writeQueryError(w, queryID, err, 500)
 				return
 			}
 			if i%1000 == 0 {
-				if f, ok := w.(http.Flusher); ok {
-					f.Flush()
-				}
+				flush()
 			}
 		}
 		return
 	}
+	if format == "arrow" {
+		w.Header().Set("Content-Type", gumshoe.ArrowStreamContentType)
+		if err := s.DB.WriteArrowRows(w, rows, query); err != nil {
+			Log.Printf("[%s] error writing arrow results: %s", queryID, err)
+		}
+		return
+	}
+	if comma, contentType, ok := gumshoe.DelimitedFormat(format); ok {
+		w.Header().Set("Content-Type", contentType)
+		if err := gumshoe.WriteDelimitedRows(w, rows, query.ResultColumns(), comma); err != nil {
+			// The response has already started, so there's no way to report the error to the client.
+			Log.Printf("[%s] error writing %s results: %s", queryID, format, err)
+		}
+		return
+	}
 	results := map[string]interface{}{
 		"results":     rows,
 		"duration_ms": durationMS,
 	}
+	if stride := query.SampleStride(); stride > 1 {
+		// Mark the results as approximate.
+		results["sample_rate"] = 1 / float64(stride)
+	}
 	WriteJSONResponse(w, results)
 }
 
@@ -182,6 +682,12 @@ func (s *Server) HandleMetricz(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// HandleSchema responds with the DB's schema (its columns, segment size, and interval duration), so that the
+// router can check that the shards' schemas match its own.
+func (s *Server) HandleSchema(w http.ResponseWriter, r *http.Request) {
+	WriteJSONResponse(w, s.DB.Schema)
+}
+
 func (s *Server) HandleRoot(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("Gumshoe is on the case!"))
 }
@@ -190,10 +696,28 @@ type Statusz struct {
 	// Unix times, nullable
 	LastUpdated    *int64
 	OldestInterval *int64
+
+	Admission      AdmissionStats // Interactive queries
+	BatchAdmission AdmissionStats
+
+	// Inserted rows which have not been flushed yet (see max_pending_insert_rows and max_pending_insert_bytes)
+	PendingInsertRows  int
+	PendingInsertBytes int
+	// Inserted rows held back until a full string column is widened at the next restart (string_overflow =
+	// "promote"), which queries don't see yet
+	HeldInsertRows int `json:",omitempty"`
+
+	InsertRateLimits []InsertRateLimitStats `json:",omitempty"` // By client
 }
 
 func (s *Server) HandleStatusz(w http.ResponseWriter, r *http.Request) {
-	var statusz Statusz
+	statusz := Statusz{
+		Admission:      s.admission.stats(),
+		BatchAdmission: s.batchAdmission.stats(),
+	}
+	statusz.PendingInsertRows, statusz.PendingInsertBytes = s.DB.GetInsertBacklog()
+	statusz.HeldInsertRows = s.DB.GetHeldRows()
+	statusz.InsertRateLimits = s.insertLimiter.stats()
 	latestTimestamp := s.DB.GetLatestTimestamp()
 	lastUpdated := latestTimestamp.Unix()
 	if !latestTimestamp.IsZero() {
@@ -207,37 +731,163 @@ func (s *Server) HandleStatusz(w http.ResponseWriter, r *http.Request) {
 	WriteJSONResponse(w, statusz)
 }
 
+// runQuery runs query against the DB, using the query cache if possible.
+func (s *Server) runQuery(ctx context.Context, query *gumshoe.Query, stream bool) ([]gumshoe.RowMap, error) {
+	if s.queryCache == nil {
+		if stream {
+			return s.DB.GetQueryResultSketches(ctx, query)
+		}
+		return s.DB.GetQueryResult(ctx, query)
+	}
+
+	lookupTables, err := s.DB.GetQueryLookupTables(query)
+	if err != nil {
+		return nil, err
+	}
+	// Plan and run the query using the same StaticTable so that the cache key matches the data scanned.
+	resp := s.DB.MakeRequest()
+	defer resp.Done()
+	plan, err := resp.StaticTable.ExplainQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	key := queryCacheKey(query, stream, plan, lookupTables)
+	if rows, ok := s.queryCache.get(key); ok {
+		metrics.Inc("query.cache.hit")
+		return rows, nil
+	}
+	metrics.Inc("query.cache.miss")
+	var rows []gumshoe.RowMap
+	if stream {
+		rows, err = resp.StaticTable.InvokeQuerySketches(ctx, query)
+	} else {
+		rows, err = resp.StaticTable.InvokeQuery(ctx, query)
+	}
+	if err != nil {
+		return nil, err
+	}
+	gumshoe.ApplyLookups(rows, query, lookupTables)
+	s.queryCache.add(key, plan, rows)
+	return rows, nil
+}
+
 // NewServer initializes a Server with a DB and sets up its routes.
+// NewServer returns a Server for the DB described by conf and schema, along with the DBs of conf's tables,
+// which are served under /tables/{name}/ with the same routes as the main DB. The API keys of conf apply to
+// every table.
 func NewServer(conf *config.Config, schema *gumshoe.Schema) *Server {
-	s := &Server{Config: conf}
+	s := newServer("", conf, schema)
+	tables, err := conf.LoadTables()
+	if err != nil {
+		Log.Fatal(err)
+	}
+	s.Tables = make(map[string]*Server)
+	for _, table := range tables {
+		Log.Printf("Loading table %q", table.Name)
+		s.Tables[table.Name] = newServer(table.Name, table.Config, table.Schema)
+	}
+	keys, err := conf.APIKeyRoles()
+	if err != nil {
+		Log.Fatal(err)
+	}
+	handler := auth.NewHandler(s.tablesHandler(s.Handler), conf.APIKeyHeader, keys, conf.AnonymousStatusz)
+	// gRPC calls are served as the equivalent HTTP requests, which are authenticated and measured as usual.
+	s.Handler = grpcHandler{metrics.NewHandler(handler), int64(conf.MaxDecompressedBodySize.Bytes)}
+	return s
+}
+
+// newServer returns a Server for a single DB, without authentication.
+func newServer(name string, conf *config.Config, schema *gumshoe.Schema) *Server {
+	s := &Server{
+		Name:                 name,
+		Config:               conf,
+		admission:            newAdmissionController(conf.MaxConcurrentQueries, conf.QueryQueueSize),
+		batchAdmission:       newAdmissionController(conf.MaxConcurrentBatchQueries, conf.BatchQueryQueueSize),
+		queries:              newQueryTracker(),
+		slowQueries:          newSlowQueryLog(conf.SlowQueryLogSize),
+		flushIntervalChanged: make(chan struct{}, 1),
+	}
+	if conf.QueryCacheSize > 0 {
+		s.queryCache = newQueryCache(conf.QueryCacheSize)
+	}
+	s.insertLimiter = newInsertRateLimiter(conf.InsertRateLimit, conf.InsertRateBurst,
+		conf.InsertRateLimitHeader)
+	s.setFlushInterval(conf.FlushInterval.Duration)
 	s.loadDB(schema)
 
 	mux := pat.New()
 
-	mux.Put("/insert", s.HandleInsert)
-	mux.Get("/dimension_tables/{name}", s.HandleSingleDimension)
-	mux.Get("/dimension_tables", s.HandleDimensionTables)
-	mux.Post("/query", s.HandleQuery)
+	// A read-only DB has no routes which would change it.
+	if !schema.ReadOnly {
+		mux.Put("/insert", s.HandleInsert)
+		mux.Delete("/rows", s.HandleDeleteRows)
+		mux.Put("/lookup_tables/{name}", s.HandlePutLookupTable)
+		mux.Put("/admin/retention", s.HandleSetRetention)
+		rules, err := conf.RemoteWriteRules(schema)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		mux.Add("POST", "/prometheus/write", remotewrite.NewHandler(s.DB.Schema, rules,
+			http.HandlerFunc(s.HandleInsert)))
+		influxRules, err := conf.InfluxRules(schema)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		mux.Add("POST", "/write", remotewrite.NewInfluxHandler(s.DB.Schema, influxRules,
+			http.HandlerFunc(s.HandleInsert)))
+	}
+	// Reloading the config also reloads the tables' configs, so only the main DB has the route.
+	if name == "" {
+		mux.Post("/admin/reload", s.HandleReload)
+	}
+	mux.Get("/dimension_tables/{name}", compressed(s.HandleSingleDimension))
+	mux.Get("/dimension_tables", compressed(s.HandleDimensionTables))
+	mux.Get("/lookup_tables/{name}", s.HandleGetLookupTable)
+	mux.Get("/query/explain", s.HandleExplainQuery)
+	mux.Post("/query/explain", s.HandleExplainQuery)
+	mux.Get("/query", compressed(s.HandleQuery))
+	mux.Post("/query", compressed(s.HandleQuery))
+
+	grafanaHandler := grafana.NewHandler(&grafana.Source{
+		Schema:       s.DB.Schema,
+		QueryHandler: http.HandlerFunc(s.HandleQuery),
+		DimensionValues: func(column string) ([]string, error) {
+			return s.DB.GetDimensionTables()[column], nil
+		},
+	})
+	mux.Add("GET", "/grafana/", grafanaHandler)
+	mux.Add("POST", "/grafana/", grafanaHandler)
 
 	mux.Get("/metricz", s.HandleMetricz)
+	mux.Add("GET", "/metrics", metrics.Handler())
 	mux.Get("/debug/rows", s.HandleDebugRows)
+	mux.Get("/debug/queries", s.HandleDebugQueries)
+	mux.Post("/admin/queries/{id}/cancel", s.HandleCancelQuery)
+	mux.Get("/debug/slow_queries", s.HandleDebugSlowQueries)
 	mux.Get("/statusz", s.HandleStatusz)
+	mux.Get("/healthz", s.HandleHealthz)
+	mux.Get("/readyz", s.HandleReadyz)
+	mux.Get("/schema", s.HandleSchema)
 	mux.Get("/", s.HandleRoot)
 
-	s.Handler = mux
+	s.Handler = gzipbody.NewHandler(mux, int64(conf.MaxDecompressedBodySize.Bytes))
 
+	shutdownFlushes.Add(1)
 	go s.RunPeriodicFlushes()
 	go s.RunPeriodicStatsChecks()
+	if (len(schema.Rollups) > 0 || len(schema.DimensionRetention) > 0) && !schema.ReadOnly {
+		go s.RunPeriodicRollups()
+	}
 	return s
 }
 
-// loadDB opens the database if it exists, or else creates a new one.
+// loadDB opens the database if it exists, or else creates a new one (unless it's read-only).
 func (s *Server) loadDB(schema *gumshoe.Schema) {
 	dir := s.Config.DatabaseDir
 	Log.Printf(`Trying to load %q...`, dir)
 	db, err := gumshoe.OpenDB(schema)
 	if err != nil {
-		if err != gumshoe.DBDoesNotExistErr {
+		if err != gumshoe.DBDoesNotExistErr || schema.ReadOnly {
 			Log.Fatal(err)
 		}
 		Log.Printf(`Database %q does not exist; creating`, dir)
@@ -253,50 +903,135 @@ func (s *Server) loadDB(schema *gumshoe.Schema) {
 	s.DB = db
 }
 
+func (s *Server) getFlushInterval() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.flushInterval))
+}
+
+func (s *Server) setFlushInterval(interval time.Duration) {
+	atomic.StoreInt64(&s.flushInterval, int64(interval))
+}
+
 func (s *Server) RunPeriodicFlushes() {
-	timer := time.NewTimer(s.Config.FlushInterval.Duration)
+	timer := time.NewTimer(s.getFlushInterval())
+	atomic.StoreInt32(&s.state, stateReady)
 	for {
 		select {
 		case <-timer.C:
 			s.Flush()
-			timer.Reset(s.Config.FlushInterval.Duration)
+			timer.Reset(s.getFlushInterval())
+		case <-s.flushIntervalChanged:
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(s.getFlushInterval())
 		case <-shutdown:
+			atomic.StoreInt32(&s.state, stateShuttingDown)
 			s.Flush()
-			os.Exit(0)
+			shutdownFlushes.Done()
+			return
 		}
 	}
 }
 
 func (s *Server) RunPeriodicStatsChecks() {
+	// The gauges of a table are kept apart from the main DB's.
+	prefix := ""
+	if s.Name != "" {
+		prefix = "tables." + s.Name + "."
+	}
 	// NOTE(caleb): For now, hardcode the interval. We can adjust it or make it a configuration option later.
-	for range time.Tick(time.Minute) {
+	// The first check is immediate so that the gauges are set as soon as the server starts.
+	ticker := time.NewTicker(time.Minute)
+	for {
 		stats := s.DB.GetDebugStats()
-		statsd.Gauge("gumshoedb.static-table.intervals", float64(stats.Intervals))
-		statsd.Gauge("gumshoedb.static-table.segments", float64(stats.Segments))
-		statsd.Gauge("gumshoedb.static-table.rows", float64(stats.Rows))
-		statsd.Gauge("gumshoedb.static-table.bytes", float64(stats.Bytes))
-		statsd.Gauge("gumshoedb.static-table.compression-ratio", stats.CompressionRatio)
+		metrics.Gauge(prefix+"static-table.intervals", float64(stats.Intervals))
+		metrics.Gauge(prefix+"static-table.segments", float64(stats.Segments))
+		metrics.Gauge(prefix+"static-table.rows", float64(stats.Rows))
+		metrics.Gauge(prefix+"static-table.bytes", float64(stats.Bytes))
+		metrics.Gauge(prefix+"static-table.compression-ratio", stats.CompressionRatio)
+		rows, bytes := s.DB.GetInsertBacklog()
+		metrics.Gauge(prefix+"insert.pending-rows", float64(rows))
+		metrics.Gauge(prefix+"insert.pending-bytes", float64(bytes))
+		<-ticker.C
+	}
+}
+
+// tablesHandler serves GET /tables (the sorted list of table names) and passes requests under
+// /tables/{name}/ on to the table, with the prefix removed. Other requests go to h.
+func (s *Server) tablesHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/tables" && r.Method == "GET" {
+			names := []string{}
+			for name := range s.Tables {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			WriteJSONResponse(w, names)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/tables/") {
+			h.ServeHTTP(w, r)
+			return
+		}
+		name := strings.SplitN(r.URL.Path[len("/tables/"):], "/", 2)[0]
+		table, ok := s.Tables[name]
+		if !ok {
+			WriteError(w, fmt.Errorf("no such table: %q", name), http.StatusNotFound)
+			return
+		}
+		http.StripPrefix("/tables/"+name, table).ServeHTTP(w, r)
+	})
+}
+
+// RunPeriodicRollups rolls up old intervals (see gumshoe.RunConfig.Rollups and
+// gumshoe.RunConfig.DimensionRetention) every hour, which is often enough for rules measured in days.
+func (s *Server) RunPeriodicRollups() {
+	for range time.Tick(time.Hour) {
+		rolledUp, err := s.DB.Rollup()
+		if err != nil {
+			Log.Println("Error rolling up intervals:", err)
+			continue
+		}
+		metrics.Count("rollup.intervals", float64(rolledUp))
+		if rolledUp > 0 && s.queryCache != nil {
+			s.queryCache.removeStale(s.DB.GetIntervalGenerations())
+		}
 	}
 }
 
 func (s *Server) ListenAndServe() error {
-	Log.Println("Now serving on", s.Config.ListenAddr)
+	tlsConfig, err := s.Config.ServerTLSConfig()
+	if err != nil {
+		return err
+	}
 	server := &http.Server{
-		Addr:    s.Config.ListenAddr,
-		Handler: s,
+		Addr:      s.Config.ListenAddr,
+		Handler:   s,
+		TLSConfig: tlsConfig,
+		Protocols: new(http.Protocols),
 	}
+	// Routers using gRPC (see grpc.go) speak HTTP/2, which they negotiate over TLS or else use without it.
+	server.Protocols.SetHTTP1(true)
+	server.Protocols.SetHTTP2(true)
+	server.Protocols.SetUnencryptedHTTP2(true)
+	if tlsConfig != nil {
+		Log.Println("Now serving HTTPS on", s.Config.ListenAddr)
+		return server.ListenAndServeTLS("", "")
+	}
+	Log.Println("Now serving on", s.Config.ListenAddr)
 	return server.ListenAndServe()
 }
 
 func main() {
+	configOverrides = config.EnvOverrides()
+	flag.Var(configOverrides, "set", "Override a config value, as name=value (repeatable; see also "+
+		config.EnvPrefix+"* environment variables)")
 	flag.Parse()
 
-	f, err := os.Open(*configFile)
-	if err != nil {
-		Log.Fatal(err)
-	}
-	defer f.Close()
-	conf, schema, err := config.LoadTOMLConfig(f)
+	conf, schema, err := config.LoadConfig(*configFile, configOverrides)
 	if err != nil {
 		Log.Fatal(err)
 	}
@@ -308,12 +1043,15 @@ func main() {
 		Log.Println("Error raising RLIMIT_NOFILE:", err)
 	}
 
-	// Set up the pprof server, if enabled.
-	if *profileAddr != "" {
+	// Set up the debugging server (pprof, expvar, and goroutine dumps), if enabled.
+	if *debugAddr == "" {
+		*debugAddr = *profileAddr
+	}
+	if *debugAddr != "" {
 		go func() {
-			Log.Println("Pprof listening on", *profileAddr)
-			Log.Printf("Go to http://%s/debug/pprof to see more", *profileAddr)
-			Log.Fatal(http.ListenAndServe(*profileAddr, nil))
+			Log.Println("Debugging endpoints listening on", *debugAddr)
+			Log.Printf("Go to http://%s/debug/pprof to see more", *debugAddr)
+			Log.Fatal(debug.ListenAndServe(*debugAddr))
 		}()
 	}
 
@@ -321,8 +1059,7 @@ func main() {
 	gumshoe.Log = log.New(os.Stdout, "[gumshoe] ", logFlags)
 
 	// Configure the statsd client
-	statsd, err = gostc.NewClient(conf.StatsdAddr)
-	if err != nil {
+	if err := metrics.Init(conf.StatsdAddr); err != nil {
 		Log.Fatal(err)
 	}
 
@@ -332,8 +1069,33 @@ func main() {
 		signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
 		<-c
 		close(shutdown)
+		shutdownFlushes.Wait()
+		os.Exit(0)
 	}()
 
 	server := NewServer(conf, schema)
+
+	if conf.GraphiteAddr != "" {
+		rules, err := conf.GraphiteRules(schema)
+		if err != nil {
+			Log.Fatal(err)
+		}
+		go func() {
+			Log.Println("Listening for graphite metrics on", conf.GraphiteAddr)
+			Log.Fatal(server.ListenGraphite(conf.GraphiteAddr, rules))
+		}()
+	}
+
+	// SIGHUP reloads the config (like POST /admin/reload).
+	go func() {
+		c := make(chan os.Signal, 1)
+		signal.Notify(c, syscall.SIGHUP)
+		for range c {
+			if _, err := server.reload(*configFile); err != nil {
+				Log.Println("Error reloading the config:", err)
+			}
+		}
+	}()
+
 	Log.Fatal(server.ListenAndServe())
 }
@@ -1,23 +1,88 @@
 package main
 
 import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/philc/gumshoedb/gumshoe"
 	"github.com/philc/gumshoedb/internal/config"
+	"github.com/philc/gumshoedb/internal/util"
+
+	"github.com/philc/gumshoedb/internal/github.com/BurntSushi/toml"
+	"github.com/philc/gumshoedb/internal/github.com/go-yaml/yaml"
 )
 
-func TestSanity(t *testing.T) {
-	const configText = `
+const testConfigText = `
 listen_addr = ""
+tls_cert_file = ""
+tls_key_file = ""
+tls_client_ca_file = ""
+api_keys = []
+api_key_header = "X-API-Key"
+anonymous_statusz = true
+shard_api_key = ""
 database_dir = "MEMORY"
 flush_interval = "1h"
 statsd_addr = "localhost:8125"
 open_file_limit = 1000
 query_parallelism = 10
+query_timeout = "10s"
+query_cache_size = 100
+slow_query_threshold = "0s"
+slow_query_log_size = 10
+max_concurrent_queries = 4
+query_queue_size = 4
+max_concurrent_batch_queries = 1
+batch_query_queue_size = 4
+max_decompressed_body_size = "1MB"
+gzip_shard_inserts = false
+gzip_query_streams = true
+shard_grpc = false
+shard_tls = false
+shard_tls_ca_file = ""
+shard_tls_cert_file = ""
+shard_tls_key_file = ""
+max_pending_insert_rows = 0
+max_pending_insert_bytes = "0"
+insert_rate_limit = 0.0
+insert_rate_burst = 0
+insert_rate_limit_header = ""
 retention_days = 7
+ttl_column = ""
+late_arrival_window = "0s"
+string_overflow = "reject"
+compress_segments = false
+segment_verification = "open"
+segment_advice = "normal"
+mlock_window = "0s"
+direct_io = false
+cold_storage_dir = ""
+cold_storage_url = ""
+cold_after = "0s"
+cold_cache_size = "1GB"
+rollups = []
+dimension_retention = []
+views = []
+remote_write = []
+influx_write = []
+graphite_addr = ""
+graphite = []
+read_only = false
+tables = []
 
 [schema]
 segment_size = "1MB"
@@ -25,8 +90,12 @@ interval_duration = "1h"
 timestamp_column = ["at", "uint32"]
 dimension_columns = [["dim1", "uint32"]]
 metric_columns = [["metric1", "uint32"]]
-	`
-	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(configText))
+bloom_filter_columns = []
+dropped_columns = []
+`
+
+func TestSanity(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -42,3 +111,595 @@ metric_columns = [["metric1", "uint32"]]
 	}
 	resp.Body.Close()
 }
+
+func TestInsertsAreRejectedWhenBacklogIsFull(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.MaxPendingInsertRows = 1
+	s := NewServer(conf, schema)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	// The row must be within the retention period.
+	body := fmt.Sprintf(`[{"at": %d, "dim1": 1, "metric1": 1}]`, time.Now().Unix())
+	insert := func() *http.Response {
+		req, err := http.NewRequest("PUT", server.URL+"/insert", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+	if resp := insert(); resp.StatusCode != 200 {
+		t.Fatalf("got status %d for first insert; want 200", resp.StatusCode)
+	}
+	resp := insert()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %d with full backlog; want 429", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "3600" {
+		t.Errorf("got Retry-After %q; want 3600", got)
+	}
+
+	s.Flush()
+	if resp := insert(); resp.StatusCode != 200 {
+		t.Fatalf("got status %d after flush; want 200", resp.StatusCode)
+	}
+}
+
+func TestTables(t *testing.T) {
+	f, err := ioutil.TempFile("", "gumshoe-table-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(testConfigText); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	tables := fmt.Sprintf("\ntables = [[\"events\", %q]]", f.Name())
+	text := strings.Replace(testConfigText, "\ntables = []", tables, 1)
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewServer(conf, schema))
+	defer server.Close()
+
+	body := fmt.Sprintf(`[{"at": %d, "dim1": 1, "metric1": 1}]`, time.Now().Unix())
+	req, err := http.NewRequest("PUT", server.URL+"/tables/events/insert", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("got status %d for insert into table; want 200", resp.StatusCode)
+	}
+
+	for _, tt := range []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/tables", 200, `["events"]`},
+		{"/tables/events/statusz", 200, `"PendingInsertRows":1`},
+		{"/statusz", 200, `"PendingInsertRows":0`},
+		{"/tables/bogus/statusz", 404, "no such table"},
+	} {
+		resp, err := http.Get(server.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.wantStatus || !strings.Contains(string(b), tt.wantBody) {
+			t.Errorf("GET %s: got status %d and body %q; want status %d and body containing %q",
+				tt.path, resp.StatusCode, b, tt.wantStatus, tt.wantBody)
+		}
+	}
+}
+
+func TestQueryDeadline(t *testing.T) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	s := &Server{Config: &config.Config{}}
+	s.Config.QueryTimeout.Duration = time.Minute
+
+	for _, tt := range []struct {
+		header, value string
+		want          time.Time
+	}{
+		{"", "", start.Add(time.Minute)},
+		{queryDeadlineHeader, "2020-01-01T00:00:10Z", start.Add(10 * time.Second)},
+		{queryDeadlineHeader, "2020-01-01T00:05:00Z", start.Add(time.Minute)},
+		{queryTimeoutHeader, "5s", start.Add(5 * time.Second)},
+	} {
+		r := httptest.NewRequest("POST", "/query", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		got, err := s.queryDeadline(r, start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("%s: %q: got deadline %s; want %s", tt.header, tt.value, got, tt.want)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/query", nil)
+	r.Header.Set(queryDeadlineHeader, "soon")
+	if _, err := s.queryDeadline(r, start); err == nil {
+		t.Error("expected an error for a bad deadline")
+	}
+}
+
+func TestGzipQueryStreams(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewServer(conf, schema))
+	defer server.Close()
+
+	query := `{"aggregates": [{"type": "sum", "name": "metric1", "column": "metric1"}]}`
+	req, err := http.NewRequest("POST", server.URL+"/query?format=stream", strings.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Accept-Encoding", "gzip")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		t.Fatalf("got status %d; want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Encoding"); got != "gzip" {
+		t.Fatalf("got Content-Encoding %q; want gzip", got)
+	}
+	gz, err := gzip.NewReader(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"num_rows":1`) {
+		t.Errorf("got stream %q; want a header with num_rows 1", b)
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewServer(conf, schema))
+	defer server.Close()
+
+	for i := 0; i < 2; i++ {
+		resp, err := http.Get(server.URL + "/metrics")
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The first scrape is counted once it's done.
+		want := `gumshoedb_http_requests_total{route="/metrics",code="200"}`
+		if i == 1 && !strings.Contains(string(b), want) {
+			t.Errorf("metrics are missing %s:\n%s", want, b)
+		}
+	}
+}
+
+func TestQueryTracker(t *testing.T) {
+	tracker := newQueryTracker()
+	_, done1 := tracker.add(context.Background(), "abc", "interactive", nil)
+	ctx2, done2 := tracker.add(context.Background(), "def", "batch", nil)
+	if got := tracker.list(); len(got) != 2 || got[0].ID != "abc" || got[1].ID != "def" {
+		t.Fatalf("got running queries %+v; want abc and def", got)
+	}
+	if n := tracker.cancel("def"); n != 1 || ctx2.Err() != context.Canceled {
+		t.Fatalf("canceling def canceled %d queries (ctx err %v); want 1", n, ctx2.Err())
+	}
+	if n := tracker.cancel("xyz"); n != 0 {
+		t.Fatalf("canceling xyz canceled %d queries; want 0", n)
+	}
+	done1()
+	if got := tracker.list(); len(got) != 1 || got[0].ID != "def" {
+		t.Fatalf("got running queries %+v; want def", got)
+	}
+	done2()
+	if got := tracker.list(); len(got) != 0 {
+		t.Fatalf("got running queries %+v; want none", got)
+	}
+}
+
+func TestGetQuery(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(NewServer(conf, schema))
+	defer server.Close()
+
+	query := `{"aggregates": [{"type": "sum", "name": "metric1", "column": "metric1"}]}`
+	for _, tt := range []struct {
+		path       string
+		wantStatus int
+		wantBody   string
+	}{
+		{"/query?q=" + url.QueryEscape(query), 200, `"results":[{"metric1":0,"rowCount":0}]`},
+		{"/query?format=csv&q=" + url.QueryEscape(query), 200, "metric1,rowCount\n0,0\n"},
+		{"/query/explain?q=" + url.QueryEscape(query), 200, "{"},
+		{"/query", 400, "q parameter"},
+	} {
+		resp, err := http.Get(server.URL + tt.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.StatusCode != tt.wantStatus || !strings.Contains(string(b), tt.wantBody) {
+			t.Errorf("GET %s: got status %d and body %q; want status %d and body containing %q",
+				tt.path, resp.StatusCode, b, tt.wantStatus, tt.wantBody)
+		}
+	}
+}
+
+func TestGrafana(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(conf, schema)
+	server := httptest.NewServer(s)
+	defer server.Close()
+	// The rows must be within the retention period.
+	now := time.Now().Truncate(time.Hour)
+	rows := []gumshoe.RowMap{
+		{"at": float64(now.Add(-time.Hour).Unix()), "dim1": 1.0, "metric1": 2.0},
+		{"at": float64(now.Unix()), "dim1": 1.0, "metric1": 3.0},
+	}
+	if err := s.DB.Insert(rows); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DB.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := fmt.Sprintf(`{"range": {"from": %q, "to": %q}, "intervalMs": 60000, `+
+		`"targets": [{"target": "metric1"}]}`,
+		now.Add(-time.Hour).Format(time.RFC3339), now.Add(time.Hour).Format(time.RFC3339))
+	resp, err := http.Post(server.URL+"/grafana/query", "application/json", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var series []struct {
+		Target     string
+		Datapoints [][2]float64
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&series); err != nil {
+		t.Fatal(err)
+	}
+	ms := float64(now.Unix() * 1000)
+	want := [][2]float64{{2, ms - 3600*1000}, {3, ms}}
+	if len(series) != 1 || !reflect.DeepEqual(series[0].Datapoints, want) {
+		t.Errorf("got series %+v; want metric1 with datapoints %v", series, want)
+	}
+}
+
+func TestGraphite(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.Graphite = [][]string{{"servers.{dim1}.*", "metric1"}}
+	rules, err := conf.GraphiteRules(schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(conf, schema)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go s.serveGraphite(ln, rules)
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rows must be within the retention period.
+	now := time.Now().Unix()
+	fmt.Fprintf(conn, "servers.3.requests 2 %d\nservers.3.errors 1 %d\nbogus\nother.metric 1\n", now, now)
+	conn.Close()
+
+	query, err := gumshoe.ParseJSONQuery(strings.NewReader(`{` +
+		`"aggregates": [{"type": "sum", "name": "metric1", "column": "metric1"}], ` +
+		`"groupings": [{"name": "dim1", "column": "dim1"}]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The rows are inserted in the background, once a second.
+	want := []gumshoe.RowMap{{"dim1": 3, "metric1": 3, "rowCount": 2}}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		s.Flush()
+		rows, err := s.runQuery(context.Background(), query, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, _ := util.DeepConvertibleEquals(rows, want); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %v; want %v", rows, want)
+		}
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(conf, schema)
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	status := func(path string) int {
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := status("/healthz"); got != 200 {
+		t.Errorf("got status %d for /healthz; want 200", got)
+	}
+	// The server becomes ready once its flushes are scheduled, which happens in the background.
+	for i := 0; status("/readyz") != 200; i++ {
+		if i == 100 {
+			t.Fatal("the server never became ready")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	atomic.StoreInt32(&s.state, stateShuttingDown)
+	if got := status("/readyz"); got != http.StatusServiceUnavailable {
+		t.Errorf("got status %d for /readyz while shutting down; want 503", got)
+	}
+}
+
+func TestSlowQueryLog(t *testing.T) {
+	l := newSlowQueryLog(2)
+	for _, id := range []string{"a", "b", "c"} {
+		l.add(&SlowQuery{ID: id})
+	}
+	if got := l.list(); len(got) != 2 || got[0].ID != "c" || got[1].ID != "b" {
+		t.Fatalf("got slow queries %+v; want c and b", got)
+	}
+
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.SlowQueryThreshold.Duration = time.Nanosecond
+	server := httptest.NewServer(NewServer(conf, schema))
+	defer server.Close()
+	query := `{"aggregates": [{"type": "sum", "name": "metric1", "column": "metric1"}]}`
+	resp, err := http.Post(server.URL+"/query", "application/json", strings.NewReader(query))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	resp, err = http.Get(server.URL + "/debug/slow_queries")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var slow []SlowQuery
+	if err := json.NewDecoder(resp.Body).Decode(&slow); err != nil {
+		t.Fatal(err)
+	}
+	if len(slow) != 1 || slow[0].NumRows != 1 || slow[0].Plan == nil {
+		t.Errorf("got slow queries %+v; want the query with 1 row and its plan", slow)
+	}
+}
+
+func TestReload(t *testing.T) {
+	conf, schema, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer(conf, schema)
+
+	f, err := ioutil.TempFile("", "gumshoe-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	text := strings.NewReplacer(
+		`flush_interval = "1h"`, `flush_interval = "2h"`,
+		"retention_days = 7", "retention_days = 3",
+		"query_parallelism = 10", "query_parallelism = 2",
+		"insert_rate_limit = 0.0", "insert_rate_limit = 5.0",
+		"insert_rate_burst = 0", "insert_rate_burst = 10",
+		"open_file_limit = 1000", "open_file_limit = 2000",
+	).Replace(testConfigText)
+	if _, err := f.WriteString(text); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	changes, err := s.reload(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The open file limit needs a restart.
+	if len(changes) != 4 {
+		t.Errorf("got changes %q; want 4", changes)
+	}
+	if got := s.getFlushInterval(); got != 2*time.Hour {
+		t.Errorf("got flush interval %s; want 2h", got)
+	}
+	if s.insertLimiter.rate != 5 || s.insertLimiter.burst != 10 {
+		t.Errorf("got insert rate limit %g (burst %g); want 5 (burst 10)", s.insertLimiter.rate,
+			s.insertLimiter.burst)
+	}
+	if changes, err := s.reload(f.Name()); err != nil || len(changes) != 0 {
+		t.Errorf("reloading again: got changes %q and error %v; want no changes", changes, err)
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	overrides := config.Overrides{
+		"listen_addr":              ":9000",
+		"query_parallelism":        "3",
+		"flush_interval":           "5m",
+		"api_keys":                 `[["k", "read"]]`,
+		"schema.interval_duration": "2h",
+	}
+	if err := overrides.Set("retention_days=30"); err != nil {
+		t.Fatal(err)
+	}
+	conf, schema, err := config.LoadTOMLConfigWithOverrides(strings.NewReader(testConfigText), overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.ListenAddr != ":9000" || conf.QueryParallelism != 3 || conf.FlushInterval.Duration != 5*time.Minute {
+		t.Errorf("overrides weren't applied as expected: %+v", conf)
+	}
+	if len(conf.APIKeys) != 1 || conf.RetentionDays != 30 || conf.DatabaseDir != "MEMORY" {
+		t.Errorf("overrides weren't applied as expected: %+v", conf)
+	}
+	if schema.IntervalDuration != 2*time.Hour || conf.Schema.SegmentSize != "1MB" {
+		t.Errorf("got interval duration %s and segment size %s; want 2h and 1MB", schema.IntervalDuration,
+			conf.Schema.SegmentSize)
+	}
+
+	t.Setenv("GUMSHOE_DATABASE_DIR", "/data")
+	t.Setenv("GUMSHOE_SCHEMA_SEGMENT_SIZE", "2MB")
+	env := config.EnvOverrides()
+	if len(env) != 2 || env["database_dir"] != "/data" || env["schema.segment_size"] != "2MB" {
+		t.Errorf("got environment overrides %v; want database_dir and schema.segment_size", env)
+	}
+
+	for _, bad := range []config.Overrides{{"bogus": "1"}, {"query_parallelism": "many"}} {
+		if _, _, err := config.LoadTOMLConfigWithOverrides(strings.NewReader(testConfigText), bad); err == nil {
+			t.Errorf("expected an error for overrides %v", bad)
+		}
+	}
+}
+
+func TestJSONConfig(t *testing.T) {
+	want, _, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if _, err := toml.Decode(testConfigText, &fields); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gumshoe-json-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeConfig := func(name string) string {
+		b, err := json.Marshal(fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	overrides := config.Overrides{"query_parallelism": "3"}
+	conf, schema, err := config.LoadConfig(writeConfig("config.json"), overrides)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want.QueryParallelism = 3
+	if !reflect.DeepEqual(conf, want) {
+		t.Errorf("got JSON config %+v; want %+v", conf, want)
+	}
+	if schema.SegmentSize != 1000000 {
+		t.Errorf("got segment size %d; want 1MB", schema.SegmentSize)
+	}
+
+	delete(fields["schema"].(map[string]interface{}), "segment_size")
+	if _, _, err := config.LoadConfig(writeConfig("missing.json"), nil); err == nil {
+		t.Error("expected an error for a JSON config without schema.segment_size")
+	}
+}
+
+func TestYAMLConfig(t *testing.T) {
+	want, _, err := config.LoadTOMLConfig(strings.NewReader(testConfigText))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]interface{}
+	if _, err := toml.Decode(testConfigText, &fields); err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "gumshoe-yaml-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeConfig := func(name string, b []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	b, err := yaml.Marshal(fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"config.yaml", "config.yml"} {
+		conf, schema, err := config.LoadConfig(writeConfig(name, b), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(conf, want) {
+			t.Errorf("got YAML config %+v; want %+v", conf, want)
+		}
+		if schema.SegmentSize != 1000000 {
+			t.Errorf("got segment size %d; want 1MB", schema.SegmentSize)
+		}
+	}
+
+	if _, _, err := config.LoadConfig(writeConfig("list.yaml", []byte("- listen_addr\n")), nil); err == nil {
+		t.Error("expected an error for a YAML config which isn't a mapping")
+	}
+}
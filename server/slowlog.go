@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/philc/gumshoedb/gumshoe"
+	"github.com/philc/gumshoedb/internal/metrics"
+)
+
+// A SlowQuery is a query which took longer than the slow query threshold, as logged and listed on
+// /debug/slow_queries.
+type SlowQuery struct {
+	ID       string // As on /debug/queries
+	Priority string
+	Started  time.Time
+	Duration string
+	NumRows  int // The number of rows in the results
+	Query    *gumshoe.Query
+	// Plan is how the query would be run against the DB once it finished (so it may differ slightly from the
+	// scan, if the DB was flushed in the meantime). Only the scanned intervals are listed.
+	Plan *gumshoe.QueryPlan `json:",omitempty"`
+}
+
+// A slowQueryLog keeps the most recent slow queries.
+type slowQueryLog struct {
+	mu      sync.Mutex
+	queries []*SlowQuery // A ring buffer
+	next    int          // The index in queries of the next query to add
+	full    bool
+}
+
+func newSlowQueryLog(size int) *slowQueryLog {
+	return &slowQueryLog{queries: make([]*SlowQuery, size)}
+}
+
+// add records q, replacing the oldest query if the log is full.
+func (l *slowQueryLog) add(q *SlowQuery) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.queries) == 0 {
+		return
+	}
+	l.queries[l.next] = q
+	l.next = (l.next + 1) % len(l.queries)
+	if l.next == 0 {
+		l.full = true
+	}
+}
+
+// list returns the logged queries, newest first.
+func (l *slowQueryLog) list() []*SlowQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	n := l.next
+	if l.full {
+		n = len(l.queries)
+	}
+	queries := make([]*SlowQuery, n)
+	for i := range queries {
+		queries[i] = l.queries[(l.next-1-i+len(l.queries))%len(l.queries)]
+	}
+	return queries
+}
+
+// logSlowQuery logs a query which took longer than the slow query threshold, along with its plan, and adds it
+// to s.slowQueries.
+func (s *Server) logSlowQuery(queryID, priority string, start time.Time, elapsed time.Duration,
+	query *gumshoe.Query, numRows int) {
+	metrics.Inc("query.slow")
+	slow := &SlowQuery{
+		ID:       queryID,
+		Priority: priority,
+		Started:  start,
+		Duration: elapsed.String(),
+		NumRows:  numRows,
+		Query:    query,
+	}
+	if plan, err := s.DB.GetQueryPlan(query); err == nil {
+		scannedIntervals(plan)
+		slow.Plan = plan
+	}
+	b, err := json.Marshal(slow)
+	if err != nil {
+		Log.Printf("[%s] error logging slow query: %s", queryID, err)
+		return
+	}
+	Log.Printf("[%s] slow query: %s", queryID, b)
+	s.slowQueries.add(slow)
+}
+
+// scannedIntervals removes the intervals which weren't scanned from plan.
+func scannedIntervals(plan *gumshoe.QueryPlan) {
+	var intervals []*gumshoe.IntervalPlan
+	for _, interval := range plan.Intervals {
+		if interval.Scanned {
+			intervals = append(intervals, interval)
+		}
+	}
+	plan.Intervals = intervals
+}